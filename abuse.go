@@ -0,0 +1,287 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// A client with abuseThreshold failed requests within abuseWindow is
+	// banned
+	abuseThreshold = 20
+	abuseWindow    = 10 * time.Minute
+	// The first ban lasts banDuration, and each one after that lasts twice
+	// as long as the last, up to maxBanDuration
+	banDuration    = time.Minute
+	maxBanDuration = 24 * time.Hour
+	// strikeMemory is how long a client has to behave for before its next
+	// ban goes back to the shortest duration
+	strikeMemory = 2 * maxBanDuration
+	// abuseSweepInterval is how often records for clients that have been
+	// forgotten about are removed
+	abuseSweepInterval = 10 * time.Minute
+)
+
+// abuseRecord is what is known about the failures of one client
+type abuseRecord struct {
+	failures    []time.Time
+	strikes     int
+	bannedUntil time.Time
+	lastBan     time.Time
+	manual      bool
+}
+
+// banInfo describes a ban for the admin API
+type banInfo struct {
+	Subject string    `json:"subject"`
+	Until   time.Time `json:"until"`
+	Strikes int       `json:"strikes"`
+	// Manual is true for bans made through the admin API
+	Manual bool `json:"manual"`
+}
+
+// abuseTracker counts failed requests by client address and by user, and bans
+// the ones that look like they are guessing credentials, scanning for files or
+// repeatedly trying uploads that are too big
+type abuseTracker struct {
+	mu       sync.Mutex
+	subjects map[string]*abuseRecord
+}
+
+func newAbuseTracker() *abuseTracker {
+	return &abuseTracker{subjects: map[string]*abuseRecord{}}
+}
+
+// abuseSubjects returns the names a request is tracked under, its address and
+// its user if it has one
+func abuseSubjects(r *http.Request) []string {
+	subjects := []string{"ip:" + requestIP(r)}
+	if id := requestIdentity(r); id != anonymous {
+		subjects = append(subjects, "user:"+id)
+	}
+	return subjects
+}
+
+// abusive says whether a response status counts towards a ban
+func abusive(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusRequestEntityTooLarge:
+		return true
+	default:
+		return false
+	}
+}
+
+// banned returns when the ban on any of the subjects ends, or false if none
+// of them are banned
+func (a *abuseTracker) banned(subjects []string, now time.Time) (time.Time, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var until time.Time
+	for _, subject := range subjects {
+		if rec, ok := a.subjects[subject]; ok && rec.bannedUntil.After(now) && rec.bannedUntil.After(until) {
+			until = rec.bannedUntil
+		}
+	}
+
+	return until, !until.IsZero()
+}
+
+// fail records a failed request, banning the subject if it has failed too
+// often
+func (a *abuseTracker) fail(subject string, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec, ok := a.subjects[subject]
+	if !ok {
+		rec = &abuseRecord{}
+		a.subjects[subject] = rec
+	}
+
+	recent := rec.failures[:0]
+	for _, t := range rec.failures {
+		if now.Sub(t) < abuseWindow {
+			recent = append(recent, t)
+		}
+	}
+	rec.failures = append(recent, now)
+
+	if len(rec.failures) < abuseThreshold {
+		return
+	}
+
+	if now.Sub(rec.lastBan) > strikeMemory {
+		rec.strikes = 0
+	}
+	rec.strikes++
+
+	d := maxBanDuration
+	if rec.strikes < 32 {
+		d = min(banDuration<<(rec.strikes-1), maxBanDuration)
+	}
+	rec.bannedUntil = now.Add(d)
+	rec.lastBan = now
+	rec.manual = false
+	rec.failures = nil
+}
+
+// ban bans a subject for d, it's used by the admin API
+func (a *abuseTracker) ban(subject string, now time.Time, d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec, ok := a.subjects[subject]
+	if !ok {
+		rec = &abuseRecord{}
+		a.subjects[subject] = rec
+	}
+	rec.bannedUntil = now.Add(d)
+	rec.lastBan = now
+	rec.manual = true
+}
+
+// unban lifts a ban and forgets the subject's history, it returns false if
+// nothing was known about the subject
+func (a *abuseTracker) unban(subject string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.subjects[subject]
+	delete(a.subjects, subject)
+	return ok
+}
+
+// bans lists the bans in force, sorted by subject
+func (a *abuseTracker) bans(now time.Time) []banInfo {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	bans := []banInfo{}
+	for subject, rec := range a.subjects {
+		if rec.bannedUntil.After(now) {
+			bans = append(bans, banInfo{Subject: subject, Until: rec.bannedUntil, Strikes: rec.strikes, Manual: rec.manual})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Subject < bans[j].Subject })
+
+	return bans
+}
+
+// sweep forgets subjects with no recent failures and no ban to remember
+func (a *abuseTracker) sweep(_ context.Context, now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for subject, rec := range a.subjects {
+		recentFailure := len(rec.failures) > 0 && now.Sub(rec.failures[len(rec.failures)-1]) < abuseWindow
+		if !recentFailure && !rec.bannedUntil.After(now) && now.Sub(rec.lastBan) > strikeMemory {
+			delete(a.subjects, subject)
+		}
+	}
+}
+
+// statusWriter remembers the status of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withAbuseDetection turns away banned clients and counts failed requests
+// towards bans. Banned clients can't use the ban admin API either, or they
+// could lift their own ban, so an admin who's banned has to lift it from
+// somewhere else.
+func withAbuseDetection(next http.Handler, abuse *abuseTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subjects := abuseSubjects(r)
+		if until, ok := abuse.banned(subjects, time.Now()); ok {
+			refuseBanned(w, until)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		if abusive(sw.status) {
+			for _, subject := range subjects {
+				abuse.fail(subject, time.Now())
+			}
+		}
+	})
+}
+
+// refuseBanned turns away a client that is banned until then
+func refuseBanned(w http.ResponseWriter, until time.Time) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+	w.WriteHeader(http.StatusForbidden)
+}
+
+// handleGetBans lists the clients that are banned
+func (s server) handleGetBans(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.abuse.bans(time.Now()))
+}
+
+// banRequest is the body for a manual ban
+type banRequest struct {
+	Subject  string `json:"subject"`
+	Duration string `json:"duration"`
+}
+
+// handlePostBan bans a client by hand, the subject is ip:<address> or
+// user:<name>
+func (s server) handlePostBan(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req banRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	d, err := time.ParseDuration(req.Duration)
+	if err != nil || d <= 0 || !(strings.HasPrefix(req.Subject, "ip:") || strings.HasPrefix(req.Subject, "user:")) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.abuse.ban(req.Subject, time.Now(), d)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeleteBan lifts a ban
+func (s server) handleDeleteBan(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.abuse.unban(ps.ByName("subject")) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
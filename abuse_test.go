@@ -0,0 +1,137 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbuseTrackerBanDurations(t *testing.T) {
+	a := newAbuseTracker()
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	failMany := func() {
+		for i := 0; i < abuseThreshold; i++ {
+			a.fail("ip:192.0.2.1", now)
+		}
+	}
+
+	// Failures spread out over more than the window don't add up to a ban
+	for i := 0; i < abuseThreshold; i++ {
+		a.fail("ip:192.0.2.1", now.Add(time.Duration(i)*abuseWindow))
+	}
+	now = now.Add(abuseThreshold * abuseWindow)
+	_, banned := a.banned([]string{"ip:192.0.2.1"}, now)
+	require.False(t, banned)
+
+	// Each ban is twice as long as the last
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		failMany()
+		until, banned := a.banned([]string{"ip:192.0.2.1", "user:alice"}, now)
+		require.True(t, banned)
+		require.Equal(t, now.Add(want), until)
+		now = until
+	}
+
+	// After behaving for long enough the next ban is short again
+	now = now.Add(strikeMemory + time.Second)
+	failMany()
+	until, _ := a.banned([]string{"ip:192.0.2.1"}, now)
+	require.Equal(t, now.Add(banDuration), until)
+
+	// Bans are capped
+	for i := 0; i < 40; i++ {
+		now = until
+		failMany()
+		until, _ = a.banned([]string{"ip:192.0.2.1"}, now)
+	}
+	require.Equal(t, now.Add(maxBanDuration), until)
+}
+
+func TestAbuseTrackerSweep(t *testing.T) {
+	a := newAbuseTracker()
+	now := time.Now()
+
+	a.fail("ip:192.0.2.1", now)
+	a.ban("user:alice", now, time.Hour)
+
+	a.sweep(context.Background(), now.Add(abuseWindow))
+	require.Len(t, a.subjects, 1)
+
+	// The ban is remembered for longer, so the next one can be longer
+	a.sweep(context.Background(), now.Add(time.Hour+strikeMemory/2))
+	require.Len(t, a.subjects, 1)
+	a.sweep(context.Background(), now.Add(time.Hour+strikeMemory))
+	require.Empty(t, a.subjects)
+}
+
+func TestWithAbuseDetection(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	router := s.routes()
+
+	get := func(target, user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if user != "" {
+			req.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Scanning for files gets the client banned
+	for i := 0; i < abuseThreshold; i++ {
+		require.Equal(t, http.StatusNotFound, get("/file/guess"+strings.Repeat("x", i), "mallory").Result().StatusCode)
+	}
+	w := get("/version", "")
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+	require.NotEmpty(t, w.Result().Header.Get("Retry-After"))
+
+	// The banned client can't lift its own ban, even as an admin
+	req := newAdminRequest(http.MethodDelete, "/admin/bans/ip:192.0.2.1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// Admins elsewhere can
+	admin := func(method, target string, body io.Reader) *httptest.ResponseRecorder {
+		req := newAdminRequest(method, target, body)
+		req.RemoteAddr = "198.51.100.10:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w = admin(http.MethodGet, "/admin/bans", nil)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var bans []banInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&bans))
+	require.Len(t, bans, 2)
+	require.Equal(t, "ip:192.0.2.1", bans[0].Subject)
+	require.Equal(t, "user:mallory", bans[1].Subject)
+	require.Equal(t, 1, bans[0].Strikes)
+
+	// Lifting the ban on the address still leaves the user banned
+	w = admin(http.MethodDelete, "/admin/bans/ip:192.0.2.1", nil)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Equal(t, http.StatusOK, get("/version", "").Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, get("/version", "mallory").Result().StatusCode)
+
+	// Bans can be made by hand
+	w = admin(http.MethodPost, "/admin/bans", strings.NewReader(`{"subject":"user:eve","duration":"1h"}`))
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, get("/version", "eve").Result().StatusCode)
+
+	w = admin(http.MethodPost, "/admin/bans", strings.NewReader(`{"subject":"eve","duration":"1h"}`))
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	w = admin(http.MethodDelete, "/admin/bans/user:nobody", nil)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
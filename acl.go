@@ -0,0 +1,204 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// access is what a grant lets someone do with a file, write includes read
+type access string
+
+const (
+	accessRead  access = "read"
+	accessWrite access = "write"
+)
+
+// grant gives a user, or everyone in a group, access to a file
+type grant struct {
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Access access `json:"access"`
+}
+
+func (g grant) validate() error {
+	if (g.User == "") == (g.Group == "") {
+		return errors.New("a grant is for either a user or a group")
+	}
+	if g.Access != accessRead && g.Access != accessWrite {
+		return fmt.Errorf("unknown access %q, expected read or write", g.Access)
+	}
+	return nil
+}
+
+// fileACL is the ACL of a file as the API sends and receives it, the owner
+// can't be changed and neither can the grants inherited from a group
+type fileACL struct {
+	Owner     string  `json:"owner"`
+	Grants    []grant `json:"grants"`
+	Inherited []grant `json:"inherited,omitempty"`
+}
+
+// owner returns who can change the ACL of the file
+func (e catalogEntry) owner() string {
+	if e.Owner != "" {
+		return e.Owner
+	}
+	return e.UploadedBy
+}
+
+// allows says whether user, who is in groups, has access to the file. Files
+// without any grants are open to everyone, as they were before there were
+// ACLs, and the owner can always do anything.
+func (e catalogEntry) allows(user string, groups []string, want access) bool {
+	if len(e.ACL) == 0 || user == e.owner() {
+		return true
+	}
+
+	for _, g := range e.ACL {
+		if want == accessWrite && g.Access != accessWrite {
+			continue
+		}
+		if (g.User != "" && g.User == user) || (g.Group != "" && contains(groups, g.Group)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed says whether the request has access to the file, counting the
+// grants it inherits from a group's prefix and the groups the user has been
+// added to
+func (s server) allowed(r *http.Request, e catalogEntry, want access) bool {
+	e.ACL = append(s.inheritedACL(e.Name), e.ACL...)
+	return e.allows(requestIdentity(r), s.groupsOf(r), want)
+}
+
+// hasAccess says whether the request has access to the file. Files that
+// aren't in the catalog only have the ACL they'd inherit.
+func (s server) hasAccess(r *http.Request, filename string, want access) bool {
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		e = catalogEntry{Name: filename}
+	}
+	return s.allowed(r, e, want)
+}
+
+// internalObject says whether name is one of the objects the server keeps
+// for itself, like the catalog and thumbnails, which all start with a dot.
+// They're never in the catalog, so they'd otherwise be open to everyone.
+func internalObject(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// checkInternal responds with a 404 for the server's own objects, as if they
+// weren't there
+func checkInternal(w http.ResponseWriter, filename string) bool {
+	if !internalObject(filename) {
+		return true
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+	log.Printf("internal object: filename: %s", filename)
+	return false
+}
+
+// checkAccess responds with a 403 if the request doesn't have access to the
+// file, and a 404 for the server's own objects
+func (s server) checkAccess(w http.ResponseWriter, r *http.Request, filename string, want access) bool {
+	if !checkInternal(w, filename) {
+		return false
+	}
+	if s.hasAccess(r, filename, want) {
+		return true
+	}
+
+	w.WriteHeader(http.StatusForbidden)
+	log.Printf("access denied: filename: %s, user: %s, access: %s", filename, requestIdentity(r), want)
+	return false
+}
+
+// requireAccess only runs h if the request has access to the file in the
+// path
+func (s server) requireAccess(want access, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s.checkAccess(w, r, ps.ByName("filename"), want) {
+			h(w, r, ps)
+		}
+	}
+}
+
+// handleGetACL returns the owner of a file and who else has access to it
+func (s server) handleGetACL(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	e, ok := s.catalog.get(ps.ByName("filename"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	grants := e.ACL
+	if grants == nil {
+		grants = []grant{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileACL{Owner: e.owner(), Grants: grants, Inherited: s.inheritedACL(e.Name)})
+}
+
+// handlePutACL replaces the grants on a file, only its owner can. An empty
+// list opens the file up to everyone again.
+func (s server) handlePutACL(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req fileACL
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode acl:", err)
+		return
+	}
+	for _, g := range req.Grants {
+		if err := g.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("acl:", err)
+			return
+		}
+	}
+
+	filename := ps.ByName("filename")
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Anyone could claim files uploaded without an identity
+	user := requestIdentity(r)
+	if user != e.owner() || user == anonymous {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("acl: filename: %s, user: %s isn't the owner", filename, user)
+		return
+	}
+
+	e.Owner = e.owner()
+	e.ACL = nil
+	if len(req.Grants) > 0 {
+		e.ACL = req.Grants
+	}
+	s.catalog.put(e)
+	err = s.saveCatalog(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("save acl:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fileACL{Owner: e.Owner, Grants: append([]grant{}, e.ACL...), Inherited: s.inheritedACL(e.Name)})
+}
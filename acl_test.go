@@ -0,0 +1,125 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileACL(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(r *http.Request, user, groups string) *httptest.ResponseRecorder {
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		if groups != "" {
+			r.Header.Set(groupsHeader, groups)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	putACL := func(filename, user, body string) *httptest.ResponseRecorder {
+		return do(httptest.NewRequest(http.MethodPut, "/file/"+filename+"/acl", strings.NewReader(body)), user, "")
+	}
+	get := func(filename, user, groups string) int {
+		return do(httptest.NewRequest(http.MethodGet, "/file/"+filename, nil), user, groups).Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", "doc.txt", "test file contents"), "alice", "").Result().StatusCode)
+	require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", "anon.txt", "anonymous contents"), "", "").Result().StatusCode)
+
+	// Files start out open to everyone
+	require.Equal(t, http.StatusOK, get("doc.txt", "carol", ""))
+
+	grants := `{"grants": [{"user": "bob", "access": "read"}, {"group": "eng", "access": "write"}]}`
+	require.Equal(t, http.StatusForbidden, putACL("doc.txt", "bob", grants).Result().StatusCode, "only the owner can change the acl")
+	require.Equal(t, http.StatusForbidden, putACL("anon.txt", "", grants).Result().StatusCode, "anonymous files have no owner")
+	require.Equal(t, http.StatusBadRequest, putACL("doc.txt", "alice", `{"grants": [{"user": "bob", "group": "eng", "access": "read"}]}`).Result().StatusCode)
+	require.Equal(t, http.StatusBadRequest, putACL("doc.txt", "alice", `{"grants": [{"user": "bob", "access": "admin"}]}`).Result().StatusCode)
+
+	w := putACL("doc.txt", "alice", grants)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	want := fileACL{Owner: "alice", Grants: []grant{{User: "bob", Access: accessRead}, {Group: "eng", Access: accessWrite}}}
+	var got fileACL
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, want, got)
+
+	w = do(httptest.NewRequest(http.MethodGet, "/file/doc.txt/acl", nil), "bob", "")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, want, got)
+
+	t.Run("read", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, get("doc.txt", "alice", ""))
+		require.Equal(t, http.StatusOK, get("doc.txt", "bob", ""))
+		require.Equal(t, http.StatusOK, get("doc.txt", "dave", "ops, eng"))
+		require.Equal(t, http.StatusForbidden, get("doc.txt", "carol", "ops"))
+		require.Equal(t, http.StatusForbidden, get("doc.txt", "", ""))
+		require.Equal(t, http.StatusForbidden, do(httptest.NewRequest(http.MethodGet, "/content/"+testFileSHA256, nil), "carol", "").Result().StatusCode)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		var entries []catalogEntry
+		w := do(httptest.NewRequest(http.MethodGet, "/files", nil), "carol", "")
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&entries))
+		require.Len(t, entries, 1)
+		require.Equal(t, "anon.txt", entries[0].Name)
+	})
+
+	t.Run("write", func(t *testing.T) {
+		require.Equal(t, http.StatusForbidden, do(newUploadRequest(t, "/upload", "doc.txt", "new contents"), "bob", "").Result().StatusCode)
+		require.Equal(t, http.StatusForbidden, do(httptest.NewRequest(http.MethodDelete, "/file/doc.txt", nil), "bob", "").Result().StatusCode)
+
+		// A new version keeps the acl
+		require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", "doc.txt", "new contents"), "dave", "eng").Result().StatusCode)
+		e, ok := s.catalog.get("doc.txt")
+		require.True(t, ok)
+		require.Equal(t, "dave", e.UploadedBy)
+		require.Equal(t, "alice", e.owner())
+		require.Equal(t, want.Grants, e.ACL)
+		require.Equal(t, http.StatusForbidden, get("doc.txt", "carol", ""))
+	})
+
+	// No grants opens the file up again
+	require.Equal(t, http.StatusOK, putACL("doc.txt", "alice", `{"grants": []}`).Result().StatusCode)
+	require.Equal(t, http.StatusOK, get("doc.txt", "carol", ""))
+}
+
+func TestInternalObjectsHidden(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	s.catalog.put(catalogEntry{Name: "a.txt"})
+	require.NoError(t, s.saveCatalog(context.Background()))
+
+	for _, test := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/file/" + catalogObject, http.StatusNotFound},
+		{http.MethodHead, "/file/" + catalogObject, http.StatusNotFound},
+		{http.MethodDelete, "/file/" + catalogObject, http.StatusNotFound},
+		{http.MethodGet, "/file/" + catalogObject + "/meta", http.StatusNotFound},
+		{http.MethodGet, "/path/" + catalogObject, http.StatusBadRequest},
+		{http.MethodDelete, "/path/" + catalogObject, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(test.method, test.target, nil)
+		r.Header.Set("Range", "bytes=0-10")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, test.want, w.Result().StatusCode, test.method+" "+test.target)
+		require.Empty(t, w.Body.String())
+	}
+
+	_, err := store.StatObject(context.Background(), "testBucket", catalogObject)
+	require.NoError(t, err)
+}
@@ -0,0 +1,69 @@
+package filesrv
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// activeContentPolicy says how files a browser would run scripts in are
+// served
+type activeContentPolicy string
+
+const (
+	// activeContentAttachment always serves them as attachments, so a file
+	// uploaded by one user can't run scripts on the server's origin when
+	// another user opens it
+	activeContentAttachment activeContentPolicy = "attachment"
+	// activeContentInline serves them like every other file, for servers that
+	// only hold trusted content or are on an origin of their own
+	activeContentInline activeContentPolicy = "inline"
+)
+
+// activeContentTypes are the content types browsers run scripts in when
+// they're opened
+var activeContentTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/xsl",
+	"text/javascript",
+	"application/javascript",
+	"application/ecmascript",
+	"text/ecmascript",
+}
+
+// validate checks the policy is one there is
+func (p activeContentPolicy) validate() error {
+	if p != activeContentAttachment && p != activeContentInline {
+		return fmt.Errorf("unknown active content policy %q", p)
+	}
+	return nil
+}
+
+// isActiveContent says whether a browser would run scripts in a file with the
+// content type
+func isActiveContent(contentType string) bool {
+	for _, t := range activeContentTypes {
+		if contentTypeMatches(t, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// forcesAttachment says whether a file with the content type has to be
+// downloaded rather than opened, whatever the request or the file asks for
+func (p activeContentPolicy) forcesAttachment(contentType string) bool {
+	return p == activeContentAttachment && isActiveContent(contentType)
+}
+
+// setNoSniff stops browsers guessing a different content type from what the
+// file is served as, which is how a file that isn't active content would get
+// opened as if it was
+func (p activeContentPolicy) setNoSniff(h http.Header) {
+	if p == activeContentAttachment {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+}
@@ -0,0 +1,45 @@
+package filesrv
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// requireAdmin only runs h for users in the admin group. The group has to
+// come from whoever authenticated the request, being added to a group with
+// the group API doesn't count, and anonymous requests are never let in.
+// Without an admin group the admin API is turned off.
+func (s server) requireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user := requestIdentity(r)
+		if s.adminGroup == "" || user == anonymous || !contains(requestGroups(r), s.adminGroup) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Printf("admin access denied: user: %s, path: %s", user, r.URL.Path)
+			return
+		}
+
+		h(w, r, ps)
+	}
+}
+
+// requireWorker only runs h for users in the worker group or the admin group,
+// for the queue routes workers use. Like for requireAdmin the group has to
+// come from whoever authenticated the request.
+func (s server) requireWorker(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		user := requestIdentity(r)
+		groups := requestGroups(r)
+		member := func(group string) bool {
+			return group != "" && contains(groups, group)
+		}
+		if user == anonymous || !(member(s.workerGroup) || member(s.adminGroup)) {
+			w.WriteHeader(http.StatusForbidden)
+			log.Printf("worker access denied: user: %s, path: %s", user, r.URL.Path)
+			return
+		}
+
+		h(w, r, ps)
+	}
+}
@@ -0,0 +1,70 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newAdminRequest returns a request from a user in the admin group
+func newAdminRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set(identityHeader, "root")
+	req.Header.Set(groupsHeader, defaultConfig().AdminGroup)
+	return req
+}
+
+func TestRequireAdmin(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	var doc openAPIDocument
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&doc))
+
+	// Every admin route is gated, including ones added later
+	params := regexp.MustCompile(`\{[^}]*\}`)
+	var tried int
+	for path, operations := range doc.Paths {
+		if !strings.HasPrefix(path, "/admin/") {
+			continue
+		}
+		target := params.ReplaceAllString(path, "x")
+		for method := range operations {
+			for _, user := range []struct{ name, groups string }{{"", ""}, {"mallory", "users"}, {"", "admin"}} {
+				req := httptest.NewRequest(strings.ToUpper(method), target, strings.NewReader("{}"))
+				if user.name != "" {
+					req.Header.Set(identityHeader, user.name)
+				}
+				if user.groups != "" {
+					req.Header.Set(groupsHeader, user.groups)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				require.Equal(t, http.StatusForbidden, w.Code, "%s %s as %+v", method, target, user)
+			}
+			tried++
+		}
+	}
+	require.NotZero(t, tried)
+
+	// The requests above got their address banned
+	req := newAdminRequest(http.MethodGet, "/admin/bans", nil)
+	req.RemoteAddr = "198.51.100.10:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Without an admin group nobody can use it
+	s.adminGroup = ""
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Code)
+}
@@ -0,0 +1,211 @@
+package filesrv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxAnnotationText is the longest an annotation can be, in bytes
+	maxAnnotationText = 4 << 10
+	// maxAnnotations is the most annotations a file can have, they're kept
+	// in its catalog entry so they can't grow without bound
+	maxAnnotations = 1000
+)
+
+// annotation is a comment on a file, for reviewing shared files
+type annotation struct {
+	ID      string    `json:"id"`
+	Author  string    `json:"author"`
+	Text    string    `json:"text"`
+	Created time.Time `json:"created"`
+	// Updated is only set once the annotation has been edited
+	Updated *time.Time `json:"updated,omitempty"`
+}
+
+// annotationRequest is the body of a request to add or edit an annotation
+type annotationRequest struct {
+	Text string `json:"text"`
+}
+
+// readAnnotationRequest decodes the body of a request to add or edit an
+// annotation, it responds with a 400 and returns false if it's bad
+func readAnnotationRequest(w http.ResponseWriter, r *http.Request) (annotationRequest, bool) {
+	var req annotationRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode annotation:", err)
+		return annotationRequest{}, false
+	}
+
+	req.Text = strings.TrimSpace(req.Text)
+	if req.Text == "" || len(req.Text) > maxAnnotationText {
+		w.WriteHeader(http.StatusBadRequest)
+		return annotationRequest{}, false
+	}
+
+	return req, true
+}
+
+// handleGetAnnotations lists the annotations on a file, oldest first
+func (s server) handleGetAnnotations(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	e, ok := s.catalog.get(ps.ByName("filename"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	annotations := e.Annotations
+	if annotations == nil {
+		annotations = []annotation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(annotations)
+}
+
+// handlePostAnnotation adds an annotation to a file, by the user making the
+// request. Anyone who can read a file can annotate it.
+func (s server) handlePostAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req, ok := readAnnotationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("random id:", err)
+		return
+	}
+	a := annotation{
+		ID:      hex.EncodeToString(id),
+		Author:  requestIdentity(r),
+		Text:    req.Text,
+		Created: time.Now().UTC(),
+	}
+
+	filename := ps.ByName("filename")
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(e.Annotations) >= maxAnnotations {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("annotation rejected: filename: %s, reason: file has %d annotations", filename, len(e.Annotations))
+		return
+	}
+
+	e.Annotations = append(slices.Clone(e.Annotations), a)
+	if !s.saveAnnotations(w, r, e) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// handlePatchAnnotation changes the text of an annotation, only its author
+// can
+func (s server) handlePatchAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	req, ok := readAnnotationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	filename := ps.ByName("filename")
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, i, ok := s.annotationByAuthor(w, r, filename, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	e.Annotations = slices.Clone(e.Annotations)
+	e.Annotations[i].Text = req.Text
+	updated := time.Now().UTC()
+	e.Annotations[i].Updated = &updated
+	if !s.saveAnnotations(w, r, e) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e.Annotations[i])
+}
+
+// handleDeleteAnnotation removes an annotation, only its author can
+func (s server) handleDeleteAnnotation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := ps.ByName("filename")
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, i, ok := s.annotationByAuthor(w, r, filename, ps.ByName("id"))
+	if !ok {
+		return
+	}
+
+	e.Annotations = slices.Delete(slices.Clone(e.Annotations), i, i+1)
+	if !s.saveAnnotations(w, r, e) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// annotationByAuthor returns the file's catalog entry and the index of the
+// annotation in it. It responds with a 404 if either doesn't exist and a 403
+// if the annotation is someone else's, and returns false. The name lock for
+// the file must be held.
+func (s server) annotationByAuthor(w http.ResponseWriter, r *http.Request, filename, id string) (catalogEntry, int, bool) {
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return catalogEntry{}, 0, false
+	}
+
+	i := slices.IndexFunc(e.Annotations, func(a annotation) bool {
+		return a.ID == id
+	})
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return catalogEntry{}, 0, false
+	}
+
+	if user := requestIdentity(r); e.Annotations[i].Author != user {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("annotation denied: filename: %s, annotation: %s, user: %s", filename, id, user)
+		return catalogEntry{}, 0, false
+	}
+
+	return e, i, true
+}
+
+// saveAnnotations stores the entry with its changed annotations, it responds
+// with a 500 and returns false if the catalog can't be saved
+func (s server) saveAnnotations(w http.ResponseWriter, r *http.Request, e catalogEntry) bool {
+	s.catalog.put(e)
+	err := s.saveCatalog(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("save annotations:", err)
+		return false
+	}
+
+	return true
+}
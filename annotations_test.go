@@ -0,0 +1,80 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotations(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	do := func(method, target, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	list := func() []annotation {
+		w := do(http.MethodGet, "/file/report.pdf/annotations", "bob", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		var annotations []annotation
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &annotations))
+		return annotations
+	}
+	require.Equal(t, []annotation{}, list())
+
+	w = do(http.MethodPost, "/file/report.pdf/annotations", "alice", `{"text": " The Q3 numbers look off "}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var added annotation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &added))
+	require.Equal(t, "alice", added.Author)
+	require.Equal(t, "The Q3 numbers look off", added.Text)
+	require.Nil(t, added.Updated)
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/file/report.pdf/annotations", "bob", `{"text": "Fixed in the next version"}`).Code)
+
+	annotations := list()
+	require.Len(t, annotations, 2)
+	require.Equal(t, added, annotations[0])
+	require.Equal(t, "bob", annotations[1].Author)
+
+	// Only the author can change or remove an annotation
+	target := "/file/report.pdf/annotations/" + added.ID
+	require.Equal(t, http.StatusForbidden, do(http.MethodPatch, target, "bob", `{"text": "Looks fine"}`).Code)
+	require.Equal(t, http.StatusForbidden, do(http.MethodDelete, target, "bob", "").Code)
+	w = do(http.MethodPatch, target, "alice", `{"text": "The Q3 numbers are off"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	var edited annotation
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &edited))
+	require.Equal(t, "The Q3 numbers are off", edited.Text)
+	require.NotNil(t, edited.Updated)
+
+	// They're in the metadata, and carry over to a new version of the file
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "new file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	w = do(http.MethodGet, "/file/report.pdf/meta", "bob", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var meta fileMeta
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &meta))
+	require.Len(t, meta.Annotations, 2)
+	require.Equal(t, "The Q3 numbers are off", meta.Annotations[0].Text)
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, target, "alice", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, target, "alice", "").Code)
+	require.Len(t, list(), 1)
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/file/report.pdf/annotations", "bob", `{"text": "  "}`).Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/file/report.pdf/annotations", "bob", `{"text": "`+strings.Repeat("a", maxAnnotationText+1)+`"}`).Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/file/missing.pdf/annotations", "bob", `{"text": "hi"}`).Code)
+}
@@ -0,0 +1,71 @@
+package filesrv
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// apiVersionHeader picks the API version for requests to paths without a
+// version prefix, and says which version answered on every response
+const apiVersionHeader = "X-Filesrv-Api-Version"
+
+// defaultAPIVersion is the version that answers paths without a version
+// prefix. It stays at 1 when later versions are added, since the paths
+// without a prefix are what every integration used before there were
+// versions.
+const defaultAPIVersion = 1
+
+// apiVersions are the versions of the API that are served. A version that
+// changes a route adds it to the router along with the version it's for,
+// and handlers check apiVersionOf for smaller differences.
+var apiVersions = []int{1}
+
+// apiVersionPrefix matches the version at the start of a path
+var apiVersionPrefix = regexp.MustCompile(`^/v([0-9]+)(/|$)`)
+
+type apiVersionKey struct{}
+
+// apiVersionOf returns the API version a request is for
+func apiVersionOf(r *http.Request) int {
+	if v, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return v
+	}
+	return defaultAPIVersion
+}
+
+// withAPIVersion serves every version of the API. Paths starting with a
+// version like /v1 are for that version, and have it taken off before
+// they're routed. Other paths are for the version in apiVersionHeader, or
+// defaultAPIVersion without one, so the same paths keep working whatever
+// versions are added.
+func withAPIVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := next
+		version := defaultAPIVersion
+		if m := apiVersionPrefix.FindStringSubmatch(r.URL.Path); m != nil {
+			version, _ = strconv.Atoi(m[1])
+			if !slices.Contains(apiVersions, version) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			h = http.StripPrefix(strings.TrimSuffix(m[0], "/"), next)
+		} else if requested := r.Header.Get(apiVersionHeader); requested != "" {
+			v, err := strconv.Atoi(strings.TrimPrefix(requested, "v"))
+			if err != nil || !slices.Contains(apiVersions, v) {
+				w.WriteHeader(http.StatusBadRequest)
+				log.Printf("unsupported API version: %q", requested)
+				return
+			}
+			version = v
+		}
+
+		w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	})
+}
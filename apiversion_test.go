@@ -0,0 +1,71 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIVersions(t *testing.T) {
+	store := newMemObjStore()
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.Buckets = []bucketConfig{{Name: "archive"}}
+	handler := newServerFromConfig(store, cfg).routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/v1/upload", "report.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.Equal(t, "1", w.Result().Header.Get(apiVersionHeader))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/v1/b/archive/upload", "notes.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	tests := []struct {
+		name       string
+		target     string
+		version    string
+		wantStatus int
+	}{
+		{name: "versioned", target: "/v1/file/report.txt", wantStatus: http.StatusOK},
+		{name: "versioned bucket", target: "/v1/b/archive/file/notes.txt", wantStatus: http.StatusOK},
+		{name: "unversioned", target: "/file/report.txt", wantStatus: http.StatusOK},
+		{name: "negotiated", target: "/file/report.txt", version: "1", wantStatus: http.StatusOK},
+		{name: "negotiated with a v", target: "/file/report.txt", version: "v1", wantStatus: http.StatusOK},
+		{name: "unknown version", target: "/v2/file/report.txt", wantStatus: http.StatusNotFound},
+		{name: "unknown negotiated version", target: "/file/report.txt", version: "2", wantStatus: http.StatusBadRequest},
+		{name: "bad negotiated version", target: "/file/report.txt", version: "latest", wantStatus: http.StatusBadRequest},
+		{name: "only a whole segment", target: "/v1file/report.txt", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.version != "" {
+				r.Header.Set(apiVersionHeader, test.version)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus == http.StatusOK {
+				require.Equal(t, "1", w.Result().Header.Get(apiVersionHeader))
+				require.Equal(t, "test file contents", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIVersionOf(t *testing.T) {
+	var got int
+	handler := withAPIVersion(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		got = apiVersionOf(r)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/healthz", nil))
+	require.Equal(t, 1, got)
+	require.Equal(t, defaultAPIVersion, apiVersionOf(httptest.NewRequest(http.MethodGet, "/healthz", nil)))
+}
@@ -0,0 +1,100 @@
+package filesrv
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxArchiveFiles is the most files POST /archive puts in one zip
+	maxArchiveFiles = 1000
+	// defaultArchiveName is what the zip is saved as if the request doesn't
+	// give it a name
+	defaultArchiveName = "files.zip"
+)
+
+// archiveRequest is the body of POST /archive
+type archiveRequest struct {
+	Names []string `json:"names"`
+	// Name is the filename the zip is downloaded as
+	Name string `json:"name,omitempty"`
+}
+
+// handlePostArchive streams back a zip of the files, decrypting each of them
+// straight into the archive so nothing is held in memory or on disk. Every
+// file is checked before any of the zip is sent, so a missing file or one the
+// user can't read fails the whole request with a status. An error after that
+// cuts the connection, which leaves the client with a zip without its
+// central directory rather than one that looks complete.
+func (s server) handlePostArchive(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req archiveRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxArchiveFiles*(maxPathLength+3)+maxFormOverhead)).Decode(&req)
+	if err == nil && len(req.Names) == 0 {
+		err = errors.New("no names")
+	}
+	if err == nil && len(req.Names) > maxArchiveFiles {
+		err = fmt.Errorf("%d names is more than %d", len(req.Names), maxArchiveFiles)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode archive request:", err)
+		return
+	}
+
+	// The files go in the order they were asked for, each of them once
+	entries := make([]catalogEntry, 0, len(req.Names))
+	for _, name := range req.Names {
+		if slices.ContainsFunc(entries, func(e catalogEntry) bool { return e.Name == name }) {
+			continue
+		}
+		if !s.readConsistent(w, r, name) || !s.downloadAllowed(w, r, name) {
+			return
+		}
+		e, ok := s.catalog.get(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			log.Println("archive: no such file:", name)
+			return
+		}
+		if !s.checkAccess(w, r, name, accessRead) {
+			return
+		}
+		entries = append(entries, e)
+	}
+
+	archiveName := req.Name
+	if archiveName == "" {
+		archiveName = defaultArchiveName
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition(dispositionAttachment, archiveName))
+
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     e.Name,
+			Method:   zip.Deflate,
+			Modified: e.Uploaded,
+		})
+		if err == nil {
+			err = s.getFile(r.Context(), fw, e.Name)
+		}
+		if err != nil {
+			writeStorageError(w, fmt.Errorf("%w: %w", errStreamInterrupted, err), "archive: filename: "+e.Name)
+			return
+		}
+		s.recordAccess(r, e.Name)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("%w: %w", errStreamInterrupted, err), "archive")
+	}
+}
@@ -0,0 +1,56 @@
+package filesrv
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostArchive(t *testing.T) {
+	handler := NewServer(newMemObjStore(), "testBucket", "key", 10<<17).routes()
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	files := map[string]string{
+		"a.txt": "first file",
+		"b.txt": strings.Repeat("second file ", 10000),
+	}
+	for name, contents := range files {
+		require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", name, contents)).Code)
+	}
+
+	w := do(httptest.NewRequest(http.MethodPost, "/archive", strings.NewReader(`{"names": ["b.txt", "a.txt", "b.txt"], "name": "bundle.zip"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/zip", w.Header().Get("Content-Type"))
+	require.Contains(t, w.Header().Get("Content-Disposition"), `filename="bundle.zip"`)
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	require.NoError(t, err)
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		require.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		require.NoError(t, err)
+		require.Equal(t, files[f.Name], string(b))
+		rc.Close()
+	}
+	require.Equal(t, []string{"b.txt", "a.txt"}, names)
+
+	for body, want := range map[string]int{
+		`{"names": []}`:                   http.StatusBadRequest,
+		`{"names": "a.txt"}`:              http.StatusBadRequest,
+		`{"names": ["a.txt", "missing"]}`: http.StatusNotFound,
+	} {
+		require.Equal(t, want, do(httptest.NewRequest(http.MethodPost, "/archive", strings.NewReader(body))).Code, body)
+	}
+}
@@ -0,0 +1,397 @@
+package filesrv
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Kinds of auth provider
+const (
+	authHeader = "header"
+	authAPIKey = "api-key"
+	authBasic  = "basic"
+	authJWT    = "jwt"
+	authMTLS   = "mtls"
+)
+
+// apiKeyHeader holds the key for the api-key provider. It has a header of its
+// own so it can't be mistaken for a bearer token.
+const apiKeyHeader = "X-API-Key"
+
+// authRealm is the realm in the challenges sent with a 401
+const authRealm = "filesrv"
+
+// errNoCredentials is returned by an auth provider when the request doesn't
+// have its kind of credentials, so the next provider is tried
+var errNoCredentials = errors.New("no credentials")
+
+// errBadCredentials is returned by an auth provider when the request has its
+// kind of credentials but they aren't right
+var errBadCredentials = errors.New("bad credentials")
+
+// identity is who a request was made by
+type identity struct {
+	User   string
+	Groups []string
+}
+
+// authProvider authenticates requests with one kind of credentials. It
+// returns errNoCredentials if the request doesn't have any of its kind, and
+// any other error if it has them but they don't check out.
+type authProvider interface {
+	authenticate(r *http.Request) (identity, error)
+}
+
+// authSchemer is an authProvider that uses the Authorization header, the
+// scheme is sent in the challenge when a request is turned away
+type authSchemer interface {
+	scheme() string
+}
+
+// authConfig is an auth provider in the config file
+type authConfig struct {
+	Name string `yaml:"name"`
+	// Type is one of header, api-key, basic, jwt or mtls
+	Type string `yaml:"type"`
+	// Users have the API keys for api-key and the passwords for basic
+	Users []authUser `yaml:"users"`
+	// Secret is the key HS256 tokens are signed with and PublicKeyFile the
+	// PEM encoded key RS256 tokens are verified with, one of them is needed
+	// for jwt
+	Secret        string `yaml:"secret"`
+	PublicKeyFile string `yaml:"public-key-file"`
+	// Issuer and Audience are checked against the token's iss and aud if
+	// they're set
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// UserClaim and GroupsClaim are the claims the user and their groups
+	// are taken from, sub and groups by default
+	UserClaim   string `yaml:"user-claim"`
+	GroupsClaim string `yaml:"groups-claim"`
+	// ClientCA is the PEM file with the CAs client certificates are checked
+	// against for mtls
+	ClientCA string `yaml:"client-ca"`
+}
+
+// authUser is a user of the api-key or basic providers
+type authUser struct {
+	User   string   `yaml:"user"`
+	Groups []string `yaml:"groups"`
+	// KeySHA256 is the hex SHA-256 of the user's API key, so the key itself
+	// isn't in the config
+	KeySHA256 string `yaml:"key-sha256"`
+	// PasswordHash is the bcrypt hash of the user's password
+	PasswordHash string `yaml:"password-hash"`
+}
+
+// newAuthProvider checks the config for a provider and returns it
+func newAuthProvider(c authConfig) (authProvider, error) {
+	switch c.Type {
+	case authHeader:
+		return headerAuth{}, nil
+	case authAPIKey:
+		return newAPIKeyAuth(c.Users)
+	case authBasic:
+		return newBasicAuth(c.Users)
+	case authJWT:
+		return newJWTAuth(c)
+	case authMTLS:
+		_, err := c.clientCAs()
+		return mtlsAuth{}, err
+	default:
+		return nil, fmt.Errorf("unknown type %q, expected one of %s, %s, %s, %s or %s", c.Type, authHeader, authAPIKey, authBasic, authJWT, authMTLS)
+	}
+}
+
+// clientCAs reads the CAs for an mtls provider
+func (c authConfig) clientCAs() (*x509.CertPool, error) {
+	if c.ClientCA == "" {
+		return nil, errors.New("no client CA")
+	}
+	b, err := os.ReadFile(c.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("client CA %s doesn't have any PEM certificates", c.ClientCA)
+	}
+	return pool, nil
+}
+
+// validateAuth checks the auth providers can be made, mtls ones need the
+// server to be serving HTTPS
+func validateAuth(providers []authConfig, https bool) error {
+	var errs []error
+	seen := map[string]bool{}
+	var mtls bool
+	for i, c := range providers {
+		fail := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("auth provider %d (%s): %s", i, c.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if c.Name == "" {
+			fail("no name")
+		}
+		if seen[c.Name] {
+			fail("name is used more than once")
+		}
+		seen[c.Name] = true
+		if _, err := newAuthProvider(c); err != nil {
+			fail("%v", err)
+		}
+		if c.Type == authMTLS && !https {
+			fail("mtls needs HTTPS, with tls-cert or autocert-hosts")
+		}
+		if c.Type == authMTLS && mtls {
+			fail("there can only be one mtls provider")
+		}
+		mtls = mtls || c.Type == authMTLS
+	}
+
+	return errors.Join(errs...)
+}
+
+// authChain tries each of its providers in turn, the first one to find its
+// kind of credentials on the request decides who it's from
+type authChain []namedAuthProvider
+
+type namedAuthProvider struct {
+	name string
+	authProvider
+}
+
+// newAuthChain makes the providers in the config. Without any the identity
+// comes from the headers set by a proxy, as it always has.
+func newAuthChain(providers []authConfig) (authChain, error) {
+	if len(providers) == 0 {
+		return authChain{{authHeader, headerAuth{}}}, nil
+	}
+
+	chain := make(authChain, 0, len(providers))
+	for _, c := range providers {
+		p, err := newAuthProvider(c)
+		if err != nil {
+			return nil, fmt.Errorf("auth provider %s: %w", c.Name, err)
+		}
+		chain = append(chain, namedAuthProvider{c.Name, p})
+	}
+
+	return chain, nil
+}
+
+func mustAuthChain(providers []authConfig) authChain {
+	chain, err := newAuthChain(providers)
+	if err != nil {
+		panic(err)
+	}
+
+	return chain
+}
+
+// authenticate returns who made the request and the name of the provider that
+// said so. Requests without credentials for any provider are anonymous.
+func (c authChain) authenticate(r *http.Request) (identity, string, error) {
+	for _, p := range c {
+		id, err := p.authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return id, p.name, err
+	}
+
+	return identity{}, "", nil
+}
+
+// schemes are the Authorization schemes the providers accept
+func (c authChain) schemes() []string {
+	schemes := []string{}
+	for _, p := range c {
+		if s, ok := p.authProvider.(authSchemer); ok && !contains(schemes, s.scheme()) {
+			schemes = append(schemes, s.scheme())
+		}
+	}
+	return schemes
+}
+
+// withAuth authenticates every request before anything else sees it. The
+// identity is passed on in identityHeader and groupsHeader, replacing any the
+// client sent, so the rest of the server doesn't need to know how it was
+// worked out. Requests with credentials that don't check out get a 401.
+//
+// Since this is ahead of withAbuseDetection, banned addresses are turned away
+// here before any credentials are checked, and failures count towards a ban
+// for the address so guessing passwords gets it banned. Checking passwords
+// and signatures takes real work, so requests with an Authorization header
+// wait for a turn in queue to be checked, if there is one.
+func withAuth(next http.Handler, chain authChain, abuse *abuseTracker, queue *requestQueue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := "ip:" + requestIP(r)
+		if until, ok := abuse.banned([]string{subject}, time.Now()); ok {
+			refuseBanned(w, until)
+			return
+		}
+
+		release := func() {}
+		if queue != nil && r.Header.Get("Authorization") != "" {
+			var err error
+			release, err = queue.acquire(r.Context())
+			if err != nil {
+				requestsShed.Add(string(priorityBulk), 1)
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		// The turn is given back before the request goes on, since it
+		// waits in the queues again for its own turn
+		id, provider, err := chain.authenticate(r)
+		release()
+		if err != nil {
+			abuse.fail(subject, time.Now())
+			for _, scheme := range chain.schemes() {
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf("%s realm=%q", scheme, authRealm))
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			log.Printf("auth failed: provider: %s, source: %s, error: %s", provider, requestIP(r), err)
+			return
+		}
+
+		r = r.Clone(r.Context())
+		r.Header.Del(identityHeader)
+		r.Header.Del(groupsHeader)
+		if id.User != "" {
+			r.Header.Set(identityHeader, id.User)
+			if len(id.Groups) > 0 {
+				r.Header.Set(groupsHeader, strings.Join(id.Groups, ","))
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerAuth trusts the identity headers, which have to be set by an
+// authenticating proxy in front of the server
+type headerAuth struct{}
+
+func (headerAuth) authenticate(r *http.Request) (identity, error) {
+	user := r.Header.Get(identityHeader)
+	if user == "" {
+		return identity{}, errNoCredentials
+	}
+
+	return identity{User: user, Groups: requestGroups(r)}, nil
+}
+
+// apiKeyAuth looks up the key in apiKeyHeader by its SHA-256
+type apiKeyAuth struct {
+	keys map[[sha256.Size]byte]identity
+}
+
+func newAPIKeyAuth(users []authUser) (apiKeyAuth, error) {
+	if len(users) == 0 {
+		return apiKeyAuth{}, errors.New("no users")
+	}
+
+	a := apiKeyAuth{keys: map[[sha256.Size]byte]identity{}}
+	for _, u := range users {
+		b, err := hex.DecodeString(u.KeySHA256)
+		if u.User == "" || err != nil || len(b) != sha256.Size {
+			return apiKeyAuth{}, fmt.Errorf("user %q needs a user and a hex SHA-256 of their key", u.User)
+		}
+		a.keys[[sha256.Size]byte(b)] = identity{User: u.User, Groups: u.Groups}
+	}
+
+	return a, nil
+}
+
+func (a apiKeyAuth) authenticate(r *http.Request) (identity, error) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return identity{}, errNoCredentials
+	}
+
+	id, ok := a.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return identity{}, errBadCredentials
+	}
+	return id, nil
+}
+
+// dummyPasswordHash is checked against for users that don't exist, so a
+// request for an unknown user takes as long as one with a wrong password and
+// doesn't give away which users there are
+const dummyPasswordHash = "$2a$10$5BdeuGsDUlC2x9BDOlJ9p.WP6KQrARw25pxzY4KG4PbpfQQ.QRhHu"
+
+// basicAuth checks HTTP basic auth passwords against bcrypt hashes
+type basicAuth struct {
+	users map[string]authUser
+}
+
+func newBasicAuth(users []authUser) (basicAuth, error) {
+	if len(users) == 0 {
+		return basicAuth{}, errors.New("no users")
+	}
+
+	a := basicAuth{users: map[string]authUser{}}
+	for _, u := range users {
+		_, err := bcrypt.Cost([]byte(u.PasswordHash))
+		if u.User == "" || err != nil {
+			return basicAuth{}, fmt.Errorf("user %q needs a user and a bcrypt password hash", u.User)
+		}
+		a.users[u.User] = u
+	}
+
+	return a, nil
+}
+
+func (a basicAuth) authenticate(r *http.Request) (identity, error) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return identity{}, errNoCredentials
+	}
+
+	u, ok := a.users[user]
+	hash := u.PasswordHash
+	if !ok {
+		hash = dummyPasswordHash
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || !ok {
+		return identity{}, errBadCredentials
+	}
+	return identity{User: u.User, Groups: u.Groups}, nil
+}
+
+func (basicAuth) scheme() string {
+	return "Basic"
+}
+
+// mtlsAuth takes the user from the common name of the client certificate and
+// their groups from its organizational units. The certificate has already
+// been checked against the client CAs by the TLS handshake.
+type mtlsAuth struct{}
+
+func (mtlsAuth) authenticate(r *http.Request) (identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return identity{}, errNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return identity{}, fmt.Errorf("%w: client certificate has no common name", errBadCredentials)
+	}
+	return identity{User: cert.Subject.CommonName, Groups: cert.Subject.OrganizationalUnit}, nil
+}
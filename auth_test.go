@@ -0,0 +1,380 @@
+package filesrv
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signTestJWT makes a token with the claims, signed with the key if it's an
+// RSA key and with HS256 otherwise
+func signTestJWT(t *testing.T, key any, claims map[string]any) string {
+	t.Helper()
+
+	alg := "HS256"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		alg = "RS256"
+	}
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"alg":%q,"typ":"JWT"}`, alg))) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		require.NoError(t, err)
+	case []byte:
+		sig = receiptMAC(key, signingInput)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestWithAuth(t *testing.T) {
+	dir := t.TempDir()
+	caFile, _ := writeTestCert(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	publicKeyFile := filepath.Join(dir, "jwt.pem")
+	require.NoError(t, os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+
+	keyHash := sha256.Sum256([]byte("ci-key"))
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	secret := []byte("jwt secret")
+
+	chain, err := newAuthChain([]authConfig{
+		{Name: "keys", Type: authAPIKey, Users: []authUser{{User: "ci", Groups: []string{"builders"}, KeySHA256: hex.EncodeToString(keyHash[:])}}},
+		{Name: "passwords", Type: authBasic, Users: []authUser{{User: "alice", PasswordHash: string(passwordHash)}}},
+		{Name: "sso", Type: authJWT, Secret: string(secret), Issuer: "https://sso.example.com", Audience: "filesrv"},
+		{Name: "certs", Type: authMTLS, ClientCA: caFile},
+	})
+	require.NoError(t, err)
+	rsaChain, err := newAuthChain([]authConfig{{Name: "sso", Type: authJWT, PublicKeyFile: publicKeyFile, UserClaim: "email", GroupsClaim: "roles"}})
+	require.NoError(t, err)
+
+	whoami := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.TrimSpace(requestIdentity(r)+" "+strings.Join(requestGroups(r), "+")))
+	})
+	exp := float64(time.Now().Add(time.Hour).Unix())
+
+	tests := []struct {
+		name    string
+		chain   authChain
+		request func(r *http.Request)
+		want    string
+		// wantStatus is 200 if it isn't set
+		wantStatus int
+	}{
+		{
+			name:    "no credentials is anonymous",
+			request: func(r *http.Request) {},
+			want:    anonymous,
+		},
+		{
+			name:    "identity headers aren't trusted without a header provider",
+			request: func(r *http.Request) { r.Header.Set(identityHeader, "admin") },
+			want:    anonymous,
+		},
+		{
+			name:    "api key",
+			request: func(r *http.Request) { r.Header.Set(apiKeyHeader, "ci-key") },
+			want:    "ci builders",
+		},
+		{
+			name:       "wrong api key",
+			request:    func(r *http.Request) { r.Header.Set(apiKeyHeader, "guess") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:    "basic",
+			request: func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") },
+			want:    "alice",
+		},
+		{
+			name:       "wrong password",
+			request:    func(r *http.Request) { r.SetBasicAuth("alice", "hunter3") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown user",
+			request:    func(r *http.Request) { r.SetBasicAuth("mallory", "hunter2") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "jwt",
+			request: func(r *http.Request) {
+				token := signTestJWT(t, secret, map[string]any{"sub": "bob", "groups": []string{"finance"}, "iss": "https://sso.example.com", "aud": []string{"filesrv"}, "exp": exp})
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			want: "bob finance",
+		},
+		{
+			name: "expired jwt",
+			request: func(r *http.Request) {
+				token := signTestJWT(t, secret, map[string]any{"sub": "bob", "iss": "https://sso.example.com", "aud": "filesrv", "exp": float64(time.Now().Add(-time.Hour).Unix())})
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "jwt for someone else",
+			request: func(r *http.Request) {
+				token := signTestJWT(t, secret, map[string]any{"sub": "bob", "iss": "https://sso.example.com", "aud": "wiki", "exp": exp})
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "jwt signed with another key",
+			request: func(r *http.Request) {
+				token := signTestJWT(t, []byte("other secret"), map[string]any{"sub": "bob", "iss": "https://sso.example.com", "aud": "filesrv", "exp": exp})
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:  "rs256 jwt",
+			chain: rsaChain,
+			request: func(r *http.Request) {
+				token := signTestJWT(t, rsaKey, map[string]any{"email": "carol@example.com", "roles": []string{"ops", "dev"}, "exp": exp})
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			want: "carol@example.com ops+dev",
+		},
+		{
+			name:  "hs256 jwt when rs256 is expected",
+			chain: rsaChain,
+			request: func(r *http.Request) {
+				token := signTestJWT(t, secret, map[string]any{"email": "carol@example.com", "exp": exp})
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "client certificate",
+			request: func(r *http.Request) {
+				cert := &x509.Certificate{Subject: pkix.Name{CommonName: "backup-job", OrganizationalUnit: []string{"ops"}}}
+				r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+			},
+			want: "backup-job ops",
+		},
+		{
+			name: "first provider with credentials decides",
+			request: func(r *http.Request) {
+				r.Header.Set(apiKeyHeader, "ci-key")
+				r.SetBasicAuth("alice", "wrong")
+			},
+			want: "ci builders",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := chain
+			if test.chain != nil {
+				c = test.chain
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			test.request(r)
+			w := httptest.NewRecorder()
+			withAuth(whoami, c, newAbuseTracker(), nil).ServeHTTP(w, r)
+
+			if test.wantStatus != 0 {
+				require.Equal(t, test.wantStatus, w.Code)
+				wantChallenges := []string{`Basic realm="filesrv"`, `Bearer realm="filesrv"`}
+				if test.chain != nil {
+					wantChallenges = wantChallenges[1:]
+				}
+				require.Equal(t, wantChallenges, w.Header().Values("WWW-Authenticate"))
+				return
+			}
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, test.want, w.Body.String())
+		})
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	caFile, _ := writeTestCert(t)
+	tests := []struct {
+		name      string
+		providers []authConfig
+		https     bool
+		wantErr   string
+	}{
+		{
+			name: "every type",
+			providers: []authConfig{
+				{Name: "proxy", Type: authHeader},
+				{Name: "keys", Type: authAPIKey, Users: []authUser{{User: "ci", KeySHA256: strings.Repeat("ab", sha256.Size)}}},
+				{Name: "sso", Type: authJWT, Secret: "secret"},
+				{Name: "certs", Type: authMTLS, ClientCA: caFile},
+			},
+			https: true,
+		},
+		{
+			name:      "unknown type",
+			providers: []authConfig{{Name: "ldap", Type: "ldap"}},
+			wantErr:   `auth provider 0 (ldap): unknown type "ldap"`,
+		},
+		{
+			name:      "repeated name",
+			providers: []authConfig{{Name: "proxy", Type: authHeader}, {Name: "proxy", Type: authHeader}},
+			wantErr:   "auth provider 1 (proxy): name is used more than once",
+		},
+		{
+			name:      "key that isn't a hash",
+			providers: []authConfig{{Name: "keys", Type: authAPIKey, Users: []authUser{{User: "ci", KeySHA256: "ci-key"}}}},
+			wantErr:   `user "ci" needs a user and a hex SHA-256 of their key`,
+		},
+		{
+			name:      "password that isn't a bcrypt hash",
+			providers: []authConfig{{Name: "passwords", Type: authBasic, Users: []authUser{{User: "alice", PasswordHash: "hunter2"}}}},
+			wantErr:   `user "alice" needs a user and a bcrypt password hash`,
+		},
+		{
+			name:      "jwt with a secret and a key",
+			providers: []authConfig{{Name: "sso", Type: authJWT, Secret: "secret", PublicKeyFile: "key.pem"}},
+			wantErr:   "needs one of a secret or a public key file",
+		},
+		{
+			name:      "jwt key that isn't PEM",
+			providers: []authConfig{{Name: "sso", Type: authJWT, PublicKeyFile: "auth_test.go"}},
+			wantErr:   "public key file auth_test.go isn't PEM",
+		},
+		{
+			name:      "mtls without https",
+			providers: []authConfig{{Name: "certs", Type: authMTLS, ClientCA: caFile}},
+			wantErr:   "mtls needs HTTPS",
+		},
+		{
+			name:      "mtls without a CA",
+			providers: []authConfig{{Name: "certs", Type: authMTLS}},
+			https:     true,
+			wantErr:   "no client CA",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateAuth(test.providers, test.https)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestDummyPasswordHash(t *testing.T) {
+	// It has to be a real hash at the usual cost, or unknown users would be
+	// turned away faster than wrong passwords
+	cost, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	require.NoError(t, err)
+	require.Equal(t, bcrypt.DefaultCost, cost)
+}
+
+func TestAuthClientCertificates(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeTestCert(t)
+	tlsConfig, err := cfg.tlsConfig()
+	require.NoError(t, err)
+	require.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+
+	cfg.Auth = []authConfig{{Name: "certs", Type: authMTLS, ClientCA: cfg.TLSCertFile}}
+	tlsConfig, err = cfg.tlsConfig()
+	require.NoError(t, err)
+	require.Equal(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+	require.NotNil(t, tlsConfig.ClientCAs)
+}
+
+func TestAuthRoutes(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.Auth = []authConfig{{Name: "passwords", Type: authBasic, Users: []authUser{{User: "alice", PasswordHash: string(passwordHash)}}}}
+	handler := newServerFromConfig(newMemObjStore(), cfg).routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/files", nil))
+	var got capabilities
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, []string{"Basic"}, got.AuthSchemes)
+
+	// Uploads are owned by whoever the provider says they're from
+	r := newUploadRequest(t, "/upload", "notes.txt", "test file contents")
+	r.SetBasicAuth("alice", "hunter2")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Code)
+	r = httptest.NewRequest(http.MethodGet, "/file/notes.txt/acl", nil)
+	r.SetBasicAuth("alice", "hunter2")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Contains(t, w.Body.String(), `"owner":"alice"`)
+
+	r = httptest.NewRequest(http.MethodGet, "/files", nil)
+	r.SetBasicAuth("alice", "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestAuthFailuresBan(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	require.NoError(t, err)
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	s.auth = mustAuthChain([]authConfig{{Name: "passwords", Type: authBasic, Users: []authUser{{User: "alice", PasswordHash: string(passwordHash)}}}})
+	handler := s.routes()
+
+	get := func(password string) int {
+		r := httptest.NewRequest(http.MethodGet, "/version", nil)
+		r.SetBasicAuth("alice", password)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusOK, get("hunter2"))
+	for i := 0; i < abuseThreshold; i++ {
+		require.Equal(t, http.StatusUnauthorized, get(fmt.Sprint("guess", i)))
+	}
+
+	// Once the address is banned the password isn't even checked
+	require.Equal(t, http.StatusForbidden, get("hunter2"))
+	require.Equal(t, "ip:192.0.2.1", s.abuse.bans(time.Now())[0].Subject)
+
+	// Checking passwords waits for a turn in the bulk queue
+	s.abuse = newAbuseTracker()
+	s.queues[priorityBulk] = newRequestQueue(1, 0)
+	handler = s.routes()
+	release, err := s.queues[priorityBulk].acquire(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, get("hunter2"))
+	release()
+}
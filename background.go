@@ -0,0 +1,22 @@
+package filesrv
+
+import (
+	"context"
+	"time"
+)
+
+// runEvery calls fn every interval until ctx is cancelled, it is used for the
+// background cleanup jobs
+func runEvery(ctx context.Context, interval time.Duration, fn func(ctx context.Context, now time.Time)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			fn(ctx, now)
+		}
+	}
+}
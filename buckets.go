@@ -0,0 +1,152 @@
+package filesrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// bucketPrefix is the start of the path for requests to a particular bucket,
+// /b/<bucket>/file/<filename> is the same as /file/<filename> on that bucket
+const bucketPrefix = "/b/"
+
+// bucketConfig is an extra bucket to serve. Anything left unset is the same
+// as for the main bucket.
+type bucketConfig struct {
+	Name          string `yaml:"name"`
+	ChunkSize     int64  `yaml:"chunk-size"`
+	EncryptionKey string `yaml:"encryption-key"`
+}
+
+// validateBuckets checks the extra buckets, main is the name of the main
+// bucket
+func validateBuckets(main string, buckets []bucketConfig) error {
+	var errs []error
+	seen := map[string]bool{main: true}
+	for i, b := range buckets {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(bucketsSection, i, "bucket %d (%s): %s", i+1, b.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if err := s3utils.CheckValidBucketNameStrict(b.Name); err != nil {
+			fail("%s", err)
+		}
+		if seen[b.Name] {
+			fail("served more than once")
+		}
+		seen[b.Name] = true
+		if b.ChunkSize != 0 && b.ChunkSize < minChunkSize {
+			fail("chunk size %d is smaller than the minimum of %d", b.ChunkSize, minChunkSize)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// forBucket returns the config for serving one of the extra buckets
+func (c config) forBucket(b bucketConfig) config {
+	c.Bucket = b.Name
+	if b.ChunkSize != 0 {
+		c.ChunkSize = b.ChunkSize
+	}
+	if b.EncryptionKey != "" {
+		c.EncryptionKey = b.EncryptionKey
+	}
+	c.Buckets = nil
+
+	return c
+}
+
+// newBucketServers returns a server for each of the extra buckets. Each one
+// has its own catalog, but they share the request limits and the reloadable
+// settings with s.
+func (s server) newBucketServers(minioClient objStorer, cfg config) map[string]server {
+	if len(cfg.Buckets) == 0 {
+		return nil
+	}
+
+	buckets := make(map[string]server, len(cfg.Buckets))
+	for _, b := range cfg.Buckets {
+		buckets[b.Name] = s.newBucketServer(minioClient, cfg, b)
+	}
+
+	return buckets
+}
+
+// newBucketServer returns the server for another bucket
+func (s server) newBucketServer(minioClient objStorer, cfg config, b bucketConfig) server {
+	bs := newServerFromConfig(minioClient, cfg.forBucket(b))
+	bs.live = s.live
+	if c, ok := bs.minioClient.(*canaryStore); ok {
+		// The canary alerts are redacted with the shared settings too
+		c.live = s.live
+	}
+	bs.deleteJobs = s.deleteJobs
+	bs.queues = s.queues
+	bs.abuse = s.abuse
+	bs.slo = s.slo
+	bs.processing = s.processing
+	bs.drainer = s.drainer
+	bs.spill = s.spill
+	bs.auth = s.auth
+	bs.fetcher = s.fetcher
+	bs.placement = s.placement
+	bs.geoIP = s.geoIP
+	// Verdicts are by contents, so they hold for every bucket
+	bs.scanner = s.scanner
+	if b.EncryptionKey != "" {
+		// The bucket's own key doesn't come from Vault
+		bs.secrets = nil
+	}
+
+	return bs
+}
+
+// allBuckets returns the server for every bucket, the main one first
+func (s server) allBuckets() []server {
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	all := []server{s}
+	for _, name := range names {
+		all = append(all, s.buckets[name])
+	}
+
+	return all
+}
+
+// withBuckets sends requests under /b/<bucket>/ to the router for that
+// bucket, with the prefix taken off. The main bucket can be reached by name
+// too, so clients can always use the long form. Any other bucket is looked up
+// with tenant, if it's set.
+func withBuckets(next http.Handler, buckets map[string]http.Handler, tenant func(w http.ResponseWriter, r *http.Request, name string) (http.Handler, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rest, ok := strings.CutPrefix(r.URL.Path, bucketPrefix)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name, _, _ := strings.Cut(rest, "/")
+		h, ok := buckets[name]
+		if !ok && tenant != nil {
+			h, ok = tenant(w, r, name)
+			if !ok {
+				return
+			}
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		http.StripPrefix(bucketPrefix+name, h).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketRouting(t *testing.T) {
+	store := newMemObjStore()
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.Buckets = []bucketConfig{{Name: "archive", EncryptionKey: "archive key"}}
+	s := newServerFromConfig(store, cfg)
+	handler := s.routes()
+
+	get := func(target string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Result().StatusCode
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/b/archive/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	store.mu.Lock()
+	_, inArchive := store.objects["archive/report.pdf"]
+	_, inMain := store.objects["testBucket/report.pdf"]
+	store.mu.Unlock()
+	require.True(t, inArchive)
+	require.False(t, inMain)
+
+	require.Equal(t, http.StatusOK, get("/b/archive/file/report.pdf"))
+	require.Equal(t, http.StatusNotFound, get("/file/report.pdf"))
+	require.Equal(t, http.StatusNotFound, get("/b/testBucket/file/report.pdf"))
+	require.Equal(t, http.StatusNotFound, get("/b/missing/file/report.pdf"))
+
+	// Each bucket has its own catalog and key
+	_, ok := s.buckets["archive"].catalog.get("report.pdf")
+	require.True(t, ok)
+	_, ok = s.catalog.get("report.pdf")
+	require.False(t, ok)
+	require.Equal(t, "archive key", s.buckets["archive"].encryptionKey)
+
+	// The main bucket can be reached by name too
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/b/testBucket/upload", "notes.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.Equal(t, http.StatusOK, get("/file/notes.txt"))
+}
+
+func TestValidateBuckets(t *testing.T) {
+	require.NoError(t, validateBuckets("filesrv", []bucketConfig{{Name: "archive"}, {Name: "media", ChunkSize: minChunkSize}}))
+
+	err := validateBuckets("filesrv", []bucketConfig{
+		{Name: "filesrv"},
+		{Name: "Bad_Name"},
+		{Name: "small", ChunkSize: 1024},
+	})
+	require.ErrorContains(t, err, "bucket 1 (filesrv): served more than once")
+	require.ErrorContains(t, err, "bucket 2 (Bad_Name)")
+	require.ErrorContains(t, err, "bucket 3 (small): chunk size 1024 is smaller than the minimum")
+}
+
+func TestConfigForBucket(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.EncryptionKey = "key"
+	cfg.Buckets = []bucketConfig{{Name: "archive"}}
+
+	b := cfg.forBucket(bucketConfig{Name: "archive", ChunkSize: 16 << 20})
+	require.Equal(t, "archive", b.Bucket)
+	require.Equal(t, int64(16<<20), b.ChunkSize)
+	require.Equal(t, "key", b.EncryptionKey)
+	require.Empty(t, b.Buckets)
+}
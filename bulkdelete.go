@@ -0,0 +1,349 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// deleteTokenTTL is how long the confirmation token for a bulk delete can be
+// used for
+const deleteTokenTTL = 10 * time.Minute
+
+// errInvalidDeleteToken is returned when a confirmation token is malformed,
+// has been tampered with or has expired
+var errInvalidDeleteToken = errors.New("invalid delete token")
+
+// deletePrefixRequest is the body of POST /admin/delete-prefix
+type deletePrefixRequest struct {
+	Prefix string `json:"prefix"`
+	// Token is the confirmation token from the summary, without it nothing
+	// is deleted
+	Token string `json:"token,omitempty"`
+}
+
+// deleteSummary is what a bulk delete would remove. It's signed into the
+// confirmation token, so the delete only goes ahead for what was confirmed.
+type deleteSummary struct {
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count"`
+	Bytes  int64  `json:"bytes"`
+	// AsOf is when the summary was made, objects written after it are left
+	// alone by the delete
+	AsOf    time.Time `json:"asOf"`
+	Expires time.Time `json:"expires"`
+}
+
+// deleteSummaryResponse is the first step of a bulk delete
+type deleteSummaryResponse struct {
+	deleteSummary
+	Token string `json:"token"`
+}
+
+// encodeDeleteToken signs the summary
+func encodeDeleteToken(key []byte, summary deleteSummary) (string, error) {
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(deleteTokenMAC(key, payload)), nil
+}
+
+// decodeDeleteToken checks the signature and expiry of a confirmation token
+// and returns the summary in it
+func decodeDeleteToken(key []byte, token string, now time.Time) (deleteSummary, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return deleteSummary{}, errInvalidDeleteToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, deleteTokenMAC(key, payload)) {
+		return deleteSummary{}, errInvalidDeleteToken
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return deleteSummary{}, errInvalidDeleteToken
+	}
+
+	var summary deleteSummary
+	err = json.Unmarshal(b, &summary)
+	if err != nil || now.After(summary.Expires) {
+		return deleteSummary{}, errInvalidDeleteToken
+	}
+
+	return summary, nil
+}
+
+// deleteTokenMAC uses the receipt key, with a prefix so a receipt can never
+// pass for a token
+func deleteTokenMAC(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("delete-prefix:" + payload))
+	return mac.Sum(nil)
+}
+
+// prefixObjects lists the objects a bulk delete of prefix would remove, that
+// is the ones under it written no later than asOf. Internal objects and
+// pinned files are never included.
+func (s server) prefixObjects(ctx context.Context, prefix string, asOf time.Time) ([]string, int64, error) {
+	objects, err := s.minioClient.ListObjects(ctx, s.bucketName, prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var names []string
+	var bytes int64
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Key, ".") || obj.LastModified.After(asOf) || s.pinned(obj.Key) {
+			continue
+		}
+		names = append(names, obj.Key)
+		bytes += obj.Size
+	}
+
+	return names, bytes, nil
+}
+
+// handlePostDeletePrefix deletes every file under a prefix in two steps. The
+// first call only returns how much would be deleted along with a token, and
+// the second call with that token starts a job to delete it. If the files
+// under the prefix have changed in between the delete is refused, and files
+// uploaded since the first call are never deleted.
+func (s server) handlePostDeletePrefix(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req deletePrefixRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode delete prefix request:", err)
+		return
+	}
+	if req.Prefix == "" || strings.HasPrefix(req.Prefix, ".") {
+		// An empty prefix would be the whole bucket
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("delete prefix: bad prefix %q", req.Prefix)
+		return
+	}
+
+	if req.Token == "" {
+		s.summarizeDeletePrefix(w, r, req.Prefix)
+		return
+	}
+
+	summary, err := decodeDeleteToken(s.receiptKey, req.Token, time.Now())
+	if err != nil || summary.Prefix != req.Prefix {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("delete prefix:", errInvalidDeleteToken)
+		return
+	}
+
+	names, bytes, err := s.prefixObjects(r.Context(), summary.Prefix, summary.AsOf)
+	if err != nil {
+		writeStorageError(w, err, "delete prefix: prefix: "+summary.Prefix)
+		return
+	}
+	if len(names) != summary.Count || bytes != summary.Bytes {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("delete prefix: prefix: %s, files changed since the summary", summary.Prefix)
+		return
+	}
+
+	job, err := s.deleteJobs.start(summary.Prefix, len(names))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("delete prefix:", err)
+		return
+	}
+	go s.runDeleteJob(job, names)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(job.status())
+	if err != nil {
+		log.Println("encode delete job:", err)
+	}
+}
+
+// summarizeDeletePrefix is the first step of a bulk delete
+func (s server) summarizeDeletePrefix(w http.ResponseWriter, r *http.Request, prefix string) {
+	now := time.Now().UTC()
+	names, bytes, err := s.prefixObjects(r.Context(), prefix, now)
+	if err != nil {
+		writeStorageError(w, err, "delete prefix: prefix: "+prefix)
+		return
+	}
+
+	summary := deleteSummary{
+		Prefix:  prefix,
+		Count:   len(names),
+		Bytes:   bytes,
+		AsOf:    now,
+		Expires: now.Add(deleteTokenTTL),
+	}
+	token, err := encodeDeleteToken(s.receiptKey, summary)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("sign delete token:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(deleteSummaryResponse{deleteSummary: summary, Token: token})
+	if err != nil {
+		log.Println("encode delete summary:", err)
+	}
+}
+
+// runDeleteJob deletes the files for a bulk delete. It carries on past
+// failures, they're recorded in the job.
+func (s server) runDeleteJob(job *deleteJob, names []string) {
+	// The job outlives the request that started it
+	ctx := context.Background()
+
+	for _, name := range names {
+		unlock := s.nameLocks.lock(name)
+		err := s.minioClient.RemoveObject(ctx, s.bucketName, name)
+		if err == nil {
+			s.catalog.remove(name)
+		}
+		unlock()
+		job.done(name, err)
+	}
+
+	err := s.saveCatalog(ctx)
+	if err != nil {
+		log.Println("delete prefix: save catalog:", err)
+	}
+
+	job.finish()
+	log.Printf("delete prefix: prefix: %s, deleted: %d, failed: %d", job.Prefix, job.status().Deleted, len(job.status().Failed))
+}
+
+// deleteJobState is where a bulk delete job is up to
+type deleteJobState string
+
+const (
+	deleteJobRunning deleteJobState = "running"
+	deleteJobDone    deleteJobState = "done"
+)
+
+// deleteJobStatus is the response for GET /admin/jobs/:id
+type deleteJobStatus struct {
+	ID      string            `json:"id"`
+	Prefix  string            `json:"prefix"`
+	State   deleteJobState    `json:"state"`
+	Total   int               `json:"total"`
+	Deleted int               `json:"deleted"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// deleteJob is a bulk delete running in the background
+type deleteJob struct {
+	ID     string
+	Prefix string
+
+	mu sync.Mutex
+	st deleteJobStatus
+}
+
+func (j *deleteJob) done(name string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err != nil {
+		if j.st.Failed == nil {
+			j.st.Failed = map[string]string{}
+		}
+		j.st.Failed[name] = err.Error()
+		return
+	}
+	j.st.Deleted++
+}
+
+func (j *deleteJob) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.st.State = deleteJobDone
+}
+
+func (j *deleteJob) status() deleteJobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	st := j.st
+	if st.Failed != nil {
+		st.Failed = make(map[string]string, len(j.st.Failed))
+		for k, v := range j.st.Failed {
+			st.Failed[k] = v
+		}
+	}
+	return st
+}
+
+// deleteJobs are the bulk delete jobs since the server started
+type deleteJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*deleteJob
+}
+
+func newDeleteJobs() *deleteJobs {
+	return &deleteJobs{jobs: map[string]*deleteJob{}}
+}
+
+// start records a new job
+func (d *deleteJobs) start(prefix string, total int) (*deleteJob, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("random id: %w", err)
+	}
+
+	job := &deleteJob{ID: hex.EncodeToString(id), Prefix: prefix}
+	job.st = deleteJobStatus{ID: job.ID, Prefix: prefix, State: deleteJobRunning, Total: total}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.jobs[job.ID] = job
+
+	return job, nil
+}
+
+func (d *deleteJobs) get(id string) (*deleteJob, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	job, ok := d.jobs[id]
+	return job, ok
+}
+
+// handleGetJob returns the progress of a bulk delete job
+func (s server) handleGetJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	job, ok := s.deleteJobs.get(ps.ByName("id"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(job.status())
+	if err != nil {
+		log.Println("encode delete job:", err)
+	}
+}
@@ -0,0 +1,129 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteToken(t *testing.T) {
+	key := []byte("key")
+	now := time.Now().UTC()
+	summary := deleteSummary{Prefix: "logs/", Count: 2, Bytes: 10, AsOf: now, Expires: now.Add(time.Minute)}
+
+	token, err := encodeDeleteToken(key, summary)
+	require.NoError(t, err)
+
+	got, err := decodeDeleteToken(key, token, now)
+	require.NoError(t, err)
+	require.True(t, got.AsOf.Equal(summary.AsOf))
+	require.Equal(t, summary.Count, got.Count)
+
+	_, err = decodeDeleteToken([]byte("other key"), token, now)
+	require.ErrorIs(t, err, errInvalidDeleteToken)
+
+	_, err = decodeDeleteToken(key, token, now.Add(2*time.Minute))
+	require.ErrorIs(t, err, errInvalidDeleteToken)
+
+	_, err = decodeDeleteToken(key, "x"+token, now)
+	require.ErrorIs(t, err, errInvalidDeleteToken)
+}
+
+func TestHandlePostDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+	for _, name := range []string{"logs/a.txt", "logs/b.txt", "keep.txt"} {
+		_, err := s.putFile(ctx, name, strings.NewReader("test file contents"), 18)
+		require.NoError(t, err)
+	}
+
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/admin/delete-prefix", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"prefix": ""}`)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	w = post(`{"prefix": "logs/", "token": "made.up"}`)
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// The summary doesn't delete anything
+	w = post(`{"prefix": "logs/"}`)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var summary deleteSummaryResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&summary))
+	require.Equal(t, 2, summary.Count)
+	require.NotEmpty(t, summary.Token)
+	require.Len(t, store.objects, 3)
+
+	// The token is only good for the prefix it was issued for
+	w = post(`{"prefix": "keep", "token": "` + summary.Token + `"}`)
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	// Files uploaded since the summary are left alone
+	_, err := s.putFile(ctx, "logs/c.txt", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+	store.setModified("testBucket", "logs/c.txt", time.Now().Add(time.Minute))
+
+	w = post(`{"prefix": "logs/", "token": "` + summary.Token + `"}`)
+	require.Equal(t, http.StatusAccepted, w.Result().StatusCode)
+	var job deleteJobStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+	require.Equal(t, "/admin/jobs/"+job.ID, w.Header().Get("Location"))
+	require.Equal(t, 2, job.Total)
+
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/admin/jobs/"+job.ID, nil))
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&job))
+		return job.State == deleteJobDone
+	}, time.Second, time.Millisecond)
+	require.Equal(t, 2, job.Deleted)
+	require.Empty(t, job.Failed)
+
+	store.mu.Lock()
+	require.Contains(t, store.objects, "testBucket/keep.txt")
+	require.Contains(t, store.objects, "testBucket/logs/c.txt")
+	require.NotContains(t, store.objects, "testBucket/logs/a.txt")
+	store.mu.Unlock()
+}
+
+func TestHandlePostDeletePrefixChanged(t *testing.T) {
+	ctx := context.Background()
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+	for _, name := range []string{"logs/a.txt", "logs/b.txt"} {
+		_, err := s.putFile(ctx, name, strings.NewReader("test file contents"), 18)
+		require.NoError(t, err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/admin/delete-prefix", strings.NewReader(`{"prefix": "logs/"}`)))
+	var summary deleteSummaryResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&summary))
+
+	require.NoError(t, store.RemoveObject(ctx, "testBucket", "logs/b.txt"))
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodPost, "/admin/delete-prefix", strings.NewReader(`{"prefix": "logs/", "token": "`+summary.Token+`"}`)))
+	require.Equal(t, http.StatusConflict, w.Result().StatusCode)
+	require.Contains(t, store.objects, "testBucket/logs/a.txt")
+}
+
+func TestHandleGetJobNotFound(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, newAdminRequest(http.MethodGet, "/admin/jobs/nope", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
@@ -0,0 +1,274 @@
+package filesrv
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/minio/minio-go/v7"
+)
+
+// These are exposed at /debug/vars
+var (
+	cacheHits  = expvar.NewInt("cache_hits")
+	cacheMiss  = expvar.NewInt("cache_misses")
+	cacheBytes = expvar.NewInt("cache_bytes")
+)
+
+// cachingStore is an objStorer that keeps recently read objects in memory, so
+// hot files don't have to be fetched from minio every time. The objects are
+// cached as they are stored in the bucket, so nothing is held in memory
+// unencrypted.
+type cachingStore struct {
+	objStorer
+
+	// maxBytes is the total size of the cache, maxObjectBytes is the largest
+	// single object that will be cached
+	maxBytes       int64
+	maxObjectBytes int64
+	ttl            time.Duration
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+	// gen is bumped every time an object is invalidated, so a read that
+	// started before an object was overwritten doesn't cache the old contents
+	gen uint64
+}
+
+type cacheItem struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+func newCachingStore(store objStorer, maxBytes, maxObjectBytes int64, ttl time.Duration) *cachingStore {
+	return &cachingStore{
+		objStorer:      store,
+		maxBytes:       maxBytes,
+		maxObjectBytes: maxObjectBytes,
+		ttl:            ttl,
+		lru:            list.New(),
+		items:          map[string]*list.Element{},
+	}
+}
+
+// GetObject returns the cached copy of the object if there is one, otherwise
+// it reads the object from the store and caches it once it has been read all
+// the way through
+func (c *cachingStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	key := path.Join(bucketName, filename)
+	if data, ok := c.get(key); ok {
+		cacheHits.Add(1)
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	cacheMiss.Add(1)
+
+	c.mu.Lock()
+	gen := c.gen
+	c.mu.Unlock()
+
+	obj, err := c.objStorer.GetObject(ctx, bucketName, filename)
+	if err != nil || obj == nil {
+		return obj, err
+	}
+
+	return &cacheFiller{ReadCloser: obj, c: c, key: key, gen: gen}, nil
+}
+
+// GetObjectRange reads from the cached copy if there is one. Ranges are read
+// straight from the store otherwise, they're no good for filling the cache.
+func (c *cachingStore) GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	if data, ok := c.get(path.Join(bucketName, filename)); ok {
+		cacheHits.Add(1)
+		return io.NopCloser(bytes.NewReader(sliceRange(data, offset, length))), nil
+	}
+
+	return c.objStorer.GetObjectRange(ctx, bucketName, filename, offset, length)
+}
+
+func (c *cachingStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
+	c.remove(path.Join(bucketName, filename))
+	return c.objStorer.PutObject(ctx, bucketName, filename, file, size, chunkSize)
+}
+
+func (c *cachingStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	c.remove(path.Join(bucketName, filename))
+	return c.objStorer.CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts)
+}
+
+func (c *cachingStore) RemoveObject(ctx context.Context, bucketName, filename string) error {
+	c.remove(path.Join(bucketName, filename))
+	return c.objStorer.RemoveObject(ctx, bucketName, filename)
+}
+
+func (c *cachingStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	for _, filename := range filenames {
+		c.remove(path.Join(bucketName, filename))
+	}
+	return c.objStorer.RemoveObjects(ctx, bucketName, filenames)
+}
+
+func (c *cachingStore) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	item := e.Value.(*cacheItem)
+	if time.Now().After(item.expires) {
+		c.removeElement(e)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return item.data, true
+}
+
+// add caches an object that was read while the cache was at generation gen
+func (c *cachingStore) add(key string, data []byte, gen uint64) {
+	if int64(len(data)) > c.maxObjectBytes || int64(len(data)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheItem{key: key, data: data, expires: time.Now().Add(c.ttl)})
+	c.size += int64(len(data))
+	cacheBytes.Add(int64(len(data)))
+
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *cachingStore) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// removeElement must be called with mu held
+func (c *cachingStore) removeElement(e *list.Element) {
+	item := c.lru.Remove(e).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= int64(len(item.data))
+	cacheBytes.Add(-int64(len(item.data)))
+}
+
+// cacheFiller passes an object through from the store, keeping a copy which is
+// added to the cache if the whole object is read
+type cacheFiller struct {
+	io.ReadCloser
+	c   *cachingStore
+	key string
+	gen uint64
+
+	buf      bytes.Buffer
+	tooLarge bool
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.tooLarge {
+		f.buf.Write(p[:n])
+		if int64(f.buf.Len()) > f.c.maxObjectBytes {
+			f.tooLarge = true
+			f.buf = bytes.Buffer{}
+		}
+	}
+
+	if err == io.EOF && !f.tooLarge {
+		f.c.add(f.key, f.buf.Bytes(), f.gen)
+	}
+
+	return n, err
+}
+
+// prefetch reads each object all the way through so that it ends up in the
+// cache, it returns the error for each object that couldn't be read
+func (s server) prefetch(ctx context.Context, filenames []string) map[string]error {
+	errs := map[string]error{}
+	for _, filename := range filenames {
+		obj, err := s.minioClient.GetObject(ctx, s.bucketName, filename)
+		if err == nil && obj == nil {
+			err = errNotFound
+		}
+		if err != nil {
+			errs[filename] = err
+			continue
+		}
+
+		_, err = io.Copy(io.Discard, obj)
+		obj.Close()
+		if err != nil {
+			errs[filename] = err
+		}
+	}
+
+	return errs
+}
+
+// prefetchResult is the outcome of warming a single object
+type prefetchResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// handlePostPrefetch warms the cache with the objects named in the JSON array
+// in the request body, so the first request for them after a deploy is fast
+func (s server) handlePostPrefetch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var filenames []string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&filenames)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode prefetch list:", err)
+		return
+	}
+
+	errs := s.prefetch(r.Context(), filenames)
+
+	results := make([]prefetchResult, 0, len(filenames))
+	for _, filename := range filenames {
+		result := prefetchResult{Name: filename, OK: errs[filename] == nil}
+		if err := errs[filename]; err != nil {
+			result.Error = fmt.Sprint(err)
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(results)
+	if err != nil {
+		log.Println("encode prefetch results:", err)
+	}
+}
@@ -0,0 +1,116 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readObject reads the whole object through the store
+func readObject(t *testing.T, store objStorer, filename string) string {
+	t.Helper()
+
+	obj, err := store.GetObject(context.Background(), "testBucket", filename)
+	require.NoError(t, err)
+	defer obj.Close()
+
+	b, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func putObject(t *testing.T, store objStorer, filename, contents string) {
+	t.Helper()
+
+	_, err := store.PutObject(context.Background(), "testBucket", filename, strings.NewReader(contents), int64(len(contents)), 0)
+	require.NoError(t, err)
+}
+
+func TestCachingStore(t *testing.T) {
+	mem := newMemObjStore()
+	cache := newCachingStore(mem, 10, 6, time.Minute)
+
+	putObject(t, cache, "a", "aaaa")
+	putObject(t, cache, "b", "bbbb")
+	putObject(t, cache, "big", "bigger than 6")
+
+	// the first read goes to the store, the second comes from the cache
+	require.Equal(t, "aaaa", readObject(t, cache, "a"))
+	require.Equal(t, "aaaa", readObject(t, cache, "a"))
+	require.Equal(t, 1, mem.gets)
+
+	// objects over the size limit aren't cached
+	require.Equal(t, "bigger than 6", readObject(t, cache, "big"))
+	require.Equal(t, "bigger than 6", readObject(t, cache, "big"))
+	require.Equal(t, 3, mem.gets)
+
+	// overwriting an object invalidates it
+	putObject(t, cache, "a", "AAAA")
+	require.Equal(t, "AAAA", readObject(t, cache, "a"))
+	require.Equal(t, 4, mem.gets)
+
+	// adding b pushes the total over 10 bytes, so the least recently used
+	// object is evicted
+	require.Equal(t, "bbbb", readObject(t, cache, "b"))
+	putObject(t, mem, "c", "cccc")
+	require.Equal(t, "cccc", readObject(t, cache, "c"))
+	require.Equal(t, 6, mem.gets)
+	require.Equal(t, "bbbb", readObject(t, cache, "b"))
+	require.Equal(t, 6, mem.gets)
+	require.Equal(t, "AAAA", readObject(t, cache, "a"))
+	require.Equal(t, 7, mem.gets)
+
+	// removing an object invalidates it
+	require.NoError(t, cache.RemoveObject(context.Background(), "testBucket", "c"))
+	obj, err := cache.GetObject(context.Background(), "testBucket", "c")
+	require.NoError(t, err)
+	_, err = io.ReadAll(obj)
+	require.Error(t, err)
+}
+
+func TestCachingStoreExpiry(t *testing.T) {
+	mem := newMemObjStore()
+	cache := newCachingStore(mem, 10, 10, -time.Second)
+
+	putObject(t, cache, "a", "aaaa")
+	require.Equal(t, "aaaa", readObject(t, cache, "a"))
+	require.Equal(t, "aaaa", readObject(t, cache, "a"))
+	require.Equal(t, 2, mem.gets)
+}
+
+func TestHandlePostPrefetch(t *testing.T) {
+	mem := newMemObjStore()
+	cache := newCachingStore(mem, 1<<20, 1<<20, time.Minute)
+	s := NewServer(cache, "testBucket", "key", 10<<17)
+
+	_, err := s.putFile(context.Background(), "hot.txt", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+
+	req := newAdminRequest(http.MethodPost, "/admin/prefetch", strings.NewReader(`["hot.txt", "missing.txt"]`))
+	w := httptest.NewRecorder()
+
+	s.handlePostPrefetch(w, req, nil)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var got []prefetchResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Len(t, got, 2)
+	require.Equal(t, prefetchResult{Name: "hot.txt", OK: true}, got[0])
+	require.False(t, got[1].OK)
+	require.NotEmpty(t, got[1].Error)
+
+	// the file is now served without going to the store
+	gets := mem.gets
+	w = httptest.NewRecorder()
+	require.NoError(t, s.getFile(context.Background(), w, "hot.txt"))
+	require.Equal(t, "test file contents", w.Body.String())
+	require.Equal(t, gets, mem.gets)
+}
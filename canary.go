@@ -0,0 +1,189 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// canaryWebhookTimeout bounds how long sending an alert can take
+const canaryWebhookTimeout = 10 * time.Second
+
+// requestDetailsKey is the context key for the details of the request an
+// operation is being done for
+type requestDetailsKey struct{}
+
+// requestDetails is what is known about a request, for alerts
+type requestDetails struct {
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Query     string      `json:"query,omitempty"`
+	SourceIP  string      `json:"sourceIP"`
+	User      string      `json:"user"`
+	UserAgent string      `json:"userAgent"`
+	Header    http.Header `json:"header"`
+}
+
+// withRequestDetails adds the details of the request to its context, so code
+// that only has the context can tell who it's working for
+func withRequestDetails(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		details := requestDetails{
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Query:     r.URL.RawQuery,
+			SourceIP:  requestIP(r),
+			User:      requestIdentity(r),
+			UserAgent: r.UserAgent(),
+			Header:    r.Header.Clone(),
+		}
+		// Don't pass credentials on to wherever the alerts go
+		details.Header.Del("Authorization")
+		details.Header.Del(apiKeyHeader)
+		details.Header.Del("Cookie")
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestDetailsKey{}, details)))
+	})
+}
+
+// canaryAlert is sent when a canary object is touched
+type canaryAlert struct {
+	Object    string         `json:"object"`
+	Operation string         `json:"operation"`
+	Time      time.Time      `json:"time"`
+	Request   requestDetails `json:"request"`
+}
+
+// canaryStore wraps an objStorer and raises an alert whenever a request reads,
+// writes or deletes one of the canary objects. Nothing legitimate should ever
+// touch a canary, so any access is a sign that someone is scraping the bucket
+// or using stolen credentials.
+type canaryStore struct {
+	objStorer
+	canaries map[string]bool
+	webhook  string
+	client   *http.Client
+	// live has the redaction rules for the alerts sent to the webhook, the
+	// logged ones go through the redacting log writer
+	live *atomic.Pointer[reloadable]
+}
+
+func newCanaryStore(store objStorer, canaries []string, webhook string, live *atomic.Pointer[reloadable]) *canaryStore {
+	c := &canaryStore{
+		objStorer: store,
+		canaries:  map[string]bool{},
+		webhook:   webhook,
+		client:    &http.Client{Timeout: canaryWebhookTimeout},
+		live:      live,
+	}
+	for _, name := range canaries {
+		c.canaries[name] = true
+	}
+
+	return c
+}
+
+// check raises an alert if filename is a canary. Operations that aren't for a
+// request, like prefetching on startup, don't count.
+func (c *canaryStore) check(ctx context.Context, filename, operation string) {
+	if !c.canaries[filename] {
+		return
+	}
+	details, ok := ctx.Value(requestDetailsKey{}).(requestDetails)
+	if !ok {
+		return
+	}
+
+	alert := canaryAlert{Object: filename, Operation: operation, Time: time.Now().UTC(), Request: details}
+	b, err := json.Marshal(alert)
+	if err != nil {
+		log.Println("marshal canary alert:", err)
+		return
+	}
+	log.Printf("CANARY ALERT: %s", b)
+
+	if c.webhook != "" {
+		// The alert is sent in the background so the request doesn't get
+		// any slower, which could tip off whoever is making it
+		go c.send([]byte(c.live.Load().redactor.redact(string(b))))
+	}
+}
+
+// send posts an alert to the webhook
+func (c *canaryStore) send(alert []byte) {
+	resp, err := c.client.Post(c.webhook, "application/json", bytes.NewReader(alert))
+	if err != nil {
+		log.Println("send canary alert:", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Println("send canary alert: webhook returned", resp.Status)
+	}
+}
+
+func (c *canaryStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
+	c.check(ctx, filename, "put")
+	return c.objStorer.PutObject(ctx, bucketName, filename, file, size, chunkSize)
+}
+
+func (c *canaryStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	c.check(ctx, filename, "put")
+	return c.objStorer.CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts)
+}
+
+func (c *canaryStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	c.check(ctx, filename, "get")
+	return c.objStorer.GetObject(ctx, bucketName, filename)
+}
+
+func (c *canaryStore) GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	c.check(ctx, filename, "get")
+	return c.objStorer.GetObjectRange(ctx, bucketName, filename, offset, length)
+}
+
+func (c *canaryStore) RemoveObject(ctx context.Context, bucketName, filename string) error {
+	c.check(ctx, filename, "remove")
+	return c.objStorer.RemoveObject(ctx, bucketName, filename)
+}
+
+func (c *canaryStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	for _, filename := range filenames {
+		c.check(ctx, filename, "remove")
+	}
+	return c.objStorer.RemoveObjects(ctx, bucketName, filenames)
+}
+
+func (c *canaryStore) PutObjectTagging(ctx context.Context, bucketName, filename string, tags map[string]string) error {
+	c.check(ctx, filename, "tag")
+	return c.objStorer.PutObjectTagging(ctx, bucketName, filename, tags)
+}
+
+func (c *canaryStore) ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error {
+	c.check(ctx, filename, "metadata")
+	return c.objStorer.ReplaceObjectMetadata(ctx, bucketName, filename)
+}
+
+func (c *canaryStore) StatObject(ctx context.Context, bucketName, filename string) (minio.ObjectInfo, error) {
+	c.check(ctx, filename, "stat")
+	return c.objStorer.StatObject(ctx, bucketName, filename)
+}
+
+func (c *canaryStore) PresignedGetObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	c.check(ctx, filename, "presign")
+	return c.objStorer.PresignedGetObject(ctx, bucketName, filename, expires)
+}
+
+func (c *canaryStore) PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	c.check(ctx, filename, "presign")
+	return c.objStorer.PresignedPutObject(ctx, bucketName, filename, expires)
+}
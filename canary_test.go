@@ -0,0 +1,88 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanaryAlerts(t *testing.T) {
+	alerts := make(chan canaryAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert canaryAlert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.Canaries = "passwords.txt"
+	cfg.CanaryWebhook = webhook.URL
+	s := newServerFromConfig(newMemObjStore(), cfg)
+	router := s.routes()
+
+	ctx := context.Background()
+	var canarySHA256 string
+	for name, contents := range map[string]string{"passwords.txt": "admin:hunter2", "filename": "test file contents"} {
+		stored, err := s.putFile(ctx, name, strings.NewReader(contents), int64(len(contents)))
+		require.NoError(t, err)
+		require.NoError(t, s.index(ctx, stored))
+		if name == "passwords.txt" {
+			canarySHA256 = stored.SHA256
+		}
+	}
+
+	// Work the server does for itself doesn't raise alerts
+	require.Empty(t, s.prefetch(ctx, []string{"passwords.txt"}))
+
+	tests := []struct {
+		name      string
+		target    string
+		wantAlert bool
+	}{
+		{name: "by name", target: "/file/passwords.txt", wantAlert: true},
+		{name: "by content", target: "/content/" + canarySHA256, wantAlert: true},
+		{name: "another file", target: "/file/filename", wantAlert: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			req.Header.Set(identityHeader, "mallory")
+			req.Header.Set("Authorization", "Bearer secret")
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			if !test.wantAlert {
+				select {
+				case alert := <-alerts:
+					t.Fatalf("unexpected alert for %s", alert.Object)
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+
+			select {
+			case alert := <-alerts:
+				require.Equal(t, "passwords.txt", alert.Object)
+				require.Equal(t, "get", alert.Operation)
+				require.Equal(t, test.target, alert.Request.Path)
+				require.Equal(t, "mallory", alert.Request.User)
+				require.Equal(t, "192.0.2.1", alert.Request.SourceIP)
+				require.Empty(t, alert.Request.Header.Get("Authorization"))
+			case <-time.After(5 * time.Second):
+				t.Fatal("no alert was sent")
+			}
+		})
+	}
+}
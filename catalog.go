@@ -0,0 +1,363 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// catalogObject is where the catalog is stored in the bucket, it goes through
+// the same encryption as every other file
+const catalogObject = ".filesrv-catalog"
+
+// catalogEntry is what the catalog knows about a stored file
+type catalogEntry struct {
+	Name string `json:"name"`
+	// OriginalName is the filename the file was uploaded with, when the
+	// naming strategy stored it under a different name
+	OriginalName string `json:"originalName,omitempty"`
+	// Size is the size of the plaintext
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded checksum of the plaintext
+	SHA256      string   `json:"sha256"`
+	ContentType string   `json:"contentType,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	// ObjectTags are the key/value tags on the object in minio, Tags are
+	// only in the catalog
+	ObjectTags map[string]string `json:"objectTags,omitempty"`
+	Uploaded   time.Time         `json:"uploaded"`
+	uploadSource
+	// Encryption is how the object is encrypted in the bucket, empty means
+	// filesrv encrypted it
+	Encryption encryptionMode `json:"encryption,omitempty"`
+	// KeyID is the key filesrv encrypted the object with and
+	// EncryptionContext what the object's own key was derived with, they're
+	// empty for files stored before they were recorded
+	KeyID             string `json:"keyID,omitempty"`
+	EncryptionContext string `json:"encryptionContext,omitempty"`
+	// Pinned files are left alone by the tmp expiry and bulk deletes
+	Pinned bool `json:"pinned,omitempty"`
+	// Region is where the object is stored, empty means the main minio
+	Region string `json:"region,omitempty"`
+	// Disposition is whether the file is shown or saved by default, see
+	// dispositionOf. It and Metadata are only set with a metadata patch.
+	Disposition string            `json:"disposition,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	// Owner controls the ACL, it's whoever uploaded the first version and is
+	// only set once there's been an ACL
+	Owner string  `json:"owner,omitempty"`
+	ACL   []grant `json:"acl,omitempty"`
+	// Annotations are the comments on the file, oldest first
+	Annotations []annotation `json:"annotations,omitempty"`
+}
+
+// catalog indexes the stored files so they can be found by something other
+// than their name. It's kept in memory and saved to the bucket after every
+// change, which is fine for a demo but would want a real database in
+// production.
+type catalog struct {
+	mu      sync.RWMutex
+	entries map[string]catalogEntry
+
+	// seq is the sequence number of the latest change, and changes holds the
+	// most recent ones for the change feed
+	seq     uint64
+	changes []catalogChange
+
+	// changed is closed and replaced after every change, to wake up anything
+	// watching for changes
+	changed chan struct{}
+
+	// tombstones records when files in synced folders were deleted
+	tombstones map[string]time.Time
+
+	// usage is the bandwidth used by each key, it's saved along with the
+	// catalog
+	usage *bandwidthUsage
+	// groups are the groups managed by filesrv, they're saved along with the
+	// catalog too
+	groups *groupDirectory
+	// users are everyone's starred and recent files, also saved with the
+	// catalog
+	users *userDirectory
+
+	// saveMu makes sure snapshots are written to the bucket in the same order
+	// they were taken
+	saveMu sync.Mutex
+}
+
+func newCatalog() *catalog {
+	return &catalog{
+		entries:    map[string]catalogEntry{},
+		changed:    make(chan struct{}),
+		tombstones: map[string]time.Time{},
+		usage:      newBandwidthUsage(),
+		groups:     newGroupDirectory(),
+		users:      newUserDirectory(),
+	}
+}
+
+// catalogState is the catalog as it's saved in the bucket
+type catalogState struct {
+	Seq     uint64          `json:"seq"`
+	Entries []catalogEntry  `json:"entries"`
+	Changes []catalogChange `json:"changes"`
+
+	Tombstones map[string]time.Time `json:"tombstones,omitempty"`
+	Usage      []usageRecord        `json:"usage,omitempty"`
+	Groups     []group              `json:"groups,omitempty"`
+	Users      []userFiles          `json:"users,omitempty"`
+}
+
+// put adds or replaces the entry for a file
+func (c *catalog) put(e catalogEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	change := changeUpdate
+	if _, ok := c.entries[e.Name]; !ok {
+		change = changeCreate
+	}
+	c.entries[e.Name] = e
+	delete(c.tombstones, e.Name)
+	c.record(catalogChange{Type: change, Name: e.Name, Entry: &e})
+}
+
+// remove deletes the entry for a file, it returns false if there wasn't one
+func (c *catalog) remove(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok {
+		return false
+	}
+	delete(c.entries, name)
+	c.record(catalogChange{Type: changeDelete, Name: name, Entry: &e})
+	return true
+}
+
+// bury records that a file was deleted, and forgets about deletes older than
+// the ttl
+func (c *catalog) bury(name string, deleted time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for n, t := range c.tombstones {
+		if deleted.Sub(t) > ttl {
+			delete(c.tombstones, n)
+		}
+	}
+	c.tombstones[name] = deleted
+}
+
+// tombstonesSince returns the files deleted after the given time
+func (c *catalog) tombstonesSince(since time.Time) map[string]time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tombstones := map[string]time.Time{}
+	for n, t := range c.tombstones {
+		if t.After(since) {
+			tombstones[n] = t
+		}
+	}
+
+	return tombstones
+}
+
+// record adds a change to the feed, dropping the oldest once there are too
+// many. c.mu must be held.
+func (c *catalog) record(change catalogChange) {
+	c.seq++
+	change.Seq = c.seq
+	change.Time = time.Now().UTC()
+
+	c.changes = append(c.changes, change)
+	if len(c.changes) > maxCatalogChanges {
+		c.changes = append([]catalogChange(nil), c.changes[len(c.changes)-maxCatalogChanges:]...)
+	}
+
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// changedChan returns a channel that is closed on the next change
+func (c *catalog) changedChan() <-chan struct{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.changed
+}
+
+// get returns the entry for a file
+func (c *catalog) get(name string) (catalogEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e, ok := c.entries[name]
+	return e, ok
+}
+
+// byChecksum finds a file with the given plaintext checksum, if more than one
+// file has the same contents the most recently uploaded one is returned
+func (c *catalog) byChecksum(sha256 string) (catalogEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var found catalogEntry
+	var ok bool
+	for _, e := range c.entries {
+		if e.SHA256 == sha256 && (!ok || e.Uploaded.After(found.Uploaded)) {
+			found, ok = e, true
+		}
+	}
+
+	return found, ok
+}
+
+// snapshot returns all of the entries sorted by name
+func (c *catalog) snapshot() []catalogEntry {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entries := make([]catalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	return entries
+}
+
+// state returns everything that needs saving
+func (c *catalog) state() catalogState {
+	entries := c.snapshot()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tombstones := make(map[string]time.Time, len(c.tombstones))
+	for n, t := range c.tombstones {
+		tombstones[n] = t
+	}
+
+	return catalogState{
+		Seq:        c.seq,
+		Entries:    entries,
+		Changes:    append([]catalogChange(nil), c.changes...),
+		Tombstones: tombstones,
+		Usage:      c.usage.records("", "", ""),
+		Groups:     c.groups.list(),
+		Users:      c.users.list(),
+	}
+}
+
+// restore replaces the contents of the catalog
+func (c *catalog) restore(state catalogState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]catalogEntry, len(state.Entries))
+	for _, e := range state.Entries {
+		c.entries[e.Name] = e
+	}
+	c.seq = state.Seq
+	c.changes = state.Changes
+	c.tombstones = state.Tombstones
+	if c.tombstones == nil {
+		c.tombstones = map[string]time.Time{}
+	}
+	c.usage.restore(state.Usage)
+	c.groups.restore(state.Groups)
+	c.users.restore(state.Users)
+}
+
+// index adds a newly stored file to the catalog and saves it
+func (s server) index(ctx context.Context, stored storedFile) error {
+	e := catalogEntry{
+		Name:         stored.Name,
+		Size:         stored.Size,
+		SHA256:       stored.SHA256,
+		ContentType:  stored.ContentType,
+		Tags:         stored.Tags,
+		ObjectTags:   stored.ObjectTags,
+		Uploaded:     time.Now().UTC(),
+		uploadSource: stored.Source,
+		Region:       stored.Region,
+	}
+	if stored.OriginalName != stored.Name {
+		e.OriginalName = stored.OriginalName
+	}
+	s.recordEncryption(&e)
+	// A new version of a pinned file stays pinned, one with an ACL keeps it
+	// and its owner, and the discussion of the file carries on
+	e.Pinned = s.pinned(stored.Name)
+	prev, ok := s.catalog.get(stored.Name)
+	if ok && prev.Owner != "" {
+		e.Owner = prev.Owner
+		e.ACL = prev.ACL
+	}
+	e.Annotations = prev.Annotations
+	// Files sent to a drop box belong to its owner rather than the sender
+	if box, ok := s.dropBoxFor(stored.Name); ok && e.Owner == "" {
+		e.Owner = box.Owner
+	}
+	s.catalog.put(e)
+
+	return s.saveCatalog(ctx)
+}
+
+// unindex removes a deleted file from the catalog and saves it
+func (s server) unindex(ctx context.Context, name string) error {
+	if !s.catalog.remove(name) {
+		return nil
+	}
+
+	return s.saveCatalog(ctx)
+}
+
+// saveCatalog writes the catalog to the bucket
+func (s server) saveCatalog(ctx context.Context) error {
+	s.catalog.saveMu.Lock()
+	defer s.catalog.saveMu.Unlock()
+
+	b, err := json.Marshal(s.catalog.state())
+	if err != nil {
+		return fmt.Errorf("marshal catalog: %w", err)
+	}
+
+	_, err = s.putFile(ctx, catalogObject, bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return fmt.Errorf("save catalog: %w", err)
+	}
+
+	return nil
+}
+
+// loadCatalog reads the catalog back from the bucket, a missing catalog is
+// treated as an empty one
+func (s server) loadCatalog(ctx context.Context) error {
+	var b bytes.Buffer
+	err := s.getFile(ctx, &b, catalogObject)
+	if errors.Is(err, errNotFound) {
+		s.catalog.restore(catalogState{})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("load catalog: %w", err)
+	}
+
+	var state catalogState
+	err = json.Unmarshal(b.Bytes(), &state)
+	if err != nil {
+		return fmt.Errorf("unmarshal catalog: %w", err)
+	}
+
+	s.catalog.restore(state)
+	return nil
+}
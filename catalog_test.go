@@ -0,0 +1,49 @@
+package filesrv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogPersistence(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	// a missing catalog is an empty one
+	require.NoError(t, s.loadCatalog(context.Background()))
+	require.Empty(t, s.catalog.snapshot())
+
+	require.NoError(t, s.index(context.Background(), storedFile{Name: "a.txt", Size: 1, SHA256: "aa"}))
+	require.NoError(t, s.index(context.Background(), storedFile{Name: "b.txt", Size: 2, SHA256: "bb"}))
+	require.NoError(t, s.unindex(context.Background(), "a.txt"))
+
+	restarted := NewServer(store, "testBucket", "key", 10<<17)
+	require.NoError(t, restarted.loadCatalog(context.Background()))
+
+	entries := restarted.catalog.snapshot()
+	require.Len(t, entries, 1)
+	require.Equal(t, "b.txt", entries[0].Name)
+	require.Equal(t, int64(2), entries[0].Size)
+	require.Equal(t, "bb", entries[0].SHA256)
+}
+
+func TestCatalogByChecksum(t *testing.T) {
+	c := newCatalog()
+	now := time.Now()
+
+	c.put(catalogEntry{Name: "old.txt", SHA256: "aa", Uploaded: now.Add(-time.Hour)})
+	c.put(catalogEntry{Name: "new.txt", SHA256: "aa", Uploaded: now})
+	c.put(catalogEntry{Name: "other.txt", SHA256: "bb", Uploaded: now})
+
+	e, ok := c.byChecksum("aa")
+	require.True(t, ok)
+	require.Equal(t, "new.txt", e.Name)
+
+	// overwriting a file with different contents removes the old checksum
+	c.put(catalogEntry{Name: "other.txt", SHA256: "cc", Uploaded: now})
+	_, ok = c.byChecksum("bb")
+	require.False(t, ok)
+}
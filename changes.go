@@ -0,0 +1,153 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxCatalogChanges is how many changes the catalog keeps for the change
+	// feed, clients that fall further behind have to start again from a full
+	// listing
+	maxCatalogChanges = 10000
+	// defaultChangesLimit is how many changes are returned at once when the
+	// client doesn't ask for a number
+	defaultChangesLimit = 1000
+)
+
+// changeType is what happened to a file
+type changeType string
+
+const (
+	changeCreate changeType = "create"
+	changeUpdate changeType = "update"
+	changeDelete changeType = "delete"
+)
+
+// catalogChange is a single event in the change feed
+type catalogChange struct {
+	Seq  uint64     `json:"seq"`
+	Type changeType `json:"type"`
+	Name string     `json:"name"`
+	Time time.Time  `json:"time"`
+	// Entry is the catalog entry after the change, or before it for deletes.
+	// The feed leaves it out for deletes, see visibleChanges.
+	Entry *catalogEntry `json:"entry,omitempty"`
+}
+
+// visibleChanges returns the changes to files the request can read, as the
+// feed shows them. Who uploaded a file from where, its keys and its ACL are
+// left out, and so is the entry for deletes.
+func (s server) visibleChanges(r *http.Request, changes []catalogChange) []catalogChange {
+	visible := []catalogChange{}
+	for _, c := range changes {
+		e := catalogEntry{Name: c.Name}
+		if c.Entry != nil {
+			e = *c.Entry
+		}
+		if !s.allowed(r, e, accessRead) {
+			continue
+		}
+
+		c.Entry = nil
+		if c.Type != changeDelete {
+			e.uploadSource = uploadSource{}
+			e.KeyID = ""
+			e.EncryptionContext = ""
+			e.Owner = ""
+			e.ACL = nil
+			c.Entry = &e
+		}
+		visible = append(visible, c)
+	}
+
+	return visible
+}
+
+// changesSince returns up to limit changes after the given sequence number in
+// order, and false if some of the changes after it have already been dropped
+func (c *catalog) changesSince(since uint64, limit int) ([]catalogChange, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if since > c.seq {
+		return nil, false
+	}
+	if since == c.seq {
+		return []catalogChange{}, true
+	}
+	if len(c.changes) == 0 || c.changes[0].Seq > since+1 {
+		return nil, false
+	}
+
+	// The changes have consecutive sequence numbers, so the first one wanted
+	// can be found directly
+	start := int(since + 1 - c.changes[0].Seq)
+	end := min(start+limit, len(c.changes))
+
+	return append([]catalogChange(nil), c.changes[start:end]...), true
+}
+
+// changesResponse is a page of the change feed
+type changesResponse struct {
+	Changes []catalogChange `json:"changes"`
+	// Cursor is passed as since to get the changes after this page
+	Cursor string `json:"cursor"`
+	// More is true if there are already more changes after this page
+	More bool `json:"more"`
+}
+
+// handleGetChanges returns the changes to the catalog after the cursor in
+// since, or from the start if there isn't one, so clients can follow the store
+// without listing everything. A cursor that is too old to follow on from gets
+// 410 Gone, the client has to start again from a full listing.
+func (s server) handleGetChanges(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultChangesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = min(n, defaultChangesLimit)
+	}
+
+	changes, ok := s.catalog.changesSince(since, limit)
+	if !ok {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	// The cursor is from every change, so the ones the client can't see
+	// aren't sent again
+	resp := changesResponse{Changes: s.visibleChanges(r, changes), Cursor: strconv.FormatUint(since, 10)}
+	if len(changes) > 0 {
+		last := changes[len(changes)-1].Seq
+		resp.Cursor = strconv.FormatUint(last, 10)
+		resp.More = last < s.catalog.latestSeq()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// latestSeq returns the sequence number of the most recent change
+func (c *catalog) latestSeq() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.seq
+}
@@ -0,0 +1,165 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetChanges(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	router := s.routes()
+
+	ctx := context.Background()
+	require.NoError(t, s.index(ctx, storedFile{Name: "a.txt", SHA256: "aa"}))
+	require.NoError(t, s.index(ctx, storedFile{Name: "b.txt", SHA256: "bb"}))
+	require.NoError(t, s.index(ctx, storedFile{Name: "a.txt", SHA256: "cc"}))
+	require.NoError(t, s.unindex(ctx, "b.txt"))
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantTypes  []changeType
+		wantCursor string
+		wantMore   bool
+	}{
+		{
+			name:       "from the start",
+			target:     "/changes",
+			wantStatus: http.StatusOK,
+			wantTypes:  []changeType{changeCreate, changeCreate, changeUpdate, changeDelete},
+			wantCursor: "4",
+		},
+		{
+			name:       "since a cursor",
+			target:     "/changes?since=2",
+			wantStatus: http.StatusOK,
+			wantTypes:  []changeType{changeUpdate, changeDelete},
+			wantCursor: "4",
+		},
+		{
+			name:       "limited",
+			target:     "/changes?since=1&limit=2",
+			wantStatus: http.StatusOK,
+			wantTypes:  []changeType{changeCreate, changeUpdate},
+			wantCursor: "3",
+			wantMore:   true,
+		},
+		{
+			name:       "up to date",
+			target:     "/changes?since=4",
+			wantStatus: http.StatusOK,
+			wantTypes:  []changeType{},
+			wantCursor: "4",
+		},
+		{
+			name:       "cursor from the future",
+			target:     "/changes?since=5",
+			wantStatus: http.StatusGone,
+		},
+		{
+			name:       "bad cursor",
+			target:     "/changes?since=abc",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bad limit",
+			target:     "/changes?limit=0",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			var resp changesResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+			types := []changeType{}
+			for _, c := range resp.Changes {
+				types = append(types, c.Type)
+				require.Equal(t, c.Type == changeDelete, c.Entry == nil)
+			}
+			require.Equal(t, test.wantTypes, types)
+			require.Equal(t, test.wantCursor, resp.Cursor)
+			require.Equal(t, test.wantMore, resp.More)
+		})
+	}
+}
+
+func TestChangesHidePrivateFiles(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	router := s.routes()
+
+	s.catalog.put(catalogEntry{Name: "open.txt", KeyID: "k1", uploadSource: uploadSource{UploadedBy: "alice", SourceIP: "192.0.2.7", UserAgent: "curl"}})
+	s.catalog.put(catalogEntry{Name: "private.txt", Owner: "alice", ACL: []grant{{User: "carol", Access: accessRead}}})
+	s.catalog.remove("private.txt")
+
+	get := func(target, user string) changesResponse {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var resp changesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+
+	for _, target := range []string{"/changes", "/watch?since=0"} {
+		resp := get(target, "bob")
+		require.Len(t, resp.Changes, 1, target)
+		require.Equal(t, "3", resp.Cursor, target)
+		require.Equal(t, catalogEntry{Name: "open.txt"}, *resp.Changes[0].Entry, target)
+
+		resp = get(target, "carol")
+		require.Len(t, resp.Changes, 3, target)
+		require.Equal(t, catalogEntry{Name: "private.txt"}, *resp.Changes[1].Entry, target)
+		require.Nil(t, resp.Changes[2].Entry, target)
+	}
+}
+
+func TestCatalogChangesTruncated(t *testing.T) {
+	c := newCatalog()
+	for i := 0; i < maxCatalogChanges+5; i++ {
+		c.put(catalogEntry{Name: "a.txt"})
+	}
+
+	_, ok := c.changesSince(0, 10)
+	require.False(t, ok)
+
+	changes, ok := c.changesSince(5, 10)
+	require.True(t, ok)
+	require.Equal(t, uint64(6), changes[0].Seq)
+}
+
+func TestChangesPersistence(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	require.NoError(t, s.index(context.Background(), storedFile{Name: "a.txt"}))
+	require.NoError(t, s.unindex(context.Background(), "a.txt"))
+
+	restarted := NewServer(store, "testBucket", "key", 10<<17)
+	require.NoError(t, restarted.loadCatalog(context.Background()))
+
+	changes, ok := restarted.catalog.changesSince(0, 10)
+	require.True(t, ok)
+	require.Len(t, changes, 2)
+
+	// New changes carry on from the saved sequence number
+	restarted.catalog.put(catalogEntry{Name: "b.txt"})
+	require.Equal(t, uint64(3), restarted.catalog.latestSeq())
+}
@@ -0,0 +1,326 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/minio/minio-go/v7"
+)
+
+// chaosReadSpan is how far into an object a GetObject can be cut off
+const chaosReadSpan = 1 << 20
+
+// chaosOperations are the operations faults can be limited to
+var chaosOperations = []string{"put", "get", "remove", "list", "stat", "multipart", "presign"}
+
+// chaosFaults are the faults chaosStore injects
+type chaosFaults struct {
+	// Latency is added to every operation, with up to Jitter more at random
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the fraction of operations that fail with the minio
+	// ErrorCode, SlowDown unless it's set
+	ErrorRate float64
+	ErrorCode string
+	// PartialReadRate is the fraction of reads that are cut off part way
+	// through the object
+	PartialReadRate float64
+	// Operations limits the faults to some of chaosOperations, empty means
+	// every operation
+	Operations []string
+}
+
+// chaosFaultsJSON is how the faults are set and shown at /admin/chaos
+type chaosFaultsJSON struct {
+	Latency         string   `json:"latency"`
+	Jitter          string   `json:"jitter"`
+	ErrorRate       float64  `json:"errorRate"`
+	ErrorCode       string   `json:"errorCode"`
+	PartialReadRate float64  `json:"partialReadRate"`
+	Operations      []string `json:"operations"`
+}
+
+// chaosStore is an objStorer that injects latency, errors and cut off reads
+// into the store underneath, so retries, timeouts and the storage error
+// handling can be tried out before minio has a real incident. It's only used
+// with -chaos, and injects nothing until faults are set with /admin/chaos.
+type chaosStore struct {
+	objStorer
+	faults atomic.Pointer[chaosFaults]
+}
+
+func newChaosStore(store objStorer) *chaosStore {
+	c := &chaosStore{objStorer: store}
+	c.faults.Store(&chaosFaults{})
+	return c
+}
+
+// inject waits for the latency and returns the injected error, if there is
+// one, for an operation
+func (c *chaosStore) inject(ctx context.Context, operation string) error {
+	f := c.faults.Load()
+	if len(f.Operations) > 0 && !slices.Contains(f.Operations, operation) {
+		return nil
+	}
+
+	if delay := f.Latency + time.Duration(rand.Int63n(int64(f.Jitter)+1)); delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+
+	if rand.Float64() < f.ErrorRate {
+		return minio.ErrorResponse{Code: f.ErrorCode, Message: "injected by chaos mode"}
+	}
+
+	return nil
+}
+
+// cutOff wraps a reader that's been picked to be cut off part way through
+func (c *chaosStore) cutOff(obj io.ReadCloser, size int64) io.ReadCloser {
+	f := c.faults.Load()
+	if obj == nil || (len(f.Operations) > 0 && !slices.Contains(f.Operations, "get")) || rand.Float64() >= f.PartialReadRate {
+		return obj
+	}
+
+	return &partialReader{ReadCloser: obj, left: rand.Int63n(max(size, 1))}
+}
+
+// partialReader fails with io.ErrUnexpectedEOF after left bytes, like a
+// connection to minio dropping
+type partialReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (p *partialReader) Read(b []byte) (int, error) {
+	if p.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n, err := p.ReadCloser.Read(b[:min(int64(len(b)), p.left)])
+	p.left -= int64(n)
+	return n, err
+}
+
+func (c *chaosStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
+	if err := c.inject(ctx, "put"); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return c.objStorer.PutObject(ctx, bucketName, filename, file, size, chunkSize)
+}
+
+// GetObject is cut off somewhere in the first chaosReadSpan bytes, since the
+// size of the object isn't known without a stat
+func (c *chaosStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	if err := c.inject(ctx, "get"); err != nil {
+		return nil, err
+	}
+	obj, err := c.objStorer.GetObject(ctx, bucketName, filename)
+	if err != nil {
+		return obj, err
+	}
+	return c.cutOff(obj, chaosReadSpan), nil
+}
+
+func (c *chaosStore) GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	if err := c.inject(ctx, "get"); err != nil {
+		return nil, err
+	}
+	obj, err := c.objStorer.GetObjectRange(ctx, bucketName, filename, offset, length)
+	if err != nil {
+		return obj, err
+	}
+	return c.cutOff(obj, length), nil
+}
+
+func (c *chaosStore) RemoveObject(ctx context.Context, bucketName, filename string) error {
+	if err := c.inject(ctx, "remove"); err != nil {
+		return err
+	}
+	return c.objStorer.RemoveObject(ctx, bucketName, filename)
+}
+
+// RemoveObjects fails as a whole, like the bulk delete request failing
+func (c *chaosStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	if err := c.inject(ctx, "remove"); err != nil {
+		errs := make(map[string]error, len(filenames))
+		for _, filename := range filenames {
+			errs[filename] = err
+		}
+		return errs
+	}
+	return c.objStorer.RemoveObjects(ctx, bucketName, filenames)
+}
+
+func (c *chaosStore) ListObjects(ctx context.Context, bucketName, prefix string) ([]minio.ObjectInfo, error) {
+	if err := c.inject(ctx, "list"); err != nil {
+		return nil, err
+	}
+	return c.objStorer.ListObjects(ctx, bucketName, prefix)
+}
+
+func (c *chaosStore) PutObjectTagging(ctx context.Context, bucketName, filename string, tags map[string]string) error {
+	if err := c.inject(ctx, "put"); err != nil {
+		return err
+	}
+	return c.objStorer.PutObjectTagging(ctx, bucketName, filename, tags)
+}
+
+func (c *chaosStore) ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error {
+	if err := c.inject(ctx, "put"); err != nil {
+		return err
+	}
+	return c.objStorer.ReplaceObjectMetadata(ctx, bucketName, filename)
+}
+
+func (c *chaosStore) StatObject(ctx context.Context, bucketName, filename string) (minio.ObjectInfo, error) {
+	if err := c.inject(ctx, "stat"); err != nil {
+		return minio.ObjectInfo{}, err
+	}
+	return c.objStorer.StatObject(ctx, bucketName, filename)
+}
+
+func (c *chaosStore) ListIncompleteUploads(ctx context.Context, bucketName, prefix string) ([]minio.ObjectMultipartInfo, error) {
+	if err := c.inject(ctx, "list"); err != nil {
+		return nil, err
+	}
+	return c.objStorer.ListIncompleteUploads(ctx, bucketName, prefix)
+}
+
+func (c *chaosStore) AbortMultipartUpload(ctx context.Context, bucketName, filename, uploadID string) error {
+	if err := c.inject(ctx, "multipart"); err != nil {
+		return err
+	}
+	return c.objStorer.AbortMultipartUpload(ctx, bucketName, filename, uploadID)
+}
+
+func (c *chaosStore) NewMultipartUpload(ctx context.Context, bucketName, filename string) (string, error) {
+	if err := c.inject(ctx, "multipart"); err != nil {
+		return "", err
+	}
+	return c.objStorer.NewMultipartUpload(ctx, bucketName, filename)
+}
+
+func (c *chaosStore) PutObjectPart(ctx context.Context, bucketName, filename, uploadID string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error) {
+	if err := c.inject(ctx, "multipart"); err != nil {
+		return minio.ObjectPart{}, err
+	}
+	return c.objStorer.PutObjectPart(ctx, bucketName, filename, uploadID, partNumber, data, size)
+}
+
+func (c *chaosStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	if err := c.inject(ctx, "multipart"); err != nil {
+		return minio.UploadInfo{}, err
+	}
+	return c.objStorer.CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts)
+}
+
+func (c *chaosStore) PresignedGetObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	if err := c.inject(ctx, "presign"); err != nil {
+		return nil, err
+	}
+	return c.objStorer.PresignedGetObject(ctx, bucketName, filename, expires)
+}
+
+func (c *chaosStore) PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	if err := c.inject(ctx, "presign"); err != nil {
+		return nil, err
+	}
+	return c.objStorer.PresignedPutObject(ctx, bucketName, filename, expires)
+}
+
+// handleGetChaos returns the faults being injected, it's a 404 unless the
+// server was started with -chaos
+func (s server) handleGetChaos(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	if s.chaos == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f := s.chaos.faults.Load()
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(chaosFaultsJSON{
+		Latency:         f.Latency.String(),
+		Jitter:          f.Jitter.String(),
+		ErrorRate:       f.ErrorRate,
+		ErrorCode:       f.ErrorCode,
+		PartialReadRate: f.PartialReadRate,
+		Operations:      f.Operations,
+	})
+	if err != nil {
+		log.Println("encode chaos faults:", err)
+	}
+}
+
+// handlePutChaos replaces the faults being injected, an empty body turns them
+// all off
+func (s server) handlePutChaos(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if s.chaos == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var req chaosFaultsJSON
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f := &chaosFaults{
+		ErrorRate:       req.ErrorRate,
+		ErrorCode:       req.ErrorCode,
+		PartialReadRate: req.PartialReadRate,
+		Operations:      req.Operations,
+	}
+	if f.ErrorCode == "" {
+		f.ErrorCode = "SlowDown"
+	}
+	f.Latency, err = parseOptionalDuration(req.Latency)
+	if err != nil || f.Latency < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.Jitter, err = parseOptionalDuration(req.Jitter)
+	if err != nil || f.Jitter < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if f.ErrorRate < 0 || f.ErrorRate > 1 || f.PartialReadRate < 0 || f.PartialReadRate > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, op := range f.Operations {
+		if !slices.Contains(chaosOperations, op) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.chaos.faults.Store(f)
+	log.Printf("chaos: injecting latency %s, jitter %s, error rate %g (%s), partial read rate %g, operations %v",
+		f.Latency, f.Jitter, f.ErrorRate, f.ErrorCode, f.PartialReadRate, f.Operations)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseOptionalDuration is time.ParseDuration with empty meaning zero
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
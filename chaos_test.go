@@ -0,0 +1,81 @@
+package filesrv
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChaosStore(t *testing.T) {
+	store := newMemObjStore()
+	c := newChaosStore(store)
+	ctx := context.Background()
+
+	contents := strings.Repeat("0123456789", 100)
+	_, err := c.PutObject(ctx, "testBucket", "file", strings.NewReader(contents), int64(len(contents)), 0)
+	require.NoError(t, err, "nothing is injected to start with")
+
+	t.Run("errors", func(t *testing.T) {
+		c.faults.Store(&chaosFaults{ErrorRate: 1, ErrorCode: "SlowDown", Operations: []string{"stat"}})
+
+		_, err := c.StatObject(ctx, "testBucket", "file")
+		require.Equal(t, http.StatusServiceUnavailable, storageStatus(err))
+		_, err = c.ListObjects(ctx, "testBucket", "")
+		require.NoError(t, err, "only stat is affected")
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		c.faults.Store(&chaosFaults{Latency: time.Hour})
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err := c.GetObject(ctx, "testBucket", "file")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("partial reads", func(t *testing.T) {
+		c.faults.Store(&chaosFaults{PartialReadRate: 1})
+
+		obj, err := c.GetObjectRange(ctx, "testBucket", "file", 0, int64(len(contents)))
+		require.NoError(t, err)
+		got, err := io.ReadAll(obj)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		require.Less(t, len(got), len(contents))
+		require.Equal(t, contents[:len(got)], string(got))
+	})
+}
+
+func TestChaosAdmin(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, newAdminRequest(method, "/admin/chaos", strings.NewReader(body)))
+		return w
+	}
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "").Result().StatusCode, "only with -chaos")
+
+	s.chaos = newChaosStore(s.minioClient)
+	s.minioClient = s.chaos
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, `{"latency": "100ms", "errorRate": 0.5, "operations": ["get"]}`).Result().StatusCode)
+	require.Equal(t, &chaosFaults{Latency: 100 * time.Millisecond, ErrorRate: 0.5, ErrorCode: "SlowDown", Operations: []string{"get"}}, s.chaos.faults.Load())
+
+	w := do(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.JSONEq(t, `{"latency": "100ms", "jitter": "0s", "errorRate": 0.5, "errorCode": "SlowDown", "partialReadRate": 0, "operations": ["get"]}`, w.Body.String())
+
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPut, `{"errorRate": 2}`).Result().StatusCode)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPut, `{"operations": ["delete"]}`).Result().StatusCode)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPut, `{"latency": "soon"}`).Result().StatusCode)
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, "").Result().StatusCode, "an empty body turns everything off")
+	require.Zero(t, s.chaos.faults.Load().ErrorRate)
+}
@@ -0,0 +1,161 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// checkObject is the name of the object used to probe the bucket permissions
+// in `filesrv check`
+const checkObject = ".filesrv-check"
+
+// minChunkSize is the smallest part size minio will accept for multipart
+// uploads
+const minChunkSize = 5 << 20
+
+// maxUploadParts is the most parts minio will take for one multipart upload
+const maxUploadParts = 10000
+
+// errSkipped is returned by a check that doesn't apply to this setup
+var errSkipped = errors.New("skipped")
+
+// readinessCheck is a single line of the `filesrv check` report
+type readinessCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// validateConfig checks the server settings for values that can't work
+func (s server) validateConfig() error {
+	if s.bucketName == "" {
+		return errors.New("bucket name is empty")
+	}
+	if s.encryptionKey == "" {
+		return errors.New("encryption key is empty")
+	}
+	if s.chunkSize < minChunkSize {
+		return fmt.Errorf("chunk size %d is smaller than the minimum of %d", s.chunkSize, minChunkSize)
+	}
+
+	return nil
+}
+
+// readinessChecks returns the checks run by `filesrv check` in the order they
+// should run. The permission checks go through the same code paths as the
+// handlers, so a pass means uploads and downloads will work.
+func (s server) readinessChecks() []readinessCheck {
+	contents := []byte("filesrv check " + time.Now().UTC().Format(time.RFC3339Nano))
+
+	return []readinessCheck{
+		{name: "config", run: func(context.Context) error {
+			return s.validateConfig()
+		}},
+		{name: "connect", run: func(ctx context.Context) error {
+			_, err := s.minioClient.ListObjects(ctx, s.bucketName, checkObject)
+			return err
+		}},
+		{name: "put", run: func(ctx context.Context) error {
+			_, err := s.putFile(ctx, checkObject, bytes.NewReader(contents), int64(len(contents)))
+			return err
+		}},
+		{name: "get", run: func(ctx context.Context) error {
+			var got bytes.Buffer
+			err := s.getFile(ctx, &got, checkObject)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(contents, got.Bytes()) {
+				return errors.New("read back contents do not match")
+			}
+			return nil
+		}},
+		{name: "encrypted", run: func(ctx context.Context) error {
+			// What's in the bucket mustn't give the contents away, in case
+			// the encryption was skipped somewhere
+			obj, err := s.minioClient.GetObject(ctx, s.bucketName, checkObject)
+			if err != nil {
+				return err
+			}
+			defer obj.Close()
+			stored, err := io.ReadAll(obj)
+			if err != nil {
+				return err
+			}
+			if bytes.Contains(stored, contents) {
+				return errors.New("probe object is stored in plaintext")
+			}
+			return nil
+		}},
+		{name: "list", run: func(ctx context.Context) error {
+			objects, err := s.minioClient.ListObjects(ctx, s.bucketName, checkObject)
+			if err != nil {
+				return err
+			}
+			for _, obj := range objects {
+				if obj.Key == checkObject {
+					return nil
+				}
+			}
+			return errors.New("probe object missing from listing")
+		}},
+		{name: "delete", run: func(ctx context.Context) error {
+			err := s.minioClient.RemoveObject(ctx, s.bucketName, checkObject)
+			if err != nil {
+				return err
+			}
+			_, err = s.minioClient.StatObject(ctx, s.bucketName, checkObject)
+			if storageErrorCode(err) != "NoSuchKey" {
+				return fmt.Errorf("probe object still there after delete: %v", err)
+			}
+			return nil
+		}},
+		{name: "kms", run: func(ctx context.Context) error {
+			if s.secrets == nil {
+				// The encryption key is in the config
+				return errSkipped
+			}
+			sec, err := s.secrets.fetch(ctx)
+			if err != nil {
+				return err
+			}
+			if sec.EncryptionKey != s.encryptionKey {
+				return errors.New("encryption key in vault differs from the one in use")
+			}
+			return nil
+		}},
+	}
+}
+
+// check runs all of the readiness checks, writes a report to out and returns
+// whether the server is ready to serve traffic
+func (s server) check(ctx context.Context, out io.Writer) bool {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	ready := true
+
+	for _, c := range s.readinessChecks() {
+		err := c.run(ctx)
+		switch {
+		case errors.Is(err, errSkipped):
+			fmt.Fprintf(tw, "%s\tskipped\n", c.name)
+		case err != nil:
+			ready = false
+			fmt.Fprintf(tw, "%s\tFAIL\t%s\n", c.name, err)
+		default:
+			fmt.Fprintf(tw, "%s\tok\n", c.name)
+		}
+	}
+
+	if ready {
+		fmt.Fprintln(tw, "\nready")
+	} else {
+		fmt.Fprintln(tw, "\nnot ready")
+	}
+	tw.Flush()
+
+	return ready
+}
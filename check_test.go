@@ -0,0 +1,137 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *memObjStore
+		chunkSize  int64
+		wantReady  bool
+		wantStatus map[string]string
+	}{
+		{
+			name:      "should work",
+			store:     newMemObjStore(),
+			chunkSize: minChunkSize,
+			wantReady: true,
+			wantStatus: map[string]string{
+				"config": "ok", "connect": "ok", "put": "ok", "get": "ok",
+				"encrypted": "ok", "list": "ok", "delete": "ok", "kms": "skipped",
+			},
+		},
+		{
+			name:       "chunk size too small",
+			store:      newMemObjStore(),
+			chunkSize:  10 << 17,
+			wantStatus: map[string]string{"config": "FAIL", "put": "ok"},
+		},
+		{
+			name: "list error",
+			store: func() *memObjStore {
+				m := newMemObjStore()
+				m.listErr = errors.New("a list error")
+				return m
+			}(),
+			chunkSize:  minChunkSize,
+			wantStatus: map[string]string{"connect": "FAIL", "put": "ok", "list": "FAIL"},
+		},
+		{
+			name: "corrupted object",
+			store: func() *memObjStore {
+				m := newMemObjStore()
+				m.corrupt = true
+				return m
+			}(),
+			chunkSize:  minChunkSize,
+			wantStatus: map[string]string{"get": "FAIL", "delete": "ok"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(test.store, "testBucket", "key", test.chunkSize)
+
+			var out strings.Builder
+			ready := s.check(context.Background(), &out)
+
+			require.Equal(t, test.wantReady, ready)
+
+			status := map[string]string{}
+			for _, line := range strings.Split(out.String(), "\n") {
+				if fields := strings.Fields(line); len(fields) >= 2 {
+					status[fields[0]] = fields[1]
+				}
+			}
+			for name, want := range test.wantStatus {
+				require.Equal(t, want, status[name], name)
+			}
+		})
+	}
+}
+
+func TestCheckVault(t *testing.T) {
+	srv := fakeVault(t, `{"data":{"minio-access-key":"ak","minio-secret-key":"sk","encryption-key":"key"}}`)
+
+	tests := []struct {
+		name    string
+		addr    string
+		token   string
+		key     string
+		wantErr string
+	}{
+		{name: "should work", addr: srv.URL, token: "root", key: "key"},
+		{name: "wrong token", addr: srv.URL, token: "nope", key: "key", wantErr: "403 Forbidden"},
+		{name: "key changed", addr: srv.URL, token: "root", key: "old key", wantErr: "differs from the one in use"},
+		{name: "unreachable", addr: "http://127.0.0.1:1", token: "root", key: "key", wantErr: "vault request"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Bucket = "testBucket"
+			cfg.EncryptionKey = test.key
+			cfg.ChunkSize = minChunkSize
+			cfg.VaultAddr = test.addr
+			cfg.VaultToken = test.token
+			cfg.VaultPath = "secret/data/filesrv"
+			s := newServerFromConfig(newMemObjStore(), cfg)
+
+			var out strings.Builder
+			ready := s.check(context.Background(), &out)
+			require.Equal(t, test.wantErr == "", ready, out.String())
+
+			if test.wantErr == "" {
+				require.Contains(t, out.String(), "kms        ok")
+			} else {
+				require.Contains(t, out.String(), "kms        FAIL")
+				require.Contains(t, out.String(), test.wantErr)
+			}
+		})
+	}
+}
+
+// keepingStore says objects were removed without removing them, like a bucket
+// with a policy that denies deletes silently
+type keepingStore struct {
+	*memObjStore
+}
+
+func (keepingStore) RemoveObject(context.Context, string, string) error {
+	return nil
+}
+
+func TestCheckDeleteIgnored(t *testing.T) {
+	s := NewServer(keepingStore{newMemObjStore()}, "testBucket", "key", minChunkSize)
+
+	var out strings.Builder
+	require.False(t, s.check(context.Background(), &out))
+	require.Contains(t, out.String(), "delete     FAIL  probe object still there after delete")
+}
@@ -0,0 +1,222 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/sio"
+)
+
+// chunkedUpload is a file being stored a part at a time over more than one
+// request, as a minio multipart upload. Each part is encrypted on its own, but
+// as a piece of one DARE stream: the packages share a nonce and are numbered
+// from where the part starts in the file, so the finished object decrypts
+// just like one stored by putFile. Since a part sent again is encrypted with
+// the same nonce and sequence numbers, it has to have the same contents, or
+// the same keystream would be used for two plaintexts.
+type chunkedUpload struct {
+	name     string
+	region   string
+	uploadID string
+	nonce    []byte
+	// partSize is the plaintext size of every part but the last
+	partSize int64
+
+	mu    sync.Mutex
+	parts map[int]minio.CompletePart
+	// sums are the SHA-256 of the plaintext of every part that has been
+	// sent, whether or not it was stored
+	sums map[int][sha256.Size]byte
+}
+
+// errPartChanged is returned when a part is sent again with different
+// contents
+var errPartChanged = stageError{status: http.StatusConflict, reason: "part was sent before with different contents"}
+
+// partSize is the plaintext size of the parts of chunked uploads. Part n
+// starts at (n-1)*partSize, which has to be on a package boundary, and minio
+// won't take parts smaller than minChunkSize apart from the last one.
+func (s server) partSize() int64 {
+	return max(s.chunkSize/decryptBlockSize*decryptBlockSize, minChunkSize)
+}
+
+// startChunked starts a multipart upload for filename in region
+func (s server) startChunked(ctx context.Context, filename, region string) (*chunkedUpload, error) {
+	nonce := make([]byte, 12)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	uploadID, err := s.minioClient.NewMultipartUpload(withRegion(ctx, region), s.bucketName, filename)
+	if err != nil {
+		return nil, fmt.Errorf("new multipart upload: %w", err)
+	}
+
+	return &chunkedUpload{
+		name:     filename,
+		region:   region,
+		uploadID: uploadID,
+		nonce:    nonce,
+		partSize: s.partSize(),
+		parts:    map[int]minio.CompletePart{},
+		sums:     map[int][sha256.Size]byte{},
+	}, nil
+}
+
+// putPart encrypts part n of the upload and stores it. The final part is the
+// last one of the file, it can be shorter than the part size but can't be
+// empty, the rest have to be exactly the part size. A part can be sent again,
+// if storing it failed, but only with the same contents.
+func (s server) putPart(ctx context.Context, c *chunkedUpload, n int, plaintext []byte, final bool) error {
+	size := int64(len(plaintext))
+	if n < 1 || (final && size == 0) || size > c.partSize || (!final && size != c.partSize) {
+		return fmt.Errorf("part %d is the wrong size: %d bytes", n, size)
+	}
+
+	// The sum is taken before anything is encrypted, since a part that
+	// failed to store could still have been seen
+	sum := sha256.Sum256(plaintext)
+	c.mu.Lock()
+	prev, sent := c.sums[n]
+	if !sent {
+		c.sums[n] = sum
+	}
+	c.mu.Unlock()
+	if sent && prev != sum {
+		return fmt.Errorf("part %d: %w", n, errPartChanged)
+	}
+
+	encrypted, err := s.encryptChunk(c.name, c.nonce, int64(n-1)*c.partSize, plaintext, final)
+	if err != nil {
+		return fmt.Errorf("encrypt part %d: %w", n, err)
+	}
+
+	part, err := s.minioClient.PutObjectPart(withRegion(ctx, c.region), s.bucketName, c.name, c.uploadID, n, bytes.NewReader(encrypted), int64(len(encrypted)))
+	if err != nil {
+		return fmt.Errorf("put object part %d: %w", n, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.parts[n] = minio.CompletePart{PartNumber: n, ETag: part.ETag}
+
+	return nil
+}
+
+// encryptChunk encrypts plaintext as the packages of the DARE stream for
+// filename starting at offset, which has to be a multiple of the package
+// size. Only the final chunk is closed, since that marks its last package as
+// the end of the stream. For the others one byte more than the chunk is
+// written so every package in it is sealed, and the extra byte is dropped.
+func (s server) encryptChunk(filename string, nonce []byte, offset int64, plaintext []byte, final bool) ([]byte, error) {
+	cfg := s.sioConfig(filename)
+	cfg.Rand = bytes.NewReader(nonce)
+	cfg.SequenceNumber = uint32(offset / decryptBlockSize)
+
+	var encrypted bytes.Buffer
+	w, err := sio.EncryptWriter(&encrypted, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if final {
+		_, err = w.Write(plaintext)
+		if err == nil {
+			err = w.Close()
+		}
+		return encrypted.Bytes(), err
+	}
+
+	_, err = w.Write(append(plaintext[:len(plaintext):len(plaintext)], 0))
+	return encrypted.Bytes(), err
+}
+
+// completeChunked puts the parts stored so far together into the object,
+// they have to run from 1 without any gaps
+func (s server) completeChunked(ctx context.Context, c *chunkedUpload) (minio.UploadInfo, error) {
+	c.mu.Lock()
+	parts := make([]minio.CompletePart, 0, len(c.parts))
+	for _, part := range c.parts {
+		parts = append(parts, part)
+	}
+	c.mu.Unlock()
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return minio.UploadInfo{}, fmt.Errorf("part %d is missing", i+1)
+		}
+	}
+
+	info, err := s.minioClient.CompleteMultipartUpload(withRegion(ctx, c.region), s.bucketName, c.name, c.uploadID, parts)
+	if err != nil {
+		return minio.UploadInfo{}, fmt.Errorf("complete multipart upload: %w", err)
+	}
+
+	return info, nil
+}
+
+// received returns the numbers of the parts stored so far in order
+func (c *chunkedUpload) received() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	parts := make([]int, 0, len(c.parts))
+	for n := range c.parts {
+		parts = append(parts, n)
+	}
+	sort.Ints(parts)
+
+	return parts
+}
+
+// checksumChunked reads the finished object back and returns the hex encoded
+// SHA256 of the plaintext, for uploads whose parts didn't arrive in order.
+// Reading it back also makes sure the parts decrypt as one stream.
+func (s server) checksumChunked(ctx context.Context, c *chunkedUpload) (string, error) {
+	obj, err := s.minioClient.GetObject(withRegion(ctx, c.region), s.bucketName, c.name)
+	if err != nil {
+		return "", fmt.Errorf("get object: %w", err)
+	}
+	if obj == nil {
+		return "", errNotFound
+	}
+	defer obj.Close()
+
+	decrypted, err := sio.DecryptReader(obj, s.sioConfig(c.name))
+	if err != nil {
+		return "", fmt.Errorf("decrypt file: %w", err)
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(h, decrypted)
+	if err != nil {
+		return "", fmt.Errorf("decrypt file: %w", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// abortChunked throws away the parts of an upload that won't be finished, it
+// doesn't use the request context so it happens even if the client has gone
+func (s server) abortChunked(c *chunkedUpload) error {
+	ctx, cancel := context.WithTimeout(withRegion(context.Background(), c.region), abortTimeout)
+	defer cancel()
+
+	err := s.minioClient.AbortMultipartUpload(ctx, s.bucketName, c.name, c.uploadID)
+	if err != nil && storageErrorCode(err) != "NoSuchUpload" {
+		return fmt.Errorf("abort multipart upload: %w", err)
+	}
+
+	return nil
+}
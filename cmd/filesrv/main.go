@@ -0,0 +1,9 @@
+// Command filesrv serves encrypted files out of minio, see the README for how
+// to run it
+package main
+
+import "github.com/sams96/filesrv"
+
+func main() {
+	filesrv.Main()
+}
@@ -0,0 +1,255 @@
+package filesrv
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"path"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// coalesceWindow is how far the fetch can get ahead of the slowest
+	// reader. Objects smaller than this are kept whole until the fetch is
+	// done, so readers can join at any point.
+	coalesceWindow = 8 << 20
+	// coalesceChunk is how much is read from the store at a time
+	coalesceChunk = 64 << 10
+)
+
+// This is exposed at /debug/vars
+var coalescedReads = expvar.NewInt("coalesced_reads")
+
+// coalescingStore is an objStorer that shares one fetch of an object between
+// everyone reading it at the same time, so a flash crowd for a big file only
+// reads it from minio once. The first reader starts the fetch and the rest
+// read from the shared buffer from the start.
+//
+// The fetch can only get coalesceWindow ahead of the slowest reader, so a slow
+// client holds the others back rather than the whole object ending up in
+// memory. Once a fetch has gone past the window new readers can't join it and
+// start their own.
+type coalescingStore struct {
+	objStorer
+
+	mu       sync.Mutex
+	inflight map[string]*broadcast
+}
+
+func newCoalescingStore(store objStorer) *coalescingStore {
+	return &coalescingStore{objStorer: store, inflight: map[string]*broadcast{}}
+}
+
+func (c *coalescingStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	key := path.Join(bucketName, filename)
+
+	// minio's GetObject doesn't do anything until the first read, so it's
+	// fine to hold the lock over it
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b, ok := c.inflight[key]; ok {
+		if r, ok := b.join(); ok {
+			coalescedReads.Add(1)
+			return r, nil
+		}
+	}
+
+	// The fetch carries on as long as anyone is reading, it can't end when
+	// the request that started it does
+	fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	obj, err := c.objStorer.GetObject(fetchCtx, bucketName, filename)
+	if err != nil || obj == nil {
+		cancel()
+		return obj, err
+	}
+
+	b := newBroadcast(cancel)
+	r, _ := b.join()
+	c.inflight[key] = b
+	go c.fill(key, b, obj)
+
+	return r, nil
+}
+
+// PutObject, CompleteMultipartUpload and RemoveObject stop later reads joining a fetch of the old
+// version of the object
+
+func (c *coalescingStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
+	defer c.forget(path.Join(bucketName, filename), nil)
+	return c.objStorer.PutObject(ctx, bucketName, filename, file, size, chunkSize)
+}
+
+func (c *coalescingStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	defer c.forget(path.Join(bucketName, filename), nil)
+	return c.objStorer.CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts)
+}
+
+func (c *coalescingStore) RemoveObject(ctx context.Context, bucketName, filename string) error {
+	defer c.forget(path.Join(bucketName, filename), nil)
+	return c.objStorer.RemoveObject(ctx, bucketName, filename)
+}
+
+func (c *coalescingStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	defer func() {
+		for _, filename := range filenames {
+			c.forget(path.Join(bucketName, filename), nil)
+		}
+	}()
+	return c.objStorer.RemoveObjects(ctx, bucketName, filenames)
+}
+
+// forget removes the fetch for key, if b isn't nil only if it's that fetch
+func (c *coalescingStore) forget(key string, b *broadcast) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if b == nil || c.inflight[key] == b {
+		delete(c.inflight, key)
+	}
+}
+
+// fill reads the object into the broadcast until it ends or everyone has
+// stopped reading
+func (c *coalescingStore) fill(key string, b *broadcast, obj io.ReadCloser) {
+	defer obj.Close()
+	defer b.cancel()
+	defer c.forget(key, b)
+
+	chunk := make([]byte, coalesceChunk)
+	for b.waitForRoom() {
+		n, err := obj.Read(chunk)
+		b.write(chunk[:n], err)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// broadcast is an object being fetched and the readers sharing it
+type broadcast struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// buf holds the object from base onwards
+	base int64
+	buf  []byte
+	// err is set once the fetch ends, io.EOF if it got to the end
+	err error
+	// abandoned is set when the last reader leaves before the fetch ends
+	abandoned bool
+
+	readers map[*broadcastReader]struct{}
+	cancel  context.CancelFunc
+}
+
+func newBroadcast(cancel context.CancelFunc) *broadcast {
+	b := &broadcast{readers: map[*broadcastReader]struct{}{}, cancel: cancel}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// join adds a reader starting at the beginning of the object, which is only
+// possible while the start is still in the buffer
+func (b *broadcast) join() (*broadcastReader, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.base > 0 || b.abandoned {
+		return nil, false
+	}
+
+	r := &broadcastReader{b: b}
+	b.readers[r] = struct{}{}
+	return r, true
+}
+
+// waitForRoom blocks until the fetch can read more without getting too far
+// ahead of the slowest reader. It returns false if there's no one left to
+// read it.
+func (b *broadcast) waitForRoom() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for {
+		if len(b.readers) == 0 {
+			b.abandoned = true
+			return false
+		}
+
+		slowest := b.base + int64(len(b.buf))
+		for r := range b.readers {
+			slowest = min(slowest, r.off)
+		}
+
+		// Everything before the slowest reader has been read by everyone,
+		// but it's only dropped once the buffer is full so that readers
+		// can join small objects right up to the end
+		if len(b.buf) >= coalesceWindow && slowest > b.base {
+			b.buf = append([]byte(nil), b.buf[slowest-b.base:]...)
+			b.base = slowest
+		}
+
+		if b.base+int64(len(b.buf))-slowest < coalesceWindow {
+			return true
+		}
+		b.cond.Wait()
+	}
+}
+
+// write adds what the fetch read to the buffer
+func (b *broadcast) write(p []byte, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if err != nil {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// broadcastReader is one reader of a broadcast
+type broadcastReader struct {
+	b *broadcast
+	// off is how far into the object this reader has got
+	off int64
+}
+
+func (r *broadcastReader) Read(p []byte) (int, error) {
+	b := r.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for r.off >= b.base+int64(len(b.buf)) && b.err == nil {
+		b.cond.Wait()
+	}
+	if r.off < b.base+int64(len(b.buf)) {
+		n := copy(p, b.buf[r.off-b.base:])
+		r.off += int64(n)
+		// The fetch may be waiting for this reader to catch up
+		b.cond.Broadcast()
+		return n, nil
+	}
+
+	return 0, b.err
+}
+
+func (r *broadcastReader) Close() error {
+	b := r.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.readers, r)
+	if len(b.readers) == 0 && b.err == nil {
+		// Nobody wants the rest, so stop the fetch even if it's waiting on
+		// the store
+		b.abandoned = true
+		b.cancel()
+	}
+	b.cond.Broadcast()
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// gatedStore holds back the contents of every object it returns until the
+// gate is opened
+type gatedStore struct {
+	*memObjStore
+	gate chan struct{}
+}
+
+func (g gatedStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	obj, err := g.memObjStore.GetObject(ctx, bucketName, filename)
+	if err != nil {
+		return nil, err
+	}
+	return gatedReader{ReadCloser: obj, gate: g.gate}, nil
+}
+
+type gatedReader struct {
+	io.ReadCloser
+	gate chan struct{}
+}
+
+func (r gatedReader) Read(p []byte) (int, error) {
+	<-r.gate
+	return r.ReadCloser.Read(p)
+}
+
+func TestCoalescingStore(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemObjStore()
+	data := make([]byte, 3*coalesceChunk+10)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	_, err = mem.PutObject(ctx, "testBucket", "big", bytes.NewReader(data), int64(len(data)), 0)
+	require.NoError(t, err)
+
+	gate := make(chan struct{})
+	c := newCoalescingStore(gatedStore{memObjStore: mem, gate: gate})
+
+	// Everyone asks before any data arrives, so they all share one fetch
+	var readers []io.ReadCloser
+	for i := 0; i < 5; i++ {
+		r, err := c.GetObject(ctx, "testBucket", "big")
+		require.NoError(t, err)
+		readers = append(readers, r)
+	}
+	require.Equal(t, 1, mem.gets)
+	close(gate)
+
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(r io.ReadCloser) {
+			defer wg.Done()
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, data, got)
+		}(r)
+	}
+	wg.Wait()
+
+	// Once the fetch is done the next read starts a new one
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.inflight) == 0
+	}, time.Second, time.Millisecond)
+	r, err := c.GetObject(ctx, "testBucket", "big")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	require.Equal(t, 2, mem.gets)
+}
+
+func TestCoalescingStoreWindow(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemObjStore()
+	data := make([]byte, 3*coalesceWindow)
+	_, err := mem.PutObject(ctx, "testBucket", "huge", bytes.NewReader(data), int64(len(data)), 0)
+	require.NoError(t, err)
+	c := newCoalescingStore(mem)
+
+	fast, err := c.GetObject(ctx, "testBucket", "huge")
+	require.NoError(t, err)
+	slow, err := c.GetObject(ctx, "testBucket", "huge")
+	require.NoError(t, err)
+	require.Equal(t, 1, mem.gets)
+
+	// The fast reader can only get a window ahead of the slow one
+	_, err = io.CopyN(io.Discard, fast, coalesceWindow)
+	require.NoError(t, err)
+	c.mu.Lock()
+	b := c.inflight["testBucket/huge"]
+	c.mu.Unlock()
+	b.mu.Lock()
+	require.LessOrEqual(t, len(b.buf), coalesceWindow)
+	b.mu.Unlock()
+
+	// Past the window the start has been dropped, so new readers get their
+	// own fetch
+	_, err = io.CopyN(io.Discard, slow, coalesceWindow)
+	require.NoError(t, err)
+	_, err = io.CopyN(io.Discard, fast, coalesceChunk)
+	require.NoError(t, err)
+	other, err := c.GetObject(ctx, "testBucket", "huge")
+	require.NoError(t, err)
+	require.Equal(t, 2, mem.gets)
+
+	// The readers hold each other back, so they have to read at the same
+	// time like requests would
+	var wg sync.WaitGroup
+	for _, r := range []io.ReadCloser{fast, slow, other} {
+		wg.Add(1)
+		go func(r io.ReadCloser) {
+			defer wg.Done()
+			_, err := io.Copy(io.Discard, r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+		}(r)
+	}
+	wg.Wait()
+}
+
+func TestCoalescingStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newCoalescingStore(newMemObjStore())
+
+	r, err := c.GetObject(ctx, "testBucket", "missing")
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.Equal(t, "NoSuchKey", storageErrorCode(err))
+	require.NoError(t, r.Close())
+}
+
+func TestCoalescingStoreAbandoned(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemObjStore()
+	_, err := mem.PutObject(ctx, "testBucket", "file", bytes.NewReader([]byte("test file contents")), 18, 0)
+	require.NoError(t, err)
+
+	gate := make(chan struct{})
+	c := newCoalescingStore(gatedStore{memObjStore: mem, gate: gate})
+	r, err := c.GetObject(ctx, "testBucket", "file")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	close(gate)
+
+	// Nobody can join a fetch that's being abandoned
+	r, err = c.GetObject(ctx, "testBucket", "file")
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "test file contents", string(got))
+	require.Equal(t, 2, mem.gets)
+}
@@ -0,0 +1,467 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// startupTimeout bounds the work a command does before it gets going, like
+// the self test
+const startupTimeout = time.Minute
+
+// errNotReady is returned by the check command when a readiness check fails
+var errNotReady = errors.New("not ready")
+
+// errDevServeOnly is returned by the commands that only make sense against a
+// real bucket
+var errDevServeOnly = errors.New("dev mode only works with the serve command")
+
+// errDefaultReceiptKey is returned by serve when the receipt key hasn't been
+// changed from the default, which would let anyone sign links to files
+var errDefaultReceiptKey = errors.New("receipt-key is the default, set it to a secret so links to files can't be forged")
+
+// command is a filesrv subcommand. The config flags come before the command
+// name and the command's own flags after it:
+//
+//	filesrv -config filesrv.yaml migrate -dry-run
+type command struct {
+	name  string
+	usage string
+	run   func(ctx context.Context, cfg config, args []string) error
+	// report is run instead of run for commands about the config itself.
+	// They're run even if the config is invalid and get the error from
+	// loading it, along with as much of the config as could be loaded.
+	report func(ctx context.Context, w io.Writer, cfg config, loadErr error, args []string) error
+}
+
+// defaultCommand is run when no command is given
+const defaultCommand = "serve"
+
+var commands = []command{
+	{name: "serve", usage: "serve the API (the default)", run: cmdServe},
+	{name: "check", usage: "check the config and that the bucket can be used", run: cmdCheck},
+	{name: "migrate", usage: "rewrite objects in the current storage format", run: cmdMigrate},
+	{name: "config", usage: "`config validate` prints every problem with the config as JSON", report: cmdConfig},
+}
+
+// findCommand returns the command named by the first argument and the
+// arguments for it
+func findCommand(args []string) (command, []string, error) {
+	name := defaultCommand
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	var names []string
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, args, nil
+		}
+		names = append(names, cmd.name)
+	}
+
+	return command{}, nil, fmt.Errorf("unknown command %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// printCommands lists the commands for the help output
+func printCommands(w io.Writer) {
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// noArgs fails for commands that don't take any arguments
+func noArgs(name string, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%s: unexpected arguments: %s", name, strings.Join(args, " "))
+	}
+	return nil
+}
+
+// newMinioClient connects to minio with the credentials from the config or
+// Vault
+func newMinioClient(ctx context.Context, cfg *config) (*minio.Client, error) {
+	creds, err := minioCredentials(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return minio.New(cfg.MinioEndpoint, &minio.Options{
+		Creds:  creds,
+		Secure: cfg.MinioSecure,
+	})
+}
+
+// cmdCheck is the `filesrv check` command, it runs the readiness checks
+// without starting the server
+func cmdCheck(ctx context.Context, cfg config, args []string) error {
+	err := noArgs("check", args)
+	if err != nil {
+		return err
+	}
+	if cfg.Dev {
+		return errDevServeOnly
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, startupTimeout)
+	defer cancel()
+
+	minioClient, err := newMinioClient(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+
+	s := newServerFromConfig(minioStore{c: minioClient}, cfg)
+	ready := true
+	for _, bs := range s.allBuckets() {
+		if len(s.buckets) > 0 {
+			fmt.Printf("bucket %s:\n", bs.bucketName)
+		}
+		ready = bs.check(ctx, os.Stdout) && ready
+	}
+	if !ready {
+		return errNotReady
+	}
+
+	return nil
+}
+
+// cmdMigrate is the `filesrv migrate` command, see server.runMigrate
+func cmdMigrate(ctx context.Context, cfg config, args []string) error {
+	if cfg.Dev {
+		return errDevServeOnly
+	}
+
+	minioClient, err := newMinioClient(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+
+	// Migrating a big bucket can take a lot longer than startup gets, so
+	// there's no timeout
+	s := newServerFromConfig(minioStore{c: minioClient}, cfg)
+	return s.runMigrate(ctx, args, os.Stdout)
+}
+
+// storage is everything the server needs from the object store
+type storage struct {
+	store objStorer
+	// notifier is the source of bucket events for -ingest-events
+	notifier bucketNotifier
+	// maker makes the tenant buckets
+	maker bucketMaker
+	// chaos is set with -chaos, it injects faults into store
+	chaos *chaosStore
+	// regions is set when uploads can be placed in other regions, it has to
+	// be told about each bucket's catalog
+	regions *regionalStore
+}
+
+// openStore returns the storage for the server. In dev mode that's the in
+// memory store, otherwise it's minio once it can be reached, along with any
+// regions.
+func openStore(ctx context.Context, cfg *config) (storage, error) {
+	if cfg.Dev {
+		err := useDevMode(cfg)
+		if err != nil {
+			return storage{}, err
+		}
+		store := newDevStore()
+		st := storage{store: store, maker: store}
+		st.withChaos(cfg)
+		return st, nil
+	}
+
+	minioClient, err := newMinioClient(ctx, cfg)
+	if err != nil {
+		return storage{}, err
+	}
+	regionClients := map[string]*minio.Client{}
+	for _, r := range cfg.Regions {
+		regionCfg := cfg.forRegion(r)
+		regionClients[r.Name], err = newMinioClient(ctx, &regionCfg)
+		if err != nil {
+			return storage{}, fmt.Errorf("region %s: %w", r.Name, err)
+		}
+	}
+
+	// Every bucket is needed in every region, since any upload can end up in
+	// any of them
+	ensureBuckets := func(ctx context.Context, client *minio.Client) error {
+		err := ensureBucket(ctx, client, cfg.Bucket, cfg.bucketSetup())
+		if err != nil {
+			return err
+		}
+		for _, b := range cfg.Buckets {
+			err := ensureBucket(ctx, client, b.Name, cfg.bucketSetup())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The retries have their own limit, which can be longer than the rest of
+	// startup gets
+	err = retryStartup(ctx, "connect to minio", cfg.StartupBackoff, cfg.StartupMaxWait, func(ctx context.Context) error {
+		err := ensureBuckets(ctx, minioClient)
+		if err != nil {
+			return err
+		}
+		for name, client := range regionClients {
+			err := ensureBuckets(ctx, client)
+			if err != nil {
+				return fmt.Errorf("region %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return storage{}, err
+	}
+
+	st := storage{notifier: minioStore{c: minioClient}, maker: minioClient}
+	var store objStorer = minioStore{c: minioClient}
+	if len(regionClients) > 0 {
+		regions := make(map[string]objStorer, len(regionClients))
+		for name, client := range regionClients {
+			regions[name] = minioStore{c: client}
+		}
+		st.regions = newRegionalStore(store, regions)
+		store = st.regions
+		log.Println("storing uploads in regions", regionNames(cfg.Regions))
+	}
+
+	st.store = store
+	st.withChaos(cfg)
+
+	// The cache goes in front, so only objects that aren't cached are fetched
+	// from minio and shared
+	store = newCoalescingStore(st.store)
+	if cfg.CacheSize > 0 {
+		store = newCachingStore(store, cfg.CacheSize, cfg.MaxCachedObjectSize, cfg.CacheTTL)
+	}
+	st.store = store
+
+	return st, nil
+}
+
+// withChaos puts the chaos store in front of the store with -chaos, under the
+// cache so faults hit what actually goes to minio
+func (st *storage) withChaos(cfg *config) {
+	if !cfg.Chaos {
+		return
+	}
+
+	st.chaos = newChaosStore(st.store)
+	st.store = st.chaos
+	log.Println("chaos mode: faults can be injected into storage with /admin/chaos")
+}
+
+// cmdServe is the `filesrv serve` command, it serves the API until ctx is
+// done
+func cmdServe(ctx context.Context, cfg config, args []string) error {
+	err := noArgs("serve", args)
+	if err != nil {
+		return err
+	}
+
+	// Dev mode replaces it with a throwaway key
+	if !cfg.Dev && cfg.ReceiptKey == defaultReceiptKey {
+		return errDefaultReceiptKey
+	}
+
+	s, err := startServer(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	// Under socket activation systemd holds the socket, so connections queue
+	// up while the server restarts instead of being refused
+	l, activated, err := systemdListener()
+	if err != nil {
+		return err
+	}
+	if !activated {
+		l, err = listen(cfg.ListenAddr)
+		if err != nil {
+			return err
+		}
+	}
+	addr := cfg.ListenAddr
+	if activated {
+		addr = l.Addr().String() + " (from systemd)"
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		log.Println("serving HTTPS on", addr)
+	} else {
+		log.Println("serving HTTP on", addr)
+	}
+
+	srv := &http.Server{
+		Handler:           s.routes(),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	srv.RegisterOnShutdown(s.drainer.drain)
+	srv.RegisterOnShutdown(func() {
+		err := sdNotify("STOPPING=1")
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		log.Println(err)
+	}
+
+	serveErr := serve(ctx, srv, l, cfg.DrainTimeout)
+
+	// Save the usage since the last periodic save
+	saveCtx, cancelSave := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelSave()
+	s.saveUsageOnce(saveCtx, time.Now())
+
+	return serveErr
+}
+
+// startServer opens the storage and starts a server with its background
+// jobs, which run until ctx is done. It's ready for requests once it returns.
+// standalone is for the filesrv command, which hands the logger over to the
+// redaction rules and reloads the config on SIGHUP. A program running filesrv
+// inside it keeps its own logger and signals.
+func startServer(ctx context.Context, cfg config, standalone bool) (server, error) {
+	// Opening the store fills in the keys from vault or dev mode, reloads
+	// are compared with the config as it was loaded
+	loaded := cfg
+
+	st, err := openStore(ctx, &cfg)
+	if err != nil {
+		return server{}, err
+	}
+
+	var geo *geoIP
+	if cfg.GeoIPDB != "" {
+		geo, err = openGeoIP(cfg.GeoIPDB)
+		if err != nil {
+			return server{}, err
+		}
+	}
+
+	s := newServerFromConfig(st.store, cfg).withGeoIP(cfg, geo)
+	s.chaos = st.chaos
+	err = s.spill.prepare()
+	if err != nil {
+		return server{}, fmt.Errorf("form spill: %w", err)
+	}
+	if standalone {
+		// From here on the redaction rules apply to everything that's
+		// logged
+		log.SetOutput(redactingWriter{w: log.Writer(), live: s.live})
+
+		// SIGHUP reloads the settings that can change without a restart,
+		// the connections stay open
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go s.reloadOnSignal(ctx, hup, loaded, func() (config, error) {
+			cfg, _, err := loadConfig(os.Args[1:], os.LookupEnv, io.Discard)
+			return cfg, err
+		})
+	}
+
+	// Every bucket's catalog says which region its files are in, and each
+	// bucket has its own background jobs. Tenant buckets get both from when
+	// they're first used.
+	startJobs := func(bs server) {
+		if st.regions != nil {
+			st.regions.track(bs.bucketName, bs.catalog)
+		}
+		go runEvery(ctx, cfg.TmpSweepInterval, bs.sweepTmpOnce)
+		go runEvery(ctx, incompleteUploadSweepInterval, bs.sweepIncompleteUploadsOnce)
+		go runEvery(ctx, presignedSweepInterval, bs.sweepPresignedOnce)
+	}
+	s = s.withTenantBuckets(st.store, st.maker, cfg, startJobs)
+
+	startupCtx, cancelStartup := context.WithTimeout(ctx, startupTimeout)
+	defer cancelStartup()
+
+	// Make sure the whole pipeline works before we start accepting requests,
+	// otherwise a bad key or missing permissions would only show up on the
+	// first upload.
+	for _, bs := range s.allBuckets() {
+		err = bs.selfTest(startupCtx)
+		if err != nil {
+			return server{}, fmt.Errorf("self test: bucket %s: %w", bs.bucketName, err)
+		}
+
+		err = bs.loadCatalog(startupCtx)
+		if err != nil {
+			return server{}, fmt.Errorf("bucket %s: %w", bs.bucketName, err)
+		}
+	}
+	log.Println("self test passed")
+
+	// The background jobs stop along with the server
+	for _, bs := range s.allBuckets() {
+		startJobs(bs)
+	}
+
+	go func() {
+		for filename, err := range s.prefetch(context.Background(), splitList(cfg.PrefetchObjects)) {
+			log.Printf("prefetch: filename: %s, error: %s", filename, err)
+		}
+	}()
+	go runEvery(ctx, usageSaveInterval, s.saveUsageOnce)
+	go runEvery(ctx, abuseSweepInterval, s.abuse.sweep)
+	go runEvery(ctx, sloPublishInterval, s.publishSLOs)
+
+	if cfg.IngestEvents {
+		go s.ingestEvents(ctx, st.notifier)
+	}
+
+	return s, nil
+}
+
+// NewDevHandler starts a server in dev mode and returns its API, for running
+// filesrv inside other programs' tests, see filesrvtest. args are the
+// settings, as they'd be given to the command. The server keeps everything
+// in memory and its background jobs run until ctx is done.
+func NewDevHandler(ctx context.Context, args ...string) (http.Handler, error) {
+	cfg, args, err := loadConfig(append([]string{"-dev"}, args...), os.LookupEnv, io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	err = noArgs("dev handler", args)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := startServer(ctx, cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.routes(), nil
+}
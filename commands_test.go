@@ -0,0 +1,71 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantName string
+		wantArgs []string
+		wantErr  string
+	}{
+		{
+			name:     "default",
+			wantName: "serve",
+		},
+		{
+			name:     "serve",
+			args:     []string{"serve"},
+			wantName: "serve",
+			wantArgs: []string{},
+		},
+		{
+			name:     "command flags",
+			args:     []string{"migrate", "-dry-run"},
+			wantName: "migrate",
+			wantArgs: []string{"-dry-run"},
+		},
+		{
+			name:    "unknown",
+			args:    []string{"server"},
+			wantErr: `unknown command "server", expected one of serve, check, migrate, config`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmd, args, err := findCommand(test.args)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantName, cmd.name)
+			require.Equal(t, test.wantArgs, args)
+		})
+	}
+}
+
+func TestNoArgs(t *testing.T) {
+	require.NoError(t, noArgs("serve", nil))
+	require.EqualError(t, noArgs("serve", []string{"now"}), "serve: unexpected arguments: now")
+}
+
+func TestPrintCommands(t *testing.T) {
+	var b bytes.Buffer
+	printCommands(&b)
+	for _, cmd := range commands {
+		require.Contains(t, b.String(), cmd.name)
+	}
+}
+
+func TestServeDefaultReceiptKey(t *testing.T) {
+	require.ErrorIs(t, cmdServe(context.Background(), defaultConfig(), nil), errDefaultReceiptKey)
+}
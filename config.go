@@ -0,0 +1,543 @@
+package filesrv
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// envPrefix is added to the upper cased flag name to get the environment
+// variable for a setting, so -minio-endpoint is FILESRV_MINIO_ENDPOINT
+const envPrefix = "FILESRV_"
+
+// config holds every setting for the server. Each one can be set with a flag
+// or an environment variable, flags win if both are set.
+type config struct {
+	ListenAddr string
+
+	// HTTPS is served with the certificate in TLSCertFile and TLSKeyFile, or
+	// with certificates from Let's Encrypt for AutocertHosts. Plain HTTP is
+	// served if neither are set.
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertHosts    string
+	AutocertEmail    string
+	AutocertCacheDir string
+
+	MinioEndpoint   string
+	MinioSecure     bool
+	AccessKeyID     string
+	SecretAccessKey string
+	Bucket          string
+
+	EncryptionKey string
+	ReceiptKey    string
+	PostPolicyKey string
+
+	// When VaultAddr is set the minio credentials and the encryption key are
+	// read from the Vault secret at VaultPath instead
+	VaultAddr  string
+	VaultToken string
+	VaultPath  string
+
+	// ChunkSize is the part size for multipart uploads, minio doesn't accept
+	// parts smaller than 5MB
+	ChunkSize     int64
+	MaxUploadSize int64
+	Naming        namingStrategy
+
+	// ActiveContent says whether files browsers run scripts in, like HTML
+	// and SVG, are always downloaded as attachments
+	ActiveContent activeContentPolicy
+
+	// Files uploaded to the /tmp namespace are deleted after TmpTTL, the
+	// sweeper checks for expired files every TmpSweepInterval
+	TmpTTL           time.Duration
+	TmpSweepInterval time.Duration
+
+	// BucketPolicy says whether a missing bucket is created on startup, with
+	// BucketRegion and BucketObjectLocking. Until minio can be reached startup
+	// is retried, waiting StartupBackoff at first and twice as long each time,
+	// for up to StartupMaxWait.
+	BucketPolicy        bucketPolicy
+	BucketRegion        string
+	BucketObjectLocking bool
+	StartupBackoff      time.Duration
+	StartupMaxWait      time.Duration
+
+	// TenantBucketPrefix gives every user their own bucket, named with the
+	// prefix followed by their identity, which is created the first time
+	// they use it
+	TenantBucketPrefix string
+
+	// IngestEvents follows the minio bucket events to pick up objects that
+	// other tools write to the bucket directly
+	IngestEvents bool
+
+	// Dev keeps the files in memory instead of minio, with throwaway keys,
+	// for trying the API out without any setup
+	Dev bool
+	// Chaos lets faults be injected into the object store with /admin/chaos,
+	// for trying out how the server copes before minio has a real incident.
+	// It's never meant for production.
+	Chaos bool
+
+	// Recently read objects are cached in memory, up to CacheSize in total.
+	// Objects bigger than MaxCachedObjectSize are never cached.
+	CacheSize           int64
+	MaxCachedObjectSize int64
+	CacheTTL            time.Duration
+	// PrefetchObjects is a comma separated list of objects to load into the
+	// cache on startup
+	PrefetchObjects string
+
+	// ClamdAddress is where the scan pipeline stage sends files to be checked
+	// for viruses, either host:port or the path to a unix socket
+	ClamdAddress string
+	// ScanCacheTTL is how long a verdict from clamd is reused for uploads
+	// with the same contents, zero turns it off. ScanCacheSize is how many
+	// verdicts are kept.
+	ScanCacheTTL  time.Duration
+	ScanCacheSize int
+
+	// ConverterURL is the service office documents are posted to for PDF
+	// previews, they're only made if it's set
+	ConverterURL string
+	// FFmpegPath is the ffmpeg binary poster frames are taken from videos
+	// with, they're only made if it's set
+	FFmpegPath string
+	// Videos of at least SegmentMinSize get a manifest of SegmentSize byte
+	// ranges, zero turns it off
+	SegmentMinSize int64
+	SegmentSize    int64
+
+	// Canaries is a comma separated list of objects that nothing should ever
+	// touch, any request for them is logged and sent to CanaryWebhook
+	Canaries      string
+	CanaryWebhook string
+
+	// Clients can shorten the time allowed for a request with the
+	// X-Request-Timeout header, but never beyond MaxRequestTimeout
+	MaxRequestTimeout time.Duration
+	// DrainTimeout is how long requests in flight get to finish when the
+	// server is shutting down
+	DrainTimeout time.Duration
+
+	// The net/http server timeouts, zero means no limit. Reading the headers
+	// is always quick, so a low limit there stops slowloris clients holding
+	// connections open. Bodies and responses can take as long as a big
+	// upload or download does, and /watch streams never end, so the write
+	// timeout is off by default and the per request timeout does the job.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// When the server is busy reads and bulk uploads wait in separate
+	// queues, each with a limit on how many run at once and how many can
+	// wait
+	InteractiveConcurrency int
+	InteractiveQueueLength int
+	BulkConcurrency        int
+	BulkQueueLength        int
+
+	// Files in multipart forms that don't fit in memory are written to
+	// FormSpillDir while they're uploaded, or the temp directory if it's
+	// empty, with at most FormSpillMax bytes there at once
+	FormSpillDir string
+	FormSpillMax int64
+
+	// AdminGroup is the group users have to be in to use /admin, it has to
+	// come from the auth providers or the proxy. The admin API is turned off
+	// if it's empty.
+	AdminGroup string
+	// WorkerGroup is the group queue workers have to be in to take and
+	// acknowledge messages, admins can as well. Only admins can if it's
+	// empty.
+	WorkerGroup string
+
+	// TrustedProxies are the comma separated addresses and CIDRs of the
+	// proxies in front of the server. The client address is only taken from
+	// X-Forwarded-For for requests from one of them.
+	TrustedProxies string
+
+	// FetchAllowPrivate lets POST /fetch download from private addresses,
+	// which it otherwise refuses so it can't be pointed at internal services
+	FetchAllowPrivate bool
+
+	// Rules are checked against every upload, they can only be set in the
+	// config file
+	Rules []uploadRule
+
+	// Buckets are served as well as Bucket, under /b/<name>/. They can only
+	// be set in the config file.
+	Buckets []bucketConfig
+
+	// Regions are other minio endpoints uploads can be stored in, they can
+	// only be set in the config file. Placement is the comma separated ways
+	// of picking one, tried in order, and GeoIPDB is the MaxMind database
+	// for the geoip placement.
+	Regions   []regionConfig
+	Placement string
+	GeoIPDB   string
+
+	// DownloadRules restrict where files can be downloaded from, looking
+	// clients up in GeoIPDB. They can only be set in the config file.
+	DownloadRules []downloadRule
+
+	// DropBoxes take uploads from anyone into a prefix, they can only be set
+	// in the config file
+	DropBoxes []dropBox
+
+	// SLOs are the targets for the latency and body sizes of routes, they
+	// can only be set in the config file
+	SLOs []sloTarget
+
+	// Redactions hide sensitive values from the logs, they can only be set
+	// in the config file
+	Redactions []redactionRule
+
+	// Tiers are the service levels tenants get, they can only be set in the
+	// config file
+	Tiers []tierConfig
+
+	// Queues are where stored files are put for external workers to process,
+	// they can only be set in the config file
+	Queues []queueConfig
+
+	// ResponseHeaders are extra headers sent with downloads, they can only be
+	// set in the config file
+	ResponseHeaders []headerRule
+
+	// Auth are the ways requests are authenticated, tried in order. Without
+	// any the identity headers from a proxy are trusted. They can only be set
+	// in the config file.
+	Auth []authConfig
+
+	// Pipelines are the stages uploads go through by content type, the
+	// first that matches is used. Without any every upload gets the default
+	// pipeline. They can only be set in the config file.
+	Pipelines []pipelineRule
+}
+
+// defaultReceiptKey is the default receipt-key. Anyone could sign download
+// links and file URLs with it, so the server won't serve with it outside dev
+// mode.
+const defaultReceiptKey = "a static receipt signing key"
+
+// defaultConfig is what the server runs with when nothing is set. The keys
+// are only good enough for trying it out locally.
+func defaultConfig() config {
+	return config{
+		ListenAddr:          ":2001",
+		AutocertCacheDir:    "autocert-cache",
+		MinioEndpoint:       "127.0.0.1:9000",
+		AccessKeyID:         "minioadmin",
+		SecretAccessKey:     "minioadmin",
+		Bucket:              "filesrv",
+		EncryptionKey:       "a static encryption key",
+		ReceiptKey:          defaultReceiptKey,
+		PostPolicyKey:       "a static post policy signing key",
+		ChunkSize:           10 << 19, // ~ 5MB
+		MaxUploadSize:       1 << 30,  // 1GB
+		Naming:              namingOriginal,
+		ActiveContent:       activeContentAttachment,
+		AdminGroup:          "admin",
+		TmpTTL:              time.Hour,
+		TmpSweepInterval:    time.Minute,
+		BucketPolicy:        bucketCreateIfMissing,
+		StartupBackoff:      time.Second,
+		StartupMaxWait:      2 * time.Minute,
+		CacheSize:           256 << 20, // 256MB
+		MaxCachedObjectSize: 16 << 20,  // 16MB
+		CacheTTL:            5 * time.Minute,
+		ScanCacheTTL:        24 * time.Hour,
+		ScanCacheSize:       100000,
+		SegmentSize:         4 << 20,
+		MaxRequestTimeout:   time.Hour,
+		DrainTimeout:        30 * time.Second,
+		ReadHeaderTimeout:   10 * time.Second,
+		ReadTimeout:         time.Hour,
+		IdleTimeout:         2 * time.Minute,
+
+		InteractiveConcurrency: 64,
+		InteractiveQueueLength: 256,
+		BulkConcurrency:        8,
+		BulkQueueLength:        32,
+	}
+}
+
+// flagSet registers a flag for every setting, with the current values as the
+// defaults
+func (c *config) flagSet(output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("filesrv", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "address to serve HTTP on, or unix:<path> for a unix domain socket")
+	fs.StringVar(&c.TLSCertFile, "tls-cert", c.TLSCertFile, "certificate file to serve HTTPS with")
+	fs.StringVar(&c.TLSKeyFile, "tls-key", c.TLSKeyFile, "private key file for -tls-cert")
+	fs.StringVar(&c.AutocertHosts, "autocert-hosts", c.AutocertHosts, "comma separated hostnames to get Let's Encrypt certificates for")
+	fs.StringVar(&c.AutocertEmail, "autocert-email", c.AutocertEmail, "contact email for the Let's Encrypt account")
+	fs.StringVar(&c.AutocertCacheDir, "autocert-cache", c.AutocertCacheDir, "directory Let's Encrypt certificates are kept in")
+	fs.StringVar(&c.MinioEndpoint, "minio-endpoint", c.MinioEndpoint, "host:port of the minio server")
+	fs.BoolVar(&c.MinioSecure, "minio-secure", c.MinioSecure, "connect to minio over TLS")
+	fs.StringVar(&c.AccessKeyID, "minio-access-key", c.AccessKeyID, "minio access key ID")
+	fs.StringVar(&c.SecretAccessKey, "minio-secret-key", c.SecretAccessKey, "minio secret access key")
+	fs.StringVar(&c.Bucket, "bucket", c.Bucket, "bucket to store files in")
+	fs.StringVar(&c.EncryptionKey, "encryption-key", c.EncryptionKey, "key the file encryption keys are derived from")
+	fs.StringVar(&c.ReceiptKey, "receipt-key", c.ReceiptKey, "key upload receipts are signed with")
+	fs.StringVar(&c.PostPolicyKey, "post-policy-key", c.PostPolicyKey, "key browser upload policies are signed with")
+	fs.StringVar(&c.VaultAddr, "vault-addr", c.VaultAddr, "address of the Vault server to read the minio credentials and encryption key from")
+	fs.StringVar(&c.VaultToken, "vault-token", c.VaultToken, "Vault token, best set with FILESRV_VAULT_TOKEN")
+	fs.StringVar(&c.VaultPath, "vault-path", c.VaultPath, "path of the Vault secret, e.g. secret/data/filesrv")
+	fs.Int64Var(&c.ChunkSize, "chunk-size", c.ChunkSize, "multipart upload part size in bytes")
+	fs.Int64Var(&c.MaxUploadSize, "max-upload-size", c.MaxUploadSize, "largest upload in bytes, 0 for no limit")
+	fs.StringVar((*string)(&c.Naming), "naming", string(c.Naming), "default naming strategy: original, timestamp, uploader or random")
+	fs.StringVar((*string)(&c.ActiveContent), "active-content", string(c.ActiveContent), "how files browsers run scripts in, like HTML and SVG, are served: attachment or inline")
+	fs.DurationVar(&c.TmpTTL, "tmp-ttl", c.TmpTTL, "how long files in /tmp are kept")
+	fs.DurationVar(&c.TmpSweepInterval, "tmp-sweep-interval", c.TmpSweepInterval, "how often expired /tmp files are deleted")
+	fs.StringVar((*string)(&c.BucketPolicy), "bucket-policy", string(c.BucketPolicy), "what to do when a bucket doesn't exist: create-if-missing or require-exists")
+	fs.StringVar(&c.BucketRegion, "bucket-region", c.BucketRegion, "region to create buckets in")
+	fs.BoolVar(&c.BucketObjectLocking, "bucket-object-locking", c.BucketObjectLocking, "create buckets with object locking turned on")
+	fs.StringVar(&c.Placement, "placement", c.Placement, "comma separated ways of picking the region for an upload: header, tenant or geoip")
+	fs.StringVar(&c.GeoIPDB, "geoip-db", c.GeoIPDB, "path to a MaxMind country or city database")
+	fs.StringVar(&c.TenantBucketPrefix, "tenant-bucket-prefix", c.TenantBucketPrefix, "give every user a bucket named with this prefix, served under /b/<prefix><user>/")
+	fs.DurationVar(&c.StartupBackoff, "startup-backoff", c.StartupBackoff, "first wait before retrying when minio can't be reached on startup")
+	fs.DurationVar(&c.StartupMaxWait, "startup-max-wait", c.StartupMaxWait, "how long to keep retrying when minio can't be reached on startup")
+	fs.BoolVar(&c.IngestEvents, "ingest-events", c.IngestEvents, "index objects written to the bucket by other tools, using minio bucket events")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "keep files in memory with throwaway keys instead of using minio, everything is lost on exit")
+	fs.BoolVar(&c.Chaos, "chaos", c.Chaos, "allow storage latency, errors and cut off reads to be injected with /admin/chaos, for resilience testing only")
+	fs.Int64Var(&c.CacheSize, "cache-size", c.CacheSize, "size of the object cache in bytes, 0 to disable it")
+	fs.Int64Var(&c.MaxCachedObjectSize, "max-cached-object-size", c.MaxCachedObjectSize, "largest object that is cached in bytes")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "how long objects stay in the cache")
+	fs.StringVar(&c.PrefetchObjects, "prefetch", c.PrefetchObjects, "comma separated objects to load into the cache on startup")
+	fs.StringVar(&c.ClamdAddress, "clamd", c.ClamdAddress, "host:port or socket path of clamd for the scan stage")
+	fs.DurationVar(&c.ScanCacheTTL, "scan-cache-ttl", c.ScanCacheTTL, "how long scan verdicts are reused for files with the same contents, 0 to always scan")
+	fs.IntVar(&c.ScanCacheSize, "scan-cache-size", c.ScanCacheSize, "how many scan verdicts to keep")
+	fs.StringVar(&c.ConverterURL, "converter-url", c.ConverterURL, "URL of the service that converts office documents to PDF previews, like Gotenberg's /forms/libreoffice/convert")
+	fs.StringVar(&c.FFmpegPath, "ffmpeg", c.FFmpegPath, "path to ffmpeg, for poster frames of videos")
+	fs.Int64Var(&c.SegmentMinSize, "segment-manifest-min-size", c.SegmentMinSize, "smallest video in bytes that gets a segment manifest, 0 for none")
+	fs.Int64Var(&c.SegmentSize, "segment-size", c.SegmentSize, "size in bytes of the segments in a manifest, a multiple of 65536")
+	fs.StringVar(&c.Canaries, "canaries", c.Canaries, "comma separated objects that raise an alert when touched")
+	fs.StringVar(&c.CanaryWebhook, "canary-webhook", c.CanaryWebhook, "URL canary alerts are posted to")
+	fs.DurationVar(&c.MaxRequestTimeout, "max-request-timeout", c.MaxRequestTimeout, "longest time a request can take")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "how long requests get to finish when shutting down")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "longest time a client can take to send the request headers, 0 for no limit")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "longest time a client can take to send a whole request, 0 for no limit")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "longest time writing a response can take, 0 for no limit")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long an idle keep-alive connection is kept open, 0 for no limit")
+	fs.IntVar(&c.InteractiveConcurrency, "interactive-concurrency", c.InteractiveConcurrency, "how many reads can run at once")
+	fs.IntVar(&c.InteractiveQueueLength, "interactive-queue", c.InteractiveQueueLength, "how many reads can wait for a turn")
+	fs.IntVar(&c.BulkConcurrency, "bulk-concurrency", c.BulkConcurrency, "how many uploads and other writes can run at once")
+	fs.IntVar(&c.BulkQueueLength, "bulk-queue", c.BulkQueueLength, "how many uploads and other writes can wait for a turn")
+	fs.StringVar(&c.FormSpillDir, "form-spill-dir", c.FormSpillDir, "directory big files from upload forms are written to while they're uploaded, the temp directory if it's empty")
+	fs.Int64Var(&c.FormSpillMax, "form-spill-max", c.FormSpillMax, "most bytes of upload forms in the spill directory at once, 0 for no limit")
+	fs.StringVar(&c.AdminGroup, "admin-group", c.AdminGroup, "group users have to be in to use /admin, empty to turn the admin API off")
+	fs.StringVar(&c.WorkerGroup, "worker-group", c.WorkerGroup, "group queue workers have to be in to receive and acknowledge messages, empty for only admins")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma separated addresses and CIDRs of proxies whose X-Forwarded-For is trusted")
+	fs.BoolVar(&c.FetchAllowPrivate, "fetch-allow-private", c.FetchAllowPrivate, "let POST /fetch download from private and loopback addresses")
+
+	return fs
+}
+
+// envName returns the environment variable for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig builds the config from the defaults, then the config file if
+// there is one, then the environment and then the command line flags in args.
+// It returns the arguments left after the flags, which is where the
+// subcommand is, even if the config turns out to be invalid. An invalid
+// config comes back with as much of it as could be loaded.
+func loadConfig(args []string, lookupEnv func(string) (string, bool), output io.Writer) (config, []string, error) {
+	cfg := defaultConfig()
+	fs := cfg.flagSet(output)
+	configPath := fs.String("config", "", "YAML config file, see config.example.yaml")
+
+	// The flags are parsed first to find the config file, but they still
+	// win over everything else, so the flags that were set are remembered
+	// and skipped when applying the file and the environment
+	err := fs.Parse(args)
+	if err != nil {
+		return config{}, nil, err
+	}
+	onCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+
+	path := *configPath
+	if v, ok := lookupEnv(envName("config")); ok && !onCommandLine["config"] {
+		path = v
+	}
+	if path != "" {
+		values, lists, err := readConfigFile(path)
+		if err != nil {
+			return config{}, fs.Args(), err
+		}
+		cfg.Rules = lists.Rules
+		cfg.Buckets = lists.Buckets
+		cfg.Regions = lists.Regions
+		cfg.DownloadRules = lists.DownloadRules
+		cfg.DropBoxes = lists.DropBoxes
+		cfg.SLOs = lists.SLOs
+		cfg.Redactions = lists.Redactions
+		cfg.Tiers = lists.Tiers
+		cfg.Queues = lists.Queues
+		cfg.ResponseHeaders = lists.ResponseHeaders
+		cfg.Auth = lists.Auth
+		cfg.Pipelines = lists.Pipelines
+		err = applyConfigFile(fs, path, values, onCommandLine)
+		if err != nil {
+			return cfg, fs.Args(), err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := lookupEnv(envName(f.Name))
+		if !ok || onCommandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			errs = append(errs, settingProblem(f.Name, "%s: %s", envName(f.Name), err))
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return cfg, fs.Args(), err
+	}
+
+	err = cfg.validate()
+	if err != nil {
+		return cfg, fs.Args(), err
+	}
+
+	return cfg, fs.Args(), nil
+}
+
+// bucketSetup returns how missing buckets are created
+func (c config) bucketSetup() bucketSetup {
+	return bucketSetup{Policy: c.BucketPolicy, Region: c.BucketRegion, ObjectLocking: c.BucketObjectLocking}
+}
+
+// validate checks for settings that can't work, so the server fails at
+// startup instead of on the first request
+func (c config) validate() error {
+	var errs []error
+	check := func(ok bool, name, format string, args ...any) {
+		if !ok {
+			errs = append(errs, settingProblem(name, format, args...))
+		}
+	}
+
+	check(c.ListenAddr != "" && c.ListenAddr != unixPrefix, "listen", "listen address is empty")
+	check(c.MinioEndpoint != "", "minio-endpoint", "minio endpoint is empty")
+	check(c.Bucket != "", "bucket", "bucket name is empty")
+	check(c.EncryptionKey != "", "encryption-key", "encryption key is empty")
+	check(c.ReceiptKey != "", "receipt-key", "receipt key is empty")
+	check(c.PostPolicyKey != "", "post-policy-key", "post policy key is empty")
+	if c.VaultAddr != "" {
+		u, err := url.Parse(c.VaultAddr)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "vault-addr", "vault address %q is not an http or https URL", c.VaultAddr)
+		check(c.VaultToken != "", "vault-token", "vault token is empty")
+		check(c.VaultPath != "", "vault-path", "vault path is empty")
+	}
+	check(c.ChunkSize >= minChunkSize, "chunk-size", "chunk size %d is smaller than the minimum of %d", c.ChunkSize, minChunkSize)
+	check(c.MaxUploadSize >= 0, "max-upload-size", "max upload size %d is negative", c.MaxUploadSize)
+	check(c.ChunkSize < minChunkSize || c.MaxUploadSize <= c.ChunkSize*maxUploadParts, "max-upload-size", "max upload size %d needs more than %d parts of the chunk size %d", c.MaxUploadSize, maxUploadParts, c.ChunkSize)
+	_, err := c.Naming.name("file", anonymous, time.Time{})
+	check(err == nil, "naming", "%v", err)
+	err = c.ActiveContent.validate()
+	check(err == nil, "active-content", "%v", err)
+	check(c.TmpTTL > 0, "tmp-ttl", "tmp ttl must be positive")
+	check(c.TmpSweepInterval > 0, "tmp-sweep-interval", "tmp sweep interval must be positive")
+	check(c.BucketPolicy == bucketCreateIfMissing || c.BucketPolicy == bucketRequireExists, "bucket-policy", "unknown bucket policy %q", c.BucketPolicy)
+	if c.TenantBucketPrefix != "" {
+		// The shortest identity has to make a valid bucket name
+		err := s3utils.CheckValidBucketNameStrict(c.TenantBucketPrefix + "x")
+		check(err == nil, "tenant-bucket-prefix", "tenant bucket prefix %q: %v", c.TenantBucketPrefix, err)
+	}
+	check(c.StartupBackoff > 0, "startup-backoff", "startup backoff must be positive")
+	check(!c.Dev || !c.IngestEvents, "ingest-events", "ingest events needs minio, it can't be used in dev mode")
+	check(c.StartupMaxWait >= 0, "startup-max-wait", "startup max wait %s is negative", c.StartupMaxWait)
+	check(c.CacheSize >= 0, "cache-size", "cache size %d is negative", c.CacheSize)
+	check(c.MaxCachedObjectSize >= 0, "max-cached-object-size", "max cached object size %d is negative", c.MaxCachedObjectSize)
+	check(c.CacheTTL > 0, "cache-ttl", "cache ttl must be positive")
+	check(c.ScanCacheTTL >= 0, "scan-cache-ttl", "scan cache ttl %s is negative", c.ScanCacheTTL)
+	check(c.ScanCacheSize >= 0, "scan-cache-size", "scan cache size %d is negative", c.ScanCacheSize)
+	check(c.SegmentMinSize >= 0, "segment-manifest-min-size", "segment manifest min size %d is negative", c.SegmentMinSize)
+	check(c.SegmentSize > 0 && c.SegmentSize%decryptBlockSize == 0, "segment-size", "segment size %d isn't a positive multiple of %d", c.SegmentSize, decryptBlockSize)
+	check(c.MaxRequestTimeout > 0, "max-request-timeout", "max request timeout must be positive")
+	check(c.DrainTimeout > 0, "drain-timeout", "drain timeout must be positive")
+	check(c.ReadHeaderTimeout >= 0, "read-header-timeout", "read header timeout %s is negative", c.ReadHeaderTimeout)
+	check(c.ReadTimeout >= 0, "read-timeout", "read timeout %s is negative", c.ReadTimeout)
+	check(c.WriteTimeout >= 0, "write-timeout", "write timeout %s is negative", c.WriteTimeout)
+	check(c.IdleTimeout >= 0, "idle-timeout", "idle timeout %s is negative", c.IdleTimeout)
+	if err := c.validateTLS(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.ConverterURL != "" {
+		u, err := url.Parse(c.ConverterURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "converter-url", "converter URL %q is not an http or https URL", c.ConverterURL)
+	}
+	if c.CanaryWebhook != "" {
+		u, err := url.Parse(c.CanaryWebhook)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "canary-webhook", "canary webhook %q is not an http or https URL", c.CanaryWebhook)
+	}
+	check(c.InteractiveConcurrency > 0, "interactive-concurrency", "interactive concurrency must be positive")
+	check(c.InteractiveQueueLength >= 0, "interactive-queue", "interactive queue length %d is negative", c.InteractiveQueueLength)
+	check(c.BulkConcurrency > 0, "bulk-concurrency", "bulk concurrency must be positive")
+	check(c.BulkQueueLength >= 0, "bulk-queue", "bulk queue length %d is negative", c.BulkQueueLength)
+	check(c.FormSpillMax >= 0, "form-spill-max", "form spill max %d is negative", c.FormSpillMax)
+	_, err = parseTrustedProxies(c.TrustedProxies)
+	check(err == nil, "trusted-proxies", "trusted proxies: %v", err)
+	if err := validateRules(c.Rules); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateBuckets(c.Bucket, c.Buckets); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.validateRegions(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateDownloadRules(c.DownloadRules, c.GeoIPDB); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateDropBoxes(c.DropBoxes); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateSLOs(c.SLOs); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateRedactions(c.Redactions); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateTiers(c.Tiers); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateQueues(c.Queues); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateHeaderRules(c.ResponseHeaders); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateAuth(c.Auth, c.TLSCertFile != "" || c.AutocertHosts != ""); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validatePipelines(c.Pipelines, c.ClamdAddress, c.Queues); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	return nil
+}
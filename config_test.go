@@ -0,0 +1,120 @@
+package filesrv
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		want     func(*config)
+		wantArgs []string
+		wantErr  string
+	}{
+		{
+			name: "defaults",
+			want: func(*config) {},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"FILESRV_BUCKET":       "files",
+				"FILESRV_MINIO_SECURE": "true",
+				"FILESRV_TMP_TTL":      "10m",
+			},
+			want: func(c *config) {
+				c.Bucket = "files"
+				c.MinioSecure = true
+				c.TmpTTL = 10 * time.Minute
+			},
+		},
+		{
+			name: "flags win over the environment",
+			args: []string{"-bucket", "from-flag", "-chunk-size", "10485760", "check"},
+			env:  map[string]string{"FILESRV_BUCKET": "from-env"},
+			want: func(c *config) {
+				c.Bucket = "from-flag"
+				c.ChunkSize = 10 << 20
+			},
+			wantArgs: []string{"check"},
+		},
+		{
+			name:    "bad environment value",
+			env:     map[string]string{"FILESRV_CACHE_TTL": "forever"},
+			wantErr: `FILESRV_CACHE_TTL: parse error`,
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-bucket-name", "files"},
+			wantErr: "flag provided but not defined: -bucket-name",
+		},
+		{
+			name:    "invalid values",
+			args:    []string{"-bucket", "", "-chunk-size", "1024", "-naming", "alphabetical"},
+			wantErr: "invalid config: bucket name is empty\nchunk size 1024 is smaller than the minimum of 5242880\nunknown naming strategy \"alphabetical\"",
+		},
+		{
+			name:    "incomplete vault settings",
+			args:    []string{"-vault-addr", "vault:8200"},
+			wantErr: "invalid config: vault address \"vault:8200\" is not an http or https URL\nvault token is empty\nvault path is empty",
+		},
+		{
+			name:    "negative server timeouts",
+			args:    []string{"-read-timeout", "-1s", "-write-timeout", "0"},
+			wantErr: "invalid config: read timeout -1s is negative",
+		},
+		{
+			name:    "bad bucket settings",
+			args:    []string{"-bucket-policy", "create-always", "-tenant-bucket-prefix", "Tenant_"},
+			wantErr: "invalid config: unknown bucket policy \"create-always\"\ntenant bucket prefix \"Tenant_\"",
+		},
+		{
+			name:    "bad converter url",
+			args:    []string{"-converter-url", "gotenberg:3000"},
+			wantErr: "invalid config: converter URL \"gotenberg:3000\" is not an http or https URL",
+		},
+		{
+			name:    "dev mode without minio",
+			args:    []string{"-dev", "-ingest-events"},
+			wantErr: "invalid config: ingest events needs minio, it can't be used in dev mode",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				v, ok := test.env[name]
+				return v, ok
+			}
+
+			cfg, args, err := loadConfig(test.args, lookupEnv, io.Discard)
+			if test.wantErr != "" {
+				require.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			want := defaultConfig()
+			test.want(&want)
+			require.Equal(t, want, cfg)
+			require.Equal(t, test.wantArgs, args)
+		})
+	}
+}
+
+func TestLoadConfigHelp(t *testing.T) {
+	_, _, err := loadConfig([]string{"-h"}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.True(t, errors.Is(err, flag.ErrHelp))
+}
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	require.NoError(t, defaultConfig().validate())
+}
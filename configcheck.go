@@ -0,0 +1,134 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// errInvalidConfig is returned by `filesrv config validate` when it found
+// problems, so it exits with a failure after printing them
+var errInvalidConfig = errors.New("invalid config")
+
+// configProblem is something wrong with the config. Path is the setting it's
+// about as it's written in the config file, like http.tls-cert or rules[2],
+// whether or not it was set there. Problems reading the file itself have the
+// file and line instead.
+type configProblem struct {
+	Path    string `json:"path,omitempty"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p configProblem) Error() string {
+	switch {
+	case p.File != "" && p.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Message)
+	case p.File != "":
+		return p.File + ": " + p.Message
+	}
+	return p.Message
+}
+
+// settingPath is where the setting with the flag name goes in the config
+// file
+func settingPath(name string) string {
+	for _, section := range sortedKeys(configSections) {
+		if contains(configSections[section], name) {
+			return section + "." + name
+		}
+	}
+	return name
+}
+
+// settingProblem is a problem with the setting with the flag name
+func settingProblem(name, format string, args ...any) configProblem {
+	return configProblem{Path: settingPath(name), Message: fmt.Sprintf(format, args...)}
+}
+
+// listProblem is a problem with the i'th entry of a list section
+func listProblem(section string, i int, format string, args ...any) configProblem {
+	return configProblem{Path: fmt.Sprintf("%s[%d]", section, i), Message: fmt.Sprintf(format, args...)}
+}
+
+// configProblems flattens the error from loading the config into the
+// problems in it, anything that isn't a configProblem keeps its message
+func configProblems(err error) []configProblem {
+	var p configProblem
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case interface{ Unwrap() []error }:
+		var problems []configProblem
+		for _, err := range e.Unwrap() {
+			problems = append(problems, configProblems(err)...)
+		}
+		return problems
+	case interface{ Unwrap() error }:
+		if errors.As(err, &p) {
+			return configProblems(e.Unwrap())
+		}
+	case configProblem:
+		return []configProblem{e}
+	}
+
+	return []configProblem{{Message: err.Error()}}
+}
+
+// checkConfigFiles checks the settings that name files can be used, which
+// validate leaves until they're opened. It's only done for `filesrv config
+// validate`, since serving would fail on them anyway.
+func (c config) checkConfigFiles() error {
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil
+	}
+
+	_, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return settingProblem("tls-cert", "TLS cert and key: %s", err)
+	}
+
+	return nil
+}
+
+// configReport is what `filesrv config validate` prints
+type configReport struct {
+	Valid  bool            `json:"valid"`
+	Errors []configProblem `json:"errors"`
+}
+
+// cmdConfig is the `filesrv config validate` command. It reports every
+// problem with the config as JSON rather than stopping at the first, for
+// deployment pipelines to check a config before it's rolled out. It's run
+// even if the config couldn't be loaded, with the error from loading it.
+func cmdConfig(_ context.Context, w io.Writer, cfg config, loadErr error, args []string) error {
+	if len(args) != 1 || args[0] != "validate" {
+		return errors.New("config: expected validate")
+	}
+
+	problems := append(configProblems(loadErr), configProblems(cfg.checkConfigFiles())...)
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Path < problems[j].Path
+	})
+
+	report := configReport{Valid: len(problems) == 0, Errors: problems}
+	if report.Errors == nil {
+		report.Errors = []configProblem{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(report)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	if !report.Valid {
+		return errInvalidConfig
+	}
+	return nil
+}
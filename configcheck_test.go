@@ -0,0 +1,70 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmdConfigValidate(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+	validate := func(t *testing.T, args ...string) (configReport, error) {
+		t.Helper()
+
+		cfg, rest, loadErr := loadConfig(args, noEnv, io.Discard)
+		var out bytes.Buffer
+		err := cmdConfig(context.Background(), &out, cfg, loadErr, rest[1:])
+		var report configReport
+		require.NoError(t, json.Unmarshal(out.Bytes(), &report))
+		return report, err
+	}
+	certFile, keyFile := writeTestCert(t)
+	_, otherKeyFile := writeTestCert(t)
+
+	t.Run("valid", func(t *testing.T) {
+		report, err := validate(t, "-config", writeConfigFile(t, testConfigFile), "config", "validate")
+		require.NoError(t, err)
+		require.Equal(t, configReport{Valid: true, Errors: []configProblem{}}, report)
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		path := writeConfigFile(t, testConfigFile+`
+rules:
+  - name: big
+    action: allow
+  - name: odd
+    action: explode
+`)
+		report, err := validate(t, "-config", path, "-tls-cert", certFile, "-max-upload-size", "1099511627776", "config", "validate")
+		require.ErrorIs(t, err, errInvalidConfig)
+		require.False(t, report.Valid)
+		require.Equal(t, []configProblem{
+			{Path: "http.tls-cert", Message: "TLS cert file and key file have to be set together"},
+			{Path: "rules[1]", Message: `rule 2 (odd): unknown action "explode"`},
+			{Path: "storage.max-upload-size", Message: "max upload size 1099511627776 needs more than 10000 parts of the chunk size 5242880"},
+		}, report.Errors)
+	})
+
+	t.Run("mismatched TLS files", func(t *testing.T) {
+		report, err := validate(t, "-config", writeConfigFile(t, testConfigFile), "-tls-cert", certFile, "-tls-key", otherKeyFile, "config", "validate")
+		require.ErrorIs(t, err, errInvalidConfig)
+		require.Len(t, report.Errors, 1)
+		require.Equal(t, "http.tls-cert", report.Errors[0].Path)
+		require.Contains(t, report.Errors[0].Message, "private key does not match public key")
+
+		report, err = validate(t, "-config", writeConfigFile(t, testConfigFile), "-tls-cert", certFile, "-tls-key", keyFile, "config", "validate")
+		require.NoError(t, err)
+		require.True(t, report.Valid)
+	})
+
+	t.Run("problems in the file", func(t *testing.T) {
+		path := writeConfigFile(t, testConfigFile+"\nstorage:\n  bucket: again\n")
+		report, err := validate(t, "-config", path, "config", "validate")
+		require.ErrorIs(t, err, errInvalidConfig)
+		require.Equal(t, []configProblem{{File: path, Line: 14, Message: `section "storage" is repeated`}}, report.Errors)
+	})
+}
@@ -0,0 +1,367 @@
+package filesrv
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configSections maps each section of the config file to the settings in it,
+// the keys are the same as the flag names
+var configSections = map[string][]string{
+	"http": {
+		"listen", "max-request-timeout", "drain-timeout",
+		"read-header-timeout", "read-timeout", "write-timeout", "idle-timeout",
+		"tls-cert", "tls-key", "autocert-hosts", "autocert-email", "autocert-cache",
+		"interactive-concurrency", "interactive-queue", "bulk-concurrency", "bulk-queue",
+		"form-spill-dir", "form-spill-max", "fetch-allow-private", "trusted-proxies", "admin-group",
+		"worker-group",
+	},
+	"storage": {
+		"minio-endpoint", "minio-secure", "minio-access-key", "minio-secret-key", "bucket",
+		"chunk-size", "max-upload-size", "naming", "active-content", "tmp-ttl", "tmp-sweep-interval",
+		"bucket-policy", "bucket-region", "bucket-object-locking", "tenant-bucket-prefix",
+		"startup-backoff", "startup-max-wait", "ingest-events", "dev", "chaos", "placement",
+	},
+	"geoip":   {"geoip-db"},
+	"crypto":  {"encryption-key", "receipt-key", "post-policy-key"},
+	"vault":   {"vault-addr", "vault-token", "vault-path"},
+	"cache":   {"cache-size", "max-cached-object-size", "cache-ttl", "prefetch"},
+	"scan":    {"clamd", "scan-cache-ttl", "scan-cache-size"},
+	"canary":  {"canaries", "canary-webhook"},
+	"preview": {"converter-url", "ffmpeg", "segment-manifest-min-size", "segment-size"},
+}
+
+// requiredConfigKeys have to be in a config file. The defaults for these are
+// only fit for trying the server out, so a deployment has to set them.
+var requiredConfigKeys = []string{
+	"storage.minio-access-key",
+	"storage.minio-secret-key",
+	"storage.bucket",
+	"crypto.encryption-key",
+	"crypto.receipt-key",
+	"crypto.post-policy-key",
+}
+
+// vaultConfigKeys don't have to be in a config file that sets vault-addr, since
+// they are read from Vault
+var vaultConfigKeys = []string{
+	"storage.minio-access-key",
+	"storage.minio-secret-key",
+	"crypto.encryption-key",
+}
+
+// rulesSection, bucketsSection, regionsSection, downloadRulesSection,
+// dropBoxesSection, slosSection, redactionsSection, tiersSection,
+// queuesSection, responseHeadersSection, authSection and pipelinesSection are
+// the sections of the config file for the upload rules, the extra buckets,
+// the regions, the download rules, the drop boxes, the SLO targets, the
+// redaction rules, the tenant tiers, the processing queues, the response
+// header rules, the auth providers and the upload pipelines, unlike the
+// others they're lists
+const (
+	rulesSection           = "rules"
+	bucketsSection         = "buckets"
+	regionsSection         = "regions"
+	downloadRulesSection   = "download-rules"
+	dropBoxesSection       = "drop-boxes"
+	slosSection            = "slos"
+	redactionsSection      = "redactions"
+	tiersSection           = "tiers"
+	queuesSection          = "queues"
+	responseHeadersSection = "response-headers"
+	authSection            = "auth"
+	pipelinesSection       = "pipelines"
+)
+
+// ruleFields and ruleMatchFields are the fields allowed in each upload rule,
+// bucketFields in each bucket, regionFields in each region,
+// downloadRuleFields in each download rule, dropBoxFields in each drop box,
+// sloFields in each SLO target, redactionFields in each redaction rule,
+// tierFields in each tier, queueFields in each queue, headerRuleFields in
+// each response header rule, authFields in each auth provider and
+// pipelineFields in each pipeline
+var (
+	ruleFields         = []string{"name", "match", "action", "tags"}
+	ruleMatchFields    = []string{"min-size", "max-size", "extensions", "magic", "min-entropy", "tenants"}
+	bucketFields       = []string{"name", "chunk-size", "encryption-key"}
+	regionFields       = []string{"name", "minio-endpoint", "minio-secure", "minio-access-key", "minio-secret-key", "countries", "tenants"}
+	downloadRuleFields = []string{"name", "prefix", "tenants", "allow-countries", "deny-countries", "status"}
+	dropBoxFields      = []string{"name", "prefix", "owner", "max-size", "allowed-types"}
+	sloFields          = []string{"route", "percentile", "latency", "request-size", "response-size"}
+	redactionFields    = []string{"name", "filenames", "metadata-keys", "query-params"}
+	tierFields         = []string{"name", "default", "tenants", "upload-rate", "download-rate", "concurrency"}
+	queueFields        = []string{"name", "content-types", "visibility-timeout", "max-deliveries"}
+	headerRuleFields   = []string{"name", "prefix", "content-types", "headers"}
+	authFields         = []string{"name", "type", "users", "secret", "public-key-file", "issuer", "audience", "user-claim", "groups-claim", "client-ca"}
+	pipelineFields     = []string{"content-type", "stages", "async"}
+)
+
+// configLists are the list sections of the config file
+type configLists struct {
+	Rules   []uploadRule
+	Buckets []bucketConfig
+	Regions []regionConfig
+
+	DownloadRules   []downloadRule
+	DropBoxes       []dropBox
+	SLOs            []sloTarget
+	Redactions      []redactionRule
+	Tiers           []tierConfig
+	Queues          []queueConfig
+	ResponseHeaders []headerRule
+	Auth            []authConfig
+	Pipelines       []pipelineRule
+}
+
+// readConfigFile reads a YAML config file into a map from flag name to value,
+// along with the list sections. Every problem with the file is reported
+// together, with line numbers.
+func readConfigFile(path string) (map[string]string, configLists, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, configLists{}, fmt.Errorf("read config file: %w", err)
+	}
+
+	var doc yaml.Node
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, configLists{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	var lists configLists
+	var errs []error
+	fail := func(node *yaml.Node, format string, args ...any) {
+		errs = append(errs, configProblem{File: path, Line: node.Line, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(doc.Content) > 0 {
+		root := doc.Content[0]
+		if root.Kind != yaml.MappingNode {
+			return nil, configLists{}, configProblem{File: path, Line: root.Line, Message: "config has to be a mapping of sections"}
+		}
+
+		seen := map[string]bool{}
+		for i := 0; i+1 < len(root.Content); i += 2 {
+			sectionKey, section := root.Content[i], root.Content[i+1]
+			keys, ok := configSections[sectionKey.Value]
+			switch {
+			case seen[sectionKey.Value]:
+				fail(sectionKey, "section %q is repeated", sectionKey.Value)
+				continue
+			case sectionKey.Value == rulesSection:
+				seen[rulesSection] = true
+				lists.Rules = readRules(section, fail)
+				continue
+			case sectionKey.Value == bucketsSection:
+				seen[bucketsSection] = true
+				lists.Buckets = readList[bucketConfig](section, bucketsSection, "bucket", bucketFields, fail)
+				continue
+			case sectionKey.Value == regionsSection:
+				seen[regionsSection] = true
+				lists.Regions = readList[regionConfig](section, regionsSection, "region", regionFields, fail)
+				continue
+			case sectionKey.Value == downloadRulesSection:
+				seen[downloadRulesSection] = true
+				lists.DownloadRules = readList[downloadRule](section, downloadRulesSection, "download rule", downloadRuleFields, fail)
+				continue
+			case sectionKey.Value == dropBoxesSection:
+				seen[dropBoxesSection] = true
+				lists.DropBoxes = readList[dropBox](section, dropBoxesSection, "drop box", dropBoxFields, fail)
+				continue
+			case sectionKey.Value == slosSection:
+				seen[slosSection] = true
+				lists.SLOs = readList[sloTarget](section, slosSection, "slo", sloFields, fail)
+				continue
+			case sectionKey.Value == redactionsSection:
+				seen[redactionsSection] = true
+				lists.Redactions = readList[redactionRule](section, redactionsSection, "redaction", redactionFields, fail)
+				continue
+			case sectionKey.Value == tiersSection:
+				seen[tiersSection] = true
+				lists.Tiers = readList[tierConfig](section, tiersSection, "tier", tierFields, fail)
+				continue
+			case sectionKey.Value == queuesSection:
+				seen[queuesSection] = true
+				lists.Queues = readList[queueConfig](section, queuesSection, "queue", queueFields, fail)
+				continue
+			case sectionKey.Value == responseHeadersSection:
+				seen[responseHeadersSection] = true
+				lists.ResponseHeaders = readList[headerRule](section, responseHeadersSection, "response header rule", headerRuleFields, fail)
+				continue
+			case sectionKey.Value == authSection:
+				seen[authSection] = true
+				lists.Auth = readList[authConfig](section, authSection, "auth provider", authFields, fail)
+				continue
+			case sectionKey.Value == pipelinesSection:
+				seen[pipelinesSection] = true
+				lists.Pipelines = readList[pipelineRule](section, pipelinesSection, "pipeline", pipelineFields, fail)
+				continue
+			case !ok:
+				sections := append(sortedKeys(configSections), rulesSection, bucketsSection, regionsSection, downloadRulesSection, dropBoxesSection, slosSection, redactionsSection, tiersSection, queuesSection, responseHeadersSection, authSection, pipelinesSection)
+				sort.Strings(sections)
+				fail(sectionKey, "unknown section %q, expected one of %s", sectionKey.Value, strings.Join(sections, ", "))
+				continue
+			case section.Kind != yaml.MappingNode:
+				fail(section, "section %q has to be a mapping", sectionKey.Value)
+				continue
+			}
+			seen[sectionKey.Value] = true
+
+			for j := 0; j+1 < len(section.Content); j += 2 {
+				key, value := section.Content[j], section.Content[j+1]
+				name := sectionKey.Value + "." + key.Value
+				switch {
+				case !contains(keys, key.Value):
+					fail(key, "unknown field %q, expected one of %s", name, strings.Join(keys, ", "))
+				case seen[name]:
+					fail(key, "field %q is repeated", name)
+				case value.Kind != yaml.ScalarNode:
+					fail(value, "field %q has to be a single value", name)
+				default:
+					seen[name] = true
+					values[key.Value] = value.Value
+				}
+			}
+		}
+
+		for _, name := range requiredConfigKeys {
+			if seen["vault.vault-addr"] && contains(vaultConfigKeys, name) {
+				continue
+			}
+			if !seen[name] {
+				fail(root, "missing required field %q", name)
+			}
+		}
+	} else {
+		errs = append(errs, configProblem{File: path, Message: "config file is empty"})
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, configLists{}, err
+	}
+
+	return values, lists, nil
+}
+
+// readRules reads the rules section of the config file
+func readRules(section *yaml.Node, fail failFunc) []uploadRule {
+	if section.Kind != yaml.SequenceNode {
+		fail(section, "section %q has to be a list", rulesSection)
+		return nil
+	}
+
+	rules := make([]uploadRule, 0, len(section.Content))
+	for _, node := range section.Content {
+		if !checkFields(node, "rule", ruleFields, fail) {
+			continue
+		}
+		ok := true
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "match" {
+				ok = checkFields(node.Content[i+1], "rule match", ruleMatchFields, fail) && ok
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		var rule uploadRule
+		err := node.Decode(&rule)
+		if err != nil {
+			fail(node, "rule: %s", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// readList reads a list section of the config file where every entry is
+// decoded into a T, like the buckets and the regions
+func readList[T any](section *yaml.Node, sectionName, name string, fields []string, fail failFunc) []T {
+	if section.Kind != yaml.SequenceNode {
+		fail(section, "section %q has to be a list", sectionName)
+		return nil
+	}
+
+	list := make([]T, 0, len(section.Content))
+	for _, node := range section.Content {
+		if !checkFields(node, name, fields, fail) {
+			continue
+		}
+
+		var v T
+		err := node.Decode(&v)
+		if err != nil {
+			fail(node, "%s: %s", name, err)
+			continue
+		}
+		list = append(list, v)
+	}
+
+	return list
+}
+
+// failFunc records a problem with a node in the config file
+type failFunc func(node *yaml.Node, format string, args ...any)
+
+// checkFields checks a list entry is a mapping with only the given fields,
+// since decoding would silently ignore unknown ones
+func checkFields(node *yaml.Node, name string, fields []string, fail failFunc) bool {
+	if node.Kind != yaml.MappingNode {
+		fail(node, "%s has to be a mapping", name)
+		return false
+	}
+	ok := true
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !contains(fields, key.Value) {
+			fail(key, "unknown field %q in %s, expected one of %s", key.Value, name, strings.Join(fields, ", "))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// applyConfigFile sets the flags from the values in the config file, skipping
+// the ones in skip
+func applyConfigFile(fs *flag.FlagSet, path string, values map[string]string, skip map[string]bool) error {
+	var errs []error
+	for _, name := range sortedKeys(values) {
+		if skip[name] {
+			continue
+		}
+		err := fs.Set(name, values[name])
+		if err != nil {
+			errs = append(errs, configProblem{Path: settingPath(name), File: path, Message: fmt.Sprintf("%s: %s", name, err)})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+package filesrv
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testConfigFile = `
+http:
+  listen: ":8080"
+storage:
+  minio-access-key: access
+  minio-secret-key: secret
+  bucket: from-file
+  tmp-ttl: 2h
+crypto:
+  encryption-key: file key
+  receipt-key: receipt key
+  post-policy-key: policy key
+`
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile)
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want func(*config)
+	}{
+		{
+			name: "file",
+			args: []string{"-config", path},
+			want: func(*config) {},
+		},
+		{
+			name: "file from the environment",
+			env:  map[string]string{"FILESRV_CONFIG": path},
+			want: func(*config) {},
+		},
+		{
+			name: "environment wins over the file",
+			args: []string{"-config", path},
+			env:  map[string]string{"FILESRV_BUCKET": "from-env"},
+			want: func(c *config) { c.Bucket = "from-env" },
+		},
+		{
+			name: "flags win over both",
+			args: []string{"-config", path, "-bucket", "from-flag"},
+			env:  map[string]string{"FILESRV_BUCKET": "from-env"},
+			want: func(c *config) { c.Bucket = "from-flag" },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				v, ok := test.env[name]
+				return v, ok
+			}
+
+			cfg, _, err := loadConfig(test.args, lookupEnv, io.Discard)
+			require.NoError(t, err)
+
+			want := defaultConfig()
+			want.ListenAddr = ":8080"
+			want.AccessKeyID = "access"
+			want.SecretAccessKey = "secret"
+			want.Bucket = "from-file"
+			want.TmpTTL = 2 * time.Hour
+			want.EncryptionKey = "file key"
+			want.ReceiptKey = "receipt key"
+			want.PostPolicyKey = "policy key"
+			test.want(&want)
+			require.Equal(t, want, cfg)
+		})
+	}
+}
+
+func TestReadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{
+			name:     "empty",
+			contents: "",
+			wantErr:  "config file is empty",
+		},
+		{
+			name:     "not a mapping",
+			contents: "- listen",
+			wantErr:  ":1: config has to be a mapping of sections",
+		},
+		{
+			name:     "unknown section",
+			contents: testConfigFile + "database:\n  url: postgres://\n",
+			wantErr:  `:13: unknown section "database", expected one of auth, buckets, cache, canary, crypto, download-rules, drop-boxes, geoip, http, pipelines, preview, queues, redactions, regions, response-headers, rules, scan, slos, storage, tiers, vault`,
+		},
+		{
+			name:     "unknown field",
+			contents: testConfigFile + "cache:\n  size: 10\n",
+			wantErr:  `:14: unknown field "cache.size", expected one of cache-size, max-cached-object-size, cache-ttl, prefetch`,
+		},
+		{
+			name:     "field in the wrong section",
+			contents: testConfigFile + "scan:\n  bucket: files\n",
+			wantErr:  `:14: unknown field "scan.bucket"`,
+		},
+		{
+			name:     "not a single value",
+			contents: testConfigFile + "cache:\n  prefetch: [a, b]\n",
+			wantErr:  `:14: field "cache.prefetch" has to be a single value`,
+		},
+		{
+			name:     "missing fields",
+			contents: "storage:\n  bucket: files\n",
+			wantErr:  `missing required field "storage.minio-access-key"`,
+		},
+		{
+			name:     "rules not a list",
+			contents: testConfigFile + "rules:\n  name: exe\n",
+			wantErr:  `:14: section "rules" has to be a list`,
+		},
+		{
+			name:     "unknown rule field",
+			contents: testConfigFile + "rules:\n  - name: exe\n    when: {}\n",
+			wantErr:  `:15: unknown field "when" in rule`,
+		},
+		{
+			name:     "unknown rule match field",
+			contents: testConfigFile + "rules:\n  - name: exe\n    match:\n      ext: [.exe]\n",
+			wantErr:  `:16: unknown field "ext" in rule match`,
+		},
+		{
+			name:     "invalid yaml",
+			contents: "storage: [",
+			wantErr:  "yaml:",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := readConfigFile(writeConfigFile(t, test.contents))
+			require.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestLoadConfigFileRules(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+rules:
+  - name: executables
+    match:
+      extensions: [exe, .dll]
+      magic: ["4d5a"]
+    action: reject
+  - name: big-and-random
+    match:
+      min-size: 1048576
+      min-entropy: 7.5
+      tenants: [alice]
+    action: tag
+    tags: [encrypted]
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []uploadRule{
+		{
+			Name:   "executables",
+			Match:  ruleMatch{Extensions: []string{"exe", ".dll"}, Magic: []string{"4d5a"}},
+			Action: ruleReject,
+		},
+		{
+			Name:   "big-and-random",
+			Match:  ruleMatch{MinSize: 1 << 20, MinEntropy: 7.5, Tenants: []string{"alice"}},
+			Action: ruleTag,
+			Tags:   []string{"encrypted"},
+		},
+	}, cfg.Rules)
+}
+
+func TestLoadConfigFileBadRule(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+"rules:\n  - name: exe\n    action: delete\n")
+
+	_, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, `rule 1 (exe): unknown action "delete"`)
+}
+
+func TestLoadConfigFileBuckets(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+buckets:
+  - name: archive
+    chunk-size: 16777216
+  - name: secrets
+    encryption-key: another key
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []bucketConfig{
+		{Name: "archive", ChunkSize: 16 << 20},
+		{Name: "secrets", EncryptionKey: "another key"},
+	}, cfg.Buckets)
+}
+
+func TestLoadConfigFileBadBucket(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+"buckets:\n  - name: archive\n    chunk: 1\n")
+
+	_, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, `unknown field "chunk" in bucket, expected one of name, chunk-size, encryption-key`)
+}
+
+func TestLoadConfigFileDownloadRules(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+geoip:
+  geoip-db: GeoLite2-Country.mmdb
+download-rules:
+  - name: licensed
+    prefix: films-
+    allow-countries: [FR, BE]
+    status: 451
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []downloadRule{
+		{Name: "licensed", Prefix: "films-", Allow: []string{"FR", "BE"}, Status: 451},
+	}, cfg.DownloadRules)
+
+	path = writeConfigFile(t, testConfigFile+"download-rules:\n  - name: licensed\n    allow-countries: [FR]\n")
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "download rules need a geoip database")
+}
+
+func TestLoadConfigFileDropBoxes(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+drop-boxes:
+  - name: k3v9q2
+    prefix: inbox-
+    owner: alice
+    max-size: 1048576
+    allowed-types: [application/pdf]
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []dropBox{
+		{Name: "k3v9q2", Prefix: "inbox-", Owner: "alice", MaxSize: 1 << 20, AllowedTypes: []string{"application/pdf"}},
+	}, cfg.DropBoxes)
+}
+
+func TestLoadConfigFileSLOs(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+slos:
+  - route: GET /file/:filename
+    percentile: 99
+    latency: 500ms
+  - route: PUT /file/:filename
+    percentile: 95
+    request-size: 104857600
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []sloTarget{
+		{Route: "GET /file/:filename", Percentile: 99, Latency: 500 * time.Millisecond},
+		{Route: "PUT /file/:filename", Percentile: 95, RequestSize: 100 << 20},
+	}, cfg.SLOs)
+
+	path = writeConfigFile(t, testConfigFile+`
+slos:
+  - route: /file/:filename
+    percentile: 100
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "route has to be a method and a path")
+	require.ErrorContains(t, err, "percentile 100 has to be between 0 and 100")
+	require.ErrorContains(t, err, "there has to be a latency")
+}
+
+func TestLoadConfigFileRedactions(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+redactions:
+  - name: patients
+    filenames: ['^patient-\d+']
+    metadata-keys: [X-Amz-Meta-Patient]
+    query-params: [token]
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []redactionRule{
+		{Name: "patients", Filenames: []string{`^patient-\d+`}, MetadataKeys: []string{"X-Amz-Meta-Patient"}, QueryParams: []string{"token"}},
+	}, cfg.Redactions)
+
+	path = writeConfigFile(t, testConfigFile+`
+redactions:
+  - name: broken
+    filenames: ['(']
+  - name: empty
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "redaction 1 (broken): filenames")
+	require.ErrorContains(t, err, "redaction 2 (empty): there's nothing to redact")
+}
+
+func TestReadConfigFileVault(t *testing.T) {
+	// The keys that come from Vault aren't required
+	values, _, err := readConfigFile(writeConfigFile(t, `
+storage:
+  bucket: files
+crypto:
+  receipt-key: receipt key
+  post-policy-key: policy key
+vault:
+  vault-addr: https://vault:8200
+  vault-path: secret/data/filesrv
+`))
+	require.NoError(t, err)
+	require.Equal(t, "https://vault:8200", values["vault-addr"])
+}
+
+func TestLoadConfigFileBadValue(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+"cache:\n  cache-ttl: forever\n")
+
+	_, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "cache-ttl: parse error")
+}
+
+func TestExampleConfigFile(t *testing.T) {
+	cfg, _, err := loadConfig([]string{"-config", "config.example.yaml"}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+
+	// The example documents the defaults
+	want := defaultConfig()
+	want.ChunkSize = 5 << 20
+	require.Equal(t, want, cfg)
+}
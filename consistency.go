@@ -0,0 +1,88 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// consistencyHeader carries the consistency token, it's set on upload
+// responses and clients send it back on reads
+const consistencyHeader = "X-Consistency-Token"
+
+// consistencyWait is the longest a read waits for the server to catch up with
+// a consistency token
+const consistencyWait = 10 * time.Second
+
+// errStaleRead is returned by awaitConsistency when the server didn't catch
+// up with the token in time
+var errStaleRead = errors.New("server hasn't caught up with the consistency token")
+
+// consistencyToken returns a token for the current state of the catalog. A
+// read that presents it is guaranteed to see every write made before it was
+// issued. It's the catalog sequence number, the same as the change feed
+// cursor, but clients should treat it as opaque.
+func (s server) consistencyToken() string {
+	return strconv.FormatUint(s.catalog.latestSeq(), 10)
+}
+
+// readConsistent makes sure a read will see the version of the file the
+// client's consistency token was issued for. If it can't, it writes the error
+// response and returns false.
+func (s server) readConsistent(w http.ResponseWriter, r *http.Request, filename string) bool {
+	token := r.Header.Get(consistencyHeader)
+	if token == "" {
+		return true
+	}
+	seq, err := strconv.ParseUint(token, 10, 64)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	err = s.awaitConsistency(r.Context(), seq, filename)
+	if err != nil {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		log.Printf("consistency: filename: %s, token: %d, error: %s", filename, seq, err)
+		return false
+	}
+
+	return true
+}
+
+// awaitConsistency waits until the catalog has caught up with seq and drops
+// any cached copy of the file, so the read that follows sees at least the
+// version the token was issued for
+func (s server) awaitConsistency(ctx context.Context, seq uint64, filename string) error {
+	timer := time.NewTimer(consistencyWait)
+	defer timer.Stop()
+
+	for {
+		// As with watch the channel has to be taken before checking, so a
+		// change in between isn't missed
+		changed := s.catalog.changedChan()
+		if s.catalog.latestSeq() >= seq {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return errStaleRead
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// The cache is invalidated on every write this server makes, but not
+	// for writes made behind its back, so read from the bucket to be sure
+	if inv, ok := s.minioClient.(invalidator); ok {
+		inv.invalidate(s.bucketName, filename)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsistencyToken(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(newCachingStore(store, 1<<20, 1<<20, time.Minute), "testBucket", "key", 10<<17)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, newUploadRequest(t, "/upload", "filename", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	var resp uploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.NotEmpty(t, resp.ConsistencyToken)
+	require.Equal(t, resp.ConsistencyToken, w.Result().Header.Get(consistencyHeader))
+
+	// Fill the cache, then change the file behind its back
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/filename", nil))
+	require.Equal(t, "test file contents", w.Body.String())
+	other := NewServer(store, "testBucket", "key", 10<<17)
+	_, err := other.putFile(context.Background(), "filename", strings.NewReader("new contents"), 12)
+	require.NoError(t, err)
+
+	// Without a token the cached copy is fine
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/filename", nil))
+	require.Equal(t, "test file contents", w.Body.String())
+
+	// With one the read goes to the bucket
+	r := httptest.NewRequest(http.MethodGet, "/file/filename", nil)
+	r.Header.Set(consistencyHeader, resp.ConsistencyToken)
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	require.Equal(t, "new contents", w.Body.String())
+}
+
+func TestConsistencyTokenWaits(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	_, err := s.putFile(context.Background(), "filename", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+
+	// A token from the future, as if another server had taken a write this
+	// one hasn't caught up with yet
+	token := strconv.FormatUint(s.catalog.latestSeq()+1, 10)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		r := httptest.NewRequest(http.MethodGet, "/file/filename", nil)
+		r.Header.Set(consistencyHeader, token)
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, r)
+		done <- w
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("read didn't wait for the catalog to catch up")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.catalog.put(catalogEntry{Name: "filename"})
+	w := <-done
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "test file contents", w.Body.String())
+}
+
+func TestConsistencyTokenErrors(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	r := httptest.NewRequest(http.MethodGet, "/file/filename", nil)
+	r.Header.Set(consistencyHeader, "not a token")
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, s.awaitConsistency(ctx, 100, "filename"), context.Canceled)
+}
@@ -0,0 +1,52 @@
+package filesrv
+
+import (
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleGetContent returns the file whose plaintext has the SHA-256 checksum
+// given in the URL, so clients can fetch by content instead of by a name that
+// might be overwritten
+func (s server) handleGetContent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sum := strings.ToLower(ps.ByName("sha256"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	entry, ok := s.catalog.byChecksum(sum)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !s.checkAccess(w, r, entry.Name, accessRead) || !s.downloadAllowed(w, r, entry.Name) {
+		return
+	}
+	if !s.setFileHeaders(w, r, entry.Name, entry) {
+		return
+	}
+	w.Header().Set("Content-Location", "/file/"+entry.Name)
+
+	err := s.getFile(r.Context(), w, entry.Name)
+	if err != nil {
+		clearFileHeaders(w.Header())
+	}
+	if errors.Is(err, errNotFound) {
+		// The catalog is out of date, the file was removed without going
+		// through the server
+		w.WriteHeader(http.StatusNotFound)
+		log.Println("catalog entry without object:", entry.Name)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err, "get content")
+		return
+	}
+}
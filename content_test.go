@@ -0,0 +1,64 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetContent(t *testing.T) {
+	tests := []struct {
+		name         string
+		sha256       string
+		wantStatus   int
+		wantBody     string
+		wantLocation string
+	}{
+		{
+			name:         "should work",
+			sha256:       "c4fa968a745586faaa030054f51fb1cafd5e9ae25fa6b137ac6477715fdc81b1",
+			wantStatus:   http.StatusOK,
+			wantBody:     "test file contents",
+			wantLocation: "/file/testFileName.txt",
+		},
+		{
+			name:         "upper case checksum",
+			sha256:       "C4FA968A745586FAAA030054F51FB1CAFD5E9AE25FA6B137AC6477715FDC81B1",
+			wantStatus:   http.StatusOK,
+			wantBody:     "test file contents",
+			wantLocation: "/file/testFileName.txt",
+		},
+		{
+			name:       "unknown checksum",
+			sha256:     "0000000000000000000000000000000000000000000000000000000000000000",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "not a checksum",
+			sha256:     "testFileName.txt",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+			w := httptest.NewRecorder()
+			s.handlePostUploadFile(w, newUploadRequest(t, "/upload", "testFileName.txt", "test file contents"), nil)
+			require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+			req := httptest.NewRequest(http.MethodGet, "/content/"+test.sha256, nil)
+			w = httptest.NewRecorder()
+
+			s.handleGetContent(w, req, httprouter.Params{{Key: "sha256", Value: test.sha256}})
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			require.Equal(t, test.wantBody, w.Body.String())
+			require.Equal(t, test.wantLocation, w.Result().Header.Get("Content-Location"))
+		})
+	}
+}
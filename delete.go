@@ -0,0 +1,152 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleDeleteFile deletes the file with the name given in the URL. With
+// If-Match the file is only deleted if it is still the version the client
+// expects, so a cleanup job can't remove a file that was uploaded again since
+// it last looked.
+func (s server) handleDeleteFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := ps.ByName("filename")
+
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	_, err := s.minioClient.StatObject(r.Context(), s.bucketName, filename)
+	if err != nil {
+		writeStorageError(w, err, "delete file: filename: "+filename)
+		return
+	}
+
+	current, exists := s.catalog.get(filename)
+	if status := checkPreconditions(r, current, exists); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	err = s.minioClient.RemoveObject(r.Context(), s.bucketName, filename)
+	if err != nil {
+		writeStorageError(w, err, "delete file: filename: "+filename)
+		return
+	}
+
+	err = s.unindex(r.Context(), filename)
+	if err != nil {
+		log.Println("unindex deleted file:", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// maxBatchDelete is the most files POST /files/delete takes, which is as many
+// as minio removes in one request
+const maxBatchDelete = 1000
+
+// batchDeleteRequest is the body of POST /files/delete
+type batchDeleteRequest struct {
+	Names []string `json:"names"`
+}
+
+// batchDeleteResult is how deleting one of the files went, Status is what
+// DELETE /file would have responded with
+type batchDeleteResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handlePostBatchDelete deletes a list of files with one request to minio,
+// for cleanup jobs that would otherwise send thousands of DELETEs. Each file
+// gets its own result, so one that's missing or can't be deleted doesn't stop
+// the rest. Like DELETE /file, files that aren't in the catalog are deleted if
+// they're in the bucket, and names that couldn't be uploaded are rejected.
+func (s server) handlePostBatchDelete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req batchDeleteRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchDelete*(maxPathLength+3)+maxFormOverhead)).Decode(&req)
+	if err == nil && len(req.Names) > maxBatchDelete {
+		err = fmt.Errorf("%d names is more than %d", len(req.Names), maxBatchDelete)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode batch delete request:", err)
+		return
+	}
+
+	// Sorted so the names are always locked in the same order
+	names := slices.Clone(req.Names)
+	slices.Sort(names)
+	names = slices.Compact(names)
+	results := make(map[string]*batchDeleteResult, len(names))
+	var remove []string
+	for _, name := range names {
+		result := &batchDeleteResult{Name: name, Status: http.StatusNoContent}
+		results[name] = result
+
+		// The objects the server keeps for itself and the files in the /tmp
+		// and sync namespaces can't be named here, like they can't be uploaded
+		if c := checkPath(name); !c.OK {
+			result.Status = c.status
+			result.Error = c.Reason
+			continue
+		}
+		if !s.hasAccess(r, name, accessWrite) {
+			result.Status = http.StatusForbidden
+			log.Printf("access denied: filename: %s, user: %s, access: %s", name, requestIdentity(r), accessWrite)
+			continue
+		}
+
+		unlock := s.nameLocks.lock(name)
+		defer unlock()
+		if _, ok := s.catalog.get(name); !ok {
+			_, err := s.minioClient.StatObject(r.Context(), s.bucketName, name)
+			if err != nil {
+				result.Status = storageStatus(err)
+				if result.Status != http.StatusNotFound {
+					result.Error = err.Error()
+					log.Printf("batch delete: filename: %s, error: %s", name, err)
+				}
+				continue
+			}
+		}
+		remove = append(remove, name)
+	}
+
+	var removed bool
+	if len(remove) > 0 {
+		errs := s.minioClient.RemoveObjects(r.Context(), s.bucketName, remove)
+		for _, name := range remove {
+			if err := errs[name]; err != nil {
+				results[name].Status = storageStatus(err)
+				results[name].Error = err.Error()
+				log.Printf("batch delete: filename: %s, error: %s", name, err)
+				continue
+			}
+			removed = s.catalog.remove(name) || removed
+		}
+	}
+	if removed {
+		err = s.saveCatalog(r.Context())
+		if err != nil {
+			log.Println("unindex deleted files:", err)
+		}
+	}
+
+	resp := make([]batchDeleteResult, 0, len(names))
+	for _, name := range names {
+		resp = append(resp, *results[name])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("encode batch delete results:", err)
+	}
+}
@@ -0,0 +1,171 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleDeleteFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		ifMatch    string
+		wantStatus int
+		wantGone   bool
+	}{
+		{
+			name:       "unconditional",
+			target:     "/file/filename",
+			wantStatus: http.StatusNoContent,
+			wantGone:   true,
+		},
+		{
+			name:       "matching etag",
+			target:     "/file/filename",
+			ifMatch:    etag(testFileSHA256),
+			wantStatus: http.StatusNoContent,
+			wantGone:   true,
+		},
+		{
+			name:       "any version",
+			target:     "/file/filename",
+			ifMatch:    "*",
+			wantStatus: http.StatusNoContent,
+			wantGone:   true,
+		},
+		{
+			name:       "changed since",
+			target:     "/file/filename",
+			ifMatch:    etag(strings.Repeat("0", 64)),
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "missing",
+			target:     "/file/missing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			s := NewServer(store, "testBucket", "key", 10<<17)
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, newUploadRequest(t, "/upload", "filename", "test file contents"))
+			require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+			w = httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/filename", nil))
+			require.Equal(t, etag(testFileSHA256), w.Result().Header.Get("ETag"))
+
+			r := httptest.NewRequest(http.MethodDelete, test.target, nil)
+			if test.ifMatch != "" {
+				r.Header.Set("If-Match", test.ifMatch)
+			}
+			w = httptest.NewRecorder()
+			s.routes().ServeHTTP(w, r)
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+
+			_, err := store.StatObject(context.Background(), "testBucket", "filename")
+			_, indexed := s.catalog.get("filename")
+			if test.wantGone {
+				require.Error(t, err)
+				require.False(t, indexed)
+			} else {
+				require.NoError(t, err)
+				require.True(t, indexed)
+			}
+		})
+	}
+}
+
+// failingRemoveStore fails to remove one object when asked to remove several
+type failingRemoveStore struct {
+	*memObjStore
+	fail string
+}
+
+func (f failingRemoveStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	var rest []string
+	for _, filename := range filenames {
+		if filename != f.fail {
+			rest = append(rest, filename)
+		}
+	}
+
+	errs := f.memObjStore.RemoveObjects(ctx, bucketName, rest)
+	errs[f.fail] = minio.ErrorResponse{Code: "AccessDenied"}
+	return errs
+}
+
+func TestHandlePostBatchDelete(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(failingRemoveStore{memObjStore: store, fail: "stuck.txt"}, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(r *http.Request, user string) *httptest.ResponseRecorder {
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	for _, name := range []string{"a.txt", "b.txt", "stuck.txt", "private.txt"} {
+		require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", name, "test file contents"), "alice").Result().StatusCode)
+	}
+	w := do(httptest.NewRequest(http.MethodPut, "/file/private.txt/acl", strings.NewReader(`{"grants": [{"user": "bob", "access": "read"}]}`)), "alice")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	// Files that aren't in the catalog are deleted too, like with DELETE
+	_, err := store.PutObject(context.Background(), "testBucket", "uncataloged.txt", strings.NewReader("test file contents"), 18, 10<<17)
+	require.NoError(t, err)
+
+	// Nor are the server's own objects or the reserved folders
+	for _, name := range []string{catalogObject, "tmp/scratch.txt", "sync/docs/a.txt"} {
+		_, err := store.PutObject(context.Background(), "testBucket", name, strings.NewReader("test file contents"), 18, 10<<17)
+		require.NoError(t, err)
+	}
+
+	w = do(httptest.NewRequest(http.MethodPost, "/files/delete", strings.NewReader(`{"names": ["b.txt", "a.txt", "missing.txt", "stuck.txt", "private.txt", "uncataloged.txt", "a.txt", ".filesrv-catalog", "tmp/scratch.txt", "sync/docs/a.txt"]}`)), "bob")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var got []batchDeleteResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, []batchDeleteResult{
+		{Name: ".filesrv-catalog", Status: http.StatusBadRequest, Error: "filename starts with a dot"},
+		{Name: "a.txt", Status: http.StatusNoContent},
+		{Name: "b.txt", Status: http.StatusNoContent},
+		{Name: "missing.txt", Status: http.StatusNotFound},
+		{Name: "private.txt", Status: http.StatusForbidden},
+		{Name: "stuck.txt", Status: http.StatusForbidden, Error: minio.ErrorResponse{Code: "AccessDenied"}.Error()},
+		{Name: "sync/docs/a.txt", Status: http.StatusBadRequest, Error: "path is in the reserved folder sync/"},
+		{Name: "tmp/scratch.txt", Status: http.StatusBadRequest, Error: "path is in the reserved folder tmp/"},
+		{Name: "uncataloged.txt", Status: http.StatusNoContent},
+	}, got)
+	for _, name := range []string{catalogObject, "tmp/scratch.txt", "sync/docs/a.txt"} {
+		_, err := store.StatObject(context.Background(), "testBucket", name)
+		require.NoError(t, err, name)
+	}
+
+	_, err = store.StatObject(context.Background(), "testBucket", "uncataloged.txt")
+	require.Error(t, err)
+	for name, want := range map[string]bool{"a.txt": false, "b.txt": false, "stuck.txt": true, "private.txt": true} {
+		_, ok := s.catalog.get(name)
+		require.Equal(t, want, ok, name)
+		_, err := store.StatObject(context.Background(), "testBucket", name)
+		require.Equal(t, want, err == nil, name)
+	}
+
+	t.Run("too many", func(t *testing.T) {
+		names, err := json.Marshal(batchDeleteRequest{Names: make([]string, maxBatchDelete+1)})
+		require.NoError(t, err)
+		w := do(httptest.NewRequest(http.MethodPost, "/files/delete", bytes.NewReader(names)), "bob")
+		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	})
+}
@@ -0,0 +1,315 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// devStore keeps objects in memory for dev mode. It answers like minio does,
+// so the rest of the server can't tell the difference.
+type devStore struct {
+	mu      sync.Mutex
+	objects map[string]devObject
+	uploads map[string]*devUpload
+}
+
+type devObject struct {
+	data     []byte
+	modified time.Time
+	metadata map[string]string
+	tags     map[string]string
+}
+
+// devUpload is a multipart upload that hasn't been completed
+type devUpload struct {
+	bucketName string
+	filename   string
+	initiated  time.Time
+	parts      map[int][]byte
+	// metadata and tags are given to the object when it's completed
+	metadata map[string]string
+	tags     map[string]string
+}
+
+func newDevStore() *devStore {
+	return &devStore{objects: map[string]devObject{}, uploads: map[string]*devUpload{}}
+}
+
+// errDevNoSuchKey is the error minio gives for a missing object
+var errDevNoSuchKey = minio.ErrorResponse{
+	Code:       "NoSuchKey",
+	Message:    "The specified key does not exist.",
+	StatusCode: http.StatusNotFound,
+}
+
+func (d *devStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, _, _ int64) (minio.UploadInfo, error) {
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.objects[path.Join(bucketName, filename)] = devObject{data: b, modified: time.Now(), metadata: objectMetadata(ctx), tags: objectTags(ctx)}
+
+	return minio.UploadInfo{Bucket: bucketName, Key: filename, Size: int64(len(b))}, nil
+}
+
+func (d *devStore) GetObject(_ context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	obj, ok := d.objects[path.Join(bucketName, filename)]
+	if !ok {
+		// minio only reports a missing object on the first read
+		return io.NopCloser(devErrorReader{err: errDevNoSuchKey}), nil
+	}
+
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (d *devStore) GetObjectRange(_ context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	obj, ok := d.objects[path.Join(bucketName, filename)]
+	if !ok {
+		return io.NopCloser(devErrorReader{err: errDevNoSuchKey}), nil
+	}
+
+	return io.NopCloser(bytes.NewReader(sliceRange(obj.data, offset, length))), nil
+}
+
+func (d *devStore) RemoveObject(_ context.Context, bucketName, filename string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.objects, path.Join(bucketName, filename))
+
+	return nil
+}
+
+func (d *devStore) RemoveObjects(_ context.Context, bucketName string, filenames []string) map[string]error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, filename := range filenames {
+		delete(d.objects, path.Join(bucketName, filename))
+	}
+
+	return nil
+}
+
+func (d *devStore) ListObjects(_ context.Context, bucketName, prefix string) ([]minio.ObjectInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var objects []minio.ObjectInfo
+	for key, obj := range d.objects {
+		name, ok := strings.CutPrefix(key, bucketName+"/")
+		if !ok || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		objects = append(objects, minio.ObjectInfo{Key: name, Size: int64(len(obj.data)), LastModified: obj.modified})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+func (d *devStore) StatObject(_ context.Context, bucketName, filename string) (minio.ObjectInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	obj, ok := d.objects[path.Join(bucketName, filename)]
+	if !ok {
+		return minio.ObjectInfo{}, errDevNoSuchKey
+	}
+
+	return minio.ObjectInfo{Key: filename, Size: int64(len(obj.data)), LastModified: obj.modified, UserMetadata: obj.metadata, UserTags: obj.tags}, nil
+}
+
+func (d *devStore) PutObjectTagging(_ context.Context, bucketName, filename string, tags map[string]string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := path.Join(bucketName, filename)
+	obj, ok := d.objects[key]
+	if !ok {
+		return errDevNoSuchKey
+	}
+	obj.tags = maps.Clone(tags)
+	d.objects[key] = obj
+
+	return nil
+}
+
+func (d *devStore) ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := path.Join(bucketName, filename)
+	obj, ok := d.objects[key]
+	if !ok {
+		return errDevNoSuchKey
+	}
+	obj.metadata = objectMetadata(ctx)
+	d.objects[key] = obj
+
+	return nil
+}
+
+// errDevNoSuchUpload is the error minio gives for a multipart upload that
+// doesn't exist, or has been completed or aborted
+var errDevNoSuchUpload = minio.ErrorResponse{Code: "NoSuchUpload", StatusCode: http.StatusNotFound}
+
+func (d *devStore) ListIncompleteUploads(_ context.Context, bucketName, prefix string) ([]minio.ObjectMultipartInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var uploads []minio.ObjectMultipartInfo
+	for id, u := range d.uploads {
+		if u.bucketName != bucketName || !strings.HasPrefix(u.filename, prefix) {
+			continue
+		}
+		info := minio.ObjectMultipartInfo{Key: u.filename, UploadID: id, Initiated: u.initiated}
+		for _, part := range u.parts {
+			info.Size += int64(len(part))
+		}
+		uploads = append(uploads, info)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Key < uploads[j].Key })
+
+	return uploads, nil
+}
+
+func (d *devStore) AbortMultipartUpload(_ context.Context, _, _, uploadID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.uploads[uploadID]; !ok {
+		return errDevNoSuchUpload
+	}
+	delete(d.uploads, uploadID)
+
+	return nil
+}
+
+func (d *devStore) NewMultipartUpload(ctx context.Context, bucketName, filename string) (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	uploadID := hex.EncodeToString(id)
+	d.uploads[uploadID] = &devUpload{bucketName: bucketName, filename: filename, initiated: time.Now(), parts: map[int][]byte{}, metadata: objectMetadata(ctx), tags: objectTags(ctx)}
+
+	return uploadID, nil
+}
+
+func (d *devStore) PutObjectPart(_ context.Context, _, _, uploadID string, partNumber int, data io.Reader, _ int64) (minio.ObjectPart, error) {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u, ok := d.uploads[uploadID]
+	if !ok {
+		return minio.ObjectPart{}, errDevNoSuchUpload
+	}
+	u.parts[partNumber] = b
+
+	sum := md5.Sum(b)
+	return minio.ObjectPart{PartNumber: partNumber, ETag: hex.EncodeToString(sum[:]), Size: int64(len(b))}, nil
+}
+
+// CompleteMultipartUpload joins the parts in the order they're listed, like
+// minio only the ones listed end up in the object
+func (d *devStore) CompleteMultipartUpload(_ context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u, ok := d.uploads[uploadID]
+	if !ok {
+		return minio.UploadInfo{}, errDevNoSuchUpload
+	}
+
+	var b []byte
+	for _, part := range parts {
+		data, ok := u.parts[part.PartNumber]
+		if !ok {
+			return minio.UploadInfo{}, minio.ErrorResponse{Code: "InvalidPart", StatusCode: http.StatusBadRequest}
+		}
+		b = append(b, data...)
+	}
+	delete(d.uploads, uploadID)
+	d.objects[path.Join(bucketName, filename)] = devObject{data: b, modified: time.Now(), metadata: u.metadata, tags: u.tags}
+
+	return minio.UploadInfo{Bucket: bucketName, Key: filename, Size: int64(len(b))}, nil
+}
+
+// errNoPresign is returned by stores that can't hand out URLs to objects
+var errNoPresign = errors.New("presigned URLs aren't supported in dev mode")
+
+func (d *devStore) PresignedGetObject(_ context.Context, _, _ string, _ time.Duration) (*url.URL, error) {
+	return nil, errNoPresign
+}
+
+func (d *devStore) PresignedPutObject(_ context.Context, _, _ string, _ time.Duration) (*url.URL, error) {
+	return nil, errNoPresign
+}
+
+// Every bucket exists in dev mode, so tenant buckets work without any setup
+
+func (d *devStore) MakeBucket(_ context.Context, _ string, _ minio.MakeBucketOptions) error {
+	return nil
+}
+
+func (d *devStore) BucketExists(_ context.Context, _ string) (bool, error) {
+	return true, nil
+}
+
+type devErrorReader struct {
+	err error
+}
+
+func (r devErrorReader) Read(_ []byte) (int, error) {
+	return 0, r.err
+}
+
+// useDevMode replaces the keys in the config with random ones. Nothing
+// outlives the process in dev mode, so there's no reason to keep them.
+func useDevMode(cfg *config) error {
+	for _, key := range []*string{&cfg.EncryptionKey, &cfg.ReceiptKey, &cfg.PostPolicyKey} {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return fmt.Errorf("generate dev key: %w", err)
+		}
+		*key = hex.EncodeToString(b)
+	}
+
+	log.Println("dev mode: files are kept in memory with a throwaway key, everything is lost on exit")
+	return nil
+}
@@ -0,0 +1,75 @@
+package filesrv
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDevStore(t *testing.T) {
+	cfg := defaultConfig()
+	require.NoError(t, useDevMode(&cfg))
+	require.NotEqual(t, defaultConfig().EncryptionKey, cfg.EncryptionKey)
+	require.NotEqual(t, defaultConfig().ReceiptKey, cfg.ReceiptKey)
+
+	store := newDevStore()
+	s := newServerFromConfig(store, cfg)
+	require.NoError(t, s.selfTest(context.Background()))
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "test.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/test.txt", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "test file contents", w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/file/test.txt", nil))
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/test.txt", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	objects, err := store.ListObjects(context.Background(), cfg.Bucket, "")
+	require.NoError(t, err)
+	for _, obj := range objects {
+		require.True(t, strings.HasPrefix(obj.Key, "."), obj.Key)
+	}
+}
+
+func TestDevStoreMultipart(t *testing.T) {
+	ctx := context.Background()
+	store := newDevStore()
+
+	uploadID, err := store.NewMultipartUpload(ctx, "testBucket", "test.txt")
+	require.NoError(t, err)
+	for i, part := range []string{"test file", " contents"} {
+		_, err := store.PutObjectPart(ctx, "testBucket", "test.txt", uploadID, i+1, strings.NewReader(part), int64(len(part)))
+		require.NoError(t, err)
+	}
+
+	uploads, err := store.ListIncompleteUploads(ctx, "testBucket", "test")
+	require.NoError(t, err)
+	require.Len(t, uploads, 1)
+	require.Equal(t, int64(18), uploads[0].Size)
+
+	_, err = store.CompleteMultipartUpload(ctx, "testBucket", "test.txt", uploadID, []minio.CompletePart{{PartNumber: 1}, {PartNumber: 2}})
+	require.NoError(t, err)
+	obj, err := store.GetObject(ctx, "testBucket", "test.txt")
+	require.NoError(t, err)
+	got, err := io.ReadAll(obj)
+	require.NoError(t, err)
+	require.Equal(t, "test file contents", string(got))
+
+	require.Equal(t, "NoSuchUpload", storageErrorCode(store.AbortMultipartUpload(ctx, "testBucket", "test.txt", uploadID)))
+}
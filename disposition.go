@@ -0,0 +1,132 @@
+package filesrv
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Dispositions a file can be served with, inline for the browser to show it
+// or attachment for it to be saved
+const (
+	dispositionInline     = "inline"
+	dispositionAttachment = "attachment"
+)
+
+// dispositionOf returns how a file should be served, from the download query
+// parameter if the request has one and otherwise from the file's default. It's
+// empty if neither says, in which case the browser decides.
+func dispositionOf(r *http.Request, e catalogEntry) (string, error) {
+	switch v := r.URL.Query().Get("download"); v {
+	case "":
+		return e.Disposition, nil
+	case "1", "true":
+		return dispositionAttachment, nil
+	case "0", "false":
+		return dispositionInline, nil
+	default:
+		return "", fmt.Errorf("download %q isn't 1 or 0", v)
+	}
+}
+
+// contentDisposition formats a Content-Disposition header for the filename.
+// The filename is given twice, as a plain ASCII fallback for old clients and
+// encoded with RFC 5987 for everything else, so names with spaces or accents
+// are saved as they were uploaded.
+func contentDisposition(disposition, filename string) string {
+	filename = path.Base(filename)
+
+	var fallback, encoded strings.Builder
+	for _, r := range filename {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' || r == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
+
+// isAttrChar says whether b can go in an RFC 5987 value without being percent
+// encoded
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// setFileHeaders sets the headers every response with the contents of a file
+// has: the content type it's served as, its disposition, nosniff and the
+// headers from the response header rules. Every route that serves the bytes
+// of a file goes through it, so active content is never served inline, and
+// the type is never left for the browser to guess, whichever route the file
+// is fetched through. It responds with a 400 and returns false if the download
+// query parameter is bad.
+func (s server) setFileHeaders(w http.ResponseWriter, r *http.Request, filename string, e catalogEntry) bool {
+	contentType := contentTypeOf(filename, e)
+	if contentType == "" {
+		// Files that aren't in the catalog have the content type they were
+		// stored with on the object
+		if info, err := s.fileInfo(r.Context(), filename); err == nil {
+			contentType = contentTypeOf(filename, info)
+		}
+	}
+	if contentType == "" {
+		// Otherwise Go would guess from the first bytes written
+		contentType = "application/octet-stream"
+	}
+	if !s.setContentDisposition(w, r, filename, e, contentType) {
+		return false
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	s.setResponseHeaders(w.Header(), filename, contentType)
+	return true
+}
+
+// clearFileHeaders removes the headers setFileHeaders set, for when the file
+// can't be sent after all
+func clearFileHeaders(h http.Header) {
+	h.Del("Content-Type")
+	h.Del("Content-Disposition")
+}
+
+// setContentDisposition sets the Content-Disposition header for a download of
+// the file, under the name it was uploaded with. Active content is always an
+// attachment unless the server is set to serve it inline. It responds with a
+// 400 and returns false if the download query parameter is bad.
+func (s server) setContentDisposition(w http.ResponseWriter, r *http.Request, filename string, e catalogEntry, contentType string) bool {
+	disposition, err := dispositionOf(r, e)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("get file: filename: %s, error: %s", filename, err)
+		return false
+	}
+
+	policy := s.settings().activeContent
+	policy.setNoSniff(w.Header())
+	if policy.forcesAttachment(contentType) {
+		disposition = dispositionAttachment
+	}
+	if disposition == "" {
+		return true
+	}
+
+	if e.OriginalName != "" {
+		filename = e.OriginalName
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
+	return true
+}
@@ -0,0 +1,135 @@
+package filesrv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		disposition string
+		filename    string
+		want        string
+	}{
+		{disposition: "attachment", filename: "report.pdf", want: `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`},
+		{disposition: "inline", filename: "reports/2024/q1 summary.pdf", want: `inline; filename="q1 summary.pdf"; filename*=UTF-8''q1%20summary.pdf`},
+		{disposition: "attachment", filename: "résumé.pdf", want: `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		{disposition: "attachment", filename: `say "hi"%.txt`, want: `attachment; filename="say _hi__.txt"; filename*=UTF-8''say%20%22hi%22%25.txt`},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			require.Equal(t, test.want, contentDisposition(test.disposition, test.filename))
+		})
+	}
+}
+
+func TestGetFileDisposition(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	get := func(method, target string) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w.Result()
+	}
+
+	// The browser decides unless something says
+	require.Empty(t, get(http.MethodGet, "/file/report.pdf").Header.Get("Content-Disposition"))
+	require.Equal(t, `attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`, get(http.MethodGet, "/file/report.pdf?download=1").Header.Get("Content-Disposition"))
+	require.Equal(t, http.StatusBadRequest, get(http.MethodGet, "/file/report.pdf?download=yes").StatusCode)
+
+	r := httptest.NewRequest(http.MethodPatch, "/file/report.pdf/meta", strings.NewReader(`{"disposition": "attachment"}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// The file's default is used, and the query parameter wins over it
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		require.True(t, strings.HasPrefix(get(method, "/file/report.pdf").Header.Get("Content-Disposition"), "attachment;"), method)
+		require.True(t, strings.HasPrefix(get(method, "/file/report.pdf?download=0").Header.Get("Content-Disposition"), "inline;"), method)
+	}
+}
+
+func TestActiveContentDisposition(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	files := map[string]string{
+		"page.html":  "<html><script>alert(1)</script></html>",
+		"logo.svg":   `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"report.pdf": "%PDF-1.4 test file contents",
+	}
+	for name, contents := range files {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", name, contents))
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	}
+
+	get := func(method, target string) *http.Response {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w.Result()
+	}
+
+	// Files that could run scripts are always downloaded, even when asked
+	// for inline
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		for _, target := range []string{"/file/page.html", "/file/logo.svg?download=0"} {
+			resp := get(method, target)
+			require.Equal(t, http.StatusOK, resp.StatusCode, target)
+			require.True(t, strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment;"), target)
+			require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"), target)
+		}
+	}
+	resp := get(http.MethodGet, "/file/report.pdf?download=0")
+	require.True(t, strings.HasPrefix(resp.Header.Get("Content-Disposition"), "inline;"))
+	require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"))
+
+	// Unless the server is set to serve them like everything else
+	cfg := defaultConfig()
+	cfg.ActiveContent = activeContentInline
+	s.reload(cfg)
+	resp = get(http.MethodGet, "/file/page.html")
+	require.Empty(t, resp.Header.Get("Content-Disposition"))
+	require.Empty(t, resp.Header.Get("X-Content-Type-Options"))
+}
+
+func TestActiveContentEveryRoute(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+	page := "<html><script>alert(1)</script></html>"
+
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", "page.html", page)).Result().StatusCode)
+	require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/tmp/upload", "page.html", page)).Result().StatusCode)
+	require.Equal(t, http.StatusCreated, do(httptest.NewRequest(http.MethodPut, "/sync/file/site/page.html", strings.NewReader(page))).Result().StatusCode)
+
+	w := do(httptest.NewRequest(http.MethodPost, "/download/link", strings.NewReader(`{"filename": "page.html", "expiresIn": 60}`)))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var link downloadLinkResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+	sum := sha256.Sum256([]byte(page))
+
+	for _, target := range []string{"/file/page.html", "/tmp/file/page.html", "/sync/file/site/page.html", "/content/" + hex.EncodeToString(sum[:]), link.URL} {
+		resp := do(httptest.NewRequest(http.MethodGet, target, nil)).Result()
+		require.Equal(t, http.StatusOK, resp.StatusCode, target)
+		require.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"), target)
+		require.True(t, strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment;"), target)
+		require.Equal(t, "nosniff", resp.Header.Get("X-Content-Type-Options"), target)
+	}
+}
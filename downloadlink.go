@@ -0,0 +1,223 @@
+package filesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultDownloadLinkTTL is how long a download link works for when the
+	// request doesn't say
+	defaultDownloadLinkTTL = time.Hour
+	// maxDownloadLinkTTL stops links being issued that work forever
+	maxDownloadLinkTTL = 7 * 24 * time.Hour
+)
+
+// errInvalidDownloadLink is returned when a download link is malformed or its
+// signature doesn't match
+var errInvalidDownloadLink = errors.New("invalid download link")
+
+// downloadLink is the signed payload of a download link
+type downloadLink struct {
+	// Bucket is the bucket the file is in, since the buckets share the key
+	Bucket   string    `json:"bucket"`
+	Filename string    `json:"name"`
+	Expires  time.Time `json:"exp"`
+	// AllowedIP restricts the link to a client address or subnet in CIDR
+	// notation, empty means anyone with the link can use it
+	AllowedIP string `json:"ip,omitempty"`
+}
+
+// downloadLinkRequest is the body of POST /download/link
+type downloadLinkRequest struct {
+	Filename string `json:"filename"`
+	// ExpiresIn is how many seconds the link works for
+	ExpiresIn int64  `json:"expiresIn"`
+	AllowedIP string `json:"allowedIP,omitempty"`
+}
+
+// downloadLinkResponse is the link to give out
+type downloadLinkResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// encode returns the token for the link, the payload followed by its signature
+func (l downloadLink) encode(key []byte) (string, error) {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(downloadLinkMAC(key, payload)), nil
+}
+
+// decodeDownloadLink checks the signature on a link token and returns the link
+func decodeDownloadLink(key []byte, token string) (downloadLink, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return downloadLink{}, errInvalidDownloadLink
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, downloadLinkMAC(key, payload)) {
+		return downloadLink{}, errInvalidDownloadLink
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return downloadLink{}, errInvalidDownloadLink
+	}
+
+	var l downloadLink
+	err = json.Unmarshal(b, &l)
+	if err != nil {
+		return downloadLink{}, errInvalidDownloadLink
+	}
+
+	return l, nil
+}
+
+// downloadLinkMAC uses the receipt key, with a prefix so a receipt can never
+// pass for a link
+func downloadLinkMAC(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("download-link:" + payload))
+	return mac.Sum(nil)
+}
+
+// parseAllowedIP reads an address or a CIDR subnet, a single address is
+// treated as a subnet of just that address
+func parseAllowedIP(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// allows says whether the client address ip can use the link
+func (l downloadLink) allows(ip string) bool {
+	if l.AllowedIP == "" {
+		return true
+	}
+
+	prefix, err := parseAllowedIP(l.AllowedIP)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	// IPv4 clients can show up as IPv4 mapped IPv6 addresses, and prefixes
+	// never contain addresses with a zone
+	return prefix.Contains(addr.Unmap().WithZone(""))
+}
+
+// handlePostDownloadLink issues a signed link to download a file without any
+// other credentials. The link can be restricted to a client address or
+// subnet, so it's no use to anyone else if it leaks.
+func (s server) handlePostDownloadLink(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req downloadLinkRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode download link request:", err)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultDownloadLinkTTL
+	}
+	if ttl < 0 || ttl > maxDownloadLinkTTL || req.Filename == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.AllowedIP != "" {
+		_, err := parseAllowedIP(req.AllowedIP)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("download link: allowed ip:", err)
+			return
+		}
+	}
+
+	if _, ok := s.catalog.get(req.Filename); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// The link can be used by anyone, so only someone who can read the file
+	// can make one
+	if !s.checkAccess(w, r, req.Filename, accessRead) {
+		return
+	}
+
+	l := downloadLink{
+		Bucket:    s.bucketName,
+		Filename:  req.Filename,
+		Expires:   time.Now().Add(ttl).UTC().Truncate(time.Second),
+		AllowedIP: req.AllowedIP,
+	}
+	token, err := l.encode(s.receiptKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("encode download link:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(downloadLinkResponse{URL: "/download/" + token, Expires: l.Expires})
+	if err != nil {
+		log.Println("encode download link response:", err)
+	}
+}
+
+// handleGetDownload serves the file for a download link
+func (s server) handleGetDownload(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	l, err := decodeDownloadLink(s.receiptKey, ps.ByName("token"))
+	if err != nil || l.Bucket != s.bucketName {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if time.Now().After(l.Expires) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if ip := requestIP(r); !l.allows(ip) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("download link: filename: %s, client %s isn't in %s", l.Filename, ip, l.AllowedIP)
+		return
+	}
+	if !s.downloadAllowed(w, r, l.Filename) {
+		return
+	}
+	e, _ := s.catalog.get(l.Filename)
+	if !s.setFileHeaders(w, r, l.Filename, e) {
+		return
+	}
+
+	err = s.getFile(r.Context(), w, l.Filename)
+	if err != nil {
+		clearFileHeaders(w.Header())
+		writeStorageError(w, err, "download link: filename: "+l.Filename)
+		return
+	}
+}
@@ -0,0 +1,156 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadLinkAllows(t *testing.T) {
+	tests := []struct {
+		allowed string
+		ip      string
+		want    bool
+	}{
+		{allowed: "", ip: "192.0.2.1", want: true},
+		{allowed: "192.0.2.1", ip: "192.0.2.1", want: true},
+		{allowed: "192.0.2.1", ip: "192.0.2.2", want: false},
+		{allowed: "192.0.2.0/24", ip: "192.0.2.200", want: true},
+		{allowed: "192.0.2.7/24", ip: "192.0.2.200", want: true},
+		{allowed: "192.0.2.0/24", ip: "198.51.100.1", want: false},
+		{allowed: "192.0.2.0/24", ip: "::ffff:192.0.2.1", want: true},
+		{allowed: "2001:db8::/32", ip: "2001:db8::1", want: true},
+		{allowed: "2001:db8::/32", ip: "2001:db9::1", want: false},
+		{allowed: "192.0.2.0/24", ip: "not an ip", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.allowed+" "+test.ip, func(t *testing.T) {
+			l := downloadLink{AllowedIP: test.allowed}
+			require.Equal(t, test.want, l.allows(test.ip))
+		})
+	}
+}
+
+func TestDecodeDownloadLink(t *testing.T) {
+	l := downloadLink{Filename: "report.pdf", Expires: time.Now().UTC().Truncate(time.Second), AllowedIP: "192.0.2.0/24"}
+	token, err := l.encode([]byte("key"))
+	require.NoError(t, err)
+
+	got, err := decodeDownloadLink([]byte("key"), token)
+	require.NoError(t, err)
+	require.Equal(t, l.Filename, got.Filename)
+	require.Equal(t, l.AllowedIP, got.AllowedIP)
+	require.True(t, l.Expires.Equal(got.Expires))
+
+	_, err = decodeDownloadLink([]byte("other key"), token)
+	require.ErrorIs(t, err, errInvalidDownloadLink)
+
+	// A receipt signed with the same key isn't a link
+	receipt, err := signReceipt([]byte("key"), receiptClaims{Filename: "report.pdf"})
+	require.NoError(t, err)
+	_, err = decodeDownloadLink([]byte("key"), receipt)
+	require.ErrorIs(t, err, errInvalidDownloadLink)
+}
+
+func TestDownloadLink(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	tests := []struct {
+		name       string
+		body       string
+		remoteAddr string
+		wantStatus int
+	}{
+		{
+			name:       "anyone",
+			body:       `{"filename": "report.pdf"}`,
+			remoteAddr: "198.51.100.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "allowed subnet",
+			body:       `{"filename": "report.pdf", "allowedIP": "192.0.2.0/24"}`,
+			remoteAddr: "192.0.2.10:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "outside subnet",
+			body:       `{"filename": "report.pdf", "allowedIP": "192.0.2.0/24"}`,
+			remoteAddr: "198.51.100.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/download/link", strings.NewReader(test.body)))
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			var resp downloadLinkResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+			req := httptest.NewRequest(http.MethodGet, resp.URL, nil)
+			req.RemoteAddr = test.remoteAddr
+			w = httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus == http.StatusOK {
+				require.Equal(t, "test file contents", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPostDownloadLinkErrors(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "bad ip", body: `{"filename": "report.pdf", "allowedIP": "192.0.2"}`, wantStatus: http.StatusBadRequest},
+		{name: "too long", body: `{"filename": "report.pdf", "expiresIn": 99999999}`, wantStatus: http.StatusBadRequest},
+		{name: "no file", body: `{"filename": "report.pdf"}`, wantStatus: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/download/link", strings.NewReader(test.body)))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+		})
+	}
+}
+
+func TestGetDownloadExpired(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	token, err := downloadLink{Bucket: s.bucketName, Filename: "report.pdf", Expires: time.Now().Add(-time.Minute)}.encode(s.receiptKey)
+	require.NoError(t, err)
+	otherBucket, err := downloadLink{Bucket: "other", Filename: "report.pdf", Expires: time.Now().Add(time.Minute)}.encode(s.receiptKey)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/download/"+token, nil))
+	require.Equal(t, http.StatusGone, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/download/"+otherBucket, nil))
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/download/made.up", nil))
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
@@ -0,0 +1,147 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// dropBoxNamePattern keeps drop box names usable as a single URL path
+// segment, long enough for a random token
+var dropBoxNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+// dropBox lets anyone upload files under Prefix at /drop/<name>, without an
+// identity, so people outside can send files in. The files belong to Owner
+// and nobody who only has the drop box URL can list or download them, so the
+// name is best made hard to guess.
+type dropBox struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	Owner  string `yaml:"owner"`
+	// MaxSize and AllowedTypes limit the uploads on top of the server's
+	// upload policy
+	MaxSize      int64    `yaml:"max-size"`
+	AllowedTypes []string `yaml:"allowed-types"`
+}
+
+// validateDropBoxes checks the drop boxes, their prefixes can't overlap since
+// that would make it unclear who owns the files
+func validateDropBoxes(boxes []dropBox) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, box := range boxes {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(dropBoxesSection, i, "drop box %d (%s): %s", i+1, box.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if !dropBoxNamePattern.MatchString(box.Name) {
+			fail("name has to be letters, digits, dashes and underscores")
+		}
+		if seen[box.Name] {
+			fail("defined more than once")
+		}
+		seen[box.Name] = true
+		if c := checkFilename(box.Prefix); !c.OK {
+			fail("prefix: %s", c.Reason)
+		}
+		if box.Owner == "" || box.Owner == anonymous {
+			fail("owner is empty")
+		}
+		if box.MaxSize < 0 {
+			fail("max size %d is negative", box.MaxSize)
+		}
+		for _, other := range boxes[:i] {
+			if box.Prefix != "" && other.Prefix != "" && (strings.HasPrefix(box.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, box.Prefix)) {
+				fail("prefix overlaps with drop box %s", other.Name)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// policy is the upload policy for the drop box
+func (box dropBox) policy() uploadPolicy {
+	return uploadPolicy{MaxSize: box.MaxSize, AllowedTypes: box.AllowedTypes}
+}
+
+// dropBoxFor returns the drop box whose prefix filename is under
+func (s server) dropBoxFor(filename string) (dropBox, bool) {
+	for _, box := range s.settings().dropBoxes {
+		if strings.HasPrefix(filename, box.Prefix) {
+			return box, true
+		}
+	}
+
+	return dropBox{}, false
+}
+
+type dropBoxKey struct{}
+
+// dropBoxNamed returns the drop box with the name
+func (s server) dropBoxNamed(name string) (dropBox, bool) {
+	for _, box := range s.settings().dropBoxes {
+		if box.Name == name {
+			return box, true
+		}
+	}
+
+	return dropBox{}, false
+}
+
+// checkDropBoxType checks the content type of an upload through a drop box
+// against the box's allowed types again, once it has been sniffed, since
+// the one the sender gave can't be trusted
+func (s server) checkDropBoxType(ctx context.Context, contentType string) error {
+	name, ok := ctx.Value(dropBoxKey{}).(string)
+	if !ok {
+		return nil
+	}
+	box, ok := s.dropBoxNamed(name)
+	if !ok {
+		return nil
+	}
+
+	if c := box.policy().checkContentType(contentType); !c.OK {
+		return stageError{status: c.status, reason: c.Name + ": " + c.Reason}
+	}
+	return nil
+}
+
+// dropping says whether the request is an upload of a new file through the
+// drop box filename is in, which doesn't need write access
+func (s server) dropping(r *http.Request, filename string) bool {
+	name, _ := r.Context().Value(dropBoxKey{}).(string)
+	box, ok := s.dropBoxFor(filename)
+	if !ok || name == "" || box.Name != name {
+		return false
+	}
+
+	_, exists := s.catalog.get(filename)
+	return !exists
+}
+
+// handlePostDrop uploads files into a drop box. They get random names so one
+// sender can't replace or find out about another's files, the original name
+// is kept in the catalog.
+func (s server) handlePostDrop(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	box, ok := s.dropBoxNamed(ps.ByName("name"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set(namingQueryParam, string(namingRandom))
+	r.URL.RawQuery = query.Encode()
+	r = r.WithContext(context.WithValue(r.Context(), dropBoxKey{}, box.Name))
+
+	s.uploadFile(w, r, box.Prefix, func(_ *http.Request, fh *formFile, _ string) *policyCheck {
+		return box.policy().firstFailure(fh.Filename, fh.Size, fh.Header.Get("Content-Type"))
+	})
+}
@@ -0,0 +1,104 @@
+package filesrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateDropBoxes(t *testing.T) {
+	tests := []struct {
+		name    string
+		boxes   []dropBox
+		wantErr string
+	}{
+		{name: "valid", boxes: []dropBox{{Name: "k3v9q2", Prefix: "inbox-", Owner: "alice"}, {Name: "other", Prefix: "invoices-", Owner: "bob"}}},
+		{name: "bad name", boxes: []dropBox{{Name: "a/b", Prefix: "inbox-", Owner: "alice"}}, wantErr: "name has to be"},
+		{name: "no prefix", boxes: []dropBox{{Name: "box", Owner: "alice"}}, wantErr: "prefix: filename is empty"},
+		{name: "no owner", boxes: []dropBox{{Name: "box", Prefix: "inbox-"}}, wantErr: "owner is empty"},
+		{name: "overlap", boxes: []dropBox{{Name: "a", Prefix: "inbox-", Owner: "alice"}, {Name: "b", Prefix: "inbox-bob-", Owner: "bob"}}, wantErr: "prefix overlaps with drop box a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateDropBoxes(test.boxes)
+			if test.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestHandlePostDrop(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	setSettings(s, func(r *reloadable) {
+		r.dropBoxes = []dropBox{{Name: "k3v9q2", Prefix: "inbox-", Owner: "alice", MaxSize: 64}}
+	})
+	handler := s.routes()
+
+	do := func(r *http.Request, user string) *httptest.ResponseRecorder {
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusNotFound, do(newUploadRequest(t, "/drop/nothing", "doc.txt", "test file contents"), "").Result().StatusCode)
+	require.Equal(t, http.StatusRequestEntityTooLarge, do(newUploadRequest(t, "/drop/k3v9q2", "doc.txt", string(make([]byte, 65))), "").Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, do(newUploadRequest(t, "/upload", "inbox-doc.txt", "test file contents"), "").Result().StatusCode, "the prefix is only writable through the drop box")
+
+	w := do(newUploadRequest(t, "/drop/k3v9q2?naming=original", "doc.txt", "test file contents"), "")
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	var resp uploadResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	require.Regexp(t, `^inbox-[0-9a-f]{32}$`, resp.Filename, "the sender can't pick the name")
+	require.Equal(t, "doc.txt", resp.OriginalName)
+
+	e, ok := s.catalog.get(resp.Filename)
+	require.True(t, ok)
+	require.Equal(t, "alice", e.owner())
+
+	// The sender can't get the file back or see what else is there
+	require.Equal(t, http.StatusForbidden, do(httptest.NewRequest(http.MethodGet, "/file/"+resp.Filename, nil), "").Result().StatusCode)
+	var entries []catalogEntry
+	require.NoError(t, json.NewDecoder(do(httptest.NewRequest(http.MethodGet, "/files", nil), "").Body).Decode(&entries))
+	require.Empty(t, entries)
+
+	require.Equal(t, http.StatusOK, do(httptest.NewRequest(http.MethodGet, "/file/"+resp.Filename, nil), "alice").Result().StatusCode)
+}
+
+func TestHandlePostDropSniffedType(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	setSettings(s, func(r *reloadable) {
+		r.dropBoxes = []dropBox{{Name: "k3v9q2", Prefix: "inbox-", AllowedTypes: []string{"image/png"}}}
+	})
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="cat.png"`)
+	h.Set("Content-Type", "image/png")
+	part, err := writer.CreatePart(h)
+	require.NoError(t, err)
+	_, err = part.Write([]byte("<html><script>alert(1)</script></html>"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/drop/k3v9q2", &body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusUnsupportedMediaType, w.Result().StatusCode, "the type is checked after sniffing, not just as declared")
+	require.Empty(t, s.catalog.snapshot())
+}
@@ -0,0 +1,267 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/sio"
+)
+
+// writerMetadata is the user metadata filesrv puts on every object it writes,
+// so bucket events for them can be told apart from writes by other tools
+const writerMetadata = "Filesrv-Writer"
+
+// contentTypeMetadata is the user metadata the content type of the plaintext
+// is kept in, so it survives without the catalog. The object's own
+// Content-Type is left alone since the object is the ciphertext.
+const contentTypeMetadata = "Filesrv-Content-Type"
+
+type contentTypeKey struct{}
+
+// withContentType returns a context for storing a file with the content type
+func withContentType(ctx context.Context, contentType string) context.Context {
+	return context.WithValue(ctx, contentTypeKey{}, contentType)
+}
+
+// objectMetadata returns the user metadata for an object filesrv writes, with
+// the content type from the context if there is one
+func objectMetadata(ctx context.Context) map[string]string {
+	metadata := map[string]string{writerMetadata: "true"}
+	if contentType, _ := ctx.Value(contentTypeKey{}).(string); contentType != "" {
+		metadata[contentTypeMetadata] = contentType
+	}
+	return metadata
+}
+
+// userMetadata returns a value from an object's user metadata, which has the
+// X-Amz-Meta- prefix or not depending on where it came from
+func userMetadata(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		k = http.CanonicalHeaderKey(k)
+		if k == key || k == "X-Amz-Meta-"+key {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// unexpectedFormatTag is added to objects written by other tools that aren't
+// encrypted the way filesrv encrypts uploads
+const unexpectedFormatTag = "unexpected-format"
+
+// ingestRetryInterval is how long to wait before subscribing to the bucket
+// events again after the connection to minio drops
+const ingestRetryInterval = 10 * time.Second
+
+// ingestEventTypes are the bucket events that are ingested
+var ingestEventTypes = []string{"s3:ObjectCreated:*", "s3:ObjectRemoved:*"}
+
+// bucketNotifier is implemented by stores that can send bucket events. Only
+// minio can, so this isn't part of objStorer.
+type bucketNotifier interface {
+	ListenBucketNotification(ctx context.Context, bucketName string, events []string) <-chan notification.Info
+}
+
+func (m minioStore) ListenBucketNotification(ctx context.Context, bucketName string, events []string) <-chan notification.Info {
+	return m.c.ListenBucketNotification(ctx, bucketName, "", "", events)
+}
+
+// invalidator is implemented by stores that keep copies of objects, so they
+// can drop them when an object is changed by something else
+type invalidator interface {
+	invalidate(bucketName, filename string)
+}
+
+func (c *cachingStore) invalidate(bucketName, filename string) {
+	c.remove(path.Join(bucketName, filename))
+}
+
+func (c *canaryStore) invalidate(bucketName, filename string) {
+	if inv, ok := c.objStorer.(invalidator); ok {
+		inv.invalidate(bucketName, filename)
+	}
+}
+
+// ingestEvents follows the bucket events until ctx is done, indexing objects
+// that other tools write directly to the bucket and removing the ones they
+// delete
+func (s server) ingestEvents(ctx context.Context, notifier bucketNotifier) {
+	for ctx.Err() == nil {
+		for info := range notifier.ListenBucketNotification(ctx, s.bucketName, ingestEventTypes) {
+			if info.Err != nil {
+				log.Println("bucket events:", info.Err)
+				continue
+			}
+			for _, event := range info.Records {
+				err := s.ingestEvent(ctx, event)
+				if err != nil {
+					log.Printf("ingest: key: %s, event: %s, error: %s", event.S3.Object.Key, event.EventName, err)
+				}
+			}
+		}
+
+		// The channel is closed when the connection to minio drops
+		select {
+		case <-ctx.Done():
+		case <-time.After(ingestRetryInterval):
+		}
+	}
+}
+
+// ingestEvent updates the catalog for a single bucket event. Events for
+// objects filesrv wrote itself are skipped, the catalog already has those.
+func (s server) ingestEvent(ctx context.Context, event notification.Event) error {
+	// Keys in events are URL encoded
+	name, err := url.QueryUnescape(event.S3.Object.Key)
+	if err != nil {
+		return fmt.Errorf("unescape key: %w", err)
+	}
+	if strings.HasPrefix(name, ".") || writtenByFilesrv(event.S3.Object.UserMetadata) {
+		return nil
+	}
+
+	if inv, ok := s.minioClient.(invalidator); ok {
+		inv.invalidate(s.bucketName, name)
+	}
+
+	switch {
+	case strings.HasPrefix(event.EventName, "s3:ObjectRemoved:"):
+		// Check it's really gone, filesrv could have written it again since
+		_, err := s.minioClient.StatObject(ctx, s.bucketName, name)
+		if storageErrorCode(err) != "NoSuchKey" {
+			return err
+		}
+		log.Println("ingest: removed out of band:", name)
+		return s.unindex(ctx, name)
+	case strings.HasPrefix(event.EventName, "s3:ObjectCreated:"):
+		return s.ingestObject(ctx, name, uploadSource{
+			UploadedBy: event.UserIdentity.PrincipalID,
+			SourceIP:   event.Source.Host,
+			UserAgent:  event.Source.UserAgent,
+		})
+	}
+
+	return nil
+}
+
+// writtenByFilesrv says whether the object metadata from an event has the
+// marker filesrv puts on the objects it writes
+func writtenByFilesrv(metadata map[string]string) bool {
+	return userMetadata(metadata, writerMetadata) != ""
+}
+
+// ingestObject adds an object written by another tool to the catalog, flagging
+// it if it isn't encrypted the way filesrv would have
+func (s server) ingestObject(ctx context.Context, name string, source uploadSource) error {
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, name)
+	if err != nil {
+		return fmt.Errorf("stat object: %w", err)
+	}
+
+	format, err := s.detectFormat(ctx, name, info)
+	if err != nil {
+		return err
+	}
+	mode := format.Encryption
+
+	e := catalogEntry{
+		Name:         name,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		Uploaded:     info.LastModified.UTC(),
+		uploadSource: source,
+		Encryption:   mode,
+	}
+	if mode == encryptionSIO {
+		size, err := sio.DecryptedSize(uint64(info.Size))
+		if err == nil {
+			e.Size = int64(size)
+		}
+		// It decrypted with the current key, or it wouldn't be in this format
+		s.recordEncryption(&e)
+	} else {
+		e.Tags = []string{unexpectedFormatTag}
+		log.Printf("ingest: %s was written out of band and isn't encrypted by filesrv, encryption: %s", name, mode)
+	}
+
+	// There's no checksum, that would mean reading the whole object
+	s.catalog.put(e)
+
+	return s.saveCatalog(ctx)
+}
+
+// objectFormat is how an object is stored in the bucket
+type objectFormat struct {
+	Encryption encryptionMode
+	// Version is the DARE version of objects encrypted by filesrv
+	Version byte
+}
+
+// current says whether the object is in the format filesrv writes now
+func (f objectFormat) current() bool {
+	return f.Encryption == encryptionSIO && f.Version == sio.Version20
+}
+
+func (f objectFormat) String() string {
+	if f.Encryption == encryptionSIO {
+		return fmt.Sprintf("sio %d.%d", f.Version>>4, f.Version&0xf)
+	}
+	return string(f.Encryption)
+}
+
+// detectFormat works out how an object is encrypted. Objects that decrypt
+// with the key filesrv would have used are in the expected format.
+func (s server) detectFormat(ctx context.Context, name string, info minio.ObjectInfo) (objectFormat, error) {
+	if info.Metadata.Get("X-Amz-Server-Side-Encryption") != "" {
+		return objectFormat{Encryption: encryptionSSE}, nil
+	}
+
+	obj, err := s.minioClient.GetObject(ctx, s.bucketName, name)
+	if err != nil {
+		return objectFormat{}, fmt.Errorf("get object: %w", err)
+	}
+	if obj == nil {
+		return objectFormat{}, errNotFound
+	}
+	defer obj.Close()
+
+	// The first byte of every package is the version
+	version := make([]byte, 1)
+	_, err = io.ReadFull(obj, version)
+	if err == io.EOF {
+		// Empty files are empty either way
+		return objectFormat{Encryption: encryptionSIO, Version: sio.Version20}, nil
+	}
+	if err != nil {
+		return objectFormat{}, fmt.Errorf("read object: %w", err)
+	}
+
+	decrypted, err := sio.DecryptReader(io.MultiReader(bytes.NewReader(version), obj), s.sioConfig(name))
+	if err != nil {
+		return objectFormat{}, fmt.Errorf("decrypt object: %w", err)
+	}
+
+	// Decrypting the first package is enough to authenticate it
+	_, err = io.ReadFull(decrypted, make([]byte, decryptBlockSize))
+	var sioErr sio.Error
+	switch {
+	case err == nil || err == io.EOF || err == io.ErrUnexpectedEOF:
+		return objectFormat{Encryption: encryptionSIO, Version: version[0]}, nil
+	case errors.As(err, &sioErr):
+		return objectFormat{Encryption: encryptionNone}, nil
+	default:
+		return objectFormat{}, fmt.Errorf("read object: %w", err)
+	}
+}
@@ -0,0 +1,122 @@
+package filesrv
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/stretchr/testify/require"
+)
+
+func newBucketEvent(name, key string, metadata map[string]string) notification.Event {
+	var event notification.Event
+	event.EventName = name
+	event.S3.Object.Key = key
+	event.S3.Object.UserMetadata = metadata
+	event.Source.UserAgent = "mc"
+	return event
+}
+
+func TestIngestEvent(t *testing.T) {
+	ctx := context.Background()
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	// Written by another tool as plaintext
+	_, err := store.PutObject(ctx, "testBucket", "plain file.txt", strings.NewReader("test file contents"), 18, 0)
+	require.NoError(t, err)
+	require.NoError(t, s.ingestEvent(ctx, newBucketEvent("s3:ObjectCreated:Put", "plain+file.txt", nil)))
+
+	entry, ok := s.catalog.get("plain file.txt")
+	require.True(t, ok)
+	require.Equal(t, encryptionNone, entry.Encryption)
+	require.Equal(t, []string{unexpectedFormatTag}, entry.Tags)
+	require.Equal(t, int64(18), entry.Size)
+	require.Equal(t, "mc", entry.UserAgent)
+
+	// Plaintext objects are served as they are
+	var got strings.Builder
+	require.NoError(t, s.getFile(ctx, &got, "plain file.txt"))
+	require.Equal(t, "test file contents", got.String())
+
+	// Copied in by another tool but in the format filesrv uses
+	_, err = s.putFile(ctx, "encrypted", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+	require.NoError(t, s.ingestEvent(ctx, newBucketEvent("s3:ObjectCreated:Copy", "encrypted", nil)))
+
+	entry, ok = s.catalog.get("encrypted")
+	require.True(t, ok)
+	require.Equal(t, encryptionSIO, entry.Encryption)
+	require.Empty(t, entry.Tags)
+	require.Equal(t, int64(18), entry.Size)
+
+	// Written by filesrv, the catalog already knows about these
+	_, err = s.putFile(ctx, "uploaded", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+	require.NoError(t, s.ingestEvent(ctx, newBucketEvent("s3:ObjectCreated:Put", "uploaded", map[string]string{"X-Amz-Meta-Filesrv-Writer": "true"})))
+	_, ok = s.catalog.get("uploaded")
+	require.False(t, ok)
+
+	// Deleted by another tool
+	require.NoError(t, store.RemoveObject(ctx, "testBucket", "encrypted"))
+	require.NoError(t, s.ingestEvent(ctx, newBucketEvent("s3:ObjectRemoved:Delete", "encrypted", nil)))
+	_, ok = s.catalog.get("encrypted")
+	require.False(t, ok)
+
+	// A delete event for an object that has been written again since is
+	// ignored
+	require.NoError(t, s.ingestEvent(ctx, newBucketEvent("s3:ObjectRemoved:Delete", "plain+file.txt", nil)))
+	_, ok = s.catalog.get("plain file.txt")
+	require.True(t, ok)
+}
+
+type fakeNotifier struct {
+	infos []notification.Info
+}
+
+func (n fakeNotifier) ListenBucketNotification(context.Context, string, []string) <-chan notification.Info {
+	ch := make(chan notification.Info, len(n.infos))
+	for _, info := range n.infos {
+		ch <- info
+	}
+	close(ch)
+	return ch
+}
+
+func TestIngestEvents(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(newCachingStore(store, 1<<20, 1<<20, time.Minute), "testBucket", "key", 10<<17)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Read the file once so it's in the cache, then overwrite it behind the
+	// cache's back
+	_, err := s.putFile(ctx, "filename", strings.NewReader("old contents"), 12)
+	require.NoError(t, err)
+	require.NoError(t, s.getFile(ctx, &strings.Builder{}, "filename"))
+	_, err = store.PutObject(ctx, "testBucket", "filename", strings.NewReader("new contents"), 12, 0)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		s.ingestEvents(ctx, fakeNotifier{infos: []notification.Info{
+			{Records: []notification.Event{newBucketEvent("s3:ObjectCreated:Put", "filename", nil)}},
+		}})
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool {
+		_, ok := s.catalog.get("filename")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	var got strings.Builder
+	require.NoError(t, s.getFile(ctx, &got, "filename"))
+	require.Equal(t, "new contents", got.String())
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,112 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// maxEXIFStripSize is the largest JPEG the strip-exif stage will rewrite, the
+// rewritten file is held in memory
+const maxEXIFStripSize = 64 << 20 // 64MB
+
+// JPEG markers used when stripping metadata
+const (
+	jpegSOI  = 0xd8
+	jpegEOI  = 0xd9
+	jpegSOS  = 0xda
+	jpegAPP1 = 0xe1
+	jpegTEM  = 0x01
+	jpegRST0 = 0xd0
+	jpegRST7 = 0xd7
+)
+
+// stripEXIFStage removes the EXIF and XMP metadata from JPEGs, which can
+// include things like the location a photo was taken. Other files are left
+// alone.
+func stripEXIFStage(_ context.Context, _ server, u *pendingUpload) error {
+	mediaType, _, _ := mime.ParseMediaType(u.ContentType)
+	if mediaType != "image/jpeg" {
+		return nil
+	}
+	if u.Size > maxEXIFStripSize {
+		return stageError{
+			status: http.StatusRequestEntityTooLarge,
+			reason: fmt.Sprintf("JPEG is larger than the %d bytes that metadata can be stripped from", maxEXIFStripSize),
+		}
+	}
+
+	b, err := io.ReadAll(u.Content)
+	if err != nil {
+		return err
+	}
+
+	stripped, err := stripJPEGMetadata(b)
+	if err != nil {
+		return stageError{status: http.StatusUnprocessableEntity, reason: err.Error()}
+	}
+
+	u.Content = bytes.NewReader(stripped)
+	u.Size = int64(len(stripped))
+	return nil
+}
+
+// stripJPEGMetadata returns the JPEG without its APP1 segments, which is where
+// EXIF and XMP metadata live
+func stripJPEGMetadata(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != 0xff || b[1] != jpegSOI {
+		return nil, errors.New("not a JPEG")
+	}
+
+	out := make([]byte, 0, len(b))
+	out = append(out, b[:2]...)
+
+	i := 2
+	for i < len(b) {
+		if b[i] != 0xff {
+			return nil, fmt.Errorf("expected a marker at offset %d", i)
+		}
+
+		// Markers can be padded with any number of 0xff bytes
+		start := i
+		for i < len(b) && b[i] == 0xff {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errors.New("truncated marker")
+		}
+		marker := b[i]
+		i++
+
+		switch {
+		case marker == jpegSOS:
+			// The compressed image data follows with no length, so
+			// everything from here on is kept as it is
+			return append(out, b[start:]...), nil
+		case marker == jpegEOI:
+			return append(out, b[start:i]...), nil
+		case marker == jpegTEM || (marker >= jpegRST0 && marker <= jpegRST7):
+			out = append(out, b[start:i]...)
+			continue
+		}
+
+		if i+2 > len(b) {
+			return nil, errors.New("truncated segment length")
+		}
+		end := i + (int(b[i])<<8 | int(b[i+1]))
+		if end > len(b) || end < i+2 {
+			return nil, errors.New("truncated segment")
+		}
+
+		if marker != jpegAPP1 {
+			out = append(out, b[start:end]...)
+		}
+		i = end
+	}
+
+	return out, nil
+}
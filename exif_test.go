@@ -0,0 +1,70 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestJPEG returns a small JPEG with an EXIF segment after the SOI marker
+// like a camera would write
+func newTestJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	var img bytes.Buffer
+	require.NoError(t, jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 8, 8)), nil))
+
+	payload := append([]byte("Exif\x00\x00"), []byte("GPS 51.5074 N 0.1278 W")...)
+	segment := []byte{0xff, jpegAPP1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+
+	b := img.Bytes()
+	return append(append(append([]byte{}, b[:2]...), segment...), b[2:]...)
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	withEXIF := newTestJPEG(t)
+
+	stripped, err := stripJPEGMetadata(withEXIF)
+	require.NoError(t, err)
+	require.NotContains(t, string(stripped), "Exif")
+	require.NotContains(t, string(stripped), "GPS")
+
+	// Stripping the metadata mustn't break the image
+	_, err = jpeg.Decode(bytes.NewReader(stripped))
+	require.NoError(t, err)
+
+	// Stripping is idempotent
+	again, err := stripJPEGMetadata(stripped)
+	require.NoError(t, err)
+	require.Equal(t, stripped, again)
+
+	_, err = stripJPEGMetadata([]byte("not a jpeg"))
+	require.EqualError(t, err, "not a JPEG")
+
+	_, err = stripJPEGMetadata(withEXIF[:8])
+	require.EqualError(t, err, "truncated segment")
+}
+
+func TestStripEXIFStage(t *testing.T) {
+	withEXIF := newTestJPEG(t)
+
+	u := &pendingUpload{ContentType: "image/jpeg", Size: int64(len(withEXIF)), Content: bytes.NewReader(withEXIF)}
+	require.NoError(t, stripEXIFStage(context.Background(), server{}, u))
+	require.Less(t, u.Size, int64(len(withEXIF)))
+
+	// Other files are left alone
+	u = &pendingUpload{ContentType: "text/plain", Size: int64(len(withEXIF)), Content: bytes.NewReader(withEXIF)}
+	require.NoError(t, stripEXIFStage(context.Background(), server{}, u))
+	require.Equal(t, int64(len(withEXIF)), u.Size)
+
+	// A file that claims to be a JPEG but isn't is rejected
+	u = &pendingUpload{ContentType: "image/jpeg", Size: 4, Content: bytes.NewReader([]byte("fake"))}
+	err := stripEXIFStage(context.Background(), server{}, u)
+	require.Equal(t, stageError{status: http.StatusUnprocessableEntity, reason: "not a JPEG"}, err)
+}
@@ -0,0 +1,93 @@
+package filesrv
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleGetExport streams a tar of every file under the prefix, decrypting
+// them into it as it goes, so a whole prefix can be pulled out in one request.
+// With gzip=true the tar is compressed. Files the user can't read, or that the
+// download rules keep from them, are left out rather than failing the export.
+// As with a zip an error part way through cuts the connection, so the client
+// is left with a truncated tar rather than one that looks complete.
+func (s server) handleGetExport(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	compress := query.Get("gzip") == "true"
+	if prefix == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("export: no prefix")
+		return
+	}
+
+	var entries []catalogEntry
+	for _, e := range s.catalog.snapshot() {
+		if !strings.HasPrefix(e.Name, prefix) || !s.allowed(r, e, accessRead) {
+			continue
+		}
+		if _, _, blocked := s.downloadBlocked(r, e); blocked {
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	name := path.Base(strings.TrimSuffix(prefix, "/"))
+	if !checkFilename(name).OK {
+		name = "export"
+	}
+	name += ".tar"
+	contentType := "application/x-tar"
+	if compress {
+		name += ".gz"
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", contentDisposition(dispositionAttachment, name))
+
+	var out io.Writer = w
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		out = zw
+	}
+	tw := tar.NewWriter(out)
+	for _, e := range entries {
+		// The size has to be known before the file is written, which older
+		// catalog entries don't have
+		info, err := s.fileInfo(r.Context(), e.Name)
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     e.Name,
+				Size:     info.Size,
+				Mode:     0o644,
+				ModTime:  info.Uploaded,
+			})
+		}
+		if err == nil {
+			err = s.getFile(r.Context(), tw, e.Name)
+		}
+		if err != nil {
+			writeStorageError(w, fmt.Errorf("%w: %w", errStreamInterrupted, err), "export: filename: "+e.Name)
+			return
+		}
+		s.recordAccess(r, e.Name)
+	}
+
+	err := tw.Close()
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		writeStorageError(w, fmt.Errorf("%w: %w", errStreamInterrupted, err), "export")
+	}
+}
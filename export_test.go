@@ -0,0 +1,75 @@
+package filesrv
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetExport(t *testing.T) {
+	handler := NewServer(newMemObjStore(), "testBucket", "key", 10<<17).routes()
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	files := map[string]string{
+		"builds-v1-app.tar":   "app build",
+		"builds-v1-notes.txt": "release notes",
+		"builds-v2-app.tar":   "newer app build",
+	}
+	for name, contents := range files {
+		require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/upload", name, contents)).Code)
+	}
+	// Files the user can't read are left out
+	r := newUploadRequest(t, "/upload", "builds-v1-secret.txt", "private")
+	r.Header.Set(identityHeader, "alice")
+	require.Equal(t, http.StatusCreated, do(r).Code)
+	r = httptest.NewRequest(http.MethodPut, "/file/builds-v1-secret.txt/acl", strings.NewReader(`{"grants": [{"user": "alice", "access": "read"}]}`))
+	r.Header.Set(identityHeader, "alice")
+	require.Equal(t, http.StatusOK, do(r).Code)
+
+	readTar := func(body io.Reader) map[string]string {
+		got := map[string]string{}
+		tr := tar.NewReader(body)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return got
+			}
+			require.NoError(t, err)
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			got[h.Name] = string(b)
+		}
+	}
+	want := map[string]string{
+		"builds-v1-app.tar":   "app build",
+		"builds-v1-notes.txt": "release notes",
+	}
+
+	w := do(httptest.NewRequest(http.MethodGet, "/export?prefix=builds-v1-", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-tar", w.Header().Get("Content-Type"))
+	require.Contains(t, w.Header().Get("Content-Disposition"), `filename="builds-v1-.tar"`)
+	require.Equal(t, want, readTar(w.Body))
+
+	w = do(httptest.NewRequest(http.MethodGet, "/export?prefix=builds-v1-&gzip=true", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/gzip", w.Header().Get("Content-Type"))
+	zr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	require.Equal(t, want, readTar(zr))
+
+	w = do(httptest.NewRequest(http.MethodGet, "/export?prefix=releases-", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, readTar(w.Body))
+
+	require.Equal(t, http.StatusBadRequest, do(httptest.NewRequest(http.MethodGet, "/export", nil)).Code)
+}
@@ -0,0 +1,159 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"syscall"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// errFetchAddress is returned when a fetch would connect to an address the
+// server doesn't fetch from
+var errFetchAddress = errors.New("address isn't public")
+
+// fetchRequest is the body of POST /fetch
+type fetchRequest struct {
+	// URL is where the file is downloaded from
+	URL string `json:"url"`
+	// Name is the name the file is stored under, it's used as it is like
+	// with PUT /file/:filename
+	Name string `json:"name"`
+}
+
+// newFetchClient returns the client files are fetched with. Unless
+// allowPrivate is set it only connects to public addresses, checked after the
+// name has been resolved and for every redirect, so a fetch can't be used to
+// reach minio or anything else on the server's network.
+func newFetchClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{}
+	if !allowPrivate {
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", errFetchAddress, addrPort.Addr())
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would do the connecting, out of reach of the address check
+	transport.Proxy = nil
+	return &http.Client{Transport: transport}
+}
+
+// nonPublicPrefixes are the ranges that are global unicast but still don't
+// lead to the internet: carrier-grade NAT, NAT64, which would reach any IPv4
+// address including private ones, and benchmarking networks
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+}
+
+// publicAddr says whether the address is on the internet rather than a
+// private network or the server itself
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handlePostFetch downloads a file from a URL and stores it like an upload,
+// so remote files can be taken in without passing through the client. The
+// download has to pass the same upload policy, size and content type, as any
+// other upload, and files without a Content-Length are written to a temporary
+// file first to find out their size, up to the most an upload can be.
+func (s server) handlePostFetch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req fetchRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err == nil {
+		var u *url.URL
+		u, err = url.Parse(req.URL)
+		if err == nil && (u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+			err = fmt.Errorf("%q isn't an http or https URL", req.URL)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode fetch request:", err)
+		return
+	}
+
+	fetchReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, req.URL, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("fetch request:", err)
+		return
+	}
+	resp, err := s.fetcher.Do(fetchReq)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errFetchAddress) {
+			status = http.StatusForbidden
+		}
+		w.WriteHeader(status)
+		log.Printf("fetch: url: %s, error: %s", req.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		w.WriteHeader(http.StatusBadGateway)
+		log.Printf("fetch: url: %s, status: %s", req.URL, resp.Status)
+		return
+	}
+
+	// The download is stored as if it were the body of a PUT, on behalf of
+	// whoever asked for it
+	upload := r.Clone(r.Context())
+	upload.Body = resp.Body
+	upload.ContentLength = resp.ContentLength
+	upload.Header.Set("Content-Type", resp.Header.Get("Content-Type"))
+	if upload.ContentLength < 0 {
+		maxSize := s.settings().policy.MaxSize
+		body := io.Reader(resp.Body)
+		if maxSize > 0 {
+			body = io.LimitReader(body, maxSize+1)
+		}
+		f, err := s.spill.spool(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			log.Printf("fetch: url: %s, error: %s", req.URL, err)
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("fetch:", err)
+			return
+		}
+		upload.Body = f
+		upload.ContentLength = info.Size()
+	}
+
+	s.putBody(w, upload, req.Name, checkFilename(req.Name))
+}
@@ -0,0 +1,102 @@
+package filesrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostFetch(t *testing.T) {
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/notes.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "remote file contents")
+		case "/stream.txt":
+			// Flushing first sends it chunked, without a Content-Length
+			w.Header().Set("Content-Type", "text/plain")
+			w.(http.Flusher).Flush()
+			io.WriteString(w, strings.Repeat("streamed ", 100))
+		case "/redirect":
+			http.Redirect(w, r, "/notes.txt", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	newHandler := func(allowPrivate bool, maxUploadSize int64) http.Handler {
+		cfg := defaultConfig()
+		cfg.Bucket = "testBucket"
+		cfg.FetchAllowPrivate = allowPrivate
+		cfg.MaxUploadSize = maxUploadSize
+		return newServerFromConfig(newMemObjStore(), cfg).routes()
+	}
+	fetch := func(handler http.Handler, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/fetch", strings.NewReader(body)))
+		return w
+	}
+	download := func(handler http.Handler, name string) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/"+name, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	handler := newHandler(true, 1<<20)
+	w := fetch(handler, `{"url": "`+remote.URL+`/notes.txt", "name": "fetched.txt"}`)
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"fetched.txt"`)
+	require.Equal(t, "remote file contents", download(handler, "fetched.txt"))
+
+	require.Equal(t, http.StatusCreated, fetch(handler, `{"url": "`+remote.URL+`/stream.txt", "name": "stream.txt"}`).Code)
+	require.Equal(t, strings.Repeat("streamed ", 100), download(handler, "stream.txt"))
+	require.Equal(t, http.StatusCreated, fetch(handler, `{"url": "`+remote.URL+`/redirect", "name": "redirected.txt"}`).Code)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		body    string
+		want    int
+	}{
+		{name: "not a url", handler: handler, body: `{"url": "notes.txt", "name": "a.txt"}`, want: http.StatusBadRequest},
+		{name: "not http", handler: handler, body: `{"url": "file:///etc/passwd", "name": "a.txt"}`, want: http.StatusBadRequest},
+		{name: "bad name", handler: handler, body: `{"url": "` + remote.URL + `/notes.txt", "name": "../a.txt"}`, want: http.StatusBadRequest},
+		{name: "missing remote file", handler: handler, body: `{"url": "` + remote.URL + `/missing", "name": "a.txt"}`, want: http.StatusBadGateway},
+		{name: "too big", handler: newHandler(true, 10), body: `{"url": "` + remote.URL + `/notes.txt", "name": "a.txt"}`, want: http.StatusRequestEntityTooLarge},
+		{name: "too big without a length", handler: newHandler(true, 10), body: `{"url": "` + remote.URL + `/stream.txt", "name": "a.txt"}`, want: http.StatusRequestEntityTooLarge},
+		{name: "private address", handler: newHandler(false, 1<<20), body: `{"url": "` + remote.URL + `/notes.txt", "name": "a.txt"}`, want: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, fetch(test.handler, test.body).Code)
+		})
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:2800:220::1": true,
+		"127.0.0.1":        false,
+		"10.0.0.5":         false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"::1":              false,
+		"::ffff:10.0.0.5":  false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+		"100.100.1.1":      false,
+		"64:ff9b::a00:5":   false,
+		"198.19.0.1":       false,
+		"100.128.0.1":      true,
+	} {
+		require.Equal(t, want, publicAddr(netip.MustParseAddr(addr)), addr)
+	}
+}
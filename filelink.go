@@ -0,0 +1,135 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// linkQueryParam is the query parameter of a signed file URL, it holds a
+// download link token for the file
+const linkQueryParam = "link"
+
+// fileLinkRequest is the body of POST /file/:filename/link, it can be left
+// out for the default expiry
+type fileLinkRequest struct {
+	// ExpiresIn is how many seconds the URL works for
+	ExpiresIn int64  `json:"expiresIn"`
+	AllowedIP string `json:"allowedIP,omitempty"`
+}
+
+// fileURL returns the path and query of a signed URL to GET the file in the
+// link
+func (l downloadLink) fileURL(key []byte) (string, error) {
+	token, err := l.encode(key)
+	if err != nil {
+		return "", err
+	}
+
+	return fileURLPath(l.Filename) + "?" + url.Values{linkQueryParam: {token}}.Encode(), nil
+}
+
+// checkFileSignature says whether the request has a signed URL for filename
+// and responds if the link is bad, has expired or is for another client.
+// Requests without a link go on to the usual access checks.
+func (s server) checkFileSignature(w http.ResponseWriter, r *http.Request, filename string) (signed, ok bool) {
+	q := r.URL.Query()
+	if !q.Has(linkQueryParam) {
+		return false, true
+	}
+
+	l, err := decodeDownloadLink(s.receiptKey, q.Get(linkQueryParam))
+	if err != nil || l.Bucket != s.bucketName || l.Filename != filename {
+		w.WriteHeader(http.StatusForbidden)
+		return true, false
+	}
+	if time.Now().After(l.Expires) {
+		w.WriteHeader(http.StatusGone)
+		return true, false
+	}
+	if ip := requestIP(r); !l.allows(ip) {
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("file link: filename: %s, client %s isn't in %s", filename, ip, l.AllowedIP)
+		return true, false
+	}
+
+	return true, true
+}
+
+// requireAccessOrSignature is requireAccess, except a request with a valid
+// signed URL for the file doesn't need any other credentials
+func (s server) requireAccessOrSignature(want access, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !checkInternal(w, ps.ByName("filename")) {
+			return
+		}
+		signed, ok := s.checkFileSignature(w, r, ps.ByName("filename"))
+		if !ok {
+			return
+		}
+		if signed || s.checkAccess(w, r, ps.ByName("filename"), want) {
+			h(w, r, ps)
+		}
+	}
+}
+
+// handlePostFileLink returns a signed URL for GET /file that works without
+// any other credentials until it expires, for sharing a file. It's a download
+// link, but the URL is the file's own.
+func (s server) handlePostFileLink(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := ps.ByName("filename")
+
+	var req fileLinkRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode file link request:", err)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultDownloadLinkTTL
+	}
+	if ttl < 0 || ttl > maxDownloadLinkTTL {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.AllowedIP != "" {
+		_, err := parseAllowedIP(req.AllowedIP)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("file link: allowed ip:", err)
+			return
+		}
+	}
+
+	if _, ok := s.catalog.get(filename); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	l := downloadLink{
+		Bucket:    s.bucketName,
+		Filename:  filename,
+		Expires:   time.Now().Add(ttl).UTC().Truncate(time.Second),
+		AllowedIP: req.AllowedIP,
+	}
+	fileURL, err := l.fileURL(s.receiptKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("encode file link:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(downloadLinkResponse{URL: fileURL, Expires: l.Expires})
+	if err != nil {
+		log.Println("encode file link response:", err)
+	}
+}
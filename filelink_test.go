@@ -0,0 +1,78 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileLink(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	s.receiptKey = []byte("receipt key")
+	handler := s.routes()
+
+	do := func(method, target, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	r := newUploadRequest(t, "/upload", "doc.txt", "test file contents")
+	r.Header.Set(identityHeader, "alice")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/file/doc.txt/acl", "alice", `{"grants": [{"user": "bob", "access": "read"}]}`).Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/file/doc.txt", "", "").Result().StatusCode)
+
+	require.Equal(t, http.StatusForbidden, do(http.MethodPost, "/file/doc.txt/link", "carol", "").Result().StatusCode, "only someone who can read the file can share it")
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/file/missing.txt/link", "", "").Result().StatusCode)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/file/doc.txt/link", "bob", `{"expiresIn": 100000000}`).Result().StatusCode)
+
+	w = do(http.MethodPost, "/file/doc.txt/link", "bob", `{"expiresIn": 600}`)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var link downloadLinkResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+	require.WithinDuration(t, time.Now().Add(10*time.Minute), link.Expires, 2*time.Second)
+	require.True(t, strings.HasPrefix(link.URL, "/file/doc.txt?link="))
+
+	w = do(http.MethodGet, link.URL, "", "")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "test file contents", w.Body.String())
+	require.Equal(t, http.StatusOK, do(http.MethodHead, link.URL, "", "").Result().StatusCode)
+
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, strings.Replace(link.URL, "link=", "link=x", 1), "", "").Result().StatusCode, "the link is signed")
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, strings.Replace(link.URL, "doc.txt", "other.txt", 1), "", "").Result().StatusCode, "the filename is signed")
+
+	signed := func(l downloadLink) string {
+		u, err := l.fileURL(s.receiptKey)
+		require.NoError(t, err)
+		return u
+	}
+	otherBucket := signed(downloadLink{Bucket: "other", Filename: "doc.txt", Expires: time.Now().Add(time.Minute)})
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, otherBucket, "", "").Result().StatusCode, "the bucket is signed")
+
+	expired := signed(downloadLink{Bucket: s.bucketName, Filename: "doc.txt", Expires: time.Now().Add(-time.Minute)})
+	require.Equal(t, http.StatusGone, do(http.MethodGet, expired, "", "").Result().StatusCode)
+
+	// Like download links, they can be restricted to a client address
+	w = do(http.MethodPost, "/file/doc.txt/link", "bob", `{"allowedIP": "198.51.100.0/24"}`)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&link))
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, link.URL, "", "").Result().StatusCode)
+	r = httptest.NewRequest(http.MethodGet, link.URL, nil)
+	r.RemoteAddr = "198.51.100.7:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/file/doc.txt/link", "bob", `{"allowedIP": "nowhere"}`).Result().StatusCode)
+}
@@ -0,0 +1,66 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handleGetFiles lists the files in the catalog. The listing can be filtered
+// with the prefix, uploadedBy, sourceIP and userAgent query parameters, and
+// tag parameters like tag=project=apollo or just tag=project, which all have
+// to match. With a delimiter, files further down than the prefix are
+// grouped into folders.
+func (s server) handleGetFiles(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	filters := []struct {
+		value string
+		field func(catalogEntry) string
+	}{
+		{query.Get("uploadedBy"), func(e catalogEntry) string { return e.UploadedBy }},
+		{query.Get("sourceIP"), func(e catalogEntry) string { return e.SourceIP }},
+		{query.Get("userAgent"), func(e catalogEntry) string { return e.UserAgent }},
+	}
+	tagFilters := parseTagFilters(query["tag"])
+
+	entries := []catalogEntry{}
+entries:
+	for _, e := range s.catalog.snapshot() {
+		if !strings.HasPrefix(e.Name, prefix) || !s.allowed(r, e, accessRead) {
+			continue
+		}
+		for _, f := range filters {
+			if f.value != "" && f.field(e) != f.value {
+				continue entries
+			}
+		}
+		for _, f := range tagFilters {
+			if !f.matches(e) {
+				continue entries
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if delimiter := query.Get("delimiter"); delimiter != "" {
+		json.NewEncoder(w).Encode(splitFolders(entries, prefix, delimiter))
+		return
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleGetFileMetadata returns what the catalog knows about a file
+func (s server) handleGetFileMetadata(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entry, ok := s.catalog.get(ps.ByName("filename"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
@@ -0,0 +1,84 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSource(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	// httptest requests come from 192.0.2.1
+	s.trustedProxies = mustTrustedProxies("192.0.2.1, 10.0.0.0/8")
+	router := s.routes()
+
+	uploads := []struct {
+		filename  string
+		user      string
+		forwarded string
+		userAgent string
+	}{
+		{filename: "a.txt", user: "alice", userAgent: "curl/8.0"},
+		{filename: "b.txt", user: "bob", forwarded: "203.0.113.7, 10.0.0.1", userAgent: "curl/8.0"},
+		{filename: "c.txt", userAgent: "Mozilla/5.0"},
+	}
+	for _, u := range uploads {
+		req := newUploadRequest(t, "/upload", u.filename, "test file contents")
+		if u.user != "" {
+			req.Header.Set(identityHeader, u.user)
+		}
+		if u.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", u.forwarded)
+		}
+		req.Header.Set("User-Agent", u.userAgent)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/b.txt/metadata", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var entry catalogEntry
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&entry))
+	require.Equal(t, uploadSource{UploadedBy: "bob", SourceIP: "203.0.113.7", UserAgent: "curl/8.0"}, entry.uploadSource)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/missing/metadata", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	tests := []struct {
+		name   string
+		target string
+		want   []string
+	}{
+		{name: "everything", target: "/files", want: []string{"a.txt", "b.txt", "c.txt"}},
+		{name: "by uploader", target: "/files?uploadedBy=anonymous", want: []string{"c.txt"}},
+		{name: "by source ip", target: "/files?sourceIP=192.0.2.1", want: []string{"a.txt", "c.txt"}},
+		{name: "by user agent", target: "/files?userAgent=curl/8.0&uploadedBy=alice", want: []string{"a.txt"}},
+		{name: "by prefix", target: "/files?prefix=b", want: []string{"b.txt"}},
+		{name: "no matches", target: "/files?uploadedBy=carol", want: []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			var entries []catalogEntry
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&entries))
+
+			names := []string{}
+			for _, e := range entries {
+				names = append(names, e.Name)
+			}
+			require.Equal(t, test.want, names)
+		})
+	}
+}
@@ -0,0 +1,144 @@
+// Package filesrvtest runs filesrv for integration tests of the services that
+// use it, without minio or any containers. Each Server is filesrv in dev mode,
+// so it keeps everything in memory and starts out empty. It runs inside the
+// test binary behind an httptest.Server, so tests can run in parallel
+// without fighting over ports.
+package filesrvtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/sams96/filesrv"
+)
+
+// Server is a running filesrv
+type Server struct {
+	// URL is the base URL of the server
+	URL string
+	// Client sends requests to the server
+	Client *http.Client
+}
+
+// Upload is what the server says about a stored file
+type Upload struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Receipt string `json:"receipt"`
+}
+
+// NewServer starts a server that's stopped when the test finishes. Any args
+// are the settings for filesrv, as they'd be given to the command, on top of
+// -dev.
+func NewServer(tb testing.TB, args ...string) *Server {
+	tb.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	handler, err := filesrv.NewDevHandler(ctx, args...)
+	if err != nil {
+		cancel()
+		tb.Fatalf("filesrvtest: start filesrv: %s", err)
+	}
+
+	ts := httptest.NewServer(handler)
+	tb.Cleanup(func() {
+		ts.Close()
+		cancel()
+	})
+
+	return &Server{URL: ts.URL, Client: ts.Client()}
+}
+
+// Seed stores a file, failing the test if it isn't stored
+func (s *Server) Seed(tb testing.TB, name, contentType string, contents []byte) Upload {
+	tb.Helper()
+
+	req, err := http.NewRequest(http.MethodPut, s.URL+"/file/"+url.PathEscape(name), bytes.NewReader(contents))
+	if err != nil {
+		tb.Fatalf("filesrvtest: seed %s: %s", name, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		tb.Fatalf("filesrvtest: seed %s: %s", name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		tb.Fatalf("filesrvtest: seed %s: %s", name, resp.Status)
+	}
+
+	var u Upload
+	err = json.NewDecoder(resp.Body).Decode(&u)
+	if err != nil {
+		tb.Fatalf("filesrvtest: seed %s: decode response: %s", name, err)
+	}
+
+	return u
+}
+
+// Get returns the contents of a file and whether it exists
+func (s *Server) Get(tb testing.TB, name string) ([]byte, bool) {
+	tb.Helper()
+
+	resp, err := s.Client.Get(s.URL + "/file/" + url.PathEscape(name))
+	if err != nil {
+		tb.Fatalf("filesrvtest: get %s: %s", name, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false
+	default:
+		tb.Fatalf("filesrvtest: get %s: %s", name, resp.Status)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tb.Fatalf("filesrvtest: get %s: %s", name, err)
+	}
+
+	return b, true
+}
+
+// AssertFile fails the test unless the file exists with the contents want
+func (s *Server) AssertFile(tb testing.TB, name string, want []byte) {
+	tb.Helper()
+
+	got, ok := s.Get(tb, name)
+	if !ok {
+		tb.Errorf("filesrvtest: %s doesn't exist", name)
+		return
+	}
+	if !bytes.Equal(got, want) {
+		tb.Errorf("filesrvtest: %s is %q, want %q", name, truncate(got), truncate(want))
+	}
+}
+
+// AssertMissing fails the test if the file exists
+func (s *Server) AssertMissing(tb testing.TB, name string) {
+	tb.Helper()
+
+	if _, ok := s.Get(tb, name); ok {
+		tb.Errorf("filesrvtest: %s exists", name)
+	}
+}
+
+// truncate shortens contents for a failure message
+func truncate(b []byte) string {
+	const limit = 64
+	if len(b) <= limit {
+		return string(b)
+	}
+	return strings.ToValidUTF8(string(b[:limit]), "") + "..."
+}
@@ -0,0 +1,55 @@
+package filesrvtest
+
+import (
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	s := NewServer(t)
+
+	u := s.Seed(t, "report.txt", "text/plain", []byte("test file contents"))
+	if u.Name != "report.txt" || u.Size != 18 || u.Receipt == "" {
+		t.Errorf("unexpected upload %+v", u)
+	}
+
+	s.AssertFile(t, "report.txt", []byte("test file contents"))
+	s.AssertMissing(t, "other.txt")
+}
+
+func TestServersAreIsolated(t *testing.T) {
+	t.Parallel()
+	a := NewServer(t)
+	b := NewServer(t)
+
+	a.Seed(t, "only-a.txt", "text/plain", []byte("a"))
+	b.AssertMissing(t, "only-a.txt")
+}
+
+func TestAssertFileFails(t *testing.T) {
+	t.Parallel()
+	s := NewServer(t)
+	s.Seed(t, "report.txt", "text/plain", []byte("test file contents"))
+
+	for name, assert := range map[string]func(tb testing.TB){
+		"wrong contents": func(tb testing.TB) { s.AssertFile(tb, "report.txt", []byte("other")) },
+		"missing":        func(tb testing.TB) { s.AssertFile(tb, "other.txt", nil) },
+		"exists":         func(tb testing.TB) { s.AssertMissing(tb, "report.txt") },
+	} {
+		rec := &recordingTB{TB: t}
+		assert(rec)
+		if !rec.failed {
+			t.Errorf("%s: the assertion passed", name)
+		}
+	}
+}
+
+// recordingTB records failures instead of failing the test
+type recordingTB struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(string, ...any) { r.failed = true }
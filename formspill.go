@@ -0,0 +1,295 @@
+package filesrv
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// formMemory is how much of the files in a multipart form are kept in
+// memory, files past it are written to the spill directory
+const formMemory = 10 << 20
+
+// formSpillPattern is what the files forms are spilled to are named, it's
+// how the ones left behind by a crash are found
+const formSpillPattern = "filesrv-form-*"
+
+var (
+	formSpillBytes    = expvar.NewInt("form_spill_bytes")
+	formSpillFiles    = expvar.NewInt("form_spill_files")
+	formSpillRejected = expvar.NewInt("form_spill_rejected")
+)
+
+// errFormSpillFull is returned when a form doesn't fit in what's left of the
+// spill directory's limit
+var errFormSpillFull = errors.New("form spill directory is full")
+
+// formSpill is where the files from multipart forms that don't fit in memory
+// are written while they're uploaded. The default temp directory fills up on
+// busy servers, so it can have a directory and a limit of its own.
+type formSpill struct {
+	// dir is empty for the default temp directory
+	dir string
+	// max is the most bytes that can be spilled at once, zero means there's
+	// no limit
+	max int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+func newFormSpill(dir string, max int64) *formSpill {
+	return &formSpill{dir: dir, max: max}
+}
+
+// reserve takes n bytes of the limit, it fails if there isn't that much
+// left
+func (fs *formSpill) reserve(n int64) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.max > 0 && fs.used+n > fs.max {
+		return false
+	}
+	fs.used += n
+	formSpillBytes.Add(n)
+	return true
+}
+
+// release gives back bytes taken with reserve
+func (fs *formSpill) release(n int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.used -= n
+	formSpillBytes.Add(-n)
+}
+
+// prepare makes the spill directory if it's been set, and removes the files
+// left in it by a server that didn't get to clean up after itself. It's
+// only called on startup, before any forms are read.
+func (fs *formSpill) prepare() error {
+	dir := fs.dir
+	if dir == "" {
+		dir = os.TempDir()
+	} else if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	leftover, err := filepath.Glob(filepath.Join(dir, formSpillPattern))
+	if err != nil {
+		return err
+	}
+	for _, path := range leftover {
+		err := os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(leftover) > 0 {
+		log.Printf("form spill: removed %d files left in %s", len(leftover), dir)
+	}
+
+	return nil
+}
+
+// spool writes the body to a temporary file in the spill directory and
+// returns it at the start, the caller removes it. It's named like the files
+// spilled from forms so it's cleaned up the same way after a crash.
+func (fs *formSpill) spool(body io.Reader) (*os.File, error) {
+	f, err := os.CreateTemp(fs.dir, formSpillPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(f, body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// formFile is a file from a multipart form, held in memory or spilled to
+// disk
+type formFile struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+
+	content []byte
+	// path is set if the file was spilled
+	path string
+}
+
+// Open returns the contents of the file
+func (f *formFile) Open() (multipart.File, error) {
+	if f.path != "" {
+		return os.Open(f.path)
+	}
+	return memFile{bytes.NewReader(f.content)}, nil
+}
+
+// memFile is the contents of a file held in memory
+type memFile struct {
+	*bytes.Reader
+}
+
+func (memFile) Close() error {
+	return nil
+}
+
+// uploadForm is a multipart form read by readForm, RemoveAll has to be called
+// once it's no longer needed
+type uploadForm struct {
+	Value map[string][]string
+	File  map[string][]*formFile
+
+	spill    *formSpill
+	spilled  []*formFile
+	reserved int64
+}
+
+// readForm reads a multipart form like ParseMultipartForm does, but spills
+// files to the spill directory and within its limit. The values are put in
+// r.Form and r.PostForm as well, so FormValue works as usual.
+func (fs *formSpill) readForm(r *http.Request) (*uploadForm, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, err
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &uploadForm{Value: map[string][]string{}, File: map[string][]*formFile{}, spill: fs}
+	memory := int64(formMemory)
+	values := int64(maxFormOverhead)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+
+		name := p.FormName()
+		if name == "" {
+			continue
+		}
+		if p.FileName() == "" {
+			var b bytes.Buffer
+			n, err := io.CopyN(&b, p, values+1)
+			if err != nil && err != io.EOF {
+				form.RemoveAll()
+				return nil, err
+			}
+			values -= n
+			if values < 0 {
+				form.RemoveAll()
+				return nil, multipart.ErrMessageTooLarge
+			}
+			form.Value[name] = append(form.Value[name], b.String())
+			continue
+		}
+
+		f, err := form.readFile(p, &memory)
+		if err != nil {
+			if errors.Is(err, errFormSpillFull) {
+				formSpillRejected.Add(1)
+			}
+			form.RemoveAll()
+			return nil, err
+		}
+		form.File[name] = append(form.File[name], f)
+	}
+
+	r.MultipartForm = &multipart.Form{Value: form.Value}
+	for k, v := range form.Value {
+		r.Form[k] = append(r.Form[k], v...)
+		r.PostForm[k] = append(r.PostForm[k], v...)
+	}
+
+	return form, nil
+}
+
+// readFile reads a file from the form into memory if there's enough of
+// memory left, and spills it otherwise
+func (form *uploadForm) readFile(p *multipart.Part, memory *int64) (*formFile, error) {
+	f := &formFile{Filename: p.FileName(), Header: p.Header}
+
+	var b bytes.Buffer
+	n, err := io.CopyN(&b, p, *memory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= *memory {
+		*memory -= n
+		f.content = b.Bytes()
+		f.Size = n
+		return f, nil
+	}
+
+	file, err := os.CreateTemp(form.spill.dir, formSpillPattern)
+	if err != nil {
+		return nil, err
+	}
+	f.path = file.Name()
+	form.spilled = append(form.spilled, f)
+	formSpillFiles.Add(1)
+
+	f.Size, err = io.Copy(spillWriter{w: file, form: form}, io.MultiReader(&b, p))
+	closeErr := file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+
+	return f, nil
+}
+
+// RemoveAll removes the spilled files and gives back their share of the limit
+func (form *uploadForm) RemoveAll() {
+	for _, f := range form.spilled {
+		err := os.Remove(f.path)
+		if err != nil {
+			log.Println("remove form spill:", err)
+		}
+	}
+	formSpillFiles.Add(-int64(len(form.spilled)))
+	form.spill.release(form.reserved)
+	form.spilled = nil
+	form.reserved = 0
+}
+
+// spillWriter writes a spilled file, taking what it writes from the limit
+type spillWriter struct {
+	w    io.Writer
+	form *uploadForm
+}
+
+func (sw spillWriter) Write(b []byte) (int, error) {
+	if !sw.form.spill.reserve(int64(len(b))) {
+		return 0, errFormSpillFull
+	}
+	sw.form.reserved += int64(len(b))
+	return sw.w.Write(b)
+}
@@ -0,0 +1,79 @@
+package filesrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormSpill(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "spill")
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.FormSpillDir = dir
+	cfg.FormSpillMax = formMemory + 2<<20
+	s := newServerFromConfig(newMemObjStore(), cfg)
+	handler := s.routes()
+
+	// Files left by a crash are cleaned up on startup
+	require.NoError(t, s.spill.prepare())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "filesrv-form-123"), []byte("left over"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other"), []byte("not ours"), 0o600))
+	require.NoError(t, s.spill.prepare())
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "other", entries[0].Name())
+
+	spilled := formSpillBytes.Value()
+	upload := func(name string, size int) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", name, strings.Repeat("a", size)))
+		return w.Code
+	}
+
+	// A file too big for memory goes through the spill directory, and is
+	// gone once the upload is done
+	require.Equal(t, http.StatusCreated, upload("big.txt", formMemory+1<<20))
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, spilled, formSpillBytes.Value())
+
+	// Past the limit the upload is turned away
+	rejected := formSpillRejected.Value()
+	require.Equal(t, http.StatusInsufficientStorage, upload("bigger.txt", formMemory+3<<20))
+	require.Equal(t, rejected+1, formSpillRejected.Value())
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, spilled, formSpillBytes.Value())
+
+	require.Equal(t, http.StatusCreated, upload("small.txt", 1<<10))
+}
+
+func TestFormSpillSpool(t *testing.T) {
+	dir := t.TempDir()
+	fs := newFormSpill(dir, 0)
+
+	f, err := fs.spool(strings.NewReader("test file contents"))
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, dir, filepath.Dir(f.Name()), "bodies are spooled to the spill directory too")
+
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	require.Equal(t, "test file contents", string(b))
+
+	require.NoError(t, fs.prepare())
+	_, err = os.Stat(f.Name())
+	require.True(t, os.IsNotExist(err), "and cleaned up after a crash")
+}
@@ -0,0 +1,92 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// incompleteUploadMaxAge is how old an unfinished multipart upload has to
+	// be before the sweeper treats it as abandoned. It is long enough that no
+	// upload still in progress gets caught.
+	incompleteUploadMaxAge = 24 * time.Hour
+	// incompleteUploadSweepInterval is how often the sweeper runs
+	incompleteUploadSweepInterval = time.Hour
+
+	// abortTimeout bounds cleaning up after a failed upload, which runs after
+	// the request has finished
+	abortTimeout = time.Minute
+)
+
+// These are exposed at /debug/vars
+var (
+	incompleteUploadsRemoved       = expvar.NewInt("incomplete_uploads_removed")
+	incompleteUploadBytesReclaimed = expvar.NewInt("incomplete_upload_bytes_reclaimed")
+)
+
+// abortUpload removes the parts of a failed multipart upload of filename, of
+// stored bytes so far. It doesn't use the request context's deadline or
+// cancellation, since the upload may have failed because the client went
+// away, but keeps its values so it goes to the same region.
+func (s server) abortUpload(ctx context.Context, filename, uploadID string, stored int64) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	err := s.minioClient.AbortMultipartUpload(ctx, s.bucketName, filename, uploadID)
+	if err != nil {
+		log.Printf("abort incomplete upload: filename: %s, error: %s", filename, err)
+		return
+	}
+
+	incompleteUploadsRemoved.Add(1)
+	incompleteUploadBytesReclaimed.Add(stored)
+}
+
+// sweepIncompleteUploads aborts every multipart upload that was started before
+// now minus incompleteUploadMaxAge and never finished, returning how many were
+// removed and the total size of their parts
+func (s server) sweepIncompleteUploads(ctx context.Context, now time.Time) (int, int64, error) {
+	uploads, err := s.minioClient.ListIncompleteUploads(ctx, s.bucketName, "")
+	if err != nil {
+		return 0, 0, fmt.Errorf("list incomplete uploads: %w", err)
+	}
+
+	var removed int
+	var reclaimed int64
+	var errs []error
+	for _, upload := range uploads {
+		if now.Sub(upload.Initiated) < incompleteUploadMaxAge {
+			continue
+		}
+
+		err := s.minioClient.AbortMultipartUpload(ctx, s.bucketName, upload.Key, upload.UploadID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("abort %s: %w", upload.Key, err))
+			continue
+		}
+
+		removed++
+		reclaimed += upload.Size
+	}
+
+	incompleteUploadsRemoved.Add(int64(removed))
+	incompleteUploadBytesReclaimed.Add(reclaimed)
+
+	return removed, reclaimed, errors.Join(errs...)
+}
+
+// sweepIncompleteUploadsOnce runs sweepIncompleteUploads and logs the result,
+// for runEvery
+func (s server) sweepIncompleteUploadsOnce(ctx context.Context, now time.Time) {
+	removed, reclaimed, err := s.sweepIncompleteUploads(ctx, now)
+	if err != nil {
+		log.Println("sweep incomplete uploads:", err)
+	}
+	if removed > 0 {
+		log.Println("removed", removed, "abandoned uploads, reclaiming", reclaimed, "bytes")
+	}
+}
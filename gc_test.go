@@ -0,0 +1,81 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSweepIncompleteUploads(t *testing.T) {
+	now := time.Now()
+
+	store := newMemObjStore()
+	store.incomplete = []minio.ObjectMultipartInfo{
+		{Key: "abandoned.iso", UploadID: "1", Initiated: now.Add(-48 * time.Hour), Size: 10 << 20},
+		{Key: "in-progress.iso", UploadID: "2", Initiated: now.Add(-time.Hour), Size: 5 << 20},
+		{Key: "also-abandoned.iso", UploadID: "3", Initiated: now.Add(-25 * time.Hour), Size: 5 << 20},
+	}
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	removedBefore := incompleteUploadsRemoved.Value()
+	reclaimedBefore := incompleteUploadBytesReclaimed.Value()
+
+	removed, reclaimed, err := s.sweepIncompleteUploads(context.Background(), now)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	require.Equal(t, int64(15<<20), reclaimed)
+
+	require.Len(t, store.incomplete, 1)
+	require.Equal(t, "in-progress.iso", store.incomplete[0].Key)
+
+	require.Equal(t, int64(2), incompleteUploadsRemoved.Value()-removedBefore)
+	require.Equal(t, int64(15<<20), incompleteUploadBytesReclaimed.Value()-reclaimedBefore)
+}
+
+func TestFailedUploadIsAborted(t *testing.T) {
+	store := newMemObjStore()
+	store.incomplete = []minio.ObjectMultipartInfo{
+		// these are other uploads of the same file that might still be in
+		// progress, they shouldn't be touched
+		{Key: "big.iso", UploadID: "1", Initiated: time.Now().Add(-time.Hour)},
+		{Key: "big.iso", UploadID: "2", Initiated: time.Now()},
+		{Key: "other.iso", UploadID: "3", Initiated: time.Now()},
+	}
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	removedBefore := incompleteUploadsRemoved.Value()
+
+	// The client goes away after the first part has been stored
+	contents := io.MultiReader(bytes.NewReader(make([]byte, 2<<20)), errorReader{err: errors.New("client went away")})
+	_, err := s.putFile(context.Background(), "big.iso", contents, 4<<20)
+	require.Error(t, err)
+
+	require.Len(t, store.incomplete, 3)
+	for i, id := range []string{"1", "2", "3"} {
+		require.Equal(t, id, store.incomplete[i].UploadID)
+	}
+	require.Empty(t, store.parts)
+	require.Equal(t, int64(1), incompleteUploadsRemoved.Value()-removedBefore)
+}
+
+func TestLargeUpload(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	contents := bytes.Repeat([]byte("test file contents"), 1<<18)
+	stored, err := s.putFile(context.Background(), "big.iso", bytes.NewReader(contents), int64(len(contents)))
+	require.NoError(t, err)
+	require.Empty(t, store.incomplete)
+
+	var got bytes.Buffer
+	err = s.getFile(context.Background(), &got, "big.iso")
+	require.NoError(t, err)
+	require.Equal(t, contents, got.Bytes())
+	require.Equal(t, stored.Info.Size, int64(len(store.objects["testBucket/big.iso"].data)))
+}
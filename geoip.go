@@ -0,0 +1,59 @@
+package filesrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// errNoCountry is returned when the database doesn't know where an address is
+var errNoCountry = errors.New("no country for address")
+
+// geoIP looks up the country of client addresses in a MaxMind DB file, like
+// GeoLite2-Country or GeoLite2-City
+type geoIP struct {
+	db *maxminddb.Reader
+}
+
+// geoIPRecord is the part of a record we need, which is in both the country
+// and the city databases
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// openGeoIP opens the database, it's kept open for as long as the server runs
+func openGeoIP(path string) (*geoIP, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %s: %w", path, err)
+	}
+
+	return &geoIP{db: db}, nil
+}
+
+// country returns the ISO 3166 code of the country ip is in
+func (g *geoIP) country(ip netip.Addr) (string, error) {
+	var record geoIPRecord
+	err := g.db.Lookup(net.IP(ip.Unmap().AsSlice()), &record)
+	if err != nil {
+		return "", fmt.Errorf("geoip: %w", err)
+	}
+
+	// Anonymous proxies and the like only have the country they're
+	// registered in
+	for _, code := range []string{record.Country.ISOCode, record.RegisteredCountry.ISOCode} {
+		if code != "" {
+			return code, nil
+		}
+	}
+
+	return "", errNoCountry
+}
@@ -0,0 +1,219 @@
+package filesrv
+
+import (
+	"bytes"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The bits of the MaxMind DB format mmdbWriter needs, see
+// https://maxmind.github.io/MaxMind-DB/
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const (
+	// mmdbDataSeparator is the gap of zeros between the search tree and the
+	// data
+	mmdbDataSeparator = 16
+
+	mmdbString = 2
+	mmdbUint32 = 6
+	mmdbMap    = 7
+)
+
+// mmdbWriter builds a small IPv6 MaxMind DB with 24 bit records for tests
+type mmdbWriter struct {
+	root *mmdbNode
+	data bytes.Buffer
+}
+
+type mmdbNode struct {
+	children [2]*mmdbNode
+	// data is the offset of the record in the data section, plus one so the
+	// zero value means there isn't one
+	data uint64
+}
+
+func newMMDBWriter() *mmdbWriter {
+	return &mmdbWriter{root: &mmdbNode{}}
+}
+
+// insert sets the record for every address in prefix, IPv4 prefixes go in the
+// IPv4 part of the tree
+func (w *mmdbWriter) insert(t *testing.T, prefix string, record map[string]any) {
+	p := netip.MustParsePrefix(prefix)
+	bits := p.Bits()
+	addr := p.Addr().As16()
+	if p.Addr().Is4() {
+		addr = [16]byte{}
+		v4 := p.Addr().As4()
+		copy(addr[12:], v4[:])
+		bits += 96
+	}
+
+	data := uint64(w.data.Len()) + 1
+	w.encode(t, record)
+
+	n := w.root
+	for i := 0; i < bits; i++ {
+		bit := addr[i/8] >> (7 - i%8) & 1
+		if n.children[bit] == nil {
+			n.children[bit] = &mmdbNode{}
+		}
+		n = n.children[bit]
+	}
+	n.data = data
+}
+
+func (w *mmdbWriter) encode(t *testing.T, v any) {
+	switch v := v.(type) {
+	case string:
+		require.Less(t, len(v), 29)
+		w.data.WriteByte(mmdbString<<5 | byte(len(v)))
+		w.data.WriteString(v)
+	case uint64:
+		var b []byte
+		for ; v > 0; v >>= 8 {
+			b = append([]byte{byte(v)}, b...)
+		}
+		w.data.WriteByte(mmdbUint32<<5 | byte(len(b)))
+		w.data.Write(b)
+	case map[string]any:
+		w.data.WriteByte(mmdbMap<<5 | byte(len(v)))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			w.encode(t, k)
+			w.encode(t, v[k])
+		}
+	default:
+		t.Fatalf("can't encode %T", v)
+	}
+}
+
+// bytes returns the database file
+func (w *mmdbWriter) bytes(t *testing.T) []byte {
+	// Number the nodes breadth first, leaves with data don't get a node
+	var nodes []*mmdbNode
+	ids := map[*mmdbNode]uint64{}
+	queue := []*mmdbNode{w.root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.data != 0 {
+			continue
+		}
+		ids[n] = uint64(len(nodes))
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	nodeCount := uint64(len(nodes))
+	var b bytes.Buffer
+	for _, n := range nodes {
+		for _, c := range n.children {
+			r := nodeCount
+			switch {
+			case c == nil:
+			case c.data != 0:
+				r = nodeCount + mmdbDataSeparator + c.data - 1
+			default:
+				r = ids[c]
+			}
+			b.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+	b.Write(make([]byte, mmdbDataSeparator))
+	b.Write(w.data.Bytes())
+	b.Write(mmdbMetadataMarker)
+
+	meta := &mmdbWriter{}
+	meta.encode(t, map[string]any{
+		"binary_format_major_version": uint64(2),
+		"database_type":               "filesrv-test",
+		"node_count":                  nodeCount,
+		"record_size":                 uint64(24),
+		"ip_version":                  uint64(6),
+	})
+	b.Write(meta.data.Bytes())
+
+	return b.Bytes()
+}
+
+// writeTestGeoIP writes a database with a country for each prefix
+func writeTestGeoIP(t *testing.T, countries map[string]string) string {
+	w := newMMDBWriter()
+	for prefix, country := range countries {
+		w.insert(t, prefix, map[string]any{"country": map[string]any{"iso_code": country}})
+	}
+
+	return w.write(t)
+}
+
+// write writes the database to a file and returns its path
+func (w *mmdbWriter) write(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "geoip.mmdb")
+	require.NoError(t, os.WriteFile(path, w.bytes(t), 0o600))
+	return path
+}
+
+func TestGeoIP(t *testing.T) {
+	path := writeTestGeoIP(t, map[string]string{
+		"203.0.113.0/24":  "DE",
+		"198.51.100.0/25": "FR",
+		"2001:db8::/32":   "JP",
+	})
+	db, err := openGeoIP(path)
+	require.NoError(t, err)
+
+	tests := []struct {
+		ip      string
+		want    string
+		wantErr error
+	}{
+		{ip: "203.0.113.7", want: "DE"},
+		{ip: "::ffff:203.0.113.7", want: "DE"},
+		{ip: "198.51.100.1", want: "FR"},
+		{ip: "198.51.100.200", wantErr: errNoCountry},
+		{ip: "2001:db8::1", want: "JP"},
+		{ip: "2001:db9::1", wantErr: errNoCountry},
+		{ip: "192.0.2.1", wantErr: errNoCountry},
+	}
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			got, err := db.country(netip.MustParseAddr(test.ip))
+			require.ErrorIs(t, err, test.wantErr)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestGeoIPRegisteredCountry(t *testing.T) {
+	w := newMMDBWriter()
+	w.insert(t, "203.0.113.0/24", map[string]any{"registered_country": map[string]any{"iso_code": "NL"}})
+	db, err := openGeoIP(w.write(t))
+	require.NoError(t, err)
+
+	got, err := db.country(netip.MustParseAddr("203.0.113.1"))
+	require.NoError(t, err)
+	require.Equal(t, "NL", got)
+}
+
+func TestOpenGeoIPInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("not a database"), 0o600))
+
+	_, err := openGeoIP(path)
+	require.ErrorContains(t, err, "invalid MaxMind DB file")
+}
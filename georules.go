@@ -0,0 +1,126 @@
+package filesrv
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// downloadRule restricts which countries a file can be downloaded from. It
+// applies to files whose name starts with Prefix, and if Tenants is set only
+// to files uploaded by one of them. The first rule that applies decides.
+type downloadRule struct {
+	Name    string   `yaml:"name"`
+	Prefix  string   `yaml:"prefix"`
+	Tenants []string `yaml:"tenants"`
+	// Allow is the only countries the files can be downloaded from, if it's
+	// set. Deny is countries they can't be.
+	Allow []string `yaml:"allow-countries"`
+	Deny  []string `yaml:"deny-countries"`
+	// Status is 403 by default, or 451 for restrictions for legal reasons
+	Status int `yaml:"status"`
+}
+
+// validateDownloadRules checks the download rules, they need a database to
+// look the countries up in
+func validateDownloadRules(rules []downloadRule, geoIPDB string) error {
+	var errs []error
+	for i, rule := range rules {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(downloadRulesSection, i, "download rule %d (%s): %s", i+1, rule.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if rule.Name == "" {
+			fail("name is empty")
+		}
+		if len(rule.Allow) == 0 && len(rule.Deny) == 0 {
+			fail("no allowed or denied countries")
+		}
+		if rule.Status != 0 && rule.Status != http.StatusForbidden && rule.Status != http.StatusUnavailableForLegalReasons {
+			fail("status %d isn't 403 or 451", rule.Status)
+		}
+	}
+	if len(rules) > 0 && geoIPDB == "" {
+		errs = append(errs, settingProblem("geoip-db", "download rules need a geoip database"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// applies says whether the rule is for the file
+func (rule downloadRule) applies(e catalogEntry) bool {
+	if !strings.HasPrefix(e.Name, rule.Prefix) {
+		return false
+	}
+	return len(rule.Tenants) == 0 || contains(rule.Tenants, e.UploadedBy)
+}
+
+// allows says whether the file can be downloaded from country, which is empty
+// if it isn't known
+func (rule downloadRule) allows(country string) bool {
+	if contains(rule.Deny, country) {
+		return false
+	}
+	return len(rule.Allow) == 0 || contains(rule.Allow, country)
+}
+
+// downloadAllowed checks the download rules for a file, responding with why
+// it was blocked if it was. Files that aren't in the catalog only have the
+// prefix rules that apply to everyone.
+func (s server) downloadAllowed(w http.ResponseWriter, r *http.Request, filename string) bool {
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		e = catalogEntry{Name: filename}
+	}
+
+	rule, country, blocked := s.downloadBlocked(r, e)
+	if !blocked {
+		return true
+	}
+
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	from := country
+	if from == "" {
+		from = "an unknown country"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s can't be downloaded from %s\n", filename, from)
+	log.Printf("download blocked: filename: %s, rule: %s, country: %s", filename, rule.Name, country)
+	return false
+}
+
+// downloadBlocked returns the rule that stops the request downloading the
+// file and the country it's from, if there is one
+func (s server) downloadBlocked(r *http.Request, e catalogEntry) (downloadRule, string, bool) {
+	rules := s.settings().downloadRules
+	if len(rules) == 0 || s.geoIP == nil {
+		return downloadRule{}, "", false
+	}
+
+	for _, rule := range rules {
+		if !rule.applies(e) {
+			continue
+		}
+
+		// Addresses the database doesn't know are treated as an unknown
+		// country, which only an allow list blocks
+		var country string
+		if ip, err := netip.ParseAddr(requestIP(r)); err == nil {
+			country, _ = s.geoIP.country(ip)
+		}
+		if rule.allows(country) {
+			return downloadRule{}, "", false
+		}
+		return rule, country, true
+	}
+
+	return downloadRule{}, "", false
+}
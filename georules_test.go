@@ -0,0 +1,81 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadRules(t *testing.T) {
+	geo, err := openGeoIP(writeTestGeoIP(t, map[string]string{
+		"203.0.113.0/24":  "DE",
+		"198.51.100.0/24": "FR",
+	}))
+	require.NoError(t, err)
+
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	s := newServerFromConfig(newMemObjStore(), cfg).withGeoIP(cfg, geo)
+	setSettings(s, func(r *reloadable) {
+		r.downloadRules = []downloadRule{
+			{Name: "licensed", Prefix: "film-", Allow: []string{"FR"}, Status: http.StatusUnavailableForLegalReasons},
+			{Name: "alice", Tenants: []string{"alice"}, Deny: []string{"DE"}},
+		}
+	})
+	handler := s.routes()
+
+	for _, upload := range []struct{ name, user string }{
+		{"film-movie.mp4", "bob"},
+		{"alice.txt", "alice"},
+		{"bob.txt", "bob"},
+	} {
+		r := newUploadRequest(t, "/upload", upload.name, "test file contents")
+		r.Header.Set(identityHeader, upload.user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode, upload.name)
+	}
+
+	tests := []struct {
+		name       string
+		target     string
+		ip         string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "allowed country", target: "/file/film-movie.mp4", ip: "198.51.100.1", wantStatus: http.StatusOK},
+		{name: "not allowed country", target: "/file/film-movie.mp4", ip: "203.0.113.1", wantStatus: http.StatusUnavailableForLegalReasons, wantBody: "film-movie.mp4 can't be downloaded from DE\n"},
+		{name: "unknown country", target: "/file/film-movie.mp4", ip: "192.0.2.1", wantStatus: http.StatusUnavailableForLegalReasons, wantBody: "film-movie.mp4 can't be downloaded from an unknown country\n"},
+		{name: "tenant denied country", target: "/file/alice.txt", ip: "203.0.113.1", wantStatus: http.StatusForbidden, wantBody: "alice.txt can't be downloaded from DE\n"},
+		{name: "tenant other country", target: "/file/alice.txt", ip: "192.0.2.1", wantStatus: http.StatusOK},
+		{name: "other tenant", target: "/file/bob.txt", ip: "203.0.113.1", wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			r.RemoteAddr = test.ip + ":1234"
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestValidateDownloadRules(t *testing.T) {
+	require.NoError(t, validateDownloadRules([]downloadRule{{Name: "eu", Allow: []string{"DE"}}}, "geoip.mmdb"))
+
+	err := validateDownloadRules([]downloadRule{
+		{Name: "empty"},
+		{Name: "teapot", Deny: []string{"DE"}, Status: http.StatusTeapot},
+	}, "")
+	require.ErrorContains(t, err, "download rule 1 (empty): no allowed or denied countries")
+	require.ErrorContains(t, err, "download rule 2 (teapot): status 418 isn't 403 or 451")
+	require.ErrorContains(t, err, "download rules need a geoip database")
+}
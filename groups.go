@@ -0,0 +1,394 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// groupNamePattern keeps group names usable in the groups header, which is a
+// comma separated list
+var groupNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+// group is a team of users that share the files under Prefix. Every member
+// can read and write them, and together they can't store more than Quota
+// bytes there. Groups from the groups header work for ACLs too, these are the
+// ones managed by filesrv itself.
+type group struct {
+	Name string `json:"name"`
+	// Owner created the group and is the only one who can add members
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+	Prefix  string   `json:"prefix"`
+	// Quota is the most the files under the prefix can add up to in bytes,
+	// zero means there isn't a limit
+	Quota int64 `json:"quota,omitempty"`
+}
+
+// groupDirectory holds the groups, it's saved along with the catalog
+type groupDirectory struct {
+	mu     sync.RWMutex
+	groups map[string]group
+}
+
+func newGroupDirectory() *groupDirectory {
+	return &groupDirectory{groups: map[string]group{}}
+}
+
+var (
+	errGroupExists   = errors.New("group already exists")
+	errGroupNotFound = errors.New("no such group")
+)
+
+// create adds a new group, its prefix can't overlap with another group's
+func (d *groupDirectory) create(g group) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.groups[g.Name]; ok {
+		return errGroupExists
+	}
+	for _, other := range d.groups {
+		if strings.HasPrefix(g.Prefix, other.Prefix) || strings.HasPrefix(other.Prefix, g.Prefix) {
+			return fmt.Errorf("prefix %q overlaps with group %s", g.Prefix, other.Name)
+		}
+	}
+
+	d.groups[g.Name] = g
+	return nil
+}
+
+// update changes a group with f, which gets a copy of the members it can
+// change freely
+func (d *groupDirectory) update(name string, f func(g *group) error) (group, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	g, ok := d.groups[name]
+	if !ok {
+		return group{}, errGroupNotFound
+	}
+	g.Members = append([]string(nil), g.Members...)
+	if err := f(&g); err != nil {
+		return group{}, err
+	}
+
+	d.groups[name] = g
+	return g, nil
+}
+
+func (d *groupDirectory) get(name string) (group, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	g, ok := d.groups[name]
+	return g, ok
+}
+
+// list returns every group sorted by name
+func (d *groupDirectory) list() []group {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	groups := make([]group, 0, len(d.groups))
+	for _, g := range d.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+
+	return groups
+}
+
+// memberOf returns the names of the groups user is in
+func (d *groupDirectory) memberOf(user string) []string {
+	var names []string
+	for _, g := range d.list() {
+		if contains(g.Members, user) {
+			names = append(names, g.Name)
+		}
+	}
+
+	return names
+}
+
+// owning returns the group whose prefix filename is under, prefixes don't
+// overlap so there's at most one
+func (d *groupDirectory) owning(filename string) (group, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, g := range d.groups {
+		if strings.HasPrefix(filename, g.Prefix) {
+			return g, true
+		}
+	}
+
+	return group{}, false
+}
+
+// restore replaces the groups with saved ones
+func (d *groupDirectory) restore(groups []group) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.groups = make(map[string]group, len(groups))
+	for _, g := range groups {
+		d.groups[g.Name] = g
+	}
+}
+
+// groupsOf returns the groups from the groups header along with the
+// ones the user has been added to here
+func (s server) groupsOf(r *http.Request) []string {
+	groups := requestGroups(r)
+	if user := requestIdentity(r); user != anonymous {
+		groups = append(groups, s.catalog.groups.memberOf(user)...)
+	}
+
+	return groups
+}
+
+// inheritedACL returns the grants a file gets from the group that owns its
+// prefix, or from the drop box it's in, if there is one
+func (s server) inheritedACL(filename string) []grant {
+	var grants []grant
+	if g, ok := s.catalog.groups.owning(filename); ok {
+		grants = append(grants, grant{Group: g.Name, Access: accessWrite})
+	}
+	if box, ok := s.dropBoxFor(filename); ok {
+		grants = append(grants, grant{User: box.Owner, Access: accessWrite})
+	}
+
+	return grants
+}
+
+// groupUsage returns how much the files under the group's prefix add up to,
+// leaving out except, which is about to be replaced
+func (s server) groupUsage(g group, except string) int64 {
+	var used int64
+	for _, e := range s.catalog.snapshot() {
+		if strings.HasPrefix(e.Name, g.Prefix) && e.Name != except {
+			used += e.Size
+		}
+	}
+
+	return used
+}
+
+// quotaError returns a 507 stageError if storing size bytes as filename would
+// take its group over quota. Two uploads at once can both fit and go over
+// together, the quota is only checked, not reserved.
+func (s server) quotaError(filename string, size int64) error {
+	g, ok := s.catalog.groups.owning(filename)
+	if !ok || g.Quota == 0 {
+		return nil
+	}
+
+	used := s.groupUsage(g, filename)
+	if used+size <= g.Quota {
+		return nil
+	}
+
+	return stageError{
+		status: http.StatusInsufficientStorage,
+		reason: fmt.Sprintf("group %s would be over its quota of %d bytes, %d are used", g.Name, g.Quota, used),
+	}
+}
+
+// checkQuota responds with a 507 if storing size bytes as filename would take
+// its group over quota
+func (s server) checkQuota(w http.ResponseWriter, filename string, size int64) bool {
+	err := s.quotaError(filename, size)
+	if err == nil {
+		return true
+	}
+
+	w.WriteHeader(http.StatusInsufficientStorage)
+	log.Printf("quota exceeded: filename: %s, error: %s", filename, err)
+	return false
+}
+
+// groupResponse is a group as the API sends it, with how much of its quota
+// has been used
+type groupResponse struct {
+	group
+	Used int64 `json:"used"`
+}
+
+func (s server) writeGroup(w http.ResponseWriter, status int, g group) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(groupResponse{group: g, Used: s.groupUsage(g, "")})
+}
+
+// createGroupRequest is the body of a request to create a group
+type createGroupRequest struct {
+	Name    string   `json:"name"`
+	Prefix  string   `json:"prefix"`
+	Quota   int64    `json:"quota"`
+	Members []string `json:"members"`
+}
+
+// handlePostGroup creates a group owned by the user making the request, who
+// is its first member. The prefix is the name and a dash if it isn't given.
+func (s server) handlePostGroup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req createGroupRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode group:", err)
+		return
+	}
+
+	user := requestIdentity(r)
+	if user == anonymous {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("create group: anonymous users can't own groups")
+		return
+	}
+
+	if req.Prefix == "" {
+		req.Prefix = req.Name + "-"
+	}
+	switch c := checkFilename(req.Prefix); {
+	case !groupNamePattern.MatchString(req.Name):
+		err = fmt.Errorf("invalid group name %q", req.Name)
+	case !c.OK:
+		err = fmt.Errorf("prefix: %s", c.Reason)
+	case req.Quota < 0:
+		err = errors.New("quota is negative")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("create group:", err)
+		return
+	}
+
+	g := group{Name: req.Name, Owner: user, Members: []string{user}, Prefix: req.Prefix, Quota: req.Quota}
+	for _, m := range req.Members {
+		if m != "" && !contains(g.Members, m) {
+			g.Members = append(g.Members, m)
+		}
+	}
+
+	err = s.catalog.groups.create(g)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		log.Println("create group:", err)
+		return
+	}
+	if !s.saveGroups(w, r) {
+		return
+	}
+
+	s.writeGroup(w, http.StatusCreated, g)
+}
+
+// handleGetGroups lists the groups the user making the request is in
+func (s server) handleGetGroups(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user := requestIdentity(r)
+	groups := []groupResponse{}
+	for _, g := range s.catalog.groups.list() {
+		if contains(g.Members, user) {
+			groups = append(groups, groupResponse{group: g, Used: s.groupUsage(g, "")})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// handleGetGroup returns a group, only its members can see it
+func (s server) handleGetGroup(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	g, ok := s.catalog.groups.get(ps.ByName("name"))
+	if !ok || !contains(g.Members, requestIdentity(r)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.writeGroup(w, http.StatusOK, g)
+}
+
+// handlePutGroupMember adds a user to a group, only the owner can
+func (s server) handlePutGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := requestIdentity(r)
+	s.updateGroup(w, r, ps.ByName("name"), func(g *group) error {
+		if user != g.Owner {
+			return errNotGroupOwner
+		}
+		if !contains(g.Members, ps.ByName("user")) {
+			g.Members = append(g.Members, ps.ByName("user"))
+		}
+		return nil
+	})
+}
+
+// handleDeleteGroupMember takes a user out of a group. The owner can remove
+// anyone but themselves, and members can leave.
+func (s server) handleDeleteGroupMember(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, member := requestIdentity(r), ps.ByName("user")
+	s.updateGroup(w, r, ps.ByName("name"), func(g *group) error {
+		switch {
+		case member == g.Owner:
+			return errRemoveGroupOwner
+		case user != g.Owner && user != member:
+			return errNotGroupOwner
+		}
+		g.Members = slices.DeleteFunc(g.Members, func(m string) bool { return m == member })
+		return nil
+	})
+}
+
+var (
+	errNotGroupOwner    = errors.New("only the owner can change the members")
+	errRemoveGroupOwner = errors.New("the owner can't be removed")
+)
+
+// updateGroup changes a group and saves it, responding with the group or
+// why it couldn't be changed. Groups the user isn't in are treated as not
+// existing.
+func (s server) updateGroup(w http.ResponseWriter, r *http.Request, name string, f func(g *group) error) {
+	user := requestIdentity(r)
+	g, err := s.catalog.groups.update(name, func(g *group) error {
+		if !contains(g.Members, user) {
+			return errGroupNotFound
+		}
+		return f(g)
+	})
+	switch {
+	case errors.Is(err, errGroupNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case errors.Is(err, errNotGroupOwner), errors.Is(err, errRemoveGroupOwner):
+		w.WriteHeader(http.StatusForbidden)
+		log.Printf("group: %s, user: %s, error: %s", name, user, err)
+		return
+	}
+	if !s.saveGroups(w, r) {
+		return
+	}
+
+	s.writeGroup(w, http.StatusOK, g)
+}
+
+// saveGroups saves the catalog the groups are kept in, responding with a 500
+// if it can't be
+func (s server) saveGroups(w http.ResponseWriter, r *http.Request) bool {
+	err := s.saveCatalog(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("save groups:", err)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,98 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroups(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(r *http.Request, user string) *httptest.ResponseRecorder {
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	create := func(user, body string) int {
+		return do(httptest.NewRequest(http.MethodPost, "/groups", strings.NewReader(body)), user).Result().StatusCode
+	}
+	member := func(method, user, member string) int {
+		return do(httptest.NewRequest(method, "/groups/finance/members/"+member, nil), user).Result().StatusCode
+	}
+	upload := func(user, filename, contents string) int {
+		return do(newUploadRequest(t, "/upload", filename, contents), user).Result().StatusCode
+	}
+	get := func(user, filename string) int {
+		return do(httptest.NewRequest(http.MethodGet, "/file/"+filename, nil), user).Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusForbidden, create("", `{"name": "finance"}`), "anonymous users can't own groups")
+	require.Equal(t, http.StatusBadRequest, create("alice", `{"name": "fin,ance"}`))
+	require.Equal(t, http.StatusBadRequest, create("alice", `{"name": "finance", "prefix": ".finance"}`))
+	require.Equal(t, http.StatusCreated, create("alice", `{"name": "finance", "quota": 40}`))
+	require.Equal(t, http.StatusConflict, create("bob", `{"name": "finance"}`))
+	require.Equal(t, http.StatusConflict, create("bob", `{"name": "fin", "prefix": "fin"}`), "prefixes can't overlap")
+
+	w := do(httptest.NewRequest(http.MethodGet, "/groups/finance", nil), "alice")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var got groupResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, group{Name: "finance", Owner: "alice", Members: []string{"alice"}, Prefix: "finance-", Quota: 40}, got.group)
+	require.Equal(t, http.StatusNotFound, do(httptest.NewRequest(http.MethodGet, "/groups/finance", nil), "bob").Result().StatusCode)
+
+	t.Run("members", func(t *testing.T) {
+		require.Equal(t, http.StatusNotFound, member(http.MethodPut, "bob", "bob"), "outsiders can't see the group")
+		require.Equal(t, http.StatusOK, member(http.MethodPut, "alice", "bob"))
+		require.Equal(t, http.StatusForbidden, member(http.MethodPut, "bob", "carol"), "only the owner adds members")
+		require.Equal(t, http.StatusForbidden, member(http.MethodDelete, "bob", "alice"), "the owner can't be removed")
+
+		var groups []groupResponse
+		require.NoError(t, json.NewDecoder(do(httptest.NewRequest(http.MethodGet, "/groups", nil), "bob").Body).Decode(&groups))
+		require.Len(t, groups, 1)
+		require.Equal(t, []string{"alice", "bob"}, groups[0].Members)
+	})
+
+	t.Run("shared prefix", func(t *testing.T) {
+		require.Equal(t, http.StatusCreated, upload("alice", "finance-q1.txt", "test file contents"))
+		require.Equal(t, http.StatusForbidden, upload("carol", "finance-q2.txt", "test file contents"), "only members can write under the prefix")
+		require.Equal(t, http.StatusCreated, upload("bob", "finance-q1.txt", "new contents"), "members can replace each other's files")
+
+		require.Equal(t, http.StatusOK, get("bob", "finance-q1.txt"))
+		require.Equal(t, http.StatusForbidden, get("carol", "finance-q1.txt"))
+
+		var acl fileACL
+		require.NoError(t, json.NewDecoder(do(httptest.NewRequest(http.MethodGet, "/file/finance-q1.txt/acl", nil), "bob").Body).Decode(&acl))
+		require.Equal(t, []grant{{Group: "finance", Access: accessWrite}}, acl.Inherited)
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		// finance-q1.txt already uses 12 of the 40 bytes
+		require.Equal(t, http.StatusInsufficientStorage, upload("alice", "finance-q2.txt", strings.Repeat("a", 29)))
+		require.Equal(t, http.StatusCreated, upload("alice", "finance-q2.txt", strings.Repeat("a", 28)))
+		// Replacing a file only counts the new version
+		require.Equal(t, http.StatusCreated, upload("alice", "finance-q2.txt", strings.Repeat("b", 28)))
+	})
+
+	t.Run("leave", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, member(http.MethodDelete, "bob", "bob"))
+		require.Equal(t, http.StatusForbidden, get("bob", "finance-q2.txt"))
+	})
+
+	t.Run("saved", func(t *testing.T) {
+		s.catalog.groups.restore(nil)
+		require.NoError(t, s.loadCatalog(context.Background()))
+		g, ok := s.catalog.groups.get("finance")
+		require.True(t, ok)
+		require.Equal(t, []string{"alice"}, g.Members)
+	})
+}
@@ -0,0 +1,85 @@
+package filesrv
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/minio/sio"
+)
+
+// handleHeadFile responds with the headers a GET of the file would have,
+// without fetching or decrypting any of it
+func (s server) handleHeadFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := ps.ByName("filename")
+	if !s.readConsistent(w, r, filename) || !s.downloadAllowed(w, r, filename) {
+		return
+	}
+
+	e, err := s.fileInfo(r.Context(), filename)
+	if err != nil {
+		writeStorageError(w, err, "head file")
+		return
+	}
+
+	w.Header().Set("Last-Modified", e.Uploaded.UTC().Format(http.TimeFormat))
+	if e.SHA256 != "" {
+		w.Header().Set("ETag", etag(e.SHA256))
+	}
+	if notModified(r, e) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if !s.setFileHeaders(w, r, filename, e) {
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// contentTypeOf returns the content type of a file, from the catalog or from
+// the extension if it isn't in there. It's empty if neither says.
+func contentTypeOf(filename string, e catalogEntry) string {
+	if e.ContentType != "" {
+		return e.ContentType
+	}
+	return mime.TypeByExtension(path.Ext(filename))
+}
+
+// fileInfo returns the catalog entry for a file. Files that aren't in the
+// catalog are looked up in minio, which only gives the size, when it was last
+// modified and the content type it was stored with.
+func (s server) fileInfo(ctx context.Context, filename string) (catalogEntry, error) {
+	e, ok := s.catalog.get(filename)
+	if ok && !e.Uploaded.IsZero() {
+		return e, nil
+	}
+
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, filename)
+	if err != nil {
+		return catalogEntry{}, err
+	}
+
+	e.Name = filename
+	e.Size = info.Size
+	if s.appEncrypted(filename) {
+		size, err := sio.DecryptedSize(uint64(info.Size))
+		if err != nil {
+			return catalogEntry{}, fmt.Errorf("decrypted size: %w", err)
+		}
+		e.Size = int64(size)
+	}
+	e.Uploaded = info.LastModified
+	if e.ContentType == "" {
+		e.ContentType = userMetadata(info.UserMetadata, contentTypeMetadata)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,161 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleHeadFile(t *testing.T) {
+	const contents = "test file contents"
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "test.txt", contents))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// Written without going through the catalog
+	_, err := s.putFile(context.Background(), "raw.txt", strings.NewReader(contents), int64(len(contents)))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		filename   string
+		wantStatus int
+		wantType   string
+		wantETag   string
+	}{
+		{name: "in catalog", filename: "test.txt", wantStatus: http.StatusOK, wantType: "text/plain; charset=utf-8", wantETag: strconv.Quote(testFileSHA256)},
+		{name: "only in bucket", filename: "raw.txt", wantStatus: http.StatusOK, wantType: "text/plain; charset=utf-8"},
+		{name: "missing", filename: "missing.txt", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gets := store.gets
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/file/"+test.filename, nil))
+
+			resp := w.Result()
+			require.Equal(t, test.wantStatus, resp.StatusCode)
+			require.Equal(t, gets, store.gets, "the object shouldn't be fetched")
+			require.Empty(t, w.Body.Bytes())
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			require.Equal(t, strconv.Itoa(len(contents)), resp.Header.Get("Content-Length"))
+			require.Equal(t, test.wantType, resp.Header.Get("Content-Type"))
+			require.Equal(t, test.wantETag, resp.Header.Get("ETag"))
+			modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+			require.NoError(t, err)
+			require.WithinDuration(t, time.Now(), modified, time.Minute)
+		})
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	const contents = "test file contents"
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "test.txt", contents))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	e, ok := s.catalog.get("test.txt")
+	require.True(t, ok)
+	lastModified := e.Uploaded.UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+	}{
+		{name: "no conditions", wantStatus: http.StatusOK},
+		{name: "same etag", header: "If-None-Match", value: strconv.Quote(testFileSHA256), wantStatus: http.StatusNotModified},
+		{name: "weak etag in a list", header: "If-None-Match", value: `"old", W/` + strconv.Quote(testFileSHA256), wantStatus: http.StatusNotModified},
+		{name: "any etag", header: "If-None-Match", value: "*", wantStatus: http.StatusNotModified},
+		{name: "other etag", header: "If-None-Match", value: `"old"`, wantStatus: http.StatusOK},
+		{name: "not modified since", header: "If-Modified-Since", value: lastModified, wantStatus: http.StatusNotModified},
+		{name: "modified since", header: "If-Modified-Since", value: e.Uploaded.Add(-time.Hour).UTC().Format(http.TimeFormat), wantStatus: http.StatusOK},
+		{name: "bad date", header: "If-Modified-Since", value: "yesterday", wantStatus: http.StatusOK},
+	}
+	for _, test := range tests {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			t.Run(test.name+" "+method, func(t *testing.T) {
+				gets := store.gets
+				r := httptest.NewRequest(method, "/file/test.txt", nil)
+				if test.header != "" {
+					r.Header.Set(test.header, test.value)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+
+				resp := w.Result()
+				require.Equal(t, test.wantStatus, resp.StatusCode)
+				require.Equal(t, strconv.Quote(testFileSHA256), resp.Header.Get("ETag"))
+				require.Equal(t, lastModified, resp.Header.Get("Last-Modified"))
+				if test.wantStatus == http.StatusNotModified {
+					require.Empty(t, w.Body.Bytes())
+					require.Empty(t, resp.Header.Get("Content-Length"))
+					require.Equal(t, gets, store.gets, "the object shouldn't be fetched")
+				} else if method == http.MethodGet {
+					require.Equal(t, contents, w.Body.String())
+				}
+			})
+		}
+	}
+
+	// An If-None-Match that doesn't match wins over an If-Modified-Since
+	// that does
+	r := httptest.NewRequest(http.MethodGet, "/file/test.txt", nil)
+	r.Header.Set("If-None-Match", `"old"`)
+	r.Header.Set("If-Modified-Since", lastModified)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestContentTypeWithoutCatalog(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	// The extension doesn't say, so the type comes from sniffing
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "logo", png))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.Equal(t, "image/png", userMetadata(store.objects["testBucket/logo"].metadata, contentTypeMetadata))
+
+	// Written without a content type
+	_, err := s.putFile(context.Background(), "blob", strings.NewReader("<html>"), int64(len("<html>")))
+	require.NoError(t, err)
+
+	// As if the catalog had been lost
+	s.catalog.remove("logo")
+
+	for _, test := range []struct {
+		filename string
+		want     string
+	}{
+		{filename: "logo", want: "image/png"},
+		{filename: "blob", want: "application/octet-stream"},
+	} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(method, "/file/"+test.filename, nil))
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+			require.Equal(t, test.want, w.Result().Header.Get("Content-Type"), method+" "+test.filename)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package filesrv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// headerRule adds response headers to downloads of files with the prefix and
+// one of the content types, like X-Robots-Tag for a public prefix or a
+// Content-Security-Policy for HTML
+type headerRule struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	// ContentTypes are full types like text/html, wildcards like image/* or
+	// * for everything, and leaving them out is the same as *
+	ContentTypes []string          `yaml:"content-types"`
+	Headers      map[string]string `yaml:"headers"`
+}
+
+// headerNamePattern matches the token a header name has to be
+var headerNamePattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// reservedHeaders are set by the server for every download, or describe how
+// the response is sent, so rules can't change them
+var reservedHeaders = []string{
+	"Accept-Ranges",
+	"Connection",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Etag",
+	"Last-Modified",
+	"Transfer-Encoding",
+}
+
+// validateHeaderRules checks the response header rules
+func validateHeaderRules(rules []headerRule) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, rule := range rules {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(responseHeadersSection, i, "response header rule %d (%s): %s", i+1, rule.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if rule.Name == "" {
+			fail("name is empty")
+		}
+		if seen[rule.Name] {
+			fail("defined more than once")
+		}
+		seen[rule.Name] = true
+		for _, ct := range rule.ContentTypes {
+			if !validContentTypePattern(ct) {
+				fail("content type %q isn't a type, a type/* wildcard or *", ct)
+			}
+		}
+		if len(rule.Headers) == 0 {
+			fail("no headers")
+		}
+		for _, name := range sortedKeys(rule.Headers) {
+			switch {
+			case !headerNamePattern.MatchString(name):
+				fail("%q isn't a header name", name)
+			case slices.Contains(reservedHeaders, http.CanonicalHeaderKey(name)):
+				fail("header %q is set by the server", name)
+			case strings.ContainsAny(rule.Headers[name], "\r\n\x00"):
+				fail("header %q has a line break in its value", name)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// appliesTo says whether the rule is for a file with the content type
+func (rule headerRule) appliesTo(filename, contentType string) bool {
+	if !strings.HasPrefix(filename, rule.Prefix) {
+		return false
+	}
+	if len(rule.ContentTypes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(rule.ContentTypes, func(pattern string) bool {
+		return contentTypeMatches(pattern, contentType)
+	})
+}
+
+// setResponseHeaders adds the headers from every rule that applies to a
+// download of the file, in order so later rules win
+func (s server) setResponseHeaders(h http.Header, filename, contentType string) {
+	for _, rule := range s.settings().headerRules {
+		if !rule.appliesTo(filename, contentType) {
+			continue
+		}
+		for name, value := range rule.Headers {
+			h.Set(name, value)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package filesrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.ResponseHeaders = []headerRule{
+		{Name: "public", Prefix: "public-", Headers: map[string]string{"X-Robots-Tag": "noindex", "Cache-Control": "public, max-age=3600"}},
+		{Name: "html", ContentTypes: []string{"text/html"}, Headers: map[string]string{"Content-Security-Policy": "sandbox"}},
+		{Name: "public-html", Prefix: "public-", ContentTypes: []string{"text/*"}, Headers: map[string]string{"Cache-Control": "no-store"}},
+	}
+	handler := newServerFromConfig(newMemObjStore(), cfg).routes()
+
+	files := map[string]string{
+		"public-page.html": "<html><p>test file contents</p></html>",
+		"public-photo.png": "\x89PNG\r\n\x1a\ntest file contents",
+		"private.html":     "<html><p>test file contents</p></html>",
+	}
+	for name, contents := range files {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", name, contents))
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+
+	get := func(method, target string, header http.Header) http.Header {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		handler.ServeHTTP(w, r)
+		require.Less(t, w.Code, 300, target)
+		return w.Result().Header
+	}
+
+	// Every rule that applies is used, and later ones win
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		h := get(method, "/file/public-page.html", nil)
+		require.Equal(t, "noindex", h.Get("X-Robots-Tag"), method)
+		require.Equal(t, "sandbox", h.Get("Content-Security-Policy"), method)
+		require.Equal(t, "no-store", h.Get("Cache-Control"), method)
+	}
+
+	h := get(http.MethodGet, "/file/public-photo.png", http.Header{"Range": {"bytes=0-3"}})
+	require.Equal(t, "noindex", h.Get("X-Robots-Tag"))
+	require.Equal(t, "public, max-age=3600", h.Get("Cache-Control"))
+	require.Empty(t, h.Get("Content-Security-Policy"))
+
+	h = get(http.MethodGet, "/file/private.html", nil)
+	require.Equal(t, "sandbox", h.Get("Content-Security-Policy"))
+	require.Empty(t, h.Get("X-Robots-Tag"))
+}
+
+func TestLoadConfigFileResponseHeaders(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+response-headers:
+  - name: public
+    prefix: public-
+    headers:
+      X-Robots-Tag: noindex
+  - name: html
+    content-types: [text/html]
+    headers:
+      Content-Security-Policy: "default-src 'none'"
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []headerRule{
+		{Name: "public", Prefix: "public-", Headers: map[string]string{"X-Robots-Tag": "noindex"}},
+		{Name: "html", ContentTypes: []string{"text/html"}, Headers: map[string]string{"Content-Security-Policy": "default-src 'none'"}},
+	}, cfg.ResponseHeaders)
+
+	path = writeConfigFile(t, testConfigFile+`
+response-headers:
+  - name: public
+    headers:
+      X-Robots-Tag: noindex
+  - name: public
+    content-types: [html]
+    headers:
+      content-length: "10"
+      "Bad Header": x
+  - name: empty
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "response header rule 2 (public): defined more than once")
+	require.ErrorContains(t, err, `response header rule 2 (public): content type "html" isn't a type, a type/* wildcard or *`)
+	require.ErrorContains(t, err, `response header rule 2 (public): header "content-length" is set by the server`)
+	require.ErrorContains(t, err, `response header rule 2 (public): "Bad Header" isn't a header name`)
+	require.ErrorContains(t, err, "response header rule 3 (empty): no headers")
+	require.Equal(t, "response-headers[1]", configProblems(err)[0].Path)
+}
@@ -0,0 +1,75 @@
+package filesrv
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// readinessTimeout bounds how long the readiness probe waits for minio, probes
+// usually time out after a second or two
+const readinessTimeout = 2 * time.Second
+
+// handleGetHealthz says the process is alive, it doesn't check anything else so
+// a slow or missing minio doesn't get the server restarted
+func handleGetHealthz(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// hiddenVars are the vars the standard library publishes that mustn't be
+// served: cmdline has the flags, keys and all, and memstats is only of use
+// to someone who can run pprof anyway
+var hiddenVars = map[string]bool{"cmdline": true, "memstats": true}
+
+// handleGetVars serves the expvar counters like expvar.Handler, without the
+// hidden ones
+func handleGetVars(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if hiddenVars[kv.Key] {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// handleGetReadyz says whether the server can handle requests, which needs
+// minio to be reachable and the bucket to be readable. A server that is
+// shutting down isn't ready, so the load balancer stops sending it requests.
+func (s server) handleGetReadyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	select {
+	case <-s.drainer.draining():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "shutting down")
+		return
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	_, err := s.minioClient.ListObjects(ctx, s.bucketName, checkObject)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "bucket not accessible")
+		log.Println("readiness:", err)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
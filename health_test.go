@@ -0,0 +1,80 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthz(t *testing.T) {
+	store := newMemObjStore()
+	store.listErr = errors.New("connection refused")
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "ok\n", w.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		listErr    error
+		draining   bool
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "ready",
+			wantStatus: http.StatusOK,
+			wantBody:   "ok\n",
+		},
+		{
+			name:       "minio down",
+			listErr:    errors.New("connection refused"),
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "bucket not accessible\n",
+		},
+		{
+			name:       "shutting down",
+			draining:   true,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "shutting down\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			store.listErr = test.listErr
+			s := NewServer(store, "testBucket", "key", 10<<17)
+			if test.draining {
+				s.drainer.drain()
+			}
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			require.Equal(t, test.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestVars(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var vars map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	require.Contains(t, vars, "incomplete_uploads_removed")
+	require.NotContains(t, vars, "cmdline")
+	require.NotContains(t, vars, "memstats")
+}
@@ -0,0 +1,150 @@
+package filesrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// identityHeader holds the user making the request. Without any auth
+// providers this is expected to be set by an authenticating proxy in front of
+// filesrv, otherwise withAuth sets it from whichever provider authenticated
+// the request.
+const identityHeader = "X-Filesrv-User"
+
+// groupsHeader holds the groups the user is in, comma separated. It's set by
+// the same proxy as identityHeader.
+const groupsHeader = "X-Filesrv-Groups"
+
+// anonymous is the identity used when the request doesn't have one
+const anonymous = "anonymous"
+
+// requestIdentity returns the user making the request
+func requestIdentity(r *http.Request) string {
+	if id := r.Header.Get(identityHeader); id != "" {
+		return id
+	}
+
+	return anonymous
+}
+
+// requestGroups returns the groups the user making the request is in
+func requestGroups(r *http.Request) []string {
+	return splitList(r.Header.Get(groupsHeader))
+}
+
+// clientIPKey is the context key for the client address worked out by
+// withClientIP
+type clientIPKey struct{}
+
+// parseTrustedProxies parses a comma separated list of addresses and CIDRs
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range splitList(list) {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, err
+			}
+			s = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func mustTrustedProxies(list string) []netip.Prefix {
+	prefixes, err := parseTrustedProxies(list)
+	if err != nil {
+		panic(err)
+	}
+
+	return prefixes
+}
+
+// withClientIP works out the address of the client before anything else sees
+// the request, for requestIP
+func withClientIP(next http.Handler, trusted []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r, trusted)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the address of the client that made the request.
+// X-Forwarded-For is only read when the request came from a trusted proxy,
+// since anyone else could put anything in it. Each proxy adds the address it
+// got the request from to the end, so the addresses are read from the end
+// back to the first one that wasn't added by a trusted proxy.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	ip := remoteIP(r)
+	isTrusted := func(s string) bool {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0 && isTrusted(ip); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		ip = hop
+	}
+
+	return ip
+}
+
+// remoteIP returns the address the connection the request came over is from
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// requestIP returns the address of the client making the request, as worked
+// out by withClientIP. Without it the request is taken to come straight from
+// the client.
+func requestIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+
+	return remoteIP(r)
+}
+
+// uploadSource records who uploaded a file and from where, for tracking where
+// files came from
+type uploadSource struct {
+	UploadedBy string `json:"uploadedBy,omitempty"`
+	SourceIP   string `json:"sourceIP,omitempty"`
+	UserAgent  string `json:"userAgent,omitempty"`
+}
+
+// requestSource returns the source of an upload request
+func requestSource(r *http.Request) uploadSource {
+	return uploadSource{
+		UploadedBy: requestIdentity(r),
+		SourceIP:   requestIP(r),
+		UserAgent:  r.UserAgent(),
+	}
+}
@@ -0,0 +1,81 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := mustTrustedProxies("10.0.0.0/8, 192.0.2.1")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{
+			name:       "no proxy",
+			remoteAddr: "203.0.113.7:1234",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded by someone untrusted",
+			remoteAddr: "203.0.113.7:1234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "forwarded by a trusted proxy",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  []string{"198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "client adds its own address",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  []string{"127.0.0.1, 198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "through two trusted proxies",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  []string{"198.51.100.1", "10.1.2.3"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "only trusted proxies",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  []string{"10.1.2.3"},
+			want:       "10.1.2.3",
+		},
+		{
+			name:       "garbage",
+			remoteAddr: "192.0.2.1:1234",
+			forwarded:  []string{"198.51.100.1, not an address, 10.1.2.3"},
+			want:       "10.1.2.3",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = test.remoteAddr
+			for _, fwd := range test.forwarded {
+				r.Header.Add("X-Forwarded-For", fwd)
+			}
+
+			var got string
+			withClientIP(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = requestIP(r)
+			}), trusted).ServeHTTP(httptest.NewRecorder(), r)
+			require.Equal(t, test.want, got)
+		})
+	}
+
+	_, err := parseTrustedProxies("10.0.0.0/8, proxy.example.com")
+	require.Error(t, err)
+}
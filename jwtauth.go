@@ -0,0 +1,209 @@
+package filesrv
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is how far the server's clock can be from the token issuer's
+// before exp and nbf start turning tokens away
+const jwtLeeway = time.Minute
+
+// jwtAuth checks bearer tokens signed by an identity provider. Only one
+// algorithm is accepted, HS256 with a secret or RS256 with a public key,
+// whatever the token's header says, so a token can't pick a weaker one.
+type jwtAuth struct {
+	alg       string
+	secret    []byte
+	publicKey *rsa.PublicKey
+
+	issuer      string
+	audience    string
+	userClaim   string
+	groupsClaim string
+	now         func() time.Time
+}
+
+func newJWTAuth(c authConfig) (jwtAuth, error) {
+	a := jwtAuth{
+		issuer:      c.Issuer,
+		audience:    c.Audience,
+		userClaim:   c.UserClaim,
+		groupsClaim: c.GroupsClaim,
+		now:         time.Now,
+	}
+	if a.userClaim == "" {
+		a.userClaim = "sub"
+	}
+	if a.groupsClaim == "" {
+		a.groupsClaim = "groups"
+	}
+
+	switch {
+	case (c.Secret == "") == (c.PublicKeyFile == ""):
+		return jwtAuth{}, errors.New("needs one of a secret or a public key file")
+	case c.Secret != "":
+		a.alg = "HS256"
+		a.secret = []byte(c.Secret)
+	default:
+		b, err := os.ReadFile(c.PublicKeyFile)
+		if err != nil {
+			return jwtAuth{}, fmt.Errorf("read public key: %w", err)
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return jwtAuth{}, fmt.Errorf("public key file %s isn't PEM", c.PublicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return jwtAuth{}, fmt.Errorf("parse public key: %w", err)
+		}
+		var ok bool
+		a.publicKey, ok = key.(*rsa.PublicKey)
+		if !ok {
+			return jwtAuth{}, fmt.Errorf("public key in %s isn't an RSA key", c.PublicKeyFile)
+		}
+		a.alg = "RS256"
+	}
+
+	return a, nil
+}
+
+func (a jwtAuth) authenticate(r *http.Request) (identity, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return identity{}, errNoCredentials
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return identity{}, fmt.Errorf("%w: %w", errBadCredentials, err)
+	}
+
+	return a.identity(claims)
+}
+
+func (jwtAuth) scheme() string {
+	return "Bearer"
+}
+
+// verify checks the signature on the token and returns its claims
+func (a jwtAuth) verify(token string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != a.alg {
+		return nil, fmt.Errorf("token is signed with %q, not %s", header.Alg, a.alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signingInput := parts[0] + "." + parts[1]
+	if a.publicKey != nil {
+		digest := sha256.Sum256([]byte(signingInput))
+		err = rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, digest[:], sig)
+	} else if !hmac.Equal(sig, receiptMAC(a.secret, signingInput)) {
+		err = errors.New("signature doesn't match")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// identity checks the claims are for now and for this server and returns who
+// they're about. A token has to have an expiry, since nothing else would
+// stop a leaked one from working.
+func (a jwtAuth) identity(claims map[string]any) (identity, error) {
+	bad := func(format string, args ...any) (identity, error) {
+		return identity{}, fmt.Errorf("%w: %s", errBadCredentials, fmt.Sprintf(format, args...))
+	}
+
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return bad("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return bad("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return bad("token isn't valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return bad("token is from %v, not %s", claims["iss"], a.issuer)
+	}
+	if a.audience != "" && !jwtHasAudience(claims["aud"], a.audience) {
+		return bad("token is for %v, not %s", claims["aud"], a.audience)
+	}
+
+	user, _ := claims[a.userClaim].(string)
+	if user == "" {
+		return bad("token has no %s claim", a.userClaim)
+	}
+	id := identity{User: user}
+	groups, _ := claims[a.groupsClaim].([]any)
+	for _, g := range groups {
+		if g, ok := g.(string); ok {
+			id.Groups = append(id.Groups, g)
+		}
+	}
+
+	return id, nil
+}
+
+// jwtHasAudience says whether the aud claim, a string or a list of them,
+// includes the audience
+func jwtHasAudience(aud any, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []any:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decodeJWTPart decodes the header or the claims of a token
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("malformed token: %w", err)
+	}
+	return nil
+}
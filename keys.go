@@ -0,0 +1,105 @@
+package filesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// keyIDLength is how many bytes of the key's MAC make up its ID, enough that
+// two keys won't share one
+const keyIDLength = 8
+
+// keyID identifies an encryption key without giving anything away about it.
+// Each bucket's key has its own, and it changes whenever the key does.
+func keyID(key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("filesrv key id"))
+	return hex.EncodeToString(mac.Sum(nil)[:keyIDLength])
+}
+
+// encryptionContext is what the key for an object is derived with, along with
+// the server's key. It's recorded in the catalog so it's clear what an object
+// is bound to without knowing how the keys are derived.
+func (s server) encryptionContext(filename string) string {
+	return path.Join(s.bucketName, filename)
+}
+
+// recordEncryption notes in the entry that the object is encrypted by filesrv
+// with the server's current key
+func (s server) recordEncryption(e *catalogEntry) {
+	e.KeyID = keyID(s.encryptionKey)
+	e.EncryptionContext = s.encryptionContext(e.Name)
+}
+
+// keyUsage is how much is stored under an encryption key
+type keyUsage struct {
+	// KeyID is empty for files stored before key IDs were recorded
+	KeyID string `json:"keyID"`
+	// Current is set for the key the server encrypts new files with
+	Current bool  `json:"current"`
+	Files   int   `json:"files"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// handleGetKeys lists the keys files are encrypted with and how much is under
+// each of them. Files encrypted by something other than filesrv aren't under
+// any of its keys, so they're left out.
+func (s server) handleGetKeys(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	current := keyID(s.encryptionKey)
+	usage := map[string]*keyUsage{current: {KeyID: current, Current: true}}
+	for _, e := range s.catalog.snapshot() {
+		if !e.appEncrypted() {
+			continue
+		}
+		u, ok := usage[e.KeyID]
+		if !ok {
+			u = &keyUsage{KeyID: e.KeyID}
+			usage[e.KeyID] = u
+		}
+		u.Files++
+		u.Bytes += e.Size
+	}
+
+	keys := make([]keyUsage, 0, len(usage))
+	for _, u := range usage {
+		keys = append(keys, *u)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].KeyID < keys[j].KeyID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// handleGetKeyFiles lists the files encrypted with a key a page at a time, in
+// the same way as search. The files stored before key IDs were recorded are
+// under the key ID "unrecorded".
+func (s server) handleGetKeyFiles(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	limit, ok := pageLimit(r.URL.Query())
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := ps.ByName("id")
+	if id == "unrecorded" {
+		id = ""
+	}
+	page := newFilePage(r.URL.Query().Get("after"), limit)
+	for _, e := range s.catalog.snapshot() {
+		if e.appEncrypted() && e.KeyID == id && !page.add(e) {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page.done())
+}
@@ -0,0 +1,64 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+	get := func(target string, v any) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, w.Code, target)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+
+	for _, name := range []string{"a.txt", "b.txt"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", name, "test file contents"))
+		require.Equal(t, http.StatusCreated, w.Code)
+	}
+	s.catalog.put(catalogEntry{Name: "legacy.txt", Size: 5})
+	s.catalog.put(catalogEntry{Name: "plain.txt", Size: 7, Encryption: encryptionNone})
+
+	current := keyID("key")
+	require.Len(t, current, 2*keyIDLength)
+	require.NotEqual(t, current, keyID("another key"))
+
+	var entry catalogEntry
+	get("/file/a.txt/metadata", &entry)
+	require.Equal(t, current, entry.KeyID)
+	require.Equal(t, "testBucket/a.txt", entry.EncryptionContext)
+
+	var keys []keyUsage
+	get("/admin/keys", &keys)
+	require.Equal(t, []keyUsage{
+		{KeyID: "", Files: 1, Bytes: 5},
+		{KeyID: current, Current: true, Files: 2, Bytes: 2 * int64(len("test file contents"))},
+	}, keys)
+
+	names := func(page filePage) []string {
+		var names []string
+		for _, e := range page.Files {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+	var page filePage
+	get("/admin/keys/"+current+"/files?limit=1", &page)
+	require.Equal(t, []string{"a.txt"}, names(page))
+	require.True(t, page.More)
+	cursor := page.Cursor
+	page = filePage{}
+	get("/admin/keys/"+current+"/files?after="+cursor, &page)
+	require.Equal(t, []string{"b.txt"}, names(page))
+	page = filePage{}
+	get("/admin/keys/unrecorded/files", &page)
+	require.Equal(t, []string{"legacy.txt"}, names(page))
+}
@@ -0,0 +1,52 @@
+package filesrv
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks a listen address as a unix domain socket path
+const unixPrefix = "unix:"
+
+// unixSocketMode lets a reverse proxy in the same group connect to the socket
+const unixSocketMode = 0o660
+
+// listen listens on a TCP address like :2001, or on a unix domain socket for
+// an address like unix:/run/filesrv.sock
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left behind by a server that didn't shut down cleanly would
+	// stop this one from starting, but anything else at the path is left
+	// alone
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("listen on %s: file exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, unixSocketMode)
+	if err != nil {
+		l.Close()
+		return nil, fmt.Errorf("set socket permissions: %w", err)
+	}
+
+	return l, nil
+}
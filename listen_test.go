@@ -0,0 +1,73 @@
+package filesrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filesrv.sock")
+
+	// A socket left behind by an earlier run is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listen("unix:" + path)
+	require.NoError(t, err)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(unixSocketMode), info.Mode().Perm())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, &http.Server{Handler: http.NotFoundHandler()}, l, time.Second)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://filesrv/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	// The socket is removed on shutdown
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnixSocketOverFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.txt")
+	require.NoError(t, os.WriteFile(path, []byte("important"), 0o600))
+
+	_, err := listen("unix:" + path)
+	require.ErrorContains(t, err, "file exists and is not a socket")
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "important", string(b))
+}
+
+func TestListenTCP(t *testing.T) {
+	l, err := listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, "tcp", l.Addr().Network())
+}
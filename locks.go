@@ -0,0 +1,46 @@
+package filesrv
+
+import "sync"
+
+// nameLocks serialises writes to the same object, so a conditional delete
+// can't slip in between an upload storing a file and indexing it
+type nameLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+type nameLock struct {
+	mu sync.Mutex
+	// waiters counts the holder and everyone waiting, the lock is dropped
+	// from the map when it gets to zero
+	waiters int
+}
+
+func newNameLocks() *nameLocks {
+	return &nameLocks{locks: map[string]*nameLock{}}
+}
+
+// lock locks name and returns the function to unlock it
+func (n *nameLocks) lock(name string) func() {
+	n.mu.Lock()
+	l, ok := n.locks[name]
+	if !ok {
+		l = &nameLock{}
+		n.locks[name] = l
+	}
+	l.waiters++
+	n.mu.Unlock()
+
+	l.mu.Lock()
+
+	return func() {
+		l.mu.Unlock()
+
+		n.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(n.locks, name)
+		}
+		n.mu.Unlock()
+	}
+}
@@ -0,0 +1,33 @@
+package filesrv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameLocks(t *testing.T) {
+	locks := newNameLocks()
+
+	unlock := locks.lock("a")
+
+	// Other names aren't held up
+	locks.lock("b")()
+
+	locked := make(chan struct{})
+	go func() {
+		locks.lock("a")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("second lock on the same name didn't wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	unlock()
+	<-locked
+	require.Empty(t, locks.locks)
+}
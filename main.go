@@ -1,38 +1,66 @@
-package main
+// Package filesrv is the filesrv server. The command is in cmd/filesrv, and
+// the package is only importable so filesrvtest can run the server inside
+// other programs' tests.
+package filesrv
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"path"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"github.com/minio/sio"
 	"golang.org/x/crypto/argon2"
 )
 
-// Since this is a demo projct, I have included the configuration here, but for
-// a production system these would be stored externally
-const (
-	minioEndpoint   = "127.0.0.1:9000"
-	accessKeyID     = "minioadmin"
-	secretAccessKey = "minioadmin"
-	bucketName      = "filesrv"
-	encryptionKey   = "a static encryption key"
-
-	// minio can handle uploading in parts for us, but it doesn't exactly match
-	// the given spec because the minimum chunk size is 5MB
-	chunkSize = 10 << 19 // ~ 5MB
-)
-
 // objStorer abstracts the minio operations to allow dependency injection
 type objStorer interface {
 	PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error)
 	GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error)
+	// GetObjectRange reads length bytes of the object starting at offset, or
+	// up to the end if there are fewer
+	GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error)
+	RemoveObject(ctx context.Context, bucketName, filename string) error
+	// RemoveObjects removes the objects in as few requests as it can, and
+	// returns the errors for the ones that couldn't be removed by name
+	RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error
+	ListObjects(ctx context.Context, bucketName, prefix string) ([]minio.ObjectInfo, error)
+	StatObject(ctx context.Context, bucketName, filename string) (minio.ObjectInfo, error)
+	ListIncompleteUploads(ctx context.Context, bucketName, prefix string) ([]minio.ObjectMultipartInfo, error)
+	AbortMultipartUpload(ctx context.Context, bucketName, filename, uploadID string) error
+	// NewMultipartUpload, PutObjectPart and CompleteMultipartUpload store an
+	// object a part at a time, for uploads that come in over more than one
+	// request
+	NewMultipartUpload(ctx context.Context, bucketName, filename string) (string, error)
+	PutObjectPart(ctx context.Context, bucketName, filename, uploadID string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error)
+	CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error)
+	PresignedGetObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error)
+	PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error)
+	// PutObjectTagging replaces the tags on an object, an empty map removes
+	// them
+	PutObjectTagging(ctx context.Context, bucketName, filename string, tags map[string]string) error
+	// ReplaceObjectMetadata replaces the user metadata of an object with the
+	// metadata for the context, like PutObject uses, without changing its
+	// contents or tags
+	ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error
 }
 
 // minioStore wraps the needed minio functions to allow for easier testing
@@ -41,151 +69,841 @@ type minioStore struct {
 }
 
 func (m minioStore) PutObject(ctx context.Context, bucketName, filename string, f io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
-	return m.c.PutObject(ctx, bucketName, filename, f, size, minio.PutObjectOptions{PartSize: uint64(chunkSize)})
+	return m.c.PutObject(ctx, bucketName, filename, f, size, minio.PutObjectOptions{
+		PartSize:     uint64(chunkSize),
+		UserMetadata: objectMetadata(ctx),
+		UserTags:     objectTags(ctx),
+	})
 }
 
 func (m minioStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
 	return m.c.GetObject(ctx, bucketName, filename, minio.GetObjectOptions{})
 }
 
+func (m minioStore) GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	err := opts.SetRange(offset, offset+length-1)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.c.GetObject(ctx, bucketName, filename, opts)
+}
+
+func (m minioStore) RemoveObject(ctx context.Context, bucketName, filename string) error {
+	return m.c.RemoveObject(ctx, bucketName, filename, minio.RemoveObjectOptions{})
+}
+
+func (m minioStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	objects := make(chan minio.ObjectInfo, len(filenames))
+	for _, filename := range filenames {
+		objects <- minio.ObjectInfo{Key: filename}
+	}
+	close(objects)
+
+	errs := map[string]error{}
+	for e := range m.c.RemoveObjects(ctx, bucketName, objects, minio.RemoveObjectsOptions{}) {
+		errs[e.ObjectName] = e.Err
+	}
+
+	return errs
+}
+
+func (m minioStore) ListObjects(ctx context.Context, bucketName, prefix string) ([]minio.ObjectInfo, error) {
+	var objects []minio.ObjectInfo
+	for obj := range m.c.ListObjects(ctx, bucketName, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		objects = append(objects, obj)
+	}
+
+	return objects, nil
+}
+
+func (m minioStore) StatObject(ctx context.Context, bucketName, filename string) (minio.ObjectInfo, error) {
+	return m.c.StatObject(ctx, bucketName, filename, minio.StatObjectOptions{})
+}
+
+// ListIncompleteUploads lists the multipart uploads that were started but never
+// completed, with Size set to the total size of the parts uploaded so far
+func (m minioStore) ListIncompleteUploads(ctx context.Context, bucketName, prefix string) ([]minio.ObjectMultipartInfo, error) {
+	core := minio.Core{Client: m.c}
+
+	var uploads []minio.ObjectMultipartInfo
+	for upload := range m.c.ListIncompleteUploads(ctx, bucketName, prefix, true) {
+		if upload.Err != nil {
+			return nil, upload.Err
+		}
+
+		marker := 0
+		for {
+			parts, err := core.ListObjectParts(ctx, bucketName, upload.Key, upload.UploadID, marker, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, part := range parts.ObjectParts {
+				upload.Size += part.Size
+			}
+			if !parts.IsTruncated {
+				break
+			}
+			marker = parts.NextPartNumberMarker
+		}
+
+		uploads = append(uploads, upload)
+	}
+
+	return uploads, nil
+}
+
+func (m minioStore) AbortMultipartUpload(ctx context.Context, bucketName, filename, uploadID string) error {
+	return minio.Core{Client: m.c}.AbortMultipartUpload(ctx, bucketName, filename, uploadID)
+}
+
+func (m minioStore) NewMultipartUpload(ctx context.Context, bucketName, filename string) (string, error) {
+	return minio.Core{Client: m.c}.NewMultipartUpload(ctx, bucketName, filename, minio.PutObjectOptions{
+		UserMetadata: objectMetadata(ctx),
+		UserTags:     objectTags(ctx),
+	})
+}
+
+func (m minioStore) PutObjectPart(ctx context.Context, bucketName, filename, uploadID string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error) {
+	return minio.Core{Client: m.c}.PutObjectPart(ctx, bucketName, filename, uploadID, partNumber, data, size, minio.PutObjectPartOptions{})
+}
+
+func (m minioStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	return minio.Core{Client: m.c}.CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts, minio.PutObjectOptions{})
+}
+
+func (m minioStore) PresignedGetObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	return m.c.PresignedGetObject(ctx, bucketName, filename, expires, nil)
+}
+
+func (m minioStore) PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	return m.c.PresignedPutObject(ctx, bucketName, filename, expires)
+}
+
+func (m minioStore) PutObjectTagging(ctx context.Context, bucketName, filename string, t map[string]string) error {
+	if len(t) == 0 {
+		return m.c.RemoveObjectTagging(ctx, bucketName, filename, minio.RemoveObjectTaggingOptions{})
+	}
+
+	objectTags, err := tags.NewTags(t, true)
+	if err != nil {
+		return err
+	}
+	return m.c.PutObjectTagging(ctx, bucketName, filename, objectTags, minio.PutObjectTaggingOptions{})
+}
+
+// ReplaceObjectMetadata copies the object onto itself with the new metadata,
+// since minio can't change the metadata of an object in place
+func (m minioStore) ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error {
+	_, err := m.c.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket:          bucketName,
+		Object:          filename,
+		ReplaceMetadata: true,
+		UserMetadata:    objectMetadata(ctx),
+	}, minio.CopySrcOptions{Bucket: bucketName, Object: filename})
+	return err
+}
+
 // server stores the dependencies for the http handlers
 type server struct {
 	minioClient   objStorer
 	bucketName    string
 	encryptionKey string
 	chunkSize     int64
+	receiptKey    []byte
+	postPolicyKey []byte
+	tmpTTL        time.Duration
+	catalog       *catalog
+	pipelines     []pipeline
+	scanner       *clamdScanner
+	converter     *converter
+	ffmpeg        *ffmpeg
+	nameLocks     *nameLocks
+	live          *atomic.Pointer[reloadable]
+	deleteJobs    *deleteJobs
+	tusUploads    *tusUploads
+	uploads       *uploadSessions
+	presigned     *presignedUploads
+	// chaos is only set with -chaos
+	chaos *chaosStore
+	// buckets are the extra buckets served under /b/<bucket>/, along with
+	// the tenant buckets if they're turned on
+	buckets map[string]server
+	tenants *tenantBuckets
+	// placement picks the region uploads are stored in
+	placement *placement
+	geoIP     *geoIP
+
+	maxRequestTimeout time.Duration
+	queues            map[priorityClass]*requestQueue
+	abuse             *abuseTracker
+	slo               *sloTracker
+	drainer           *drainer
+	// fetcher downloads the files for POST /fetch
+	fetcher *http.Client
+	// auth works out who requests are from
+	auth authChain
+	// trustedProxies are where X-Forwarded-For is believed from
+	trustedProxies []netip.Prefix
+	// adminGroup is the group users need to be in for /admin, the admin API
+	// is turned off if it's empty
+	adminGroup string
+	// workerGroup is the group queue workers need to be in, as well as the
+	// admin group
+	workerGroup string
+	// spill is where big files from multipart forms are written while
+	// they're uploaded
+	spill *formSpill
+	// secrets is where the encryption key came from when it's kept in
+	// Vault, it's nil when the key is in the config
+	secrets secretsProvider
+	// processing are the queues stored files are put in for external
+	// workers, they're nil if there aren't any
+	processing processingQueues
+
+	// Videos of at least segmentMinSize get a manifest of segmentSize
+	// segments, if it isn't zero
+	segmentMinSize int64
+	segmentSize    int64
 }
 
+// NewServer returns a server with the default config for everything but the
+// storage settings
 func NewServer(minioClient objStorer, bucketName, encryptionKey string, chunkSize int64) server {
-	return server{
-		minioClient:   minioClient,
-		bucketName:    bucketName,
-		encryptionKey: encryptionKey,
-		chunkSize:     chunkSize,
+	cfg := defaultConfig()
+	cfg.Bucket = bucketName
+	cfg.EncryptionKey = encryptionKey
+	cfg.ChunkSize = chunkSize
+
+	return newServerFromConfig(minioClient, cfg)
+}
+
+// newServerFromConfig returns a server with the given config
+func newServerFromConfig(minioClient objStorer, cfg config) server {
+	live := newLiveSettings(cfg)
+	if canaries := splitList(cfg.Canaries); len(canaries) > 0 {
+		minioClient = newCanaryStore(minioClient, canaries, cfg.CanaryWebhook, live)
+	}
+
+	s := server{
+		minioClient:       minioClient,
+		bucketName:        cfg.Bucket,
+		encryptionKey:     cfg.EncryptionKey,
+		chunkSize:         cfg.ChunkSize,
+		receiptKey:        []byte(cfg.ReceiptKey),
+		postPolicyKey:     []byte(cfg.PostPolicyKey),
+		tmpTTL:            cfg.TmpTTL,
+		catalog:           newCatalog(),
+		pipelines:         mustPipelines(pipelineRules(cfg)),
+		scanner:           newClamdScanner(cfg.ClamdAddress, cfg.ScanCacheTTL, cfg.ScanCacheSize),
+		converter:         newConverter(cfg.ConverterURL),
+		ffmpeg:            newFFmpeg(cfg.FFmpegPath),
+		segmentMinSize:    cfg.SegmentMinSize,
+		segmentSize:       cfg.SegmentSize,
+		nameLocks:         newNameLocks(),
+		live:              live,
+		deleteJobs:        newDeleteJobs(),
+		tusUploads:        newTusUploads(),
+		uploads:           newUploadSessions(),
+		presigned:         newPresignedUploads(),
+		maxRequestTimeout: cfg.MaxRequestTimeout,
+		queues: map[priorityClass]*requestQueue{
+			priorityInteractive: newRequestQueue(cfg.InteractiveConcurrency, cfg.InteractiveQueueLength),
+			priorityBulk:        newRequestQueue(cfg.BulkConcurrency, cfg.BulkQueueLength),
+		},
+		abuse:          newAbuseTracker(),
+		slo:            newSLOTracker(),
+		drainer:        newDrainer(),
+		spill:          newFormSpill(cfg.FormSpillDir, cfg.FormSpillMax),
+		auth:           mustAuthChain(cfg.Auth),
+		trustedProxies: mustTrustedProxies(cfg.TrustedProxies),
+		adminGroup:     cfg.AdminGroup,
+		workerGroup:    cfg.WorkerGroup,
+		fetcher:        newFetchClient(cfg.FetchAllowPrivate),
+		processing:     newProcessingQueues(cfg.Queues),
 	}
+	if cfg.VaultAddr != "" {
+		s.secrets = newVaultProvider(cfg.VaultAddr, cfg.VaultToken, cfg.VaultPath)
+	}
+	s.buckets = s.newBucketServers(minioClient, cfg)
+
+	return s
 }
 
 // handlePostUploadFile accepts a file in the form with key "file", encrypts the
 // contents and stores it in minio
 func (s server) handlePostUploadFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	err := r.ParseMultipartForm(10 << 20)
+	s.uploadFile(w, r, "")
+}
+
+// uploadFile handles a multipart upload, storing the file with prefix added to
+// the start of its name. Any checks given are run after the upload policy.
+// There can be more than one file in the form, each is stored on its own and
+// the response has how each one went.
+func (s server) uploadFile(w http.ResponseWriter, r *http.Request, prefix string, checks ...uploadCheck) {
+	if policy := s.settings().policy; policy.MaxSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, policy.MaxSize+maxFormOverhead)
+	}
+
+	form, err := s.spill.readForm(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr):
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errFormSpillFull):
+			w.WriteHeader(http.StatusInsufficientStorage)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
 		log.Println("parse form:", err)
 		return
 	}
+	defer form.RemoveAll()
 
-	file, handler, err := r.FormFile("file")
-	if err != nil {
+	files := form.File["file"]
+	switch len(files) {
+	case 0:
 		w.WriteHeader(http.StatusBadRequest)
-		log.Println("form file:", err)
+		log.Println("form file:", http.ErrMissingFile)
+		return
+	case 1:
+		stored, err := s.uploadFormFile(r, prefix, files[0], checks)
+		if err != nil {
+			writeUploadError(w, err, files[0].Filename)
+			return
+		}
+
+		// I am mostly just using status codes for responses here because it
+		// is a demo project, a real service would include a response body
+		// with more information such as more detailed errors. The upload
+		// response is the exception since the client needs the receipt.
+		s.writeUploadResponse(w, stored)
 		return
 	}
-	defer file.Close()
 
-	// I chose to use the encryption method detailed in the minio documentation,
-	// since it is designed for data at rest, works well with minio, and is
-	// relativly well used.
-	salt := []byte(path.Join(s.bucketName, handler.Filename))
-	encrypted, err := sio.EncryptReader(file, sio.Config{
-		Key: argon2.IDKey([]byte(s.encryptionKey), salt, 1, 64*1024, 4, 32),
-	})
+	results := make([]uploadResult, 0, len(files))
+	status := http.StatusCreated
+	for _, fh := range files {
+		result := uploadResult{Filename: fh.Filename, Status: http.StatusCreated}
+		stored, err := s.uploadFormFile(r, prefix, fh, checks)
+		if err != nil {
+			result.Status, result.Error = uploadErrorStatus(err)
+			status = http.StatusMultiStatus
+			log.Printf("upload failed: filename: %s, error: %s", fh.Filename, err)
+		} else {
+			resp := s.newUploadResponse(stored)
+			result.File = &resp
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(consistencyHeader, s.consistencyToken())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(results)
+}
+
+// uploadResult is how one of the files in a multi-file upload went
+type uploadResult struct {
+	// Filename is the name the file was uploaded with
+	Filename string `json:"filename"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+	// File is set if the file was stored
+	File *uploadResponse `json:"file,omitempty"`
+}
+
+// uploadFormFile checks and stores one of the files from a multipart form
+// upload. Rejections are stageErrors with the status to respond with, other
+// errors are from storing the file.
+func (s server) uploadFormFile(r *http.Request, prefix string, fh *formFile, checks []uploadCheck) (storedFile, error) {
+	name, err := s.objectName(r, fh.Filename)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("encrypt file:", err)
-		return
+		return storedFile{}, stageError{status: http.StatusBadRequest, reason: "object name: " + err.Error()}
+	}
+
+	if failed := s.checkUpload(r, fh, prefix+name, checks); failed != nil {
+		return storedFile{}, stageError{status: failed.status, reason: failed.Name + ": " + failed.Reason}
 	}
 
-	encryptedSize, err := sio.EncryptedSize(uint64(handler.Size))
+	region, err := s.placement.region(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("encrypted size:", err)
-		return
+		return storedFile{}, stageError{status: http.StatusBadRequest, reason: "placement: " + err.Error()}
 	}
 
-	info, err := s.minioClient.PutObject(r.Context(), s.bucketName, handler.Filename, encrypted, int64(encryptedSize), s.chunkSize)
+	objectTags, err := objectTagsOf(r)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("put object: filename: %s, error: %s", handler.Filename, err)
-		return
+		return storedFile{}, stageError{status: http.StatusBadRequest, reason: "tags: " + err.Error()}
+	}
+
+	if !s.dropping(r, prefix+name) && !s.hasAccess(r, prefix+name, accessWrite) {
+		return storedFile{}, stageError{status: http.StatusForbidden, reason: "access denied"}
+	}
+	if err := s.quotaError(prefix+name, fh.Size); err != nil {
+		return storedFile{}, err
 	}
 
-	log.Println("uploaded file", handler.Filename, "of size", info.Size)
+	file, err := fh.Open()
+	if err != nil {
+		return storedFile{}, fmt.Errorf("open form file: %w", err)
+	}
+	defer file.Close()
+
+	u := &pendingUpload{
+		Name:         prefix + name,
+		OriginalName: fh.Filename,
+		ContentType:  fh.Header.Get("Content-Type"),
+		Source:       requestSource(r),
+		Size:         fh.Size,
+		Region:       region,
+		ObjectTags:   objectTags,
+		Content:      file,
+	}
+	unlock := s.nameLocks.lock(u.Name)
+	defer unlock()
+	err = s.process(r.Context(), u)
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	return u.Stored, nil
+}
+
+// uploadErrorStatus returns the status and the reason to give the client for
+// an upload that failed, the details of storage errors are only logged
+func uploadErrorStatus(err error) (int, string) {
+	var stageErr stageError
+	if errors.As(err, &stageErr) {
+		return stageErr.status, err.Error()
+	}
 
-	// I am just using status codes for responses here because it is a demo
-	// project, a real service would include a response body with more
-	// information such as more detailed errors.
-	w.WriteHeader(http.StatusCreated)
+	status := storageStatus(err)
+	return status, http.StatusText(status)
+}
+
+// writeUploadError responds with the status for an upload that failed
+func writeUploadError(w http.ResponseWriter, err error, filename string) {
+	var stageErr stageError
+	if errors.As(err, &stageErr) {
+		w.WriteHeader(stageErr.status)
+		log.Printf("upload rejected: filename: %s, reason: %s", filename, err)
+		return
+	}
+
+	writeStorageError(w, err, "upload file: filename: "+filename)
 }
 
 // handleGetFile gets the file with name given in the URL, decrypts it and
 // returns it in the response body
 func (s server) handleGetFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	filename := ps.ByName("filename")
-	obj, err := s.minioClient.GetObject(r.Context(), s.bucketName, filename)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("get object:", err)
+	if !s.readConsistent(w, r, filename) || !s.downloadAllowed(w, r, filename) {
 		return
 	}
-	if obj == nil {
-		w.WriteHeader(http.StatusNotFound)
-		log.Println("file not found")
+	e, inCatalog := s.catalog.get(filename)
+	if inCatalog && e.SHA256 != "" {
+		// Clients need this to make a conditional delete
+		w.Header().Set("ETag", etag(e.SHA256))
+	}
+	if inCatalog && !e.Uploaded.IsZero() {
+		w.Header().Set("Last-Modified", e.Uploaded.UTC().Format(http.TimeFormat))
+	}
+	// Caches and browsers revalidate with these, files that aren't in the
+	// catalog are always sent since there's nothing to compare with
+	if inCatalog && notModified(r, e) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	defer obj.Close()
 
-	salt := []byte(path.Join(s.bucketName, filename))
-	_, err = sio.Decrypt(w, obj, sio.Config{
+	if !s.setFileHeaders(w, r, filename, e) {
+		return
+	}
+	if r.URL.Query().Get("redirect") == "true" && s.redirectToStorage(w, r, filename) {
+		return
+	}
+	if r.Header.Get("Range") != "" && s.serveRange(w, r, filename) {
+		s.recordAccess(r, filename)
+		return
+	}
+
+	// Browsers won't let anyone seek in a video without these
+	w.Header().Set("Accept-Ranges", "bytes")
+	if inCatalog && !e.Uploaded.IsZero() {
+		w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	}
+
+	err := s.getFile(r.Context(), w, filename)
+	if err != nil {
+		clearFileHeaders(w.Header())
+		w.Header().Del("Content-Length")
+		writeStorageError(w, err, "get file")
+		return
+	}
+	s.recordAccess(r, filename)
+}
+
+// errNotFound is returned by getFile when the requested object doesn't exist
+var errNotFound = errors.New("not found")
+
+// errStreamInterrupted is returned by getFile when it fails after it has
+// started writing the file
+var errStreamInterrupted = errors.New("stream interrupted")
+
+// decryptBlockSize is the size of the plaintext in each DARE package, reading
+// this much decrypts and authenticates the first package of a file
+const decryptBlockSize = 64 << 10
+
+// sioConfig returns the encryption config for the given file, the key is
+// derived from the server key with the bucket and filename as the salt so each
+// object gets its own key
+func (s server) sioConfig(filename string) sio.Config {
+	salt := []byte(s.encryptionContext(filename))
+	return sio.Config{
 		Key: argon2.IDKey([]byte(s.encryptionKey), salt, 1, 64*1024, 4, 32),
-	})
+	}
+}
+
+// storedFile describes a file that has been encrypted and stored in minio
+type storedFile struct {
+	Name string
+	// OriginalName is the filename the client uploaded the file with, it can
+	// differ from Name depending on the naming strategy
+	OriginalName string
+	ContentType  string
+	// Source is who uploaded the file and from where
+	Source uploadSource
+	Tags   []string
+	// ObjectTags are the key/value tags on the object
+	ObjectTags map[string]string
+	// Size is the size of the plaintext
+	Size int64
+	// SHA256 is the hex encoded checksum of the plaintext
+	SHA256 string
+	// Region is where the file was stored, see regionalStore
+	Region string
+	Info   minio.UploadInfo
+}
+
+// putFile encrypts the contents of f and stores it in minio as filename
+func (s server) putFile(ctx context.Context, filename string, f io.Reader, size int64) (storedFile, error) {
+	// The checksum is of the plaintext, so it can be compared with the file
+	// the client has
+	h := sha256.New()
+
+	// I chose to use the encryption method detailed in the minio documentation,
+	// since it is designed for data at rest, works well with minio, and is
+	// relativly well used.
+	encrypted, err := sio.EncryptReader(io.TeeReader(f, h), s.sioConfig(filename))
 	if err != nil {
-		if err.Error() == "The specified key does not exist." {
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
+		return storedFile{}, fmt.Errorf("encrypt file: %w", err)
+	}
 
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Println("decrypt file:", err)
-		return
+	encryptedSize, err := sio.EncryptedSize(uint64(size))
+	if err != nil {
+		return storedFile{}, fmt.Errorf("encrypted size: %w", err)
+	}
+
+	var info minio.UploadInfo
+	if int64(encryptedSize) <= s.chunkSize {
+		info, err = s.minioClient.PutObject(ctx, s.bucketName, filename, encrypted, int64(encryptedSize), s.chunkSize)
+		if err != nil {
+			return storedFile{}, fmt.Errorf("put object: %w", err)
+		}
+	} else {
+		info, err = s.putMultipart(ctx, filename, encrypted, int64(encryptedSize))
+		if err != nil {
+			return storedFile{}, err
+		}
 	}
+
+	return storedFile{
+		Name:   filename,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+		Info:   info,
+	}, nil
 }
 
-func main() {
-	// Initialize minio client object.
-	minioClient, err := minio.New(minioEndpoint, &minio.Options{
-		Creds: credentials.NewStaticV4(accessKeyID, secretAccessKey, ""),
-	})
+// putMultipart stores the size bytes of r as filename a chunk at a time. It
+// starts the multipart upload itself, rather than leaving it to PutObject, so
+// that if it fails exactly this upload's parts can be thrown away.
+func (s server) putMultipart(ctx context.Context, filename string, r io.Reader, size int64) (minio.UploadInfo, error) {
+	uploadID, err := s.minioClient.NewMultipartUpload(ctx, s.bucketName, filename)
 	if err != nil {
-		log.Fatalln(err)
+		return minio.UploadInfo{}, fmt.Errorf("new multipart upload: %w", err)
 	}
 
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Minute)
-	defer cancelFunc()
+	var parts []minio.CompletePart
+	var stored int64
+	buf := make([]byte, s.chunkSize)
+	for n := 1; stored < size; n++ {
+		chunk := buf[:min(s.chunkSize, size-stored)]
+		_, err = io.ReadFull(r, chunk)
+		if err != nil {
+			s.abortUpload(ctx, filename, uploadID, stored)
+			return minio.UploadInfo{}, fmt.Errorf("read part %d: %w", n, err)
+		}
+
+		part, err := s.minioClient.PutObjectPart(ctx, s.bucketName, filename, uploadID, n, bytes.NewReader(chunk), int64(len(chunk)))
+		if err != nil {
+			s.abortUpload(ctx, filename, uploadID, stored)
+			return minio.UploadInfo{}, fmt.Errorf("put object part %d: %w", n, err)
+		}
 
-	err = minioClient.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{})
+		parts = append(parts, minio.CompletePart{PartNumber: n, ETag: part.ETag})
+		stored += int64(len(chunk))
+	}
+
+	info, err := s.minioClient.CompleteMultipartUpload(ctx, s.bucketName, filename, uploadID, parts)
 	if err != nil {
-		// Check to see if we already own this bucket (which happens if you run this twice)
-		exists, errBucketExists := minioClient.BucketExists(ctx, bucketName)
-		if errBucketExists == nil && exists {
-			log.Printf("We already own %s\n", bucketName)
-		} else {
-			log.Fatalln(err)
+		s.abortUpload(ctx, filename, uploadID, stored)
+		return minio.UploadInfo{}, fmt.Errorf("complete multipart upload: %w", err)
+	}
+	info.Size = size
+
+	return info, nil
+}
+
+// getFile fetches filename from minio and writes the decrypted contents to w.
+// Nothing is written to w until the first block of the file has been fetched
+// and decrypted, so a missing file or a bad key returns an error before any of
+// the response has been sent. If something goes wrong after that the error
+// wraps errStreamInterrupted.
+func (s server) getFile(ctx context.Context, w io.Writer, filename string) error {
+	obj, err := s.minioClient.GetObject(ctx, s.bucketName, filename)
+	if err != nil {
+		return fmt.Errorf("get object: %w", err)
+	}
+	if obj == nil {
+		return errNotFound
+	}
+	defer obj.Close()
+
+	// Objects that weren't encrypted by filesrv are already plaintext by the
+	// time minio hands them over
+	var decrypted io.Reader = obj
+	if s.appEncrypted(filename) {
+		decrypted, err = sio.DecryptReader(obj, s.sioConfig(filename))
+		if err != nil {
+			return fmt.Errorf("decrypt file: %w", err)
 		}
-	} else {
-		log.Printf("Successfully created bucket %s\n", bucketName)
 	}
 
-	s := NewServer(minioStore{c: minioClient}, bucketName, encryptionKey, chunkSize)
+	return streamDecrypted(w, decrypted)
+}
+
+// streamDecrypted writes the plaintext from decrypted to w, reading the first
+// block before writing anything so errors can still get a status
+func streamDecrypted(w io.Writer, decrypted io.Reader) error {
+	// minio doesn't make the request until the object is first read, so this
+	// is where a missing object shows up
+	first := make([]byte, decryptBlockSize)
+	n, err := io.ReadFull(decrypted, first)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		if storageErrorCode(err) == "NoSuchKey" {
+			return errNotFound
+		}
+
+		return fmt.Errorf("decrypt file: %w", err)
+	}
+
+	_, err = w.Write(first[:n])
+	if err != nil {
+		return fmt.Errorf("%w: %w", errStreamInterrupted, err)
+	}
+
+	_, err = io.Copy(w, decrypted)
+	if err != nil {
+		return fmt.Errorf("%w: decrypt file: %w", errStreamInterrupted, err)
+	}
+
+	return nil
+}
+
+// routes sets up the router with all of the handlers
+func (s server) routes() http.Handler {
+	// The bucket prefix comes off first, so the middleware sees the same
+	// paths whichever bucket the request is for
+	buckets := map[string]http.Handler{s.bucketName: s.withMiddleware(s.router())}
+	for name, bs := range s.buckets {
+		buckets[name] = s.withMiddleware(bs.router())
+	}
 
+	var tenant func(w http.ResponseWriter, r *http.Request, name string) (http.Handler, bool)
+	if s.tenants != nil {
+		tenant = s.tenants.handler
+	}
+
+	// Requests are authenticated before anything else, since the tenant
+	// buckets are picked by who the request is from, but after the client
+	// address is known so failures can be logged and counted against it
+	handler := withAuth(withAPIVersion(withBuckets(buckets[s.bucketName], buckets, tenant)), s.auth, s.abuse, s.queues[priorityBulk])
+	return withClientIP(handler, s.trustedProxies)
+}
+
+// withMiddleware wraps a router in the middleware every request goes through
+func (s server) withMiddleware(router http.Handler) http.Handler {
+	// The timeout goes on the outside so that time spent waiting in a queue
+	// counts towards it
+	handler := withPriority(router, s.queues)
+	// Tenants over their tier's limits are turned away before they take up
+	// a place in the queues
+	handler = withTiers(handler, func() *tenantTiers { return s.settings().tiers })
+	handler = s.withSLOTracking(handler)
+	handler = withBandwidthAccounting(handler, s.catalog.usage)
+	handler = withAbuseDetection(handler, s.abuse)
+	handler = withRequestDetails(handler)
+	return withRequestTimeout(handler, s.maxRequestTimeout)
+}
+
+// router returns the API for the server's bucket, without any of the
+// middleware
+func (s server) router() http.Handler {
 	// I used the httprouter package because it allows me to easily expose the
 	// API that I want with minimal code.
-	router := httprouter.New()
+	router := routeRecorder{httprouter.New(), &[]apiRoute{}}
 	router.POST("/upload", s.handlePostUploadFile)
-	router.GET("/file/:filename", s.handleGetFile)
+	router.POST("/upload/validate", s.handlePostValidateUpload)
+	router.POST("/upload/policy", s.handlePostUploadPolicy)
+	router.POST("/upload/form", s.handlePostUploadForm)
+	router.POST("/upload/presigned", s.handlePostPresignedUpload)
+	router.POST("/fetch", s.handlePostFetch)
+	router.POST("/upload/presigned/:id/complete", s.handlePostPresignedUploadComplete)
+	router.POST("/receipt/verify", s.handlePostVerifyReceipt)
+	router.POST("/tmp/upload", s.handlePostUploadTmpFile)
+	router.POST("/drop/:name", s.handlePostDrop)
+	router.POST("/tus", tusHandler(s.handlePostTus))
+	router.HEAD("/tus/:id", tusHandler(s.handleHeadTus))
+	router.PATCH("/tus/:id", tusHandler(s.handlePatchTus))
+	router.DELETE("/tus/:id", tusHandler(s.handleDeleteTus))
+	router.POST("/uploads", s.handlePostUploads)
+	router.GET("/uploads/:id", s.handleGetUploadSession)
+	router.DELETE("/uploads/:id", s.handleDeleteUploadSession)
+	router.PUT("/uploads/:id/parts/:n", s.handlePutUploadPart)
+	router.POST("/uploads/:id/complete", s.handlePostUploadComplete)
+	router.GET("/tmp/file/:filename", s.handleGetTmpFile)
+	router.PUT("/tmp/file/:filename/pin", withTmp(s.requireAccess(accessWrite, s.handlePutPin)))
+	router.DELETE("/tmp/file/:filename/pin", withTmp(s.requireAccess(accessWrite, s.handleDeletePin)))
+	router.GET("/content/:sha256", s.handleGetContent)
+	router.POST("/download/link", s.handlePostDownloadLink)
+	router.GET("/download/:token", s.handleGetDownload)
+	router.GET("/changes", s.handleGetChanges)
+	router.GET("/watch", s.handleGetWatch)
+	router.GET("/sync/list/:folder", s.handleGetSyncList)
+	router.GET("/sync/file/:folder/*path", s.handleGetSyncFile)
+	router.PUT("/sync/file/:folder/*path", s.handlePutSyncFile)
+	router.DELETE("/sync/file/:folder/*path", s.handleDeleteSyncFile)
+	router.GET("/file/:filename", s.requireAccessOrSignature(accessRead, s.handleGetFile))
+	router.HEAD("/file/:filename", s.requireAccessOrSignature(accessRead, s.handleHeadFile))
+	router.PUT("/file/:filename", s.handlePutFile)
+	router.DELETE("/file/:filename", s.requireAccess(accessWrite, s.handleDeleteFile))
+	router.GET("/file/:filename/thumbnail", s.requireAccess(accessRead, s.handleGetThumbnail))
+	router.GET("/file/:filename/preview.pdf", s.requireAccess(accessRead, s.handleGetPreview))
+	router.GET("/file/:filename/poster", s.requireAccess(accessRead, s.handleGetPoster))
+	router.GET("/file/:filename/segments", s.requireAccess(accessRead, s.handleGetSegments))
+	router.GET("/file/:filename/metadata", s.requireAccess(accessRead, s.handleGetFileMetadata))
+	router.GET("/file/:filename/meta", s.requireAccess(accessRead, s.handleGetFileMeta))
+	router.PATCH("/file/:filename/meta", s.requireAccess(accessWrite, s.handlePatchFileMetadata))
+	router.PUT("/file/:filename/pin", s.requireAccess(accessWrite, s.handlePutPin))
+	router.DELETE("/file/:filename/pin", s.requireAccess(accessWrite, s.handleDeletePin))
+	router.POST("/file/:filename/link", s.requireAccess(accessRead, s.handlePostFileLink))
+	router.GET("/file/:filename/annotations", s.requireAccess(accessRead, s.handleGetAnnotations))
+	router.POST("/file/:filename/annotations", s.requireAccess(accessRead, s.handlePostAnnotation))
+	router.PATCH("/file/:filename/annotations/:id", s.requireAccess(accessRead, s.handlePatchAnnotation))
+	router.DELETE("/file/:filename/annotations/:id", s.requireAccess(accessRead, s.handleDeleteAnnotation))
+	router.GET("/file/:filename/tags", s.requireAccess(accessRead, s.handleGetObjectTags))
+	router.PUT("/file/:filename/tags", s.requireAccess(accessWrite, s.handlePutObjectTags))
+	router.PUT("/file/:filename/star", s.requireAccess(accessRead, s.handlePutStar))
+	router.DELETE("/file/:filename/star", s.handleDeleteStar)
+	router.GET("/file/:filename/acl", s.requireAccess(accessRead, s.handleGetACL))
+	router.PUT("/file/:filename/acl", s.handlePutACL)
+	router.GET("/path/*path", withPath(s.requireAccessOrSignature(accessRead, s.handleGetFile)))
+	router.HEAD("/path/*path", withPath(s.requireAccessOrSignature(accessRead, s.handleHeadFile)))
+	router.PUT("/path/*path", s.handlePutPath)
+	router.DELETE("/path/*path", withPath(s.requireAccess(accessWrite, s.handleDeleteFile)))
+	router.GET("/files", s.handleGetFiles)
+	router.GET("/search", s.handleGetSearch)
+	router.POST("/files/delete", s.handlePostBatchDelete)
+	router.POST("/archive", s.handlePostArchive)
+	router.GET("/export", s.handleGetExport)
+	router.POST("/groups", s.handlePostGroup)
+	router.GET("/groups", s.handleGetGroups)
+	router.GET("/groups/:name", s.handleGetGroup)
+	router.PUT("/groups/:name/members/:user", s.handlePutGroupMember)
+	router.DELETE("/groups/:name/members/:user", s.handleDeleteGroupMember)
+	router.GET("/usage/bandwidth", s.handleGetBandwidthUsage)
+	router.GET("/me/starred", s.handleGetStarred)
+	router.GET("/me/recent", s.handleGetRecent)
+	router.GET("/queues", s.handleGetQueues)
+	router.POST("/queues/:name/receive", s.requireWorker(s.handlePostQueueReceive))
+	router.DELETE("/queues/:name/messages/:receipt", s.requireWorker(s.handleDeleteQueueMessage))
+	router.PUT("/queues/:name/messages/:receipt/lease", s.requireWorker(s.handlePutQueueLease))
+	router.POST("/queues/:name/messages/:receipt/failure", s.requireWorker(s.handlePostQueueFailure))
+	router.GET("/queues/:name/dead", s.requireWorker(s.handleGetQueueDeadLetters))
+	router.POST("/queues/:name/dead/redrive", s.requireWorker(s.handlePostQueueRedrive))
+	router.POST("/admin/selftest", s.requireAdmin(s.handlePostSelfTest))
+	router.POST("/admin/prefetch", s.requireAdmin(s.handlePostPrefetch))
+	router.POST("/admin/delete-prefix", s.requireAdmin(s.handlePostDeletePrefix))
+	router.GET("/admin/jobs/:id", s.requireAdmin(s.handleGetJob))
+	router.GET("/admin/keys", s.requireAdmin(s.handleGetKeys))
+	router.GET("/admin/keys/:id/files", s.requireAdmin(s.handleGetKeyFiles))
+	router.GET("/admin/bans", s.requireAdmin(s.handleGetBans))
+	router.POST("/admin/bans", s.requireAdmin(s.handlePostBan))
+	router.DELETE("/admin/bans/:subject", s.requireAdmin(s.handleDeleteBan))
+	router.GET("/admin/slo", s.requireAdmin(s.handleGetSLO))
+	router.GET("/admin/chaos", s.requireAdmin(s.handleGetChaos))
+	router.PUT("/admin/chaos", s.requireAdmin(s.handlePutChaos))
+	router.GET("/version", handleGetVersion)
+	router.GET("/openapi.json", handleGetOpenAPI(router.routes))
+	router.GET("/healthz", handleGetHealthz)
+	router.GET("/readyz", s.handleGetReadyz)
+	router.GET("/debug/vars", handleGetVars)
+
+	// httprouter sets the Allow header for OPTIONS requests on any route, this
+	// adds the capability document to the response
+	router.GlobalOPTIONS = http.HandlerFunc(s.handleOptions)
+
+	return router
+}
 
-	err = http.ListenAndServe(":2001", router)
+// Main runs the filesrv command with the arguments the program was started
+// with
+func Main() {
+	cfg, args, loadErr := loadConfig(os.Args[1:], os.LookupEnv, os.Stderr)
+	if errors.Is(loadErr, flag.ErrHelp) {
+		printCommands(os.Stderr)
+		return
+	}
+
+	cmd, args, err := findCommand(args)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if cmd.report != nil {
+		err = cmd.report(context.Background(), os.Stdout, cfg, loadErr, args)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if loadErr != nil {
+		log.Fatalln(loadErr)
+	}
+
+	info := buildVersionInfo()
+	log.Printf("filesrv %s (commit %s, built %s)", info.Version, info.Commit, info.BuildDate)
+
+	// Every command stops on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = cmd.run(ctx, cfg, args)
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		log.Fatalln(err)
+	}
 }
@@ -1,16 +1,25 @@
-package main
+package filesrv
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/sio"
 	"github.com/stretchr/testify/require"
@@ -20,24 +29,52 @@ import (
 func TestHandlePostUploadFile(t *testing.T) {
 	tests := []struct {
 		name       string
+		filename   string
+		policy     uploadPolicy
 		err        error
 		wantStatus int
 	}{
 		{
 			name:       "should work",
+			filename:   "testFileName.txt",
 			wantStatus: http.StatusCreated,
 		},
 		{
 			name:       "put object error",
+			filename:   "testFileName.txt",
 			err:        errors.New("a put object error"),
 			wantStatus: http.StatusInternalServerError,
 		},
+		{
+			name:       "put object too large",
+			filename:   "testFileName.txt",
+			err:        minio.ErrorResponse{Code: "EntityTooLarge", StatusCode: http.StatusBadRequest},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "reserved filename",
+			filename:   ".filesrv-selftest",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "file too large",
+			filename:   "testFileName.txt",
+			policy:     uploadPolicy{MaxSize: 4},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "content type not allowed",
+			filename:   "testFileName.txt",
+			policy:     uploadPolicy{AllowedTypes: []string{"image/png"}},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			store := mockObjStore{err: test.err}
 			s := NewServer(store, "testBucket", "key", 10<<17)
+			setSettings(s, func(r *reloadable) { r.policy = test.policy })
 
 			pr, pw := io.Pipe()
 			writer := multipart.NewWriter(pw)
@@ -45,7 +82,7 @@ func TestHandlePostUploadFile(t *testing.T) {
 			go func() {
 				defer writer.Close()
 
-				ff, err := writer.CreateFormFile("file", "testFileName.txt")
+				ff, err := writer.CreateFormFile("file", test.filename)
 				require.NoError(t, err)
 
 				_, err = ff.Write([]byte("test file contents"))
@@ -59,6 +96,19 @@ func TestHandlePostUploadFile(t *testing.T) {
 			s.handlePostUploadFile(w, req, nil)
 
 			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var got uploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, test.filename, got.Filename)
+			require.Equal(t, int64(len("test file contents")), got.Size)
+			require.Equal(t, "c4fa968a745586faaa030054f51fb1cafd5e9ae25fa6b137ac6477715fdc81b1", got.SHA256)
+
+			claims, err := verifyReceipt(s.receiptKey, got.Receipt)
+			require.NoError(t, err)
+			require.Equal(t, got.SHA256, claims.SHA256)
 		})
 	}
 }
@@ -83,9 +133,19 @@ func TestHandleGetFile(t *testing.T) {
 		},
 		{
 			name:        "file not found",
-			readerError: errors.New("The specified key does not exist."),
+			readerError: errNoSuchKey,
 			wantStatus:  http.StatusNotFound,
 		},
+		{
+			name:        "access denied",
+			readerError: minio.ErrorResponse{Code: "AccessDenied", StatusCode: http.StatusForbidden},
+			wantStatus:  http.StatusForbidden,
+		},
+		{
+			name:        "slow down",
+			readerError: minio.ErrorResponse{Code: "SlowDown", StatusCode: http.StatusServiceUnavailable},
+			wantStatus:  http.StatusServiceUnavailable,
+		},
 	}
 
 	for _, test := range tests {
@@ -109,6 +169,158 @@ func TestHandleGetFile(t *testing.T) {
 	}
 }
 
+func TestHandleGetFileBadObject(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantPanic bool
+	}{
+		{
+			name: "corrupt first block",
+			size: 100,
+		},
+		{
+			name:      "corrupt after the first block",
+			size:      3 * decryptBlockSize,
+			wantPanic: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			s := NewServer(store, "testBucket", "key", 10<<17)
+
+			_, err := s.putFile(context.Background(), "filename", bytes.NewReader(make([]byte, test.size)), int64(test.size))
+			require.NoError(t, err)
+			store.corrupt = true
+
+			req := httptest.NewRequest(http.MethodGet, "/file/filename", nil)
+			w := httptest.NewRecorder()
+			ps := httprouter.Params{{Key: "filename", Value: "filename"}}
+
+			if test.wantPanic {
+				// the headers have gone, so the connection has to be cut
+				require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+					s.handleGetFile(w, req, ps)
+				})
+				return
+			}
+
+			s.handleGetFile(w, req, ps)
+
+			require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+			require.Empty(t, w.Body.String())
+		})
+	}
+}
+
+func TestUploadMultipleFiles(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		policy      uploadPolicy
+		wantStatus  int
+		wantResults map[string]int
+	}{
+		{
+			name:        "all stored",
+			files:       map[string]string{"a.txt": "test file contents", "b.txt": "more contents"},
+			wantStatus:  http.StatusCreated,
+			wantResults: map[string]int{"a.txt": http.StatusCreated, "b.txt": http.StatusCreated},
+		},
+		{
+			name:        "some rejected",
+			files:       map[string]string{"a.txt": "test file contents", "b.txt": "tiny", ".hidden": "tiny"},
+			policy:      uploadPolicy{MaxSize: 8},
+			wantStatus:  http.StatusMultiStatus,
+			wantResults: map[string]int{"a.txt": http.StatusRequestEntityTooLarge, "b.txt": http.StatusCreated, ".hidden": http.StatusBadRequest},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+			setSettings(s, func(r *reloadable) { r.policy = test.policy })
+
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			for filename, contents := range test.files {
+				ff, err := writer.CreateFormFile("file", filename)
+				require.NoError(t, err)
+				_, err = ff.Write([]byte(contents))
+				require.NoError(t, err)
+			}
+			require.NoError(t, writer.Close())
+
+			req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+			req.Header.Add("Content-Type", writer.FormDataContentType())
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, req)
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+
+			var results []uploadResult
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&results))
+			got := map[string]int{}
+			for _, result := range results {
+				got[result.Filename] = result.Status
+				if result.Status != http.StatusCreated {
+					require.NotEmpty(t, result.Error)
+					require.Nil(t, result.File)
+					continue
+				}
+
+				require.Equal(t, int64(len(test.files[result.Filename])), result.File.Size)
+				var stored strings.Builder
+				require.NoError(t, s.getFile(context.Background(), &stored, result.File.Filename))
+				require.Equal(t, test.files[result.Filename], stored.String())
+			}
+			require.Equal(t, test.wantResults, got)
+		})
+	}
+}
+
+// setSettings swaps in a copy of the server's reloadable settings with the
+// changes made by change, like a reload does, rather than changing the ones
+// that are in use
+func setSettings(s server, change func(r *reloadable)) {
+	next := *s.settings()
+	change(&next)
+	s.live.Store(&next)
+}
+
+// newUploadRequest builds a multipart upload request like the one curl -F
+// sends
+func newUploadRequest(t *testing.T, target, filename, contents string) *http.Request {
+	t.Helper()
+	return newFormUploadRequest(t, target, nil, filename, contents)
+}
+
+// newFormUploadRequest builds a multipart upload request with extra form fields
+// before the file, like a browser form would
+func newFormUploadRequest(t *testing.T, target string, fields map[string]string, filename, contents string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	for k, v := range fields {
+		require.NoError(t, writer.WriteField(k, v))
+	}
+
+	ff, err := writer.CreateFormFile("file", filename)
+	require.NoError(t, err)
+
+	_, err = ff.Write([]byte(contents))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	return req
+}
+
 type mockObjStore struct {
 	objectBody    string
 	encryptionKey string
@@ -116,11 +328,16 @@ type mockObjStore struct {
 	err           error
 }
 
-func (m mockObjStore) PutObject(_ context.Context, _, _ string, _ io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
+func (m mockObjStore) PutObject(_ context.Context, _, _ string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
 	if m.err != nil {
 		return minio.UploadInfo{}, m.err
 	}
 
+	_, err := io.Copy(io.Discard, file)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+
 	return minio.UploadInfo{Size: size}, nil
 }
 
@@ -147,6 +364,390 @@ func (m mockObjStore) GetObject(_ context.Context, bucketName, filename string)
 	return io.NopCloser(encrypted), nil
 }
 
+func (m mockObjStore) GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	obj, err := m.GetObject(ctx, bucketName, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		return io.NopCloser(errorReader{err: err}), nil
+	}
+
+	return io.NopCloser(bytes.NewReader(sliceRange(b, offset, length))), nil
+}
+
+func (m mockObjStore) RemoveObject(_ context.Context, _, _ string) error {
+	return m.err
+}
+
+func (m mockObjStore) RemoveObjects(_ context.Context, _ string, filenames []string) map[string]error {
+	errs := map[string]error{}
+	if m.err != nil {
+		for _, filename := range filenames {
+			errs[filename] = m.err
+		}
+	}
+	return errs
+}
+
+func (m mockObjStore) ListObjects(_ context.Context, _, _ string) ([]minio.ObjectInfo, error) {
+	return nil, m.err
+}
+
+func (m mockObjStore) StatObject(_ context.Context, _, filename string) (minio.ObjectInfo, error) {
+	return minio.ObjectInfo{Key: filename, LastModified: time.Now()}, m.err
+}
+
+func (m mockObjStore) ListIncompleteUploads(_ context.Context, _, _ string) ([]minio.ObjectMultipartInfo, error) {
+	return nil, m.err
+}
+
+func (m mockObjStore) AbortMultipartUpload(_ context.Context, _, _, _ string) error {
+	return m.err
+}
+
+func (m mockObjStore) NewMultipartUpload(_ context.Context, _, _ string) (string, error) {
+	return "upload", m.err
+}
+
+func (m mockObjStore) PutObjectPart(_ context.Context, _, _, _ string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error) {
+	if m.err != nil {
+		return minio.ObjectPart{}, m.err
+	}
+
+	_, err := io.Copy(io.Discard, data)
+	return minio.ObjectPart{PartNumber: partNumber, Size: size}, err
+}
+
+func (m mockObjStore) CompleteMultipartUpload(_ context.Context, _, _, _ string, _ []minio.CompletePart) (minio.UploadInfo, error) {
+	return minio.UploadInfo{}, m.err
+}
+
+func (m mockObjStore) PresignedGetObject(_ context.Context, bucketName, filename string, _ time.Duration) (*url.URL, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+
+	return &url.URL{Scheme: "http", Host: "minio:9000", Path: path.Join("/", bucketName, filename), RawQuery: "X-Amz-Signature=sig"}, nil
+}
+
+func (m mockObjStore) PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	return m.PresignedGetObject(ctx, bucketName, filename, expires)
+}
+
+func (m mockObjStore) PutObjectTagging(_ context.Context, _, _ string, _ map[string]string) error {
+	return m.err
+}
+
+func (m mockObjStore) ReplaceObjectMetadata(_ context.Context, _, _ string) error {
+	return m.err
+}
+
+// memObjStore is an objStorer that keeps objects in memory, for tests that
+// need to read back what they wrote
+type memObjStore struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+	// incomplete holds the unfinished multipart uploads, tests can add these
+	// directly, and parts has the parts uploaded to them by ID
+	incomplete []minio.ObjectMultipartInfo
+	parts      map[string]map[int][]byte
+	// pending has the metadata and tags of the unfinished uploads by ID
+	pending map[string]memObject
+
+	putErr    error
+	removeErr error
+	listErr   error
+	// corrupt flips a bit in every object returned by GetObject
+	corrupt bool
+	// gets counts the calls to GetObject
+	gets int
+	// ranges records the offset and length of every GetObjectRange
+	ranges [][2]int64
+}
+
+type memObject struct {
+	data     []byte
+	modified time.Time
+	metadata map[string]string
+	tags     map[string]string
+}
+
+// errNoSuchKey is what minio returns for objects that don't exist
+var errNoSuchKey = minio.ErrorResponse{
+	Code:       "NoSuchKey",
+	Message:    "The specified key does not exist.",
+	StatusCode: http.StatusNotFound,
+}
+
+func newMemObjStore() *memObjStore {
+	return &memObjStore{objects: map[string]memObject{}, parts: map[string]map[int][]byte{}, pending: map[string]memObject{}}
+}
+
+func (m *memObjStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, _ int64) (minio.UploadInfo, error) {
+	if m.putErr != nil {
+		return minio.UploadInfo{}, m.putErr
+	}
+
+	b, err := io.ReadAll(file)
+	if err != nil {
+		return minio.UploadInfo{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[path.Join(bucketName, filename)] = memObject{data: b, modified: time.Now(), metadata: objectMetadata(ctx), tags: objectTags(ctx)}
+
+	return minio.UploadInfo{Bucket: bucketName, Key: filename, Size: int64(len(b))}, nil
+}
+
+func (m *memObjStore) GetObject(_ context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gets++
+
+	obj, ok := m.objects[path.Join(bucketName, filename)]
+	if !ok {
+		return io.NopCloser(errorReader{err: errNoSuchKey}), nil
+	}
+
+	b := bytes.Clone(obj.data)
+	if m.corrupt && len(b) > 0 {
+		b[len(b)-1] ^= 1
+	}
+
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memObjStore) GetObjectRange(_ context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.ranges = append(m.ranges, [2]int64{offset, length})
+
+	obj, ok := m.objects[path.Join(bucketName, filename)]
+	if !ok {
+		return io.NopCloser(errorReader{err: errNoSuchKey}), nil
+	}
+
+	return io.NopCloser(bytes.NewReader(bytes.Clone(sliceRange(obj.data, offset, length)))), nil
+}
+
+func (m *memObjStore) RemoveObject(_ context.Context, bucketName, filename string) error {
+	if m.removeErr != nil {
+		return m.removeErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, path.Join(bucketName, filename))
+
+	return nil
+}
+
+func (m *memObjStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	errs := map[string]error{}
+	for _, filename := range filenames {
+		if err := m.RemoveObject(ctx, bucketName, filename); err != nil {
+			errs[filename] = err
+		}
+	}
+	return errs
+}
+
+func (m *memObjStore) ListObjects(_ context.Context, bucketName, prefix string) ([]minio.ObjectInfo, error) {
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var objects []minio.ObjectInfo
+	for key, obj := range m.objects {
+		name := strings.TrimPrefix(key, bucketName+"/")
+		if name == key || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		objects = append(objects, minio.ObjectInfo{Key: name, Size: int64(len(obj.data)), LastModified: obj.modified})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	return objects, nil
+}
+
+func (m *memObjStore) StatObject(_ context.Context, bucketName, filename string) (minio.ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[path.Join(bucketName, filename)]
+	if !ok {
+		return minio.ObjectInfo{}, errNoSuchKey
+	}
+
+	return minio.ObjectInfo{Key: filename, Size: int64(len(obj.data)), LastModified: obj.modified, UserMetadata: obj.metadata, UserTags: obj.tags}, nil
+}
+
+func (m *memObjStore) PutObjectTagging(_ context.Context, bucketName, filename string, tags map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := path.Join(bucketName, filename)
+	obj, ok := m.objects[key]
+	if !ok {
+		return errNoSuchKey
+	}
+	obj.tags = maps.Clone(tags)
+	m.objects[key] = obj
+
+	return nil
+}
+
+func (m *memObjStore) ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := path.Join(bucketName, filename)
+	obj, ok := m.objects[key]
+	if !ok {
+		return errNoSuchKey
+	}
+	obj.metadata = objectMetadata(ctx)
+	m.objects[key] = obj
+
+	return nil
+}
+
+func (m *memObjStore) ListIncompleteUploads(_ context.Context, _, prefix string) ([]minio.ObjectMultipartInfo, error) {
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var uploads []minio.ObjectMultipartInfo
+	for _, upload := range m.incomplete {
+		if strings.HasPrefix(upload.Key, prefix) {
+			uploads = append(uploads, upload)
+		}
+	}
+
+	return uploads, nil
+}
+
+func (m *memObjStore) AbortMultipartUpload(_ context.Context, _, filename, uploadID string) error {
+	if m.removeErr != nil {
+		return m.removeErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, upload := range m.incomplete {
+		if upload.Key == filename && upload.UploadID == uploadID {
+			m.incomplete = append(m.incomplete[:i], m.incomplete[i+1:]...)
+			delete(m.parts, uploadID)
+			delete(m.pending, uploadID)
+			return nil
+		}
+	}
+
+	return errNoSuchUpload
+}
+
+// errNoSuchUpload is what minio returns for multipart uploads that don't
+// exist, or have been completed or aborted
+var errNoSuchUpload = minio.ErrorResponse{Code: "NoSuchUpload", StatusCode: http.StatusNotFound}
+
+func (m *memObjStore) NewMultipartUpload(ctx context.Context, _, filename string) (string, error) {
+	if m.putErr != nil {
+		return "", m.putErr
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uploadID := fmt.Sprintf("upload-%d", len(m.parts)+len(m.incomplete)+1)
+	m.incomplete = append(m.incomplete, minio.ObjectMultipartInfo{Key: filename, UploadID: uploadID, Initiated: time.Now()})
+	m.parts[uploadID] = map[int][]byte{}
+	m.pending[uploadID] = memObject{metadata: objectMetadata(ctx), tags: objectTags(ctx)}
+
+	return uploadID, nil
+}
+
+func (m *memObjStore) PutObjectPart(_ context.Context, _, _, uploadID string, partNumber int, data io.Reader, _ int64) (minio.ObjectPart, error) {
+	if m.putErr != nil {
+		return minio.ObjectPart{}, m.putErr
+	}
+
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parts, ok := m.parts[uploadID]
+	if !ok {
+		return minio.ObjectPart{}, errNoSuchUpload
+	}
+	parts[partNumber] = b
+
+	return minio.ObjectPart{PartNumber: partNumber, ETag: fmt.Sprintf("etag-%d", partNumber), Size: int64(len(b))}, nil
+}
+
+func (m *memObjStore) CompleteMultipartUpload(_ context.Context, bucketName, filename, uploadID string, completed []minio.CompletePart) (minio.UploadInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	parts, ok := m.parts[uploadID]
+	if !ok {
+		return minio.UploadInfo{}, errNoSuchUpload
+	}
+
+	var b []byte
+	for _, part := range completed {
+		b = append(b, parts[part.PartNumber]...)
+	}
+	pending := m.pending[uploadID]
+	delete(m.parts, uploadID)
+	delete(m.pending, uploadID)
+	for i, upload := range m.incomplete {
+		if upload.UploadID == uploadID {
+			m.incomplete = append(m.incomplete[:i], m.incomplete[i+1:]...)
+			break
+		}
+	}
+	m.objects[path.Join(bucketName, filename)] = memObject{data: b, modified: time.Now(), metadata: pending.metadata, tags: pending.tags}
+
+	return minio.UploadInfo{Bucket: bucketName, Key: filename, Size: int64(len(b))}, nil
+}
+
+func (m *memObjStore) PresignedGetObject(_ context.Context, bucketName, filename string, _ time.Duration) (*url.URL, error) {
+	return &url.URL{Scheme: "http", Host: "minio:9000", Path: path.Join("/", bucketName, filename), RawQuery: "X-Amz-Signature=sig"}, nil
+}
+
+func (m *memObjStore) PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	return m.PresignedGetObject(ctx, bucketName, filename, expires)
+}
+
+// setModified changes the last modified time of an object, for testing
+// anything that depends on an object's age
+func (m *memObjStore) setModified(bucketName, filename string, modified time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := path.Join(bucketName, filename)
+	obj := m.objects[key]
+	obj.modified = modified
+	m.objects[key] = obj
+}
+
 type errorReader struct {
 	err error
 }
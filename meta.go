@@ -0,0 +1,235 @@
+package filesrv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// mergePatchType is the media type for JSON merge patches, RFC 7396
+const mergePatchType = "application/merge-patch+json"
+
+// metadataPatch is a merge patch of the metadata of a catalog entry. A null
+// field clears it, and a null key in Metadata removes just that key.
+type metadataPatch map[string]json.RawMessage
+
+// apply makes the changes in the patch to e
+func (p metadataPatch) apply(e *catalogEntry) error {
+	for field, value := range p {
+		null := bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+
+		var err error
+		switch field {
+		case "tags":
+			e.Tags = nil
+			if !null {
+				err = json.Unmarshal(value, &e.Tags)
+			}
+		case "contentType":
+			e.ContentType = ""
+			if !null {
+				err = json.Unmarshal(value, &e.ContentType)
+				if err == nil {
+					_, _, err = mime.ParseMediaType(e.ContentType)
+				}
+			}
+		case "disposition":
+			e.Disposition = ""
+			if !null {
+				err = json.Unmarshal(value, &e.Disposition)
+				if err == nil && e.Disposition != dispositionInline && e.Disposition != dispositionAttachment {
+					err = fmt.Errorf("expected %s or %s", dispositionInline, dispositionAttachment)
+				}
+			}
+		case "metadata":
+			if null {
+				e.Metadata = nil
+				break
+			}
+			var changes map[string]*string
+			err = json.Unmarshal(value, &changes)
+			if err == nil {
+				e.Metadata = mergeMetadata(e.Metadata, changes)
+			}
+		default:
+			err = fmt.Errorf("can't be changed")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+
+	return nil
+}
+
+// mergeMetadata returns a copy of metadata with the changes made, a nil value
+// removes the key
+func mergeMetadata(metadata map[string]string, changes map[string]*string) map[string]string {
+	merged := make(map[string]string, len(metadata)+len(changes))
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = *v
+		}
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// editableMetadata is the metadata a patch can change, it's what the patch
+// returns
+type editableMetadata struct {
+	Tags        []string          `json:"tags"`
+	ContentType string            `json:"contentType"`
+	Disposition string            `json:"disposition,omitempty"`
+	Metadata    map[string]string `json:"metadata"`
+}
+
+// handlePatchFileMetadata updates the metadata of a file with a JSON merge
+// patch and returns the result. The metadata lives in the catalog, apart
+// from the content type which is on the object too, so the object's
+// metadata is replaced when it changes. Its contents are never rewritten.
+func (s server) handlePatchFileMetadata(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil || (mediaType != mergePatchType && mediaType != "application/json") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	var patch metadataPatch
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&patch)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode metadata patch:", err)
+		return
+	}
+
+	filename := ps.ByName("filename")
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	contentType := e.ContentType
+	err = patch.apply(&e)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("metadata patch: filename: %s, error: %s", filename, err)
+		return
+	}
+
+	// Only objects filesrv wrote have the content type on them
+	if e.ContentType != contentType && e.appEncrypted() {
+		ctx := withContentType(withRegion(r.Context(), e.Region), e.ContentType)
+		err = s.minioClient.ReplaceObjectMetadata(ctx, s.bucketName, filename)
+		if err != nil {
+			writeStorageError(w, err, "metadata patch: filename: "+filename)
+			return
+		}
+	}
+
+	s.catalog.put(e)
+	err = s.saveCatalog(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("save metadata:", err)
+		return
+	}
+
+	meta := editableMetadata{Tags: e.Tags, ContentType: e.ContentType, Disposition: e.Disposition, Metadata: e.Metadata}
+	if meta.Tags == nil {
+		meta.Tags = []string{}
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(meta)
+	if err != nil {
+		log.Println("encode metadata:", err)
+	}
+}
+
+// fileMeta is what GET /file/:filename/meta says about a file, the fields a
+// metadata patch changes along with the ones the upload recorded
+type fileMeta struct {
+	Name string `json:"name"`
+	// Size is the size of the plaintext, not of the encrypted object
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Uploaded    time.Time `json:"uploaded"`
+	// SHA256 is empty for files that aren't in the catalog
+	SHA256      string            `json:"sha256,omitempty"`
+	Tags        []string          `json:"tags"`
+	Disposition string            `json:"disposition,omitempty"`
+	Metadata    map[string]string `json:"metadata"`
+	Annotations []annotation      `json:"annotations"`
+}
+
+// handleGetFileMeta returns the metadata of a file without fetching or
+// decrypting any of it. Files missing from the catalog only have what minio
+// knows about the object.
+func (s server) handleGetFileMeta(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := ps.ByName("filename")
+	if !s.readConsistent(w, r, filename) {
+		return
+	}
+
+	e, err := s.fileInfo(r.Context(), filename)
+	if err != nil {
+		writeStorageError(w, err, "file meta")
+		return
+	}
+
+	meta := fileMeta{
+		Name:        filename,
+		Size:        e.Size,
+		ContentType: contentTypeOf(filename, e),
+		Uploaded:    e.Uploaded.UTC(),
+		SHA256:      e.SHA256,
+		Tags:        e.Tags,
+		Disposition: e.Disposition,
+		Metadata:    e.Metadata,
+		Annotations: e.Annotations,
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	if meta.Tags == nil {
+		meta.Tags = []string{}
+	}
+	if meta.Metadata == nil {
+		meta.Metadata = map[string]string{}
+	}
+	if meta.Annotations == nil {
+		meta.Annotations = []annotation{}
+	}
+
+	if e.SHA256 != "" {
+		w.Header().Set("ETag", etag(e.SHA256))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(meta)
+	if err != nil {
+		log.Println("encode file meta:", err)
+	}
+}
@@ -0,0 +1,164 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchFileMetadata(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	patch := func(filename, body string) *http.Response {
+		r := httptest.NewRequest(http.MethodPatch, "/file/"+filename+"/meta", strings.NewReader(body))
+		r.Header.Set("Content-Type", mergePatchType)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result()
+	}
+
+	require.Equal(t, http.StatusNotFound, patch("report.pdf", `{"tags": ["a"]}`).StatusCode)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	gets := store.gets
+
+	res := patch("report.pdf", `{
+		"tags": ["finance", "q3"],
+		"contentType": "application/pdf",
+		"metadata": {"owner": "alice", "dept": "accounts"}
+	}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// Only the fields a patch can change are returned
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&fields))
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	require.ElementsMatch(t, []string{"tags", "contentType", "metadata"}, names)
+	require.JSONEq(t, `["finance", "q3"]`, string(fields["tags"]))
+	require.JSONEq(t, `"application/pdf"`, string(fields["contentType"]))
+	require.JSONEq(t, `{"owner": "alice", "dept": "accounts"}`, string(fields["metadata"]))
+
+	// The content type on the object is kept in step, for when the catalog
+	// doesn't have the file
+	info, err := store.StatObject(context.Background(), "testBucket", "report.pdf")
+	require.NoError(t, err)
+	require.Equal(t, "application/pdf", userMetadata(info.UserMetadata, contentTypeMetadata))
+
+	// Keys not in the patch are left alone, null removes them
+	res = patch("report.pdf", `{"tags": null, "metadata": {"dept": null, "reviewed": "yes"}}`)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	e, _ := s.catalog.get("report.pdf")
+	require.Empty(t, e.Tags)
+	require.Equal(t, "application/pdf", e.ContentType)
+	require.Equal(t, map[string]string{"owner": "alice", "reviewed": "yes"}, e.Metadata)
+
+	// The contents of the object are never read or rewritten
+	require.Equal(t, gets, store.gets)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/report.pdf", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "test file contents", w.Body.String())
+}
+
+func TestPatchFileMetadataInvalid(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{name: "unknown field", body: `{"size": 1}`, want: http.StatusBadRequest},
+		{name: "visibility", body: `{"visibility": "public"}`, want: http.StatusBadRequest},
+		{name: "bad disposition", body: `{"disposition": "download"}`, want: http.StatusBadRequest},
+		{name: "bad content type", body: `{"contentType": "not a type"}`, want: http.StatusBadRequest},
+		{name: "bad tags", body: `{"tags": "one"}`, want: http.StatusBadRequest},
+		{name: "not json", body: `tags`, want: http.StatusBadRequest},
+		{name: "wrong media type", contentType: "text/plain", body: `{}`, want: http.StatusUnsupportedMediaType},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/file/report.pdf/meta", strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", tc.contentType)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			require.Equal(t, tc.want, w.Result().StatusCode)
+		})
+	}
+
+	e, _ := s.catalog.get("report.pdf")
+	require.Empty(t, e.Tags)
+}
+
+func TestGetFileMeta(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	get := func(filename string) (*http.Response, fileMeta) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/"+filename+"/meta", nil))
+		var meta fileMeta
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&meta))
+		}
+		return w.Result(), meta
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	r := httptest.NewRequest(http.MethodPatch, "/file/report.txt/meta", strings.NewReader(`{"tags": ["q3"], "metadata": {"owner": "alice"}}`))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	gets := store.gets
+
+	res, meta := get("report.txt")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, etag(testFileSHA256), res.Header.Get("ETag"))
+	require.WithinDuration(t, time.Now(), meta.Uploaded, time.Minute)
+	meta.Uploaded = time.Time{}
+	require.Equal(t, fileMeta{
+		Name:        "report.txt",
+		Size:        18,
+		ContentType: "text/plain; charset=utf-8",
+		SHA256:      testFileSHA256,
+		Tags:        []string{"q3"},
+		Metadata:    map[string]string{"owner": "alice"},
+		Annotations: []annotation{},
+	}, meta)
+	require.Equal(t, gets, store.gets, "the body isn't fetched")
+
+	// Files that aren't in the catalog only have what minio knows
+	_, err := s.putFile(context.Background(), "uncataloged.bin", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+	res, meta = get("uncataloged.bin")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, int64(18), meta.Size, "the decrypted size")
+	require.Equal(t, "application/octet-stream", meta.ContentType)
+	require.Empty(t, meta.SHA256)
+	require.Equal(t, map[string]string{}, meta.Metadata)
+
+	res, _ = get("missing.txt")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
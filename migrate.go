@@ -0,0 +1,208 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/sio"
+)
+
+// migrationStatus is what happened to a single object in a migration
+type migrationStatus string
+
+const (
+	migrationCurrent  migrationStatus = "current"
+	migrationMigrated migrationStatus = "migrated"
+	// migrationPending is used instead of migrated for a dry run
+	migrationPending migrationStatus = "needs migration"
+	migrationSkipped migrationStatus = "skipped"
+	migrationFailed  migrationStatus = "failed"
+)
+
+// errMigrationFailed is returned by runMigrate when some objects couldn't be
+// migrated
+var errMigrationFailed = errors.New("migration failed")
+
+// migrationItem is a line in the migration report
+type migrationItem struct {
+	Name   string
+	Format string
+	Status migrationStatus
+	Reason string
+}
+
+// migrationReport is the outcome of migrating the whole bucket
+type migrationReport struct {
+	Items  []migrationItem
+	Counts map[migrationStatus]int
+}
+
+// migrate scans the bucket for objects that aren't in the format filesrv
+// writes now, either because another tool wrote them or because an older
+// version of sio encrypted them, and rewrites them in the current format.
+// With dryRun nothing is changed, the report says what would be.
+func (s server) migrate(ctx context.Context, dryRun bool) (migrationReport, error) {
+	objects, err := s.minioClient.ListObjects(ctx, s.bucketName, "")
+	if err != nil {
+		return migrationReport{}, fmt.Errorf("list objects: %w", err)
+	}
+
+	report := migrationReport{Counts: map[migrationStatus]int{}}
+	for _, obj := range objects {
+		item := s.migrateItem(ctx, obj, dryRun)
+		report.Counts[item.Status]++
+		if item.Status != migrationCurrent {
+			report.Items = append(report.Items, item)
+		}
+	}
+
+	return report, nil
+}
+
+// migrateItem checks and if needed migrates a single object
+func (s server) migrateItem(ctx context.Context, obj minio.ObjectInfo, dryRun bool) migrationItem {
+	item := migrationItem{Name: obj.Key}
+	if strings.HasPrefix(obj.Key, ".") {
+		// The internal objects are rewritten by the server all the time,
+		// so they'll catch up on their own
+		item.Status = migrationSkipped
+		item.Reason = "internal object"
+		return item
+	}
+	if strings.HasPrefix(obj.Key, presignedPrefix) {
+		// These are encrypted when the presigned upload is finished
+		item.Status = migrationSkipped
+		item.Reason = "presigned upload"
+		return item
+	}
+
+	// Listings don't say whether minio encrypted the object
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, obj.Key)
+	if err != nil {
+		item.Status = migrationFailed
+		item.Reason = err.Error()
+		return item
+	}
+
+	format, err := s.detectFormat(ctx, obj.Key, info)
+	if err != nil {
+		item.Status = migrationFailed
+		item.Reason = err.Error()
+		return item
+	}
+	item.Format = format.String()
+
+	switch {
+	case format.current():
+		item.Status = migrationCurrent
+	case dryRun:
+		item.Status = migrationPending
+	default:
+		err = s.migrateObject(ctx, obj.Key, info.Size, format)
+		item.Status = migrationMigrated
+		if err != nil {
+			item.Status = migrationFailed
+			item.Reason = err.Error()
+		}
+	}
+
+	return item
+}
+
+// migrateObject rewrites an object in the current format and updates the
+// catalog to match
+func (s server) migrateObject(ctx context.Context, name string, size int64, format objectFormat) error {
+	obj, err := s.minioClient.GetObject(ctx, s.bucketName, name)
+	if err != nil {
+		return fmt.Errorf("get object: %w", err)
+	}
+	if obj == nil {
+		return errNotFound
+	}
+	defer obj.Close()
+
+	// minio decrypts objects with server side encryption itself, so only
+	// the ones filesrv encrypted need decrypting
+	var plaintext io.Reader = obj
+	if format.Encryption == encryptionSIO {
+		plaintext, err = sio.DecryptReader(obj, s.sioConfig(name))
+		if err != nil {
+			return fmt.Errorf("decrypt object: %w", err)
+		}
+		decryptedSize, err := sio.DecryptedSize(uint64(size))
+		if err != nil {
+			return fmt.Errorf("decrypted size: %w", err)
+		}
+		size = int64(decryptedSize)
+	}
+
+	stored, err := s.putFile(ctx, name, plaintext, size)
+	if err != nil {
+		return err
+	}
+
+	e, ok := s.catalog.get(name)
+	if !ok {
+		return s.index(ctx, stored)
+	}
+	e.Size = stored.Size
+	e.SHA256 = stored.SHA256
+	e.Encryption = ""
+	s.recordEncryption(&e)
+	tags := e.Tags[:0:0]
+	for _, tag := range e.Tags {
+		if tag != unexpectedFormatTag {
+			tags = append(tags, tag)
+		}
+	}
+	e.Tags = tags
+	s.catalog.put(e)
+
+	return s.saveCatalog(ctx)
+}
+
+// runMigrate is the `filesrv migrate` command, it migrates the bucket and
+// writes the report to out
+func (s server) runMigrate(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("filesrv migrate", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "report what would be migrated without changing anything")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = s.loadCatalog(ctx)
+	if err != nil {
+		return err
+	}
+
+	report, err := s.migrate(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, item := range report.Items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", item.Name, item.Format, item.Status, item.Reason)
+	}
+	fmt.Fprintln(tw)
+	for _, status := range []migrationStatus{migrationCurrent, migrationMigrated, migrationPending, migrationSkipped, migrationFailed} {
+		if n := report.Counts[status]; n > 0 {
+			fmt.Fprintf(tw, "%s\t%d\n", status, n)
+		}
+	}
+	tw.Flush()
+
+	if n := report.Counts[migrationFailed]; n > 0 {
+		return fmt.Errorf("%w: %d objects failed", errMigrationFailed, n)
+	}
+
+	return nil
+}
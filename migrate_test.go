@@ -0,0 +1,101 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/minio/sio"
+	"github.com/stretchr/testify/require"
+)
+
+// newMigrationBucket returns a server with an object in each of the formats
+// migrate knows about
+func newMigrationBucket(t *testing.T) (server, *memObjStore) {
+	t.Helper()
+
+	ctx := context.Background()
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	_, err := s.putFile(ctx, "current", strings.NewReader("current contents"), 16)
+	require.NoError(t, err)
+
+	_, err = store.PutObject(ctx, "testBucket", "plain", strings.NewReader("plain contents"), 14, 0)
+	require.NoError(t, err)
+	s.catalog.put(catalogEntry{Name: "plain", Encryption: encryptionNone, Tags: []string{"keep", unexpectedFormatTag}})
+
+	var legacy bytes.Buffer
+	cfg := s.sioConfig("legacy")
+	cfg.MinVersion, cfg.MaxVersion = sio.Version10, sio.Version10
+	_, err = sio.Encrypt(&legacy, strings.NewReader("legacy contents"), cfg)
+	require.NoError(t, err)
+	_, err = store.PutObject(ctx, "testBucket", "legacy", &legacy, int64(legacy.Len()), 0)
+	require.NoError(t, err)
+
+	require.NoError(t, s.saveCatalog(ctx))
+
+	return s, store
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	s, store := newMigrationBucket(t)
+
+	report, err := s.migrate(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, []migrationItem{
+		{Name: ".filesrv-catalog", Status: migrationSkipped, Reason: "internal object"},
+		{Name: "legacy", Format: "sio 1.0", Status: migrationPending},
+		{Name: "plain", Format: "none", Status: migrationPending},
+	}, report.Items)
+	require.Equal(t, 1, report.Counts[migrationCurrent])
+
+	// A dry run doesn't change anything
+	b, ok := store.objects["testBucket/plain"]
+	require.True(t, ok)
+	require.Equal(t, "plain contents", string(b.data))
+
+	report, err = s.migrate(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, map[migrationStatus]int{migrationCurrent: 1, migrationMigrated: 2, migrationSkipped: 1}, report.Counts)
+
+	for name, want := range map[string]string{"current": "current contents", "plain": "plain contents", "legacy": "legacy contents"} {
+		var got strings.Builder
+		require.NoError(t, s.getFile(ctx, &got, name), name)
+		require.Equal(t, want, got.String(), name)
+	}
+
+	entry, ok := s.catalog.get("plain")
+	require.True(t, ok)
+	require.Empty(t, entry.Encryption)
+	require.Equal(t, []string{"keep"}, entry.Tags)
+	require.Equal(t, int64(14), entry.Size)
+	sum := sha256.Sum256([]byte("plain contents"))
+	require.Equal(t, hex.EncodeToString(sum[:]), entry.SHA256)
+
+	_, ok = s.catalog.get("legacy")
+	require.True(t, ok, "migrated objects the catalog didn't know about should be indexed")
+
+	// Everything is current now
+	report, err = s.migrate(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, map[migrationStatus]int{migrationCurrent: 3, migrationSkipped: 1}, report.Counts)
+}
+
+func TestRunMigrate(t *testing.T) {
+	s, _ := newMigrationBucket(t)
+
+	var out strings.Builder
+	require.NoError(t, s.runMigrate(context.Background(), []string{"-dry-run"}, &out))
+	require.Contains(t, out.String(), "legacy            sio 1.0  needs migration")
+	require.Contains(t, out.String(), "needs migration  2")
+
+	// Nothing was changed
+	report, err := s.migrate(context.Background(), true)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Counts[migrationPending])
+}
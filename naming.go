@@ -0,0 +1,72 @@
+package filesrv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// namingStrategy decides the name a file is stored under
+type namingStrategy string
+
+const (
+	// namingOriginal keeps the name the file was uploaded with
+	namingOriginal namingStrategy = "original"
+	// namingTimestamp prefixes the name with the upload time, so uploads
+	// with the same name don't overwrite each other
+	namingTimestamp namingStrategy = "timestamp"
+	// namingUploader prefixes the name with the uploader's identity, giving
+	// each user their own set of names
+	namingUploader namingStrategy = "uploader"
+	// namingRandom replaces the name with a random ID, the original name is
+	// kept in the catalog
+	namingRandom namingStrategy = "random"
+)
+
+// namingQueryParam lets a request pick the naming strategy for its upload
+const namingQueryParam = "naming"
+
+// name returns the name to store the file as
+func (n namingStrategy) name(original, uploader string, now time.Time) (string, error) {
+	switch n {
+	case namingOriginal, "":
+		return original, nil
+	case namingTimestamp:
+		return now.UTC().Format("20060102T150405Z") + "-" + original, nil
+	case namingUploader:
+		return uploader + "-" + original, nil
+	case namingRandom:
+		id := make([]byte, 16)
+		_, err := rand.Read(id)
+		if err != nil {
+			return "", fmt.Errorf("random id: %w", err)
+		}
+		return hex.EncodeToString(id), nil
+	default:
+		return "", fmt.Errorf("unknown naming strategy %q", n)
+	}
+}
+
+// objectName applies the naming strategy for the request to the uploaded
+// filename, the request can override the server's default with the naming
+// query parameter
+func (s server) objectName(r *http.Request, original string) (string, error) {
+	strategy := s.settings().naming
+	if q := r.URL.Query().Get(namingQueryParam); q != "" {
+		strategy = namingStrategy(q)
+	}
+
+	name, err := strategy.name(original, requestIdentity(r), time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	// The strategies add to the name, so it has to be checked again
+	if c := checkFilename(name); !c.OK {
+		return "", fmt.Errorf("%s naming: %s", strategy, c.Reason)
+	}
+
+	return name, nil
+}
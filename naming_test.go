@@ -0,0 +1,100 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadNaming(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		naming     namingStrategy
+		user       string
+		wantStatus int
+		wantName   *regexp.Regexp
+	}{
+		{
+			name:       "original",
+			target:     "/upload",
+			wantStatus: http.StatusCreated,
+			wantName:   regexp.MustCompile(`^report\.pdf$`),
+		},
+		{
+			name:       "timestamp by default",
+			target:     "/upload",
+			naming:     namingTimestamp,
+			wantStatus: http.StatusCreated,
+			wantName:   regexp.MustCompile(`^\d{8}T\d{6}Z-report\.pdf$`),
+		},
+		{
+			name:       "uploader from query",
+			target:     "/upload?naming=uploader",
+			user:       "alice",
+			wantStatus: http.StatusCreated,
+			wantName:   regexp.MustCompile(`^alice-report\.pdf$`),
+		},
+		{
+			name:       "anonymous uploader",
+			target:     "/upload?naming=uploader",
+			wantStatus: http.StatusCreated,
+			wantName:   regexp.MustCompile(`^anonymous-report\.pdf$`),
+		},
+		{
+			name:       "random",
+			target:     "/upload?naming=random",
+			wantStatus: http.StatusCreated,
+			wantName:   regexp.MustCompile(`^[0-9a-f]{32}$`),
+		},
+		{
+			name:       "uploader with a slash",
+			target:     "/upload?naming=uploader",
+			user:       "team/alice",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown strategy",
+			target:     "/upload?naming=backwards",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+			setSettings(s, func(r *reloadable) { r.naming = test.naming })
+
+			req := newUploadRequest(t, test.target, "report.pdf", "test file contents")
+			if test.user != "" {
+				req.Header.Set(identityHeader, test.user)
+			}
+			w := httptest.NewRecorder()
+
+			s.handlePostUploadFile(w, req, nil)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var got uploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Regexp(t, test.wantName, got.Filename)
+
+			entry, ok := s.catalog.get(got.Filename)
+			require.True(t, ok)
+			if got.Filename == "report.pdf" {
+				require.Empty(t, got.OriginalName)
+				require.Empty(t, entry.OriginalName)
+			} else {
+				require.Equal(t, "report.pdf", got.OriginalName)
+				require.Equal(t, "report.pdf", entry.OriginalName)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// objectTaggingHeader sets the tags of an upload, in the same query string
+// format as S3's X-Amz-Tagging, like project=apollo&team=infra
+const objectTaggingHeader = "X-Filesrv-Tagging"
+
+// validateObjectTags checks the tags against the limits S3 has on object
+// tags, the number of them, their lengths and the characters they can have
+func validateObjectTags(t map[string]string) error {
+	_, err := tags.NewTags(t, true)
+	return err
+}
+
+// objectTagsOf returns the tags to give an upload from objectTaggingHeader,
+// nil if it doesn't have any
+func objectTagsOf(r *http.Request) (map[string]string, error) {
+	header := r.Header.Get(objectTaggingHeader)
+	if header == "" {
+		return nil, nil
+	}
+
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return nil, err
+	}
+	t := make(map[string]string, len(values))
+	for k, v := range values {
+		if len(v) > 1 {
+			return nil, fmt.Errorf("tag %q is given more than once", k)
+		}
+		t[k] = v[0]
+	}
+
+	return t, validateObjectTags(t)
+}
+
+type objectTagsKey struct{}
+
+// withObjectTags returns a context for storing a file with the tags
+func withObjectTags(ctx context.Context, t map[string]string) context.Context {
+	return context.WithValue(ctx, objectTagsKey{}, t)
+}
+
+// objectTags returns the tags for an object filesrv writes from the context,
+// nil if it doesn't have any
+func objectTags(ctx context.Context) map[string]string {
+	t, _ := ctx.Value(objectTagsKey{}).(map[string]string)
+	return t
+}
+
+// tagFilter matches files with a tag, and the value if it has one
+type tagFilter struct {
+	key   string
+	value string
+	// anyValue is set for filters without a value, which only need the file
+	// to have the tag
+	anyValue bool
+}
+
+// parseTagFilters reads filters like project=apollo or just project
+func parseTagFilters(filters []string) []tagFilter {
+	parsed := make([]tagFilter, 0, len(filters))
+	for _, f := range filters {
+		key, value, found := strings.Cut(f, "=")
+		parsed = append(parsed, tagFilter{key: key, value: value, anyValue: !found})
+	}
+	return parsed
+}
+
+// matches says whether the file has the tag
+func (f tagFilter) matches(e catalogEntry) bool {
+	value, ok := e.ObjectTags[f.key]
+	return ok && (f.anyValue || value == f.value)
+}
+
+// handleGetObjectTags returns the tags on a file
+func (s server) handleGetObjectTags(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	e, ok := s.catalog.get(ps.ByName("filename"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	t := e.ObjectTags
+	if t == nil {
+		t = map[string]string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// handlePutObjectTags replaces the tags on a file, on the object in minio as
+// well as in the catalog. An empty object removes them all.
+func (s server) handlePutObjectTags(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var t map[string]string
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&t)
+	if err == nil {
+		err = validateObjectTags(t)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode tags:", err)
+		return
+	}
+
+	filename := ps.ByName("filename")
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = s.minioClient.PutObjectTagging(r.Context(), s.bucketName, filename, t)
+	if err != nil {
+		writeStorageError(w, err, "put tags: filename: "+filename)
+		return
+	}
+
+	e.ObjectTags = nil
+	if len(t) > 0 {
+		e.ObjectTags = maps.Clone(t)
+	}
+	s.catalog.put(e)
+	err = s.saveCatalog(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("save tags:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectTags(t *testing.T) {
+	store := newMemObjStore()
+	handler := NewServer(store, "testBucket", "key", 10<<17).routes()
+
+	do := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	objectTags := func(name string) map[string]string {
+		info, err := store.StatObject(context.Background(), "testBucket", name)
+		require.NoError(t, err)
+		return info.UserTags
+	}
+	list := func(query string) []string {
+		w := do(httptest.NewRequest(http.MethodGet, "/files?"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var entries []catalogEntry
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &entries))
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+
+	// Tags can be given with the upload, as a form or as the body
+	r := newUploadRequest(t, "/upload", "plan.txt", "test file contents")
+	r.Header.Set(objectTaggingHeader, "project=apollo&team=infra")
+	require.Equal(t, http.StatusCreated, do(r).Code)
+	r = httptest.NewRequest(http.MethodPut, "/file/notes.txt", strings.NewReader("test file contents"))
+	r.Header.Set(objectTaggingHeader, "project=gemini")
+	require.Equal(t, http.StatusCreated, do(r).Code)
+	require.Equal(t, map[string]string{"project": "apollo", "team": "infra"}, objectTags("plan.txt"))
+
+	r = newUploadRequest(t, "/upload", "bad.txt", "test file contents")
+	r.Header.Set(objectTaggingHeader, "project=a&project=b")
+	require.Equal(t, http.StatusBadRequest, do(r).Code)
+
+	require.Equal(t, []string{"notes.txt", "plan.txt"}, list("tag=project"))
+	require.Equal(t, []string{"plan.txt"}, list("tag=project=apollo"))
+	require.Equal(t, []string{"plan.txt"}, list("tag=project&tag=team=infra"))
+	require.Empty(t, list("tag=team=platform"))
+
+	// Replacing them changes the object as well as the catalog
+	w := do(httptest.NewRequest(http.MethodPut, "/file/notes.txt/tags", strings.NewReader(`{"project": "apollo", "stage": "draft"}`)))
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Equal(t, map[string]string{"project": "apollo", "stage": "draft"}, objectTags("notes.txt"))
+	w = do(httptest.NewRequest(http.MethodGet, "/file/notes.txt/tags", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"project": "apollo", "stage": "draft"}`, w.Body.String())
+	require.Equal(t, []string{"notes.txt", "plan.txt"}, list("tag=project=apollo"))
+
+	require.Equal(t, http.StatusNoContent, do(httptest.NewRequest(http.MethodPut, "/file/notes.txt/tags", strings.NewReader(`{}`))).Code)
+	require.Empty(t, objectTags("notes.txt"))
+	require.Equal(t, `{}`, strings.TrimSpace(do(httptest.NewRequest(http.MethodGet, "/file/notes.txt/tags", nil)).Body.String()))
+
+	tooMany := map[string]string{}
+	for _, k := range strings.Split("a b c d e f g h i j k", " ") {
+		tooMany[k] = "x"
+	}
+	b, err := json.Marshal(tooMany)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, do(httptest.NewRequest(http.MethodPut, "/file/notes.txt/tags", strings.NewReader(string(b)))).Code)
+	require.Equal(t, http.StatusNotFound, do(httptest.NewRequest(http.MethodPut, "/file/missing.txt/tags", strings.NewReader(`{}`))).Code)
+}
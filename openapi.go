@@ -0,0 +1,156 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiRoute is a method and path pattern the router serves
+type apiRoute struct {
+	Method string
+	Path   string
+}
+
+// openAPIDocument is an OpenAPI 3 description of the API, only the parts
+// that can be worked out from the routes are filled in
+type openAPIDocument struct {
+	OpenAPI string                                 `json:"openapi"`
+	Info    openAPIInfo                            `json:"info"`
+	Servers []openAPIServer                        `json:"servers"`
+	Paths   map[string]map[string]openAPIOperation `json:"paths"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Version     string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Tags        []string                   `json:"tags"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Required    bool          `json:"required"`
+	Description string        `json:"description,omitempty"`
+	Schema      openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Type string `json:"type"`
+}
+
+type openAPIResponse struct {
+	Description string `json:"description"`
+}
+
+// newOpenAPIDocument describes the routes, they're served under /v1 and
+// every bucket has them under /b/<name>/ as well
+func newOpenAPIDocument(routes []apiRoute) openAPIDocument {
+	doc := openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:       "filesrv",
+			Description: fmt.Sprintf("Every path is also served without the /v%d prefix, and for each bucket under /b/{bucket}.", defaultAPIVersion),
+			Version:     buildVersionInfo().Version,
+		},
+		Servers: []openAPIServer{{URL: fmt.Sprintf("/v%d", defaultAPIVersion), Description: "the default bucket"}},
+		Paths:   map[string]map[string]openAPIOperation{},
+	}
+
+	for _, route := range routes {
+		path, params := openAPIPath(route.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]openAPIOperation{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = openAPIOperation{
+			OperationID: operationID(route),
+			Tags:        []string{strings.Split(strings.TrimPrefix(route.Path, "/"), "/")[0]},
+			Parameters:  params,
+			Responses:   map[string]openAPIResponse{"default": {Description: "See the README for the responses"}},
+		}
+	}
+
+	return doc
+}
+
+// openAPIPath turns an httprouter path into an OpenAPI one, with the
+// parameters in it. Catch all parameters can have slashes in them, which
+// OpenAPI has no way of saying other than in the description.
+func openAPIPath(pattern string) (string, []openAPIParameter) {
+	segments := strings.Split(pattern, "/")
+	var params []openAPIParameter
+	for i, segment := range segments {
+		if segment == "" || (segment[0] != ':' && segment[0] != '*') {
+			continue
+		}
+
+		param := openAPIParameter{Name: segment[1:], In: "path", Required: true, Schema: openAPISchema{Type: "string"}}
+		if segment[0] == '*' {
+			param.Description = "The rest of the path, slashes included"
+		}
+		params = append(params, param)
+		segments[i] = "{" + segment[1:] + "}"
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+// operationID names a route after its method and path, like
+// getFileByFilenameAnnotations for GET /file/:filename/annotations
+func operationID(route apiRoute) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(route.Method))
+	for _, segment := range strings.Split(route.Path, "/") {
+		if segment != "" && (segment[0] == ':' || segment[0] == '*') {
+			b.WriteString("By")
+			segment = segment[1:]
+		}
+		// Words are split on anything that can't go in an identifier, like
+		// the dash in delete-prefix
+		for _, word := range strings.FieldsFunc(segment, func(r rune) bool {
+			return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+		}) {
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+
+	return b.String()
+}
+
+// handleGetOpenAPI serves the OpenAPI document for the routes, which are
+// only looked at once the router is serving so the document includes
+// every route
+func handleGetOpenAPI(routes *[]apiRoute) httprouter.Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		sorted := append([]apiRoute(nil), *routes...)
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].Path != sorted[j].Path {
+				return sorted[i].Path < sorted[j].Path
+			}
+			return sorted[i].Method < sorted[j].Method
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(newOpenAPIDocument(sorted))
+		if err != nil {
+			log.Println("encode openapi:", err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetOpenAPI(t *testing.T) {
+	handler := NewServer(newMemObjStore(), "testBucket", "key", 10<<17).routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var doc openAPIDocument
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	require.Equal(t, "3.0.3", doc.OpenAPI)
+	require.Equal(t, "/v1", doc.Servers[0].URL)
+
+	// Every route is in there, including this one
+	require.Contains(t, doc.Paths, "/openapi.json")
+	file := doc.Paths["/file/{filename}"]
+	require.Contains(t, file, "get")
+	require.Contains(t, file, "head")
+	require.Contains(t, file, "delete")
+	require.Equal(t, openAPIOperation{
+		OperationID: "getFileByFilenameAnnotations",
+		Tags:        []string{"file"},
+		Parameters:  []openAPIParameter{{Name: "filename", In: "path", Required: true, Schema: openAPISchema{Type: "string"}}},
+		Responses:   map[string]openAPIResponse{"default": {Description: "See the README for the responses"}},
+	}, doc.Paths["/file/{filename}/annotations"]["get"])
+
+	sync := doc.Paths["/sync/file/{folder}/{path}"]["put"]
+	require.Equal(t, "putSyncFileByFolderByPath", sync.OperationID)
+	require.Len(t, sync.Parameters, 2)
+	require.Equal(t, "The rest of the path, slashes included", sync.Parameters[1].Description)
+	require.Equal(t, "postAdminDeletePrefix", doc.Paths["/admin/delete-prefix"]["post"].OperationID)
+
+	// Operation IDs have to be unique for generated clients
+	ids := map[string]bool{}
+	for _, ops := range doc.Paths {
+		for _, op := range ops {
+			require.False(t, ids[op.OperationID], op.OperationID)
+			ids[op.OperationID] = true
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// capabilities is the machine readable document returned for OPTIONS
+// requests, so clients can find out what this server supports without
+// hardcoding it
+type capabilities struct {
+	Version string `json:"version"`
+	// MaxUploadSize is the largest file that can be uploaded in bytes, zero
+	// means there is no limit
+	MaxUploadSize int64 `json:"maxUploadSize"`
+	// AuthSchemes lists the accepted Authorization schemes, it is empty when
+	// none of the auth providers use the Authorization header
+	AuthSchemes []string `json:"authSchemes"`
+	Features    []string `json:"features"`
+}
+
+// capabilities describes what this server supports
+func (s server) capabilities() capabilities {
+	info := buildVersionInfo()
+	return capabilities{
+		Version:       info.Version,
+		MaxUploadSize: s.settings().policy.MaxSize,
+		AuthSchemes:   s.auth.schemes(),
+		Features:      info.Features,
+	}
+}
+
+// handleOptions writes the capability document, the Allow header has already
+// been set by the router by the time this is called. tus clients get the
+// headers the protocol uses for this too.
+func (s server) handleOptions(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/tus" || strings.HasPrefix(r.URL.Path, "/tus/") {
+		s.setTusOptions(w)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.capabilities())
+	if err != nil {
+		log.Println("encode capabilities:", err)
+	}
+}
@@ -0,0 +1,66 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{
+			name:       "upload",
+			path:       "/upload",
+			wantStatus: http.StatusOK,
+			wantAllow:  "OPTIONS, POST",
+		},
+		{
+			name:       "file",
+			path:       "/file/filename",
+			wantStatus: http.StatusOK,
+			wantAllow:  "DELETE, GET, HEAD, OPTIONS, PUT",
+		},
+		{
+			name:       "server wide",
+			path:       "*",
+			wantStatus: http.StatusOK,
+			wantAllow:  "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT",
+		},
+		{
+			name:       "unknown route",
+			path:       "/nothing",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(mockObjStore{}, "testBucket", "key", 10<<17)
+
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			req.URL.Path = test.path
+			w := httptest.NewRecorder()
+
+			s.routes().ServeHTTP(w, req)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			require.Equal(t, test.wantAllow, w.Result().Header.Get("Allow"))
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got capabilities
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, version, got.Version)
+			require.NotNil(t, got.AuthSchemes)
+		})
+	}
+}
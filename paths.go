@@ -0,0 +1,81 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Files can be put in folders by uploading them with a path, like
+// reports/2024/q1.pdf, through /path/*path. The path is the object name, so
+// listing /files with a prefix and a delimiter shows the folders. /file only
+// takes single segment names, so these files are only served under /path.
+
+// withPath checks the path of a /path/*path route and passes it on as the
+// filename, so the /file handlers and access checks work on it
+func withPath(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		name := strings.TrimPrefix(ps.ByName("path"), "/")
+		if !checkPath(name).OK {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		h(w, r, httprouter.Params{{Key: "filename", Value: name}})
+	}
+}
+
+// handlePutPath uploads the request body into a folder, like handlePutFile.
+// The folders don't have to exist first, they're just part of the name.
+func (s server) handlePutPath(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := strings.TrimPrefix(ps.ByName("path"), "/")
+	s.putBody(w, r, name, checkPath(name))
+}
+
+// fileURLPath returns the path the file is served at, under /path if it's in
+// a folder
+func fileURLPath(name string) string {
+	if !strings.Contains(name, "/") {
+		return "/file/" + url.PathEscape(name)
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return "/path/" + strings.Join(parts, "/")
+}
+
+// folderListing is the response to /files with a delimiter, the files
+// directly under the prefix and the folders in it
+type folderListing struct {
+	Files []catalogEntry `json:"files"`
+	// Folders are the prefixes of the files further down, each ending in the
+	// delimiter
+	Folders []string `json:"folders"`
+}
+
+// splitFolders splits entries under prefix into the ones directly under it
+// and the folders the rest are in
+func splitFolders(entries []catalogEntry, prefix, delimiter string) folderListing {
+	listing := folderListing{Files: []catalogEntry{}, Folders: []string{}}
+	seen := map[string]bool{}
+	for _, e := range entries {
+		rest := strings.TrimPrefix(e.Name, prefix)
+		i := strings.Index(rest, delimiter)
+		if i < 0 {
+			listing.Files = append(listing.Files, e)
+			continue
+		}
+
+		folder := prefix + rest[:i+len(delimiter)]
+		if !seen[folder] {
+			seen[folder] = true
+			listing.Folders = append(listing.Folders, folder)
+		}
+	}
+
+	return listing
+}
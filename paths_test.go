@@ -0,0 +1,82 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaths(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, name := range []string{"reports/2024/q1.txt", "reports/2024/q2.txt", "reports/2023/q4.txt", "reports/summary.txt", "top.txt"} {
+		require.Equal(t, http.StatusCreated, do(http.MethodPut, "/path/"+name, "contents of "+name).Result().StatusCode, name)
+	}
+
+	w := do(http.MethodGet, "/path/reports/2024/q1.txt", "")
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "contents of reports/2024/q1.txt", w.Body.String())
+	require.Equal(t, http.StatusOK, do(http.MethodHead, "/path/reports/summary.txt", "").Result().StatusCode)
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/path/reports/2024/q3.txt", "").Result().StatusCode)
+
+	t.Run("list", func(t *testing.T) {
+		w := do(http.MethodGet, "/files?prefix=reports/&delimiter=/", "")
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		var listing folderListing
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&listing))
+		require.Equal(t, []string{"reports/2023/", "reports/2024/"}, listing.Folders)
+		require.Len(t, listing.Files, 1)
+		require.Equal(t, "reports/summary.txt", listing.Files[0].Name)
+
+		w = do(http.MethodGet, "/files?delimiter=/", "")
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&listing))
+		require.Equal(t, []string{"reports/"}, listing.Folders)
+		require.Len(t, listing.Files, 1)
+		require.Equal(t, "top.txt", listing.Files[0].Name)
+
+		// Without a delimiter it's the usual flat listing
+		w = do(http.MethodGet, "/files?prefix=reports/2024/", "")
+		var entries []catalogEntry
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&entries))
+		require.Len(t, entries, 2)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/path/reports/2023/q4.txt", "").Result().StatusCode)
+		require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/path/reports/2023/q4.txt", "").Result().StatusCode)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		for _, name := range []string{"tmp/a.txt", "sync/folder/a.txt", "presigned/abc", "reports//a.txt", "reports/.hidden", "reports/", "../a.txt"} {
+			require.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/path/"+name, "contents").Result().StatusCode, name)
+		}
+		require.Equal(t, http.StatusBadRequest, do(http.MethodGet, "/path/tmp/a.txt", "").Result().StatusCode)
+	})
+
+	t.Run("signed", func(t *testing.T) {
+		require.Equal(t, "/path/reports/2024/a%20b.txt", fileURLPath("reports/2024/a b.txt"))
+		require.Equal(t, "/file/a%20b.txt", fileURLPath("a b.txt"))
+	})
+}
+
+func TestCheckPath(t *testing.T) {
+	require.True(t, checkPath("a/b/c.txt").OK)
+	require.True(t, checkPath("c.txt").OK)
+	require.True(t, checkPath("tmpfiles/c.txt").OK)
+	require.Equal(t, "path is in the reserved folder tmp/", checkPath("tmp/c.txt").Reason)
+	require.Equal(t, "filename is empty", checkPath("a//c.txt").Reason)
+	require.Equal(t, "path is longer than 1024 bytes", checkPath(strings.Repeat("a/", 513)).Reason)
+}
@@ -0,0 +1,50 @@
+package filesrv
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// handlePutPin pins a file, so it's never deleted by the tmp expiry or a bulk
+// prefix delete. Deleting the file by name still works.
+func (s server) handlePutPin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.setPinned(w, r, ps.ByName("filename"), true)
+}
+
+// handleDeletePin unpins a file
+func (s server) handleDeletePin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.setPinned(w, r, ps.ByName("filename"), false)
+}
+
+// setPinned sets the pin flag in the catalog entry for a file
+func (s server) setPinned(w http.ResponseWriter, r *http.Request, filename string, pinned bool) {
+	unlock := s.nameLocks.lock(filename)
+	defer unlock()
+
+	e, ok := s.catalog.get(filename)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if e.Pinned != pinned {
+		e.Pinned = pinned
+		s.catalog.put(e)
+		err := s.saveCatalog(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			log.Println("save pin:", err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pinned says whether a file is pinned
+func (s server) pinned(filename string) bool {
+	e, ok := s.catalog.get(filename)
+	return ok && e.Pinned
+}
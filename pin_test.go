@@ -0,0 +1,103 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPin(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(method, target string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodPut, "/file/report.pdf/pin"))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, "/file/report.pdf/pin"))
+	require.True(t, s.pinned("report.pdf"))
+
+	// Uploading the file again keeps the pin
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "report.pdf", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.True(t, s.pinned("report.pdf"))
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/file/report.pdf/pin"))
+	require.False(t, s.pinned("report.pdf"))
+}
+
+func TestPinnedTmpFile(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	s.tmpTTL = time.Hour
+	handler := s.routes()
+
+	r := newUploadRequest(t, "/tmp/upload", "scratch.txt", "test file contents")
+	r.Header.Set(identityHeader, "alice")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	// Only someone who can write the file can pin it
+	e, ok := s.catalog.get("tmp/scratch.txt")
+	require.True(t, ok)
+	e.ACL = []grant{{User: "bob", Access: accessRead}}
+	s.catalog.put(e)
+	pin := func(method, user string) int {
+		r := httptest.NewRequest(method, "/tmp/file/scratch.txt/pin", nil)
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	require.Equal(t, http.StatusForbidden, pin(http.MethodPut, "bob"))
+	require.Equal(t, http.StatusForbidden, pin(http.MethodDelete, "bob"))
+	require.Equal(t, http.StatusNoContent, pin(http.MethodPut, "alice"))
+
+	now := time.Now()
+	store.setModified("testBucket", "tmp/scratch.txt", now.Add(-2*time.Hour))
+
+	// Pinned files can still be read once they'd have expired
+	r = httptest.NewRequest(http.MethodGet, "/tmp/file/scratch.txt", nil)
+	r.Header.Set(identityHeader, "bob")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Empty(t, w.Header().Get("Expires"))
+
+	removed, err := s.sweepTmp(context.Background(), now)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+}
+
+func TestPinnedPrefixObjects(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	for _, name := range []string{"logs/a.txt", "logs/b.txt"} {
+		stored, err := s.putFile(context.Background(), name, strings.NewReader("test file contents"), 18)
+		require.NoError(t, err)
+		require.NoError(t, s.index(context.Background(), stored))
+	}
+
+	e, ok := s.catalog.get("logs/b.txt")
+	require.True(t, ok)
+	e.Pinned = true
+	s.catalog.put(e)
+
+	names, _, err := s.prefixObjects(context.Background(), "logs/", time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{"logs/a.txt"}, names)
+}
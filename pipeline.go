@@ -0,0 +1,473 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// asyncStageTimeout bounds how long the async stages for a single upload can
+// run for
+const asyncStageTimeout = 5 * time.Minute
+
+// pendingUpload is an upload making its way through the pipeline
+type pendingUpload struct {
+	// Name is the name the file will be stored under
+	Name string
+	// OriginalName is the filename the client uploaded the file with
+	OriginalName string
+	ContentType  string
+	Source       uploadSource
+	Size         int64
+	// Region is where the file is stored, empty for the main minio
+	Region string
+	// Tags are added by the upload rules
+	Tags []string
+	// ObjectTags are the key/value tags the client gave the upload
+	ObjectTags map[string]string
+
+	// Content is the plaintext of the file. Stages before store can read it
+	// or replace it, but it must be left at the start. It isn't available
+	// after the store stage.
+	Content io.ReadSeeker
+
+	// Stored is set by the store stage
+	Stored storedFile
+}
+
+// stageError is returned by a stage to reject an upload with a specific
+// status, any other error from a stage is a 500
+type stageError struct {
+	status int
+	reason string
+}
+
+func (e stageError) Error() string {
+	return e.reason
+}
+
+// pipelineStage is a single step in processing an upload
+type pipelineStage struct {
+	name string
+	// beforeStore stages work on the contents of the file and run before it
+	// is stored, the rest work on the stored file
+	beforeStore bool
+	// modifies is set for stages that change the contents of the file
+	modifies bool
+	run      func(ctx context.Context, s server, u *pendingUpload) error
+}
+
+// pipelineStages lists every stage that can be used in a pipeline
+var pipelineStages = map[string]pipelineStage{
+	"sniff":      {name: "sniff", beforeStore: true, run: sniffStage},
+	"scan":       {name: "scan", beforeStore: true, run: scanStage},
+	"strip-exif": {name: "strip-exif", beforeStore: true, modifies: true, run: stripEXIFStage},
+	"rules":      {name: "rules", beforeStore: true, run: rulesStage},
+	"store":      {name: "store", run: storeStage},
+	"index":      {name: "index", run: indexStage},
+	"thumbnail":  {name: "thumbnail", run: thumbnailStage},
+	"preview":    {name: "preview", run: previewStage},
+	"poster":     {name: "poster", run: posterStage},
+	"segments":   {name: "segments", run: segmentsStage},
+	"queue":      {name: "queue", run: queueStage},
+}
+
+// pipelineRule is the declarative config for a pipeline
+type pipelineRule struct {
+	// ContentType is the media type the pipeline handles, it can be a full
+	// type like image/png, a wildcard like image/* or * for everything
+	ContentType string `yaml:"content-type"`
+	// Stages are run in order, they must include store and index
+	Stages []string `yaml:"stages"`
+	// Async lists stages that run in the background after the response has
+	// been sent, they have to come after store
+	Async []string `yaml:"async"`
+}
+
+// defaultPipelineRules is the flow every upload went through before pipelines
+// were configurable, plus sniffing the content type and the upload rules
+var defaultPipelineRules = []pipelineRule{
+	{ContentType: "*", Stages: []string{"sniff", "rules", "store", "index"}},
+}
+
+// pipelineRules returns the pipelines in the config if there are any.
+// Otherwise it's defaultPipelineRules, with uploads scanned if clamd is set,
+// stored files put in the processing queues and the previews, poster frames
+// and segment manifests made in the background if they're turned on.
+func pipelineRules(cfg config) []pipelineRule {
+	if len(cfg.Pipelines) > 0 {
+		return cfg.Pipelines
+	}
+
+	var scan []string
+	if cfg.ClamdAddress != "" {
+		scan = append(scan, "scan")
+	}
+	var queue []string
+	if len(cfg.Queues) > 0 {
+		queue = append(queue, "queue")
+	}
+	var async []string
+	if cfg.ConverterURL != "" {
+		async = append(async, "preview")
+	}
+	if cfg.FFmpegPath != "" {
+		async = append(async, "poster")
+	}
+	if cfg.SegmentMinSize > 0 {
+		async = append(async, "segments")
+	}
+	if len(scan) == 0 && len(queue) == 0 && len(async) == 0 {
+		return defaultPipelineRules
+	}
+
+	// Scanning goes after sniffing, so the rules see the sniffed type and
+	// nothing infected is stored
+	rule := defaultPipelineRules[0]
+	stages := slices.Insert(slices.Clone(rule.Stages), 1, scan...)
+	stages = append(stages, queue...)
+	return []pipelineRule{{
+		ContentType: rule.ContentType,
+		Stages:      append(stages, async...),
+		Async:       async,
+	}}
+}
+
+// mustPipelines is newPipelines for rules that are known to be valid
+func mustPipelines(rules []pipelineRule) []pipeline {
+	pipelines, err := newPipelines(rules)
+	if err != nil {
+		panic(err)
+	}
+
+	return pipelines
+}
+
+// validatePipelines checks the pipelines section of the config. A scan stage
+// needs clamd, and a queue stage needs queues to put files in.
+func validatePipelines(rules []pipelineRule, clamd string, queues []queueConfig) error {
+	var errs []error
+	for i, rule := range rules {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(pipelinesSection, i, "pipeline %d (%s): %s", i+1, rule.ContentType, fmt.Sprintf(format, args...)))
+		}
+
+		if !validContentTypePattern(rule.ContentType) {
+			fail("content type %q isn't a type, a type/* wildcard or *", rule.ContentType)
+		}
+		if _, err := newPipeline(rule); err != nil {
+			fail("%s", err)
+		}
+		if contains(rule.Stages, "scan") && clamd == "" {
+			fail("the scan stage needs clamd")
+		}
+		if contains(rule.Stages, "queue") && len(queues) == 0 {
+			fail("the queue stage needs queues")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// pipeline is a pipelineRule that has been checked and resolved
+type pipeline struct {
+	contentType string
+	sync        []pipelineStage
+	async       []pipelineStage
+}
+
+// newPipelines checks the rules and resolves them into pipelines, in the same
+// order so that the first matching rule wins
+func newPipelines(rules []pipelineRule) ([]pipeline, error) {
+	pipelines := make([]pipeline, 0, len(rules))
+	for _, rule := range rules {
+		p, err := newPipeline(rule)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline for %s: %w", rule.ContentType, err)
+		}
+		pipelines = append(pipelines, p)
+	}
+
+	return pipelines, nil
+}
+
+func newPipeline(rule pipelineRule) (pipeline, error) {
+	p := pipeline{contentType: rule.ContentType}
+
+	async := map[string]bool{}
+	for _, name := range rule.Async {
+		async[name] = true
+	}
+
+	stored := false
+	seen := map[string]bool{}
+	for _, name := range rule.Stages {
+		stage, ok := pipelineStages[name]
+		switch {
+		case !ok:
+			return pipeline{}, fmt.Errorf("unknown stage %q", name)
+		case seen[name]:
+			return pipeline{}, fmt.Errorf("stage %q is listed twice", name)
+		case stage.beforeStore && stored:
+			return pipeline{}, fmt.Errorf("stage %q has to come before store", name)
+		case !stage.beforeStore && name != "store" && !stored:
+			return pipeline{}, fmt.Errorf("stage %q has to come after store", name)
+		case async[name] && (stage.beforeStore || name == "store"):
+			return pipeline{}, fmt.Errorf("stage %q can't be async", name)
+		}
+		seen[name] = true
+		stored = stored || name == "store"
+
+		if async[name] {
+			p.async = append(p.async, stage)
+		} else {
+			p.sync = append(p.sync, stage)
+		}
+	}
+
+	if !stored {
+		return pipeline{}, errors.New("there is no store stage")
+	}
+	if !seen["index"] {
+		return pipeline{}, errors.New("there is no index stage")
+	}
+	for name := range async {
+		if !seen[name] {
+			return pipeline{}, fmt.Errorf("async stage %q isn't in the pipeline", name)
+		}
+	}
+
+	return p, nil
+}
+
+// unmodified returns the pipeline without the stages that change the contents
+// of the file
+func (p pipeline) unmodified() pipeline {
+	keep := func(stages []pipelineStage) []pipelineStage {
+		return slices.DeleteFunc(slices.Clone(stages), func(stage pipelineStage) bool {
+			return stage.modifies
+		})
+	}
+
+	return pipeline{contentType: p.contentType, sync: keep(p.sync), async: keep(p.async)}
+}
+
+// matches says whether the pipeline handles the given content type
+func (p pipeline) matches(contentType string) bool {
+	return contentTypeMatches(p.contentType, contentType)
+}
+
+// validContentTypePattern says whether pattern is something contentTypeMatches
+// can match against
+func validContentTypePattern(pattern string) bool {
+	if pattern == "*" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(strings.TrimSuffix(pattern, "*") + "x")
+	return err == nil && strings.Contains(mediaType, "/")
+}
+
+// contentTypeMatches says whether the content type is matched by pattern,
+// which can be a full type like image/png, a wildcard like image/* or * for
+// everything
+func contentTypeMatches(pattern, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = ""
+	}
+
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	default:
+		return strings.EqualFold(mediaType, pattern)
+	}
+}
+
+// pipelineFor returns the first pipeline that handles the content type
+func (s server) pipelineFor(contentType string) (pipeline, bool) {
+	for _, p := range s.pipelines {
+		if p.matches(contentType) {
+			return p, true
+		}
+	}
+
+	return pipeline{}, false
+}
+
+// process runs the pipeline for the upload, which is chosen by the content
+// type the client sent since sniffing is itself a stage, and checked again
+// once it has run. The synchronous stages run before it returns and the async
+// ones are started in the background. Failures in
+// stages after the file has been stored are logged rather than returned,
+// since the file has been accepted by then.
+func (s server) process(ctx context.Context, u *pendingUpload) error {
+	p, err := s.processBeforeStore(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	return s.processFromStore(ctx, p, u)
+}
+
+// processWith runs the whole of the pipeline p for the upload, for callers
+// that have already picked the pipeline
+func (s server) processWith(ctx context.Context, p pipeline, u *pendingUpload) error {
+	err := s.runBeforeStore(ctx, p, u)
+	if err != nil {
+		return err
+	}
+
+	return s.processFromStore(ctx, p, u)
+}
+
+// processBeforeStore runs the stages before store and returns the pipeline
+// for the rest, for uploads that are stored a part at a time outside of the
+// pipeline
+func (s server) processBeforeStore(ctx context.Context, u *pendingUpload) (pipeline, error) {
+	p, ok := s.pipelineFor(u.ContentType)
+	if !ok {
+		return pipeline{}, stageError{status: http.StatusUnsupportedMediaType, reason: "no pipeline for " + u.ContentType}
+	}
+
+	return p, s.runBeforeStore(ctx, p, u)
+}
+
+// runBeforeStore runs the stages of p that come before store. If sniffing
+// changed the content type to one p isn't the pipeline for, the upload is
+// rejected, otherwise a file could skip the stages for its real type by being
+// sent as something else.
+func (s server) runBeforeStore(ctx context.Context, p pipeline, u *pendingUpload) error {
+	declared := u.ContentType
+	for _, stage := range p.sync {
+		if !stage.beforeStore {
+			continue
+		}
+		err := stage.run(ctx, s, u)
+		if err != nil {
+			return fmt.Errorf("%s: %w", stage.name, err)
+		}
+	}
+
+	if u.ContentType != declared {
+		if sniffed, ok := s.pipelineFor(u.ContentType); !ok || sniffed.contentType != p.contentType {
+			return stageError{status: http.StatusUnsupportedMediaType, reason: fmt.Sprintf("content type %s isn't handled by the pipeline for %s", u.ContentType, declared)}
+		}
+	}
+
+	return nil
+}
+
+// processFromStore runs the rest of the pipeline from the store stage on,
+// which is skipped if the upload has already been stored
+func (s server) processFromStore(ctx context.Context, p pipeline, u *pendingUpload) error {
+	for _, stage := range p.sync {
+		if stage.beforeStore || (stage.name == "store" && u.Stored.Name != "") {
+			continue
+		}
+		err := stage.run(ctx, s, u)
+		if err == nil {
+			continue
+		}
+		if stage.name == "store" {
+			return fmt.Errorf("%s: %w", stage.name, err)
+		}
+		log.Printf("pipeline: filename: %s, stage: %s, error: %s", u.Name, stage.name, err)
+	}
+
+	if len(p.async) > 0 {
+		go s.processAsync(*u, p.async)
+	}
+
+	return nil
+}
+
+// processAsync runs the async stages for an upload, it doesn't use the
+// request context since the request will have finished
+func (s server) processAsync(u pendingUpload, stages []pipelineStage) {
+	ctx, cancel := context.WithTimeout(context.Background(), asyncStageTimeout)
+	defer cancel()
+
+	u.Content = nil
+	for _, stage := range stages {
+		err := stage.run(ctx, s, &u)
+		if err != nil {
+			log.Printf("pipeline: filename: %s, stage: %s, error: %s", u.Name, stage.name, err)
+		}
+	}
+}
+
+// sniffStage replaces the content type the client sent with one detected from
+// the contents, unless the detected one is too generic to be useful
+func sniffStage(ctx context.Context, s server, u *pendingUpload) error {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(u.Content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	_, err = u.Content.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	detected := http.DetectContentType(head[:n])
+	switch {
+	case detected == "application/octet-stream":
+		// Nothing more specific could be detected
+	case strings.HasPrefix(detected, "text/plain") && !genericContentType(u.ContentType):
+		// Plain text is the best that can be detected for formats like CSV
+		// and JSON, so a more specific type from the client is better
+	default:
+		u.ContentType = detected
+	}
+
+	return s.checkDropBoxType(ctx, u.ContentType)
+}
+
+// genericContentType says whether a content type doesn't say anything about
+// the file, curl sends application/octet-stream for every file by default
+func genericContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "" || mediaType == "application/octet-stream"
+}
+
+// storeStage encrypts the file and stores it in minio
+func storeStage(ctx context.Context, s server, u *pendingUpload) error {
+	ctx = withObjectTags(withContentType(withRegion(ctx, u.Region), u.ContentType), u.ObjectTags)
+	stored, err := s.putFile(ctx, u.Name, u.Content, u.Size)
+	if err != nil {
+		return err
+	}
+
+	u.setStored(stored)
+	log.Println("uploaded file", stored.Name, "of size", stored.Info.Size)
+	return nil
+}
+
+// setStored records that the upload has been stored, with what's known
+// about it from the pipeline
+func (u *pendingUpload) setStored(stored storedFile) {
+	stored.OriginalName = u.OriginalName
+	stored.ContentType = u.ContentType
+	stored.Source = u.Source
+	stored.Tags = u.Tags
+	stored.ObjectTags = u.ObjectTags
+	stored.Region = u.Region
+	u.Stored = stored
+	u.Content = nil
+}
+
+// indexStage adds the stored file to the catalog
+func indexStage(ctx context.Context, s server, u *pendingUpload) error {
+	return s.index(ctx, u.Stored)
+}
@@ -0,0 +1,280 @@
+package filesrv
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      pipelineRule
+		wantSync  []string
+		wantAsync []string
+		wantErr   string
+	}{
+		{
+			name:     "default",
+			rule:     defaultPipelineRules[0],
+			wantSync: []string{"sniff", "rules", "store", "index"},
+		},
+		{
+			name:      "async thumbnail",
+			rule:      pipelineRule{ContentType: "image/*", Stages: []string{"sniff", "strip-exif", "store", "index", "thumbnail"}, Async: []string{"thumbnail"}},
+			wantSync:  []string{"sniff", "strip-exif", "store", "index"},
+			wantAsync: []string{"thumbnail"},
+		},
+		{
+			name:    "unknown stage",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"compress", "store"}},
+			wantErr: `unknown stage "compress"`,
+		},
+		{
+			name:    "no store",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"sniff"}},
+			wantErr: "there is no store stage",
+		},
+		{
+			name:    "no index",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"sniff", "store"}},
+			wantErr: "there is no index stage",
+		},
+		{
+			name:    "duplicate stage",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"store", "index", "index"}},
+			wantErr: `stage "index" is listed twice`,
+		},
+		{
+			name:    "content stage after store",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"store", "scan"}},
+			wantErr: `stage "scan" has to come before store`,
+		},
+		{
+			name:    "stored stage before store",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"index", "store"}},
+			wantErr: `stage "index" has to come after store`,
+		},
+		{
+			name:    "async store",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"store"}, Async: []string{"store"}},
+			wantErr: `stage "store" can't be async`,
+		},
+		{
+			name:    "async stage not in pipeline",
+			rule:    pipelineRule{ContentType: "*", Stages: []string{"store", "index"}, Async: []string{"thumbnail"}},
+			wantErr: `async stage "thumbnail" isn't in the pipeline`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := newPipeline(test.rule)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantSync, stageNames(p.sync))
+			require.Equal(t, test.wantAsync, stageNames(p.async))
+		})
+	}
+}
+
+func stageNames(stages []pipelineStage) []string {
+	var names []string
+	for _, stage := range stages {
+		names = append(names, stage.name)
+	}
+	return names
+}
+
+func TestLoadConfigFilePipelines(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+scan:
+  clamd: 127.0.0.1:3310
+pipelines:
+  - content-type: image/*
+    stages: [sniff, scan, strip-exif, store, index, thumbnail]
+    async: [thumbnail]
+  - content-type: "*"
+    stages: [sniff, scan, rules, store, index]
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []pipelineRule{
+		{ContentType: "image/*", Stages: []string{"sniff", "scan", "strip-exif", "store", "index", "thumbnail"}, Async: []string{"thumbnail"}},
+		{ContentType: "*", Stages: []string{"sniff", "scan", "rules", "store", "index"}},
+	}, pipelineRules(cfg))
+
+	path = writeConfigFile(t, testConfigFile+`
+pipelines:
+  - content-type: "*"
+    stages: [sniff, store, index]
+  - content-type: images
+    stages: [scan, index, store]
+  - content-type: "*"
+    stages: [store, index, queue]
+    priority: high
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, `unknown field "priority" in pipeline`)
+
+	path = writeConfigFile(t, testConfigFile+`
+pipelines:
+  - content-type: "*"
+    stages: [sniff, store, index]
+  - content-type: images
+    stages: [scan, index, store]
+  - content-type: "*"
+    stages: [store, index, queue]
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, `pipeline 2 (images): content type "images" isn't a type, a type/* wildcard or *`)
+	require.ErrorContains(t, err, `pipeline 2 (images): stage "index" has to come after store`)
+	require.ErrorContains(t, err, "pipeline 2 (images): the scan stage needs clamd")
+	require.ErrorContains(t, err, "pipeline 3 (*): the queue stage needs queues")
+	require.Equal(t, "pipelines[1]", configProblems(err)[0].Path)
+}
+
+func TestPipelineMatches(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		contentType string
+		want        bool
+	}{
+		{pattern: "*", contentType: "", want: true},
+		{pattern: "*", contentType: "text/plain", want: true},
+		{pattern: "image/*", contentType: "image/png", want: true},
+		{pattern: "image/*", contentType: "text/plain", want: false},
+		{pattern: "image/*", contentType: "imagery/png", want: false},
+		{pattern: "image/png", contentType: "image/PNG", want: true},
+		{pattern: "text/plain", contentType: "text/plain; charset=utf-8", want: true},
+		{pattern: "text/plain", contentType: "text/csv", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+" "+test.contentType, func(t *testing.T) {
+			require.Equal(t, test.want, pipeline{contentType: test.pattern}.matches(test.contentType))
+		})
+	}
+}
+
+func TestSniffStage(t *testing.T) {
+	tests := []struct {
+		name     string
+		declared string
+		contents string
+		want     string
+	}{
+		{
+			name:     "generic type replaced",
+			declared: "application/octet-stream",
+			contents: "\x89PNG\r\n\x1a\n",
+			want:     "image/png",
+		},
+		{
+			name:     "spoofed type replaced",
+			declared: "image/png",
+			contents: "<html><body>hello</body></html>",
+			want:     "text/html; charset=utf-8",
+		},
+		{
+			name:     "specific text type kept",
+			declared: "text/csv",
+			contents: "a,b,c\n1,2,3\n",
+			want:     "text/csv",
+		},
+		{
+			name:     "text detected",
+			declared: "application/octet-stream",
+			contents: "test file contents",
+			want:     "text/plain; charset=utf-8",
+		},
+		{
+			name:     "nothing detected",
+			declared: "application/x-custom",
+			contents: "\x00\x01\x02\x03",
+			want:     "application/x-custom",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := &pendingUpload{ContentType: test.declared, Content: strings.NewReader(test.contents)}
+			require.NoError(t, sniffStage(context.Background(), server{}, u))
+			require.Equal(t, test.want, u.ContentType)
+
+			// The contents have to be left at the start for the next stage
+			b, err := io.ReadAll(u.Content)
+			require.NoError(t, err)
+			require.Equal(t, test.contents, string(b))
+		})
+	}
+}
+
+func TestUploadPipeline(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      []pipelineRule
+		wantStatus int
+		wantType   string
+		wantIndex  bool
+	}{
+		{
+			name:       "default",
+			rules:      defaultPipelineRules,
+			wantStatus: http.StatusCreated,
+			wantType:   "text/plain; charset=utf-8",
+			wantIndex:  true,
+		},
+		{
+			name:       "no matching pipeline",
+			rules:      []pipelineRule{{ContentType: "image/*", Stages: []string{"store", "index"}}},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "pipeline checked against sniffed type",
+			rules:      []pipelineRule{{ContentType: "application/octet-stream", Stages: []string{"sniff", "store", "index"}}},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name: "sniffed type has a different pipeline",
+			rules: []pipelineRule{
+				{ContentType: "text/*", Stages: []string{"sniff", "scan", "store", "index"}},
+				{ContentType: "*", Stages: []string{"sniff", "store", "index"}},
+			},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "scan without a scanner",
+			rules:      []pipelineRule{{ContentType: "*", Stages: []string{"scan", "store", "index"}}},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			s := NewServer(store, "testBucket", "key", 10<<17)
+			s.pipelines = mustPipelines(test.rules)
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, newUploadRequest(t, "/upload", "filename", "test file contents"))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+
+			_, stored := store.objects["testBucket/filename"]
+			require.Equal(t, test.wantStatus == http.StatusCreated, stored)
+
+			entry, ok := s.catalog.get("filename")
+			require.Equal(t, test.wantIndex, ok)
+			require.Equal(t, test.wantType, entry.ContentType)
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxFormOverhead is how much bigger than the maximum file size a multipart
+// request body is allowed to be, to leave room for the part headers and any
+// other form fields
+const maxFormOverhead = 1 << 20 // 1MB
+
+// maxFilenameLength matches the limit on most filesystems, so files can be
+// downloaded with the same name they were uploaded with
+const maxFilenameLength = 255
+
+// maxPathLength is the longest object name minio allows
+const maxPathLength = 1024
+
+// reservedPrefixes are the folders the server keeps files outside the usual
+// namespace in, files can't be uploaded into them by path
+var reservedPrefixes = []string{tmpPrefix, syncPrefix, presignedPrefix}
+
+// uploadPolicy holds the rules an upload has to pass before it is stored
+type uploadPolicy struct {
+	// MaxSize is the largest file that can be uploaded in bytes, zero means
+	// there is no limit
+	MaxSize int64
+	// AllowedTypes lists the accepted media types, an empty list accepts
+	// anything
+	AllowedTypes []string
+}
+
+// policyCheck is the result of a single upload policy rule
+type policyCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Reason string `json:"reason,omitempty"`
+
+	// status is what the upload handler responds with when this check fails
+	status int
+}
+
+// check runs every rule in the policy against an upload. There is no auth or
+// quota in this server yet, so those aren't checked.
+func (p uploadPolicy) check(filename string, size int64, contentType string) []policyCheck {
+	return p.checkNamed(checkFilename(filename), size, contentType)
+}
+
+// checkNamed is check for an upload whose name has already been checked, for
+// names that aren't plain filenames
+func (p uploadPolicy) checkNamed(name policyCheck, size int64, contentType string) []policyCheck {
+	return []policyCheck{
+		name,
+		p.checkSize(size),
+		p.checkContentType(contentType),
+	}
+}
+
+// firstFailure returns the first check that failed or nil if the upload is
+// allowed
+func (p uploadPolicy) firstFailure(filename string, size int64, contentType string) *policyCheck {
+	return firstFailed(p.check(filename, size, contentType))
+}
+
+// firstFailed returns the first of the checks that failed or nil if they all
+// passed
+func firstFailed(checks []policyCheck) *policyCheck {
+	for _, c := range checks {
+		if !c.OK {
+			return &c
+		}
+	}
+
+	return nil
+}
+
+// uploadCheck is an extra check on an upload, on top of the upload policy.
+// name is what the file will be stored as. It returns the failed check or nil
+// if the upload is allowed.
+type uploadCheck func(r *http.Request, fh *formFile, name string) *policyCheck
+
+// checkUpload runs the upload policy and then any extra checks against a file
+// from a multipart form, returning the first failure
+func (s server) checkUpload(r *http.Request, fh *formFile, name string, checks []uploadCheck) *policyCheck {
+	failed := s.settings().policy.firstFailure(fh.Filename, fh.Size, fh.Header.Get("Content-Type"))
+	for i := 0; failed == nil && i < len(checks); i++ {
+		failed = checks[i](r, fh, name)
+	}
+
+	return failed
+}
+
+// checkFilename makes sure the name can be used as a single URL path segment
+// and doesn't collide with the objects the server uses internally, which all
+// start with a dot
+func checkFilename(filename string) policyCheck {
+	c := policyCheck{Name: "filename", status: http.StatusBadRequest}
+
+	switch {
+	case filename == "":
+		c.Reason = "filename is empty"
+	case len(filename) > maxFilenameLength:
+		c.Reason = fmt.Sprintf("filename is longer than %d bytes", maxFilenameLength)
+	case strings.HasPrefix(filename, "."):
+		c.Reason = "filename starts with a dot"
+	case strings.ContainsAny(filename, `/\`):
+		c.Reason = "filename contains a path separator"
+	case strings.IndexFunc(filename, unicode.IsControl) >= 0:
+		c.Reason = "filename contains a control character"
+	default:
+		c.OK = true
+	}
+
+	return c
+}
+
+// checkPath makes sure a path of folders ending in a filename, separated by
+// slashes, is a valid filename at every level and isn't in one of the folders
+// the server keeps files outside the usual namespace in
+func checkPath(path string) policyCheck {
+	c := policyCheck{Name: "filename", status: http.StatusBadRequest}
+	if len(path) > maxPathLength {
+		c.Reason = fmt.Sprintf("path is longer than %d bytes", maxPathLength)
+		return c
+	}
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			c.Reason = "path is in the reserved folder " + prefix
+			return c
+		}
+	}
+	for _, part := range strings.Split(path, "/") {
+		if partCheck := checkFilename(part); !partCheck.OK {
+			c.Reason = partCheck.Reason
+			return c
+		}
+	}
+
+	c.OK = true
+	return c
+}
+
+func (p uploadPolicy) checkSize(size int64) policyCheck {
+	c := policyCheck{Name: "size", status: http.StatusRequestEntityTooLarge}
+
+	switch {
+	case size < 0:
+		c.Reason = "size is negative"
+		c.status = http.StatusBadRequest
+	case p.MaxSize > 0 && size > p.MaxSize:
+		c.Reason = fmt.Sprintf("size is larger than the maximum of %d bytes", p.MaxSize)
+	default:
+		c.OK = true
+	}
+
+	return c
+}
+
+func (p uploadPolicy) checkContentType(contentType string) policyCheck {
+	c := policyCheck{Name: "contentType", status: http.StatusUnsupportedMediaType}
+	if len(p.AllowedTypes) == 0 {
+		c.OK = true
+		return c
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		c.Reason = fmt.Sprintf("invalid content type %q", contentType)
+		return c
+	}
+
+	for _, allowed := range p.AllowedTypes {
+		if strings.EqualFold(mediaType, allowed) {
+			c.OK = true
+			return c
+		}
+	}
+
+	c.Reason = fmt.Sprintf("content type %s is not allowed", mediaType)
+	return c
+}
+
+// validateUploadRequest is the body of POST /upload/validate, describing the
+// file the client wants to upload
+type validateUploadRequest struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+// validateUploadResponse says whether the described upload would be accepted
+// and the status code the upload would get
+type validateUploadResponse struct {
+	Allowed bool          `json:"allowed"`
+	Status  int           `json:"status"`
+	Checks  []policyCheck `json:"checks"`
+}
+
+// handlePostValidateUpload runs the upload policy against the metadata in the
+// request body without the file itself, so clients can find out if a large
+// upload will be rejected before sending it. The response status is the one
+// the real upload would get.
+func (s server) handlePostValidateUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req validateUploadRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode validate request:", err)
+		return
+	}
+
+	resp := validateUploadResponse{
+		Allowed: true,
+		Status:  http.StatusCreated,
+		Checks:  s.settings().policy.check(req.Filename, req.Size, req.ContentType),
+	}
+	for _, c := range resp.Checks {
+		if !c.OK {
+			resp.Allowed = false
+			resp.Status = c.status
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Allowed {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(resp.Status)
+	}
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("encode validate response:", err)
+	}
+}
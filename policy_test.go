@@ -0,0 +1,79 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePostValidateUpload(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		policy      uploadPolicy
+		wantStatus  int
+		wantAllowed bool
+		wantFailed  string
+	}{
+		{
+			name:        "should work",
+			body:        `{"filename": "report.pdf", "size": 1024, "contentType": "application/pdf"}`,
+			policy:      uploadPolicy{MaxSize: 2048, AllowedTypes: []string{"application/pdf"}},
+			wantStatus:  http.StatusOK,
+			wantAllowed: true,
+		},
+		{
+			name:       "invalid body",
+			body:       `{"filename":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "filename with a path separator",
+			body:       `{"filename": "a/b.txt", "size": 1}`,
+			wantStatus: http.StatusBadRequest,
+			wantFailed: "filename",
+		},
+		{
+			name:       "too large",
+			body:       `{"filename": "big.iso", "size": 4096}`,
+			policy:     uploadPolicy{MaxSize: 2048},
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantFailed: "size",
+		},
+		{
+			name:       "content type not allowed",
+			body:       `{"filename": "page.html", "size": 10, "contentType": "text/html; charset=utf-8"}`,
+			policy:     uploadPolicy{AllowedTypes: []string{"application/pdf"}},
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantFailed: "contentType",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(mockObjStore{}, "testBucket", "key", 10<<17)
+			setSettings(s, func(r *reloadable) { r.policy = test.policy })
+
+			req := httptest.NewRequest(http.MethodPost, "/upload/validate", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+
+			s.handlePostValidateUpload(w, req, nil)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus == http.StatusBadRequest && test.wantFailed == "" {
+				return
+			}
+
+			var got validateUploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, test.wantAllowed, got.Allowed)
+			for _, c := range got.Checks {
+				require.Equal(t, c.Name != test.wantFailed, c.OK, c.Name)
+			}
+		})
+	}
+}
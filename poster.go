@@ -0,0 +1,121 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// posterPrefix is where video poster frames are stored in the bucket
+	posterPrefix = ".posters/"
+	// posterWidth is the widest a poster frame is, smaller videos keep their
+	// size
+	posterWidth = 640
+	// posterOffset is how far into the video the poster frame is taken from,
+	// the very first frame is often black
+	posterOffset = "1"
+)
+
+// ffmpeg takes poster frames from videos by running the ffmpeg binary
+type ffmpeg struct {
+	path string
+}
+
+// newFFmpeg returns an ffmpeg that runs the binary at path, or nil if there's
+// no path
+func newFFmpeg(path string) *ffmpeg {
+	if path == "" {
+		return nil
+	}
+
+	return &ffmpeg{path: path}
+}
+
+// poster returns a JPEG of a frame of the video in the file at path. Videos
+// shorter than posterOffset get their first frame.
+func (f *ffmpeg) poster(ctx context.Context, path string) ([]byte, error) {
+	for _, offset := range []string{posterOffset, "0"} {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, f.path,
+			"-hide_banner", "-loglevel", "error",
+			"-ss", offset, "-i", path,
+			"-frames:v", "1", "-vf", fmt.Sprintf("scale='min(%d,iw)':-2", posterWidth),
+			"-f", "image2", "-c:v", "mjpeg", "pipe:1",
+		)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return nil, fmt.Errorf("ffmpeg: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		if stdout.Len() > 0 {
+			return stdout.Bytes(), nil
+		}
+	}
+
+	return nil, errors.New("ffmpeg: no frames in the video")
+}
+
+// posterStage stores a JPEG frame of uploaded videos, which is served at
+// /file/:filename/poster. Other files are skipped.
+func posterStage(ctx context.Context, s server, u *pendingUpload) error {
+	mediaType, _, _ := mime.ParseMediaType(u.Stored.ContentType)
+	if !strings.HasPrefix(mediaType, "video/") {
+		return nil
+	}
+	if s.ffmpeg == nil {
+		return errors.New("ffmpeg isn't configured")
+	}
+
+	// ffmpeg needs to seek around most containers, so the video can't be
+	// piped in
+	f, err := os.CreateTemp("", "filesrv-poster-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = s.getFile(ctx, f, u.Stored.Name)
+	if err != nil {
+		return fmt.Errorf("get video: %w", err)
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	poster, err := s.ffmpeg.poster(ctx, f.Name())
+	if err != nil {
+		return err
+	}
+
+	_, err = s.putFile(ctx, posterPrefix+u.Stored.Name, bytes.NewReader(poster), int64(len(poster)))
+	if err != nil {
+		return fmt.Errorf("store poster: %w", err)
+	}
+
+	return nil
+}
+
+// handleGetPoster returns the poster frame for an uploaded video
+func (s server) handleGetPoster(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "image/jpeg")
+
+	err := s.getFile(r.Context(), w, posterPrefix+ps.ByName("filename"))
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeStorageError(w, err, "get poster")
+		return
+	}
+}
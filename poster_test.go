@@ -0,0 +1,115 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMP4 is enough of an MP4 for it to be sniffed as a video
+const testMP4 = "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"
+
+// fakeFFmpeg writes a script that stands in for ffmpeg. It outputs a poster
+// for videos, unless they contain "short" and it's asked for a frame after
+// the start, and fails for ones containing "broken".
+func fakeFFmpeg(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	script := `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-ss) offset="$2"; shift ;;
+	-i) input="$2"; shift ;;
+	esac
+	shift
+done
+if grep -q broken "$input"; then
+	echo "invalid data found when processing input" >&2
+	exit 1
+fi
+if grep -q short "$input" && [ "$offset" != 0 ]; then
+	exit 0
+fi
+printf 'poster at %s' "$offset"
+`
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o700))
+	return path
+}
+
+func TestHandleGetPoster(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	s.ffmpeg = newFFmpeg(fakeFFmpeg(t))
+	s.pipelines = mustPipelines([]pipelineRule{
+		{ContentType: "*", Stages: []string{"sniff", "store", "index", "poster"}},
+	})
+	router := s.routes()
+
+	for filename, contents := range map[string]string{
+		"long.mp4":   testMP4 + "long",
+		"short.mp4":  testMP4 + "short",
+		"broken.mp4": testMP4 + "broken",
+		"notes.txt":  "test file contents",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequest(t, "/upload", filename, contents))
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode, filename)
+	}
+
+	tests := []struct {
+		filename   string
+		wantStatus int
+		wantBody   string
+	}{
+		{filename: "long.mp4", wantStatus: http.StatusOK, wantBody: "poster at 1"},
+		{filename: "short.mp4", wantStatus: http.StatusOK, wantBody: "poster at 0"},
+		{filename: "broken.mp4", wantStatus: http.StatusNotFound},
+		{filename: "notes.txt", wantStatus: http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.filename, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/"+test.filename+"/poster", nil))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus == http.StatusOK {
+				require.Equal(t, "image/jpeg", w.Result().Header.Get("Content-Type"))
+				require.Equal(t, test.wantBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestFFmpegError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	require.NoError(t, os.WriteFile(path, []byte("broken"), 0o600))
+
+	_, err := newFFmpeg(fakeFFmpeg(t)).poster(context.Background(), path)
+	require.EqualError(t, err, "ffmpeg: exit status 1: invalid data found when processing input")
+}
+
+func TestPipelineRules(t *testing.T) {
+	cfg := defaultConfig()
+	require.Equal(t, defaultPipelineRules, pipelineRules(cfg))
+
+	cfg.ConverterURL = "http://gotenberg:3000/forms/libreoffice/convert"
+	cfg.FFmpegPath = "ffmpeg"
+	require.Equal(t, []pipelineRule{{
+		ContentType: "*",
+		Stages:      []string{"sniff", "rules", "store", "index", "preview", "poster"},
+		Async:       []string{"preview", "poster"},
+	}}, pipelineRules(cfg))
+	_, err := newPipelines(pipelineRules(cfg))
+	require.NoError(t, err)
+
+	cfg.ClamdAddress = "127.0.0.1:3310"
+	require.Equal(t, []string{"sniff", "scan", "rules", "store", "index", "preview", "poster"}, pipelineRules(cfg)[0].Stages)
+
+	// Configured pipelines are used as they are
+	cfg.Pipelines = []pipelineRule{{ContentType: "*", Stages: []string{"store", "index"}}}
+	require.Equal(t, cfg.Pipelines, pipelineRules(cfg))
+}
@@ -0,0 +1,185 @@
+package filesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultPostPolicyTTL is how long a post policy is valid for when the
+	// request doesn't say
+	defaultPostPolicyTTL = time.Hour
+	// maxPostPolicyTTL stops policies being issued that are valid forever
+	maxPostPolicyTTL = 24 * time.Hour
+)
+
+// postPolicy restricts what can be uploaded with a signed browser form, the
+// same idea as an S3 POST policy
+type postPolicy struct {
+	// Prefix is what the uploaded filename has to start with
+	Prefix string `json:"prefix"`
+	// MaxSize is the largest file that can be uploaded in bytes, zero means
+	// only the server limit applies
+	MaxSize int64 `json:"maxSize,omitempty"`
+	// ContentTypes lists the accepted media types, empty accepts anything the
+	// server does
+	ContentTypes []string  `json:"contentTypes,omitempty"`
+	Expires      time.Time `json:"expires"`
+	// Issuer is who asked for the policy, files uploaded with it are theirs
+	Issuer string `json:"issuer"`
+}
+
+// postPolicyRequest is the body of POST /upload/policy
+type postPolicyRequest struct {
+	Prefix       string   `json:"prefix"`
+	MaxSize      int64    `json:"maxSize"`
+	ContentTypes []string `json:"contentTypes"`
+	// ExpiresIn is how many seconds the policy is valid for
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// postPolicyResponse tells the browser where to send the form and which
+// fields to include alongside the file
+type postPolicyResponse struct {
+	URL     string            `json:"url"`
+	Fields  map[string]string `json:"fields"`
+	Expires time.Time         `json:"expires"`
+}
+
+var errInvalidPostPolicy = errors.New("invalid post policy")
+
+// encode returns the policy and signature form fields for the policy
+func (p postPolicy) encode(key []byte) (policy, signature string, err error) {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", "", err
+	}
+
+	policy = base64.RawURLEncoding.EncodeToString(b)
+	return policy, base64.RawURLEncoding.EncodeToString(postPolicyMAC(key, policy)), nil
+}
+
+// decodePostPolicy checks the signature on the policy form field and returns
+// the policy
+func decodePostPolicy(key []byte, policy, signature string) (postPolicy, error) {
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, postPolicyMAC(key, policy)) {
+		return postPolicy{}, errInvalidPostPolicy
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(policy)
+	if err != nil {
+		return postPolicy{}, errInvalidPostPolicy
+	}
+
+	var p postPolicy
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return postPolicy{}, errInvalidPostPolicy
+	}
+
+	return p, nil
+}
+
+func postPolicyMAC(key []byte, policy string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(policy))
+	return mac.Sum(nil)
+}
+
+// handlePostUploadPolicy issues a signed policy that lets a browser upload a
+// file matching it through POST /upload/form. Only users with an identity can
+// ask for one, and the upload is made as them.
+func (s server) handlePostUploadPolicy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	issuer := requestIdentity(r)
+	if issuer == anonymous {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("post policy denied: no identity")
+		return
+	}
+
+	var req postPolicyRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode post policy request:", err)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultPostPolicyTTL
+	}
+	if ttl < 0 || ttl > maxPostPolicyTTL || req.MaxSize < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	p := postPolicy{
+		Prefix:       req.Prefix,
+		MaxSize:      req.MaxSize,
+		ContentTypes: req.ContentTypes,
+		Expires:      time.Now().Add(ttl).UTC().Truncate(time.Second),
+		Issuer:       issuer,
+	}
+	policy, signature, err := p.encode(s.postPolicyKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("encode post policy:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(postPolicyResponse{
+		URL:     "/upload/form",
+		Fields:  map[string]string{"policy": policy, "signature": signature},
+		Expires: p.Expires,
+	})
+	if err != nil {
+		log.Println("encode post policy response:", err)
+	}
+}
+
+// handlePostUploadForm accepts an upload from a browser form that includes a
+// signed policy in the "policy" and "signature" fields
+func (s server) handlePostUploadForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.uploadFile(w, r, "", s.checkPostPolicy)
+}
+
+// checkPostPolicy is an uploadCheck that enforces the signed policy sent with
+// the form. The rest of the upload is made as the policy's issuer, whatever
+// identity the browser has.
+func (s server) checkPostPolicy(r *http.Request, fh *formFile, name string) *policyCheck {
+	failed := &policyCheck{Name: "postPolicy", status: http.StatusForbidden}
+
+	p, err := decodePostPolicy(s.postPolicyKey, r.FormValue("policy"), r.FormValue("signature"))
+	switch {
+	case err != nil:
+		failed.Reason = err.Error()
+		return failed
+	case p.Issuer == "" || p.Issuer == anonymous:
+		failed.Reason = "post policy has no issuer"
+		return failed
+	case time.Now().After(p.Expires):
+		failed.Reason = "post policy has expired"
+		return failed
+	case !strings.HasPrefix(name, p.Prefix):
+		failed.Reason = "filename doesn't start with " + p.Prefix
+		return failed
+	}
+
+	r.Header.Set(identityHeader, p.Issuer)
+	r.Header.Del(groupsHeader)
+
+	restrictions := uploadPolicy{MaxSize: p.MaxSize, AllowedTypes: p.ContentTypes}
+	return restrictions.firstFailure(fh.Filename, fh.Size, fh.Header.Get("Content-Type"))
+}
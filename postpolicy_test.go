@@ -0,0 +1,216 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePostUploadPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		anonymous  bool
+		wantStatus int
+	}{
+		{
+			name:       "should work",
+			body:       `{"prefix": "avatar-", "maxSize": 1024, "contentTypes": ["image/png"], "expiresIn": 600}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "default expiry",
+			body:       `{"prefix": "avatar-"}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "expiry too long",
+			body:       `{"prefix": "avatar-", "expiresIn": 604800}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid body",
+			body:       `{"prefix":`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "anonymous",
+			body:       `{"prefix": "avatar-"}`,
+			anonymous:  true,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(mockObjStore{}, "testBucket", "key", 10<<17)
+
+			req := httptest.NewRequest(http.MethodPost, "/upload/policy", strings.NewReader(test.body))
+			if !test.anonymous {
+				req.Header.Set(identityHeader, "alice")
+			}
+			w := httptest.NewRecorder()
+
+			s.handlePostUploadPolicy(w, req, nil)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got postPolicyResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, "/upload/form", got.URL)
+			require.True(t, got.Expires.After(time.Now()))
+
+			p, err := decodePostPolicy(s.postPolicyKey, got.Fields["policy"], got.Fields["signature"])
+			require.NoError(t, err)
+			require.Equal(t, "avatar-", p.Prefix)
+			require.Equal(t, "alice", p.Issuer)
+		})
+	}
+}
+
+func TestHandlePostUploadForm(t *testing.T) {
+	valid := postPolicy{
+		Prefix:       "avatar-",
+		MaxSize:      1024,
+		ContentTypes: []string{"application/octet-stream"},
+		Expires:      time.Now().Add(time.Hour),
+		Issuer:       "alice",
+	}
+
+	tests := []struct {
+		name       string
+		policy     postPolicy
+		key        string
+		naming     namingStrategy
+		filename   string
+		contents   string
+		wantStatus int
+	}{
+		{
+			name:       "should work",
+			policy:     valid,
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "wrong prefix",
+			policy:     valid,
+			filename:   "other.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "stored under another name",
+			policy:     valid,
+			naming:     namingRandom,
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "no issuer",
+			policy: postPolicy{
+				Prefix:  "avatar-",
+				Expires: time.Now().Add(time.Hour),
+			},
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "signed with another key",
+			policy:     valid,
+			key:        "another key",
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "expired",
+			policy: postPolicy{
+				Prefix:  "avatar-",
+				Expires: time.Now().Add(-time.Minute),
+				Issuer:  "alice",
+			},
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "too large",
+			policy: postPolicy{
+				Prefix:  "avatar-",
+				MaxSize: 4,
+				Expires: time.Now().Add(time.Hour),
+				Issuer:  "alice",
+			},
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "content type not allowed",
+			policy: postPolicy{
+				Prefix:       "avatar-",
+				ContentTypes: []string{"image/png"},
+				Expires:      time.Now().Add(time.Hour),
+				Issuer:       "alice",
+			},
+			filename:   "avatar-1.png",
+			contents:   "test file contents",
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+			key := s.postPolicyKey
+			if test.key != "" {
+				key = []byte(test.key)
+			}
+			policy, signature, err := test.policy.encode(key)
+			require.NoError(t, err)
+
+			fields := map[string]string{"policy": policy, "signature": signature}
+			target := "/upload/form"
+			if test.naming != "" {
+				target += "?naming=" + string(test.naming)
+			}
+			req := newFormUploadRequest(t, target, fields, test.filename, test.contents)
+			req.Header.Set(identityHeader, "mallory")
+			w := httptest.NewRecorder()
+
+			s.handlePostUploadForm(w, req, nil)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusCreated {
+				return
+			}
+
+			// The file belongs to whoever the policy was issued to
+			e, ok := s.catalog.get(test.filename)
+			require.True(t, ok)
+			require.Equal(t, "alice", e.owner())
+		})
+	}
+}
+
+func TestHandlePostUploadFormWithoutPolicy(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	w := httptest.NewRecorder()
+	s.handlePostUploadForm(w, newUploadRequest(t, "/upload/form", "avatar-1.png", "test file contents"), nil)
+
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+}
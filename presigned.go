@@ -0,0 +1,391 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// presignedPrefix is where files uploaded with a presigned URL wait until
+	// they're run through the pipeline and stored under their name. Uploaded
+	// filenames can't contain a slash, so these can never clash with normal
+	// uploads.
+	presignedPrefix = "presigned/"
+	// defaultPresignedUploadTTL is how long a presigned upload URL works for
+	// when the request doesn't say
+	defaultPresignedUploadTTL = time.Hour
+	// maxPresignedUploadTTL is the longest minio will sign a URL for
+	maxPresignedUploadTTL = 7 * 24 * time.Hour
+	// presignedSweepInterval is how often files uploaded with a presigned URL
+	// are looked for, in case the client never says it has finished
+	presignedSweepInterval = time.Minute
+)
+
+// presignedUpload is a file that's being uploaded straight to minio with a
+// presigned URL, so it never passes through filesrv on the way in. The file
+// lands unencrypted in presignedPrefix, then once the client says it has
+// finished, or the sweeper finds it, it goes through the pipeline like any
+// other upload and the plaintext is removed.
+type presignedUpload struct {
+	id      string
+	owner   string
+	expires time.Time
+
+	// mu is held while the file is being finished, so the client and the
+	// sweeper can't both do it
+	mu sync.Mutex
+	u  *pendingUpload
+	// done is set once the file is stored, the upload is kept until it
+	// expires so the client can still be told how it went
+	done bool
+}
+
+func (p *presignedUpload) finished() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.done
+}
+
+// staged is where the file is uploaded to
+func (p *presignedUpload) staged() string {
+	return presignedPrefix + p.id
+}
+
+// presignedUploads are the presigned uploads that haven't expired, they're
+// only kept in memory
+type presignedUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*presignedUpload
+}
+
+func newPresignedUploads() *presignedUploads {
+	return &presignedUploads{uploads: map[string]*presignedUpload{}}
+}
+
+func (p *presignedUploads) add(upload *presignedUpload) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.uploads[upload.id] = upload
+}
+
+// get returns the upload with the id, uploads belonging to someone else are
+// treated as not existing
+func (p *presignedUploads) get(id, owner string) (*presignedUpload, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upload, ok := p.uploads[id]
+	if !ok || upload.owner != owner {
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// all returns every upload
+func (p *presignedUploads) all() []*presignedUpload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	uploads := make([]*presignedUpload, 0, len(p.uploads))
+	for _, upload := range p.uploads {
+		uploads = append(uploads, upload)
+	}
+
+	return uploads
+}
+
+func (p *presignedUploads) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.uploads, id)
+}
+
+// presignedUploadRequest is the body of POST /upload/presigned
+type presignedUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	// ExpiresIn is how many seconds the URL works for
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// presignedUploadResponse tells the client where to PUT the file
+type presignedUploadResponse struct {
+	ID string `json:"id"`
+	// Name is the name the file will be stored under
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// errNotUploaded is returned when a presigned upload is finished before the
+// file has been uploaded
+var errNotUploaded = stageError{status: http.StatusConflict, reason: "the file hasn't been uploaded yet"}
+
+// handlePostPresignedUpload issues a presigned URL to PUT a file straight to
+// minio, for files too big to be worth sending through filesrv. The checks
+// are the same as for a multipart upload, but minio can't hold the client to
+// the size so it's checked again once the file is there.
+func (s server) handlePostPresignedUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req presignedUploadRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err == nil && (req.Filename == "" || req.Size < 0) {
+		err = errors.New("filename or size is missing")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode presigned upload request:", err)
+		return
+	}
+
+	ttl := time.Duration(req.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultPresignedUploadTTL
+	}
+	if ttl < 0 || ttl > maxPresignedUploadTTL {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if failed := s.settings().policy.firstFailure(req.Filename, req.Size, req.ContentType); failed != nil {
+		w.WriteHeader(failed.status)
+		log.Printf("upload rejected: filename: %s, check: %s, reason: %s", req.Filename, failed.Name, failed.Reason)
+		return
+	}
+
+	name, err := s.objectName(r, req.Filename)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("object name:", err)
+		return
+	}
+
+	region, err := s.placement.region(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("placement:", err)
+		return
+	}
+
+	if !s.checkAccess(w, r, name, accessWrite) || !s.checkQuota(w, name, req.Size) {
+		return
+	}
+
+	if _, ok := s.pipelineFor(req.ContentType); !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		log.Printf("upload rejected: filename: %s, reason: no pipeline for %s", req.Filename, req.ContentType)
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("random id:", err)
+		return
+	}
+
+	upload := &presignedUpload{
+		id:      hex.EncodeToString(id),
+		owner:   requestIdentity(r),
+		expires: time.Now().Add(ttl),
+		u: &pendingUpload{
+			Name:         name,
+			OriginalName: req.Filename,
+			ContentType:  req.ContentType,
+			Source:       requestSource(r),
+			Size:         req.Size,
+			Region:       region,
+		},
+	}
+
+	u, err := s.minioClient.PresignedPutObject(r.Context(), s.bucketName, upload.staged(), ttl)
+	if err != nil {
+		writeStorageError(w, err, "presign upload: filename: "+name)
+		return
+	}
+	s.presigned.add(upload)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(presignedUploadResponse{
+		ID:      upload.id,
+		Name:    name,
+		URL:     u.String(),
+		Expires: upload.expires,
+	})
+	if err != nil {
+		log.Println("encode presigned upload:", err)
+	}
+}
+
+// handlePostPresignedUploadComplete is called by the client once it has
+// uploaded the file, so it gets the receipt straight away rather than waiting
+// for the sweeper
+func (s server) handlePostPresignedUploadComplete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload, ok := s.presigned.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	stored, err := s.finishPresigned(r.Context(), upload)
+	if err != nil {
+		writeUploadError(w, err, upload.u.Name)
+		return
+	}
+
+	s.writeUploadResponse(w, stored)
+}
+
+// finishPresigned runs the file uploaded for a presigned upload through the
+// pipeline, which encrypts it and stores it under its name, and removes the
+// plaintext. A file that's rejected is removed as well.
+func (s server) finishPresigned(ctx context.Context, upload *presignedUpload) (storedFile, error) {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if upload.done {
+		return upload.u.Stored, nil
+	}
+
+	info, err := s.minioClient.StatObject(ctx, s.bucketName, upload.staged())
+	if storageErrorCode(err) == "NoSuchKey" {
+		return storedFile{}, errNotUploaded
+	}
+	if err != nil {
+		return storedFile{}, fmt.Errorf("stat uploaded file: %w", err)
+	}
+
+	err = s.processPresigned(ctx, upload, info.Size)
+	var stageErr stageError
+	if err != nil && !errors.As(err, &stageErr) {
+		// It's worth trying again
+		return storedFile{}, err
+	}
+
+	rmErr := s.minioClient.RemoveObject(ctx, s.bucketName, upload.staged())
+	if rmErr != nil {
+		log.Printf("remove presigned upload: filename: %s, error: %s", upload.u.Name, rmErr)
+	}
+	if err != nil {
+		s.presigned.remove(upload.id)
+		return storedFile{}, err
+	}
+
+	upload.done = true
+	return upload.u.Stored, nil
+}
+
+// processPresigned reads the uploaded file back and runs it through the
+// pipeline
+func (s server) processPresigned(ctx context.Context, upload *presignedUpload, size int64) error {
+	if size != upload.u.Size {
+		return stageError{status: http.StatusBadRequest, reason: fmt.Sprintf("%d bytes were uploaded but the size was %d", size, upload.u.Size)}
+	}
+
+	obj, err := s.minioClient.GetObject(ctx, s.bucketName, upload.staged())
+	if err != nil {
+		return fmt.Errorf("get uploaded file: %w", err)
+	}
+	if obj == nil {
+		return errNotUploaded
+	}
+	defer obj.Close()
+
+	var content io.ReadSeeker = newRewindReader(obj, ruleSampleSize)
+	if p, ok := s.pipelineFor(upload.u.ContentType); ok && !p.streamable() {
+		f, err := s.spill.spool(obj)
+		if err != nil {
+			return fmt.Errorf("spool uploaded file: %w", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		content = f
+	}
+
+	upload.u.Content = content
+	defer func() { upload.u.Content = nil }()
+
+	unlock := s.nameLocks.lock(upload.u.Name)
+	defer unlock()
+
+	return s.process(ctx, upload.u)
+}
+
+// sweepPresigned finishes every presigned upload whose file has been
+// uploaded, forgets the ones that have expired, and removes any
+// uploaded files that aren't for an upload filesrv knows about, which are
+// left behind if it restarts. It returns how many were finished.
+func (s server) sweepPresigned(ctx context.Context, now time.Time) (int, error) {
+	var finished int
+	var errs []error
+	known := map[string]bool{}
+	for _, upload := range s.presigned.all() {
+		known[upload.staged()] = true
+		if upload.finished() {
+			if now.After(upload.expires) {
+				s.presigned.remove(upload.id)
+			}
+			continue
+		}
+
+		_, err := s.finishPresigned(ctx, upload)
+		switch {
+		case err == nil:
+			finished++
+		case errors.Is(err, errNotUploaded):
+			if now.After(upload.expires) {
+				s.presigned.remove(upload.id)
+			}
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", upload.u.Name, err))
+		}
+	}
+
+	objects, err := s.minioClient.ListObjects(ctx, s.bucketName, presignedPrefix)
+	if err != nil {
+		return finished, errors.Join(append(errs, fmt.Errorf("list presigned uploads: %w", err))...)
+	}
+	for _, obj := range objects {
+		// Nothing can be uploaded with a URL older than the longest TTL
+		if !strings.HasPrefix(obj.Key, presignedPrefix) || known[obj.Key] || now.Sub(obj.LastModified) < maxPresignedUploadTTL {
+			continue
+		}
+
+		err := s.minioClient.RemoveObject(ctx, s.bucketName, obj.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remove %s: %w", obj.Key, err))
+		}
+	}
+
+	return finished, errors.Join(errs...)
+}
+
+// sweepPresignedOnce runs sweepPresigned and logs the result, for runEvery
+func (s server) sweepPresignedOnce(ctx context.Context, now time.Time) {
+	finished, err := s.sweepPresigned(ctx, now)
+	if err != nil {
+		log.Println("sweep presigned uploads:", err)
+	}
+	if finished > 0 {
+		log.Println("finished", finished, "presigned uploads")
+	}
+}
@@ -0,0 +1,126 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresignedUploads(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+	ctx := context.Background()
+
+	do := func(target, body, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	start := func(filename string, size int) presignedUploadResponse {
+		w := do("/upload/presigned", `{"filename": "`+filename+`", "contentType": "text/plain", "size": `+strconv.Itoa(size)+`}`, "")
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+		var resp presignedUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+	// upload does what the client would with the presigned URL
+	upload := func(resp presignedUploadResponse, contents string) {
+		_, err := store.PutObject(ctx, "testBucket", presignedPrefix+resp.ID, strings.NewReader(contents), int64(len(contents)), 0)
+		require.NoError(t, err)
+	}
+	staged := func(resp presignedUploadResponse) bool {
+		_, err := store.StatObject(ctx, "testBucket", presignedPrefix+resp.ID)
+		return err == nil
+	}
+
+	t.Run("completed by the client", func(t *testing.T) {
+		resp := start("report.txt", 18)
+		require.Equal(t, "report.txt", resp.Name)
+		require.Contains(t, resp.URL, "/testBucket/presigned/"+resp.ID)
+		require.WithinDuration(t, time.Now().Add(defaultPresignedUploadTTL), resp.Expires, time.Minute)
+
+		require.Equal(t, http.StatusConflict, do("/upload/presigned/"+resp.ID+"/complete", "", "").Result().StatusCode)
+
+		upload(resp, "test file contents")
+		w := do("/upload/presigned/"+resp.ID+"/complete", "", "")
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+		var stored uploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&stored))
+		require.Equal(t, "report.txt", stored.Filename)
+		require.NotEmpty(t, stored.Receipt)
+
+		var got bytes.Buffer
+		require.NoError(t, s.getFile(ctx, &got, "report.txt"))
+		require.Equal(t, "test file contents", got.String())
+		require.False(t, staged(resp), "the plaintext is removed")
+
+		// Asking again gets the same answer
+		require.Equal(t, http.StatusCreated, do("/upload/presigned/"+resp.ID+"/complete", "", "").Result().StatusCode)
+	})
+
+	t.Run("finished by the sweeper", func(t *testing.T) {
+		resp := start("swept.txt", 5)
+		waiting := start("waiting.txt", 5)
+		upload(resp, "swept")
+
+		finished, err := s.sweepPresigned(ctx, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, 1, finished)
+		_, ok := s.catalog.get("swept.txt")
+		require.True(t, ok)
+		require.False(t, staged(resp))
+
+		// Uploads are forgotten once they expire
+		_, err = s.sweepPresigned(ctx, time.Now().Add(2*defaultPresignedUploadTTL))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, do("/upload/presigned/"+waiting.ID+"/complete", "", "").Result().StatusCode)
+		require.Equal(t, http.StatusNotFound, do("/upload/presigned/"+resp.ID+"/complete", "", "").Result().StatusCode)
+	})
+
+	t.Run("wrong size", func(t *testing.T) {
+		resp := start("short.txt", 100)
+		upload(resp, "not 100 bytes")
+
+		require.Equal(t, http.StatusBadRequest, do("/upload/presigned/"+resp.ID+"/complete", "", "").Result().StatusCode)
+		require.False(t, staged(resp))
+		_, ok := s.catalog.get("short.txt")
+		require.False(t, ok)
+	})
+
+	t.Run("left behind", func(t *testing.T) {
+		orphan := presignedUploadResponse{ID: "orphan"}
+		upload(orphan, "from before a restart")
+		store.setModified("testBucket", presignedPrefix+"orphan", time.Now().Add(-maxPresignedUploadTTL))
+
+		_, err := s.sweepPresigned(ctx, time.Now())
+		require.NoError(t, err)
+		require.False(t, staged(orphan))
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		w := do("/upload/presigned", `{"filename": "mine.txt", "contentType": "text/plain", "size": 4}`, "alice")
+		var resp presignedUploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+		require.Equal(t, http.StatusNotFound, do("/upload/presigned/"+resp.ID+"/complete", "", "bob").Result().StatusCode)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, do("/upload/presigned", `{"contentType": "text/plain", "size": 4}`, "").Result().StatusCode)
+		require.Equal(t, http.StatusBadRequest, do("/upload/presigned", `{"filename": "a.txt", "size": 4, "expiresIn": 1000000}`, "").Result().StatusCode)
+		require.Equal(t, http.StatusBadRequest, do("/upload/presigned", `{"filename": ".filesrv-selftest", "size": 4}`, "").Result().StatusCode)
+	})
+}
@@ -0,0 +1,165 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// previewPrefix is where PDF previews are stored in the bucket, next to
+	// the thumbnails
+	previewPrefix = ".previews/"
+	// maxPreviewSourceSize is the largest document a preview will be made
+	// from, it's sent to the converter in one go
+	maxPreviewSourceSize = 64 << 20 // 64MB
+	// maxPreviewSize is the largest PDF the converter can send back
+	maxPreviewSize = 128 << 20 // 128MB
+)
+
+// previewTypes are the documents that get previews, by extension. The
+// converter goes on the extension of the filename it's sent, so it's kept
+// even if the file was stored under another name.
+var previewTypes = map[string]string{
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+}
+
+// converter turns office documents into PDFs with an external service. The
+// document is posted as the "files" field of a multipart form and the PDF
+// comes back as the response, which is what Gotenberg's LibreOffice route
+// does.
+type converter struct {
+	url    string
+	client *http.Client
+}
+
+// newConverter returns a converter for the service at url, or nil if there is
+// no URL
+func newConverter(url string) *converter {
+	if url == "" {
+		return nil
+	}
+
+	return &converter{url: url, client: &http.Client{}}
+}
+
+// convert sends the document to the converter and returns the PDF
+func (c *converter) convert(ctx context.Context, filename string, doc io.Reader) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", filename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(part, doc)
+	if err != nil {
+		return nil, err
+	}
+	err = form.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("converter: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("converter: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	pdf, err := io.ReadAll(io.LimitReader(resp.Body, maxPreviewSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("converter: read PDF: %w", err)
+	}
+	if len(pdf) > maxPreviewSize {
+		return nil, fmt.Errorf("converter: PDF is bigger than %d bytes", maxPreviewSize)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		return nil, errors.New("converter: response isn't a PDF")
+	}
+
+	return pdf, nil
+}
+
+// previewName returns the name to send a stored file to the converter with,
+// and whether it's a document that gets a preview at all
+func previewName(f storedFile) (string, bool) {
+	for _, name := range []string{f.OriginalName, f.Name} {
+		if _, ok := previewTypes[strings.ToLower(path.Ext(name))]; ok {
+			return path.Base(name), true
+		}
+	}
+
+	// The name doesn't say, but the client might have
+	mediaType, _, _ := mime.ParseMediaType(f.ContentType)
+	for ext, t := range previewTypes {
+		if mediaType == t {
+			return path.Base(f.Name) + ext, true
+		}
+	}
+
+	return "", false
+}
+
+// previewStage stores a PDF version of office documents, which is served at
+// /file/:filename/preview.pdf. Other files are skipped.
+func previewStage(ctx context.Context, s server, u *pendingUpload) error {
+	name, ok := previewName(u.Stored)
+	if !ok || u.Stored.Size > maxPreviewSourceSize {
+		return nil
+	}
+	if s.converter == nil {
+		return errors.New("no document converter is configured")
+	}
+
+	var doc bytes.Buffer
+	err := s.getFile(ctx, &doc, u.Stored.Name)
+	if err != nil {
+		return fmt.Errorf("get document: %w", err)
+	}
+
+	pdf, err := s.converter.convert(ctx, name, &doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.putFile(ctx, previewPrefix+u.Stored.Name, bytes.NewReader(pdf), int64(len(pdf)))
+	if err != nil {
+		return fmt.Errorf("store preview: %w", err)
+	}
+
+	return nil
+}
+
+// handleGetPreview returns the PDF preview of an office document
+func (s server) handleGetPreview(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/pdf")
+
+	err := s.getFile(r.Context(), w, previewPrefix+ps.ByName("filename"))
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeStorageError(w, err, "get preview")
+		return
+	}
+}
@@ -0,0 +1,112 @@
+package filesrv
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConverter answers with a PDF naming the file it was sent, or fails for
+// files with "broken" in their name
+func fakeConverter(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, header, err := r.FormFile("files")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		io.Copy(io.Discard, f)
+
+		if strings.Contains(header.Filename, "broken") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "LibreOffice failed")
+			return
+		}
+		io.WriteString(w, "%PDF-1.7 "+header.Filename)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestHandleGetPreview(t *testing.T) {
+	converter := fakeConverter(t)
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	s.converter = newConverter(converter.URL)
+	s.pipelines = mustPipelines([]pipelineRule{
+		{ContentType: "*", Stages: []string{"sniff", "store", "index", "preview"}},
+	})
+	router := s.routes()
+
+	for _, filename := range []string{"report.docx", "notes.txt", "broken.xlsx"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequest(t, "/upload", filename, "test file contents"))
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode, filename)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/report.docx/preview.pdf", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "application/pdf", w.Result().Header.Get("Content-Type"))
+	require.Equal(t, "%PDF-1.7 report.docx", w.Body.String())
+
+	// Only office documents get previews, and a failed conversion leaves the
+	// upload alone
+	for _, filename := range []string{"notes.txt", "broken.xlsx"} {
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/"+filename+"/preview.pdf", nil))
+		require.Equal(t, http.StatusNotFound, w.Result().StatusCode, filename)
+	}
+}
+
+func TestConverterNotPDF(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html>")
+	}))
+	defer srv.Close()
+
+	_, err := newConverter(srv.URL).convert(context.Background(), "report.docx", strings.NewReader("test"))
+	require.EqualError(t, err, "converter: response isn't a PDF")
+}
+
+func TestPreviewName(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored storedFile
+		want   string
+		wantOK bool
+	}{
+		{name: "extension", stored: storedFile{Name: "report.docx"}, want: "report.docx", wantOK: true},
+		{name: "upper case", stored: storedFile{Name: "SLIDES.PPTX"}, want: "SLIDES.PPTX", wantOK: true},
+		{name: "renamed", stored: storedFile{Name: "3f2a9c", OriginalName: "budget.xlsx"}, want: "budget.xlsx", wantOK: true},
+		{name: "content type", stored: storedFile{Name: "3f2a9c", ContentType: previewTypes[".docx"]}, want: "3f2a9c.docx", wantOK: true},
+		{name: "zip", stored: storedFile{Name: "archive.zip", ContentType: "application/zip"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := previewName(test.stored)
+			require.Equal(t, test.wantOK, ok)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestConverterPipeline(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ConverterURL = "http://gotenberg:3000/forms/libreoffice/convert"
+	s := newServerFromConfig(newMemObjStore(), cfg)
+
+	p, ok := s.pipelineFor("application/octet-stream")
+	require.True(t, ok)
+	require.Len(t, p.async, 1)
+	require.Equal(t, "preview", p.async[0].name)
+}
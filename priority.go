@@ -0,0 +1,117 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+)
+
+// priorityClass decides which queue a request waits in when the server is
+// busy
+type priorityClass string
+
+const (
+	// priorityExempt requests never wait, these are health checks and
+	// metrics that need to work when the server is overloaded, and long polls
+	// that spend their time idle
+	priorityExempt priorityClass = "exempt"
+	// priorityInteractive is for reads, which someone is usually waiting on
+	priorityInteractive priorityClass = "interactive"
+	// priorityBulk is for uploads and admin jobs, which can be throttled
+	// without anyone noticing much
+	priorityBulk priorityClass = "bulk"
+)
+
+// requestsShed counts the requests turned away because their queue was full,
+// by priority class
+var requestsShed = expvar.NewMap("requests_shed")
+
+// errQueueFull is returned when a request can't even wait for a slot
+var errQueueFull = errors.New("queue is full")
+
+// requestQueue limits how many requests run at once, with a bounded number
+// waiting for a turn
+type requestQueue struct {
+	// running holds a token for each request that is running
+	running chan struct{}
+	// admitted holds a token for each request that is running or waiting
+	admitted chan struct{}
+}
+
+func newRequestQueue(concurrency, queueLength int) *requestQueue {
+	return &requestQueue{
+		running:  make(chan struct{}, concurrency),
+		admitted: make(chan struct{}, concurrency+queueLength),
+	}
+}
+
+// acquire waits for a turn to run. It fails straight away with errQueueFull if
+// too many requests are already waiting, or with the context error if the
+// request gives up first. The returned function has to be called once the
+// request is done.
+func (q *requestQueue) acquire(ctx context.Context) (func(), error) {
+	select {
+	case q.admitted <- struct{}{}:
+	default:
+		return nil, errQueueFull
+	}
+
+	select {
+	case q.running <- struct{}{}:
+	case <-ctx.Done():
+		<-q.admitted
+		return nil, ctx.Err()
+	}
+
+	return func() {
+		<-q.running
+		<-q.admitted
+	}, nil
+}
+
+// requestPriority classifies a request
+func requestPriority(r *http.Request) priorityClass {
+	switch {
+	case r.URL.Path == "/version" || r.URL.Path == "/watch" || strings.HasPrefix(r.URL.Path, "/debug/"):
+		return priorityExempt
+	case r.URL.Path == "/healthz" || r.URL.Path == "/readyz":
+		// Probes mustn't fail just because the server is busy
+		return priorityExempt
+	case r.Method == http.MethodOptions:
+		return priorityExempt
+	case r.URL.Path == "/export":
+		// A whole prefix is a download that can take as long as an upload
+		return priorityBulk
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return priorityInteractive
+	default:
+		return priorityBulk
+	}
+}
+
+// withPriority runs each request through the queue for its priority class, so
+// when the server is saturated a flood of uploads can't hold up downloads.
+// Requests that can't get into a queue are told to come back later.
+func withPriority(next http.Handler, queues map[priorityClass]*requestQueue) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		class := requestPriority(r)
+		q, ok := queues[class]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		release, err := q.acquire(r.Context())
+		if err != nil {
+			requestsShed.Add(string(class), 1)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+
+		next.ServeHTTP(w, r)
+	})
+}
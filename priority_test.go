@@ -0,0 +1,107 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestQueue(t *testing.T) {
+	q := newRequestQueue(1, 1)
+
+	release, err := q.acquire(context.Background())
+	require.NoError(t, err)
+
+	// The second request waits for the first
+	acquired := make(chan func())
+	go func() {
+		release, err := q.acquire(context.Background())
+		require.NoError(t, err)
+		acquired <- release
+	}()
+	require.Eventually(t, func() bool { return len(q.admitted) == 2 }, time.Second, time.Millisecond)
+
+	// There's no room for a third to wait
+	_, err = q.acquire(context.Background())
+	require.ErrorIs(t, err, errQueueFull)
+
+	release()
+	(<-acquired)()
+
+	// A request that gives up while waiting frees its place in the queue
+	release, err = q.acquire(context.Background())
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = q.acquire(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, q.admitted, 1)
+	release()
+}
+
+func TestRequestPriority(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   priorityClass
+	}{
+		{method: http.MethodGet, target: "/file/filename", want: priorityInteractive},
+		{method: http.MethodGet, target: "/files", want: priorityInteractive},
+		{method: http.MethodPost, target: "/upload", want: priorityBulk},
+		{method: http.MethodPut, target: "/sync/file/photos/a.jpg", want: priorityBulk},
+		{method: http.MethodPost, target: "/admin/prefetch", want: priorityBulk},
+		{method: http.MethodGet, target: "/export?prefix=builds/", want: priorityBulk},
+		{method: http.MethodGet, target: "/version", want: priorityExempt},
+		{method: http.MethodGet, target: "/readyz", want: priorityExempt},
+		{method: http.MethodGet, target: "/debug/vars", want: priorityExempt},
+		{method: http.MethodGet, target: "/watch", want: priorityExempt},
+		{method: http.MethodOptions, target: "/upload", want: priorityExempt},
+	}
+
+	for _, test := range tests {
+		t.Run(test.method+" "+test.target, func(t *testing.T) {
+			require.Equal(t, test.want, requestPriority(httptest.NewRequest(test.method, test.target, nil)))
+		})
+	}
+}
+
+func TestWithPriority(t *testing.T) {
+	unblock := make(chan struct{})
+	var running sync.WaitGroup
+	handler := withPriority(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			running.Done()
+			<-unblock
+		}
+	}), map[priorityClass]*requestQueue{
+		priorityInteractive: newRequestQueue(1, 0),
+		priorityBulk:        newRequestQueue(1, 0),
+	})
+
+	// Saturate the bulk queue with an upload that doesn't finish
+	running.Add(1)
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil))
+		close(done)
+	}()
+	running.Wait()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	require.Equal(t, "1", w.Result().Header.Get("Retry-After"))
+
+	// Reads are still served
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/filename", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	close(unblock)
+	<-done
+}
@@ -0,0 +1,198 @@
+package filesrv
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// streamableStages are the stages before store that only look at the start
+// of the file, so they can run on a request body while it's being streamed
+var streamableStages = map[string]bool{"sniff": true, "rules": true}
+
+// streamable says whether an upload can go straight from the request body to
+// minio through the pipeline, without being written anywhere first
+func (p pipeline) streamable() bool {
+	for _, stage := range p.sync {
+		if stage.beforeStore && !streamableStages[stage.name] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// handlePutFile uploads the request body as the file named in the URL, for
+// clients that can't or don't want to build a multipart form. The name is
+// used as it is, without the naming strategy. The body is encrypted and
+// stored as it arrives unless the pipeline has a stage that needs the whole
+// file, like scan, in which case it's written to a temporary file first.
+func (s server) handlePutFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := ps.ByName("filename")
+	s.putBody(w, r, filename, checkFilename(filename))
+}
+
+// putBody stores the request body as filename, nameCheck is the result of
+// checking the name
+func (s server) putBody(w http.ResponseWriter, r *http.Request, filename string, nameCheck policyCheck) {
+	u, ok := s.storeBody(w, r, filename, nameCheck, putOptions{})
+	if ok {
+		s.writeUploadResponse(w, u.Stored)
+	}
+}
+
+// putOptions change how storeBody stores a file
+type putOptions struct {
+	// unmodified leaves out the stages that change the contents, for clients
+	// that check what's stored against their own copy
+	unmodified bool
+	// precondition is run with the name locked, just before the file is
+	// stored. If it returns a status the upload is turned away with it.
+	precondition func() int
+}
+
+// storeBody runs the request body through the checks and the pipeline and
+// stores it as filename. If it returns false it has already responded with
+// why the upload failed, otherwise the response is left to the caller.
+func (s server) storeBody(w http.ResponseWriter, r *http.Request, filename string, nameCheck policyCheck, opts putOptions) (*pendingUpload, bool) {
+	// The size is needed up front for the encrypted size minio is given
+	if r.ContentLength < 0 {
+		w.WriteHeader(http.StatusLengthRequired)
+		return nil, false
+	}
+
+	contentType := r.Header.Get("Content-Type")
+	if failed := firstFailed(s.settings().policy.checkNamed(nameCheck, r.ContentLength, contentType)); failed != nil {
+		w.WriteHeader(failed.status)
+		log.Printf("upload rejected: filename: %s, check: %s, reason: %s", filename, failed.Name, failed.Reason)
+		return nil, false
+	}
+
+	objectTags, err := objectTagsOf(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("tags:", err)
+		return nil, false
+	}
+
+	region, err := s.placement.region(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("placement:", err)
+		return nil, false
+	}
+
+	if !s.checkAccess(w, r, filename, accessWrite) || !s.checkQuota(w, filename, r.ContentLength) {
+		return nil, false
+	}
+
+	p, ok := s.pipelineFor(contentType)
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		log.Printf("upload rejected: filename: %s, reason: no pipeline for %s", filename, contentType)
+		return nil, false
+	}
+	if opts.unmodified {
+		p = p.unmodified()
+	}
+
+	var content io.ReadSeeker = newRewindReader(r.Body, ruleSampleSize)
+	if !p.streamable() {
+		f, err := s.spill.spool(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println("spool upload:", err)
+			return nil, false
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		content = f
+	}
+
+	u := &pendingUpload{
+		Name:         filename,
+		OriginalName: filename,
+		ContentType:  contentType,
+		Source:       requestSource(r),
+		Size:         r.ContentLength,
+		Region:       region,
+		ObjectTags:   objectTags,
+		Content:      content,
+	}
+	unlock := s.nameLocks.lock(u.Name)
+	defer unlock()
+	if opts.precondition != nil {
+		if status := opts.precondition(); status != 0 {
+			w.WriteHeader(status)
+			return nil, false
+		}
+	}
+	err = s.processWith(r.Context(), p, u)
+	if err != nil {
+		var stageErr stageError
+		if errors.As(err, &stageErr) {
+			w.WriteHeader(stageErr.status)
+			log.Printf("upload rejected: filename: %s, reason: %s", u.Name, err)
+			return nil, false
+		}
+
+		writeStorageError(w, err, "put file: filename: "+u.Name)
+		return nil, false
+	}
+
+	return u, true
+}
+
+// errRewound is returned when a stage tries to go back further than the
+// start of the file that rewindReader keeps
+var errRewound = errors.New("can't seek back past the start of a streamed upload")
+
+// rewindReader is a reader that keeps the first limit bytes it reads, so the
+// stages that only look at the start of a file can seek back to it
+type rewindReader struct {
+	r     io.Reader
+	head  []byte
+	limit int
+	pos   int64
+}
+
+func newRewindReader(r io.Reader, limit int) *rewindReader {
+	return &rewindReader{r: r, limit: limit}
+}
+
+func (rr *rewindReader) Read(p []byte) (int, error) {
+	if rr.pos < int64(len(rr.head)) {
+		n := copy(p, rr.head[rr.pos:])
+		rr.pos += int64(n)
+		return n, nil
+	}
+
+	n, err := rr.r.Read(p)
+	if room := rr.limit - len(rr.head); room > 0 && rr.pos == int64(len(rr.head)) {
+		rr.head = append(rr.head, p[:min(n, room)]...)
+	}
+	rr.pos += int64(n)
+	return n, err
+}
+
+func (rr *rewindReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rr.pos
+	default:
+		return rr.pos, errRewound
+	}
+	// Once it's read past what it kept, the rest of the way back is gone
+	kept := int64(len(rr.head))
+	if offset != rr.pos && (rr.pos > kept || offset < 0 || offset > kept) {
+		return rr.pos, errRewound
+	}
+
+	rr.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,91 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePutFile(t *testing.T) {
+	addr := fakeClamd(t)
+	// Bigger than the start of the file that's kept for the rules, so the
+	// rest has to be streamed
+	large := strings.Repeat("a", ruleSampleSize*3+1)
+
+	tests := []struct {
+		name       string
+		filename   string
+		contents   string
+		noLength   bool
+		policy     uploadPolicy
+		scan       bool
+		wantStatus int
+	}{
+		{name: "stored", filename: "test.txt", contents: "test file contents", wantStatus: http.StatusCreated},
+		{name: "streamed", filename: "large.txt", contents: large, wantStatus: http.StatusCreated},
+		{name: "scanned", filename: "large.txt", contents: large, scan: true, wantStatus: http.StatusCreated},
+		{name: "infected", filename: "virus.txt", contents: large + "virus", scan: true, wantStatus: http.StatusUnprocessableEntity},
+		{name: "no length", filename: "test.txt", contents: "test file contents", noLength: true, wantStatus: http.StatusLengthRequired},
+		{name: "too large", filename: "test.txt", contents: "test file contents", policy: uploadPolicy{MaxSize: 4}, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "reserved filename", filename: ".filesrv-selftest", contents: "test file contents", wantStatus: http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+			setSettings(s, func(r *reloadable) { r.policy = test.policy })
+			if test.scan {
+				s.scanner = newClamdScanner(addr, 0, 0)
+				s.pipelines = mustPipelines([]pipelineRule{{ContentType: "*", Stages: []string{"sniff", "scan", "store", "index"}}})
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/file/"+test.filename, strings.NewReader(test.contents))
+			if test.noLength {
+				req.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, req)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resp uploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			require.Equal(t, test.filename, resp.Filename)
+			require.Equal(t, int64(len(test.contents)), resp.Size)
+
+			var got strings.Builder
+			require.NoError(t, s.getFile(context.Background(), &got, test.filename))
+			require.Equal(t, test.contents, got.String())
+
+			e, ok := s.catalog.get(test.filename)
+			require.True(t, ok)
+			require.Equal(t, "text/plain; charset=utf-8", e.ContentType)
+		})
+	}
+}
+
+func TestRewindReader(t *testing.T) {
+	rr := newRewindReader(strings.NewReader("0123456789"), 4)
+
+	head := make([]byte, 3)
+	_, err := io.ReadFull(rr, head)
+	require.NoError(t, err)
+	_, err = rr.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	all, err := io.ReadAll(rr)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(all))
+
+	// Only the first four bytes were kept
+	_, err = rr.Seek(0, io.SeekStart)
+	require.ErrorIs(t, err, errRewound)
+}
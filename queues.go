@@ -0,0 +1,523 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultVisibilityTimeout is how long a received message is hidden from
+	// other workers when neither the queue nor the worker says
+	defaultVisibilityTimeout = 30 * time.Second
+	// maxVisibilityTimeout is the longest a worker can hold a message
+	maxVisibilityTimeout = 12 * time.Hour
+	// maxReceive is the most messages a worker can take at once
+	maxReceive = 100
+	// maxQueuedMessages bounds each queue, files stored while a queue is full
+	// aren't queued
+	maxQueuedMessages = 100000
+	// maxDeadLetters bounds the dead letters kept for each queue, the oldest
+	// are dropped once it's reached
+	maxDeadLetters = 10000
+	// maxFailureReason is the longest failure a worker can report
+	maxFailureReason = 1 << 10
+)
+
+// queueConfig is a processing queue that stored files with matching content
+// types are put in, for external workers to pull from
+type queueConfig struct {
+	Name string `yaml:"name"`
+	// ContentTypes are full types like image/png, wildcards like image/* or
+	// * for everything
+	ContentTypes      []string      `yaml:"content-types"`
+	VisibilityTimeout time.Duration `yaml:"visibility-timeout"`
+	// MaxDeliveries is how many times a message is handed out before it's
+	// moved to the dead letters, 0 means it never is
+	MaxDeliveries int `yaml:"max-deliveries"`
+}
+
+// validateQueues checks the processing queues
+func validateQueues(queues []queueConfig) error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, q := range queues {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(queuesSection, i, "queue %d (%s): %s", i+1, q.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if !dropBoxNamePattern.MatchString(q.Name) {
+			fail("name has to be letters, digits, dashes and underscores")
+		}
+		if seen[q.Name] {
+			fail("defined more than once")
+		}
+		seen[q.Name] = true
+		if len(q.ContentTypes) == 0 {
+			fail("no content types")
+		}
+		for _, ct := range q.ContentTypes {
+			if !validContentTypePattern(ct) {
+				fail("content type %q isn't a type, a type/* wildcard or *", ct)
+			}
+		}
+		if q.VisibilityTimeout < 0 || q.VisibilityTimeout > maxVisibilityTimeout {
+			fail("visibility timeout %s isn't between 0 and %s", q.VisibilityTimeout, maxVisibilityTimeout)
+		}
+		if q.MaxDeliveries < 0 {
+			fail("max deliveries %d is negative", q.MaxDeliveries)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// queueMessage tells a worker about a stored file. Receipt is new each time
+// the message is handed out, and is what the worker acknowledges it with, so
+// a worker that took too long can't acknowledge a message that has since gone
+// to another worker.
+type queueMessage struct {
+	ID          string    `json:"id"`
+	Receipt     string    `json:"receipt"`
+	Bucket      string    `json:"bucket"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	Enqueued    time.Time `json:"enqueued"`
+	Deliveries  int       `json:"deliveries"`
+	// LastError is the last failure a worker reported
+	LastError string `json:"lastError,omitempty"`
+
+	// visibleAt is when the message can be handed out again
+	visibleAt time.Time
+}
+
+// processingQueue holds the messages for one queue in the order they were
+// queued. They're only kept in memory.
+type processingQueue struct {
+	queueConfig
+
+	mu       sync.Mutex
+	messages []*queueMessage
+	// dead are the messages that were handed out as many times as the queue
+	// allows without being processed, oldest first
+	dead []*queueMessage
+}
+
+// processingQueues are the configured queues by name
+type processingQueues map[string]*processingQueue
+
+// newProcessingQueues returns the queues, or nil if there aren't any
+func newProcessingQueues(queues []queueConfig) processingQueues {
+	if len(queues) == 0 {
+		return nil
+	}
+
+	pq := processingQueues{}
+	for _, q := range queues {
+		if q.VisibilityTimeout == 0 {
+			q.VisibilityTimeout = defaultVisibilityTimeout
+		}
+		pq[q.Name] = &processingQueue{queueConfig: q}
+	}
+
+	return pq
+}
+
+// wants says whether files with the content type go in the queue
+func (q *processingQueue) wants(contentType string) bool {
+	for _, ct := range q.ContentTypes {
+		if contentTypeMatches(ct, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// push adds a message to the end of the queue, it fails if the queue is full
+func (q *processingQueue) push(m *queueMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.messages) >= maxQueuedMessages {
+		return false
+	}
+	q.messages = append(q.messages, m)
+	return true
+}
+
+// receive hands out up to max of the messages that aren't hidden, oldest
+// first, and hides them for the timeout. Messages that have been handed out
+// as many times as the queue allows are moved to the dead letters instead.
+func (q *processingQueue) receive(now time.Time, max int, timeout time.Duration) ([]queueMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	received := []queueMessage{}
+	kept := q.messages[:0]
+	for _, m := range q.messages {
+		switch {
+		case len(received) == max || m.visibleAt.After(now):
+		case q.MaxDeliveries > 0 && m.Deliveries >= q.MaxDeliveries:
+			q.deadLetter(m)
+			continue
+		default:
+			receipt, err := newQueueID()
+			if err != nil {
+				return nil, err
+			}
+			m.Receipt = receipt
+			m.Deliveries++
+			m.visibleAt = now.Add(timeout)
+			received = append(received, *m)
+		}
+		kept = append(kept, m)
+	}
+	clear(q.messages[len(kept):])
+	q.messages = kept
+
+	return received, nil
+}
+
+// deadLetter keeps a message that's been given up on, q.mu must be held
+func (q *processingQueue) deadLetter(m *queueMessage) {
+	log.Printf("queue: giving up on message: queue: %s, filename: %s, deliveries: %d, error: %s", q.Name, m.Name, m.Deliveries, m.LastError)
+	m.Receipt = ""
+	if len(q.dead) >= maxDeadLetters {
+		q.dead = slices.Delete(q.dead, 0, 1)
+	}
+	q.dead = append(q.dead, m)
+}
+
+// find returns the index of the message last handed out with the receipt,
+// or -1 if the receipt isn't current. q.mu must be held.
+func (q *processingQueue) find(receipt string) int {
+	if receipt == "" {
+		return -1
+	}
+	return slices.IndexFunc(q.messages, func(m *queueMessage) bool {
+		return m.Receipt == receipt
+	})
+}
+
+// ack removes the message last handed out with the receipt
+func (q *processingQueue) ack(receipt string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.find(receipt)
+	if i < 0 {
+		return false
+	}
+	q.messages = slices.Delete(q.messages, i, i+1)
+	return true
+}
+
+// extend hides the message last handed out with the receipt for the timeout
+// from now, for workers that need longer than they first asked for
+func (q *processingQueue) extend(now time.Time, receipt string, timeout time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.find(receipt)
+	if i < 0 {
+		return false
+	}
+	q.messages[i].visibleAt = now.Add(timeout)
+	return true
+}
+
+// fail records that the worker couldn't process the message last handed out
+// with the receipt. It can be handed out again straight away, unless it's
+// been handed out as many times as the queue allows, in which case it's moved
+// to the dead letters.
+func (q *processingQueue) fail(now time.Time, receipt, reason string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.find(receipt)
+	if i < 0 {
+		return false
+	}
+	m := q.messages[i]
+	m.LastError = reason
+	// The receipt is spent, so a worker can't fail a message twice
+	m.Receipt = ""
+	m.visibleAt = now
+	if q.MaxDeliveries > 0 && m.Deliveries >= q.MaxDeliveries {
+		q.messages = slices.Delete(q.messages, i, i+1)
+		q.deadLetter(m)
+	}
+	return true
+}
+
+// deadLetters returns a copy of the dead letters
+func (q *processingQueue) deadLetters() []queueMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dead := make([]queueMessage, 0, len(q.dead))
+	for _, m := range q.dead {
+		dead = append(dead, *m)
+	}
+	return dead
+}
+
+// redrive puts the dead letters back in the queue with their deliveries
+// reset, once whatever made them fail has been fixed. Dead letters that don't
+// fit in the queue are left where they are.
+func (q *processingQueue) redrive() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := min(len(q.dead), maxQueuedMessages-len(q.messages))
+	for _, m := range q.dead[:n] {
+		m.Deliveries = 0
+		m.visibleAt = time.Time{}
+		q.messages = append(q.messages, m)
+	}
+	q.dead = slices.Delete(q.dead, 0, n)
+	return n
+}
+
+// stats counts the messages waiting to be handed out and the ones being
+// worked on
+func (q *processingQueue) stats(now time.Time) queueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := queueStats{Name: q.Name, Dead: len(q.dead)}
+	for _, m := range q.messages {
+		if m.visibleAt.After(now) {
+			stats.InFlight++
+		} else {
+			stats.Visible++
+		}
+	}
+	return stats
+}
+
+// queueStats is how a queue is doing, for GET /queues
+type queueStats struct {
+	Name     string `json:"name"`
+	Visible  int    `json:"visible"`
+	InFlight int    `json:"inFlight"`
+	Dead     int    `json:"dead"`
+}
+
+// newQueueID returns a random ID for a message or a receipt
+func newQueueID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("random id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// queueStage puts the stored file in every queue that wants its content
+// type. It comes after index so the file can be looked up by the time a
+// worker hears about it.
+func queueStage(_ context.Context, s server, u *pendingUpload) error {
+	var errs []error
+	for _, q := range s.processing {
+		if !q.wants(u.Stored.ContentType) {
+			continue
+		}
+
+		id, err := newQueueID()
+		if err != nil {
+			return err
+		}
+		ok := q.push(&queueMessage{
+			ID:          id,
+			Bucket:      s.bucketName,
+			Name:        u.Stored.Name,
+			ContentType: u.Stored.ContentType,
+			Size:        u.Stored.Size,
+			SHA256:      u.Stored.SHA256,
+			Enqueued:    time.Now().UTC(),
+		})
+		if !ok {
+			errs = append(errs, fmt.Errorf("queue %s is full", q.Name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// handleGetQueues returns how many messages are in each queue
+func (s server) handleGetQueues(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	now := time.Now()
+	stats := []queueStats{}
+	for _, name := range sortedKeys(s.processing) {
+		stats = append(stats, s.processing[name].stats(now))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// visibilityTimeout returns the visibilityTimeout query parameter, or the
+// queue's if there isn't one. It's false if the parameter is bad.
+func (q *processingQueue) visibilityTimeout(r *http.Request) (time.Duration, bool) {
+	timeout, err := parseOptionalDuration(r.URL.Query().Get("visibilityTimeout"))
+	if err != nil || timeout < 0 || timeout > maxVisibilityTimeout {
+		return 0, false
+	}
+	if timeout == 0 {
+		timeout = q.VisibilityTimeout
+	}
+	return timeout, true
+}
+
+// handlePostQueueReceive hands out messages for a worker to process. The
+// messages are hidden from other workers until the visibility timeout, and
+// handed out again after it unless the worker acknowledges them first.
+func (s server) handlePostQueueReceive(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q, ok := s.processing[ps.ByName("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	max := 1
+	if v := query.Get("max"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxReceive {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		max = n
+	}
+	timeout, ok := q.visibilityTimeout(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	messages, err := q.receive(time.Now(), max, timeout)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("queue receive:", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(messages)
+	if err != nil {
+		log.Println("encode queue messages:", err)
+	}
+}
+
+// handleDeleteQueueMessage acknowledges a message once the worker has
+// processed it, so it isn't handed out again
+func (s server) handleDeleteQueueMessage(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	q, ok := s.processing[ps.ByName("name")]
+	if !ok || !q.ack(ps.ByName("receipt")) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlePutQueueLease extends the lease a worker has on a message, hiding it
+// from other workers for the visibility timeout from now
+func (s server) handlePutQueueLease(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q, ok := s.processing[ps.ByName("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	timeout, ok := q.visibilityTimeout(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !q.extend(time.Now(), ps.ByName("receipt"), timeout) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queueFailure is the body of a failure report
+type queueFailure struct {
+	Error string `json:"error"`
+}
+
+// handlePostQueueFailure reports that a worker couldn't process a message,
+// so it's handed out again without waiting for the visibility timeout
+func (s server) handlePostQueueFailure(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q, ok := s.processing[ps.ByName("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var failure queueFailure
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&failure)
+	if err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode queue failure:", err)
+		return
+	}
+	if len(failure.Error) > maxFailureReason {
+		failure.Error = failure.Error[:maxFailureReason]
+	}
+
+	if !q.fail(time.Now(), ps.ByName("receipt"), failure.Error) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetQueueDeadLetters lists the messages that were given up on
+func (s server) handleGetQueueDeadLetters(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	q, ok := s.processing[ps.ByName("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q.deadLetters())
+}
+
+// redriveResult is the response to a redrive
+type redriveResult struct {
+	Redriven int `json:"redriven"`
+}
+
+// handlePostQueueRedrive puts the dead letters back in the queue
+func (s server) handlePostQueueRedrive(w http.ResponseWriter, _ *http.Request, ps httprouter.Params) {
+	q, ok := s.processing[ps.ByName("name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	n := q.redrive()
+	log.Printf("queue: redrove dead letters: queue: %s, messages: %d", q.Name, n)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(redriveResult{Redriven: n})
+}
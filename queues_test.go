@@ -0,0 +1,236 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessingQueues(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.Queues = []queueConfig{
+		{Name: "images", ContentTypes: []string{"image/*"}},
+		{Name: "documents", ContentTypes: []string{"text/plain", "application/pdf"}},
+	}
+	cfg.WorkerGroup = "workers"
+	handler := newServerFromConfig(newMemObjStore(), cfg).routes()
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newWorkerRequest(method, target, nil))
+		return w
+	}
+	receive := func(target string) []queueMessage {
+		w := do(http.MethodPost, target)
+		require.Equal(t, http.StatusOK, w.Code)
+		var messages []queueMessage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+		return messages
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "notes.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	// Only workers and admins can take messages
+	for _, groups := range []string{"", "users"} {
+		r := httptest.NewRequest(http.MethodPost, "/queues/documents/receive", nil)
+		r.Header.Set(identityHeader, "mallory")
+		r.Header.Set(groupsHeader, groups)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusForbidden, w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/queues/documents/messages/x", nil))
+	require.Equal(t, http.StatusForbidden, w.Code)
+
+	// Only the queue that wants text gets it
+	require.Empty(t, receive("/queues/images/receive"))
+	messages := receive("/queues/documents/receive?max=10&visibilityTimeout=1m")
+	require.Len(t, messages, 1)
+	require.Equal(t, "testBucket", messages[0].Bucket)
+	require.Equal(t, "notes.txt", messages[0].Name)
+	require.Equal(t, "text/plain; charset=utf-8", messages[0].ContentType)
+	require.Equal(t, int64(len("test file contents")), messages[0].Size)
+	require.Equal(t, 1, messages[0].Deliveries)
+
+	// It's hidden from other workers until it's acknowledged
+	require.Empty(t, receive("/queues/documents/receive"))
+	w = do(http.MethodGet, "/queues")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `[
+		{"name": "documents", "visible": 0, "inFlight": 1, "dead": 0},
+		{"name": "images", "visible": 0, "inFlight": 0, "dead": 0}
+	]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodDelete, "/queues/documents/messages/"+messages[0].Receipt, nil))
+	require.Equal(t, http.StatusNoContent, w.Code, "admins can act as workers")
+	require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/queues/documents/messages/"+messages[0].Receipt).Code)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/queues/missing/receive").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queues/documents/receive?max=0").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queues/documents/receive?visibilityTimeout=soon").Code)
+}
+
+// newWorkerRequest is a request from a queue worker
+func newWorkerRequest(method, target string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	req.Header.Set(identityHeader, "worker-1")
+	req.Header.Set(groupsHeader, "workers")
+	return req
+}
+
+func TestProcessingQueueReceive(t *testing.T) {
+	q := newProcessingQueues([]queueConfig{{Name: "images", ContentTypes: []string{"*"}, MaxDeliveries: 2}})["images"]
+	require.Equal(t, defaultVisibilityTimeout, q.VisibilityTimeout)
+	require.True(t, q.push(&queueMessage{ID: "1", Name: "a.png"}))
+	require.True(t, q.push(&queueMessage{ID: "2", Name: "b.png"}))
+	now := time.Now()
+
+	first, err := q.receive(now, 1, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, first, 1)
+	require.Equal(t, "a.png", first[0].Name)
+
+	// The worker took too long, so the message goes to the next one and the
+	// first worker's receipt no longer works
+	now = now.Add(2 * time.Minute)
+	second, err := q.receive(now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, second, 2)
+	require.Equal(t, "a.png", second[0].Name)
+	require.Equal(t, 2, second[0].Deliveries)
+	require.NotEqual(t, first[0].Receipt, second[0].Receipt)
+	require.False(t, q.ack(first[0].Receipt))
+	require.True(t, q.ack(second[1].Receipt))
+
+	// It's given up on after being handed out as many times as allowed
+	now = now.Add(2 * time.Minute)
+	third, err := q.receive(now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Empty(t, third)
+	require.Equal(t, queueStats{Name: "images", Dead: 1}, q.stats(now))
+
+	// And handed out again once it's redriven
+	require.Equal(t, 1, q.redrive())
+	fourth, err := q.receive(now, 10, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, fourth, 1)
+	require.Equal(t, "a.png", fourth[0].Name)
+	require.Equal(t, 1, fourth[0].Deliveries)
+
+	require.Nil(t, newProcessingQueues(nil))
+}
+
+func TestProcessingQueueLeases(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Queues = []queueConfig{{Name: "scan", ContentTypes: []string{"*"}, MaxDeliveries: 2}}
+	s := newServerFromConfig(newMemObjStore(), cfg)
+	handler := s.routes()
+	q := s.processing["scan"]
+	require.True(t, q.push(&queueMessage{ID: "1", Name: "a.exe"}))
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newAdminRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	receive := func() []queueMessage {
+		messages, err := q.receive(time.Now(), 1, time.Minute)
+		require.NoError(t, err)
+		return messages
+	}
+
+	// Nobody else can touch the messages
+	for _, route := range []apiRoute{
+		{http.MethodPost, "/queues/scan/messages/x/failure"},
+		{http.MethodGet, "/queues/scan/dead"},
+		{http.MethodPost, "/queues/scan/dead/redrive"},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(route.Method, route.Path, nil))
+		require.Equal(t, http.StatusForbidden, w.Code, "%s %s", route.Method, route.Path)
+	}
+
+	// A worker that needs longer keeps the message hidden
+	first := receive()
+	require.Len(t, first, 1)
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, "/queues/scan/messages/"+first[0].Receipt+"/lease?visibilityTimeout=1h", "").Code)
+	require.True(t, q.messages[0].visibleAt.After(time.Now().Add(59*time.Minute)))
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPut, "/queues/scan/messages/"+first[0].Receipt+"/lease?visibilityTimeout=1000h", "").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodPut, "/queues/scan/messages/stale/lease", "").Code)
+
+	// A failure hands it out again straight away, and the receipt is spent
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "/queues/scan/messages/"+first[0].Receipt+"/failure", `{"error": "clamd unreachable"}`).Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodPost, "/queues/scan/messages/"+first[0].Receipt+"/failure", "").Code)
+	second := receive()
+	require.Len(t, second, 1)
+	require.Equal(t, "clamd unreachable", second[0].LastError)
+
+	// Failing it on the last delivery makes it a dead letter
+	require.Equal(t, http.StatusNoContent, do(http.MethodPost, "/queues/scan/messages/"+second[0].Receipt+"/failure", `{"error": "still unreachable"}`).Code)
+	require.Empty(t, receive())
+	w := do(http.MethodGet, "/queues/scan/dead", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var dead []queueMessage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &dead))
+	require.Len(t, dead, 1)
+	require.Equal(t, "a.exe", dead[0].Name)
+	require.Equal(t, "still unreachable", dead[0].LastError)
+	require.Empty(t, dead[0].Receipt)
+
+	w = do(http.MethodPost, "/queues/scan/dead/redrive", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"redriven": 1}`, w.Body.String())
+	require.Len(t, receive(), 1)
+
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/queues/missing/dead", "").Code)
+	require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/queues/scan/messages/x/failure", "{").Code)
+}
+
+func TestLoadConfigFileQueues(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+queues:
+  - name: images
+    content-types: [image/*]
+    visibility-timeout: 5m
+    max-deliveries: 5
+  - name: documents
+    content-types: [application/pdf, text/*]
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []queueConfig{
+		{Name: "images", ContentTypes: []string{"image/*"}, VisibilityTimeout: 5 * time.Minute, MaxDeliveries: 5},
+		{Name: "documents", ContentTypes: []string{"application/pdf", "text/*"}},
+	}, cfg.Queues)
+
+	path = writeConfigFile(t, testConfigFile+`
+queues:
+  - name: images
+    content-types: [image/*]
+  - name: images
+    content-types: [pdf]
+    max-deliveries: -1
+  - name: all files
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "queue 2 (images): defined more than once")
+	require.ErrorContains(t, err, `queue 2 (images): content type "pdf" isn't a type, a type/* wildcard or *`)
+	require.ErrorContains(t, err, "queue 2 (images): max deliveries -1 is negative")
+	require.ErrorContains(t, err, "queue 3 (all files): name has to be letters, digits, dashes and underscores")
+	require.ErrorContains(t, err, "queue 3 (all files): no content types")
+	require.Equal(t, "queues[1]", configProblems(err)[0].Path)
+}
@@ -0,0 +1,181 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/minio/sio"
+)
+
+// encryptedBlockSize is the size of each DARE package in the bucket, the
+// plaintext block with a 16 byte header before it and a 16 byte tag after
+const encryptedBlockSize = decryptBlockSize + 32
+
+// errRangeUnsatisfiable is returned by parseRange when none of the range is
+// in the file
+var errRangeUnsatisfiable = errors.New("range not satisfiable")
+
+// parseRange reads a Range header for a file of size bytes, returning the
+// start and length of the range. Only a single byte range is supported,
+// anything else is an error and gets the whole file.
+func parseRange(header string, size int64) (start, length int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", header)
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed range %q", header)
+	}
+
+	if first == "" {
+		// A suffix, the last n bytes of the file
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("malformed range %q", header)
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errRangeUnsatisfiable
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("malformed range %q", header)
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("malformed range %q", header)
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, errRangeUnsatisfiable
+	}
+
+	return start, end - start + 1, nil
+}
+
+// sliceRange returns the part of b a ranged read covers
+func sliceRange(b []byte, offset, length int64) []byte {
+	if offset >= int64(len(b)) {
+		return nil
+	}
+	return b[offset:min(offset+length, int64(len(b)))]
+}
+
+// serveRange responds to a GET with a Range header, the file headers have to
+// have been set already. It returns false if the whole file should be sent
+// instead, because the range isn't one that's supported or If-Range doesn't
+// match.
+func (s server) serveRange(w http.ResponseWriter, r *http.Request, filename string) bool {
+	e, err := s.fileInfo(r.Context(), filename)
+	if err != nil {
+		clearFileHeaders(w.Header())
+		writeStorageError(w, err, "get file range")
+		return true
+	}
+
+	// Files that aren't in the catalog have no ETag to match
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && (e.SHA256 == "" || ifRange != etag(e.SHA256)) {
+		return false
+	}
+
+	start, length, err := parseRange(r.Header.Get("Range"), e.Size)
+	if errors.Is(err, errRangeUnsatisfiable) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", e.Size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	// The status can't be sent until the first block has been decrypted
+	pw := &partialWriter{ResponseWriter: w, header: func(h http.Header) {
+		h.Set("Accept-Ranges", "bytes")
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, e.Size))
+		h.Set("Content-Length", strconv.FormatInt(length, 10))
+	}}
+	err = s.getFileRange(r.Context(), pw, filename, start, length)
+	if err != nil {
+		clearFileHeaders(w.Header())
+		writeStorageError(w, err, "get file range")
+	}
+
+	return true
+}
+
+// partialWriter sends a 206 with the headers from header just before the
+// first write
+type partialWriter struct {
+	http.ResponseWriter
+	header  func(http.Header)
+	written bool
+}
+
+func (pw *partialWriter) Write(b []byte) (int, error) {
+	if !pw.written {
+		pw.written = true
+		pw.header(pw.Header())
+		pw.WriteHeader(http.StatusPartialContent)
+	}
+
+	return pw.ResponseWriter.Write(b)
+}
+
+// getFileRange writes length bytes of the plaintext of filename starting at
+// start to w. Only the DARE packages covering the range are fetched, and
+// decryption starts at the sequence number of the first of them. Errors are
+// the same as from getFile.
+func (s server) getFileRange(ctx context.Context, w io.Writer, filename string, start, length int64) error {
+	encrypted := s.appEncrypted(filename)
+	first := start / decryptBlockSize
+	offset, size := start, length
+	if encrypted {
+		last := (start + length - 1) / decryptBlockSize
+		offset = first * encryptedBlockSize
+		size = (last - first + 1) * encryptedBlockSize
+	}
+
+	obj, err := s.minioClient.GetObjectRange(ctx, s.bucketName, filename, offset, size)
+	if err != nil {
+		return fmt.Errorf("get object: %w", err)
+	}
+	if obj == nil {
+		return errNotFound
+	}
+	defer obj.Close()
+
+	var decrypted io.Reader = obj
+	if encrypted {
+		cfg := s.sioConfig(filename)
+		cfg.SequenceNumber = uint32(first)
+		decrypted, err = sio.DecryptReader(obj, cfg)
+		if err != nil {
+			return fmt.Errorf("decrypt file: %w", err)
+		}
+
+		// The range can start part way through the first block
+		_, err = io.CopyN(io.Discard, decrypted, start-first*decryptBlockSize)
+		if err != nil {
+			if storageErrorCode(err) == "NoSuchKey" {
+				return errNotFound
+			}
+			return fmt.Errorf("decrypt file: %w", err)
+		}
+	}
+
+	// The last package isn't there to be read unless the range goes to the
+	// end of the file, so the decryption has to stop at the end of the range
+	return streamDecrypted(w, io.LimitReader(decrypted, length))
+}
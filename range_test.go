@@ -0,0 +1,150 @@
+package filesrv
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetFileRange(t *testing.T) {
+	// A bit over three DARE packages
+	contents := make([]byte, 3*decryptBlockSize+1000)
+	rand.New(rand.NewSource(1)).Read(contents)
+	size := int64(len(contents))
+
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "file.bin", string(contents)))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	e, ok := s.catalog.get("file.bin")
+	require.True(t, ok)
+
+	tests := []struct {
+		name       string
+		rangeHdr   string
+		ifRange    string
+		wantStatus int
+		wantStart  int64
+		wantEnd    int64
+		// wantFetch is the offset and length of the encrypted range fetched
+		wantFetch [2]int64
+	}{
+		{name: "start", rangeHdr: "bytes=0-9", wantStatus: http.StatusPartialContent, wantStart: 0, wantEnd: 9, wantFetch: [2]int64{0, encryptedBlockSize}},
+		{name: "across blocks", rangeHdr: "bytes=65530-65545", wantStatus: http.StatusPartialContent, wantStart: 65530, wantEnd: 65545, wantFetch: [2]int64{0, 2 * encryptedBlockSize}},
+		{name: "middle block", rangeHdr: "bytes=140000-140099", wantStatus: http.StatusPartialContent, wantStart: 140000, wantEnd: 140099, wantFetch: [2]int64{2 * encryptedBlockSize, encryptedBlockSize}},
+		{name: "suffix", rangeHdr: "bytes=-100", wantStatus: http.StatusPartialContent, wantStart: size - 100, wantEnd: size - 1, wantFetch: [2]int64{3 * encryptedBlockSize, encryptedBlockSize}},
+		{name: "to the end", rangeHdr: "bytes=197000-", wantStatus: http.StatusPartialContent, wantStart: 197000, wantEnd: size - 1, wantFetch: [2]int64{3 * encryptedBlockSize, encryptedBlockSize}},
+		{name: "past the end", rangeHdr: "bytes=100-999999999", wantStatus: http.StatusPartialContent, wantStart: 100, wantEnd: size - 1, wantFetch: [2]int64{0, 4 * encryptedBlockSize}},
+		{name: "if-range matches", rangeHdr: "bytes=0-9", ifRange: strconv.Quote(e.SHA256), wantStatus: http.StatusPartialContent, wantStart: 0, wantEnd: 9, wantFetch: [2]int64{0, encryptedBlockSize}},
+		{name: "if-range doesn't match", rangeHdr: "bytes=0-9", ifRange: `"old"`, wantStatus: http.StatusOK},
+		{name: "several ranges", rangeHdr: "bytes=0-1,5-6", wantStatus: http.StatusOK},
+		{name: "unsatisfiable", rangeHdr: "bytes=999999-", wantStatus: http.StatusRequestedRangeNotSatisfiable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store.ranges = nil
+			r := httptest.NewRequest(http.MethodGet, "/file/file.bin", nil)
+			r.Header.Set("Range", test.rangeHdr)
+			if test.ifRange != "" {
+				r.Header.Set("If-Range", test.ifRange)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			resp := w.Result()
+			require.Equal(t, test.wantStatus, resp.StatusCode)
+			switch test.wantStatus {
+			case http.StatusOK:
+				require.Equal(t, contents, w.Body.Bytes())
+			case http.StatusRequestedRangeNotSatisfiable:
+				require.Equal(t, fmt.Sprintf("bytes */%d", size), resp.Header.Get("Content-Range"))
+			default:
+				require.Equal(t, contents[test.wantStart:test.wantEnd+1], w.Body.Bytes())
+				require.Equal(t, fmt.Sprintf("bytes %d-%d/%d", test.wantStart, test.wantEnd, size), resp.Header.Get("Content-Range"))
+				require.Equal(t, strconv.FormatInt(test.wantEnd-test.wantStart+1, 10), resp.Header.Get("Content-Length"))
+				require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+				require.Equal(t, [][2]int64{test.wantFetch}, store.ranges)
+			}
+		})
+	}
+}
+
+func TestGetFileRangeNotInCatalog(t *testing.T) {
+	const contents = "test file contents"
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	_, err := s.putFile(context.Background(), "raw.txt", strings.NewReader(contents), int64(len(contents)))
+	require.NoError(t, err)
+
+	for target, want := range map[string]int{"/file/raw.txt": http.StatusPartialContent, "/file/missing.txt": http.StatusNotFound} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Range", "bytes=5-8")
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, r)
+		require.Equal(t, want, w.Result().StatusCode, target)
+		if want == http.StatusPartialContent {
+			require.Equal(t, "file", w.Body.String())
+		}
+	}
+}
+
+func TestGetFileRangeStorageError(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newUploadRequest(t, "/upload", "gone.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.NoError(t, store.RemoveObject(context.Background(), "testBucket", "gone.txt"))
+
+	r := httptest.NewRequest(http.MethodGet, "/file/gone.txt?download=1", nil)
+	r.Header.Set("Range", "bytes=5-8")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	require.Empty(t, w.Header().Get("Content-Type"), "the error isn't sent as the file's type")
+	require.Empty(t, w.Header().Get("Content-Disposition"))
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		wantStart  int64
+		wantLength int64
+		wantErr    string
+	}{
+		{header: "bytes=0-0", wantStart: 0, wantLength: 1},
+		{header: "bytes=5-", wantStart: 5, wantLength: 95},
+		{header: "bytes=-5", wantStart: 95, wantLength: 5},
+		{header: "bytes=-500", wantStart: 0, wantLength: 100},
+		{header: "bytes=100-", wantErr: "range not satisfiable"},
+		{header: "bytes=-0", wantErr: "range not satisfiable"},
+		{header: "bytes=9-5", wantErr: `malformed range "bytes=9-5"`},
+		{header: "bytes=a-5", wantErr: `malformed range "bytes=a-5"`},
+		{header: "bytes=5", wantErr: `malformed range "bytes=5"`},
+		{header: "items=0-5", wantErr: `unsupported range "items=0-5"`},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			start, length, err := parseRange(test.header, 100)
+			if test.wantErr != "" {
+				require.EqualError(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantStart, start)
+			require.Equal(t, test.wantLength, length)
+		})
+	}
+}
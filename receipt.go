@@ -0,0 +1,166 @@
+package filesrv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// receiptHeader is the JWS protected header used for every receipt. Receipts
+// are only ever signed and verified by this server so HMAC is enough, and
+// pinning the algorithm means a receipt can't pick its own.
+var receiptHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// errInvalidReceipt is returned when a receipt is malformed or its signature
+// doesn't match
+var errInvalidReceipt = errors.New("invalid receipt")
+
+// receiptClaims is the signed payload of an upload receipt
+type receiptClaims struct {
+	Filename string `json:"name"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	// IssuedAt is when the upload was accepted, in seconds since the epoch
+	IssuedAt int64 `json:"iat"`
+}
+
+// signReceipt returns a compact JWS over the claims
+func signReceipt(key []byte, claims receiptClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("marshal claims: %w", err)
+	}
+
+	signingInput := receiptHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(receiptMAC(key, signingInput)), nil
+}
+
+// verifyReceipt checks the signature on a receipt and returns its claims
+func verifyReceipt(key []byte, receipt string) (receiptClaims, error) {
+	parts := strings.Split(receipt, ".")
+	if len(parts) != 3 || parts[0] != receiptHeader {
+		return receiptClaims{}, errInvalidReceipt
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return receiptClaims{}, errInvalidReceipt
+	}
+	if !hmac.Equal(sig, receiptMAC(key, parts[0]+"."+parts[1])) {
+		return receiptClaims{}, errInvalidReceipt
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return receiptClaims{}, errInvalidReceipt
+	}
+
+	var claims receiptClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return receiptClaims{}, errInvalidReceipt
+	}
+
+	return claims, nil
+}
+
+func receiptMAC(key []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// uploadResponse is the body returned for a successful upload
+type uploadResponse struct {
+	Filename string `json:"name"`
+	// OriginalName is set when the file was stored under a different name to
+	// the one it was uploaded with
+	OriginalName string `json:"originalName,omitempty"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+	// Tags were added to the file by the upload rules
+	Tags []string `json:"tags,omitempty"`
+	// ConsistencyToken can be sent in the X-Consistency-Token header when
+	// reading the file to make sure this version or a later one is served
+	ConsistencyToken string `json:"consistencyToken"`
+	// Receipt can be presented to POST /receipt/verify later on to prove the
+	// server accepted this file
+	Receipt string `json:"receipt"`
+}
+
+// writeUploadResponse signs a receipt for the stored file and writes it out
+// along with the file details
+func (s server) writeUploadResponse(w http.ResponseWriter, stored storedFile) {
+	resp := s.newUploadResponse(stored)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(consistencyHeader, resp.ConsistencyToken)
+	w.WriteHeader(http.StatusCreated)
+
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("encode upload response:", err)
+	}
+}
+
+// newUploadResponse signs a receipt for the stored file and returns it along
+// with the file details
+func (s server) newUploadResponse(stored storedFile) uploadResponse {
+	receipt, err := signReceipt(s.receiptKey, receiptClaims{
+		Filename: stored.Name,
+		SHA256:   stored.SHA256,
+		Size:     stored.Size,
+		IssuedAt: time.Now().Unix(),
+	})
+	if err != nil {
+		// The file is already stored so this is still a success, the client
+		// just doesn't get a receipt
+		log.Println("sign receipt:", err)
+	}
+
+	resp := uploadResponse{
+		Filename:         stored.Name,
+		Size:             stored.Size,
+		SHA256:           stored.SHA256,
+		Tags:             stored.Tags,
+		ConsistencyToken: s.consistencyToken(),
+		Receipt:          receipt,
+	}
+	if stored.OriginalName != stored.Name {
+		resp.OriginalName = stored.OriginalName
+	}
+
+	return resp
+}
+
+// handlePostVerifyReceipt checks the receipt in the request body and returns
+// its claims if it was signed by this server
+func (s server) handlePostVerifyReceipt(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64<<10))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("read receipt:", err)
+		return
+	}
+
+	claims, err := verifyReceipt(s.receiptKey, strings.TrimSpace(string(body)))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(claims)
+	if err != nil {
+		log.Println("encode receipt claims:", err)
+	}
+}
@@ -0,0 +1,77 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePostVerifyReceipt(t *testing.T) {
+	claims := receiptClaims{
+		Filename: "testFileName.txt",
+		SHA256:   "c4fa968a745586faaa030054f51fb1cafd5e9ae25fa6b137ac6477715fdc81b1",
+		Size:     18,
+		IssuedAt: 1700000000,
+	}
+
+	receipt, err := signReceipt([]byte("key"), claims)
+	require.NoError(t, err)
+
+	otherKeyReceipt, err := signReceipt([]byte("another key"), claims)
+	require.NoError(t, err)
+
+	parts := strings.Split(receipt, ".")
+	tampered := parts[0] + "." + strings.TrimSuffix(parts[1], "fQ") + "." + parts[2]
+
+	tests := []struct {
+		name       string
+		receipt    string
+		wantStatus int
+	}{
+		{
+			name:       "should work",
+			receipt:    receipt + "\n",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "signed with another key",
+			receipt:    otherKeyReceipt,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "tampered payload",
+			receipt:    tampered,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed",
+			receipt:    "not a receipt",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(mockObjStore{}, "testBucket", "key", 10<<17)
+			s.receiptKey = []byte("key")
+
+			req := httptest.NewRequest(http.MethodPost, "/receipt/verify", strings.NewReader(test.receipt))
+			w := httptest.NewRecorder()
+
+			s.handlePostVerifyReceipt(w, req, nil)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+
+			var got receiptClaims
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			require.Equal(t, claims, got)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package filesrv
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sync/atomic"
+)
+
+// redacted replaces the values hidden by the redaction rules
+const redacted = "[redacted]"
+
+// redactionRule hides sensitive values from the logs and canary alerts, for
+// deployments where even the names of files are regulated data. Filenames
+// are regular expressions, any word in a log line that matches one is hidden,
+// so names with spaces in can only be partly matched. The values of metadata
+// keys are hidden wherever they're written as key=value, key: value or as
+// JSON, ignoring case, and query parameters wherever they're in a query
+// string.
+type redactionRule struct {
+	Name         string   `yaml:"name"`
+	Filenames    []string `yaml:"filenames"`
+	MetadataKeys []string `yaml:"metadata-keys"`
+	QueryParams  []string `yaml:"query-params"`
+}
+
+// redactor applies the redaction rules
+type redactor struct {
+	filenames []*regexp.Regexp
+	// values match a key and its value, the first group is kept and the
+	// second is the value that's hidden
+	values []*regexp.Regexp
+}
+
+// logWord is what counts as a word when looking for filenames, filenames in
+// the logs are set off by spaces, commas or quotes
+var logWord = regexp.MustCompile(`[^\s,"]+`)
+
+// compileRedactions compiles the redaction rules, reporting every problem
+// with them together
+func compileRedactions(rules []redactionRule) (*redactor, error) {
+	r := &redactor{}
+	var errs []error
+	for i, rule := range rules {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(redactionsSection, i, "redaction %d (%s): %s", i+1, rule.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if len(rule.Filenames) == 0 && len(rule.MetadataKeys) == 0 && len(rule.QueryParams) == 0 {
+			fail("there's nothing to redact")
+		}
+		for _, pattern := range rule.Filenames {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				fail("filenames: %s", err)
+				continue
+			}
+			r.filenames = append(r.filenames, re)
+		}
+		for _, key := range rule.MetadataKeys {
+			if key == "" {
+				fail("metadata key is empty")
+				continue
+			}
+			r.values = append(r.values, regexp.MustCompile(`(?i)((?:^|[^\w-])"?`+regexp.QuoteMeta(key)+`"?\s*[:=]\s*\[?"?)([^"\s,&\]}]*)`))
+		}
+		for _, param := range rule.QueryParams {
+			if param == "" {
+				fail("query parameter is empty")
+				continue
+			}
+			r.values = append(r.values, regexp.MustCompile(`((?:^|[?&\s"])`+regexp.QuoteMeta(param)+`=)([^&\s"]*)`))
+		}
+	}
+
+	return r, errors.Join(errs...)
+}
+
+// newRedactor returns the redactor for rules that have been validated, or nil
+// if there aren't any
+func newRedactor(rules []redactionRule) *redactor {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	r, _ := compileRedactions(rules)
+	return r
+}
+
+// validateRedactions checks the redaction rules
+func validateRedactions(rules []redactionRule) error {
+	_, err := compileRedactions(rules)
+	return err
+}
+
+// redact hides everything the rules match in s
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+
+	if len(r.filenames) > 0 {
+		s = logWord.ReplaceAllStringFunc(s, func(word string) string {
+			for _, re := range r.filenames {
+				if re.MatchString(word) {
+					return redacted
+				}
+			}
+			return word
+		})
+	}
+	for _, re := range r.values {
+		s = re.ReplaceAllString(s, "${1}"+redacted)
+	}
+
+	return s
+}
+
+// redactingWriter redacts the log lines written to it with the current
+// rules, the log package writes each line in one go
+type redactingWriter struct {
+	w    io.Writer
+	live *atomic.Pointer[reloadable]
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	r := rw.live.Load().redactor
+	if r == nil {
+		return rw.w.Write(p)
+	}
+
+	_, err := io.WriteString(rw.w, r.redact(string(p)))
+	return len(p), err
+}
@@ -0,0 +1,55 @@
+package filesrv
+
+import (
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	r, err := compileRedactions([]redactionRule{{
+		Filenames:    []string{`^patient-\d+`},
+		MetadataKeys: []string{"X-Amz-Meta-Patient"},
+		QueryParams:  []string{"token"},
+	}})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "filename", in: "put file: patient-1234.pdf: access denied", want: "put file: [redacted] access denied"},
+		{name: "quoted filename", in: `stored "patient-99.png", 10 bytes`, want: `stored "[redacted]", 10 bytes`},
+		{name: "other filename", in: "put file: report.pdf", want: "put file: report.pdf"},
+		{name: "metadata header", in: "metadata x-amz-meta-patient=jane", want: "metadata x-amz-meta-patient=[redacted]"},
+		{name: "metadata JSON", in: `{"X-Amz-Meta-Patient":["Jane"],"Size":"10"}`, want: `{"X-Amz-Meta-Patient":["[redacted]"],"Size":"10"}`},
+		{name: "query", in: "GET /file/a?token=abc&w=10", want: "GET /file/a?token=[redacted]&w=10"},
+		{name: "other query", in: "GET /file/a?mytoken=abc", want: "GET /file/a?mytoken=abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, r.redact(tt.in))
+		})
+	}
+
+	require.Equal(t, "patient-1", (*redactor)(nil).redact("patient-1"))
+}
+
+func TestRedactingWriter(t *testing.T) {
+	cfg := defaultConfig()
+	live := newLiveSettings(cfg)
+
+	var out strings.Builder
+	l := log.New(redactingWriter{w: &out, live: live}, "", 0)
+	l.Println("get file: secret.txt")
+
+	cfg.Redactions = []redactionRule{{Filenames: []string{`^secret`}}}
+	live.Store(newReloadable(cfg))
+	l.Println("get file: secret.txt")
+
+	require.Equal(t, "get file: secret.txt\nget file: [redacted]\n", out.String())
+}
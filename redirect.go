@@ -0,0 +1,59 @@
+package filesrv
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// encryptionMode records how an object is protected in the bucket
+type encryptionMode string
+
+const (
+	// encryptionSIO objects were encrypted by filesrv with a key derived from
+	// the server key, this is what every upload gets
+	encryptionSIO encryptionMode = "sio"
+	// encryptionNone objects are stored as plaintext
+	encryptionNone encryptionMode = "none"
+	// encryptionSSE objects are encrypted by minio with server side
+	// encryption, minio decrypts them when they're read
+	encryptionSSE encryptionMode = "sse"
+)
+
+// presignedURLExpiry is how long a redirect to minio is valid for, it only
+// needs to last long enough for the client to follow it
+const presignedURLExpiry = 5 * time.Minute
+
+// appEncrypted says whether filesrv has to decrypt the object itself. Objects
+// the catalog doesn't know about are assumed to have been uploaded through
+// filesrv.
+func (s server) appEncrypted(filename string) bool {
+	e, ok := s.catalog.get(filename)
+	return !ok || e.appEncrypted()
+}
+
+// appEncrypted says whether filesrv encrypted the file
+func (e catalogEntry) appEncrypted() bool {
+	return e.Encryption == "" || e.Encryption == encryptionSIO
+}
+
+// redirectToStorage sends the client to a short lived presigned minio URL for
+// the object, so large downloads don't have to pass through filesrv. This only
+// works for objects that minio can hand out as plaintext, for the rest it
+// returns false without writing anything and the file should be served as
+// normal.
+func (s server) redirectToStorage(w http.ResponseWriter, r *http.Request, filename string) bool {
+	if s.appEncrypted(filename) {
+		return false
+	}
+
+	u, err := s.minioClient.PresignedGetObject(r.Context(), s.bucketName, filename, presignedURLExpiry)
+	if err != nil {
+		// The file can still be served through filesrv
+		log.Println("presign get object:", err)
+		return false
+	}
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return true
+}
@@ -0,0 +1,80 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetFileRedirect(t *testing.T) {
+	tests := []struct {
+		name         string
+		encryption   encryptionMode
+		target       string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{
+			name:         "plaintext object",
+			encryption:   encryptionNone,
+			target:       "/file/filename?redirect=true",
+			wantStatus:   http.StatusFound,
+			wantLocation: "http://minio:9000/testBucket/filename?X-Amz-Signature=sig",
+		},
+		{
+			name:         "sse object",
+			encryption:   encryptionSSE,
+			target:       "/file/filename?redirect=true",
+			wantStatus:   http.StatusFound,
+			wantLocation: "http://minio:9000/testBucket/filename?X-Amz-Signature=sig",
+		},
+		{
+			name:       "plaintext object without redirect",
+			encryption: encryptionNone,
+			target:     "/file/filename",
+			wantStatus: http.StatusOK,
+			wantBody:   "test file contents",
+		},
+		{
+			name:       "encrypted by filesrv",
+			encryption: encryptionSIO,
+			target:     "/file/filename?redirect=true",
+			wantStatus: http.StatusOK,
+			wantBody:   "test file contents",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			s := NewServer(store, "testBucket", "key", 10<<17)
+
+			contents := strings.NewReader("test file contents")
+			if test.encryption == encryptionSIO {
+				_, err := s.putFile(context.Background(), "filename", contents, contents.Size())
+				require.NoError(t, err)
+			} else {
+				_, err := store.PutObject(context.Background(), "testBucket", "filename", contents, contents.Size(), 0)
+				require.NoError(t, err)
+			}
+			s.catalog.put(catalogEntry{Name: "filename", Encryption: test.encryption})
+
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			w := httptest.NewRecorder()
+
+			s.handleGetFile(w, req, httprouter.Params{{Key: "filename", Value: "filename"}})
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			require.Equal(t, test.wantLocation, w.Result().Header.Get("Location"))
+			if test.wantBody != "" {
+				require.Equal(t, test.wantBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// regionHeader lets the client pick the region an upload is stored in
+const regionHeader = "X-Filesrv-Region"
+
+// Ways of placing an upload in a region, given in -placement in the order
+// they're tried
+const (
+	placeByHeader = "header"
+	placeByTenant = "tenant"
+	placeByGeoIP  = "geoip"
+)
+
+// regionConfig is another minio endpoint that uploads can be stored in. The
+// buckets are the same as in the main one. Countries and Tenants are what
+// the geoip and tenant placement go on.
+type regionConfig struct {
+	Name            string   `yaml:"name"`
+	MinioEndpoint   string   `yaml:"minio-endpoint"`
+	MinioSecure     bool     `yaml:"minio-secure"`
+	AccessKeyID     string   `yaml:"minio-access-key"`
+	SecretAccessKey string   `yaml:"minio-secret-key"`
+	Countries       []string `yaml:"countries"`
+	Tenants         []string `yaml:"tenants"`
+}
+
+// validateRegions checks the regions and the placement that picks between
+// them
+func (c config) validateRegions() error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, r := range c.Regions {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(regionsSection, i, "region %d (%s): %s", i+1, r.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if r.Name == "" {
+			fail("name is empty")
+		}
+		if seen[r.Name] {
+			fail("defined more than once")
+		}
+		seen[r.Name] = true
+		if r.MinioEndpoint == "" {
+			fail("minio endpoint is empty")
+		}
+		if (r.AccessKeyID == "") != (r.SecretAccessKey == "") {
+			fail("set both minio keys or neither")
+		}
+	}
+
+	for _, source := range splitList(c.Placement) {
+		switch source {
+		case placeByHeader, placeByTenant:
+		case placeByGeoIP:
+			if c.GeoIPDB == "" {
+				errs = append(errs, settingProblem("geoip-db", "geoip placement needs a geoip database"))
+			}
+		default:
+			errs = append(errs, settingProblem("placement", "unknown placement %q, expected header, tenant or geoip", source))
+		}
+	}
+	if c.Placement != "" && len(c.Regions) == 0 {
+		errs = append(errs, settingProblem("placement", "placement needs regions to place uploads in"))
+	}
+	if c.Dev && len(c.Regions) > 0 {
+		errs = append(errs, settingProblem("dev", "regions need minio, they can't be used in dev mode"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// forRegion returns the config for connecting to a region's minio
+func (c config) forRegion(r regionConfig) config {
+	c.MinioEndpoint = r.MinioEndpoint
+	c.MinioSecure = r.MinioSecure
+	if r.AccessKeyID != "" {
+		c.AccessKeyID = r.AccessKeyID
+		c.SecretAccessKey = r.SecretAccessKey
+	}
+
+	return c
+}
+
+// placement decides which region uploads are stored in
+type placement struct {
+	sources []string
+	regions []regionConfig
+	geoIP   *geoIP
+}
+
+// withGeoIP sets the database used by the geoip placement and the download
+// rules, and turns on placing uploads in regions, for every bucket. geo is
+// nil if there's no database.
+func (s server) withGeoIP(cfg config, geo *geoIP) server {
+	s.geoIP = geo
+	if len(cfg.Regions) > 0 {
+		s.placement = &placement{sources: splitList(cfg.Placement), regions: cfg.Regions, geoIP: geo}
+	}
+	for name, bs := range s.buckets {
+		bs.geoIP = s.geoIP
+		bs.placement = s.placement
+		s.buckets[name] = bs
+	}
+
+	return s
+}
+
+// errUnknownRegion is returned when the client asks for a region that isn't
+// configured
+var errUnknownRegion = errors.New("unknown region")
+
+// region returns the region to store an upload in, an empty string is the
+// main minio
+func (p *placement) region(r *http.Request) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+
+	for _, source := range p.sources {
+		switch source {
+		case placeByHeader:
+			name := r.Header.Get(regionHeader)
+			if name == "" {
+				continue
+			}
+			for _, region := range p.regions {
+				if region.Name == name {
+					return name, nil
+				}
+			}
+			return "", fmt.Errorf("%w %q", errUnknownRegion, name)
+		case placeByTenant:
+			tenant := requestIdentity(r)
+			for _, region := range p.regions {
+				if contains(region.Tenants, tenant) {
+					return region.Name, nil
+				}
+			}
+		case placeByGeoIP:
+			ip, err := netip.ParseAddr(requestIP(r))
+			if err != nil {
+				continue
+			}
+			country, err := p.geoIP.country(ip)
+			if err != nil {
+				continue
+			}
+			for _, region := range p.regions {
+				if contains(region.Countries, country) {
+					return region.Name, nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
+
+type regionKey struct{}
+
+// withRegion returns a context for storing a file in region
+func withRegion(ctx context.Context, region string) context.Context {
+	return context.WithValue(ctx, regionKey{}, region)
+}
+
+// regionalStore is an objStorer spread over the main minio and the regions.
+// New objects go to the region in the context, or the main minio if there
+// isn't one. Everything else goes to wherever the catalog says the object
+// is, so reads follow the file to its region.
+type regionalStore struct {
+	home    objStorer
+	regions map[string]objStorer
+
+	mu       sync.RWMutex
+	catalogs map[string]*catalog
+}
+
+func newRegionalStore(home objStorer, regions map[string]objStorer) *regionalStore {
+	return &regionalStore{home: home, regions: regions, catalogs: map[string]*catalog{}}
+}
+
+// track has the objects in bucketName found using c
+func (rs *regionalStore) track(bucketName string, c *catalog) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.catalogs[bucketName] = c
+}
+
+// located returns the region the catalog has an object in, and whether the
+// catalog has it at all
+func (rs *regionalStore) located(bucketName, filename string) (string, bool) {
+	rs.mu.RLock()
+	c := rs.catalogs[bucketName]
+	rs.mu.RUnlock()
+	if c == nil {
+		return "", false
+	}
+
+	e, ok := c.get(filename)
+	return e.Region, ok
+}
+
+// storeFor returns the store an existing object is in
+func (rs *regionalStore) storeFor(bucketName, filename string) objStorer {
+	region, _ := rs.located(bucketName, filename)
+	return rs.store(region)
+}
+
+// store returns the store for a region, the main one for an empty name
+func (rs *regionalStore) store(region string) objStorer {
+	if s, ok := rs.regions[region]; ok {
+		return s
+	}
+	return rs.home
+}
+
+// all returns every store, the main one first
+func (rs *regionalStore) all() []objStorer {
+	names := make([]string, 0, len(rs.regions))
+	for name := range rs.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stores := []objStorer{rs.home}
+	for _, name := range names {
+		stores = append(stores, rs.regions[name])
+	}
+	return stores
+}
+
+func (rs *regionalStore) PutObject(ctx context.Context, bucketName, filename string, file io.Reader, size, chunkSize int64) (minio.UploadInfo, error) {
+	region, _ := ctx.Value(regionKey{}).(string)
+	prev, known := rs.located(bucketName, filename)
+
+	info, err := rs.store(region).PutObject(ctx, bucketName, filename, file, size, chunkSize)
+	if err != nil {
+		return info, err
+	}
+
+	// The old version would be left behind in the other region otherwise
+	if known && prev != region {
+		err := rs.store(prev).RemoveObject(ctx, bucketName, filename)
+		if err != nil {
+			log.Printf("remove old version from region %q: filename: %s, error: %s", prev, filename, err)
+		}
+	}
+
+	return info, nil
+}
+
+// NewMultipartUpload starts the upload in the region in the context, like
+// PutObject. The parts and completing it have to have the same region.
+func (rs *regionalStore) NewMultipartUpload(ctx context.Context, bucketName, filename string) (string, error) {
+	region, _ := ctx.Value(regionKey{}).(string)
+	return rs.store(region).NewMultipartUpload(ctx, bucketName, filename)
+}
+
+func (rs *regionalStore) PutObjectPart(ctx context.Context, bucketName, filename, uploadID string, partNumber int, data io.Reader, size int64) (minio.ObjectPart, error) {
+	region, _ := ctx.Value(regionKey{}).(string)
+	return rs.store(region).PutObjectPart(ctx, bucketName, filename, uploadID, partNumber, data, size)
+}
+
+func (rs *regionalStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	region, _ := ctx.Value(regionKey{}).(string)
+	prev, known := rs.located(bucketName, filename)
+
+	info, err := rs.store(region).CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts)
+	if err != nil {
+		return info, err
+	}
+
+	if known && prev != region {
+		err := rs.store(prev).RemoveObject(ctx, bucketName, filename)
+		if err != nil {
+			log.Printf("remove old version from region %q: filename: %s, error: %s", prev, filename, err)
+		}
+	}
+
+	return info, nil
+}
+
+// GetObject reads from the region in the context if there is one, so an
+// object can be read back before the catalog knows where it is
+func (rs *regionalStore) GetObject(ctx context.Context, bucketName, filename string) (io.ReadCloser, error) {
+	if region, ok := ctx.Value(regionKey{}).(string); ok {
+		return rs.store(region).GetObject(ctx, bucketName, filename)
+	}
+	return rs.storeFor(bucketName, filename).GetObject(ctx, bucketName, filename)
+}
+
+func (rs *regionalStore) GetObjectRange(ctx context.Context, bucketName, filename string, offset, length int64) (io.ReadCloser, error) {
+	return rs.storeFor(bucketName, filename).GetObjectRange(ctx, bucketName, filename, offset, length)
+}
+
+func (rs *regionalStore) RemoveObject(ctx context.Context, bucketName, filename string) error {
+	return rs.storeFor(bucketName, filename).RemoveObject(ctx, bucketName, filename)
+}
+
+// RemoveObjects removes the objects from each region in one go
+func (rs *regionalStore) RemoveObjects(ctx context.Context, bucketName string, filenames []string) map[string]error {
+	byStore := map[objStorer][]string{}
+	for _, filename := range filenames {
+		store := rs.storeFor(bucketName, filename)
+		byStore[store] = append(byStore[store], filename)
+	}
+
+	errs := map[string]error{}
+	for store, names := range byStore {
+		for filename, err := range store.RemoveObjects(ctx, bucketName, names) {
+			errs[filename] = err
+		}
+	}
+
+	return errs
+}
+
+func (rs *regionalStore) StatObject(ctx context.Context, bucketName, filename string) (minio.ObjectInfo, error) {
+	return rs.storeFor(bucketName, filename).StatObject(ctx, bucketName, filename)
+}
+
+func (rs *regionalStore) PresignedGetObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	return rs.storeFor(bucketName, filename).PresignedGetObject(ctx, bucketName, filename, expires)
+}
+
+func (rs *regionalStore) PresignedPutObject(ctx context.Context, bucketName, filename string, expires time.Duration) (*url.URL, error) {
+	return rs.storeFor(bucketName, filename).PresignedPutObject(ctx, bucketName, filename, expires)
+}
+
+func (rs *regionalStore) PutObjectTagging(ctx context.Context, bucketName, filename string, tags map[string]string) error {
+	return rs.storeFor(bucketName, filename).PutObjectTagging(ctx, bucketName, filename, tags)
+}
+
+func (rs *regionalStore) ReplaceObjectMetadata(ctx context.Context, bucketName, filename string) error {
+	return rs.storeFor(bucketName, filename).ReplaceObjectMetadata(ctx, bucketName, filename)
+}
+
+// ListObjects lists the objects in every region
+func (rs *regionalStore) ListObjects(ctx context.Context, bucketName, prefix string) ([]minio.ObjectInfo, error) {
+	var objects []minio.ObjectInfo
+	for _, s := range rs.all() {
+		found, err := s.ListObjects(ctx, bucketName, prefix)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, found...)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+// ListIncompleteUploads lists the incomplete uploads in every region
+func (rs *regionalStore) ListIncompleteUploads(ctx context.Context, bucketName, prefix string) ([]minio.ObjectMultipartInfo, error) {
+	var uploads []minio.ObjectMultipartInfo
+	for _, s := range rs.all() {
+		found, err := s.ListIncompleteUploads(ctx, bucketName, prefix)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, found...)
+	}
+
+	return uploads, nil
+}
+
+// AbortMultipartUpload aborts the upload in whichever region has it, upload
+// IDs are only known to the minio that issued them
+func (rs *regionalStore) AbortMultipartUpload(ctx context.Context, bucketName, filename, uploadID string) error {
+	var err error
+	for _, s := range rs.all() {
+		err = s.AbortMultipartUpload(ctx, bucketName, filename, uploadID)
+		if storageErrorCode(err) != "NoSuchUpload" {
+			return err
+		}
+	}
+
+	return err
+}
+
+// regionNames lists the configured regions for the log
+func regionNames(regions []regionConfig) string {
+	names := make([]string, 0, len(regions))
+	for _, r := range regions {
+		names = append(names, r.Name)
+	}
+	return strings.Join(names, ", ")
+}
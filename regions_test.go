@@ -0,0 +1,151 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlacementRegion(t *testing.T) {
+	geo, err := openGeoIP(writeTestGeoIP(t, map[string]string{"203.0.113.0/24": "DE"}))
+	require.NoError(t, err)
+
+	p := &placement{
+		sources: []string{placeByHeader, placeByTenant, placeByGeoIP},
+		regions: []regionConfig{
+			{Name: "eu", Countries: []string{"DE", "FR"}},
+			{Name: "us", Tenants: []string{"bob"}},
+		},
+		geoIP: geo,
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		user    string
+		ip      string
+		want    string
+		wantErr error
+	}{
+		{name: "nothing matches", ip: "192.0.2.1"},
+		{name: "header", header: "us", ip: "203.0.113.1", want: "us"},
+		{name: "unknown header", header: "mars", wantErr: errUnknownRegion},
+		{name: "tenant before geoip", user: "bob", ip: "203.0.113.1", want: "us"},
+		{name: "geoip", user: "alice", ip: "203.0.113.1", want: "eu"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if test.ip != "" {
+				r.RemoteAddr = test.ip + ":1234"
+			}
+			if test.header != "" {
+				r.Header.Set(regionHeader, test.header)
+			}
+			if test.user != "" {
+				r.Header.Set(identityHeader, test.user)
+			}
+
+			got, err := p.region(r)
+			require.ErrorIs(t, err, test.wantErr)
+			require.Equal(t, test.want, got)
+		})
+	}
+
+	// Without placement everything goes to the main minio
+	got, err := (*placement)(nil).region(httptest.NewRequest(http.MethodPost, "/upload", nil))
+	require.NoError(t, err)
+	require.Empty(t, got)
+}
+
+func TestRegionalUploads(t *testing.T) {
+	home, eu := newMemObjStore(), newMemObjStore()
+	store := newRegionalStore(home, map[string]objStorer{"eu": eu})
+
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.Regions = []regionConfig{{Name: "eu", MinioEndpoint: "eu.example.com:9000"}}
+	cfg.Placement = placeByHeader
+	s := newServerFromConfig(store, cfg).withGeoIP(cfg, nil)
+	store.track(s.bucketName, s.catalog)
+	handler := s.routes()
+
+	has := func(m *memObjStore, name string) bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		_, ok := m.objects["testBucket/"+name]
+		return ok
+	}
+	upload := func(region string) {
+		r := newUploadRequest(t, "/upload", "report.pdf", "test file contents")
+		if region != "" {
+			r.Header.Set(regionHeader, region)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	}
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/report.pdf", nil))
+		return w
+	}
+
+	upload("eu")
+	require.True(t, has(eu, "report.pdf"))
+	require.False(t, has(home, "report.pdf"))
+	e, _ := s.catalog.get("report.pdf")
+	require.Equal(t, "eu", e.Region)
+
+	// Reads go to the region the catalog has the file in
+	w := get()
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "test file contents", w.Body.String())
+
+	// The catalog itself stays in the main minio
+	require.True(t, has(home, catalogObject))
+
+	// A new version somewhere else doesn't leave the old one behind
+	upload("")
+	require.True(t, has(home, "report.pdf"))
+	require.False(t, has(eu, "report.pdf"))
+	require.Equal(t, http.StatusOK, get().Result().StatusCode)
+
+	upload("eu")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/file/report.pdf", nil))
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.False(t, has(eu, "report.pdf"))
+	require.False(t, has(home, "report.pdf"))
+
+	w = httptest.NewRecorder()
+	r := newUploadRequest(t, "/upload", "report.pdf", "test file contents")
+	r.Header.Set(regionHeader, "mars")
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestValidateRegions(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Regions = []regionConfig{
+		{Name: "eu", MinioEndpoint: "eu.example.com:9000"},
+		{Name: "eu", AccessKeyID: "key"},
+	}
+	cfg.Placement = "geoip,nearest"
+
+	err := cfg.validateRegions()
+	require.ErrorContains(t, err, "region 2 (eu): defined more than once")
+	require.ErrorContains(t, err, "region 2 (eu): minio endpoint is empty")
+	require.ErrorContains(t, err, "region 2 (eu): set both minio keys or neither")
+	require.ErrorContains(t, err, "geoip placement needs a geoip database")
+	require.ErrorContains(t, err, `unknown placement "nearest"`)
+
+	cfg = defaultConfig()
+	cfg.Placement = placeByHeader
+	require.ErrorContains(t, cfg.validateRegions(), "placement needs regions")
+}
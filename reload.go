@@ -0,0 +1,162 @@
+package filesrv
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// reloadable are the settings that can be changed without restarting the
+// server. They're swapped in all at once, so a request sees either the old
+// settings or the new ones, never a mix.
+type reloadable struct {
+	policy uploadPolicy
+	naming namingStrategy
+	rules  []uploadRule
+
+	activeContent activeContentPolicy
+
+	downloadRules []downloadRule
+	dropBoxes     []dropBox
+	slos          []sloTarget
+	// redactor is nil if there aren't any redaction rules
+	redactor    *redactor
+	headerRules []headerRule
+	// tiers is nil if there aren't any
+	tiers *tenantTiers
+}
+
+func newReloadable(cfg config) *reloadable {
+	return &reloadable{
+		policy: uploadPolicy{MaxSize: cfg.MaxUploadSize},
+		naming: cfg.Naming,
+		rules:  cfg.Rules,
+
+		activeContent: cfg.ActiveContent,
+
+		downloadRules: cfg.DownloadRules,
+		dropBoxes:     cfg.DropBoxes,
+		slos:          cfg.SLOs,
+		redactor:      newRedactor(cfg.Redactions),
+		headerRules:   cfg.ResponseHeaders,
+		tiers:         newTenantTiers(cfg.Tiers),
+	}
+}
+
+// reloadableFlags are the settings with flags that reload picks up. The
+// rules, download-rules, drop-boxes, slos, redactions, response-headers and
+// tiers sections are reloaded too, everything else needs a restart.
+var reloadableFlags = []string{"max-upload-size", "naming", "active-content"}
+
+// restartNeeded returns the settings that are different in next but only
+// take effect when the server starts, by flag or section name
+func restartNeeded(prev, next config) []string {
+	var changed []string
+	prevFlags, nextFlags := prev.flagSet(io.Discard), next.flagSet(io.Discard)
+	prevFlags.VisitAll(func(f *flag.Flag) {
+		if !contains(reloadableFlags, f.Name) && f.Value.String() != nextFlags.Lookup(f.Name).Value.String() {
+			changed = append(changed, f.Name)
+		}
+	})
+
+	sections := []struct {
+		name       string
+		prev, next any
+	}{
+		{bucketsSection, prev.Buckets, next.Buckets},
+		{regionsSection, prev.Regions, next.Regions},
+		{queuesSection, prev.Queues, next.Queues},
+		{authSection, prev.Auth, next.Auth},
+		{pipelinesSection, prev.Pipelines, next.Pipelines},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.prev, section.next) {
+			changed = append(changed, section.name)
+		}
+	}
+
+	return changed
+}
+
+// newLiveSettings returns the holder for the reloadable settings shared by
+// every copy of the server
+func newLiveSettings(cfg config) *atomic.Pointer[reloadable] {
+	p := &atomic.Pointer[reloadable]{}
+	p.Store(newReloadable(cfg))
+	return p
+}
+
+// settings returns the current reloadable settings, they mustn't be changed
+// once the server is running
+func (s server) settings() *reloadable {
+	return s.live.Load()
+}
+
+// reload swaps in the reloadable settings from cfg. Everything else in cfg is
+// ignored, the listener, storage and keys are only read at startup.
+func (s server) reload(cfg config) {
+	next := newReloadable(cfg)
+	prev := s.live.Swap(next)
+
+	if prev.policy.MaxSize != next.policy.MaxSize {
+		log.Printf("reload: max-upload-size: %d -> %d", prev.policy.MaxSize, next.policy.MaxSize)
+	}
+	if prev.naming != next.naming {
+		log.Printf("reload: naming: %s -> %s", prev.naming, next.naming)
+	}
+	if prev.activeContent != next.activeContent {
+		log.Printf("reload: active-content: %s -> %s", prev.activeContent, next.activeContent)
+	}
+	if !reflect.DeepEqual(prev.rules, next.rules) {
+		log.Printf("reload: rules: %d -> %d rules", len(prev.rules), len(next.rules))
+	}
+	if !reflect.DeepEqual(prev.downloadRules, next.downloadRules) {
+		log.Printf("reload: download rules: %d -> %d rules", len(prev.downloadRules), len(next.downloadRules))
+	}
+	if !reflect.DeepEqual(prev.dropBoxes, next.dropBoxes) {
+		log.Printf("reload: drop boxes: %d -> %d boxes", len(prev.dropBoxes), len(next.dropBoxes))
+	}
+	if !reflect.DeepEqual(prev.redactor, next.redactor) {
+		log.Println("reload: redactions changed")
+	}
+	if !reflect.DeepEqual(prev.slos, next.slos) {
+		log.Printf("reload: slos: %d -> %d targets", len(prev.slos), len(next.slos))
+	}
+	if !reflect.DeepEqual(prev.headerRules, next.headerRules) {
+		log.Printf("reload: response headers: %d -> %d rules", len(prev.headerRules), len(next.headerRules))
+	}
+	if prevTiers, nextTiers := prev.tiers.configs(), next.tiers.configs(); !reflect.DeepEqual(prevTiers, nextTiers) {
+		log.Printf("reload: tiers: %d -> %d tiers", len(prevTiers), len(nextTiers))
+	}
+}
+
+// reloadOnSignal reloads the config with load every time a signal arrives,
+// until ctx is done. current is the config the server was started with. A
+// config that doesn't load, or that changes settings that need a restart,
+// leaves the settings as they were.
+func (s server) reloadOnSignal(ctx context.Context, signals <-chan os.Signal, current config, load func() (config, error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			cfg, err := load()
+			if err != nil {
+				log.Println("reload config:", err)
+				continue
+			}
+			if changed := restartNeeded(current, cfg); len(changed) > 0 {
+				log.Printf("reload config: %s can't be changed without a restart", strings.Join(changed, ", "))
+				continue
+			}
+			s.reload(cfg)
+			current = cfg
+			log.Println("reloaded config")
+		}
+	}
+}
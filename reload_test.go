@@ -0,0 +1,96 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	upload := func() int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", "test.txt", "test file contents"))
+		return w.Result().StatusCode
+	}
+	require.Equal(t, http.StatusCreated, upload())
+
+	// The handler was built before the reload, it still has to pick up the
+	// new settings
+	cfg := defaultConfig()
+	cfg.MaxUploadSize = 4
+	cfg.Naming = namingRandom
+	s.reload(cfg)
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, upload())
+	require.Equal(t, namingRandom, s.settings().naming)
+
+	// The rate limits in the tiers are reloaded too
+	cfg.Tiers = []tierConfig{{Name: "free", Default: true, UploadRate: 1 << 20, DownloadRate: 4 << 20}}
+	s.reload(cfg)
+	require.Equal(t, cfg.Tiers, s.settings().tiers.configs())
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal)
+	loads := make(chan error)
+	cfg := defaultConfig()
+	cfg.MaxUploadSize = 4
+	go s.reloadOnSignal(ctx, signals, defaultConfig(), func() (config, error) {
+		err := <-loads
+		return cfg, err
+	})
+
+	// A bad config is ignored
+	signals <- syscall.SIGHUP
+	loads <- errors.New("bad config")
+	signals <- syscall.SIGHUP
+	require.Equal(t, defaultConfig().MaxUploadSize, s.settings().policy.MaxSize)
+
+	loads <- nil
+	require.Eventually(t, func() bool {
+		return s.settings().policy.MaxSize == 4
+	}, time.Second, time.Millisecond)
+
+	// So is one that changes settings that need a restart
+	cfg.MaxUploadSize = 8
+	cfg.EncryptionKey = "another key"
+	signals <- syscall.SIGHUP
+	loads <- nil
+	signals <- syscall.SIGHUP
+	require.Equal(t, int64(4), s.settings().policy.MaxSize)
+
+	cfg.EncryptionKey = defaultConfig().EncryptionKey
+	loads <- nil
+	require.Eventually(t, func() bool {
+		return s.settings().policy.MaxSize == 8
+	}, time.Second, time.Millisecond)
+}
+
+func TestRestartNeeded(t *testing.T) {
+	prev := defaultConfig()
+	next := defaultConfig()
+	next.MaxUploadSize = 4
+	next.Naming = namingRandom
+	next.Rules = []uploadRule{{Name: "executables", Action: ruleReject}}
+	next.Tiers = []tierConfig{{Name: "free", Default: true, UploadRate: 1 << 20}}
+	require.Empty(t, restartNeeded(prev, next))
+
+	next.EncryptionKey = "another key"
+	next.InteractiveConcurrency = 1
+	next.Queues = []queueConfig{{Name: "images", ContentTypes: []string{"image/*"}}}
+	require.Equal(t, []string{"encryption-key", "interactive-concurrency", "queues"}, restartNeeded(prev, next))
+}
@@ -0,0 +1,235 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// quarantinePrefix is where uploads quarantined by a rule are stored. It starts
+// with a dot and has a slash in it, so they can't be fetched through /file.
+const quarantinePrefix = ".quarantine/"
+
+// ruleSampleSize is how much of the start of a file is read for the magic
+// bytes and entropy checks
+const ruleSampleSize = 64 << 10
+
+// ruleAction is what happens to an upload when a rule matches it
+type ruleAction string
+
+const (
+	ruleAllow      ruleAction = "allow"
+	ruleReject     ruleAction = "reject"
+	ruleQuarantine ruleAction = "quarantine"
+	// ruleTag adds the tags to the upload and carries on with the next rule,
+	// the other actions stop at the first match
+	ruleTag ruleAction = "tag"
+)
+
+// uploadRule is a single rule from the rules section of the config file
+type uploadRule struct {
+	Name   string     `yaml:"name"`
+	Match  ruleMatch  `yaml:"match"`
+	Action ruleAction `yaml:"action"`
+	Tags   []string   `yaml:"tags"`
+}
+
+// ruleMatch is the conditions for a rule, every condition that is set has to
+// hold. The lists match if any of their values do.
+type ruleMatch struct {
+	MinSize int64 `yaml:"min-size"`
+	// MaxSize of zero means there is no limit
+	MaxSize int64 `yaml:"max-size"`
+	// Extensions are compared with the name the file was uploaded with,
+	// ignoring case
+	Extensions []string `yaml:"extensions"`
+	// Magic is hex encoded prefixes of the contents
+	Magic []string `yaml:"magic"`
+	// MinEntropy is in bits per byte, from 0 to 8. Compressed and encrypted
+	// data is close to 8.
+	MinEntropy float64  `yaml:"min-entropy"`
+	Tenants    []string `yaml:"tenants"`
+}
+
+// ruleSample is what the rules know about an upload
+type ruleSample struct {
+	Size      int64
+	Extension string
+	Head      []byte
+	Entropy   float64
+	Tenant    string
+}
+
+// ruleDecision is the outcome of running the rules on an upload. Rule is empty
+// when no rule decided the action.
+type ruleDecision struct {
+	Action ruleAction
+	Rule   string
+	Tags   []string
+}
+
+// validateRules checks the rules from the config file
+func validateRules(rules []uploadRule) error {
+	var errs []error
+	for i, rule := range rules {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(rulesSection, i, "rule %d (%s): %s", i+1, rule.Name, fmt.Sprintf(format, args...)))
+		}
+
+		switch rule.Action {
+		case ruleAllow, ruleReject, ruleQuarantine:
+		case ruleTag:
+			if len(rule.Tags) == 0 {
+				fail("tag action without any tags")
+			}
+		default:
+			fail("unknown action %q", rule.Action)
+		}
+		if rule.Name == "" {
+			fail("name is empty")
+		}
+		if rule.Match.MinSize < 0 || rule.Match.MaxSize < 0 {
+			fail("sizes can't be negative")
+		}
+		if rule.Match.MaxSize > 0 && rule.Match.MaxSize < rule.Match.MinSize {
+			fail("max size is smaller than min size")
+		}
+		if rule.Match.MinEntropy < 0 || rule.Match.MinEntropy > 8 {
+			fail("min entropy has to be between 0 and 8")
+		}
+		for _, m := range rule.Match.Magic {
+			if b, err := hex.DecodeString(m); err != nil || len(b) == 0 {
+				fail("magic %q isn't hex encoded bytes", m)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// matches says whether every condition in the rule holds for the sample
+func (m ruleMatch) matches(sample ruleSample) bool {
+	if sample.Size < m.MinSize || (m.MaxSize > 0 && sample.Size > m.MaxSize) {
+		return false
+	}
+	if sample.Entropy < m.MinEntropy {
+		return false
+	}
+	if len(m.Tenants) > 0 && !contains(m.Tenants, sample.Tenant) {
+		return false
+	}
+
+	if len(m.Extensions) > 0 {
+		found := false
+		for _, ext := range m.Extensions {
+			found = found || strings.EqualFold("."+strings.TrimPrefix(ext, "."), sample.Extension)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(m.Magic) > 0 {
+		found := false
+		for _, magic := range m.Magic {
+			b, _ := hex.DecodeString(magic)
+			found = found || (len(b) > 0 && bytes.HasPrefix(sample.Head, b))
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// evaluateRules runs the rules in order. Tags are collected from every
+// matching tag rule until a rule with another action matches, and an upload
+// that no rule decides on is allowed.
+func evaluateRules(rules []uploadRule, sample ruleSample) ruleDecision {
+	d := ruleDecision{Action: ruleAllow}
+	for _, rule := range rules {
+		if !rule.Match.matches(sample) {
+			continue
+		}
+		if rule.Action == ruleTag {
+			d.Tags = append(d.Tags, rule.Tags...)
+			continue
+		}
+
+		d.Action = rule.Action
+		d.Rule = rule.Name
+		d.Tags = append(d.Tags, rule.Tags...)
+		break
+	}
+
+	return d
+}
+
+// entropy returns the Shannon entropy of b in bits per byte
+func entropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var e float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+
+	return e
+}
+
+// rulesStage runs the upload rules from the config, rejecting, quarantining or
+// tagging the upload
+func rulesStage(_ context.Context, s server, u *pendingUpload) error {
+	rules := s.settings().rules
+	if len(rules) == 0 {
+		return nil
+	}
+
+	head, err := io.ReadAll(io.LimitReader(u.Content, ruleSampleSize))
+	if err != nil {
+		return err
+	}
+	_, err = u.Content.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	d := evaluateRules(rules, ruleSample{
+		Size:      u.Size,
+		Extension: strings.ToLower(path.Ext(u.OriginalName)),
+		Head:      head,
+		Entropy:   entropy(head),
+		Tenant:    u.Source.UploadedBy,
+	})
+	u.Tags = append(u.Tags, d.Tags...)
+
+	switch d.Action {
+	case ruleReject:
+		return stageError{status: http.StatusUnprocessableEntity, reason: "rejected by rule " + d.Rule}
+	case ruleQuarantine:
+		log.Printf("upload quarantined: filename: %s, rule: %s", u.Name, d.Rule)
+		u.Name = quarantinePrefix + u.Name
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateRules(t *testing.T) {
+	rules := []uploadRule{
+		{Name: "big", Match: ruleMatch{MinSize: 100}, Action: ruleTag, Tags: []string{"big"}},
+		{Name: "alice", Match: ruleMatch{Tenants: []string{"alice"}}, Action: ruleAllow},
+		{Name: "exe", Match: ruleMatch{Extensions: []string{"exe"}}, Action: ruleReject},
+		{Name: "pe", Match: ruleMatch{Magic: []string{"4d5a"}}, Action: ruleQuarantine},
+		{Name: "random", Match: ruleMatch{MinEntropy: 7}, Action: ruleQuarantine, Tags: []string{"random"}},
+	}
+
+	tests := []struct {
+		name   string
+		sample ruleSample
+		want   ruleDecision
+	}{
+		{
+			name:   "nothing matches",
+			sample: ruleSample{Size: 10, Extension: ".txt", Head: []byte("hello")},
+			want:   ruleDecision{Action: ruleAllow},
+		},
+		{
+			name:   "extension",
+			sample: ruleSample{Size: 10, Extension: ".EXE"},
+			want:   ruleDecision{Action: ruleReject, Rule: "exe"},
+		},
+		{
+			name:   "tags carry on to the deciding rule",
+			sample: ruleSample{Size: 200, Extension: ".exe"},
+			want:   ruleDecision{Action: ruleReject, Rule: "exe", Tags: []string{"big"}},
+		},
+		{
+			name:   "first deciding rule wins",
+			sample: ruleSample{Size: 10, Extension: ".exe", Tenant: "alice"},
+			want:   ruleDecision{Action: ruleAllow, Rule: "alice"},
+		},
+		{
+			name:   "magic",
+			sample: ruleSample{Size: 10, Extension: ".bin", Head: []byte("MZ\x90\x00")},
+			want:   ruleDecision{Action: ruleQuarantine, Rule: "pe"},
+		},
+		{
+			name:   "entropy",
+			sample: ruleSample{Size: 10, Entropy: 7.9},
+			want:   ruleDecision{Action: ruleQuarantine, Rule: "random", Tags: []string{"random"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, evaluateRules(rules, test.sample))
+		})
+	}
+}
+
+func TestEntropy(t *testing.T) {
+	require.Zero(t, entropy(nil))
+	require.Zero(t, entropy([]byte("aaaa")))
+	require.InDelta(t, 1, entropy([]byte("abab")), 0.001)
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	require.InDelta(t, 8, entropy(all), 0.001)
+}
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    uploadRule
+		wantErr string
+	}{
+		{
+			name: "valid",
+			rule: uploadRule{Name: "exe", Match: ruleMatch{Magic: []string{"4D5A"}}, Action: ruleReject},
+		},
+		{
+			name:    "unknown action",
+			rule:    uploadRule{Name: "exe", Action: "delete"},
+			wantErr: `unknown action "delete"`,
+		},
+		{
+			name:    "tag without tags",
+			rule:    uploadRule{Name: "exe", Action: ruleTag},
+			wantErr: "tag action without any tags",
+		},
+		{
+			name:    "no name",
+			rule:    uploadRule{Action: ruleAllow},
+			wantErr: "name is empty",
+		},
+		{
+			name:    "bad magic",
+			rule:    uploadRule{Name: "exe", Match: ruleMatch{Magic: []string{"MZ"}}, Action: ruleReject},
+			wantErr: `magic "MZ" isn't hex encoded bytes`,
+		},
+		{
+			name:    "sizes the wrong way round",
+			rule:    uploadRule{Name: "exe", Match: ruleMatch{MinSize: 10, MaxSize: 5}, Action: ruleReject},
+			wantErr: "max size is smaller than min size",
+		},
+		{
+			name:    "entropy out of range",
+			rule:    uploadRule{Name: "exe", Match: ruleMatch{MinEntropy: 9}, Action: ruleReject},
+			wantErr: "min entropy has to be between 0 and 8",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRules([]uploadRule{test.rule})
+			if test.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
+
+func TestRulesStage(t *testing.T) {
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	rules := []uploadRule{
+		{Name: "exe", Match: ruleMatch{Extensions: []string{".exe"}}, Action: ruleReject},
+		{Name: "random", Match: ruleMatch{MinEntropy: 7.5}, Action: ruleQuarantine},
+		{Name: "text", Match: ruleMatch{Magic: []string{"2320"}}, Action: ruleTag, Tags: []string{"markdown"}},
+	}
+
+	tests := []struct {
+		name       string
+		filename   string
+		contents   string
+		wantStatus int
+		wantName   string
+		wantTags   []string
+	}{
+		{
+			name:       "allowed",
+			filename:   "notes.txt",
+			contents:   "test file contents",
+			wantStatus: http.StatusCreated,
+			wantName:   "notes.txt",
+		},
+		{
+			name:       "rejected",
+			filename:   "setup.exe",
+			contents:   "test file contents",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "quarantined",
+			filename:   "blob.bin",
+			contents:   string(random),
+			wantStatus: http.StatusCreated,
+			wantName:   quarantinePrefix + "blob.bin",
+		},
+		{
+			name:       "tagged",
+			filename:   "readme.md",
+			contents:   "# test file contents",
+			wantStatus: http.StatusCreated,
+			wantName:   "readme.md",
+			wantTags:   []string{"markdown"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+			setSettings(s, func(r *reloadable) { r.rules = rules })
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, newUploadRequest(t, "/upload", test.filename, test.contents))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus != http.StatusCreated {
+				return
+			}
+
+			var resp uploadResponse
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+			require.Equal(t, test.wantName, resp.Filename)
+			require.Equal(t, test.wantTags, resp.Tags)
+
+			entry, ok := s.catalog.get(test.wantName)
+			require.True(t, ok)
+			require.Equal(t, test.wantTags, entry.Tags)
+
+			// The rules mustn't leave the file part way through
+			var got strings.Builder
+			require.NoError(t, s.getFile(context.Background(), &got, test.wantName))
+			require.Equal(t, test.contents, got.String())
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package filesrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is how much of the file is sent to clamd in each INSTREAM
+// chunk, it has to be below clamd's StreamMaxLength
+const clamdChunkSize = 64 << 10
+
+// clamdTimeout bounds a single scan
+const clamdTimeout = 5 * time.Minute
+
+// clamdScanner scans files with a clamd daemon using the INSTREAM command
+type clamdScanner struct {
+	// addr is a host:port for TCP or a path for a unix socket
+	addr string
+
+	// verdicts is nil if they aren't cached
+	verdicts *verdictCache
+}
+
+// newClamdScanner returns a scanner for the clamd at addr, or nil if there is
+// no address. Verdicts are cached for cacheTTL, if it isn't zero.
+func newClamdScanner(addr string, cacheTTL time.Duration, cacheSize int) *clamdScanner {
+	if addr == "" {
+		return nil
+	}
+
+	c := &clamdScanner{addr: addr}
+	if cacheTTL > 0 && cacheSize > 0 {
+		c.verdicts = newVerdictCache(cacheTTL, cacheSize)
+	}
+
+	return c
+}
+
+// dial connects to clamd, the connection gives up at the deadline of ctx or
+// after clamdTimeout
+func (c *clamdScanner) dial(ctx context.Context) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(c.addr, "/") {
+		network = "unix"
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect to clamd: %w", err)
+	}
+
+	deadline := time.Now().Add(clamdTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// scanResult is what clamd said about a file
+type scanResult struct {
+	Infected bool
+	// Signature is the name of the virus that was found
+	Signature string
+}
+
+// scan streams r to clamd and returns its verdict
+func (c *clamdScanner) scan(ctx context.Context, r io.Reader) (scanResult, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return scanResult{}, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return scanResult{}, fmt.Errorf("send command: %w", err)
+	}
+
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				return scanResult{}, fmt.Errorf("send chunk: %w", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return scanResult{}, fmt.Errorf("read file: %w", err)
+		}
+	}
+
+	// A zero length chunk marks the end of the stream
+	_, err = conn.Write([]byte{0, 0, 0, 0})
+	if err != nil {
+		return scanResult{}, fmt.Errorf("send end of stream: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return scanResult{}, fmt.Errorf("read reply: %w", err)
+	}
+
+	return parseClamdReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// version asks clamd for the version of its signature database, which goes up
+// every time the signatures are updated
+func (c *clamdScanner) version(ctx context.Context) (string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("zVERSION\x00"))
+	if err != nil {
+		return "", fmt.Errorf("send command: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("read reply: %w", err)
+	}
+
+	return parseClamdVersion(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseClamdVersion reads the signature version out of a reply like
+// "ClamAV 1.0.1/26860/Mon Apr 10 07:25:32 2023"
+func parseClamdVersion(reply string) (string, error) {
+	parts := strings.Split(reply, "/")
+	if len(parts) < 2 || parts[1] == "" {
+		return "", fmt.Errorf("clamd: unexpected version %q", reply)
+	}
+
+	return parts[1], nil
+}
+
+// parseClamdReply reads a reply like "stream: OK" or
+// "stream: Eicar-Signature FOUND"
+func parseClamdReply(reply string) (scanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return scanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return scanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return scanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// scanStage rejects files that clamd finds a virus in
+func scanStage(ctx context.Context, s server, u *pendingUpload) error {
+	if s.scanner == nil {
+		return errors.New("no virus scanner is configured")
+	}
+
+	result, err := s.scanner.scanCached(ctx, u.Content)
+	if err != nil {
+		return err
+	}
+
+	if result.Infected {
+		return stageError{status: http.StatusUnprocessableEntity, reason: "virus found: " + result.Signature}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package filesrv
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClamd accepts INSTREAM scans and reports any stream containing the
+// word "virus" as infected
+func fakeClamd(t *testing.T) string {
+	t.Helper()
+	return newFakeClamd(t).addr
+}
+
+// fakeClamdServer is a fake clamd that counts the scans and has a signature
+// version that can be changed
+type fakeClamdServer struct {
+	addr    string
+	scans   atomic.Int32
+	version atomic.Value
+}
+
+func newFakeClamd(t *testing.T) *fakeClamdServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	f := &fakeClamdServer{addr: l.Addr().String()}
+	f.version.Store("1")
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				cmd, err := r.ReadString(0)
+				if err == nil && cmd == "zVERSION\x00" {
+					conn.Write([]byte("ClamAV 1.0.1/" + f.version.Load().(string) + "/Mon Apr 10 07:25:32 2023\x00"))
+					return
+				}
+				if err != nil || cmd != "zINSTREAM\x00" {
+					return
+				}
+				f.scans.Add(1)
+
+				var stream strings.Builder
+				for {
+					var size uint32
+					if binary.Read(r, binary.BigEndian, &size) != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(stream.String(), "virus") {
+					conn.Write([]byte("stream: Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return f
+}
+
+func TestScanStage(t *testing.T) {
+	addr := fakeClamd(t)
+
+	tests := []struct {
+		name       string
+		contents   string
+		wantStatus int
+	}{
+		{
+			name:       "clean",
+			contents:   "test file contents",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "infected",
+			contents:   "test file contents with a virus",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+		{
+			name:       "larger than a chunk",
+			contents:   strings.Repeat("a", clamdChunkSize*2+1) + "virus",
+			wantStatus: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			s := NewServer(store, "testBucket", "key", 10<<17)
+			s.scanner = newClamdScanner(addr, 0, 0)
+			s.pipelines = mustPipelines([]pipelineRule{{ContentType: "*", Stages: []string{"scan", "store", "index"}}})
+
+			w := httptest.NewRecorder()
+			s.routes().ServeHTTP(w, newUploadRequest(t, "/upload", "filename", test.contents))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+
+			if test.wantStatus == http.StatusCreated {
+				// The scan mustn't leave the file part way through
+				var got strings.Builder
+				require.NoError(t, s.getFile(context.Background(), &got, "filename"))
+				require.Equal(t, test.contents, got.String())
+			}
+		})
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	result, err := parseClamdReply("stream: OK")
+	require.NoError(t, err)
+	require.Equal(t, scanResult{}, result)
+
+	result, err = parseClamdReply("stream: Eicar-Signature FOUND")
+	require.NoError(t, err)
+	require.Equal(t, scanResult{Infected: true, Signature: "Eicar-Signature"}, result)
+
+	_, err = parseClamdReply("INSTREAM size limit exceeded. ERROR")
+	require.EqualError(t, err, "clamd: INSTREAM size limit exceeded. ERROR")
+}
+
+func TestParseClamdVersion(t *testing.T) {
+	version, err := parseClamdVersion("ClamAV 1.0.1/26860/Mon Apr 10 07:25:32 2023")
+	require.NoError(t, err)
+	require.Equal(t, "26860", version)
+
+	_, err = parseClamdVersion("ClamAV 1.0.1")
+	require.EqualError(t, err, `clamd: unexpected version "ClamAV 1.0.1"`)
+}
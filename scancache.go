@@ -0,0 +1,175 @@
+package filesrv
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// These are exposed at /debug/vars
+var (
+	scanCacheHits = expvar.NewInt("scan_cache_hits")
+	scanCacheMiss = expvar.NewInt("scan_cache_misses")
+)
+
+// clamdVersionInterval is how often clamd is asked for its signature version,
+// so a verdict can outlive a signature update by this long at most
+const clamdVersionInterval = time.Minute
+
+// verdictCache remembers what clamd said about files by the checksum of their
+// plaintext, so the same contents uploaded again don't have to be scanned
+// again. A verdict only holds for the signatures it was made with.
+type verdictCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+
+	// version is the signature version clamd last reported, and checked is
+	// when it was asked
+	version string
+	checked time.Time
+}
+
+type verdict struct {
+	sha256  string
+	result  scanResult
+	version string
+	expires time.Time
+}
+
+func newVerdictCache(ttl time.Duration, maxEntries int) *verdictCache {
+	return &verdictCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		items:      map[string]*list.Element{},
+	}
+}
+
+// get returns the verdict for the contents with the checksum sum, if there's
+// one from the signature version that hasn't expired
+func (vc *verdictCache) get(sum, version string) (scanResult, bool) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	elem, ok := vc.items[sum]
+	if !ok {
+		return scanResult{}, false
+	}
+	v := elem.Value.(*verdict)
+	if v.version != version || time.Now().After(v.expires) {
+		vc.lru.Remove(elem)
+		delete(vc.items, sum)
+		return scanResult{}, false
+	}
+
+	vc.lru.MoveToFront(elem)
+	return v.result, true
+}
+
+// put records a verdict, dropping the least recently used ones if there are
+// too many
+func (vc *verdictCache) put(sum, version string, result scanResult) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	v := &verdict{sha256: sum, result: result, version: version, expires: time.Now().Add(vc.ttl)}
+	if elem, ok := vc.items[sum]; ok {
+		elem.Value = v
+		vc.lru.MoveToFront(elem)
+	} else {
+		vc.items[sum] = vc.lru.PushFront(v)
+	}
+
+	for vc.lru.Len() > vc.maxEntries {
+		oldest := vc.lru.Back()
+		vc.lru.Remove(oldest)
+		delete(vc.items, oldest.Value.(*verdict).sha256)
+	}
+}
+
+// signatureVersion returns the version of clamd's signatures, only asking
+// clamd once every clamdVersionInterval
+func (c *clamdScanner) signatureVersion(ctx context.Context) (string, error) {
+	vc := c.verdicts
+	vc.mu.Lock()
+	if vc.version != "" && time.Since(vc.checked) < clamdVersionInterval {
+		version := vc.version
+		vc.mu.Unlock()
+		return version, nil
+	}
+	vc.mu.Unlock()
+
+	version, err := c.version(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	vc.version = version
+	vc.checked = time.Now()
+
+	return version, nil
+}
+
+// scanCached scans content, unless clamd has already given a verdict on the
+// same contents with the signatures it has now. content is left at the start.
+func (c *clamdScanner) scanCached(ctx context.Context, content io.ReadSeeker) (scanResult, error) {
+	if c.verdicts == nil {
+		return c.scanFromStart(ctx, content)
+	}
+
+	h := sha256.New()
+	_, err := io.Copy(h, content)
+	if err != nil {
+		return scanResult{}, err
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return scanResult{}, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// Without the version there's no telling whether a verdict still holds
+	version, err := c.signatureVersion(ctx)
+	if err != nil {
+		log.Println("scan cache: signature version:", err)
+		return c.scanFromStart(ctx, content)
+	}
+
+	if result, ok := c.verdicts.get(sum, version); ok {
+		scanCacheHits.Add(1)
+		return result, nil
+	}
+	scanCacheMiss.Add(1)
+
+	result, err := c.scanFromStart(ctx, content)
+	if err != nil {
+		return scanResult{}, err
+	}
+	c.verdicts.put(sum, version, result)
+
+	return result, nil
+}
+
+// scanFromStart scans content and puts it back to the start for the stages
+// after
+func (c *clamdScanner) scanFromStart(ctx context.Context, content io.ReadSeeker) (scanResult, error) {
+	result, err := c.scan(ctx, content)
+	if err != nil {
+		return scanResult{}, err
+	}
+
+	_, err = content.Seek(0, io.SeekStart)
+	return result, err
+}
@@ -0,0 +1,67 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanStageCachesVerdicts(t *testing.T) {
+	clamd := newFakeClamd(t)
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	s.scanner = newClamdScanner(clamd.addr, time.Hour, 10)
+	s.pipelines = mustPipelines([]pipelineRule{{ContentType: "*", Stages: []string{"scan", "store", "index"}}})
+	handler := s.routes()
+
+	upload := func(filename, contents string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", filename, contents))
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusCreated, upload("a.txt", "test file contents"))
+	require.Equal(t, http.StatusCreated, upload("b.txt", "test file contents"))
+	require.Equal(t, int32(1), clamd.scans.Load(), "the same contents should only be scanned once")
+
+	require.Equal(t, http.StatusUnprocessableEntity, upload("c.txt", "a virus"))
+	require.Equal(t, http.StatusUnprocessableEntity, upload("d.txt", "a virus"))
+	require.Equal(t, int32(2), clamd.scans.Load(), "infected verdicts should be cached too")
+
+	// New signatures might find something the old ones didn't
+	clamd.version.Store("2")
+	s.scanner.verdicts.checked = time.Time{}
+	require.Equal(t, http.StatusCreated, upload("e.txt", "test file contents"))
+	require.Equal(t, int32(3), clamd.scans.Load())
+}
+
+func TestVerdictCache(t *testing.T) {
+	vc := newVerdictCache(time.Hour, 2)
+	infected := scanResult{Infected: true, Signature: "Test-Signature"}
+
+	vc.put("a", "1", scanResult{})
+	vc.put("b", "1", infected)
+	got, ok := vc.get("b", "1")
+	require.True(t, ok)
+	require.Equal(t, infected, got)
+
+	_, ok = vc.get("b", "2")
+	require.False(t, ok, "verdicts from other signatures don't count")
+	_, ok = vc.get("b", "1")
+	require.False(t, ok, "verdicts from other signatures are dropped")
+
+	// a is the least recently used, so it goes first
+	vc.put("b", "1", infected)
+	vc.put("c", "1", scanResult{})
+	_, ok = vc.get("a", "1")
+	require.False(t, ok)
+	_, ok = vc.get("b", "1")
+	require.True(t, ok)
+
+	vc.ttl = -time.Second
+	vc.put("d", "1", scanResult{})
+	_, ok = vc.get("d", "1")
+	require.False(t, ok, "expired verdicts don't count")
+}
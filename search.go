@@ -0,0 +1,164 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultSearchLimit is how many files a search, or any other page of
+	// files, returns at once when the client doesn't ask for a number
+	defaultSearchLimit = 100
+	// maxSearchLimit is the most files a page returns at once
+	maxSearchLimit = 1000
+)
+
+// searchTerm is one word of a search query
+type searchTerm struct {
+	text string
+	// glob is set for terms with wildcards, they're matched against the
+	// whole name rather than anywhere in it
+	glob bool
+}
+
+// parseSearchQuery splits a query into its terms, every one of them has to
+// match. Terms are compared ignoring case.
+func parseSearchQuery(q string) ([]searchTerm, error) {
+	var terms []searchTerm
+	for _, word := range strings.Fields(strings.ToLower(q)) {
+		term := searchTerm{text: word, glob: strings.ContainsAny(word, "*?[")}
+		if term.glob {
+			// Only a malformed pattern makes Match fail, whatever the name
+			_, err := path.Match(word, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+		terms = append(terms, term)
+	}
+
+	return terms, nil
+}
+
+// matches says whether the term matches the file. Globs are matched against
+// the name and the name it was uploaded with, other terms can be anywhere in
+// those, the tags or the metadata.
+func (t searchTerm) matches(e catalogEntry) bool {
+	names := []string{strings.ToLower(e.Name), strings.ToLower(e.OriginalName)}
+	if t.glob {
+		for _, name := range names {
+			if ok, _ := path.Match(t.text, name); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	fields := append(names, e.Tags...)
+	for k, v := range e.Metadata {
+		fields = append(fields, k, v)
+	}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(field), t.text) {
+			return true
+		}
+	}
+	return false
+}
+
+// filePage is a page of files, like search results
+type filePage struct {
+	Files []catalogEntry `json:"files"`
+	// Cursor is passed as after to get the files after this page
+	Cursor string `json:"cursor,omitempty"`
+	// More is true if there are more files after this page
+	More bool `json:"more"`
+
+	after string
+	limit int
+}
+
+// pageLimit reads how many files to return at once from the limit query
+// parameter, false if it's bad
+func pageLimit(query url.Values) (int, bool) {
+	v := query.Get("limit")
+	if v == "" {
+		return defaultSearchLimit, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return min(n, maxSearchLimit), true
+}
+
+// newFilePage starts a page of up to limit files that come after the name
+func newFilePage(after string, limit int) *filePage {
+	return &filePage{Files: []catalogEntry{}, after: after, limit: limit}
+}
+
+// add adds the file to the page if it comes after the page's start. Files
+// have to be added in order of name, and once the page is full it returns
+// false.
+func (p *filePage) add(e catalogEntry) bool {
+	if e.Name <= p.after {
+		return true
+	}
+	if len(p.Files) == p.limit {
+		p.More = true
+		return false
+	}
+	p.Files = append(p.Files, e)
+	return true
+}
+
+// done sets the cursor for the next page
+func (p *filePage) done() *filePage {
+	if len(p.Files) > 0 {
+		p.Cursor = p.Files[len(p.Files)-1].Name
+	}
+	return p
+}
+
+// handleGetSearch finds the files matching every term in q that the user
+// making the request can read, in order of name. Results come a page at a
+// time, after the name in the after query parameter.
+func (s server) handleGetSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	terms, err := parseSearchQuery(query.Get("q"))
+	if err != nil || len(terms) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	limit, ok := pageLimit(query)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	page := newFilePage(query.Get("after"), limit)
+entries:
+	for _, e := range s.catalog.snapshot() {
+		if !s.allowed(r, e, accessRead) {
+			continue
+		}
+		for _, t := range terms {
+			if !t.matches(e) {
+				continue entries
+			}
+		}
+		if !page.add(e) {
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page.done())
+}
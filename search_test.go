@@ -0,0 +1,71 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSearch(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+	s.catalog.put(catalogEntry{Name: "invoice-2024-01.pdf", Tags: []string{"finance"}})
+	s.catalog.put(catalogEntry{Name: "invoice-2024-02.pdf", Metadata: map[string]string{"customer": "Acme"}})
+	s.catalog.put(catalogEntry{Name: "b1c9e0.png", OriginalName: "Holiday Photo.png"})
+	s.catalog.put(catalogEntry{Name: "notes.txt", Metadata: map[string]string{"project": "acme-rollout"}})
+
+	search := func(target string) (int, filePage) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var resp filePage
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		}
+		return w.Code, resp
+	}
+	names := func(resp filePage) []string {
+		var names []string
+		for _, e := range resp.Files {
+			names = append(names, e.Name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{q: "invoice", want: []string{"invoice-2024-01.pdf", "invoice-2024-02.pdf"}},
+		{q: "*.pdf", want: []string{"invoice-2024-01.pdf", "invoice-2024-02.pdf"}},
+		{q: "holiday", want: []string{"b1c9e0.png"}},
+		{q: "FINANCE", want: []string{"invoice-2024-01.pdf"}},
+		{q: "acme", want: []string{"invoice-2024-02.pdf", "notes.txt"}},
+		{q: "acme *.pdf", want: []string{"invoice-2024-02.pdf"}},
+		{q: "*.doc"},
+	}
+	for _, test := range tests {
+		t.Run(test.q, func(t *testing.T) {
+			status, resp := search("/search?q=" + url.QueryEscape(test.q))
+			require.Equal(t, http.StatusOK, status)
+			require.Equal(t, test.want, names(resp))
+			require.False(t, resp.More)
+		})
+	}
+
+	// Pages follow on from the cursor
+	status, resp := search("/search?q=invoice&limit=1")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []string{"invoice-2024-01.pdf"}, names(resp))
+	require.True(t, resp.More)
+	_, resp = search("/search?q=invoice&limit=1&after=" + resp.Cursor)
+	require.Equal(t, []string{"invoice-2024-02.pdf"}, names(resp))
+
+	for _, target := range []string{"/search", "/search?q=[", "/search?q=a&limit=0"} {
+		status, _ = search(target)
+		require.Equal(t, http.StatusBadRequest, status, target)
+	}
+}
@@ -0,0 +1,211 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// secretsTimeout bounds how long fetching the secrets can take
+const secretsTimeout = 10 * time.Second
+
+// secretsRetryInterval is how long to wait before trying again when renewing
+// the secrets fails
+const secretsRetryInterval = 30 * time.Second
+
+// secrets are the settings that can come from a secrets provider instead of
+// the config, so they never have to be written down anywhere else
+type secrets struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	EncryptionKey   string
+	// TTL is how long the secrets can be used for, zero means they don't
+	// expire
+	TTL time.Duration
+}
+
+// secretsProvider fetches the secrets from wherever they are kept
+type secretsProvider interface {
+	fetch(ctx context.Context) (secrets, error)
+}
+
+// vaultProvider reads the secrets from a HashiCorp Vault secret. The secret
+// has the same keys as the flags: minio-access-key, minio-secret-key and
+// encryption-key. Both versions of the KV engine work, as do dynamic secrets
+// engines that return those keys.
+type vaultProvider struct {
+	addr   string
+	token  string
+	path   string
+	client *http.Client
+}
+
+func newVaultProvider(addr, token, path string) vaultProvider {
+	return vaultProvider{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		path:   strings.Trim(path, "/"),
+		client: &http.Client{Timeout: secretsTimeout},
+	}
+}
+
+// vaultResponse is the part of a Vault read response we need
+type vaultResponse struct {
+	LeaseDuration int             `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+}
+
+func (v vaultProvider) fetch(ctx context.Context) (secrets, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return secrets{}, fmt.Errorf("vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return secrets{}, fmt.Errorf("vault request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return secrets{}, fmt.Errorf("vault read %s: %s", v.path, resp.Status)
+	}
+
+	var body vaultResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return secrets{}, fmt.Errorf("decode vault response: %w", err)
+	}
+
+	// KV version 2 wraps the secret in another data field, along with the
+	// metadata
+	var data map[string]any
+	err = json.Unmarshal(body.Data, &data)
+	if err != nil {
+		return secrets{}, fmt.Errorf("decode vault secret: %w", err)
+	}
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	var errs []error
+	value := func(key string) string {
+		s, _ := data[key].(string)
+		if s == "" {
+			errs = append(errs, fmt.Errorf("vault secret %s has no %s", v.path, key))
+		}
+		return s
+	}
+	sec := secrets{
+		AccessKeyID:     value("minio-access-key"),
+		SecretAccessKey: value("minio-secret-key"),
+		EncryptionKey:   value("encryption-key"),
+		TTL:             time.Duration(body.LeaseDuration) * time.Second,
+	}
+	if err := errors.Join(errs...); err != nil {
+		return secrets{}, err
+	}
+
+	return sec, nil
+}
+
+// providerCredentials gives minio-go the credentials from a secrets provider.
+// minio-go checks IsExpired before every request, so the credentials are
+// fetched again when the lease is two thirds of the way through, leaving
+// time to retry before the old ones stop working.
+type providerCredentials struct {
+	provider secretsProvider
+
+	mu      sync.Mutex
+	current secrets
+	expires time.Time
+}
+
+// newProviderCredentials returns credentials starting with secrets that have
+// already been fetched
+func newProviderCredentials(provider secretsProvider, sec secrets, fetched time.Time) *providerCredentials {
+	c := &providerCredentials{provider: provider}
+	c.set(sec, fetched)
+	return c
+}
+
+func (c *providerCredentials) set(sec secrets, fetched time.Time) {
+	c.current = sec
+	c.expires = time.Time{}
+	if sec.TTL > 0 {
+		c.expires = fetched.Add(sec.TTL * 2 / 3)
+	}
+}
+
+func (c *providerCredentials) Retrieve() (credentials.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.expired() {
+		ctx, cancel := context.WithTimeout(context.Background(), secretsTimeout)
+		defer cancel()
+
+		sec, err := c.provider.fetch(ctx)
+		if err != nil {
+			// The old credentials may well still work, the lease isn't
+			// over yet
+			log.Println("renew secrets:", err)
+			c.expires = time.Now().Add(secretsRetryInterval)
+		} else {
+			if sec.EncryptionKey != c.current.EncryptionKey {
+				log.Println("renew secrets: the encryption key has changed, it will be used after a restart")
+			}
+			c.set(sec, time.Now())
+		}
+	}
+
+	return credentials.Value{
+		AccessKeyID:     c.current.AccessKeyID,
+		SecretAccessKey: c.current.SecretAccessKey,
+		SignerType:      credentials.SignatureV4,
+	}, nil
+}
+
+func (c *providerCredentials) IsExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.expired()
+}
+
+func (c *providerCredentials) expired() bool {
+	return !c.expires.IsZero() && time.Now().After(c.expires)
+}
+
+// minioCredentials returns the credentials for the minio client. With Vault
+// configured the secrets are fetched now and replace the ones in the config,
+// and the minio credentials are renewed along with the lease. The encryption
+// key is only read at startup, since changing it under a running server would
+// make every stored file unreadable.
+func minioCredentials(ctx context.Context, cfg *config) (*credentials.Credentials, error) {
+	if cfg.VaultAddr == "" {
+		return credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""), nil
+	}
+
+	provider := newVaultProvider(cfg.VaultAddr, cfg.VaultToken, cfg.VaultPath)
+	sec, err := provider.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AccessKeyID = sec.AccessKeyID
+	cfg.SecretAccessKey = sec.SecretAccessKey
+	cfg.EncryptionKey = sec.EncryptionKey
+
+	return credentials.New(newProviderCredentials(provider, sec, time.Now())), nil
+}
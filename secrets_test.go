@@ -0,0 +1,137 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault serves the given JSON for secret/data/filesrv to requests with the
+// token "root"
+func fakeVault(t *testing.T, body string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("X-Vault-Token") != "root":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path != "/v1/secret/data/filesrv":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(body))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestVaultProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		token   string
+		want    secrets
+		wantErr string
+	}{
+		{
+			name:  "kv version 2",
+			body:  `{"lease_duration":0,"data":{"data":{"minio-access-key":"ak","minio-secret-key":"sk","encryption-key":"ek"},"metadata":{"version":3}}}`,
+			token: "root",
+			want:  secrets{AccessKeyID: "ak", SecretAccessKey: "sk", EncryptionKey: "ek"},
+		},
+		{
+			name:  "leased",
+			body:  `{"lease_duration":3600,"data":{"minio-access-key":"ak","minio-secret-key":"sk","encryption-key":"ek"}}`,
+			token: "root",
+			want:  secrets{AccessKeyID: "ak", SecretAccessKey: "sk", EncryptionKey: "ek", TTL: time.Hour},
+		},
+		{
+			name:    "missing key",
+			body:    `{"data":{"minio-access-key":"ak","minio-secret-key":"sk"}}`,
+			token:   "root",
+			wantErr: "vault secret secret/data/filesrv has no encryption-key",
+		},
+		{
+			name:    "bad token",
+			token:   "guess",
+			wantErr: "403 Forbidden",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fakeVault(t, test.body)
+
+			got, err := newVaultProvider(srv.URL+"/", test.token, "/secret/data/filesrv").fetch(context.Background())
+			if test.wantErr != "" {
+				require.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+type fakeSecretsProvider struct {
+	sec secrets
+	err error
+}
+
+func (p *fakeSecretsProvider) fetch(context.Context) (secrets, error) {
+	return p.sec, p.err
+}
+
+func TestProviderCredentialsRenew(t *testing.T) {
+	first := secrets{AccessKeyID: "ak1", SecretAccessKey: "sk1", EncryptionKey: "ek", TTL: time.Hour}
+	provider := &fakeSecretsProvider{sec: secrets{AccessKeyID: "ak2", SecretAccessKey: "sk2", EncryptionKey: "ek", TTL: time.Hour}}
+
+	// Fetched long enough ago that the lease needs renewing
+	c := newProviderCredentials(provider, first, time.Now().Add(-50*time.Minute))
+	require.True(t, c.IsExpired())
+
+	provider.err = errors.New("vault is down")
+	v, err := c.Retrieve()
+	require.NoError(t, err)
+	require.Equal(t, "ak1", v.AccessKeyID)
+	require.False(t, c.IsExpired(), "a failed renewal should wait before trying again")
+
+	provider.err = nil
+	c.expires = time.Now().Add(-time.Second)
+	v, err = c.Retrieve()
+	require.NoError(t, err)
+	require.Equal(t, "ak2", v.AccessKeyID)
+	require.Equal(t, "sk2", v.SecretAccessKey)
+	require.False(t, c.IsExpired())
+}
+
+func TestProviderCredentialsNoLease(t *testing.T) {
+	c := newProviderCredentials(&fakeSecretsProvider{}, secrets{AccessKeyID: "ak"}, time.Now().Add(-24*time.Hour))
+	require.False(t, c.IsExpired())
+}
+
+func TestMinioCredentialsFromVault(t *testing.T) {
+	srv := fakeVault(t, `{"data":{"minio-access-key":"ak","minio-secret-key":"sk","encryption-key":"ek"}}`)
+
+	cfg := defaultConfig()
+	cfg.VaultAddr = srv.URL
+	cfg.VaultToken = "root"
+	cfg.VaultPath = "secret/data/filesrv"
+
+	creds, err := minioCredentials(context.Background(), &cfg)
+	require.NoError(t, err)
+	require.Equal(t, "ak", cfg.AccessKeyID)
+	require.Equal(t, "sk", cfg.SecretAccessKey)
+	require.Equal(t, "ek", cfg.EncryptionKey)
+
+	v, err := creds.Get()
+	require.NoError(t, err)
+	require.Equal(t, "ak", v.AccessKeyID)
+}
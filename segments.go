@@ -0,0 +1,86 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// segmentsPrefix is where segment manifests are stored in the bucket
+const segmentsPrefix = ".segments/"
+
+// segmentManifest splits a large video into byte ranges that line up with the
+// encrypted blocks, so a player or downloader can fetch them with Range
+// requests without any block being fetched and decrypted twice
+type segmentManifest struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+	// ETag goes in If-Range, so a segment of a newer version of the file
+	// isn't mixed in with the rest
+	ETag     string    `json:"etag"`
+	Segments []segment `json:"segments"`
+}
+
+// segment is a range of bytes, end is inclusive like in a Range header
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// newSegmentManifest splits a file into segments of segmentSize, the last one
+// can be shorter
+func newSegmentManifest(f storedFile, segmentSize int64) segmentManifest {
+	m := segmentManifest{
+		Name:        f.Name,
+		Size:        f.Size,
+		ContentType: f.ContentType,
+		ETag:        etag(f.SHA256),
+		Segments:    []segment{},
+	}
+	for start := int64(0); start < f.Size; start += segmentSize {
+		m.Segments = append(m.Segments, segment{Start: start, End: min(start+segmentSize, f.Size) - 1})
+	}
+
+	return m
+}
+
+// segmentsStage stores a segment manifest for videos of at least
+// segmentMinSize, which is served at /file/:filename/segments. Other files
+// are skipped.
+func segmentsStage(ctx context.Context, s server, u *pendingUpload) error {
+	mediaType, _, _ := mime.ParseMediaType(u.Stored.ContentType)
+	if !strings.HasPrefix(mediaType, "video/") || s.segmentMinSize == 0 || u.Stored.Size < s.segmentMinSize {
+		return nil
+	}
+
+	b, err := json.Marshal(newSegmentManifest(u.Stored, s.segmentSize))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.putFile(ctx, segmentsPrefix+u.Stored.Name, bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return fmt.Errorf("store segment manifest: %w", err)
+	}
+
+	return nil
+}
+
+// handleGetSegments returns the segment manifest for a large video
+func (s server) handleGetSegments(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := s.getFile(r.Context(), w, segmentsPrefix+ps.ByName("filename"))
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeStorageError(w, err, "get segments")
+		return
+	}
+}
@@ -0,0 +1,102 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSegmentManifest(t *testing.T) {
+	m := newSegmentManifest(storedFile{Name: "video.mp4", Size: 10, ContentType: "video/mp4", SHA256: "abc"}, 4)
+	require.Equal(t, segmentManifest{
+		Name:        "video.mp4",
+		Size:        10,
+		ContentType: "video/mp4",
+		ETag:        `"abc"`,
+		Segments:    []segment{{Start: 0, End: 3}, {Start: 4, End: 7}, {Start: 8, End: 9}},
+	}, m)
+
+	m = newSegmentManifest(storedFile{Name: "empty.mp4"}, 4)
+	require.Empty(t, m.Segments)
+}
+
+func TestHandleGetSegments(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.SegmentMinSize = 1000
+	cfg.SegmentSize = decryptBlockSize
+	s := newServerFromConfig(newMemObjStore(), cfg)
+	// The manifest is made in the background otherwise
+	s.pipelines = mustPipelines([]pipelineRule{
+		{ContentType: "*", Stages: []string{"sniff", "store", "index", "segments"}},
+	})
+	router := s.routes()
+
+	large := testMP4 + strings.Repeat("a", 2*decryptBlockSize)
+	for filename, contents := range map[string]string{"large.mp4": large, "small.mp4": testMP4} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newUploadRequest(t, "/upload", filename, contents))
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode, filename)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/large.mp4/segments", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+
+	var m segmentManifest
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	require.Equal(t, int64(len(large)), m.Size)
+	require.Equal(t, "video/mp4", m.ContentType)
+	require.Len(t, m.Segments, 3)
+
+	// Each segment can be fetched with the manifest's ETag
+	var got strings.Builder
+	for _, seg := range m.Segments {
+		r := httptest.NewRequest(http.MethodGet, "/file/large.mp4", nil)
+		r.Header.Set("Range", "bytes="+strconv.FormatInt(seg.Start, 10)+"-"+strconv.FormatInt(seg.End, 10))
+		r.Header.Set("If-Range", m.ETag)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		require.Equal(t, http.StatusPartialContent, w.Result().StatusCode)
+		require.Equal(t, "video/mp4", w.Result().Header.Get("Content-Type"))
+		got.WriteString(w.Body.String())
+	}
+	require.Equal(t, large, got.String())
+
+	// Small videos don't need one
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/small.mp4/segments", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestGetFileVideoHeaders(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	router := s.routes()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, "/upload", "video.mp4", testMP4))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/video.mp4", nil))
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	require.Equal(t, strconv.Itoa(len(testMP4)), resp.Header.Get("Content-Length"))
+	require.Equal(t, testMP4, w.Body.String())
+
+	// Nothing is left behind for the error
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/missing.mp4", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	require.Empty(t, w.Result().Header.Get("Content-Type"))
+}
@@ -0,0 +1,60 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// selfTestObject is the name of the object written by the self test, the
+// leading dot keeps it from clashing with normal uploads
+const selfTestObject = ".filesrv-selftest"
+
+// selfTest writes a small object through the same encrypt and store path used
+// for uploads, reads it back, checks that the contents match and then deletes
+// it. This catches a bad encryption key, a missing bucket or bad credentials
+// before any real traffic arrives.
+func (s server) selfTest(ctx context.Context) error {
+	want := []byte("filesrv self test " + time.Now().UTC().Format(time.RFC3339Nano))
+
+	_, err := s.putFile(ctx, selfTestObject, bytes.NewReader(want), int64(len(want)))
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+
+	var got bytes.Buffer
+	err = s.getFile(ctx, &got, selfTestObject)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+
+	if !bytes.Equal(want, got.Bytes()) {
+		return errors.New("read back contents do not match")
+	}
+
+	err = s.minioClient.RemoveObject(ctx, s.bucketName, selfTestObject)
+	if err != nil {
+		return fmt.Errorf("remove: %w", err)
+	}
+
+	return nil
+}
+
+// handlePostSelfTest runs the self test on demand, so that it can be used to
+// check a running instance
+func (s server) handlePostSelfTest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	err := s.selfTest(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("self test:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
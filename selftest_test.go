@@ -0,0 +1,73 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlePostSelfTest(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *memObjStore
+		wantStatus int
+	}{
+		{
+			name:       "should work",
+			store:      newMemObjStore(),
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name: "put object error",
+			store: func() *memObjStore {
+				m := newMemObjStore()
+				m.putErr = errors.New("a put object error")
+				return m
+			}(),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "corrupted object",
+			store: func() *memObjStore {
+				m := newMemObjStore()
+				m.corrupt = true
+				return m
+			}(),
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "remove object error",
+			store: func() *memObjStore {
+				m := newMemObjStore()
+				m.removeErr = errors.New("a remove object error")
+				return m
+			}(),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(test.store, "testBucket", "key", 10<<17)
+
+			req := newAdminRequest(http.MethodPost, "/admin/selftest", nil)
+			w := httptest.NewRecorder()
+
+			s.handlePostSelfTest(w, req, nil)
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+		})
+	}
+}
+
+func TestSelfTestCleansUp(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+
+	require.NoError(t, s.selfTest(context.Background()))
+	require.Empty(t, store.objects)
+}
@@ -0,0 +1,74 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// drainer tells long running handlers that the server is shutting down, so
+// that idle long polls return straight away instead of holding up the drain
+type drainer struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{ch: make(chan struct{})}
+}
+
+// drain marks the server as shutting down, it can be called more than once
+func (d *drainer) drain() {
+	d.once.Do(func() { close(d.ch) })
+}
+
+// draining returns a channel that is closed when the server starts shutting
+// down
+func (d *drainer) draining() <-chan struct{} {
+	return d.ch
+}
+
+// serve serves HTTP on l until ctx is cancelled, then stops accepting new
+// connections and waits up to drainTimeout for the requests in flight to
+// finish. Anything still running after that is cut off.
+func serve(ctx context.Context, srv *http.Server, l net.Listener, drainTimeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("shutting down, waiting up to", drainTimeout, "for requests to finish")
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	err := srv.Shutdown(drainCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		closeErr := srv.Close()
+		if closeErr != nil {
+			log.Println("close server:", closeErr)
+		}
+		return fmt.Errorf("requests still running after %s were aborted", drainTimeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Serve returns ErrServerClosed as soon as Shutdown is called
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package filesrv
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startServe runs serve with handler on a random port, it returns the base URL
+// and a channel with the result of serve
+func startServe(t *testing.T, ctx context.Context, handler http.Handler, drainTimeout time.Duration) (string, <-chan error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, &http.Server{Handler: handler}, l, drainTimeout)
+	}()
+
+	return "http://" + l.Addr().String(), done
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	url, done := startServe(t, ctx, handler, 5*time.Second)
+
+	resps := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		require.NoError(t, err)
+		resps <- resp
+	}()
+	<-started
+
+	cancel()
+
+	// New connections are refused while the request in flight finishes
+	require.Eventually(t, func() bool {
+		_, err := net.Dial("tcp", url[len("http://"):])
+		return err != nil
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	resp := <-resps
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	require.NoError(t, <-done)
+}
+
+func TestServeAbortsAfterDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	url, done := startServe(t, ctx, handler, 10*time.Millisecond)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := http.Get(url)
+		errs <- err
+	}()
+	<-started
+
+	cancel()
+	require.ErrorContains(t, <-done, "aborted")
+	require.Error(t, <-errs)
+}
+
+func TestWatchEndsWhenDraining(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/watch?timeout=1m", nil))
+		done <- w
+	}()
+
+	s.drainer.drain()
+	select {
+	case w := <-done:
+		require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch didn't end when the server started draining")
+	}
+}
@@ -0,0 +1,450 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// sloSlotSize is how much time each slot of the SLO history covers, and
+	// sloSlots is how many are kept, enough for the longest window
+	sloSlotSize = time.Minute
+	sloSlots    = 6 * 60
+	// sloPublishInterval is how often the burn rates in /debug/vars are
+	// worked out again
+	sloPublishInterval = 30 * time.Second
+)
+
+// sloWindows are the rolling windows the SLOs are reported over. The short
+// one shows a fast burn quickly, and the long ones that it isn't just a blip.
+var sloWindows = []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour}
+
+// sloBurnRates has the burn rate of every objective over every window, keyed
+// by route, metric and window
+var sloBurnRates = expvar.NewMap("slo_burn_rate")
+
+// sloTarget is a service level objective for a route: Percentile percent of
+// requests have to be within each of the limits that are set. The route is
+// the method and the path pattern it's registered with, like
+// "GET /file/:filename".
+type sloTarget struct {
+	Route      string  `yaml:"route"`
+	Percentile float64 `yaml:"percentile"`
+
+	Latency      time.Duration `yaml:"latency"`
+	RequestSize  int64         `yaml:"request-size"`
+	ResponseSize int64         `yaml:"response-size"`
+}
+
+// validateSLOs checks the SLO targets
+func validateSLOs(targets []sloTarget) error {
+	var errs []error
+	for i, t := range targets {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(slosSection, i, "slo %d (%s): %s", i+1, t.Route, fmt.Sprintf(format, args...)))
+		}
+
+		method, path, _ := strings.Cut(t.Route, " ")
+		if method == "" || method != strings.ToUpper(method) || !strings.HasPrefix(path, "/") {
+			fail("route has to be a method and a path, like GET /file/:filename")
+		}
+		if t.Percentile <= 0 || t.Percentile >= 100 {
+			fail("percentile %g has to be between 0 and 100", t.Percentile)
+		}
+		if t.Latency < 0 || t.RequestSize < 0 || t.ResponseSize < 0 {
+			fail("limits can't be negative")
+		}
+		if t.Latency == 0 && t.RequestSize == 0 && t.ResponseSize == 0 {
+			fail("there has to be a latency, request-size or response-size")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// sloMetric is something measured about every request
+type sloMetric int
+
+const (
+	sloLatency sloMetric = iota
+	sloRequestSize
+	sloResponseSize
+)
+
+var sloMetricNames = [...]string{"latency", "requestSize", "responseSize"}
+
+func (m sloMetric) String() string {
+	return sloMetricNames[m]
+}
+
+// limit returns the target's limit for the metric, zero if it doesn't have
+// one. Latency is in nanoseconds and sizes are in bytes.
+func (t sloTarget) limit(m sloMetric) int64 {
+	switch m {
+	case sloLatency:
+		return int64(t.Latency)
+	case sloRequestSize:
+		return t.RequestSize
+	default:
+		return t.ResponseSize
+	}
+}
+
+// sloLimitKey identifies a limit, so requests over it can be counted
+type sloLimitKey struct {
+	metric sloMetric
+	limit  int64
+}
+
+// sloBounds are the upper bounds of the histogram buckets for each metric,
+// there's one more bucket for everything over the last
+var sloBounds = [...][]int64{
+	sloLatency: {
+		int64(time.Millisecond), int64(2 * time.Millisecond), int64(5 * time.Millisecond),
+		int64(10 * time.Millisecond), int64(20 * time.Millisecond), int64(50 * time.Millisecond),
+		int64(100 * time.Millisecond), int64(200 * time.Millisecond), int64(500 * time.Millisecond),
+		int64(time.Second), int64(2 * time.Second), int64(5 * time.Second),
+		int64(10 * time.Second), int64(30 * time.Second), int64(time.Minute),
+	},
+	sloRequestSize:  sizeBounds(),
+	sloResponseSize: sizeBounds(),
+}
+
+// sizeBounds are powers of 4 from 1KiB to 4GiB
+func sizeBounds() []int64 {
+	var bounds []int64
+	for b := int64(1 << 10); b <= 4<<30; b *= 4 {
+		bounds = append(bounds, b)
+	}
+	return bounds
+}
+
+// sloSlot is what happened on a route during one slot of time
+type sloSlot struct {
+	start    int64
+	requests int64
+	// buckets are histograms of each metric, max is the largest value seen
+	// so the last bucket has something to report
+	buckets [3][]int64
+	max     [3]int64
+	// over counts the requests over each limit of the route's targets
+	over map[sloLimitKey]int64
+}
+
+// sloRoute is the recent history of a route, slots are only made once
+// there's a request in them
+type sloRoute struct {
+	slots [sloSlots]*sloSlot
+}
+
+// sloTracker records every request against the route it matched
+type sloTracker struct {
+	mu     sync.Mutex
+	routes map[string]*sloRoute
+}
+
+func newSLOTracker() *sloTracker {
+	return &sloTracker{routes: map[string]*sloRoute{}}
+}
+
+// record adds a request to the route's history, counting whether it was
+// over the limits of the targets
+func (t *sloTracker) record(route string, now time.Time, values [3]int64, targets []sloTarget) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rt, ok := t.routes[route]
+	if !ok {
+		rt = &sloRoute{}
+		t.routes[route] = rt
+	}
+
+	start := now.Truncate(sloSlotSize).Unix()
+	i := int(now.Unix()/int64(sloSlotSize/time.Second)) % sloSlots
+	slot := rt.slots[i]
+	if slot == nil || slot.start != start {
+		slot = &sloSlot{start: start, over: map[sloLimitKey]int64{}}
+		for m := range slot.buckets {
+			slot.buckets[m] = make([]int64, len(sloBounds[m])+1)
+		}
+		rt.slots[i] = slot
+	}
+
+	slot.requests++
+	for m, v := range values {
+		bucket := sort.Search(len(sloBounds[m]), func(j int) bool { return sloBounds[m][j] >= v })
+		slot.buckets[m][bucket]++
+		slot.max[m] = max(slot.max[m], v)
+	}
+	for _, target := range targets {
+		for m, v := range values {
+			if limit := target.limit(sloMetric(m)); limit > 0 && v > limit {
+				slot.over[sloLimitKey{metric: sloMetric(m), limit: limit}]++
+			}
+		}
+	}
+}
+
+// sloPercentiles are the percentiles of a metric over a window, estimated
+// from the histogram as the top of the bucket they fall in
+type sloPercentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// sloObjective is how a route did against one limit of a target
+type sloObjective struct {
+	Metric     string  `json:"metric"`
+	Percentile float64 `json:"percentile"`
+	// Limit is in milliseconds for latency and bytes for sizes
+	Limit float64 `json:"limit"`
+	Over  int64   `json:"over"`
+	// BurnRate is how fast the error budget is being used, the share of
+	// requests over the limit divided by the share that are allowed to be.
+	// Anything over 1 would use up the budget before the window is out.
+	BurnRate  float64 `json:"burnRate"`
+	Compliant bool    `json:"compliant"`
+}
+
+// sloWindowSummary is how a route did over one window, latencies are in
+// milliseconds and sizes in bytes
+type sloWindowSummary struct {
+	Window       string         `json:"window"`
+	Requests     int64          `json:"requests"`
+	Latency      sloPercentiles `json:"latencyMs"`
+	RequestSize  sloPercentiles `json:"requestSize"`
+	ResponseSize sloPercentiles `json:"responseSize"`
+	Objectives   []sloObjective `json:"objectives"`
+}
+
+// sloRouteSummary is how a route did over every window
+type sloRouteSummary struct {
+	Route   string             `json:"route"`
+	Windows []sloWindowSummary `json:"windows"`
+}
+
+// summary reports every route that has had requests recently or has a
+// target, sorted by route
+func (t *sloTracker) summary(now time.Time, targets []sloTarget) []sloRouteSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := map[string]bool{}
+	for name := range t.routes {
+		names[name] = true
+	}
+	for _, target := range targets {
+		names[target.Route] = true
+	}
+
+	summaries := make([]sloRouteSummary, 0, len(names))
+	for name := range names {
+		rs := sloRouteSummary{Route: name}
+		for _, window := range sloWindows {
+			rs.Windows = append(rs.Windows, t.window(name, now, window, targets))
+		}
+		summaries = append(summaries, rs)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Route < summaries[j].Route })
+
+	return summaries
+}
+
+// window sums up the slots of a route within the window, t.mu has to be held
+func (t *sloTracker) window(route string, now time.Time, window time.Duration, targets []sloTarget) sloWindowSummary {
+	sum := sloSlot{over: map[sloLimitKey]int64{}}
+	for m := range sum.buckets {
+		sum.buckets[m] = make([]int64, len(sloBounds[m])+1)
+	}
+
+	oldest := now.Add(-window).Truncate(sloSlotSize).Unix()
+	if rt, ok := t.routes[route]; ok {
+		for _, slot := range rt.slots {
+			// The slot the window starts part way through is left out
+			if slot == nil || slot.start <= oldest || slot.start > now.Unix() {
+				continue
+			}
+			sum.requests += slot.requests
+			for m := range slot.buckets {
+				for b, n := range slot.buckets[m] {
+					sum.buckets[m][b] += n
+				}
+				sum.max[m] = max(sum.max[m], slot.max[m])
+			}
+			for k, n := range slot.over {
+				sum.over[k] += n
+			}
+		}
+	}
+
+	ws := sloWindowSummary{
+		Window:       window.String(),
+		Requests:     sum.requests,
+		Latency:      sum.percentiles(sloLatency, float64(time.Millisecond)),
+		RequestSize:  sum.percentiles(sloRequestSize, 1),
+		ResponseSize: sum.percentiles(sloResponseSize, 1),
+		Objectives:   []sloObjective{},
+	}
+	for _, target := range targets {
+		if target.Route != route {
+			continue
+		}
+		for _, m := range []sloMetric{sloLatency, sloRequestSize, sloResponseSize} {
+			limit := target.limit(m)
+			if limit == 0 {
+				continue
+			}
+			o := sloObjective{
+				Metric:     m.String(),
+				Percentile: target.Percentile,
+				Limit:      float64(limit),
+				Over:       sum.over[sloLimitKey{metric: m, limit: limit}],
+				Compliant:  true,
+			}
+			if m == sloLatency {
+				o.Limit /= float64(time.Millisecond)
+			}
+			if sum.requests > 0 {
+				o.BurnRate = float64(o.Over) / float64(sum.requests) / (1 - target.Percentile/100)
+				o.Compliant = o.BurnRate <= 1
+			}
+			ws.Objectives = append(ws.Objectives, o)
+		}
+	}
+
+	return ws
+}
+
+// percentiles estimates the percentiles of a metric, dividing them by unit
+func (s sloSlot) percentiles(m sloMetric, unit float64) sloPercentiles {
+	at := func(p float64) float64 {
+		if s.requests == 0 {
+			return 0
+		}
+		rank := int64(p*float64(s.requests) + 0.5)
+		var seen int64
+		for b, n := range s.buckets[m] {
+			seen += n
+			if seen >= rank && n > 0 {
+				if b == len(sloBounds[m]) {
+					return float64(s.max[m]) / unit
+				}
+				return float64(min(sloBounds[m][b], s.max[m])) / unit
+			}
+		}
+		return float64(s.max[m]) / unit
+	}
+
+	return sloPercentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99)}
+}
+
+// routeKey is the context key for where the router writes the route a
+// request matched
+type routeKey struct{}
+
+// routeRecorder is an httprouter that writes down the route each request
+// matched, since httprouter doesn't say which one it was. It keeps a list of
+// the routes for the OpenAPI document too.
+type routeRecorder struct {
+	*httprouter.Router
+	routes *[]apiRoute
+}
+
+func (rr routeRecorder) Handle(method, path string, h httprouter.Handle) {
+	*rr.routes = append(*rr.routes, apiRoute{Method: method, Path: path})
+	route := method + " " + path
+	rr.Router.Handle(method, path, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if matched, ok := r.Context().Value(routeKey{}).(*string); ok {
+			*matched = route
+		}
+		h(w, r, ps)
+	})
+}
+
+func (rr routeRecorder) GET(path string, h httprouter.Handle) {
+	rr.Handle(http.MethodGet, path, h)
+}
+
+func (rr routeRecorder) HEAD(path string, h httprouter.Handle) {
+	rr.Handle(http.MethodHead, path, h)
+}
+
+func (rr routeRecorder) POST(path string, h httprouter.Handle) {
+	rr.Handle(http.MethodPost, path, h)
+}
+
+func (rr routeRecorder) PUT(path string, h httprouter.Handle) {
+	rr.Handle(http.MethodPut, path, h)
+}
+
+func (rr routeRecorder) PATCH(path string, h httprouter.Handle) {
+	rr.Handle(http.MethodPatch, path, h)
+}
+
+func (rr routeRecorder) DELETE(path string, h httprouter.Handle) {
+	rr.Handle(http.MethodDelete, path, h)
+}
+
+// withSLOTracking records the latency and body sizes of every request that
+// matched a route. The latency includes any time spent queueing.
+func (s server) withSLOTracking(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var route string
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		cw := &countingResponseWriter{ResponseWriter: w}
+
+		// Handlers abort broken downloads with a panic, which still needs
+		// recording
+		defer func() {
+			if route == "" {
+				return
+			}
+			now := time.Now()
+			var targets []sloTarget
+			for _, target := range s.settings().slos {
+				if target.Route == route {
+					targets = append(targets, target)
+				}
+			}
+			s.slo.record(route, now, [3]int64{int64(now.Sub(start)), body.n, cw.n}, targets)
+		}()
+
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), routeKey{}, &route)))
+	})
+}
+
+// publishSLOs works out the burn rates for /debug/vars, for runEvery
+func (s server) publishSLOs(_ context.Context, now time.Time) {
+	for _, rs := range s.slo.summary(now, s.settings().slos) {
+		for _, ws := range rs.Windows {
+			for _, o := range ws.Objectives {
+				v := new(expvar.Float)
+				v.Set(o.BurnRate)
+				sloBurnRates.Set(rs.Route+" "+o.Metric+" "+ws.Window, v)
+			}
+		}
+	}
+}
+
+// handleGetSLO summarises every route against its targets over each window
+func (s server) handleGetSLO(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.slo.summary(time.Now(), s.settings().slos))
+	if err != nil {
+		log.Println("encode slo:", err)
+	}
+}
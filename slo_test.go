@@ -0,0 +1,86 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSLOTracker(t *testing.T) {
+	tracker := newSLOTracker()
+	targets := []sloTarget{{Route: "GET /file/:filename", Percentile: 90, Latency: 100 * time.Millisecond, ResponseSize: 1 << 20}}
+	now := time.Date(2024, 3, 1, 12, 0, 30, 0, time.UTC)
+
+	// 18 fast requests and 2 slow ones in the last 5 minutes
+	for i := 0; i < 20; i++ {
+		latency := 10 * time.Millisecond
+		if i < 2 {
+			latency = 300 * time.Millisecond
+		}
+		tracker.record("GET /file/:filename", now.Add(-time.Duration(i)*10*time.Second), [3]int64{int64(latency), 0, 2048}, targets)
+	}
+	// And 10 slow ones two hours ago
+	for i := 0; i < 10; i++ {
+		tracker.record("GET /file/:filename", now.Add(-2*time.Hour), [3]int64{int64(2 * time.Second), 0, 2048}, targets)
+	}
+
+	summary := tracker.summary(now, targets)
+	require.Len(t, summary, 1)
+	windows := summary[0].Windows
+	require.Len(t, windows, 3)
+
+	short := windows[0]
+	require.Equal(t, "5m0s", short.Window)
+	require.Equal(t, int64(20), short.Requests)
+	require.Equal(t, sloPercentiles{P50: 10, P90: 10, P99: 300}, short.Latency)
+	require.Equal(t, sloPercentiles{P50: 2048, P90: 2048, P99: 2048}, short.ResponseSize)
+	require.Len(t, short.Objectives, 2)
+	require.Equal(t, "latency", short.Objectives[0].Metric)
+	require.Equal(t, float64(100), short.Objectives[0].Limit)
+	require.Equal(t, int64(2), short.Objectives[0].Over)
+	require.InDelta(t, 1, short.Objectives[0].BurnRate, 0.001)
+	require.Equal(t, sloObjective{Metric: "responseSize", Percentile: 90, Limit: 1 << 20, Compliant: true}, short.Objectives[1])
+
+	long := windows[2]
+	require.Equal(t, int64(30), long.Requests)
+	require.InDelta(t, 4, long.Objectives[0].BurnRate, 0.001)
+	require.False(t, long.Objectives[0].Compliant)
+}
+
+func TestHandleGetSLO(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	setSettings(s, func(r *reloadable) {
+		r.slos = []sloTarget{{Route: "GET /file/:filename", Percentile: 99, Latency: time.Minute}}
+	})
+	handler := s.routes()
+
+	_, err := s.putFile(context.Background(), "test.txt", strings.NewReader("test file contents"), 18)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/test.txt", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+	// Requests that don't match a route aren't recorded
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nothing", nil))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, newAdminRequest(http.MethodGet, "/admin/slo", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var summary []sloRouteSummary
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&summary))
+	// The request for the summary isn't recorded until it's been written
+	require.Len(t, summary, 1)
+	require.Equal(t, "GET /file/:filename", summary[0].Route)
+	short := summary[0].Windows[0]
+	require.Equal(t, int64(3), short.Requests)
+	require.Equal(t, float64(18), short.ResponseSize.P50)
+	require.Equal(t, []sloObjective{{Metric: "latency", Percentile: 99, Limit: 60000, Compliant: true}}, short.Objectives)
+}
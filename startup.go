@@ -0,0 +1,99 @@
+package filesrv
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// maxStartupBackoff caps the wait between attempts to reach the object store
+const maxStartupBackoff = 30 * time.Second
+
+// bucketMaker is the part of the minio client used to set up the bucket
+type bucketMaker interface {
+	MakeBucket(ctx context.Context, bucketName string, opts minio.MakeBucketOptions) error
+	BucketExists(ctx context.Context, bucketName string) (bool, error)
+}
+
+// retryStartup calls op until it succeeds, waiting twice as long after each
+// failure starting from backoff. It gives up once maxWait has passed, so
+// minio starting a little after filesrv, as it often does in a container
+// orchestrator, doesn't stop filesrv from starting.
+func retryStartup(ctx context.Context, name string, backoff, maxWait time.Duration, op func(ctx context.Context) error) error {
+	deadline := time.Now().Add(maxWait)
+	for attempt := 1; ; attempt++ {
+		err := op(ctx)
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", name, attempt, err)
+		}
+		wait := min(backoff, maxStartupBackoff, remaining)
+		log.Printf("%s: attempt %d failed, retrying in %s: %s", name, attempt, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w", name, ctx.Err())
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// bucketPolicy says what to do when a bucket doesn't exist
+type bucketPolicy string
+
+const (
+	// bucketCreateIfMissing creates the bucket if it doesn't exist
+	bucketCreateIfMissing bucketPolicy = "create-if-missing"
+	// bucketRequireExists fails if the bucket doesn't exist, for when
+	// buckets are set up by something else
+	bucketRequireExists bucketPolicy = "require-exists"
+)
+
+// bucketSetup is how buckets are created when they're missing
+type bucketSetup struct {
+	Policy bucketPolicy
+	// Region and ObjectLocking are only used when creating a bucket
+	Region        string
+	ObjectLocking bool
+}
+
+// ensureBucket makes sure the bucket exists, creating it if the policy allows
+func ensureBucket(ctx context.Context, client bucketMaker, bucketName string, setup bucketSetup) error {
+	if setup.Policy == bucketCreateIfMissing {
+		err := client.MakeBucket(ctx, bucketName, minio.MakeBucketOptions{
+			Region:        setup.Region,
+			ObjectLocking: setup.ObjectLocking,
+		})
+		if err == nil {
+			log.Println("created bucket", bucketName)
+			return nil
+		}
+
+		// Check to see if we already own this bucket (which happens if you
+		// run this twice)
+		exists, errBucketExists := client.BucketExists(ctx, bucketName)
+		if errBucketExists == nil && exists {
+			log.Println("using existing bucket", bucketName)
+			return nil
+		}
+		return err
+	}
+
+	exists, err := client.BucketExists(ctx, bucketName)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s doesn't exist and -bucket-policy is %s", bucketName, setup.Policy)
+	}
+
+	return nil
+}
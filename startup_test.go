@@ -0,0 +1,137 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryStartup(t *testing.T) {
+	errDown := errors.New("connection refused")
+
+	tests := []struct {
+		name      string
+		failures  int
+		maxWait   time.Duration
+		wantCalls int
+		wantErr   error
+	}{
+		{
+			name:      "first time",
+			maxWait:   time.Second,
+			wantCalls: 1,
+		},
+		{
+			name:      "after a few failures",
+			failures:  3,
+			maxWait:   time.Second,
+			wantCalls: 4,
+		},
+		{
+			name:      "gives up",
+			failures:  1000,
+			maxWait:   50 * time.Millisecond,
+			wantCalls: -1,
+			wantErr:   errDown,
+		},
+		{
+			name:      "no retries",
+			failures:  1,
+			wantCalls: 1,
+			wantErr:   errDown,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			err := retryStartup(context.Background(), "test", time.Millisecond, test.maxWait, func(context.Context) error {
+				calls++
+				if calls <= test.failures {
+					return errDown
+				}
+				return nil
+			})
+
+			require.ErrorIs(t, err, test.wantErr)
+			if test.wantCalls >= 0 {
+				require.Equal(t, test.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestRetryStartupCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := retryStartup(ctx, "test", time.Hour, time.Hour, func(context.Context) error {
+		return errors.New("connection refused")
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+type fakeBucketMaker struct {
+	exists  bool
+	makeErr error
+	made    bool
+	opts    minio.MakeBucketOptions
+}
+
+func (f *fakeBucketMaker) MakeBucket(_ context.Context, _ string, opts minio.MakeBucketOptions) error {
+	if f.makeErr != nil {
+		return f.makeErr
+	}
+	f.made = true
+	f.opts = opts
+	return nil
+}
+
+func (f *fakeBucketMaker) BucketExists(context.Context, string) (bool, error) {
+	return f.exists, nil
+}
+
+func TestEnsureBucket(t *testing.T) {
+	errOwned := errors.New("bucket already owned by you")
+
+	tests := []struct {
+		name     string
+		maker    fakeBucketMaker
+		setup    bucketSetup
+		wantMade bool
+		wantErr  string
+	}{
+		{name: "created", setup: bucketSetup{Policy: bucketCreateIfMissing}, wantMade: true},
+		{name: "already exists", maker: fakeBucketMaker{exists: true, makeErr: errOwned}, setup: bucketSetup{Policy: bucketCreateIfMissing}},
+		{name: "can't create", maker: fakeBucketMaker{makeErr: errOwned}, setup: bucketSetup{Policy: bucketCreateIfMissing}, wantErr: "bucket already owned by you"},
+		{name: "not created when it exists", maker: fakeBucketMaker{exists: true}, setup: bucketSetup{Policy: bucketRequireExists}},
+		{name: "missing and not created", setup: bucketSetup{Policy: bucketRequireExists}, wantErr: "bucket testBucket doesn't exist"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := ensureBucket(context.Background(), &test.maker, "testBucket", test.setup)
+			if test.wantErr != "" {
+				require.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.wantMade, test.maker.made)
+		})
+	}
+}
+
+func TestEnsureBucketOptions(t *testing.T) {
+	var maker fakeBucketMaker
+	err := ensureBucket(context.Background(), &maker, "testBucket", bucketSetup{
+		Policy:        bucketCreateIfMissing,
+		Region:        "eu-west-1",
+		ObjectLocking: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, minio.MakeBucketOptions{Region: "eu-west-1", ObjectLocking: true}, maker.opts)
+}
@@ -0,0 +1,72 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// storageErrorCode returns the S3 error code from an object store error, or an
+// empty string if it didn't come from the object store
+func storageErrorCode(err error) string {
+	var resp minio.ErrorResponse
+	if errors.As(err, &resp) {
+		return resp.Code
+	}
+
+	return ""
+}
+
+// storageStatus maps an error from the object store to the status the client
+// should get, anything unexpected is a 500
+func storageStatus(err error) int {
+	if errors.Is(err, errNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// The request ran out of the time it was given
+		return http.StatusGatewayTimeout
+	}
+
+	switch storageErrorCode(err) {
+	case "NoSuchKey":
+		return http.StatusNotFound
+	case "AccessDenied":
+		return http.StatusForbidden
+	case "SlowDown", "ServiceUnavailable":
+		return http.StatusServiceUnavailable
+	case "EntityTooLarge":
+		return http.StatusRequestEntityTooLarge
+	case "KeyTooLongError", "XMinioInvalidObjectName":
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeStorageError responds with the status for an object store error. It is
+// logged with msg unless the object just doesn't exist.
+//
+// If the error happened after the response had started, the status has
+// already been sent, so the only way to tell the client something went wrong
+// is to cut the connection before the end of the body.
+func writeStorageError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, errStreamInterrupted) {
+		log.Println(msg+":", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	status := storageStatus(err)
+	if status == http.StatusServiceUnavailable {
+		// minio is asking us to slow down, so pass that on to the client
+		w.Header().Set("Retry-After", "1")
+	}
+	w.WriteHeader(status)
+
+	if status != http.StatusNotFound {
+		log.Println(msg+":", err)
+	}
+}
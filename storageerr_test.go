@@ -0,0 +1,76 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{
+			name:       "no such key",
+			err:        errNoSuchKey,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "wrapped not found",
+			err:        fmt.Errorf("get: %w", errNotFound),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "wrapped access denied",
+			err:        fmt.Errorf("put object: %w", minio.ErrorResponse{Code: "AccessDenied"}),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "slow down",
+			err:        minio.ErrorResponse{Code: "SlowDown"},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "entity too large",
+			err:        minio.ErrorResponse{Code: "EntityTooLarge"},
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "deadline exceeded",
+			err:        fmt.Errorf("put object: %w", context.DeadlineExceeded),
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "other storage error",
+			err:        minio.ErrorResponse{Code: "InternalError"},
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "not a storage error",
+			err:        errors.New("an error"),
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.wantStatus, storageStatus(test.err))
+
+			w := httptest.NewRecorder()
+			writeStorageError(w, test.err, "test")
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			if test.wantStatus == http.StatusServiceUnavailable {
+				require.Equal(t, "1", w.Result().Header.Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// syncPrefix is where synced folders are stored in the bucket, each
+	// folder gets its own prefix under it
+	syncPrefix = "sync/"
+	// syncTombstoneTTL is how long deletes are remembered for, a sync client
+	// that has been away for longer can't tell a deleted file from one it
+	// hasn't uploaded yet
+	syncTombstoneTTL = 30 * 24 * time.Hour
+)
+
+// syncFile is a file in a synced folder
+type syncFile struct {
+	Path     string    `json:"path"`
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// syncTombstone records that a file in a synced folder was deleted
+type syncTombstone struct {
+	Path    string    `json:"path"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// syncListing is the state of a synced folder
+type syncListing struct {
+	// Cursor can be passed to /changes to follow the folder from here on
+	Cursor     string          `json:"cursor"`
+	Files      []syncFile      `json:"files"`
+	Tombstones []syncTombstone `json:"tombstones"`
+}
+
+// syncObjectName works out the object name for a file in a synced folder. The
+// folder and every part of the path have to be valid filenames.
+func syncObjectName(ps httprouter.Params) (string, bool) {
+	folder := ps.ByName("folder")
+	path := strings.TrimPrefix(ps.ByName("path"), "/")
+
+	for _, part := range append([]string{folder}, strings.Split(path, "/")...) {
+		if !checkFilename(part).OK {
+			return "", false
+		}
+	}
+
+	return syncPrefix + folder + "/" + path, true
+}
+
+// etag formats a checksum as an HTTP entity tag
+func etag(sha256 string) string {
+	return strconv.Quote(sha256)
+}
+
+// checkPreconditions applies the If-Match and If-None-Match headers to the
+// current version of a file, it returns 0 if the request can go ahead
+func checkPreconditions(r *http.Request, current catalogEntry, exists bool) int {
+	if m := r.Header.Get("If-Match"); m != "" {
+		if !exists || (m != "*" && m != etag(current.SHA256)) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if m := r.Header.Get("If-None-Match"); m != "" {
+		if exists && (m == "*" || m == etag(current.SHA256)) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	return 0
+}
+
+// notModified applies the If-None-Match and If-Modified-Since headers of a
+// GET or HEAD to the current version of a file, it's true if the client's
+// copy is still good and it can be sent a 304. If-Modified-Since is ignored
+// when there's an If-None-Match, since the ETag is the better check.
+func notModified(r *http.Request, current catalogEntry) bool {
+	if m := r.Header.Get("If-None-Match"); m != "" {
+		if current.SHA256 == "" {
+			return false
+		}
+		for _, tag := range strings.Split(m, ",") {
+			// The weak comparison is used for GET, so W/ is ignored
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag(current.SHA256) {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || current.Uploaded.IsZero() {
+		return false
+	}
+	// Last-Modified only has seconds
+	return !current.Uploaded.Truncate(time.Second).After(since)
+}
+
+// handleGetSyncList lists the files in a synced folder with their checksums,
+// along with the files that were deleted from it. Files the user can't read
+// are left out.
+func (s server) handleGetSyncList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	folder := ps.ByName("folder")
+	if !checkFilename(folder).OK {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	prefix := syncPrefix + folder + "/"
+
+	// The cursor is taken first, so a change made while listing is at worst
+	// seen twice rather than missed
+	listing := syncListing{
+		Cursor:     strconv.FormatUint(s.catalog.latestSeq(), 10),
+		Files:      []syncFile{},
+		Tombstones: []syncTombstone{},
+	}
+
+	for _, e := range s.catalog.snapshot() {
+		if strings.HasPrefix(e.Name, prefix) && s.allowed(r, e, accessRead) {
+			listing.Files = append(listing.Files, syncFile{
+				Path:     strings.TrimPrefix(e.Name, prefix),
+				SHA256:   e.SHA256,
+				Size:     e.Size,
+				Modified: e.Uploaded,
+			})
+		}
+	}
+
+	for name, deleted := range s.catalog.tombstonesSince(time.Now().Add(-syncTombstoneTTL)) {
+		if strings.HasPrefix(name, prefix) {
+			listing.Tombstones = append(listing.Tombstones, syncTombstone{
+				Path:    strings.TrimPrefix(name, prefix),
+				Deleted: deleted,
+			})
+		}
+	}
+	sort.Slice(listing.Tombstones, func(i, j int) bool {
+		return listing.Tombstones[i].Path < listing.Tombstones[j].Path
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// handleGetSyncFile returns a file from a synced folder, with its checksum as
+// the ETag for conditional uploads and deletes. Synced files are ordinary
+// files, so they have the same access checks and download rules as /file.
+func (s server) handleGetSyncFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name, ok := syncObjectName(ps)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.readConsistent(w, r, name) || !s.checkAccess(w, r, name, accessRead) || !s.downloadAllowed(w, r, name) {
+		return
+	}
+
+	entry, ok := s.catalog.get(name)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.setFileHeaders(w, r, name, entry) {
+		return
+	}
+	w.Header().Set("ETag", etag(entry.SHA256))
+
+	err := s.getFile(r.Context(), w, name)
+	if err != nil {
+		clearFileHeaders(w.Header())
+		w.Header().Del("ETag")
+		writeStorageError(w, err, "get sync file")
+		return
+	}
+	s.recordAccess(r, name)
+}
+
+// handlePutSyncFile stores the request body as a file in a synced folder. The
+// upload can be made conditional with If-Match, to only replace the version
+// the client last saw, or with If-None-Match: * to only create new files.
+//
+// The upload goes through the same checks and pipeline as PUT /file, apart
+// from stages like strip-exif that change the contents, since the checksums
+// would never match the client's copy.
+func (s server) handlePutSyncFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name, ok := syncObjectName(ps)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// The precondition is checked with the name locked, or two clients could
+	// both replace the same version
+	var exists bool
+	u, ok := s.storeBody(w, r, name, checkPath(strings.TrimPrefix(name, syncPrefix)), putOptions{
+		unmodified: true,
+		precondition: func() int {
+			var current catalogEntry
+			current, exists = s.catalog.get(name)
+			return checkPreconditions(r, current, exists)
+		},
+	})
+	if !ok {
+		return
+	}
+
+	w.Header().Set("ETag", etag(u.Stored.SHA256))
+	w.Header().Set(consistencyHeader, s.consistencyToken())
+	if exists {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// handleDeleteSyncFile deletes a file from a synced folder and leaves a
+// tombstone, so other clients know to delete their copy. It takes the same
+// If-Match header as uploads.
+func (s server) handleDeleteSyncFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name, ok := syncObjectName(ps)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.checkAccess(w, r, name, accessWrite) {
+		return
+	}
+
+	unlock := s.nameLocks.lock(name)
+	defer unlock()
+
+	current, exists := s.catalog.get(name)
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if status := checkPreconditions(r, current, exists); status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	err := s.minioClient.RemoveObject(r.Context(), s.bucketName, name)
+	if err != nil {
+		writeStorageError(w, err, "delete sync file: filename: "+name)
+		return
+	}
+
+	s.catalog.bury(name, time.Now().UTC(), syncTombstoneTTL)
+	err = s.unindex(r.Context(), name)
+	if err != nil {
+		log.Println("unindex sync file:", err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
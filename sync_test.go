@@ -0,0 +1,190 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testFileSHA256 = "c4fa968a745586faaa030054f51fb1cafd5e9ae25fa6b137ac6477715fdc81b1"
+
+func newSyncRequest(method, target, body string, header map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestSyncPreconditions(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		header     map[string]string
+		wantStatus int
+	}{
+		{
+			name:       "create",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/new.txt",
+			header:     map[string]string{"If-None-Match": "*"},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "create when it exists",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/2024/a.txt",
+			header:     map[string]string{"If-None-Match": "*"},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "replace the current version",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/2024/a.txt",
+			header:     map[string]string{"If-Match": etag(testFileSHA256)},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "replace an old version",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/2024/a.txt",
+			header:     map[string]string{"If-Match": etag("old")},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "replace a missing file",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/b.txt",
+			header:     map[string]string{"If-Match": "*"},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "unconditional",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/2024/a.txt",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "bad path",
+			method:     http.MethodPut,
+			target:     "/sync/file/photos/../a.txt",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "delete an old version",
+			method:     http.MethodDelete,
+			target:     "/sync/file/photos/2024/a.txt",
+			header:     map[string]string{"If-Match": etag("old")},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "delete the current version",
+			method:     http.MethodDelete,
+			target:     "/sync/file/photos/2024/a.txt",
+			header:     map[string]string{"If-Match": etag(testFileSHA256)},
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "delete a missing file",
+			method:     http.MethodDelete,
+			target:     "/sync/file/photos/b.txt",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+			router := s.routes()
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, newSyncRequest(http.MethodPut, "/sync/file/photos/2024/a.txt", "test file contents", nil))
+			require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+			require.Equal(t, etag(testFileSHA256), w.Result().Header.Get("ETag"))
+
+			w = httptest.NewRecorder()
+			router.ServeHTTP(w, newSyncRequest(test.method, test.target, "new contents", test.header))
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+		})
+	}
+}
+
+func TestSyncListing(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	router := s.routes()
+
+	for _, target := range []string{"/sync/file/photos/a.txt", "/sync/file/photos/2024/b.txt", "/sync/file/music/c.txt"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newSyncRequest(http.MethodPut, target, "test file contents", nil))
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newSyncRequest(http.MethodDelete, "/sync/file/photos/a.txt", "", nil))
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sync/list/photos", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	var listing syncListing
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&listing))
+	require.Equal(t, "4", listing.Cursor)
+	require.Len(t, listing.Files, 1)
+	require.Equal(t, "2024/b.txt", listing.Files[0].Path)
+	require.Equal(t, testFileSHA256, listing.Files[0].SHA256)
+	require.Len(t, listing.Tombstones, 1)
+	require.Equal(t, "a.txt", listing.Tombstones[0].Path)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sync/file/photos/2024/b.txt", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, etag(testFileSHA256), w.Result().Header.Get("ETag"))
+	require.Equal(t, "test file contents", w.Body.String())
+
+	// Uploading the file again clears the tombstone
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newSyncRequest(http.MethodPut, "/sync/file/photos/a.txt", "test file contents", nil))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	require.Empty(t, s.catalog.tombstonesSince(listing.Tombstones[0].Deleted.Add(-1)))
+}
+
+func TestSyncAccess(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.Rules = []uploadRule{{Name: "no-secrets", Match: ruleMatch{Magic: []string{"736563726574"}}, Action: ruleReject}}
+	s := newServerFromConfig(newMemObjStore(), cfg)
+	router := s.routes()
+
+	do := func(method, target, body, user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, newSyncRequest(method, target, body, map[string]string{identityHeader: user}))
+		return w
+	}
+
+	require.Equal(t, http.StatusCreated, do(http.MethodPut, "/sync/file/docs/plan.txt", "test file contents", "alice").Result().StatusCode)
+	e, ok := s.catalog.get("sync/docs/plan.txt")
+	require.True(t, ok)
+	e.ACL = []grant{{User: "bob", Access: accessRead}}
+	s.catalog.put(e)
+
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/sync/file/docs/plan.txt", "", "bob").Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, do(http.MethodGet, "/sync/file/docs/plan.txt", "", "carol").Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, do(http.MethodPut, "/sync/file/docs/plan.txt", "new contents", "bob").Result().StatusCode)
+	require.Equal(t, http.StatusForbidden, do(http.MethodDelete, "/sync/file/docs/plan.txt", "", "bob").Result().StatusCode)
+
+	var listing syncListing
+	require.NoError(t, json.NewDecoder(do(http.MethodGet, "/sync/list/docs", "", "carol").Body).Decode(&listing))
+	require.Empty(t, listing.Files)
+
+	// The upload rules apply to synced files like any other upload
+	require.Equal(t, http.StatusUnprocessableEntity, do(http.MethodPut, "/sync/file/docs/secret.txt", "secret", "alice").Result().StatusCode)
+	_, ok = s.catalog.get("sync/docs/secret.txt")
+	require.False(t, ok)
+}
@@ -0,0 +1,91 @@
+package filesrv
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdFirstFD is the first file descriptor systemd passes sockets on
+const systemdFirstFD = 3
+
+// systemdListenFDs returns how many sockets systemd passed to this process
+// with socket activation. LISTEN_PID says which process they're for, so a
+// child that inherits the environment doesn't take them too.
+func systemdListenFDs(lookupEnv func(string) (string, bool), pid int) (int, error) {
+	pidEnv, ok := lookupEnv("LISTEN_PID")
+	if !ok {
+		return 0, nil
+	}
+	listenPID, err := strconv.Atoi(pidEnv)
+	if err != nil {
+		return 0, fmt.Errorf("LISTEN_PID: %w", err)
+	}
+	if listenPID != pid {
+		return 0, nil
+	}
+
+	fdsEnv, _ := lookupEnv("LISTEN_FDS")
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil {
+		return 0, fmt.Errorf("LISTEN_FDS: %w", err)
+	}
+
+	return n, nil
+}
+
+// systemdListener returns the socket systemd passed with socket activation,
+// or false if it didn't pass one. The socket unit decides the address, so the
+// listen setting is ignored.
+func systemdListener() (net.Listener, bool, error) {
+	n, err := systemdListenFDs(os.LookupEnv, os.Getpid())
+	if err != nil || n == 0 {
+		return nil, false, err
+	}
+	if n > 1 {
+		return nil, false, fmt.Errorf("systemd passed %d sockets, only one is supported", n)
+	}
+
+	// Nothing started from here should think the socket is for it
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFD, "systemd socket")
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, false, fmt.Errorf("systemd socket: %w", err)
+	}
+
+	return l, true, nil
+}
+
+// sdNotify sends a state change like READY=1 to systemd. It does nothing when
+// systemd isn't waiting to hear, which is whenever NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// An @ means the socket is in the abstract namespace
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("sd_notify: %w", err)
+	}
+
+	return nil
+}
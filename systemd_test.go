@@ -0,0 +1,71 @@
+package filesrv
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdListenFDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    int
+		wantErr string
+	}{
+		{
+			name: "not socket activated",
+		},
+		{
+			name: "one socket",
+			env:  map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "1"},
+			want: 1,
+		},
+		{
+			name: "for another process",
+			env:  map[string]string{"LISTEN_PID": "7", "LISTEN_FDS": "1"},
+		},
+		{
+			name:    "bad count",
+			env:     map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "one"},
+			wantErr: "LISTEN_FDS",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookupEnv := func(name string) (string, bool) {
+				v, ok := test.env[name]
+				return v, ok
+			}
+
+			n, err := systemdListenFDs(lookupEnv, 42)
+			if test.wantErr != "" {
+				require.ErrorContains(t, err, test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.want, n)
+		})
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.NoError(t, sdNotify("READY=1"))
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	require.NoError(t, sdNotify("READY=1"))
+
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "READY=1", string(b[:n]))
+}
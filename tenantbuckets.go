@@ -0,0 +1,138 @@
+package filesrv
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7/pkg/s3utils"
+)
+
+// tenantBuckets gives every user their own bucket, served under
+// /b/<prefix><user>/. The bucket is set up the first time the user makes a
+// request to it, following the same bucket policy as the configured buckets,
+// and users can only reach their own.
+type tenantBuckets struct {
+	prefix string
+	setup  bucketSetup
+	maker  bucketMaker
+	// newServer returns the server for a tenant's bucket, and started is
+	// called with it once the bucket is ready. wrap adds the middleware.
+	newServer func(name string) server
+	started   func(server)
+	wrap      func(server) http.Handler
+
+	mu      sync.Mutex
+	buckets map[string]*tenantBucket
+}
+
+// tenantBucket is a tenant's bucket, handler is set once done is closed if the
+// bucket could be set up
+type tenantBucket struct {
+	done    chan struct{}
+	handler http.Handler
+}
+
+// withTenantBuckets turns on tenant buckets for the server, with buckets made
+// by maker. Each tenant bucket shares everything but its catalog with s, like
+// the configured buckets.
+func (s server) withTenantBuckets(minioClient objStorer, maker bucketMaker, cfg config, started func(server)) server {
+	if cfg.TenantBucketPrefix == "" {
+		return s
+	}
+
+	s.tenants = &tenantBuckets{
+		prefix: cfg.TenantBucketPrefix,
+		setup:  cfg.bucketSetup(),
+		maker:  maker,
+		newServer: func(name string) server {
+			return s.newBucketServer(minioClient, cfg, bucketConfig{Name: name})
+		},
+		started: started,
+		wrap: func(bs server) http.Handler {
+			return s.withMiddleware(bs.router())
+		},
+		buckets: map[string]*tenantBucket{},
+	}
+
+	return s
+}
+
+// handler returns the handler for the bucket called name, writing the
+// response itself if the request can't use it
+func (t *tenantBuckets) handler(w http.ResponseWriter, r *http.Request, name string) (http.Handler, bool) {
+	tenant, ok := strings.CutPrefix(name, t.prefix)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, false
+	}
+	if tenant != requestIdentity(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+	if err := s3utils.CheckValidBucketNameStrict(name); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("tenant bucket: tenant: %s, error: %s", tenant, err)
+		return nil, false
+	}
+
+	t.mu.Lock()
+	b, ok := t.buckets[name]
+	if !ok {
+		b = &tenantBucket{done: make(chan struct{})}
+		t.buckets[name] = b
+		// The bucket is set up for everyone waiting on it, so it can't
+		// stop when this request does
+		go t.create(context.WithoutCancel(r.Context()), name, b)
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-r.Context().Done():
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if b.handler == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	return b.handler, true
+}
+
+// create sets up a tenant's bucket. If it fails the bucket is forgotten, so
+// the next request tries again.
+func (t *tenantBuckets) create(ctx context.Context, name string, b *tenantBucket) {
+	defer close(b.done)
+
+	ctx, cancel := context.WithTimeout(ctx, startupTimeout)
+	defer cancel()
+
+	fail := func(err error) {
+		log.Printf("tenant bucket: bucket: %s, error: %s", name, err)
+		t.mu.Lock()
+		delete(t.buckets, name)
+		t.mu.Unlock()
+	}
+
+	err := ensureBucket(ctx, t.maker, name, t.setup)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	bs := t.newServer(name)
+	err = bs.loadCatalog(ctx)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	if t.started != nil {
+		t.started(bs)
+	}
+	b.handler = t.wrap(bs)
+}
@@ -0,0 +1,85 @@
+package filesrv
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantBuckets(t *testing.T) {
+	store := newMemObjStore()
+	maker := &fakeBucketMaker{}
+	cfg := defaultConfig()
+	cfg.Bucket = "testBucket"
+	cfg.EncryptionKey = "key"
+	cfg.ChunkSize = 10 << 17
+	cfg.TenantBucketPrefix = "tenant-"
+
+	var started []string
+	s := newServerFromConfig(store, cfg)
+	s = s.withTenantBuckets(store, maker, cfg, func(bs server) { started = append(started, bs.bucketName) })
+	handler := s.routes()
+
+	do := func(r *http.Request, user string) int {
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	// The bucket is created on first use
+	require.Equal(t, http.StatusCreated, do(newUploadRequest(t, "/b/tenant-alice/upload", "notes.txt", "test file contents"), "alice"))
+	require.True(t, maker.made)
+	require.Equal(t, []string{"tenant-alice"}, started)
+
+	store.mu.Lock()
+	_, ok := store.objects["tenant-alice/notes.txt"]
+	store.mu.Unlock()
+	require.True(t, ok)
+
+	require.Equal(t, http.StatusOK, do(httptest.NewRequest(http.MethodGet, "/b/tenant-alice/file/notes.txt", nil), "alice"))
+	require.Equal(t, []string{"tenant-alice"}, started)
+
+	// Tenants can only use their own bucket
+	require.Equal(t, http.StatusForbidden, do(httptest.NewRequest(http.MethodGet, "/b/tenant-alice/file/notes.txt", nil), "bob"))
+	require.Equal(t, http.StatusNotFound, do(httptest.NewRequest(http.MethodGet, "/b/other/file/notes.txt", nil), "alice"))
+	require.Equal(t, http.StatusBadRequest, do(httptest.NewRequest(http.MethodGet, "/b/tenant-Bob_Smith/files", nil), "Bob_Smith"))
+}
+
+func TestTenantBucketCreateFails(t *testing.T) {
+	store := newMemObjStore()
+	maker := &fakeBucketMaker{makeErr: errors.New("access denied")}
+	cfg := defaultConfig()
+	cfg.TenantBucketPrefix = "tenant-"
+
+	s := newServerFromConfig(store, cfg).withTenantBuckets(store, maker, cfg, nil)
+	handler := s.routes()
+
+	get := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/b/tenant-alice/files", nil)
+		r.Header.Set(identityHeader, "alice")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+
+	require.Equal(t, http.StatusServiceUnavailable, get())
+
+	// A failed bucket is tried again on the next request
+	maker.makeErr = nil
+	require.Equal(t, http.StatusOK, get())
+	require.True(t, maker.made)
+}
+
+func TestTenantBucketsOff(t *testing.T) {
+	cfg := defaultConfig()
+	s := newServerFromConfig(newMemObjStore(), cfg).withTenantBuckets(newMemObjStore(), &fakeBucketMaker{}, cfg, nil)
+	require.Nil(t, s.tenants)
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/b/tenant-alice/files", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
@@ -0,0 +1,102 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the decoder for thumbnails
+	"image/jpeg"
+	_ "image/png" // registers the decoder for thumbnails
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// thumbnailPrefix is where thumbnails are stored in the bucket, the
+	// leading dot keeps them apart from uploads
+	thumbnailPrefix = ".thumbnails/"
+	// thumbnailSize is the longest side of a thumbnail in pixels
+	thumbnailSize = 256
+	// maxThumbnailSourceSize is the largest image a thumbnail will be made
+	// from, the whole image has to be decoded in memory
+	maxThumbnailSourceSize = 32 << 20 // 32MB
+)
+
+// thumbnailStage stores a small JPEG version of uploaded images, which is
+// served at /file/:filename/thumbnail. Other files are skipped.
+func thumbnailStage(ctx context.Context, s server, u *pendingUpload) error {
+	mediaType, _, _ := mime.ParseMediaType(u.Stored.ContentType)
+	if !strings.HasPrefix(mediaType, "image/") || u.Stored.Size > maxThumbnailSourceSize {
+		return nil
+	}
+
+	var b bytes.Buffer
+	err := s.getFile(ctx, &b, u.Stored.Name)
+	if err != nil {
+		return fmt.Errorf("get image: %w", err)
+	}
+
+	img, _, err := image.Decode(&b)
+	if err == image.ErrFormat {
+		// Not a format that can be decoded, so there's no thumbnail
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+
+	var thumb bytes.Buffer
+	err = jpeg.Encode(&thumb, resize(img, thumbnailSize), &jpeg.Options{Quality: 80})
+	if err != nil {
+		return fmt.Errorf("encode thumbnail: %w", err)
+	}
+
+	_, err = s.putFile(ctx, thumbnailPrefix+u.Stored.Name, &thumb, int64(thumb.Len()))
+	if err != nil {
+		return fmt.Errorf("store thumbnail: %w", err)
+	}
+
+	return nil
+}
+
+// resize scales img down with nearest neighbour sampling so its longest side
+// is at most size, images that are already small enough are returned as they
+// are
+func resize(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	tw, th = max(tw, 1), max(th, 1)
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		for x := 0; x < tw; x++ {
+			thumb.Set(x, y, img.At(bounds.Min.X+x*w/tw, bounds.Min.Y+y*h/th))
+		}
+	}
+
+	return thumb
+}
+
+// handleGetThumbnail returns the thumbnail for an uploaded image
+func (s server) handleGetThumbnail(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "image/jpeg")
+
+	err := s.getFile(r.Context(), w, thumbnailPrefix+ps.ByName("filename"))
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeStorageError(w, err, "get thumbnail")
+		return
+	}
+}
@@ -0,0 +1,67 @@
+package filesrv
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name   string
+		bounds image.Rectangle
+		want   image.Point
+	}{
+		{name: "landscape", bounds: image.Rect(0, 0, 1024, 512), want: image.Pt(256, 128)},
+		{name: "portrait", bounds: image.Rect(0, 0, 300, 600), want: image.Pt(128, 256)},
+		{name: "already small", bounds: image.Rect(0, 0, 100, 50), want: image.Pt(100, 50)},
+		{name: "offset bounds", bounds: image.Rect(10, 10, 522, 522), want: image.Pt(256, 256)},
+		{name: "very thin", bounds: image.Rect(0, 0, 4096, 1), want: image.Pt(256, 1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, resize(image.NewGray(test.bounds), thumbnailSize).Bounds().Size())
+		})
+	}
+}
+
+func TestHandleGetThumbnail(t *testing.T) {
+	var img bytes.Buffer
+	require.NoError(t, png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 512, 512))))
+
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	s.pipelines = mustPipelines([]pipelineRule{
+		{ContentType: "*", Stages: []string{"sniff", "store", "index", "thumbnail"}},
+	})
+	router := s.routes()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, "/upload", "image.png", img.String()))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, newUploadRequest(t, "/upload", "text", "test file contents"))
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/image.png/thumbnail", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "image/jpeg", w.Result().Header.Get("Content-Type"))
+
+	thumb, err := jpeg.Decode(w.Body)
+	require.NoError(t, err)
+	require.Equal(t, image.Pt(256, 256), thumb.Bounds().Size())
+
+	// Only images get thumbnails
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/file/text/thumbnail", nil))
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
@@ -0,0 +1,342 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// tierHeader names the tier of the user making the request. Like
+	// identityHeader it's set by the authenticating proxy, which knows what
+	// each tenant pays for, and it wins over the tenants listed in the config.
+	tierHeader = "X-Filesrv-Tier"
+	// tierBurst is how far ahead of its rate a tenant can get, so small
+	// requests aren't slowed down at all
+	tierBurst = time.Second
+	// tierWriteChunk is the most of a response that's written between waits,
+	// so a big write doesn't go out in one burst and then stall
+	tierWriteChunk = 32 << 10
+)
+
+// tierRequestsLimited counts the requests turned away because their tenant
+// was already running as many as its tier allows, by tier
+var tierRequestsLimited = expvar.NewMap("tier_requests_limited")
+
+// tierConfig is a service level, the limits apply to each tenant in the tier
+// on its own. Tenants not in any tier get the default tier, and without one
+// they aren't limited at all. Zero means no limit.
+type tierConfig struct {
+	Name    string   `yaml:"name"`
+	Default bool     `yaml:"default"`
+	Tenants []string `yaml:"tenants"`
+	// UploadRate and DownloadRate are in bytes a second, across all of a
+	// tenant's requests
+	UploadRate   int64 `yaml:"upload-rate"`
+	DownloadRate int64 `yaml:"download-rate"`
+	// Concurrency is how many requests a tenant can have running at once
+	Concurrency int `yaml:"concurrency"`
+}
+
+// validateTiers checks the tiers
+func validateTiers(tiers []tierConfig) error {
+	var errs []error
+	seen := map[string]bool{}
+	tenants := map[string]string{}
+	var defaultTier string
+	for i, t := range tiers {
+		fail := func(format string, args ...any) {
+			errs = append(errs, listProblem(tiersSection, i, "tier %d (%s): %s", i+1, t.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if t.Name == "" {
+			fail("name is empty")
+		}
+		if seen[t.Name] {
+			fail("defined more than once")
+		}
+		seen[t.Name] = true
+		if t.Default {
+			if defaultTier != "" {
+				fail("tier %s is already the default", defaultTier)
+			}
+			defaultTier = t.Name
+		}
+		for _, tenant := range t.Tenants {
+			if other, ok := tenants[tenant]; ok {
+				fail("tenant %s is already in tier %s", tenant, other)
+			}
+			tenants[tenant] = t.Name
+		}
+		if t.UploadRate < 0 || t.DownloadRate < 0 || t.Concurrency < 0 {
+			fail("limits can't be negative")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// tenantTiers applies the limits of each tenant's tier
+type tenantTiers struct {
+	tiers       map[string]tierConfig
+	byTenant    map[string]string
+	defaultTier string
+
+	mu sync.Mutex
+	// active are the limits for the tenants with requests running, they're
+	// dropped once a tenant's last request finishes so idle tenants don't
+	// pile up
+	active map[string]*tenantLimits
+}
+
+// tenantLimits are one tenant's share of its tier's limits
+type tenantLimits struct {
+	requests int
+	// running holds a token for each running request, it's nil without a
+	// concurrency limit
+	running  chan struct{}
+	upload   *rateLimiter
+	download *rateLimiter
+}
+
+// newTenantTiers returns the tiers, or nil if there aren't any
+func newTenantTiers(tiers []tierConfig) *tenantTiers {
+	if len(tiers) == 0 {
+		return nil
+	}
+
+	t := &tenantTiers{
+		tiers:    map[string]tierConfig{},
+		byTenant: map[string]string{},
+		active:   map[string]*tenantLimits{},
+	}
+	for _, tier := range tiers {
+		t.tiers[tier.Name] = tier
+		if tier.Default {
+			t.defaultTier = tier.Name
+		}
+		for _, tenant := range tier.Tenants {
+			t.byTenant[tenant] = tier.Name
+		}
+	}
+
+	return t
+}
+
+// configs returns the tiers sorted by name, for telling whether they've
+// changed
+func (t *tenantTiers) configs() []tierConfig {
+	if t == nil {
+		return nil
+	}
+
+	configs := make([]tierConfig, 0, len(t.tiers))
+	for _, name := range sortedKeys(t.tiers) {
+		configs = append(configs, t.tiers[name])
+	}
+	return configs
+}
+
+// tierOf returns the tier the request's tenant is in, from the proxy if it
+// says and otherwise from the config. A tier the proxy names that isn't in
+// the config gets the default, so a typo can't lift the limits.
+func (t *tenantTiers) tierOf(r *http.Request) (tierConfig, bool) {
+	name, ok := r.Header.Get(tierHeader), true
+	if name == "" {
+		name, ok = t.byTenant[requestIdentity(r)]
+	}
+	tier, known := t.tiers[name]
+	if !known {
+		if ok && name != "" {
+			log.Printf("unknown tier: tier: %s, user: %s", name, requestIdentity(r))
+		}
+		tier, known = t.tiers[t.defaultTier]
+	}
+
+	return tier, known
+}
+
+// acquire takes one of the tenant's request slots, the returned function
+// gives it back. It fails if the tenant is already running as many requests
+// as its tier allows.
+func (t *tenantTiers) acquire(tenant string, tier tierConfig) (*tenantLimits, func(), bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The key includes the tier so a tenant that's moved between tiers gets
+	// the new limits once its old requests are done
+	key := tier.Name + "\x00" + tenant
+	l, ok := t.active[key]
+	if !ok {
+		l = &tenantLimits{
+			upload:   newRateLimiter(tier.UploadRate),
+			download: newRateLimiter(tier.DownloadRate),
+		}
+		if tier.Concurrency > 0 {
+			l.running = make(chan struct{}, tier.Concurrency)
+		}
+		t.active[key] = l
+	}
+
+	if l.running != nil {
+		select {
+		case l.running <- struct{}{}:
+		default:
+			return nil, nil, false
+		}
+	}
+	l.requests++
+
+	return l, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if l.running != nil {
+			<-l.running
+		}
+		l.requests--
+		if l.requests == 0 {
+			delete(t.active, key)
+		}
+	}, true
+}
+
+// withTiers holds each request to the limits of its tenant's tier. Requests
+// over the concurrency limit are turned away rather than queued, since
+// they'd only be waiting on the tenant's own requests. The tiers come from
+// current since they can be reloaded, requests that are already running
+// keep to the limits they started with.
+func withTiers(next http.Handler, current func() *tenantTiers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tiers := current()
+		if tiers == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tier, ok := tiers.tierOf(r)
+		if !ok || requestPriority(r) == priorityExempt {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limits, release, ok := tiers.acquire(requestIdentity(r), tier)
+		if !ok {
+			tierRequestsLimited.Add(tier.Name, 1)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+
+		if limits.upload != nil {
+			r.Body = &throttledReader{ReadCloser: r.Body, ctx: r.Context(), limiter: limits.upload}
+		}
+		if limits.download != nil {
+			w = &throttledResponseWriter{ResponseWriter: w, ctx: r.Context(), limiter: limits.download}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiter spaces out bytes to a rate, it's shared by all of a tenant's
+// requests so opening more connections doesn't get around it
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	// next is when the bytes reserved so far will have been used up at the
+	// rate
+	next time.Time
+}
+
+// newRateLimiter returns a limiter for bytes a second, or nil for no limit
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{rate: float64(rate)}
+}
+
+// reserve takes n bytes and returns how long to wait before using them
+func (l *rateLimiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if earliest := now.Add(-tierBurst); l.next.Before(earliest) {
+		l.next = earliest
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+
+	return l.next.Sub(now)
+}
+
+// wait waits until n bytes can be used, or the context is done
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	delay := l.reserve(time.Now(), n)
+	if delay <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// throttledReader reads a request body no faster than its limiter allows
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// throttledResponseWriter writes a response body no faster than its limiter
+// allows
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), tierWriteChunk)]
+		if err := w.limiter.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter
+func (w *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,139 @@
+package filesrv
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+	now := time.Now()
+
+	// A second's worth goes straight through
+	require.LessOrEqual(t, l.reserve(now, 600), time.Duration(0))
+	require.LessOrEqual(t, l.reserve(now, 400), time.Duration(0))
+	// Then it's held to the rate
+	require.Equal(t, 500*time.Millisecond, l.reserve(now, 500))
+	require.Equal(t, time.Second, l.reserve(now, 500))
+
+	// Time spent idle doesn't build up more than the burst
+	later := now.Add(time.Hour)
+	require.LessOrEqual(t, l.reserve(later, 1000), time.Duration(0))
+	require.Equal(t, 100*time.Millisecond, l.reserve(later, 100))
+
+	require.Nil(t, newRateLimiter(0))
+}
+
+func TestTierOf(t *testing.T) {
+	tiers := newTenantTiers([]tierConfig{
+		{Name: "free", Default: true, Concurrency: 2},
+		{Name: "paid", Tenants: []string{"acme"}, Concurrency: 20},
+	})
+
+	tierOf := func(user, tier string) string {
+		r := httptest.NewRequest(http.MethodGet, "/file/a.txt", nil)
+		r.Header.Set(identityHeader, user)
+		r.Header.Set(tierHeader, tier)
+		got, ok := tiers.tierOf(r)
+		require.True(t, ok)
+		return got.Name
+	}
+
+	require.Equal(t, "paid", tierOf("acme", ""))
+	require.Equal(t, "free", tierOf("initech", ""))
+	require.Equal(t, "paid", tierOf("initech", "paid"), "the proxy wins")
+	require.Equal(t, "free", tierOf("acme", "platinum"), "unknown tiers get the default")
+
+	// Without a default, tenants that aren't in a tier aren't limited
+	tiers = newTenantTiers([]tierConfig{{Name: "paid", Tenants: []string{"acme"}}})
+	_, ok := tiers.tierOf(httptest.NewRequest(http.MethodGet, "/file/a.txt", nil))
+	require.False(t, ok)
+
+	require.Nil(t, newTenantTiers(nil))
+}
+
+func TestWithTiers(t *testing.T) {
+	tiers := newTenantTiers([]tierConfig{
+		{Name: "free", Default: true, Concurrency: 1, DownloadRate: 1 << 20},
+		{Name: "paid", Tenants: []string{"acme"}},
+	})
+
+	started, finish := make(chan struct{}), make(chan struct{})
+	handler := withTiers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-finish
+		}
+		io.WriteString(w, "contents")
+	}), func() *tenantTiers { return tiers })
+	do := func(target, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- do("/slow", "initech") }()
+	<-started
+
+	// The free tenant is at its limit, but others and the probes aren't
+	w := do("/file/a.txt", "initech")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+	require.Equal(t, http.StatusOK, do("/file/a.txt", "globex").Code)
+	require.Equal(t, http.StatusOK, do("/file/a.txt", "acme").Code)
+	require.Equal(t, http.StatusOK, do("/readyz", "initech").Code)
+
+	close(finish)
+	w = <-done
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "contents", w.Body.String())
+
+	// The slot is given back, and forgotten about once it's idle
+	require.Equal(t, http.StatusOK, do("/file/a.txt", "initech").Code)
+	require.Empty(t, tiers.active)
+}
+
+func TestLoadConfigFileTiers(t *testing.T) {
+	path := writeConfigFile(t, testConfigFile+`
+tiers:
+  - name: free
+    default: true
+    upload-rate: 1048576
+    download-rate: 4194304
+    concurrency: 4
+  - name: paid
+    tenants: [acme, globex]
+    concurrency: 64
+`)
+
+	cfg, _, err := loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, []tierConfig{
+		{Name: "free", Default: true, UploadRate: 1 << 20, DownloadRate: 4 << 20, Concurrency: 4},
+		{Name: "paid", Tenants: []string{"acme", "globex"}, Concurrency: 64},
+	}, cfg.Tiers)
+
+	path = writeConfigFile(t, testConfigFile+`
+tiers:
+  - name: free
+    default: true
+    tenants: [acme]
+  - name: paid
+    default: true
+    tenants: [acme]
+    concurrency: -1
+`)
+	_, _, err = loadConfig([]string{"-config", path}, func(string) (string, bool) { return "", false }, io.Discard)
+	require.ErrorContains(t, err, "tier 2 (paid): tier free is already the default")
+	require.ErrorContains(t, err, "tier 2 (paid): tenant acme is already in tier free")
+	require.ErrorContains(t, err, "tier 2 (paid): limits can't be negative")
+	require.Equal(t, "tiers[1]", configProblems(err)[0].Path)
+}
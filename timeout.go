@@ -0,0 +1,50 @@
+package filesrv
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// requestTimeoutHeader lets clients say how long they are willing to wait,
+// interactive clients can ask to fail fast and batch clients can allow for long
+// transfers
+const requestTimeoutHeader = "X-Request-Timeout"
+
+// parseTimeout reads a positive timeout given either as a duration like 30s or
+// as a number of seconds
+func parseTimeout(v string) (time.Duration, bool) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, false
+		}
+		d = time.Duration(n) * time.Second
+	}
+
+	return d, d > 0
+}
+
+// withRequestTimeout sets a deadline on the context of every request, which
+// the storage operations for the request all use. The deadline comes from the
+// X-Request-Timeout header if there is one, and is never more than max.
+func withRequestTimeout(next http.Handler, max time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := max
+		if v := r.Header.Get(requestTimeoutHeader); v != "" {
+			d, ok := parseTimeout(v)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			timeout = min(d, max)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
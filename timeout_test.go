@@ -0,0 +1,89 @@
+package filesrv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		wantStatus   int
+		wantDeadline time.Duration
+	}{
+		{
+			name:         "no header",
+			wantStatus:   http.StatusOK,
+			wantDeadline: time.Hour,
+		},
+		{
+			name:         "seconds",
+			header:       "5",
+			wantStatus:   http.StatusOK,
+			wantDeadline: 5 * time.Second,
+		},
+		{
+			name:         "duration",
+			header:       "1m30s",
+			wantStatus:   http.StatusOK,
+			wantDeadline: 90 * time.Second,
+		},
+		{
+			name:         "longer than the maximum",
+			header:       "48h",
+			wantStatus:   http.StatusOK,
+			wantDeadline: time.Hour,
+		},
+		{
+			name:       "zero",
+			header:     "0",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid",
+			header:     "later",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var deadline time.Time
+			handler := withRequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ = r.Context().Deadline()
+			}), time.Hour)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.header != "" {
+				req.Header.Set(requestTimeoutHeader, test.header)
+			}
+
+			w := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(w, req)
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+
+			if test.wantStatus == http.StatusOK {
+				require.WithinDuration(t, start.Add(test.wantDeadline), deadline, time.Second)
+			}
+		})
+	}
+}
+
+func TestWatchRequestTimeout(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	// A request timeout shorter than the watch timeout ends the watch early
+	// in the same way
+	req := httptest.NewRequest(http.MethodGet, "/watch?timeout=1m", nil)
+	req.Header.Set(requestTimeoutHeader, "10ms")
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+}
@@ -0,0 +1,79 @@
+package filesrv
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsConfig returns the TLS config for serving HTTPS, or nil to serve plain
+// HTTP. Certificates either come from files or are provisioned from Let's
+// Encrypt for the autocert hosts. Clients are asked for a certificate if
+// there's an mtls auth provider.
+func (c config) tlsConfig() (*tls.Config, error) {
+	cfg, err := c.serverTLSConfig()
+	if cfg == nil || err != nil {
+		return cfg, err
+	}
+
+	for _, a := range c.Auth {
+		if a.Type != authMTLS {
+			continue
+		}
+		cfg.ClientCAs, err = a.clientCAs()
+		if err != nil {
+			return nil, fmt.Errorf("auth provider %s: %w", a.Name, err)
+		}
+		// Clients without a certificate can still use the other providers
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// serverTLSConfig returns the TLS config for the server's certificates
+func (c config) serverTLSConfig() (*tls.Config, error) {
+	switch {
+	case c.TLSCertFile != "":
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate: %w", err)
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil
+	case c.AutocertHosts != "":
+		// The TLS-ALPN-01 challenge is answered on the same port, so
+		// nothing else needs to listen on port 80
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(splitList(c.AutocertHosts)...),
+			Cache:      autocert.DirCache(c.AutocertCacheDir),
+			Email:      c.AutocertEmail,
+		}
+		cfg := m.TLSConfig()
+		cfg.MinVersion = tls.VersionTLS12
+		return cfg, nil
+	default:
+		return nil, nil
+	}
+}
+
+// validateTLS checks that the TLS settings make sense together
+func (c config) validateTLS() error {
+	var errs []error
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, settingProblem("tls-cert", "TLS cert file and key file have to be set together"))
+	}
+	if c.TLSCertFile != "" && c.AutocertHosts != "" {
+		errs = append(errs, settingProblem("autocert-hosts", "TLS cert files and autocert hosts can't both be set"))
+	}
+	if c.AutocertHosts != "" && c.AutocertCacheDir == "" {
+		errs = append(errs, settingProblem("autocert-cache", "autocert needs a cache directory, or every restart would request new certificates"))
+	}
+
+	return errors.Join(errs...)
+}
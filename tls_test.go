@@ -0,0 +1,142 @@
+package filesrv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert writes a self signed certificate for 127.0.0.1 and its key to
+// files
+func writeTestCert(t *testing.T) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "filesrv test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	return certFile, keyFile
+}
+
+func TestServeTLS(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = writeTestCert(t)
+
+	tlsConfig, err := cfg.tlsConfig()
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, &http.Server{Handler: http.NotFoundHandler()}, tls.NewListener(l, tlsConfig), time.Second)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + l.Addr().String() + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NotNil(t, resp.TLS)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestTLSConfig(t *testing.T) {
+	cfg := defaultConfig()
+	tlsConfig, err := cfg.tlsConfig()
+	require.NoError(t, err)
+	require.Nil(t, tlsConfig)
+
+	cfg.AutocertHosts = "files.example.com"
+	tlsConfig, err = cfg.tlsConfig()
+	require.NoError(t, err)
+	require.NotNil(t, tlsConfig.GetCertificate)
+
+	cfg = defaultConfig()
+	cfg.TLSCertFile, cfg.TLSKeyFile = "missing.pem", "missing.key"
+	_, err = cfg.tlsConfig()
+	require.ErrorContains(t, err, "load TLS certificate")
+}
+
+func TestValidateTLS(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(*config)
+		wantErr string
+	}{
+		{
+			name: "plain http",
+			set:  func(*config) {},
+		},
+		{
+			name:    "cert without key",
+			set:     func(c *config) { c.TLSCertFile = "cert.pem" },
+			wantErr: "TLS cert file and key file have to be set together",
+		},
+		{
+			name: "cert files and autocert",
+			set: func(c *config) {
+				c.TLSCertFile, c.TLSKeyFile = "cert.pem", "key.pem"
+				c.AutocertHosts = "files.example.com"
+			},
+			wantErr: "TLS cert files and autocert hosts can't both be set",
+		},
+		{
+			name: "autocert without a cache",
+			set: func(c *config) {
+				c.AutocertHosts = "files.example.com"
+				c.AutocertCacheDir = ""
+			},
+			wantErr: "autocert needs a cache directory",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			test.set(&cfg)
+
+			err := cfg.validateTLS()
+			if test.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, test.wantErr)
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// tmpPrefix is where files in the /tmp namespace are stored in the bucket.
+// Uploaded filenames can't contain a slash, so these can never clash with
+// normal uploads.
+const tmpPrefix = "tmp/"
+
+// withTmp passes the filename of a /tmp/file route on as the name it's stored
+// under, so the /file handlers and access checks work on it. Pinning a file in
+// the /tmp namespace stops it expiring.
+func withTmp(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		h(w, r, httprouter.Params{{Key: "filename", Value: tmpPrefix + ps.ByName("filename")}})
+	}
+}
+
+// handlePostUploadTmpFile works like handlePostUploadFile, but the file is
+// deleted once it is older than the tmp TTL
+func (s server) handlePostUploadTmpFile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s.uploadFile(w, r, tmpPrefix)
+}
+
+// handleGetTmpFile returns a file from the /tmp namespace, files that have
+// expired but haven't been swept yet are treated as missing
+func (s server) handleGetTmpFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := tmpPrefix + ps.ByName("filename")
+	if !s.checkAccess(w, r, filename, accessRead) || !s.readConsistent(w, r, filename) || !s.downloadAllowed(w, r, filename) {
+		return
+	}
+
+	info, err := s.minioClient.StatObject(r.Context(), s.bucketName, filename)
+	if err != nil {
+		writeStorageError(w, err, "stat tmp file")
+		return
+	}
+
+	// Pinned files don't expire
+	if !s.pinned(filename) {
+		expires := info.LastModified.Add(s.tmpTTL)
+		if time.Now().After(expires) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+	}
+
+	e, _ := s.catalog.get(filename)
+	if e.ContentType == "" {
+		e.ContentType = info.ContentType
+	}
+	if !s.setFileHeaders(w, r, filename, e) {
+		return
+	}
+
+	err = s.getFile(r.Context(), w, filename)
+	if err != nil {
+		clearFileHeaders(w.Header())
+		writeStorageError(w, err, "get tmp file")
+		return
+	}
+}
+
+// sweepTmp deletes every file in the /tmp namespace that is older than the
+// TTL and isn't pinned, and returns how many were deleted
+func (s server) sweepTmp(ctx context.Context, now time.Time) (int, error) {
+	objects, err := s.minioClient.ListObjects(ctx, s.bucketName, tmpPrefix)
+	if err != nil {
+		return 0, fmt.Errorf("list tmp files: %w", err)
+	}
+
+	var removed int
+	var errs []error
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Key, tmpPrefix) || now.Sub(obj.LastModified) < s.tmpTTL || s.pinned(obj.Key) {
+			continue
+		}
+
+		err := s.minioClient.RemoveObject(ctx, s.bucketName, obj.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("remove %s: %w", obj.Key, err))
+			continue
+		}
+		removed++
+
+		err = s.unindex(ctx, obj.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unindex %s: %w", obj.Key, err))
+		}
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// sweepTmpOnce runs sweepTmp and logs the result, for runEvery
+func (s server) sweepTmpOnce(ctx context.Context, now time.Time) {
+	removed, err := s.sweepTmp(ctx, now)
+	if err != nil {
+		log.Println("sweep tmp:", err)
+	}
+	if removed > 0 {
+		log.Println("removed", removed, "expired tmp files")
+	}
+}
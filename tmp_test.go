@@ -0,0 +1,123 @@
+package filesrv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTmpFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		age        time.Duration
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "should work",
+			wantStatus: http.StatusOK,
+			wantBody:   "test file contents",
+		},
+		{
+			name:       "expired",
+			age:        2 * time.Hour,
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newMemObjStore()
+			s := NewServer(store, "testBucket", "key", 10<<17)
+			s.tmpTTL = time.Hour
+
+			w := httptest.NewRecorder()
+			s.handlePostUploadTmpFile(w, newUploadRequest(t, "/tmp/upload", "scratch.txt", "test file contents"), nil)
+			require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+			store.setModified("testBucket", "tmp/scratch.txt", time.Now().Add(-test.age))
+
+			req := httptest.NewRequest(http.MethodGet, "/tmp/file/scratch.txt", nil)
+			w = httptest.NewRecorder()
+
+			s.handleGetTmpFile(w, req, httprouter.Params{{Key: "filename", Value: "scratch.txt"}})
+
+			require.Equal(t, test.wantStatus, w.Result().StatusCode)
+			require.Equal(t, test.wantBody, w.Body.String())
+		})
+	}
+}
+
+func TestHandleGetTmpFileACL(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	r := newUploadRequest(t, "/tmp/upload", "scratch.txt", "test file contents")
+	r.Header.Set(identityHeader, "alice")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+	e, ok := s.catalog.get("tmp/scratch.txt")
+	require.True(t, ok)
+	e.ACL = []grant{{User: "bob", Access: accessRead}}
+	s.catalog.put(e)
+
+	get := func(user string) int {
+		r := httptest.NewRequest(http.MethodGet, "/tmp/file/scratch.txt", nil)
+		r.Header.Set(identityHeader, user)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Result().StatusCode
+	}
+	require.Equal(t, http.StatusOK, get("alice"))
+	require.Equal(t, http.StatusOK, get("bob"))
+	require.Equal(t, http.StatusForbidden, get("carol"))
+}
+
+func TestHandleGetTmpFileNotFound(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+
+	req := httptest.NewRequest(http.MethodGet, "/tmp/file/missing.txt", nil)
+	w := httptest.NewRecorder()
+
+	s.handleGetTmpFile(w, req, httprouter.Params{{Key: "filename", Value: "missing.txt"}})
+
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
+
+func TestSweepTmp(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	s.tmpTTL = time.Hour
+
+	for _, name := range []string{"tmp/old.txt", "tmp/new.txt", "kept.txt"} {
+		_, err := s.putFile(context.Background(), name, strings.NewReader(""), 0)
+		require.NoError(t, err)
+	}
+
+	now := time.Now()
+	store.setModified("testBucket", "tmp/old.txt", now.Add(-2*time.Hour))
+	store.setModified("testBucket", "kept.txt", now.Add(-2*time.Hour))
+
+	removed, err := s.sweepTmp(context.Background(), now)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+
+	objects, err := store.ListObjects(context.Background(), "testBucket", "")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	require.Equal(t, "kept.txt", objects[0].Key)
+	require.Equal(t, "tmp/new.txt", objects[1].Key)
+
+	store.listErr = errors.New("a list error")
+	_, err = s.sweepTmp(context.Background(), now)
+	require.Error(t, err)
+}
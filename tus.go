@@ -0,0 +1,457 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// tusVersion is the version of the tus protocol that's supported, see
+	// https://tus.io/protocols/resumable-upload
+	tusVersion = "1.0.0"
+	// tusExtensions are the tus extensions that are supported
+	tusExtensions = "creation,expiration,termination"
+	// tusExpiry is how long a client has to finish an upload. It's no longer
+	// than incompleteUploadMaxAge so the sweeper doesn't abort the multipart
+	// upload behind one that can still be resumed.
+	tusExpiry = incompleteUploadMaxAge
+)
+
+// tusUpload is a file being uploaded with the tus protocol. The stages before
+// store run once the start of the file has arrived, after which it's stored
+// a part at a time as a chunkedUpload, so only a part of it is ever held in
+// memory. The rest of the pipeline runs once the last byte has been received.
+type tusUpload struct {
+	id      string
+	owner   string
+	expires time.Time
+
+	// mu is held while data is being added, tus clients send one PATCH at a
+	// time for an upload
+	mu sync.Mutex
+	// offset is how much has been received, it can be read without mu so
+	// the client can find out while a PATCH it gave up on is still going
+	offset  atomic.Int64
+	u       *pendingUpload
+	p       pipeline
+	hash    hash.Hash
+	head    []byte
+	pending []byte
+	chunked *chunkedUpload
+	parts   int
+	// last is set once the final part has been stored, so completing the
+	// object can be retried without sending it again
+	last bool
+	done bool
+}
+
+// tusUploads are the tus uploads that haven't expired, they're only kept in
+// memory so they can't be resumed after a restart
+type tusUploads struct {
+	mu      sync.Mutex
+	uploads map[string]*tusUpload
+}
+
+func newTusUploads() *tusUploads {
+	return &tusUploads{uploads: map[string]*tusUpload{}}
+}
+
+// add records a new upload, throwing away the ones that have expired
+func (t *tusUploads) add(s server, upload *tusUpload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for id, expired := range t.uploads {
+		if now.Before(expired.expires) {
+			continue
+		}
+		delete(t.uploads, id)
+		go s.abortTus(expired)
+	}
+
+	t.uploads[upload.id] = upload
+}
+
+// get returns the upload with the id, uploads belonging to someone else are
+// treated as not existing
+func (t *tusUploads) get(id, owner string) (*tusUpload, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	upload, ok := t.uploads[id]
+	if !ok || upload.owner != owner || time.Now().After(upload.expires) {
+		return nil, false
+	}
+
+	return upload, true
+}
+
+func (t *tusUploads) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.uploads, id)
+}
+
+// abortTus throws away whatever has been stored for an upload that won't be
+// finished
+func (s server) abortTus(upload *tusUpload) {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+
+	if upload.chunked == nil || upload.done {
+		return
+	}
+	err := s.abortChunked(upload.chunked)
+	if err != nil {
+		log.Printf("abort tus upload: filename: %s, error: %s", upload.u.Name, err)
+	}
+	upload.chunked = nil
+}
+
+// tusHandler checks that the request uses the supported version of the
+// protocol, which every tus response has to say
+func tusHandler(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		h(w, r, ps)
+	}
+}
+
+// setTusOptions adds the headers tus clients look for to find out what the
+// server supports to the response to an OPTIONS request
+func (s server) setTusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if maxSize := s.settings().policy.MaxSize; maxSize > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	}
+}
+
+// parseTusMetadata parses the Upload-Metadata header, a comma separated list
+// of keys each followed by a space and its base64 encoded value, which can
+// be left out
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("metadata %s: %w", key, err)
+		}
+		meta[key] = string(value)
+	}
+
+	return meta, nil
+}
+
+// handlePostTus creates a tus upload. The filename and content type come
+// from the filename and filetype metadata, and the naming strategy is applied
+// like for a multipart upload. Only pipelines that can run on the start of a
+// file can be used, since the file is never all in one place.
+func (s server) handlePostTus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("tus create: invalid Upload-Length:", r.Header.Get("Upload-Length"))
+		return
+	}
+
+	meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err == nil && meta["filename"] == "" {
+		err = errors.New("filename metadata is missing")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("tus create:", err)
+		return
+	}
+
+	filename, contentType := meta["filename"], meta["filetype"]
+	if failed := s.settings().policy.firstFailure(filename, size, contentType); failed != nil {
+		w.WriteHeader(failed.status)
+		log.Printf("upload rejected: filename: %s, check: %s, reason: %s", filename, failed.Name, failed.Reason)
+		return
+	}
+
+	name, err := s.objectName(r, filename)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("object name:", err)
+		return
+	}
+
+	region, err := s.placement.region(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("placement:", err)
+		return
+	}
+
+	if !s.checkAccess(w, r, name, accessWrite) || !s.checkQuota(w, name, size) {
+		return
+	}
+
+	p, ok := s.pipelineFor(contentType)
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		log.Printf("upload rejected: filename: %s, reason: no pipeline for %s", filename, contentType)
+		return
+	}
+	if !p.streamable() {
+		w.WriteHeader(http.StatusNotImplemented)
+		log.Printf("tus create: filename: %s, reason: the pipeline for %s needs the whole file", filename, contentType)
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("random id:", err)
+		return
+	}
+
+	upload := &tusUpload{
+		id:      hex.EncodeToString(id),
+		owner:   requestIdentity(r),
+		expires: time.Now().Add(tusExpiry),
+		u: &pendingUpload{
+			Name:         name,
+			OriginalName: filename,
+			ContentType:  contentType,
+			Source:       requestSource(r),
+			Size:         size,
+			Region:       region,
+		},
+		p:    p,
+		hash: sha256.New(),
+	}
+
+	// An empty file is already complete
+	if size == 0 {
+		upload.u.Content = bytes.NewReader(nil)
+		unlock := s.nameLocks.lock(upload.u.Name)
+		err = s.process(r.Context(), upload.u)
+		unlock()
+		if err != nil {
+			writeUploadError(w, err, upload.u.Name)
+			return
+		}
+		upload.done = true
+	}
+
+	s.tusUploads.add(s, upload)
+
+	// Relative to the request, so it works under /b/<bucket>/ too
+	w.Header().Set("Location", "tus/"+upload.id)
+	w.Header().Set("Upload-Expires", upload.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// handleHeadTus returns how much of an upload has been received, so the
+// client knows where to resume from
+func (s server) handleHeadTus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload, ok := s.tusUploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset.Load(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.u.Size, 10))
+	w.Header().Set("Upload-Expires", upload.expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePatchTus adds the body to the upload at Upload-Offset, which has to
+// be how much has been received so far. Everything read before the client
+// goes away is kept, and a HEAD request says where to carry on from.
+func (s server) handlePatchTus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload, ok := s.tusUploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if !upload.mu.TryLock() {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("tus patch: upload: %s, reason: another request is adding to it", upload.id)
+		return
+	}
+	defer upload.mu.Unlock()
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != upload.offset.Load() {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("tus patch: upload: %s, offset %s doesn't match %d", upload.id, r.Header.Get("Upload-Offset"), upload.offset.Load())
+		return
+	}
+
+	err = s.readTus(r.Context(), upload, io.LimitReader(r.Body, upload.u.Size-offset))
+	if err == nil && upload.offset.Load() == upload.u.Size && !upload.done {
+		err = s.finishTus(r.Context(), upload)
+	}
+	if err != nil {
+		var stageErr stageError
+		if errors.As(err, &stageErr) {
+			// The upload was rejected, so it can't be resumed
+			s.tusUploads.remove(upload.id)
+			if upload.chunked != nil {
+				if err := s.abortChunked(upload.chunked); err != nil {
+					log.Printf("abort tus upload: filename: %s, error: %s", upload.u.Name, err)
+				}
+			}
+		}
+		writeUploadError(w, err, upload.u.Name)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset.Load(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readTus adds what's read from body to the upload. If the body can't be read
+// to the end, what was read is kept for the client to resume after.
+func (s server) readTus(ctx context.Context, upload *tusUpload, body io.Reader) error {
+	buf := make([]byte, 32<<10)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			err := s.writeTus(ctx, upload, buf[:n])
+			if err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			log.Printf("tus patch: upload: %s, read body: %s", upload.id, readErr)
+			return nil
+		}
+	}
+}
+
+// writeTus adds data to the upload. Until the start of the file has arrived
+// it's kept for the stages before store, and after that it's stored a full
+// part at a time. The last part is always left for finishTus since it's
+// encrypted differently.
+func (s server) writeTus(ctx context.Context, upload *tusUpload, data []byte) error {
+	upload.hash.Write(data)
+	upload.offset.Add(int64(len(data)))
+
+	if upload.chunked == nil {
+		upload.head = append(upload.head, data...)
+		if int64(len(upload.head)) < min(ruleSampleSize, upload.u.Size) {
+			return nil
+		}
+
+		upload.u.Content = bytes.NewReader(upload.head)
+		p, err := s.processBeforeStore(ctx, upload.u)
+		if err != nil {
+			return err
+		}
+		upload.p = p
+		upload.u.Content = nil
+
+		upload.chunked, err = s.startChunked(ctx, upload.u.Name, upload.u.Region)
+		if err != nil {
+			return err
+		}
+		upload.pending, upload.head = upload.head, nil
+	} else {
+		upload.pending = append(upload.pending, data...)
+	}
+
+	for int64(len(upload.pending)) > upload.chunked.partSize {
+		err := s.putPart(ctx, upload.chunked, upload.parts+1, upload.pending[:upload.chunked.partSize], false)
+		if err != nil {
+			return err
+		}
+		upload.parts++
+		upload.pending = append(upload.pending[:0], upload.pending[upload.chunked.partSize:]...)
+	}
+
+	return nil
+}
+
+// finishTus stores the last part, puts the object together and runs the rest
+// of the pipeline
+func (s server) finishTus(ctx context.Context, upload *tusUpload) error {
+	unlock := s.nameLocks.lock(upload.u.Name)
+	defer unlock()
+
+	if !upload.last {
+		err := s.putPart(ctx, upload.chunked, upload.parts+1, upload.pending, true)
+		if err != nil {
+			return err
+		}
+		upload.parts++
+		upload.pending = nil
+		upload.last = true
+	}
+
+	info, err := s.completeChunked(ctx, upload.chunked)
+	if err != nil {
+		return err
+	}
+	upload.done = true
+
+	upload.u.setStored(storedFile{
+		Name:   upload.u.Name,
+		Size:   upload.u.Size,
+		SHA256: hex.EncodeToString(upload.hash.Sum(nil)),
+		Info:   info,
+	})
+	log.Println("uploaded file", upload.u.Name, "of size", info.Size)
+
+	return s.processFromStore(ctx, upload.p, upload.u)
+}
+
+// handleDeleteTus stops an upload and throws away what has been received
+func (s server) handleDeleteTus(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	upload, ok := s.tusUploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.tusUploads.remove(upload.id)
+	s.abortTus(upload)
+	w.WriteHeader(http.StatusNoContent)
+}
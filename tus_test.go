@@ -0,0 +1,227 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTus(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(method, target string, header map[string]string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	create := func(filename string, size int, extra map[string]string) *httptest.ResponseRecorder {
+		header := map[string]string{
+			"Upload-Length":   strconv.Itoa(size),
+			"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)) + ",filetype dGV4dC9wbGFpbg==",
+		}
+		for k, v := range extra {
+			header[k] = v
+		}
+		return do(http.MethodPost, "/tus", header, nil)
+	}
+	patch := func(location string, offset int, data []byte) *httptest.ResponseRecorder {
+		return do(http.MethodPatch, "/"+location, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}, data)
+	}
+
+	t.Run("upload in parts", func(t *testing.T) {
+		// More than two parts, so there's a part in the middle as well
+		contents := bytes.Repeat([]byte("0123456789abcdef"), (2*minChunkSize+minChunkSize/2)/16)
+
+		w := create("large.txt", len(contents), nil)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+		require.Equal(t, tusVersion, w.Header().Get("Tus-Resumable"))
+		require.NotEmpty(t, w.Header().Get("Upload-Expires"))
+		location := w.Header().Get("Location")
+		require.True(t, strings.HasPrefix(location, "tus/"))
+
+		// The pieces don't line up with the parts
+		offset := 0
+		for _, n := range []int{100, ruleSampleSize, minChunkSize, minChunkSize} {
+			w = patch(location, offset, contents[offset:offset+n])
+			require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+			offset += n
+			require.Equal(t, strconv.Itoa(offset), w.Header().Get("Upload-Offset"))
+		}
+
+		require.Equal(t, http.StatusConflict, patch(location, 0, contents[:10]).Result().StatusCode, "the offset has to match")
+
+		w = do(http.MethodHead, "/"+location, nil, nil)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, strconv.Itoa(offset), w.Header().Get("Upload-Offset"))
+		require.Equal(t, strconv.Itoa(len(contents)), w.Header().Get("Upload-Length"))
+		require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+		w = patch(location, offset, contents[offset:])
+		require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+		require.Equal(t, strconv.Itoa(len(contents)), w.Header().Get("Upload-Offset"))
+
+		var got bytes.Buffer
+		require.NoError(t, s.getFile(context.Background(), &got, "large.txt"))
+		require.True(t, bytes.Equal(contents, got.Bytes()))
+
+		e, ok := s.catalog.get("large.txt")
+		require.True(t, ok)
+		sum := sha256.Sum256(contents)
+		require.Equal(t, hex.EncodeToString(sum[:]), e.SHA256)
+		require.Equal(t, int64(len(contents)), e.Size)
+		require.Empty(t, store.incomplete)
+	})
+
+	t.Run("small", func(t *testing.T) {
+		w := create("small.txt", 18, nil)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+		location := w.Header().Get("Location")
+
+		require.Equal(t, http.StatusNoContent, patch(location, 0, []byte("test file")).Result().StatusCode)
+		require.Equal(t, http.StatusNoContent, patch(location, 9, []byte(" contents")).Result().StatusCode)
+
+		var got strings.Builder
+		require.NoError(t, s.getFile(context.Background(), &got, "small.txt"))
+		require.Equal(t, "test file contents", got.String())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		w := create("empty.txt", 0, nil)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+		w = do(http.MethodHead, "/"+w.Header().Get("Location"), nil, nil)
+		require.Equal(t, "0", w.Header().Get("Upload-Offset"))
+		_, ok := s.catalog.get("empty.txt")
+		require.True(t, ok)
+	})
+
+	t.Run("terminate", func(t *testing.T) {
+		w := create("gone.txt", ruleSampleSize*2, nil)
+		location := w.Header().Get("Location")
+		require.Equal(t, http.StatusNoContent, patch(location, 0, bytes.Repeat([]byte("a"), ruleSampleSize)).Result().StatusCode)
+		require.Len(t, store.incomplete, 1)
+
+		require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/"+location, nil, nil).Result().StatusCode)
+		require.Empty(t, store.incomplete)
+		require.Equal(t, http.StatusNotFound, do(http.MethodHead, "/"+location, nil, nil).Result().StatusCode)
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		w := create("mine.txt", 10, map[string]string{identityHeader: "alice"})
+		location := w.Header().Get("Location")
+
+		w = do(http.MethodHead, "/"+location, map[string]string{identityHeader: "bob"}, nil)
+		require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		require.Equal(t, http.StatusPreconditionFailed, do(http.MethodPost, "/tus", map[string]string{"Tus-Resumable": "0.2.2"}, nil).Result().StatusCode)
+		require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/tus", map[string]string{"Upload-Length": "10"}, nil).Result().StatusCode, "the filename is needed")
+		require.Equal(t, http.StatusBadRequest, create(".filesrv-selftest", 10, nil).Result().StatusCode)
+
+		location := create("bad.txt", 10, nil).Header().Get("Location")
+		w := do(http.MethodPatch, "/"+location, map[string]string{"Upload-Offset": "0"}, []byte("0123456789"))
+		require.Equal(t, http.StatusUnsupportedMediaType, w.Result().StatusCode)
+	})
+
+	t.Run("whole file pipeline", func(t *testing.T) {
+		s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+		s.pipelines = mustPipelines([]pipelineRule{{ContentType: "*", Stages: []string{"sniff", "scan", "store", "index"}}})
+		handler = s.routes()
+		defer func() { handler = s.routes() }()
+
+		require.Equal(t, http.StatusNotImplemented, create("test.txt", 10, nil).Result().StatusCode)
+	})
+}
+
+// failingCompleteStore fails to complete the first multipart upload
+type failingCompleteStore struct {
+	*memObjStore
+	failed bool
+}
+
+func (f *failingCompleteStore) CompleteMultipartUpload(ctx context.Context, bucketName, filename, uploadID string, parts []minio.CompletePart) (minio.UploadInfo, error) {
+	if !f.failed {
+		f.failed = true
+		return minio.UploadInfo{}, errors.New("a complete multipart upload error")
+	}
+
+	return f.memObjStore.CompleteMultipartUpload(ctx, bucketName, filename, uploadID, parts)
+}
+
+func TestTusRetryComplete(t *testing.T) {
+	store := &failingCompleteStore{memObjStore: newMemObjStore()}
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(method, target string, header map[string]string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		r.Header.Set("Tus-Resumable", tusVersion)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), ruleSampleSize/8)
+	w := do(http.MethodPost, "/tus", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(contents)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("retried.txt")),
+	}, nil)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	location := w.Header().Get("Location")
+
+	patch := map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": "0"}
+	w = do(http.MethodPatch, "/"+location, patch, contents)
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+
+	// Everything has been received, so the retry has no body
+	w = do(http.MethodHead, "/"+location, nil, nil)
+	require.Equal(t, strconv.Itoa(len(contents)), w.Header().Get("Upload-Offset"))
+
+	patch["Upload-Offset"] = strconv.Itoa(len(contents))
+	w = do(http.MethodPatch, "/"+location, patch, nil)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	var got bytes.Buffer
+	require.NoError(t, s.getFile(context.Background(), &got, "retried.txt"))
+	require.True(t, bytes.Equal(contents, got.Bytes()))
+	_, ok := s.catalog.get("retried.txt")
+	require.True(t, ok)
+}
+
+func TestTusOptions(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	setSettings(s, func(r *reloadable) { r.policy = uploadPolicy{MaxSize: 1 << 20} })
+
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/tus", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, tusVersion, w.Header().Get("Tus-Version"))
+	require.Equal(t, tusExtensions, w.Header().Get("Tus-Extension"))
+	require.Equal(t, "1048576", w.Header().Get("Tus-Max-Size"))
+}
@@ -0,0 +1,443 @@
+package filesrv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// uploadSessionExpiry is how long a client has to finish a chunked upload,
+// it's no longer than incompleteUploadMaxAge for the same reason as tusExpiry
+const uploadSessionExpiry = incompleteUploadMaxAge
+
+// uploadSession is a file being uploaded in parts with the session API. The
+// parts are the parts of the minio multipart upload, so they're all the same
+// size apart from the last. Part 1 has to be sent first since the stages
+// before store run on it, and they can change the name the file is stored
+// under and so how it's encrypted. After that the parts can come in any
+// order, in parallel, and be sent again if they fail.
+type uploadSession struct {
+	id      string
+	owner   string
+	expires time.Time
+	parts   int
+
+	// mu is held while the stages before store run on part 1 and while the
+	// upload is being completed
+	mu      sync.Mutex
+	u       *pendingUpload
+	p       pipeline
+	chunked *chunkedUpload
+}
+
+// uploadSessions are the chunked uploads that haven't been completed or
+// expired, they're only kept in memory
+type uploadSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func newUploadSessions() *uploadSessions {
+	return &uploadSessions{sessions: map[string]*uploadSession{}}
+}
+
+// add records a new session, throwing away the ones that have expired
+func (u *uploadSessions) add(s server, session *uploadSession) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	for id, expired := range u.sessions {
+		if now.Before(expired.expires) {
+			continue
+		}
+		delete(u.sessions, id)
+		go s.abortSession(expired)
+	}
+
+	u.sessions[session.id] = session
+}
+
+// get returns the session with the id, sessions belonging to someone else
+// are treated as not existing
+func (u *uploadSessions) get(id, owner string) (*uploadSession, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	session, ok := u.sessions[id]
+	if !ok || session.owner != owner || time.Now().After(session.expires) {
+		return nil, false
+	}
+
+	return session, true
+}
+
+func (u *uploadSessions) remove(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delete(u.sessions, id)
+}
+
+// abortSession throws away the parts stored for a session that won't be
+// completed
+func (s server) abortSession(session *uploadSession) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.chunked == nil {
+		return
+	}
+	err := s.abortChunked(session.chunked)
+	if err != nil {
+		log.Printf("abort upload session: filename: %s, error: %s", session.u.Name, err)
+	}
+	session.chunked = nil
+}
+
+// partLength returns the size part n has to be
+func (session *uploadSession) partLength(partSize int64, n int) int64 {
+	if n < session.parts {
+		return partSize
+	}
+
+	return session.u.Size - int64(session.parts-1)*partSize
+}
+
+// startUploadRequest is the body of a request to start a chunked upload
+type startUploadRequest struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+}
+
+// uploadSessionResponse describes a chunked upload to the client
+type uploadSessionResponse struct {
+	ID string `json:"id"`
+	// Name is the name the file will be stored under
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// PartSize is how big every part but the last has to be
+	PartSize int64 `json:"partSize"`
+	Parts    int   `json:"parts"`
+	// Received are the parts that have been stored
+	Received []int     `json:"received"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (s server) writeUploadSession(w http.ResponseWriter, status int, session *uploadSession) {
+	session.mu.Lock()
+	resp := uploadSessionResponse{
+		ID:       session.id,
+		Name:     session.u.Name,
+		Size:     session.u.Size,
+		PartSize: s.partSize(),
+		Parts:    session.parts,
+		Received: []int{},
+		Expires:  session.expires,
+	}
+	if session.chunked != nil {
+		resp.Received = session.chunked.received()
+	}
+	session.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Println("encode upload session:", err)
+	}
+}
+
+// handlePostUploads starts a chunked upload. The size has to be known up
+// front, it decides how many parts there are. The checks are the same as for
+// a multipart upload, and like tus only pipelines that can run on the start
+// of a file can be used.
+func (s server) handlePostUploads(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req startUploadRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFormOverhead)).Decode(&req)
+	if err == nil && (req.Filename == "" || req.Size < 0) {
+		err = errors.New("filename or size is missing")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("decode upload session:", err)
+		return
+	}
+
+	if failed := s.settings().policy.firstFailure(req.Filename, req.Size, req.ContentType); failed != nil {
+		w.WriteHeader(failed.status)
+		log.Printf("upload rejected: filename: %s, check: %s, reason: %s", req.Filename, failed.Name, failed.Reason)
+		return
+	}
+
+	name, err := s.objectName(r, req.Filename)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("object name:", err)
+		return
+	}
+
+	region, err := s.placement.region(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("placement:", err)
+		return
+	}
+
+	if !s.checkAccess(w, r, name, accessWrite) || !s.checkQuota(w, name, req.Size) {
+		return
+	}
+
+	p, ok := s.pipelineFor(req.ContentType)
+	if !ok {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		log.Printf("upload rejected: filename: %s, reason: no pipeline for %s", req.Filename, req.ContentType)
+		return
+	}
+	if !p.streamable() {
+		w.WriteHeader(http.StatusNotImplemented)
+		log.Printf("upload session: filename: %s, reason: the pipeline for %s needs the whole file", req.Filename, req.ContentType)
+		return
+	}
+
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("random id:", err)
+		return
+	}
+
+	partSize := s.partSize()
+	if parts := (req.Size + partSize - 1) / partSize; parts > maxUploadParts {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		log.Printf("upload session: filename: %s, reason: %d parts is more than %d", req.Filename, parts, maxUploadParts)
+		return
+	}
+	session := &uploadSession{
+		id:      hex.EncodeToString(id),
+		owner:   requestIdentity(r),
+		expires: time.Now().Add(uploadSessionExpiry),
+		parts:   int((req.Size + partSize - 1) / partSize),
+		u: &pendingUpload{
+			Name:         name,
+			OriginalName: req.Filename,
+			ContentType:  req.ContentType,
+			Source:       requestSource(r),
+			Size:         req.Size,
+			Region:       region,
+		},
+		p: p,
+	}
+	s.uploads.add(s, session)
+
+	s.writeUploadSession(w, http.StatusCreated, session)
+}
+
+// handleGetUploadSession returns a chunked upload with the parts that have
+// been stored, so a client can find out what's left to send
+func (s server) handleGetUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, ok := s.uploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.writeUploadSession(w, http.StatusOK, session)
+}
+
+// handlePutUploadPart stores a part of a chunked upload, replacing it if it
+// was sent before
+func (s server) handlePutUploadPart(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, ok := s.uploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	partSize := s.partSize()
+	n, err := strconv.Atoi(ps.ByName("n"))
+	if err == nil && n > maxUploadParts {
+		// minio won't take it, whatever size the upload is
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("upload part: upload: %s, part %d is more than %d", session.id, n, maxUploadParts)
+		return
+	}
+	if err != nil || n < 1 || n > session.parts {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if want := session.partLength(partSize, n); r.ContentLength != want {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("upload part: upload: %s, part: %d, length %d should be %d", session.id, n, r.ContentLength, want)
+		return
+	}
+
+	data := make([]byte, r.ContentLength)
+	_, err = io.ReadFull(r.Body, data)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		log.Printf("upload part: upload: %s, part: %d, read body: %s", session.id, n, err)
+		return
+	}
+
+	chunked, err := s.startSession(r, session, n, data)
+	if err == nil {
+		err = s.putPart(r.Context(), chunked, n, data, n == session.parts)
+	}
+	if err != nil {
+		writeUploadError(w, err, session.u.Name)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errFirstPart is returned for the other parts of a chunked upload before
+// part 1 has been sent
+var errFirstPart = stageError{status: http.StatusConflict, reason: "part 1 has to be sent first"}
+
+// startSession runs the stages before store on part 1 and starts the
+// multipart upload, it returns the multipart upload for the other parts. An
+// upload that's rejected by a stage is thrown away.
+//
+// The stages run again whenever part 1 is sent again, so the part that's
+// stored is always one they've passed. Only what they decided the first time
+// is kept, since the upload has already been started with it.
+func (s server) startSession(r *http.Request, session *uploadSession, n int, data []byte) (*chunkedUpload, error) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	if session.chunked == nil && n != 1 {
+		return nil, errFirstPart
+	}
+	if n != 1 {
+		return session.chunked, nil
+	}
+
+	u := session.u
+	if session.chunked != nil {
+		again := *session.u
+		u = &again
+	}
+	u.Content = bytes.NewReader(data)
+	p, err := s.processBeforeStore(r.Context(), u)
+	u.Content = nil
+	if err != nil {
+		s.uploads.remove(session.id)
+		if session.chunked != nil {
+			if err := s.abortChunked(session.chunked); err != nil {
+				log.Printf("abort upload session: filename: %s, error: %s", session.u.Name, err)
+			}
+			session.chunked = nil
+		}
+		return nil, err
+	}
+	if session.chunked != nil {
+		return session.chunked, nil
+	}
+	session.p = p
+
+	session.chunked, err = s.startChunked(r.Context(), session.u.Name, session.u.Region)
+	return session.chunked, err
+}
+
+// handlePostUploadComplete puts the parts of a chunked upload together into
+// the file and runs the rest of the pipeline. The checksum in the response is
+// worked out by reading the file back, since the parts could have come in
+// any order.
+func (s server) handlePostUploadComplete(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, ok := s.uploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	unlock := s.nameLocks.lock(session.u.Name)
+	defer unlock()
+
+	// An empty file doesn't have any parts
+	if session.parts == 0 {
+		session.u.Content = bytes.NewReader(nil)
+		err := s.process(r.Context(), session.u)
+		if err != nil {
+			writeUploadError(w, err, session.u.Name)
+			return
+		}
+		s.uploads.remove(session.id)
+		s.writeUploadResponse(w, session.u.Stored)
+		return
+	}
+
+	var received []int
+	if session.chunked != nil {
+		received = session.chunked.received()
+	}
+	if len(received) != session.parts {
+		w.WriteHeader(http.StatusConflict)
+		log.Printf("complete upload: upload: %s, only parts %v of %d have been received", session.id, received, session.parts)
+		return
+	}
+
+	stored, err := s.completeSession(r, session)
+	if err != nil {
+		writeUploadError(w, err, session.u.Name)
+		return
+	}
+	s.uploads.remove(session.id)
+	session.chunked = nil
+
+	session.u.setStored(stored)
+	log.Println("uploaded file", stored.Name, "of size", stored.Info.Size)
+	err = s.processFromStore(r.Context(), session.p, session.u)
+	if err != nil {
+		writeUploadError(w, err, session.u.Name)
+		return
+	}
+
+	s.writeUploadResponse(w, session.u.Stored)
+}
+
+// completeSession completes the multipart upload and reads it back for the
+// checksum
+func (s server) completeSession(r *http.Request, session *uploadSession) (storedFile, error) {
+	info, err := s.completeChunked(r.Context(), session.chunked)
+	if err != nil {
+		return storedFile{}, err
+	}
+
+	sum, err := s.checksumChunked(r.Context(), session.chunked)
+	if err != nil {
+		return storedFile{}, fmt.Errorf("checksum: %w", err)
+	}
+
+	return storedFile{Name: session.u.Name, Size: session.u.Size, SHA256: sum, Info: info}, nil
+}
+
+// handleDeleteUploadSession stops a chunked upload and throws away the parts
+func (s server) handleDeleteUploadSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	session, ok := s.uploads.get(ps.ByName("id"), requestIdentity(r))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	s.uploads.remove(session.id)
+	s.abortSession(session)
+	w.WriteHeader(http.StatusNoContent)
+}
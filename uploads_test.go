@@ -0,0 +1,155 @@
+package filesrv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSessions(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	do := func(method, target string, body []byte, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, bytes.NewReader(body))
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	start := func(filename string, size int) uploadSessionResponse {
+		w := do(http.MethodPost, "/uploads", []byte(`{"filename": "`+filename+`", "contentType": "text/plain", "size": `+strconv.Itoa(size)+`}`), "")
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+		var session uploadSessionResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&session))
+		return session
+	}
+	part := func(session uploadSessionResponse, n int, data []byte) int {
+		return do(http.MethodPut, "/uploads/"+session.ID+"/parts/"+strconv.Itoa(n), data, "").Result().StatusCode
+	}
+	complete := func(session uploadSessionResponse) *httptest.ResponseRecorder {
+		return do(http.MethodPost, "/uploads/"+session.ID+"/complete", nil, "")
+	}
+
+	t.Run("parts out of order", func(t *testing.T) {
+		contents := bytes.Repeat([]byte("0123456789abcdef"), (3*minChunkSize+100)/16)
+		session := start("large.txt", len(contents))
+		require.Equal(t, int64(minChunkSize), session.PartSize)
+		require.Equal(t, 4, session.Parts)
+		chunk := func(n int) []byte {
+			return contents[int64(n-1)*session.PartSize : min(int64(n)*session.PartSize, int64(len(contents)))]
+		}
+
+		require.Equal(t, http.StatusConflict, part(session, 2, chunk(2)), "part 1 has to come first")
+		require.Equal(t, http.StatusBadRequest, part(session, 1, chunk(1)[:100]))
+		require.Equal(t, http.StatusNoContent, part(session, 1, chunk(1)))
+
+		var wg sync.WaitGroup
+		for _, n := range []int{4, 2} {
+			wg.Add(1)
+			go func(n int) {
+				defer wg.Done()
+				require.Equal(t, http.StatusNoContent, part(session, n, chunk(n)))
+			}(n)
+		}
+		wg.Wait()
+
+		require.Equal(t, http.StatusConflict, complete(session).Result().StatusCode, "part 3 is missing")
+		w := do(http.MethodGet, "/uploads/"+session.ID, nil, "")
+		var status uploadSessionResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+		require.Equal(t, []int{1, 2, 4}, status.Received)
+
+		require.Equal(t, http.StatusNoContent, part(session, 3, chunk(3)))
+		w = complete(session)
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+
+		var resp uploadResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		sum := sha256.Sum256(contents)
+		require.Equal(t, hex.EncodeToString(sum[:]), resp.SHA256)
+
+		var got bytes.Buffer
+		require.NoError(t, s.getFile(context.Background(), &got, "large.txt"))
+		require.True(t, bytes.Equal(contents, got.Bytes()))
+		require.Empty(t, store.incomplete)
+
+		require.Equal(t, http.StatusNotFound, complete(session).Result().StatusCode, "the session is gone once it's complete")
+	})
+
+	t.Run("one part", func(t *testing.T) {
+		session := start("small.txt", 18)
+		require.Equal(t, 1, session.Parts)
+		require.Equal(t, http.StatusNoContent, part(session, 1, []byte("test file contents")))
+		require.Equal(t, http.StatusCreated, complete(session).Result().StatusCode)
+
+		var got strings.Builder
+		require.NoError(t, s.getFile(context.Background(), &got, "small.txt"))
+		require.Equal(t, "test file contents", got.String())
+	})
+
+	t.Run("part sent again", func(t *testing.T) {
+		session := start("again.txt", 18)
+		require.Equal(t, http.StatusNoContent, part(session, 1, []byte("test file contents")))
+		require.Equal(t, http.StatusNoContent, part(session, 1, []byte("test file contents")), "the same contents can be sent again")
+		require.Equal(t, http.StatusConflict, part(session, 1, []byte("other contents!!!!")), "it can't be encrypted again with the same nonce")
+
+		// The stages before store run on part 1 every time it's sent
+		cfg := defaultConfig()
+		cfg.Rules = []uploadRule{{Name: "no-tests", Match: ruleMatch{Magic: []string{hex.EncodeToString([]byte("test"))}}, Action: ruleReject}}
+		s.reload(cfg)
+		defer s.reload(defaultConfig())
+		require.Equal(t, http.StatusUnprocessableEntity, part(session, 1, []byte("test file contents")))
+		require.Equal(t, http.StatusNotFound, complete(session).Result().StatusCode)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		session := start("empty.txt", 0)
+		require.Equal(t, 0, session.Parts)
+		require.Equal(t, http.StatusCreated, complete(session).Result().StatusCode)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		session := start("gone.txt", 18)
+		require.Equal(t, http.StatusNotFound, do(http.MethodDelete, "/uploads/"+session.ID, nil, "bob").Result().StatusCode, "only the owner can see it")
+		require.Equal(t, http.StatusNotFound, part(session, 2, nil))
+		require.Equal(t, http.StatusBadRequest, part(session, maxUploadParts+1, nil), "minio takes at most 10000 parts")
+		require.Equal(t, http.StatusNoContent, part(session, 1, []byte("test file contents")))
+		require.Len(t, store.incomplete, 1)
+
+		require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/uploads/"+session.ID, nil, "").Result().StatusCode)
+		require.Empty(t, store.incomplete)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/uploads", []byte(`{"size": 10}`), "").Result().StatusCode)
+		require.Equal(t, http.StatusBadRequest, do(http.MethodPost, "/uploads", []byte(`{"filename": ".filesrv-selftest", "size": 10}`), "").Result().StatusCode)
+
+		prev := s.settings()
+		setSettings(s, func(r *reloadable) {
+			r.rules = []uploadRule{{Name: "no-secrets", Match: ruleMatch{Magic: []string{"736563726574"}}, Action: ruleReject}}
+		})
+		defer s.live.Store(prev)
+		session := start("secret.txt", 6)
+		require.Equal(t, http.StatusUnprocessableEntity, part(session, 1, []byte("secret")))
+		require.Equal(t, http.StatusNotFound, complete(session).Result().StatusCode)
+
+		// Even without a size limit, minio takes at most 10000 parts
+		setSettings(s, func(r *reloadable) { r.policy = uploadPolicy{} })
+		tooMany := strconv.FormatInt(s.partSize()*maxUploadParts+1, 10)
+		require.Equal(t, http.StatusRequestEntityTooLarge, do(http.MethodPost, "/uploads", []byte(`{"filename": "huge.bin", "size": `+tooMany+`}`), "").Result().StatusCode)
+	})
+}
@@ -0,0 +1,201 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// usageDayFormat is how days are written in usage records
+	usageDayFormat = "2006-01-02"
+	// usageRetention is how long daily usage is kept for
+	usageRetention = 90 * 24 * time.Hour
+	// usageSaveInterval is how often usage is written to the bucket, usage
+	// since the last save is lost if the server stops
+	usageSaveInterval = time.Minute
+)
+
+// usageRecord is the bandwidth used by one key on one day. Until there are API
+// keys, the key is the identity of the user making the requests.
+type usageRecord struct {
+	Day     string `json:"day"`
+	Key     string `json:"key"`
+	Ingress int64  `json:"ingress"`
+	Egress  int64  `json:"egress"`
+}
+
+type usageKey struct {
+	day string
+	key string
+}
+
+// bandwidthUsage keeps daily totals of bytes in and out per key
+type bandwidthUsage struct {
+	mu    sync.Mutex
+	days  map[usageKey]*usageRecord
+	dirty bool
+}
+
+func newBandwidthUsage() *bandwidthUsage {
+	return &bandwidthUsage{days: map[usageKey]*usageRecord{}}
+}
+
+// add adds to the totals for the key on the day of now
+func (u *bandwidthUsage) add(key string, now time.Time, ingress, egress int64) {
+	if ingress == 0 && egress == 0 {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	k := usageKey{day: now.UTC().Format(usageDayFormat), key: key}
+	rec, ok := u.days[k]
+	if !ok {
+		rec = &usageRecord{Day: k.day, Key: key}
+		u.days[k] = rec
+	}
+	rec.Ingress += ingress
+	rec.Egress += egress
+	u.dirty = true
+}
+
+// records returns the usage between from and to inclusive, for key or for
+// every key if it's empty, sorted by day and then key
+func (u *bandwidthUsage) records(from, to, key string) []usageRecord {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	records := []usageRecord{}
+	for k, rec := range u.days {
+		if (from == "" || k.day >= from) && (to == "" || k.day <= to) && (key == "" || k.key == key) {
+			records = append(records, *rec)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Day != records[j].Day {
+			return records[i].Day < records[j].Day
+		}
+		return records[i].Key < records[j].Key
+	})
+
+	return records
+}
+
+// restore replaces the usage with saved records
+func (u *bandwidthUsage) restore(records []usageRecord) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.days = make(map[usageKey]*usageRecord, len(records))
+	for _, rec := range records {
+		rec := rec
+		u.days[usageKey{day: rec.Day, key: rec.Key}] = &rec
+	}
+	u.dirty = false
+}
+
+// prune forgets usage from before the retention period and reports whether
+// there is anything new to save
+func (u *bandwidthUsage) prune(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	oldest := now.Add(-usageRetention).UTC().Format(usageDayFormat)
+	for k := range u.days {
+		if k.day < oldest {
+			delete(u.days, k)
+			u.dirty = true
+		}
+	}
+
+	dirty := u.dirty
+	u.dirty = false
+	return dirty
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of the response body
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the real ResponseWriter
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withBandwidthAccounting meters the request and response body bytes of every
+// request against the key making it
+func withBandwidthAccounting(next http.Handler, usage *bandwidthUsage) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		cw := &countingResponseWriter{ResponseWriter: w}
+
+		// Handlers abort broken downloads with a panic, which still needs
+		// counting
+		defer func() {
+			usage.add(requestIdentity(r), time.Now(), body.n, cw.n)
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// saveUsageOnce prunes old usage and saves the catalog if the usage or the
+// recent files have changed since the last save, for runEvery
+func (s server) saveUsageOnce(ctx context.Context, now time.Time) {
+	usageChanged := s.catalog.usage.prune(now)
+	recentChanged := s.catalog.users.takeDirty()
+	if !usageChanged && !recentChanged {
+		return
+	}
+
+	err := s.saveCatalog(ctx)
+	if err != nil {
+		log.Println("save usage:", err)
+	}
+}
+
+// handleGetBandwidthUsage returns the daily bandwidth usage, optionally
+// filtered to the days between from and to and to a single key
+func (s server) handleGetBandwidthUsage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, day := range []string{from, to} {
+		if _, err := time.Parse(usageDayFormat, day); day != "" && err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.catalog.usage.records(from, to, query.Get("key")))
+}
@@ -0,0 +1,98 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthAccounting(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	router := s.routes()
+
+	req := newUploadRequest(t, "/upload", "filename", "test file contents")
+	req.Header.Set(identityHeader, "alice")
+	uploadSize := req.ContentLength
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	uploadResponseSize := int64(w.Body.Len())
+
+	req = httptest.NewRequest(http.MethodGet, "/file/filename", nil)
+	req.Header.Set(identityHeader, "bob")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	today := time.Now().UTC().Format(usageDayFormat)
+	tests := []struct {
+		name   string
+		target string
+		want   []usageRecord
+	}{
+		{
+			name:   "everything",
+			target: "/usage/bandwidth",
+			want: []usageRecord{
+				{Day: today, Key: "alice", Ingress: uploadSize, Egress: uploadResponseSize},
+				{Day: today, Key: "bob", Egress: int64(len("test file contents"))},
+			},
+		},
+		{
+			name:   "one key",
+			target: "/usage/bandwidth?key=bob&from=" + today,
+			want: []usageRecord{
+				{Day: today, Key: "bob", Egress: int64(len("test file contents"))},
+			},
+		},
+		{
+			name:   "before today",
+			target: "/usage/bandwidth?to=2000-01-01",
+			want:   []usageRecord{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.target, nil))
+			require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+			var records []usageRecord
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&records))
+			require.Equal(t, test.want, records)
+		})
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/usage/bandwidth?from=yesterday", nil))
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestBandwidthUsagePersistence(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	s.catalog.usage.add("alice", now, 10, 20)
+	s.catalog.usage.add("alice", now.Add(time.Hour), 1, 2)
+	s.catalog.usage.add("alice", now.Add(-100*24*time.Hour), 5, 5)
+	s.saveUsageOnce(context.Background(), now)
+
+	restarted := NewServer(store, "testBucket", "key", 10<<17)
+	require.NoError(t, restarted.loadCatalog(context.Background()))
+
+	// Usage from before the retention period is dropped
+	require.Equal(t, []usageRecord{
+		{Day: "2024-03-01", Key: "alice", Ingress: 11, Egress: 22},
+	}, restarted.catalog.usage.records("", "", ""))
+
+	// Nothing is saved when nothing has changed
+	require.False(t, restarted.catalog.usage.prune(now))
+}
@@ -0,0 +1,254 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxRecentFiles is how many of the files a user last downloaded are
+	// remembered
+	maxRecentFiles = 50
+	// maxStarredFiles is the most files a user can star
+	maxStarredFiles = 1000
+)
+
+// userFiles are one user's starred and recent files, they're the names of
+// the files along with when they were starred or downloaded, newest last
+type userFiles struct {
+	User    string      `json:"user"`
+	Starred []fileVisit `json:"starred,omitempty"`
+	Recent  []fileVisit `json:"recent,omitempty"`
+}
+
+// fileVisit is when a user starred or downloaded a file
+type fileVisit struct {
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+}
+
+// userDirectory holds every user's starred and recent files, it's saved
+// along with the catalog
+type userDirectory struct {
+	mu    sync.Mutex
+	users map[string]*userFiles
+	// dirty is set when files are downloaded, which happens too often to
+	// save the catalog every time, so it's saved along with the usage
+	dirty bool
+}
+
+func newUserDirectory() *userDirectory {
+	return &userDirectory{users: map[string]*userFiles{}}
+}
+
+// get returns the user's files, adding them if there aren't any yet. d.mu
+// must be held.
+func (d *userDirectory) get(user string) *userFiles {
+	u, ok := d.users[user]
+	if !ok {
+		u = &userFiles{User: user}
+		d.users[user] = u
+	}
+	return u
+}
+
+// visit moves the file to the end of visits with the time, and drops the
+// oldest visits past max
+func visit(visits []fileVisit, name string, now time.Time, max int) []fileVisit {
+	visits = slices.DeleteFunc(visits, func(v fileVisit) bool {
+		return v.Name == name
+	})
+	visits = append(visits, fileVisit{Name: name, At: now.UTC()})
+	if len(visits) > max {
+		visits = slices.Delete(visits, 0, len(visits)-max)
+	}
+	return visits
+}
+
+// star adds the file to the user's starred files, it fails if they've
+// starred as many as they can
+func (d *userDirectory) star(user, name string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u := d.get(user)
+	i := slices.IndexFunc(u.Starred, func(v fileVisit) bool {
+		return v.Name == name
+	})
+	switch {
+	case i >= 0:
+		// Starring again doesn't move it
+		return true
+	case len(u.Starred) >= maxStarredFiles:
+		return false
+	}
+	u.Starred = append(u.Starred, fileVisit{Name: name, At: now.UTC()})
+	return true
+}
+
+// unstar removes the file from the user's starred files
+func (d *userDirectory) unstar(user, name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u := d.get(user)
+	u.Starred = slices.DeleteFunc(u.Starred, func(v fileVisit) bool {
+		return v.Name == name
+	})
+}
+
+// accessed records that the user downloaded the file
+func (d *userDirectory) accessed(user, name string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u := d.get(user)
+	u.Recent = visit(u.Recent, name, now, maxRecentFiles)
+	d.dirty = true
+}
+
+// files returns a copy of the user's starred and recent files
+func (d *userDirectory) files(user string) userFiles {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u, ok := d.users[user]
+	if !ok {
+		return userFiles{User: user}
+	}
+	return userFiles{User: user, Starred: slices.Clone(u.Starred), Recent: slices.Clone(u.Recent)}
+}
+
+// list returns everyone's files for saving, sorted by user
+func (d *userDirectory) list() []userFiles {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	users := make([]userFiles, 0, len(d.users))
+	for _, u := range d.users {
+		if len(u.Starred) > 0 || len(u.Recent) > 0 {
+			users = append(users, userFiles{User: u.User, Starred: slices.Clone(u.Starred), Recent: slices.Clone(u.Recent)})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].User < users[j].User })
+
+	return users
+}
+
+// restore replaces everyone's files with saved ones
+func (d *userDirectory) restore(users []userFiles) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.users = make(map[string]*userFiles, len(users))
+	for _, u := range users {
+		u := u
+		d.users[u.User] = &u
+	}
+	d.dirty = false
+}
+
+// takeDirty reports whether files have been downloaded since it was last
+// called
+func (d *userDirectory) takeDirty() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dirty := d.dirty
+	d.dirty = false
+	return dirty
+}
+
+// recordAccess adds the file to the recent files of the user making the
+// request, anonymous users don't have any
+func (s server) recordAccess(r *http.Request, filename string) {
+	if user := requestIdentity(r); user != anonymous {
+		s.catalog.users.accessed(user, filename, time.Now())
+	}
+}
+
+// handlePutStar stars a file for the user making the request
+func (s server) handlePutStar(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.changeStar(w, r, ps.ByName("filename"), true)
+}
+
+// handleDeleteStar unstars a file for the user making the request
+func (s server) handleDeleteStar(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s.changeStar(w, r, ps.ByName("filename"), false)
+}
+
+// changeStar stars or unstars a file and saves the catalog
+func (s server) changeStar(w http.ResponseWriter, r *http.Request, filename string, starred bool) {
+	user := requestIdentity(r)
+	if user == anonymous {
+		w.WriteHeader(http.StatusForbidden)
+		log.Println("star: anonymous users can't star files")
+		return
+	}
+
+	if starred {
+		if _, ok := s.catalog.get(filename); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !s.catalog.users.star(user, filename, time.Now()) {
+			w.WriteHeader(http.StatusConflict)
+			log.Printf("star rejected: user: %s, reason: %d files are starred", user, maxStarredFiles)
+			return
+		}
+	} else {
+		s.catalog.users.unstar(user, filename)
+	}
+
+	err := s.saveCatalog(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("save stars:", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// visitedFile is a file in the user's starred or recent files, with when it
+// was starred or downloaded
+type visitedFile struct {
+	catalogEntry
+	At time.Time `json:"at"`
+}
+
+// visitedFiles returns the files that still exist and the user making the
+// request can still read, newest first
+func (s server) visitedFiles(r *http.Request, visits []fileVisit) []visitedFile {
+	files := []visitedFile{}
+	for i := len(visits) - 1; i >= 0; i-- {
+		e, ok := s.catalog.get(visits[i].Name)
+		if ok && s.allowed(r, e, accessRead) {
+			files = append(files, visitedFile{catalogEntry: e, At: visits[i].At})
+		}
+	}
+	return files
+}
+
+// handleGetStarred lists the files the user making the request has starred,
+// most recently starred first
+func (s server) handleGetStarred(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	files := s.catalog.users.files(requestIdentity(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.visitedFiles(r, files.Starred))
+}
+
+// handleGetRecent lists the files the user making the request last
+// downloaded, most recent first
+func (s server) handleGetRecent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	files := s.catalog.users.files(requestIdentity(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.visitedFiles(r, files.Recent))
+}
@@ -0,0 +1,87 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserFiles(t *testing.T) {
+	store := newMemObjStore()
+	s := NewServer(store, "testBucket", "key", 10<<17)
+	handler := s.routes()
+
+	for _, filename := range []string{"a.txt", "b.txt", "c.txt"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, newUploadRequest(t, "/upload", filename, "test file contents"))
+		require.Equal(t, http.StatusCreated, w.Result().StatusCode)
+	}
+
+	do := func(method, target, user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if user != "" {
+			r.Header.Set(identityHeader, user)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	names := func(target, user string) []string {
+		w := do(http.MethodGet, target, user)
+		require.Equal(t, http.StatusOK, w.Code)
+		var files []visitedFile
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &files))
+		names := []string{}
+		for _, f := range files {
+			require.False(t, f.At.IsZero())
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, "/file/a.txt/star", "alice").Code)
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, "/file/c.txt/star", "alice").Code)
+	require.Equal(t, http.StatusNoContent, do(http.MethodPut, "/file/a.txt/star", "alice").Code)
+	require.Equal(t, http.StatusNotFound, do(http.MethodPut, "/file/missing.txt/star", "alice").Code)
+	require.Equal(t, http.StatusForbidden, do(http.MethodPut, "/file/a.txt/star", "").Code)
+	require.Equal(t, []string{"c.txt", "a.txt"}, names("/me/starred", "alice"))
+	require.Equal(t, []string{}, names("/me/starred", "bob"))
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/file/c.txt/star", "alice").Code)
+	require.Equal(t, []string{"a.txt"}, names("/me/starred", "alice"))
+
+	for _, filename := range []string{"a.txt", "b.txt", "a.txt"} {
+		require.Equal(t, http.StatusOK, do(http.MethodGet, "/file/"+filename, "alice").Code)
+	}
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/file/missing.txt", "alice").Code)
+	require.Equal(t, []string{"a.txt", "b.txt"}, names("/me/recent", "alice"))
+	require.Equal(t, []string{}, names("/me/recent", "bob"))
+
+	// Files that have gone are left out
+	require.Equal(t, http.StatusNoContent, do(http.MethodDelete, "/file/b.txt", "alice").Code)
+	require.Equal(t, []string{"a.txt"}, names("/me/recent", "alice"))
+
+	// Downloads are saved along with the usage
+	s.saveUsageOnce(context.Background(), time.Now())
+	require.False(t, s.catalog.users.takeDirty())
+	restored := NewServer(store, "testBucket", "key", 10<<17)
+	require.NoError(t, restored.loadCatalog(context.Background()))
+	require.Equal(t, s.catalog.users.files("alice"), restored.catalog.users.files("alice"))
+}
+
+func TestRecentFilesLimit(t *testing.T) {
+	d := newUserDirectory()
+	now := time.Now()
+	for i := 0; i < maxRecentFiles+10; i++ {
+		d.accessed("alice", string(rune('a'+i%26))+string(rune('a'+i/26))+".txt", now)
+	}
+
+	recent := d.files("alice").Recent
+	require.Len(t, recent, maxRecentFiles)
+	require.Equal(t, "ka.txt", recent[0].Name, "the oldest are dropped")
+}
@@ -0,0 +1,82 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// These are set at build time with ldflags, for example:
+//
+//	go build -ldflags "-X github.com/sams96/filesrv.version=v1.0.0 -X github.com/sams96/filesrv.commit=$(git rev-parse HEAD) -X github.com/sams96/filesrv.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ) -X github.com/sams96/filesrv.features=selftest,check" ./cmd/filesrv
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+	// features is a comma separated list of the feature flags enabled in
+	// this build
+	features = ""
+)
+
+// versionInfo is the response body for GET /version
+type versionInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"buildDate"`
+	GoVersion string   `json:"goVersion"`
+	Features  []string `json:"features"`
+}
+
+// buildVersionInfo collects the version information, falling back to the vcs
+// information embedded by the go tool when the ldflags weren't set
+func buildVersionInfo() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		Features:  splitList(features),
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.GoVersion = bi.GoVersion
+	for _, setting := range bi.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.BuildDate == "":
+			info.BuildDate = setting.Value
+		}
+	}
+
+	return info
+}
+
+// splitList splits a comma separated list, ignoring any empty items
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// handleGetVersion returns the version and build information of the running
+// binary as JSON
+func handleGetVersion(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(buildVersionInfo())
+	if err != nil {
+		log.Println("encode version:", err)
+	}
+}
@@ -0,0 +1,33 @@
+package filesrv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetVersion(t *testing.T) {
+	defer func(v, c, d, f string) {
+		version, commit, buildDate, features = v, c, d, f
+	}(version, commit, buildDate, features)
+
+	version, commit, buildDate, features = "v1.2.3", "abc123", "2024-01-02T03:04:05Z", "selftest, check,"
+
+	req := httptest.NewRequest(http.MethodGet, "/version", nil)
+	w := httptest.NewRecorder()
+
+	handleGetVersion(w, req, nil)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "application/json", w.Result().Header.Get("Content-Type"))
+
+	var got versionInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	require.Equal(t, "v1.2.3", got.Version)
+	require.Equal(t, "abc123", got.Commit)
+	require.Equal(t, "2024-01-02T03:04:05Z", got.BuildDate)
+	require.Equal(t, []string{"selftest", "check"}, got.Features)
+}
@@ -0,0 +1,116 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// defaultWatchTimeout is how long a watch waits for a change when the
+	// client doesn't say
+	defaultWatchTimeout = 30 * time.Second
+	// maxWatchTimeout stops clients holding connections open forever, it's
+	// kept under the usual proxy idle timeouts
+	maxWatchTimeout = 5 * time.Minute
+)
+
+// parseWatchTimeout reads a timeout given either as a duration like 30s or as
+// a number of seconds
+func parseWatchTimeout(v string) (time.Duration, bool) {
+	if v == "" {
+		return defaultWatchTimeout, true
+	}
+
+	d, ok := parseTimeout(v)
+	if !ok {
+		return 0, false
+	}
+
+	return min(d, maxWatchTimeout), true
+}
+
+// handleGetWatch waits until a file under prefix changes and returns the
+// changes, or returns 204 No Content if nothing changed before the timeout. It
+// waits for changes after the since cursor if there is one, so nothing is
+// missed between watches, and otherwise for changes after the request was
+// made.
+func (s server) handleGetWatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+
+	timeout, ok := parseWatchTimeout(query.Get("timeout"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	since := s.catalog.latestSeq()
+	if v := query.Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// The channel has to be taken before looking for changes, otherwise
+		// a change in between would be missed
+		changed := s.catalog.changedChan()
+
+		changes, ok := s.catalog.changesSince(since, maxCatalogChanges)
+		if !ok {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		var matching []catalogChange
+		for _, c := range changes {
+			if strings.HasPrefix(c.Name, prefix) {
+				matching = append(matching, c)
+			}
+		}
+		resp := changesResponse{Changes: s.visibleChanges(r, matching), Cursor: strconv.FormatUint(since, 10)}
+		if len(changes) > 0 {
+			since = changes[len(changes)-1].Seq
+			resp.Cursor = strconv.FormatUint(since, 10)
+		}
+
+		if len(resp.Changes) > 0 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+
+		select {
+		case <-changed:
+			continue
+		case <-timer.C:
+		case <-s.drainer.draining():
+			// The server is shutting down, so end the poll early rather
+			// than hold up the drain
+		case <-r.Context().Done():
+			if !errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+				// The client has gone away
+				return
+			}
+		}
+
+		// The cursor lets the client skip the changes it wasn't interested
+		// in
+		w.Header().Set("X-Filesrv-Cursor", resp.Cursor)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+}
@@ -0,0 +1,80 @@
+package filesrv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleGetWatch(t *testing.T) {
+	s := NewServer(newMemObjStore(), "testBucket", "key", 10<<17)
+	router := s.routes()
+	ctx := context.Background()
+
+	require.NoError(t, s.index(ctx, storedFile{Name: "tmp/a.txt"}))
+
+	// A cursor from before the first change returns it straight away
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/watch?since=0", nil))
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Without a change before the timeout there is no content
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/watch?timeout=10ms", nil))
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	require.Equal(t, "1", w.Result().Header.Get("X-Filesrv-Cursor"))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/watch?prefix=tmp/&timeout=10", nil))
+		done <- w
+	}()
+
+	// Changes outside of the prefix don't end the watch
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, s.index(ctx, storedFile{Name: "b.txt"}))
+	require.NoError(t, s.index(ctx, storedFile{Name: "tmp/c.txt"}))
+
+	select {
+	case w := <-done:
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+		var resp changesResponse
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp.Changes, 1)
+		require.Equal(t, "tmp/c.txt", resp.Changes[0].Name)
+		require.Equal(t, "3", resp.Cursor)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch didn't return after a change")
+	}
+}
+
+func TestParseWatchTimeout(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", want: defaultWatchTimeout, wantOK: true},
+		{value: "15s", want: 15 * time.Second, wantOK: true},
+		{value: "20", want: 20 * time.Second, wantOK: true},
+		{value: "1h", want: maxWatchTimeout, wantOK: true},
+		{value: "0", wantOK: false},
+		{value: "-1s", wantOK: false},
+		{value: "soon", wantOK: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, ok := parseWatchTimeout(test.value)
+			require.Equal(t, test.wantOK, ok)
+			require.Equal(t, test.want, got)
+		})
+	}
+}